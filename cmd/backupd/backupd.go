@@ -12,47 +12,121 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Binary backupd provides tarballs of /perm.
+// Binary backupd provides tarballs of /perm, exports and imports the router7
+// configuration files, and periodically verifies that backups are intact.
 package main
 
 import (
-	"net"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
-	"github.com/gokrazy/gokrazy"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/auth"
 	"github.com/rtr7/router7/internal/backup"
+	"github.com/rtr7/router7/internal/healthz"
 	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
 	"github.com/rtr7/router7/internal/teelogger"
 )
 
 var log = teelogger.NewConsole()
 
-var httpListeners = multilisten.NewPool()
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "backupd", "8077")
+)
 
 func updateListeners() error {
-	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	addrs, err := management.Addrs()
 	if err != nil {
 		return err
 	}
 
-	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8077")}
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		// backup.tar.gz is streamed as it is being generated, which can take
+		// longer than the default write timeout for large /perm partitions.
+		srv.WriteTimeout = 0
+		return srv
 	})
 	return nil
 }
 
 func logic() error {
+	v := &verifier{
+		url:     *verifyURL,
+		restore: *verifyRestore,
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
 	http.HandleFunc("/backup.tar.gz", func(w http.ResponseWriter, r *http.Request) {
 		if err := backup.Archive(w, "/perm"); err != nil {
 			log.Printf("backup.tar.gz: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
+	// config.tar.gz contains only configuration files. With ?redact=1,
+	// secrets are redacted so that the configuration can be shared, e.g. in
+	// bug reports.
+	http.HandleFunc("/config.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		redact := r.FormValue("redact") == "1"
+		if err := backup.ExportConfig(w, "/perm", redact); err != nil {
+			log.Printf("config.tar.gz: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	audit := auditlog.New("/perm", "backupd")
+	// Import a config.tar.gz, e.g.:
+	// curl -u gokrazy --data-binary @config.tar.gz http://router7:8077/import
+	http.Handle("/import", auth.RequirePassword("backupd", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		names, err := backup.ImportConfig(r.Body, "/perm")
+		if err != nil {
+			log.Printf("import: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("imported configuration files: %s", strings.Join(names, ", "))
+		if err := audit.Record(r, "import-config", nil, names); err != nil {
+			log.Printf("audit log: %v", err)
+		}
+		// Daemons which do not reload their configuration on SIGUSR1 (or
+		// periodically) pick up changes when restarted.
+		for _, daemon := range []string{"netconfigd", "dhcp4d", "dnsd"} {
+			if err := notify.Process("/user/"+daemon, syscall.SIGUSR1); err != nil {
+				log.Printf("notifying %s: %v", daemon, err)
+			}
+		}
+		fmt.Fprintf(w, "imported %s\n", strings.Join(names, ", "))
+	})))
+	// The most recent verification result, or verify now, e.g.:
+	// curl -X POST http://router7:8077/verify
+	http.Handle("/verify", v)
+	if *verifyInterval > 0 {
+		go v.schedule(*verifyInterval)
+	}
 	updateListeners()
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGUSR1)
 	for range ch {
@@ -64,7 +138,8 @@ func logic() error {
 }
 
 func main() {
-	if err := logic(); err != nil {
+	flag.Parse()
+	if err := supervise.Run("backupd", logic); err != nil {
 		log.Fatal(err)
 	}
 }
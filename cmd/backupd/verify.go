@@ -0,0 +1,212 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/backup"
+)
+
+var (
+	verifyInterval = flag.Duration("verify_interval",
+		24*time.Hour,
+		"how often to verify that a backup archive is complete and intact (0 disables scheduled verification)")
+
+	verifyURL = flag.String("verify_url",
+		"",
+		"URL of the backup archive to verify, e.g. the most recent copy on a NAS (with an optional sha256sum checksum file at the same URL plus .sha256). If empty, a freshly generated archive of /perm is verified")
+
+	verifyRestore = flag.Bool("verify_restore",
+		false,
+		"restore the archive into a temporary directory when verifying (dry run), which requires space for a copy of /perm in $TMPDIR")
+)
+
+var (
+	verifySuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "backup",
+		Name:      "verify_success",
+		Help:      "Whether the most recent backup verification succeeded (1) or failed (0)",
+	})
+
+	verifyTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "backup",
+		Name:      "verify_timestamp_seconds",
+		Help:      "When the most recent backup verification finished, in seconds since the epoch",
+	})
+
+	verifyBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "backup",
+		Name:      "verify_bytes",
+		Help:      "Uncompressed size of the files in the most recently verified backup archive",
+	})
+)
+
+// verification is the result of a backup verification, as served by /verify.
+type verification struct {
+	Time     time.Time            `json:"time"`
+	Duration time.Duration        `json:"duration"`
+	Source   string               `json:"source"` // URL or /perm
+	Result   *backup.VerifyResult `json:"result,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+type verifier struct {
+	url     string // empty for a freshly generated archive of /perm
+	restore bool
+
+	runMu sync.Mutex // serializes verifications
+
+	mu   sync.Mutex
+	last *verification
+}
+
+// open returns the archive to verify, and its expected SHA-256 hash if a
+// checksum file is available.
+func (v *verifier) open() (io.ReadCloser, string, error) {
+	if v.url == "" {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(backup.Archive(pw, "/perm"))
+		}()
+		return pr, "", nil
+	}
+	var sum string
+	resp, err := http.Get(v.url + ".sha256")
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	switch {
+	case err != nil:
+		return nil, "", err
+	case resp.StatusCode == http.StatusOK:
+		if sum, err = backup.ParseChecksum(b); err != nil {
+			return nil, "", fmt.Errorf("%s.sha256: %v", v.url, err)
+		}
+	case resp.StatusCode != http.StatusNotFound:
+		return nil, "", fmt.Errorf("%s.sha256: unexpected HTTP status: %v", v.url, resp.Status)
+	}
+	resp, err = http.Get(v.url)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("%s: unexpected HTTP status: %v", v.url, resp.Status)
+	}
+	return resp.Body, sum, nil
+}
+
+func (v *verifier) verify() (*backup.VerifyResult, error) {
+	rc, sum, err := v.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var restoreDir string
+	if v.restore {
+		restoreDir, err = ioutil.TempDir("", "backupd-verify")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(restoreDir)
+	}
+	res, err := backup.Verify(rc, restoreDir)
+	if err != nil {
+		return nil, err
+	}
+	if sum != "" && res.SHA256 != sum {
+		return nil, fmt.Errorf("archive SHA-256 %s does not match checksum file (%s)", res.SHA256, sum)
+	}
+	return res, nil
+}
+
+// run verifies the backup archive and records the result.
+func (v *verifier) run() *verification {
+	v.runMu.Lock()
+	defer v.runMu.Unlock()
+	source := v.url
+	if source == "" {
+		source = "/perm"
+	}
+	start := time.Now()
+	res, err := v.verify()
+	vf := &verification{
+		Time:     time.Now(),
+		Duration: time.Since(start),
+		Source:   source,
+		Result:   res,
+	}
+	verifyTimestamp.Set(float64(vf.Time.Unix()))
+	if err != nil {
+		vf.Error = err.Error()
+		verifySuccess.Set(0)
+		log.Printf("verifying backup of %s failed: %v", source, err)
+	} else {
+		verifySuccess.Set(1)
+		verifyBytes.Set(float64(res.Bytes))
+		log.Printf("verified backup of %s: %d files, %d bytes, sha256 %s (restored: %v)", source, res.Files, res.Bytes, res.SHA256, res.Restored)
+	}
+	v.mu.Lock()
+	v.last = vf
+	v.mu.Unlock()
+	return vf
+}
+
+// ServeHTTP returns the most recent verification result, or verifies the
+// backup archive now on POST requests.
+func (v *verifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var vf *verification
+	if r.Method == http.MethodPost {
+		vf = v.run()
+	} else {
+		v.mu.Lock()
+		vf = v.last
+		v.mu.Unlock()
+	}
+	if vf == nil {
+		http.Error(w, "no verification yet, trigger one with a POST request", http.StatusNotFound)
+		return
+	}
+	b, err := json.MarshalIndent(vf, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (v *verifier) schedule(interval time.Duration) {
+	// Give the other daemons a chance to start before reading /perm.
+	time.Sleep(1 * time.Minute)
+	for {
+		v.run()
+		time.Sleep(interval)
+	}
+}
@@ -12,8 +12,10 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Binary captured streams network packets to wireshark via SSH, replaying
-// buffered packets upon connection for retroactive debugging.
+// Binary captured streams network packets to wireshark via SSH or WebSocket,
+// replaying buffered packets upon connection for retroactive debugging. The
+// router7-extcap helper (see contrib/router7-extcap) makes the router’s
+// interfaces available as capture interfaces in Wireshark.
 package main
 
 import (
@@ -22,27 +24,50 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/lowpower"
 	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
 
-	"github.com/gokrazy/gokrazy"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
-
-	_ "net/http/pprof"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	hostKeyPath = flag.String("host_key",
 		"/perm/breakglass.host_key",
 		"path to a PEM-encoded RSA, DSA or ECDSA private key (create using e.g. ssh-keygen -f /perm/breakglass.host_key -N '' -t rsa)")
+
+	httpPort = flag.String("http_port",
+		"8088",
+		"port on which to stream packets over WebSocket (/capture, protected by the gokrazy password) and serve metrics, on the same addresses as the SSH listener")
 )
 
+// paused is 1 while the low-power mode is active: packets are not read, so
+// that they are dropped by the kernel instead of being decoded and buffered.
+var paused int32
+
+func updatePaused() {
+	var p int32
+	if lowpower.Active("/perm") {
+		p = 1
+	}
+	if atomic.SwapInt32(&paused, p) != p {
+		log.Printf("low-power mode: capturing paused: %v", p == 1)
+	}
+}
+
 func capturePackets(ctx context.Context) (chan gopacket.Packet, error) {
 	packets := make(chan gopacket.Packet)
 	for _, ifname := range []string{"uplink0", "lan0"} {
@@ -59,6 +84,14 @@ func capturePackets(ctx context.Context) (chan gopacket.Packet, error) {
 		go func() {
 			defer handle.Close()
 			for {
+				if atomic.LoadInt32(&paused) == 1 {
+					select {
+					case <-time.After(1 * time.Second):
+						continue
+					case <-ctx.Done():
+						return
+					}
+				}
 				packet, err := pkgsrc.NextPacket()
 				if err != nil {
 					log.Printf("NextPacket: %v", err)
@@ -103,16 +136,32 @@ func (prb *packetRingBuffer) packetsLocked() []gopacket.Packet {
 	return packets
 }
 
-var sshListeners = multilisten.NewPool()
+var (
+	sshListeners  = multilisten.NewPool()
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "captured", "5022")
+)
 
 func updateListeners(srv *server) error {
-	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	addrs, err := management.Addrs()
 	if err != nil {
 		return err
 	}
 
-	sshListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return srv.listenerFor(host)
+	sshListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return srv.listenerFor(addr)
+	})
+
+	httpAddrs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		httpAddrs = append(httpAddrs, net.JoinHostPort(host, *httpPort))
+	}
+	httpListeners.ListenAndServe(httpAddrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
 	})
 	return nil
 }
@@ -123,10 +172,21 @@ func logic() error {
 	if err != nil {
 		return err
 	}
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	http.Handle("/capture", auth.RequirePassword("captured", captureHandler(prb)))
 	if err := updateListeners(srv); err != nil {
 		return err
 	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(srv); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
 
+	updatePaused()
 	go func() {
 		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGUSR1)
@@ -134,6 +194,7 @@ func logic() error {
 			if err := updateListeners(srv); err != nil {
 				log.Printf("updateListeners: %v", err)
 			}
+			updatePaused()
 		}
 	}()
 
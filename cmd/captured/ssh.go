@@ -20,9 +20,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"strings"
 
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -74,37 +73,21 @@ func (s *session) request(req *ssh.Request, prb *packetRingBuffer) (err error) {
 			}
 		}()
 
-		ctx, canc := context.WithCancel(context.Background())
-		defer canc()
-
-		pcapw := pcapgo.NewWriter(s.channel)
-		if err := pcapw.WriteFileHeader(1600, layers.LinkTypeEthernet); err != nil {
-			return fmt.Errorf("pcapw.WriteFileHeader: %v", err)
+		// The command selects stream options, see streamOptions. Commands
+		// without options (e.g. “captured”) stream all packets, as commands
+		// were ignored before options existed.
+		command := string(req.Payload[4:])
+		if !strings.Contains(command, "=") {
+			command = ""
 		}
-
-		prb.Lock()
-		packets, err := capturePackets(ctx)
-		buffered := prb.packetsLocked()
-		prb.Unlock()
+		opts, err := parseStreamOptions(command)
 		if err != nil {
-			return fmt.Errorf("capturePackets: %v", err)
-		}
-
-		req.Reply(true, nil)
-
-		for _, packet := range buffered {
-			if err := pcapw.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
-				return fmt.Errorf("pcap.WritePacket(): %v", err)
-			}
-		}
-
-		for packet := range packets {
-			if err := pcapw.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
-				return fmt.Errorf("pcap.WritePacket(): %v", err)
-			}
+			return err
 		}
 
-		return nil
+		return stream(context.Background(), s.channel, prb, opts, func() {
+			req.Reply(true, nil)
+		})
 
 	default:
 		return fmt.Errorf("unknown request type: %q", req.Type)
@@ -146,18 +129,18 @@ func newServer(prb *packetRingBuffer) (*server, error) {
 	}, nil
 }
 
-func (s *server) listenerFor(host string) *serverListener {
-	return &serverListener{srv: s, host: host}
+func (s *server) listenerFor(addr string) *serverListener {
+	return &serverListener{srv: s, addr: addr}
 }
 
 type serverListener struct {
 	srv  *server
-	host string
+	addr string
 	ln   net.Listener
 }
 
 func (sl *serverListener) ListenAndServe() error {
-	ln, err := net.Listen("tcp", net.JoinHostPort(sl.host, "5022"))
+	ln, err := net.Listen("tcp", sl.addr)
 	if err != nil {
 		return err
 	}
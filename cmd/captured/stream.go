@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// defaultSnaplen is the snapshot length of streams which do not specify one.
+const defaultSnaplen = 1600
+
+// streamOptions select the packets which are streamed to a client. They are
+// specified as URL query parameters, either in the WebSocket URL or as SSH
+// command, e.g.:
+//
+//	ssh -p 5022 router7 'interface=lan0&snaplen=256' | wireshark -k -i -
+//
+// The filter parameter contains classic BPF instructions as printed by
+// tcpdump -ddd (without the instruction count), separated by commas, e.g.
+// “40 0 0 12,21 0 1 34525,6 0 0 262144,6 0 0 0” for ip6. The
+// router7-extcap Wireshark helper compiles capture filters into this format.
+type streamOptions struct {
+	ifindex int     // 0 means all interfaces
+	snaplen int     // bytes of each packet to stream
+	filter  *bpf.VM // nil means all packets
+}
+
+func parseFilter(s string) (*bpf.VM, error) {
+	var raw []bpf.RawInstruction
+	for _, ins := range strings.Split(s, ",") {
+		fields := strings.Fields(ins)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed instruction %q: want 4 fields (code jt jf k)", ins)
+		}
+		var vals [4]uint64
+		for i, bits := range []int{16, 8, 8, 32} {
+			v, err := strconv.ParseUint(fields[i], 0, bits)
+			if err != nil {
+				return nil, fmt.Errorf("malformed instruction %q: %v", ins, err)
+			}
+			vals[i] = v
+		}
+		raw = append(raw, bpf.RawInstruction{
+			Op: uint16(vals[0]),
+			Jt: uint8(vals[1]),
+			Jf: uint8(vals[2]),
+			K:  uint32(vals[3]),
+		})
+	}
+	instructions, ok := bpf.Disassemble(raw)
+	if !ok {
+		return nil, fmt.Errorf("filter contains unsupported instructions")
+	}
+	return bpf.NewVM(instructions)
+}
+
+func parseStreamOptions(query string) (*streamOptions, error) {
+	v, err := url.ParseQuery(strings.TrimSpace(query))
+	if err != nil {
+		return nil, err
+	}
+	opts := &streamOptions{snaplen: defaultSnaplen}
+	for key := range v {
+		switch key {
+		case "interface", "snaplen", "filter":
+		default:
+			return nil, fmt.Errorf("unknown option %q (want interface, snaplen or filter)", key)
+		}
+	}
+	if ifname := v.Get("interface"); ifname != "" {
+		ifc, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return nil, err
+		}
+		opts.ifindex = ifc.Index
+	}
+	if s := v.Get("snaplen"); s != "" {
+		snaplen, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("snaplen: %v", err)
+		}
+		if snaplen <= 0 || snaplen > defaultSnaplen {
+			return nil, fmt.Errorf("snaplen %d out of range [1, %d]", snaplen, defaultSnaplen)
+		}
+		opts.snaplen = snaplen
+	}
+	if s := v.Get("filter"); s != "" {
+		if opts.filter, err = parseFilter(s); err != nil {
+			return nil, fmt.Errorf("filter: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// apply returns the capture info and data of p to stream, or false if p should
+// not be streamed.
+func (o *streamOptions) apply(p gopacket.Packet) (gopacket.CaptureInfo, []byte, bool) {
+	ci := p.Metadata().CaptureInfo
+	data := p.Data()
+	if o.ifindex != 0 && ci.InterfaceIndex != o.ifindex {
+		return ci, nil, false
+	}
+	snaplen := o.snaplen
+	if o.filter != nil {
+		n, err := o.filter.Run(data)
+		if err != nil || n == 0 {
+			return ci, nil, false
+		}
+		if n < snaplen {
+			snaplen = n
+		}
+	}
+	if len(data) > snaplen {
+		data = data[:snaplen]
+	}
+	ci.CaptureLength = len(data)
+	return ci, data, true
+}
+
+// stream writes the buffered packets followed by newly captured packets which
+// match opts to w in pcap format, until writing to w fails or ctx is done.
+// started is called once capturing started, before any packets are written.
+func stream(ctx context.Context, w io.Writer, prb *packetRingBuffer, opts *streamOptions, started func()) error {
+	ctx, canc := context.WithCancel(ctx)
+	defer canc()
+
+	bw := bufio.NewWriter(w)
+	pcapw := pcapgo.NewWriter(bw)
+	if err := pcapw.WriteFileHeader(uint32(opts.snaplen), layers.LinkTypeEthernet); err != nil {
+		return fmt.Errorf("pcapw.WriteFileHeader: %v", err)
+	}
+
+	prb.Lock()
+	packets, err := capturePackets(ctx)
+	buffered := prb.packetsLocked()
+	prb.Unlock()
+	if err != nil {
+		return fmt.Errorf("capturePackets: %v", err)
+	}
+
+	started()
+
+	write := func(packet gopacket.Packet) error {
+		ci, data, ok := opts.apply(packet)
+		if !ok {
+			return nil
+		}
+		if err := pcapw.WritePacket(ci, data); err != nil {
+			return fmt.Errorf("pcap.WritePacket(): %v", err)
+		}
+		return nil
+	}
+
+	for _, packet := range buffered {
+		if err := write(packet); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case packet := <-packets:
+			if err := write(packet); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
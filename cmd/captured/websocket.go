@@ -0,0 +1,59 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// captureHandler streams packets in pcap format as binary WebSocket messages,
+// selected by the URL query parameters (see streamOptions).
+func captureHandler(prb *packetRingBuffer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseStreamOptions(r.URL.RawQuery)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		srv := websocket.Server{
+			// Clients are authenticated via HTTP basic authentication, and
+			// non-browser clients (e.g. router7-extcap) do not send an
+			// Origin header, so accept requests from any origin.
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				ws.PayloadType = websocket.BinaryFrame
+				log.Printf("streaming to %s (%s)", r.RemoteAddr, r.URL.RawQuery)
+				ctx, canc := context.WithCancel(r.Context())
+				defer canc()
+				go func() {
+					// Clients do not send any messages: stop streaming once
+					// the connection is closed, even if no packets match.
+					io.Copy(ioutil.Discard, ws)
+					canc()
+				}()
+				if err := stream(ctx, ws, prb, opts, func() {}); err != nil {
+					log.Printf("streaming to %s done: %v", r.RemoteAddr, err)
+				}
+			},
+		}
+		srv.ServeHTTP(w, r)
+	})
+}
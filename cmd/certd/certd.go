@@ -0,0 +1,279 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary certd obtains and renews a certificate for router7’s public hostname
+// (configured in /perm/certd.json) via ACME. The certificate is stored in
+// /perm/certd, from where the management listeners of all router7 daemons
+// load it for HTTPS, picking up renewals without restarting.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rtr7/router7/internal/certd"
+	"github.com/rtr7/router7/internal/dyndns"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var (
+	perm = flag.String("perm",
+		"/perm",
+		"path to replace /perm")
+
+	interval = flag.Duration("interval",
+		12*time.Hour,
+		"how often to check whether the certificate needs to be renewed")
+
+	propagationDelay = flag.Duration("propagation_delay",
+		30*time.Second,
+		"how long to wait for challenge records to reach all authoritative name servers")
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	expiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "certd",
+		Name:      "expiry_timestamp_seconds",
+		Help:      "Expiry of the current certificate as a UNIX timestamp",
+	})
+	renewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "certd",
+		Name:      "renewals_total",
+		Help:      "Attempts to obtain a certificate, by result",
+	}, []string{"result"})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "certd", "8086")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// accountKey loads the ACME account key, creating it if necessary.
+func accountKey(dir string) (*ecdsa.PrivateKey, error) {
+	fn := filepath.Join(dir, "account.key")
+	b, err := ioutil.ReadFile(fn)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", fn)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := renameio.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type manager struct {
+	dir string // e.g. /perm/certd
+
+	mu     sync.Mutex
+	expiry time.Time
+}
+
+func (m *manager) healthy() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.expiry.IsZero() {
+		return fmt.Errorf("no certificate obtained yet")
+	}
+	if left := time.Until(m.expiry); left < 7*24*time.Hour {
+		return fmt.Errorf("certificate expires in %v", left.Round(time.Hour))
+	}
+	return nil
+}
+
+func (m *manager) setExpiry(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expiry = t
+	expiry.Set(float64(t.Unix()))
+}
+
+// renew obtains a new certificate if the current one (if any) is about to
+// expire.
+func (m *manager) renew(cfg *certd.Config) error {
+	certFile := filepath.Join(m.dir, "cert.pem")
+	current, err := ioutil.ReadFile(certFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if t, err := certd.Expiry(current); err == nil {
+		m.setExpiry(t)
+	}
+	if !cfg.NeedsRenewal(current, time.Now()) {
+		return nil
+	}
+
+	dyn, err := dyndns.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	if !dyn.Enabled {
+		return fmt.Errorf("DNS-01 challenges require dyndns to be enabled in dyndns.json")
+	}
+	key, err := accountKey(m.dir)
+	if err != nil {
+		return err
+	}
+	issuer := &certd.Issuer{
+		Client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.Directory,
+		},
+		SetTXT:           dyn.SetTXT,
+		PropagationDelay: *propagationDelay,
+	}
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer canc()
+	if err := issuer.Register(ctx, cfg.Email); err != nil {
+		return fmt.Errorf("registering ACME account: %v", err)
+	}
+	certPEM, keyPEM, err := issuer.Obtain(ctx, cfg.Hostname)
+	if err != nil {
+		renewals.With(prometheus.Labels{"result": "error"}).Inc()
+		return err
+	}
+	renewals.With(prometheus.Labels{"result": "success"}).Inc()
+	// Write the key first: listeners reload once cert.pem changes.
+	if err := renameio.WriteFile(filepath.Join(m.dir, "key.pem"), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	t, err := certd.Expiry(certPEM)
+	if err != nil {
+		return err
+	}
+	m.setExpiry(t)
+	log.Printf("obtained certificate for %s, valid until %v", cfg.Hostname, t)
+	return nil
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	cfg, err := certd.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("certd not enabled in /perm/certd.json, idling")
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}
+
+	m := &manager{dir: filepath.Join(*perm, "certd")}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	healthz.Register("certificate", m.healthy)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := m.renew(cfg); err != nil {
+			log.Printf("renewing certificate: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ch:
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			updated, err := certd.ReadConfig(*perm)
+			if err != nil {
+				log.Printf("reading certd.json: %v", err)
+				continue
+			}
+			cfg = updated
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("certd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
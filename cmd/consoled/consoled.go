@@ -0,0 +1,371 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary consoled serves a restricted interactive console (show leases, show
+// wan, flush dns, tail logs) via SSH, authenticating users with the public
+// keys in /perm/authorized_keys. It is useful when the HTTP interfaces are
+// unreachable.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/console"
+	"github.com/rtr7/router7/internal/gokrazyctl"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var (
+	hostKeyPath = flag.String("host_key",
+		"/perm/breakglass.host_key",
+		"path to a PEM-encoded RSA, DSA or ECDSA private key (create using e.g. ssh-keygen -f /perm/breakglass.host_key -N '' -t rsa)")
+
+	authorizedKeysPath = flag.String("authorized_keys",
+		"/perm/authorized_keys",
+		"path to an OpenSSH authorized_keys file, re-read for each login")
+)
+
+var log = teelogger.NewConsole()
+
+func flushDNS() error {
+	pw, err := auth.Password()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://"+multilisten.Resolve("dnsd", "localhost:8053")+"/flush", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(auth.User, pw)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status: got %v (%s), want %v", resp.Status, strings.TrimSpace(string(b)), want)
+	}
+	return nil
+}
+
+func tailLog(ctx context.Context, w io.Writer, daemon string) error {
+	// teelogger writes to stderr.
+	return gokrazyctl.Log(ctx, w, "/user/"+daemon, "stderr")
+}
+
+// authorized returns whether key is listed in the authorized_keys file.
+func authorized(key ssh.PublicKey) (bool, error) {
+	b, err := ioutil.ReadFile(*authorizedKeysPath)
+	if err != nil {
+		return false, err
+	}
+	marshaled := key.Marshal()
+	for len(b) > 0 {
+		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break // no more keys
+		}
+		if bytes.Equal(pubKey.Marshal(), marshaled) {
+			return true, nil
+		}
+		b = rest
+	}
+	return false, nil
+}
+
+type server struct {
+	config  *ssh.ServerConfig
+	console *console.Console
+}
+
+func newServer() (*server, error) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			ok, err := authorized(pubKey)
+			if err != nil {
+				log.Printf("reading authorized keys: %v", err)
+			}
+			if !ok {
+				return nil, fmt.Errorf("public key of %s not authorized", conn.RemoteAddr())
+			}
+			return nil, nil
+		},
+	}
+
+	b, err := ioutil.ReadFile(*hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+
+	return &server{
+		config: config,
+		console: &console.Console{
+			Dir:      "/perm",
+			FlushDNS: flushDNS,
+			TailLog:  tailLog,
+		},
+	}, nil
+}
+
+// interruptReader passes data from the SSH channel to the terminal, except
+// for ^C while a command is running, which cancels the command instead.
+type interruptReader struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc // non-nil while a command is running
+}
+
+func (ir *interruptReader) run(ch ssh.Channel, w *io.PipeWriter) {
+	buf := make([]byte, 256)
+	for {
+		n, err := ch.Read(buf)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		ir.mu.Lock()
+		cancel := ir.cancel
+		ir.mu.Unlock()
+		if cancel != nil {
+			if bytes.IndexByte(buf[:n], 3) > -1 {
+				cancel()
+			}
+			continue // discard input while commands are running
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (ir *interruptReader) exec(c *console.Console, w io.Writer, line string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ir.mu.Lock()
+	ir.cancel = cancel
+	ir.mu.Unlock()
+	defer func() {
+		ir.mu.Lock()
+		ir.cancel = nil
+		ir.mu.Unlock()
+	}()
+	return c.Exec(ctx, w, line)
+}
+
+// shell runs an interactive console session on ch.
+func (s *server) shell(ch ssh.Channel, term *terminal.Terminal, ir *interruptReader) {
+	defer ch.Close()
+	fmt.Fprintf(term, "router7 console, type “help” for a list of commands\n")
+	for {
+		line, err := term.ReadLine()
+		if err != nil {
+			return // connection closed or ^D
+		}
+		if err := ir.exec(s.console, term, line); err != nil {
+			if err == console.ErrExit {
+				return
+			}
+			fmt.Fprintf(term, "%v\n", err)
+		}
+	}
+}
+
+func sendExitStatus(ch ssh.Channel, status uint32) {
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+func (s *server) handleChannel(newChannel ssh.NewChannel) {
+	if t := newChannel.ChannelType(); t != "session" {
+		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %q", t))
+		return
+	}
+	ch, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Printf("could not accept channel: %v", err)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	ir := &interruptReader{}
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{pr, ch}, "router7> ")
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			// string TERM, uint32 width, uint32 height, …
+			if len(req.Payload) >= 4 {
+				termLen := binary.BigEndian.Uint32(req.Payload)
+				if rest := req.Payload[4:]; uint32(len(rest)) >= termLen+8 {
+					rest = rest[termLen:]
+					term.SetSize(int(binary.BigEndian.Uint32(rest)), int(binary.BigEndian.Uint32(rest[4:])))
+				}
+			}
+			req.Reply(true, nil)
+
+		case "window-change":
+			// uint32 width, uint32 height, …
+			if len(req.Payload) >= 8 {
+				term.SetSize(int(binary.BigEndian.Uint32(req.Payload)), int(binary.BigEndian.Uint32(req.Payload[4:])))
+			}
+			req.Reply(false, nil)
+
+		case "shell":
+			req.Reply(true, nil)
+			go ir.run(ch, pw)
+			go s.shell(ch, term, ir)
+
+		case "exec":
+			// string command
+			if len(req.Payload) < 4 {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			line := string(req.Payload[4:])
+			go ir.run(ch, pw)
+			go func() {
+				defer ch.Close()
+				status := uint32(0)
+				if err := ir.exec(s.console, ch, line); err != nil && err != console.ErrExit {
+					fmt.Fprintf(ch.Stderr(), "%v\n", err)
+					status = 1
+				}
+				sendExitStatus(ch, status)
+			}()
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *server) listenerFor(addr string) *serverListener {
+	return &serverListener{srv: s, addr: addr}
+}
+
+type serverListener struct {
+	srv  *server
+	addr string
+	ln   net.Listener
+}
+
+func (sl *serverListener) ListenAndServe() error {
+	ln, err := net.Listen("tcp", sl.addr)
+	if err != nil {
+		return err
+	}
+	sl.ln = ln
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func(conn net.Conn) {
+			sshConn, chans, reqs, err := ssh.NewServerConn(conn, sl.srv.config)
+			if err != nil {
+				log.Printf("handshake: %v", err)
+				return
+			}
+			log.Printf("console session for %s from %s", sshConn.User(), sshConn.RemoteAddr())
+
+			// discard all out of band requests
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				go sl.srv.handleChannel(newChannel)
+			}
+		}(conn)
+	}
+}
+
+func (sl *serverListener) Close() error {
+	return sl.ln.Close()
+}
+
+var (
+	sshListeners = multilisten.NewPool()
+	management   = multilisten.NewManagement(flag.CommandLine, "consoled", "5023")
+)
+
+func updateListeners(srv *server) error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	sshListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return srv.listenerFor(addr)
+	})
+	return nil
+}
+
+func logic() error {
+	srv, err := newServer()
+	if err != nil {
+		return err
+	}
+	if err := updateListeners(srv); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(srv); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(srv); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -121,6 +121,9 @@ func logic() error {
 		if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
 			log.Printf("notifying netconfig: %v", err)
 		}
+		if err := notify.Process("/user/telemetryd", syscall.SIGUSR1); err != nil {
+			log.Printf("notifying telemetryd: %v", err)
+		}
 		select {
 		case <-time.After(time.Until(c.Config().RenewAfter)):
 			// fallthrough and renew the DHCP lease
@@ -13,10 +13,12 @@
 // limitations under the License.
 
 // Binary dhcp6 obtains a DHCPv6 lease, persists it to
-// /perm/dhcp6/wire/lease.json and notifies netconfigd.
+// /perm/dhcp6/wire/lease.json and notifies netconfigd. When the delegated
+// prefixes change, the hooks configured in /perm/dhcp6/hooks.json are run.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
@@ -34,6 +36,33 @@ import (
 
 var log = teelogger.NewConsole()
 
+// readLease returns the lease persisted at path, or an empty lease.
+func readLease(path string) dhcp6.Config {
+	var cfg dhcp6.Config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		log.Printf("%s: %v", path, err)
+	}
+	return cfg
+}
+
+// runHooks runs the hooks configured in /perm/dhcp6/hooks.json for ch.
+func runHooks(ch *dhcp6.PrefixChange) {
+	hooks, err := dhcp6.ReadHooks("/perm")
+	if err != nil {
+		log.Printf("reading hooks: %v", err)
+		return
+	}
+	ctx, canc := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer canc()
+	if err := hooks.Run(ctx, ch); err != nil {
+		log.Printf("running hooks: %v", err)
+	}
+}
+
 func logic() error {
 	const leasePath = "/perm/dhcp6/wire/lease.json"
 	if err := os.MkdirAll(filepath.Dir(leasePath), 0755); err != nil {
@@ -45,13 +74,17 @@ func logic() error {
 		log.Printf("could not read /perm/dhcp6/duid (%v), proceeding with DUID-LLT", err)
 	}
 
+	const iface = "uplink0"
 	c, err := dhcp6.NewClient(dhcp6.ClientConfig{
-		InterfaceName: "uplink0",
+		InterfaceName: iface,
 		DUID:          duid,
 	})
 	if err != nil {
 		return err
 	}
+	// The previous lease survives restarts, so that hooks only run when the
+	// prefixes actually change.
+	prev := readLease(leasePath)
 	usr2 := make(chan os.Signal, 1)
 	signal.Notify(usr2, syscall.SIGUSR2)
 	for c.ObtainOrRenew() {
@@ -74,6 +107,15 @@ func logic() error {
 		if err := notify.Process("/user/radvd", syscall.SIGUSR1); err != nil {
 			log.Printf("notifying radvd: %v", err)
 		}
+		if err := notify.Process("/user/dhcp6d", syscall.SIGUSR1); err != nil {
+			log.Printf("notifying dhcp6d: %v", err)
+		}
+		if ch := dhcp6.NewPrefixChange(iface, prev, c.Config(), time.Now()); ch != nil {
+			log.Printf("prefixes changed from %v to %v, running hooks", ch.OldPrefixes, ch.NewPrefixes)
+			// Hooks must not delay renewals.
+			go runHooks(ch)
+		}
+		prev = c.Config()
 		select {
 		case <-time.After(time.Until(c.Config().RenewAfter)):
 			// fallthrough and renew the DHCP lease
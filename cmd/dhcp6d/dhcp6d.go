@@ -0,0 +1,332 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary dhcp6d sub-delegates parts of the IPv6 prefix obtained by dhcp6 to
+// downstream routers (DHCPv6 prefix delegation) and routes the delegated
+// prefixes to them.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/dhcp6d"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/statefile"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var iface = flag.String("interface", "lan0", "ethernet interface to listen for DHCPv6 requests on")
+
+var log = teelogger.NewConsole()
+
+var delegatedPrefixes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "delegated_prefixes",
+	Help: "Number of non-expired prefixes delegated to downstream routers",
+})
+
+const leasesPath = "/perm/dhcp6d/leases.json"
+
+var (
+	leasesMu sync.Mutex
+	leases   []*dhcp6d.Lease
+)
+
+func loadLeases(h *dhcp6d.Handler) error {
+	b, err := ioutil.ReadFile(leasesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var loaded []*dhcp6d.Lease
+	if err := statefile.Leases6.Unmarshal(b, &loaded); err != nil {
+		return err
+	}
+	h.SetLeases(loaded)
+	leasesMu.Lock()
+	leases = loaded
+	leasesMu.Unlock()
+	return nil
+}
+
+func persistLeases(newLeases []*dhcp6d.Lease) error {
+	leasesMu.Lock()
+	leases = newLeases
+	leasesMu.Unlock()
+	b, err := statefile.Leases6.Marshal(newLeases)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(leasesPath, b, 0644)
+}
+
+// syncRoutes installs a route for each non-expired lease towards the
+// downstream router and removes routes of expired or released leases.
+// Routes installed by dhcp6d are identified by protocol RTPROT_DHCP.
+func syncRoutes(link netlink.Link) error {
+	installed, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Protocol:  unix.RTPROT_DHCP,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool)
+	now := time.Now()
+	leasesMu.Lock()
+	current := leases
+	leasesMu.Unlock()
+	nonExpired := 0
+	for _, l := range current {
+		if l.Expired(now) {
+			continue
+		}
+		nonExpired++
+		_, dst, err := net.ParseCIDR(l.Prefix)
+		if err != nil {
+			return err
+		}
+		want[dst.String()] = true
+		if err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Gw:        l.NextHop,
+			Protocol:  unix.RTPROT_DHCP,
+		}); err != nil {
+			return fmt.Errorf("RouteReplace(%v via %v): %v", dst, l.NextHop, err)
+		}
+	}
+	delegatedPrefixes.Set(float64(nonExpired))
+	for _, r := range installed {
+		if r.Dst == nil || want[r.Dst.String()] {
+			continue
+		}
+		r := r // copy
+		if err := netlink.RouteDel(&r); err != nil {
+			return fmt.Errorf("RouteDel(%v): %v", r.Dst, err)
+		}
+	}
+	return nil
+}
+
+// readPrefix applies the first prefix of the DHCPv6 lease obtained by dhcp6.
+func readPrefix(h *dhcp6d.Handler) error {
+	b, err := ioutil.ReadFile("/perm/dhcp6/wire/lease.json")
+	if err != nil {
+		return err
+	}
+	var cfg dhcp6.Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return err
+	}
+	if len(cfg.Prefixes) == 0 {
+		return fmt.Errorf("no prefix delegated to the router")
+	}
+	return h.SetPrefix(cfg.Prefixes[0])
+}
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "dhcp6d", "8069")
+)
+
+func updateListeners() error {
+	var extra []string
+	if net1, err := multilisten.IPv6Net1("/perm"); err == nil {
+		extra = append(extra, net1)
+	}
+	addrs, err := management.Addrs(extra...)
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		leasesMu.Lock()
+		b, err := json.MarshalIndent(leases, "", "  ")
+		leasesMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	cfg, err := dhcp6d.ReadConfig("/perm")
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("prefix delegation not enabled in /perm/dhcp6d.json, idling")
+		select {}
+	}
+
+	if err := os.MkdirAll("/perm/dhcp6d", 0755); err != nil {
+		return err
+	}
+	ifc, err := net.InterfaceByName(*iface)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(*iface)
+	if err != nil {
+		return err
+	}
+	// DUID-LL (RFC 8415, section 11.4) of the LAN interface.
+	serverID := append([]byte{0x00, 0x03, 0x00, 0x01}, ifc.HardwareAddr...)
+	handler, err := dhcp6d.NewHandler(serverID, cfg)
+	if err != nil {
+		return fmt.Errorf("dhcp6d.json: %v", err)
+	}
+	if err := loadLeases(handler); err != nil {
+		return err
+	}
+	if err := readPrefix(handler); err != nil {
+		log.Printf("cannot delegate prefixes: %v", err)
+	}
+	leasesMu.Lock()
+	leases = handler.CurrentLeases() // without leases outside of the prefix
+	leasesMu.Unlock()
+	if err := syncRoutes(link); err != nil {
+		log.Printf("syncRoutes: %v", err)
+	}
+
+	var syncMu sync.Mutex
+	resync := func() {
+		syncMu.Lock()
+		defer syncMu.Unlock()
+		if err := syncRoutes(link); err != nil {
+			log.Printf("syncRoutes: %v", err)
+		}
+	}
+	handler.Leases = func(newLeases []*dhcp6d.Lease) {
+		if err := persistLeases(newLeases); err != nil {
+			log.Printf("persisting leases: %v", err)
+		}
+		go resync()
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			if err := readPrefix(handler); err != nil {
+				log.Printf("cannot delegate prefixes: %v", err)
+			}
+			// Leases outside of a new prefix were discarded.
+			if err := persistLeases(handler.CurrentLeases()); err != nil {
+				log.Printf("persisting leases: %v", err)
+			}
+			resync()
+		}
+	}()
+	go func() {
+		// Remove routes of expired leases.
+		for range time.Tick(1 * time.Minute) {
+			resync()
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp6", net.JoinHostPort("::", "547"))
+	if err != nil {
+		return err
+	}
+	pc := ipv6.NewPacketConn(conn)
+	allServers := &net.UDPAddr{IP: net.ParseIP("ff02::1:2")} // All_DHCP_Relay_Agents_and_Servers
+	if err := pc.JoinGroup(ifc, allServers); err != nil {
+		return err
+	}
+	if err := pc.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, cm, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if cm == nil || cm.IfIndex != ifc.Index {
+			continue // not received on the LAN interface
+		}
+		peer, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		reply, err := handler.ServeDHCPv6(buf[:n], peer.IP)
+		if err != nil {
+			log.Printf("%v: %v", peer, err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err := pc.WriteTo(reply, &ipv6.ControlMessage{IfIndex: ifc.Index}, peer); err != nil {
+			log.Printf("WriteTo(%v): %v", peer, err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("dhcp6d", logic); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary dyndns publishes AAAA records for the LAN hosts configured in
+// /perm/dyndns.json, so that e.g. a home server’s public AAAA record follows
+// changes of the delegated IPv6 prefix.
+package main
+
+import (
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/daemons/dyndns"
+)
+
+func main() {
+	daemon.Main(dyndns.Daemon)
+}
@@ -0,0 +1,227 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary fwlogd receives packets logged by the firewall rules which netconfigd
+// installs, aggregates them into structured events and serves them on a web
+// page and as metrics by rule.
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/fwlog"
+	"github.com/rtr7/router7/internal/geoip"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+var geoipDB = flag.String("geoip_db",
+	"/perm/geoip/GeoLite2-Country.mmdb",
+	"path to a MaxMind DB country database for tagging events by country (optional)")
+
+var log = teelogger.NewConsole()
+
+var (
+	loggedPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "fwlog",
+			Name:      "packets_total",
+			Help:      "Packets logged by the firewall",
+		},
+		[]string{"rule"})
+
+	suppressedPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "fwlog",
+			Name:      "suppressed_total",
+			Help:      "Logged packets which were not recorded due to rate limiting",
+		},
+		[]string{"rule"})
+
+	countryPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "fwlog",
+			Name:      "country_packets_total",
+			Help:      "Logged packets with an internet peer, by country of the peer",
+		},
+		[]string{"rule", "country"})
+)
+
+//go:embed events.html.tmpl
+var eventsHTML string
+
+var eventsTmpl = webui.Must(webui.Parse("fwlogd", eventsHTML, nil))
+
+func eventsTable(aggs []fwlog.Aggregate) *webui.Table {
+	t := &webui.Table{
+		Columns: []string{"rule", "interface", "protocol", "source", "destination", "country", "count", "first", "last"},
+		Empty:   "no_events",
+	}
+	for _, a := range aggs {
+		dst := a.Dst
+		if a.DstPort != 0 {
+			dst += ":" + strconv.Itoa(int(a.DstPort))
+		}
+		t.Append(
+			webui.Text(a.Rule),
+			webui.Text(a.InIface),
+			webui.Text(a.Proto),
+			webui.Addr(a.Src),
+			webui.Addr(dst),
+			webui.Text(a.Country),
+			webui.Text(a.Count),
+			webui.Text(a.First.Format("2006-01-02 15:04:05")),
+			webui.Text(a.Time.Format("2006-01-02 15:04:05")))
+	}
+	return t
+}
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "fwlogd", "8075")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+func ifname(index uint32) string {
+	ifc, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		return strconv.Itoa(int(index))
+	}
+	return ifc.Name
+}
+
+func logic() error {
+	// GeoIP support is optional: a nil *geoip.DB knows no countries.
+	var db *geoip.DB
+	if _, err := os.Stat(*geoipDB); err == nil {
+		db, err = geoip.Open(*geoipDB)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	agg := fwlog.NewAggregator()
+	alerter := alert.NewAlerter("/perm")
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := eventsTmpl.Execute(w, r, eventsTable(agg.Aggregates())); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	http.HandleFunc("/events.json", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(agg.Aggregates(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			if err := alerter.Reload(); err != nil {
+				log.Printf("reloading alert config: %v", err)
+			}
+		}
+	}()
+
+	conn, err := fwlog.Listen(fwlog.Group)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		packets, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		for _, p := range packets {
+			ev := fwlog.Decode(p, ifname)
+			labels := prometheus.Labels{"rule": ev.Rule}
+			loggedPackets.With(labels).Inc()
+			if remote := ev.Remote(); remote != nil {
+				ev.Country = db.Country(remote)
+				countryPackets.With(prometheus.Labels{
+					"rule":    ev.Rule,
+					"country": ev.Country,
+				}).Inc()
+			}
+			if !agg.Add(ev) {
+				suppressedPackets.With(labels).Inc()
+				continue
+			}
+			if ev.Rule == "rogue" {
+				// The device was identified as a rogue router or DHCP
+				// server by rogued and is still sending traffic.
+				alerter.Alert("fwlog-rogue-"+ev.Src, "traffic from blocked rogue device",
+					fmt.Sprintf("The firewall dropped traffic from a blocked rogue device:\n\n%s %s → %s on %s\n", ev.Proto, ev.Src, ev.Dst, ev.InIface))
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("fwlogd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
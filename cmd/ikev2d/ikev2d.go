@@ -0,0 +1,231 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary ikev2d runs an IKEv2 VPN for the built-in VPN clients of iOS, macOS
+// and Windows if enabled in /perm/ikev2.json: it generates the strongSwan
+// configuration and supervises strongSwan’s charon, which programs the
+// negotiated security associations into the kernel.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/ikev2"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var perm = flag.String("perm",
+	"/perm",
+	"path to replace /perm")
+
+var log = teelogger.NewConsole()
+
+var (
+	charonRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ikev2",
+		Name:      "charon_running",
+		Help:      "Whether strongSwan’s charon is running",
+	})
+	charonRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "ikev2",
+		Name:      "charon_restarts_total",
+		Help:      "Restarts of strongSwan’s charon after it exited",
+	})
+	loads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ikev2",
+		Name:      "config_loads_total",
+		Help:      "Configuration loads via swanctl, by result",
+	}, []string{"result"})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "ikev2d", "8083")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// writeConfig generates swanctl.conf and strongswan.conf in dir.
+func writeConfig(cfg *ikev2.Config, dir string) error {
+	lan, err := netconfig.LinkAddress(*perm, "lan0")
+	if err != nil {
+		log.Printf("not assigning dnsd as DNS server: %v", err)
+	}
+	swanctl, err := cfg.SwanctlConf(lan)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// swanctl.conf contains the user passwords.
+	if err := renameio.WriteFile(filepath.Join(dir, "swanctl.conf"), swanctl, 0600); err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(dir, "strongswan.conf"), ikev2.StrongswanConf(), 0644)
+}
+
+// load (re-)loads the configuration into charon, which might still be
+// starting up.
+func load(cfg *ikev2.Config, dir string) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		swanctl := exec.Command(cfg.Swanctl,
+			"--load-all",
+			"--uri", ikev2.ViciSocket,
+			"--file", filepath.Join(dir, "swanctl.conf"))
+		var out []byte
+		out, err = swanctl.CombinedOutput()
+		if err == nil {
+			loads.With(prometheus.Labels{"result": "success"}).Inc()
+			return nil
+		}
+		err = fmt.Errorf("%v: %v: %s", swanctl.Args, err, strings.TrimSpace(string(out)))
+		time.Sleep(1 * time.Second)
+	}
+	loads.With(prometheus.Labels{"result": "failure"}).Inc()
+	return err
+}
+
+// runCharon runs charon, restarting it whenever it exits.
+func runCharon(cfg *ikev2.Config, dir string) {
+	for {
+		charon := exec.Command(cfg.Charon)
+		charon.Env = append(os.Environ(), "STRONGSWAN_CONF="+filepath.Join(dir, "strongswan.conf"))
+		charon.Stdout = os.Stdout
+		charon.Stderr = os.Stderr
+		if err := charon.Start(); err != nil {
+			log.Printf("starting charon: %v", err)
+		} else {
+			charonRunning.Set(1)
+			go func() {
+				if err := load(cfg, dir); err != nil {
+					log.Printf("loading configuration: %v", err)
+				}
+			}()
+			log.Printf("charon exited: %v", charon.Wait())
+			charonRunning.Set(0)
+		}
+		charonRestarts.Inc()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	cfg, err := ikev2.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("IKEv2 VPN not enabled in /perm/ikev2.json, idling")
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}
+	dir := filepath.Join(*perm, "ikev2", "generated")
+	if err := writeConfig(cfg, dir); err != nil {
+		return err
+	}
+	healthz.Register("charon", func() error {
+		if _, err := os.Stat(strings.TrimPrefix(ikev2.ViciSocket, "unix://")); err != nil {
+			return fmt.Errorf("charon not running: %v", err)
+		}
+		return nil
+	})
+	go runCharon(cfg, dir)
+
+	// On SIGUSR1, reload the configuration (e.g. new users) without
+	// interrupting established tunnels. Enabling or disabling the VPN
+	// requires a restart.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		updated, err := ikev2.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("reading ikev2.json: %v", err)
+			continue
+		}
+		if !updated.Enabled {
+			log.Printf("IKEv2 VPN disabled, restart ikev2d to stop charon")
+			continue
+		}
+		if err := writeConfig(updated, dir); err != nil {
+			log.Printf("writing configuration: %v", err)
+			continue
+		}
+		if err := load(updated, dir); err != nil {
+			log.Printf("loading configuration: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("ikev2d", logic); err != nil {
+		log.Fatal(err)
+	}
+}
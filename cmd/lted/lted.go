@@ -0,0 +1,393 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary lted brings up a USB LTE modem (QMI or MBIM) as backup uplink if
+// enabled in /perm/lte.json: it establishes the data connection, exports the
+// signal quality as metrics and makes netconfigd route traffic via LTE while
+// uplink0 is down.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/lte"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var perm = flag.String("perm",
+	"/perm",
+	"path to replace /perm")
+
+var log = teelogger.NewConsole()
+
+var (
+	connected = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "lte",
+		Name:      "connected",
+		Help:      "Whether the LTE data connection is established",
+	})
+	active = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "lte",
+		Name:      "active",
+		Help:      "Whether traffic is routed via LTE because uplink0 is down",
+	})
+	failovers = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "lte",
+		Name:      "failovers_total",
+		Help:      "Failovers from uplink0 to LTE",
+	})
+	signalRSSI = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "lte",
+		Name:      "signal_rssi_dbm",
+		Help:      "Received signal strength indicator",
+	})
+	signalRSRQ = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "lte",
+		Name:      "signal_rsrq_db",
+		Help:      "LTE reference signal received quality (QMI modems only)",
+	})
+	signalRSRP = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "lte",
+		Name:      "signal_rsrp_dbm",
+		Help:      "LTE reference signal received power (QMI modems only)",
+	})
+	signalSNR = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "lte",
+		Name:      "signal_snr_db",
+		Help:      "LTE signal-to-noise ratio (QMI modems only)",
+	})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "lted", "8087")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// run runs the command line tool of the modem with args.
+func run(cfg *lte.Config, args []string) (string, error) {
+	out, err := exec.Command(cfg.Binary(), args...).CombinedOutput()
+	if err != nil {
+		// Do not log the arguments, which might contain the PIN or password.
+		return "", fmt.Errorf("%s: %v: %s", filepath.Base(cfg.Binary()), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// modem establishes and monitors the data connection and decides whether
+// traffic is routed via LTE.
+type modem struct {
+	cfg *lte.Config
+
+	mu     sync.Mutex
+	conn   lte.Connection
+	lease  *lte.Lease // nil while not connected
+	active bool
+}
+
+// connect unlocks the SIM card, starts the data connection and publishes its
+// IP settings.
+func (m *modem) connect() error {
+	cfg := m.cfg
+	if args := cfg.UnlockArgs(); args != nil {
+		if _, err := run(cfg, args); err != nil {
+			// The SIM card might already be unlocked, e.g. after a restart
+			// of lted.
+			log.Printf("unlocking SIM card: %v", err)
+		}
+	}
+	if cfg.Protocol == lte.ProtocolQMI {
+		// Current QMI modems only support raw IP (no ethernet headers),
+		// which can only be switched while the interface is down.
+		fn := filepath.Join("/sys/class/net", cfg.Interface, "qmi", "raw_ip")
+		if err := ioutil.WriteFile(fn, []byte("Y"), 0644); err != nil {
+			log.Printf("enabling raw IP: %v", err)
+		}
+	}
+	out, err := run(cfg, cfg.ConnectArgs())
+	if err != nil {
+		return err
+	}
+	var conn lte.Connection
+	if cfg.Protocol == lte.ProtocolQMI {
+		if conn, err = lte.ParseConnection(out); err != nil {
+			return err
+		}
+	}
+	out, err = run(cfg, cfg.SettingsArgs())
+	if err != nil {
+		return err
+	}
+	lease, err := cfg.ParseSettings(out)
+	if err != nil {
+		return err
+	}
+	lease.Interface = cfg.Interface
+	log.Printf("connected: %s via %s", lease.Addr, lease.Gateway)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conn = conn
+	m.lease = lease
+	return m.publish()
+}
+
+// disconnect stops the data connection (if any), e.g. when it stopped
+// working.
+func (m *modem) disconnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lease == nil {
+		return
+	}
+	if _, err := run(m.cfg, m.cfg.DisconnectArgs(m.conn)); err != nil {
+		log.Printf("disconnecting: %v", err)
+	}
+	m.lease = nil
+	if err := m.publish(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// publish writes the lease and makes netconfigd apply it. m.mu must be held.
+func (m *modem) publish() error {
+	var lease *lte.Lease
+	if m.lease != nil {
+		l := *m.lease
+		l.Active = m.active
+		lease = &l
+	}
+	if err := lte.WriteLease(*perm, lease); err != nil {
+		return err
+	}
+	if m.lease != nil {
+		connected.Set(1)
+	} else {
+		connected.Set(0)
+	}
+	if m.active {
+		active.Set(1)
+	} else {
+		active.Set(0)
+	}
+	if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+		log.Printf("notifying netconfigd: %v", err)
+	}
+	return nil
+}
+
+// setActive routes traffic via LTE (or uplink0 again).
+func (m *modem) setActive(a bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == a {
+		return
+	}
+	m.active = a
+	if a {
+		failovers.Inc()
+		log.Printf("uplink0 down, routing traffic via LTE")
+	} else {
+		log.Printf("uplink0 up again, routing traffic via uplink0")
+	}
+	if err := m.publish(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// monitor queries the signal quality and verifies that the connection still
+// has its IP settings, reconnecting otherwise.
+func (m *modem) monitor() {
+	for {
+		m.mu.Lock()
+		up := m.lease != nil
+		m.mu.Unlock()
+		if !up {
+			if err := m.connect(); err != nil {
+				log.Printf("connecting: %v", err)
+				time.Sleep(30 * time.Second)
+				continue
+			}
+		}
+		if out, err := run(m.cfg, m.cfg.SignalArgs()); err != nil {
+			log.Printf("querying signal: %v", err)
+		} else if s, err := m.cfg.ParseSignal(out); err != nil {
+			log.Printf("querying signal: %v", err)
+		} else {
+			signalRSSI.Set(s.RSSI)
+			signalRSRQ.Set(s.RSRQ)
+			signalRSRP.Set(s.RSRP)
+			signalSNR.Set(s.SNR)
+		}
+		if out, err := run(m.cfg, m.cfg.SettingsArgs()); err != nil {
+			log.Printf("connection lost: %v", err)
+			m.disconnect()
+		} else if _, err := m.cfg.ParseSettings(out); err != nil {
+			log.Printf("connection lost: %v", err)
+			m.disconnect()
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// probe returns whether addr accepts TCP connections via uplink0, regardless
+// of the routing table (which routes traffic via LTE during a failover).
+func probe(addr string) error {
+	d := net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.BindToDevice(int(fd), "uplink0")
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := d.Dial("tcp4", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// failover probes uplink0 and routes traffic via LTE once the probe failed
+// for FailoverAfter, and via uplink0 again once it succeeded for
+// FailbackAfter.
+func (m *modem) failover() {
+	failoverAfter, _ := m.cfg.FailoverAfterDuration() // validated in ReadConfig
+	failbackAfter, _ := m.cfg.FailbackAfterDuration()
+	var since time.Time // of the current probe result
+	var lastErr error
+	for {
+		err := probe(m.cfg.Probe)
+		if (err == nil) != (lastErr == nil) || since.IsZero() {
+			since = time.Now()
+		}
+		lastErr = err
+		switch {
+		case err != nil && time.Since(since) >= failoverAfter:
+			m.setActive(true)
+		case err == nil && time.Since(since) >= failbackAfter:
+			m.setActive(false)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+
+	cfg, err := lte.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("LTE not enabled in /perm/lte.json, idling")
+		if err := lte.WriteLease(*perm, nil); err != nil {
+			return err
+		}
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}
+	if _, err := os.Stat(cfg.Binary()); err != nil {
+		return err
+	}
+
+	m := &modem{cfg: cfg}
+	// A lease of a previous lted process is stale: the connection needs to
+	// be established again.
+	if err := lte.WriteLease(*perm, nil); err != nil {
+		return err
+	}
+	healthz.Register("lte", func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.lease == nil {
+			return errors.New("LTE data connection not established")
+		}
+		return nil
+	})
+	go m.monitor()
+	go m.failover()
+
+	// Changing lte.json requires a restart.
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("lted", logic); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary maintd reboots the router or restarts individual daemons within the
+// maintenance windows configured in /perm/maintenance.json, postponing (and
+// eventually skipping) tasks while the uplink carries significant traffic.
+//
+// Example /perm/maintenance.json:
+//
+//	{
+//	  "max_uplink_bytes_per_second": 125000,
+//	  "tasks": [
+//	    {"action": "reboot", "weekdays": ["sun"], "start": "04:00", "duration": "1h"},
+//	    {"action": "restart", "path": "/user/dnsd", "start": "03:00", "duration": "30m"}
+//	  ]
+//	}
+//
+// maintd also switches the low-power mode (see package lowpower) when the
+// power source reported via its /power API or read from the GPIO configured in
+// /perm/lowpower.json changes.
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/gokrazyctl"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/maintenance"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var (
+	uplink = flag.String("uplink",
+		"uplink0",
+		"network interface whose traffic is checked before performing tasks")
+
+	sampleInterval = flag.Duration("sample_interval",
+		10*time.Second,
+		"interval over which uplink traffic is measured")
+
+	retryInterval = flag.Duration("retry_interval",
+		time.Minute,
+		"how long to wait before re-checking uplink traffic when a task was postponed")
+)
+
+var log = teelogger.NewConsole()
+
+var nextScheduled = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "maintenance",
+		Name:      "next_scheduled_timestamp_seconds",
+		Help:      "Start of the next maintenance window, in seconds since the epoch",
+	},
+	[]string{"task"})
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "maintd", "8079")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// uplinkBusy returns whether the uplink traffic exceeds the configured
+// threshold, measured over *sampleInterval.
+func uplinkBusy(ctx context.Context, cfg *maintenance.Config) (bool, error) {
+	if cfg.MaxUplinkBytesPerSecond == 0 {
+		return false, nil
+	}
+	before, err := maintenance.UplinkBytes(*uplink)
+	if err != nil {
+		return false, err
+	}
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(*sampleInterval):
+	}
+	after, err := maintenance.UplinkBytes(*uplink)
+	if err != nil {
+		return false, err
+	}
+	rate := float64(after-before) / sampleInterval.Seconds()
+	if rate > float64(cfg.MaxUplinkBytesPerSecond) {
+		log.Printf("uplink traffic of %.0f bytes/s exceeds %d bytes/s", rate, cfg.MaxUplinkBytesPerSecond)
+		return true, nil
+	}
+	return false, nil
+}
+
+func perform(t *maintenance.Task) error {
+	switch t.Action {
+	case "reboot":
+		return gokrazyctl.Reboot()
+	case "restart":
+		return gokrazyctl.Restart(t.Path)
+	}
+	return nil // unreached: LoadConfig validates actions
+}
+
+var (
+	lastRunsMu sync.Mutex
+	lastRuns   maintenance.LastRuns
+)
+
+// ran returns whether task t was already performed in the window starting at
+// start.
+func ran(t *maintenance.Task, start time.Time) bool {
+	lastRunsMu.Lock()
+	defer lastRunsMu.Unlock()
+	return lastRuns.Ran(t, start)
+}
+
+// recordRun records performing task t now. This must happen before performing
+// it: a reboot task does not return.
+func recordRun(t *maintenance.Task) error {
+	lastRunsMu.Lock()
+	defer lastRunsMu.Unlock()
+	lastRuns[t.String()] = time.Now()
+	return maintenance.WriteLastRuns("/perm", lastRuns)
+}
+
+// schedule performs task t in each of its windows until ctx is canceled.
+func schedule(ctx context.Context, cfg *maintenance.Config, t *maintenance.Task) {
+	s := &maintenance.Scheduler{
+		Task:          t,
+		RetryInterval: *retryInterval,
+		Busy: func(ctx context.Context) (bool, error) {
+			return uplinkBusy(ctx, cfg)
+		},
+		Ran: func(start time.Time) bool {
+			return ran(t, start)
+		},
+		Perform: func() error {
+			if err := recordRun(t); err != nil {
+				log.Printf("%v: recording run: %v", t, err)
+			}
+			return perform(t)
+		},
+		Scheduled: func(start, end time.Time) {
+			nextScheduled.With(prometheus.Labels{"task": t.String()}).Set(float64(start.Unix()))
+		},
+	}
+	s.Run(ctx)
+}
+
+// scheduler runs the tasks of the most recently loaded configuration.
+type scheduler struct {
+	canc context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+func (s *scheduler) reload() error {
+	cfg, err := maintenance.LoadConfig("/perm")
+	if err != nil {
+		if os.IsNotExist(err) {
+			cfg = &maintenance.Config{}
+		} else {
+			return err
+		}
+	}
+	if s.canc != nil {
+		s.canc()
+		s.wg.Wait()
+	}
+	nextScheduled.Reset()
+	ctx, canc := context.WithCancel(context.Background())
+	s.canc = canc
+	for _, t := range cfg.Tasks {
+		t := t // copy
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			schedule(ctx, cfg, t)
+		}()
+	}
+	log.Printf("scheduled %d maintenance tasks", len(cfg.Tasks))
+	return nil
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	pwr, err := newPower()
+	if err != nil {
+		return err
+	}
+	http.Handle("/power", auth.RequirePassword("maintd", pwr))
+	go pwr.pollGPIO()
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	lr, err := maintenance.ReadLastRuns("/perm")
+	if err != nil {
+		log.Printf("reading last runs: %v", err)
+		lr = make(maintenance.LastRuns)
+	}
+	lastRuns = lr
+	var s scheduler
+	if err := s.reload(); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		if err := s.reload(); err != nil {
+			log.Printf("reloading configuration: %v", err)
+		}
+		if err := pwr.reload(); err != nil {
+			log.Printf("reloading low-power configuration: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if err := supervise.Run("maintd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
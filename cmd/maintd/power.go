@@ -0,0 +1,211 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/gokrazyctl"
+	"github.com/rtr7/router7/internal/lowpower"
+	"github.com/rtr7/router7/internal/notify"
+)
+
+var onBatteryGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Subsystem: "lowpower",
+	Name:      "on_battery",
+	Help:      "Whether the router runs on battery, i.e. in low-power mode",
+})
+
+// power enters and leaves the low-power mode when the power source changes,
+// as reported via the /power API or read from the configured GPIO.
+type power struct {
+	audit *auditlog.Log
+
+	mu    sync.Mutex
+	cfg   *lowpower.Config
+	state lowpower.State
+}
+
+func newPower() (*power, error) {
+	cfg, err := lowpower.ReadConfig("/perm")
+	if err != nil {
+		return nil, err
+	}
+	state, err := lowpower.ReadState("/perm")
+	if err != nil {
+		return nil, err
+	}
+	p := &power{
+		audit: auditlog.New("/perm", "maintd"),
+		cfg:   cfg,
+		state: state,
+	}
+	if state.OnBattery {
+		// maintd was restarted on battery (possibly by a reboot):
+		// non-essential daemons were started again.
+		log.Printf("power: on battery since %v (%s)", state.Since, state.Source)
+		p.applyLocked()
+	}
+	onBatteryGauge.Set(boolFloat(state.OnBattery))
+	return p, nil
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *power) reload() error {
+	cfg, err := lowpower.ReadConfig("/perm")
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg = cfg
+	return nil
+}
+
+// set records the power source reported by source, entering or leaving the
+// low-power mode if it changed. It returns the previous state.
+func (p *power) set(onBattery bool, source string) (lowpower.State, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	before := p.state
+	if before.OnBattery == onBattery {
+		return before, nil
+	}
+	state := lowpower.State{
+		OnBattery: onBattery,
+		Since:     time.Now(),
+		Source:    source,
+	}
+	if err := lowpower.WriteState("/perm", state); err != nil {
+		return before, err
+	}
+	p.state = state
+	onBatteryGauge.Set(boolFloat(onBattery))
+	if onBattery {
+		log.Printf("power: on battery (%s), entering low-power mode", source)
+	} else {
+		log.Printf("power: power returned (%s), leaving low-power mode", source)
+	}
+	p.applyLocked()
+	return before, nil
+}
+
+// applyLocked stops (on battery) or starts the configured non-essential
+// daemons and notifies the daemons which adapt to the low-power mode.
+func (p *power) applyLocked() {
+	for _, path := range p.cfg.Stop {
+		var err error
+		if p.state.OnBattery {
+			err = gokrazyctl.Stop(path)
+		} else {
+			err = gokrazyctl.Restart(path)
+		}
+		if err != nil {
+			log.Printf("power: %s: %v", path, err)
+		}
+	}
+	for _, path := range lowpower.Adapting {
+		if err := notify.Process(path, syscall.SIGUSR1); err != nil {
+			log.Printf("power: notifying %s: %v", path, err)
+		}
+	}
+}
+
+// pollGPIO reads the configured GPIO (if any) and sets the power source
+// whenever its value changes. Changes made via the API stay in effect until
+// the GPIO value changes.
+func (p *power) pollGPIO() {
+	var last *bool
+	for {
+		p.mu.Lock()
+		cfg := p.cfg
+		p.mu.Unlock()
+		if cfg.GPIO == "" {
+			last = nil
+		} else if onBattery, err := cfg.ReadGPIO(); err != nil {
+			log.Printf("power: %v", err)
+		} else if last == nil || *last != onBattery {
+			last = &onBattery
+			if _, err := p.set(onBattery, lowpower.SourceGPIO); err != nil {
+				log.Printf("power: %v", err)
+			}
+		}
+		time.Sleep(cfg.PollIntervalDuration())
+	}
+}
+
+// ServeHTTP returns the power state as JSON and, on POST, sets the power
+// source (on_battery=true or on_battery=false), e.g. from a UPS monitor.
+func (p *power) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if ip := net.ParseIP(host); !gokrazy.IsInPrivateNet(ip) {
+		http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+		return
+	}
+	if r.Method == "POST" {
+		onBattery, err := strconv.ParseBool(r.FormValue("on_battery"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("on_battery: %v", err), http.StatusBadRequest)
+			return
+		}
+		before, err := p.set(onBattery, lowpower.SourceAPI)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		action := "power-mains"
+		if onBattery {
+			action = "power-battery"
+		}
+		if err := p.audit.Record(r, action, before, p.current()); err != nil {
+			log.Printf("audit log: %v", err)
+		}
+	}
+	b, err := json.MarshalIndent(p.current(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (p *power) current() lowpower.State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
@@ -0,0 +1,289 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary metricspushd scrapes the metrics of the router7 daemons and pushes
+// them to a Prometheus remote_write endpoint or Pushgateway as configured in
+// /perm/metricspush.json, buffering samples while the WAN is down.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/lowpower"
+	"github.com/rtr7/router7/internal/metricspush"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var perm = flag.String("perm",
+	"/perm",
+	"path to replace /perm")
+
+var log = teelogger.NewConsole()
+
+var (
+	pushes = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "metricspush",
+		Name:      "pushes_total",
+		Help:      "Successful pushes to the remote_write endpoint or Pushgateway",
+	})
+
+	pushErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "metricspush",
+		Name:      "push_errors_total",
+		Help:      "Failed pushes (e.g. while the WAN is down)",
+	})
+
+	scrapeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "metricspush",
+		Name:      "scrape_errors_total",
+		Help:      "Errors scraping local targets",
+	}, []string{"job"})
+
+	buffered = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "metricspush",
+		Name:      "buffered_batches",
+		Help:      "Scrapes which could not be pushed yet",
+	})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "metricspushd", "8081")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+func scrape(ctx context.Context, addr string) ([]byte, error) {
+	req, err := http.NewRequest("GET", "http://"+addr+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status: got %v, want %v", resp.Status, want)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// toSeries converts the scraped metric families into one sample per time
+// series, expanding summaries and histograms like Prometheus does.
+func toSeries(families map[string]*dto.MetricFamily, job, instance string, ts int64) metricspush.Batch {
+	var batch metricspush.Batch
+	for name, mf := range families {
+		for _, m := range mf.GetMetric() {
+			add := func(name string, value float64, extra ...metricspush.Label) {
+				labels := []metricspush.Label{
+					{Name: "__name__", Value: name},
+					{Name: "job", Value: job},
+					{Name: "instance", Value: instance},
+				}
+				for _, lp := range m.GetLabel() {
+					labels = append(labels, metricspush.Label{Name: lp.GetName(), Value: lp.GetValue()})
+				}
+				batch = append(batch, metricspush.Series{
+					Labels:    append(labels, extra...),
+					Value:     value,
+					Timestamp: ts,
+				})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), metricspush.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), metricspush.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), metricspush.Label{Name: "le", Value: formatFloat(math.Inf(+1))})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return batch
+}
+
+func push(cfg *metricspush.Config, client *metricspush.Client, buf *metricspush.Buffer) {
+	ctx, canc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer canc()
+	now := time.Now()
+	jobs := make([]string, 0, len(cfg.Targets))
+	for job := range cfg.Targets {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	var batch metricspush.Batch
+	for _, job := range jobs {
+		text, err := scrape(ctx, cfg.Targets[job])
+		if err != nil {
+			scrapeErrors.WithLabelValues(job).Inc()
+			log.Printf("scraping %s: %v", job, err)
+			continue
+		}
+		if cfg.Pushgateway {
+			if err := client.Pushgateway(ctx, job, text); err != nil {
+				pushErrors.Inc()
+				log.Printf("pushing %s: %v", job, err)
+			} else {
+				pushes.Inc()
+			}
+			continue
+		}
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(bytes.NewReader(text))
+		if err != nil {
+			scrapeErrors.WithLabelValues(job).Inc()
+			log.Printf("parsing metrics of %s: %v", job, err)
+			continue
+		}
+		batch = append(batch, toSeries(families, job, cfg.Instance, now.UnixNano()/int64(time.Millisecond))...)
+	}
+	if cfg.Pushgateway {
+		return
+	}
+	buf.Add(now, batch)
+	err := buf.Flush(func(batch metricspush.Batch) error {
+		if err := client.RemoteWrite(ctx, batch); err != nil {
+			return err
+		}
+		pushes.Inc()
+		return nil
+	})
+	if err != nil {
+		pushErrors.Inc()
+		log.Printf("remote_write (%d scrapes buffered): %v", buf.Len(), err)
+	}
+	buffered.Set(float64(buf.Len()))
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}()
+
+	cfg, err := metricspush.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	if cfg.URL == "" {
+		// Keep serving /healthz and /metrics.
+		log.Printf("pushing metrics not configured in %s/metricspush.json, idling", *perm)
+		select {}
+	}
+	interval, _ := cfg.IntervalDuration()
+	bufferDuration, _ := cfg.BufferDuration()
+	client := metricspush.NewClient(cfg, &http.Client{Timeout: 20 * time.Second})
+	buf := metricspush.NewBuffer(bufferDuration)
+	for {
+		push(cfg, client, buf)
+		time.Sleep(pushInterval(interval))
+	}
+}
+
+// pushInterval returns interval, or the longer metrics interval of
+// lowpower.json while the low-power mode is active.
+func pushInterval(interval time.Duration) time.Duration {
+	if !lowpower.Active(*perm) {
+		return interval
+	}
+	cfg, err := lowpower.ReadConfig(*perm)
+	if err != nil {
+		log.Printf("%v", err)
+		return interval
+	}
+	if lp := cfg.MetricsIntervalDuration(); lp > interval {
+		return lp
+	}
+	return interval
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("metricspushd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
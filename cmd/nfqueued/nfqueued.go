@@ -0,0 +1,186 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary nfqueued passes packets which match the rules in
+// /perm/nfqueue.json to judge programs (e.g. intrusion detection experiments)
+// and applies their verdicts.
+//
+// A judge program reads one JSON object per line from stdin, e.g.:
+//
+//	{"id":1,"family":2,"in_index":3,"payload":"RQAAPP…"}
+//
+// and replies with one JSON object per line on stdout:
+//
+//	{"id":1,"verdict":"accept"}
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/nfqueue"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var (
+	perm = flag.String("perm",
+		"/perm",
+		"path to replace /perm")
+
+	timeout = flag.Duration("timeout",
+		100*time.Millisecond,
+		"how long to wait for a judge’s verdict before applying the rule’s fallback verdict")
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	verdicts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "nfqueue",
+			Name:      "verdicts_total",
+			Help:      "Verdicts on queued packets, by queue",
+		},
+		[]string{"queue", "verdict"})
+
+	judgeErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "nfqueue",
+			Name:      "judge_errors_total",
+			Help:      "Queued packets for which the judge failed to provide a verdict",
+		},
+		[]string{"queue"})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "nfqueued", "8076")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// serve applies the verdicts of judge to packets on queue. fallback is applied
+// when judge fails.
+func serve(queue uint16, judge nfqueue.Judge, fallback nfqueue.Verdict) error {
+	conn, err := nfqueue.Listen(queue)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	label := strconv.Itoa(int(queue))
+	for {
+		packets, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		for _, p := range packets {
+			v, err := judge.Judge(p)
+			if err != nil {
+				log.Printf("queue %d: %v", queue, err)
+				judgeErrors.With(prometheus.Labels{"queue": label}).Inc()
+				v = fallback
+			}
+			verdicts.With(prometheus.Labels{"queue": label, "verdict": v.String()}).Inc()
+			if err := conn.SetVerdict(p.ID, v); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func logic() error {
+	cfg, err := nfqueue.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	// Rules sharing a queue share a judge (ReadConfig verifies this), and a
+	// queue fails closed if any of its rules does.
+	type queue struct {
+		judge    string
+		fallback nfqueue.Verdict
+	}
+	queues := make(map[uint16]*queue)
+	for _, r := range cfg.Rules {
+		q, ok := queues[r.Queue]
+		if !ok {
+			q = &queue{judge: r.Judge, fallback: nfqueue.Accept}
+			queues[r.Queue] = q
+		}
+		if r.FailClosed {
+			q.fallback = nfqueue.Drop
+		}
+	}
+	if len(queues) == 0 {
+		log.Printf("no rules configured in %s/nfqueue.json", *perm)
+	}
+
+	errs := make(chan error, len(queues))
+	for num, q := range queues {
+		go func(num uint16, q *queue) {
+			judge := &nfqueue.ProcessJudge{
+				Path:    q.judge,
+				Timeout: *timeout,
+			}
+			defer judge.Close()
+			errs <- fmt.Errorf("queue %d: %v", num, serve(num, judge, q.fallback))
+		}(num, q)
+	}
+	// netconfigd bypasses (or drops, for fail-closed rules) queued packets
+	// while nfqueued restarts, so any error is fatal.
+	return <-errs
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("nfqueued", logic); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary ntpd serves (S)NTP to LAN clients, so that devices which are not
+// allowed to reach the internet still get correct time.
+//
+// ntpd does not set the system clock (gokrazy’s ntp program does): it queries
+// the upstream servers to determine the stratum and offset it advertises, and
+// tells clients that it is unsynchronized while no upstream is reachable.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/ntp"
+	"github.com/rtr7/router7/internal/privdrop"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var (
+	upstreams = flag.String("upstreams",
+		"0.pool.ntp.org,1.pool.ntp.org,2.pool.ntp.org,3.pool.ntp.org",
+		"comma-separated list of upstream NTP servers")
+
+	interval = flag.Duration("interval",
+		5*time.Minute,
+		"how often to query the upstream NTP servers")
+
+	maxAge = flag.Duration("max_age",
+		1*time.Hour,
+		"how long to keep advertising the most recent upstream synchronization while upstreams are unreachable")
+
+	uid = flag.Int("uid", 123, "user id to switch to once the NTP listeners are open (-1 to keep running as root)")
+	gid = flag.Int("gid", 123, "group id to switch to once the NTP listeners are open")
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	upstreamStratum = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ntp",
+		Name:      "upstream_stratum",
+		Help:      "Stratum of the selected upstream NTP server",
+	})
+
+	upstreamOffset = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ntp",
+		Name:      "upstream_offset_seconds",
+		Help:      "Offset of the local clock relative to the selected upstream NTP server",
+	})
+
+	upstreamRTT = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ntp",
+		Name:      "upstream_rtt_seconds",
+		Help:      "Round trip time to the selected upstream NTP server",
+	})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ntp",
+		Name:      "upstream_errors_total",
+		Help:      "Failed upstream NTP queries",
+	}, []string{"upstream"})
+)
+
+var srv = ntp.NewServer()
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "ntpd", "8123")
+	ntpListeners  = multilisten.NewPool()
+)
+
+func updateListeners() error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	ntpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &ntp.Listener{
+			Addr:   net.JoinHostPort(host, "123"),
+			Server: srv,
+		}
+	})
+
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// queryUpstreams queries all upstreams and returns the response with the lowest
+// synchronization distance.
+func queryUpstreams(ctx context.Context) (*ntp.Response, error) {
+	var (
+		best    *ntp.Response
+		lastErr error
+	)
+	for _, upstream := range strings.Split(*upstreams, ",") {
+		ctx, canc := context.WithTimeout(ctx, 5*time.Second)
+		r, err := ntp.Query(ctx, net.JoinHostPort(upstream, "123"))
+		canc()
+		if err != nil {
+			upstreamErrors.With(prometheus.Labels{"upstream": upstream}).Inc()
+			lastErr = err
+			continue
+		}
+		if best == nil ||
+			r.RootDelay+r.RTT < best.RootDelay+best.RTT {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+func syncLoop() {
+	var lastSync time.Time
+	for {
+		r, err := queryUpstreams(context.Background())
+		if err != nil {
+			log.Printf("querying upstreams: %v", err)
+			if !lastSync.IsZero() && time.Since(lastSync) > *maxAge {
+				log.Printf("no upstream reachable for %v, advertising unsynchronized", *maxAge)
+				srv.SetUpstream(nil)
+				upstreamStratum.Set(ntp.StratumUnsynchronized)
+				lastSync = time.Time{}
+			}
+		} else {
+			if r.Offset <= -ntp.MaxOffset || r.Offset >= ntp.MaxOffset {
+				log.Printf("local clock is off by %v from %v, advertising unsynchronized", r.Offset, r.Server)
+			}
+			srv.SetUpstream(r)
+			lastSync = time.Now()
+			upstreamStratum.Set(float64(r.Stratum))
+			upstreamOffset.Set(r.Offset.Seconds())
+			upstreamRTT.Set(r.RTT.Seconds())
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func logic() error {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "ntp",
+		Name:      "stratum",
+		Help:      "Stratum served to LAN clients (16 means unsynchronized)",
+	}, func() float64 { return float64(srv.Stratum()) })
+	upstreamStratum.Set(ntp.StratumUnsynchronized)
+	healthz.Register("upstream", func() error {
+		if srv.Stratum() == ntp.StratumUnsynchronized {
+			return fmt.Errorf("not synchronized to any of %s (or local clock off by more than %v)", *upstreams, ntp.MaxOffset)
+		}
+		return nil
+	})
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	if *uid != -1 {
+		// Listeners are re-created when addresses change, so binding to port
+		// 123 needs to remain possible. supervise records crashes in
+		// /perm/ntpd.
+		if err := privdrop.Drop(privdrop.Config{
+			UID:      *uid,
+			GID:      *gid,
+			Caps:     []int{unix.CAP_NET_BIND_SERVICE},
+			Writable: []string{"/perm/ntpd"},
+		}); err != nil {
+			return err
+		}
+	}
+	go syncLoop()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if err := supervise.Run("ntpd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
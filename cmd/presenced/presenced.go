@@ -0,0 +1,217 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary presenced reports whether the devices tagged “presence” in the device
+// registry are home (based on their DHCP leases) to Home Assistant, via MQTT
+// discovery and/or the REST API as configured in /perm/presence.json.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/mqtt"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/presence"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/statefile"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var interval = flag.Duration("interval",
+	30*time.Second,
+	"how often to re-evaluate device presence")
+
+var log = teelogger.NewConsole()
+
+var home = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "presence",
+		Name:      "home",
+		Help:      "Whether the device is home (1) or away (0)",
+	},
+	[]string{"device"})
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "presenced", "8078")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+func readLeases() ([]*dhcp4d.Lease, error) {
+	b, err := ioutil.ReadFile("/perm/dhcp4d/leases.json")
+	if err != nil {
+		return nil, err
+	}
+	var leases []*dhcp4d.Lease
+	if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// publisher publishes presence changes to Home Assistant.
+type publisher struct {
+	client *mqtt.Client // nil until connected
+}
+
+func (p *publisher) publishMQTT(cfg *presence.MQTTConfig, all, changed []presence.Device) error {
+	if p.client != nil && p.client.Err() != nil {
+		p.client = nil // connection broken, reconnect
+	}
+	if p.client == nil {
+		client, err := mqtt.Dial(cfg.Broker, mqtt.Options{
+			ClientID: "router7-presenced",
+			Username: cfg.Username,
+			Password: cfg.Password,
+		})
+		if err != nil {
+			return err
+		}
+		p.client = client
+		changed = all // (re-)announce all devices
+	}
+	for _, d := range changed {
+		msgs, err := presence.DiscoveryMessages(cfg.DiscoveryPrefix, d)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := p.client.Publish(m.Topic, m.Payload, m.Retain); err != nil {
+				p.client.Close()
+				p.client = nil
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *publisher) publish(cfg *presence.Config, all, changed []presence.Device) {
+	if cfg.MQTT != nil {
+		if err := p.publishMQTT(cfg.MQTT, all, changed); err != nil {
+			log.Printf("publishing via MQTT: %v", err)
+		}
+	} else if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	if cfg.REST != nil {
+		for _, d := range changed {
+			if err := presence.PostREST(context.Background(), cfg.REST, d); err != nil {
+				log.Printf("publishing via REST: %v", err)
+			}
+		}
+	}
+}
+
+func logic() error {
+	var (
+		mu      sync.Mutex
+		tracker presence.Tracker
+	)
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		b, err := json.MarshalIndent(tracker.Devices(), "", "  ")
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	var p publisher
+	for {
+		cfg, err := presence.ReadConfig("/perm")
+		if err != nil {
+			return err
+		}
+		awayAfter, _ := cfg.AwayAfterDuration() // verified by ReadConfig
+		reg, err := devices.Read("/perm")
+		if err != nil {
+			return err
+		}
+		leases, err := readLeases()
+		if err != nil {
+			log.Printf("readLeases: %v", err)
+		}
+
+		mu.Lock()
+		tracker.AwayAfter = awayAfter
+		changed := tracker.Update(time.Now(), leases, reg)
+		all := tracker.Devices()
+		mu.Unlock()
+		home.Reset()
+		for _, d := range all {
+			v := 0.0
+			if d.Home {
+				v = 1
+			}
+			home.With(prometheus.Labels{"device": d.Name}).Set(v)
+		}
+		for _, d := range changed {
+			log.Printf("%s (%s): home=%v", d.Name, d.HardwareAddr, d.Home)
+		}
+		p.publish(cfg, all, changed)
+
+		time.Sleep(*interval)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("presenced", logic); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary rogued watches the LAN for rogue IPv6 router advertisements and rogue
+// DHCPv4 servers (e.g. a misconfigured consumer router plugged in the wrong
+// way), alerting via log, webhook and metrics, and optionally blocking the
+// offender.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/raw"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/bpf"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/rogue"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/webhook"
+)
+
+var (
+	iface = flag.String("interface", "lan0", "ethernet interface to watch")
+
+	allowed = flag.String("allowed",
+		"",
+		"comma-separated list of MAC addresses of legitimate routers or DHCP servers")
+
+	webhookURL = flag.String("webhook_url",
+		"",
+		"if non-empty, URL to POST a JSON event to when a new offender is detected")
+
+	block = flag.Bool("block",
+		false,
+		"install nftables rules (via netconfigd) which drop traffic from offenders")
+
+	forgetAfter = flag.Duration("forget_after",
+		24*time.Hour,
+		"how long to remember (and block) offenders after their last rogue packet")
+
+	maxOffenders = flag.Int("max_offenders",
+		64,
+		"maximum number of offenders to remember (and block); the least recently seen ones are forgotten first")
+)
+
+var log = teelogger.NewConsole()
+
+var roguePackets = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "rogue",
+		Name:      "packets_total",
+		Help:      "Router advertisements and DHCPv4 replies not sent by router7",
+	},
+	[]string{"kind"})
+
+// kindNames describe rogue.Event kinds in alerts.
+var kindNames = map[string]string{
+	rogue.KindRA:    "IPv6 router",
+	rogue.KindDHCP4: "DHCPv4 server",
+}
+
+// offendersHandler returns the recently seen offenders as JSON.
+func offendersHandler(o *rogue.Offenders) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(o.List(time.Now()), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "rogued", "8074")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// syncBlocked makes the recently seen offenders the blocked devices, so that
+// devices which are no longer seen (e.g. spoofed MAC addresses) are unblocked.
+func syncBlocked(o *rogue.Offenders) error {
+	blocked, err := rogue.ReadBlocked("/perm")
+	if err != nil {
+		return err
+	}
+	var hwaddrs []string
+	seen := make(map[string]bool)
+	for _, off := range o.List(time.Now()) {
+		if !seen[off.HardwareAddr] {
+			seen[off.HardwareAddr] = true
+			hwaddrs = append(hwaddrs, off.HardwareAddr)
+		}
+	}
+	if reflect.DeepEqual(blocked.HardwareAddrs, hwaddrs) {
+		return nil
+	}
+	blocked.HardwareAddrs = hwaddrs
+	if err := rogue.WriteBlocked("/perm", blocked); err != nil {
+		return err
+	}
+	return notify.Process("/user/netconfigd", syscall.SIGUSR1)
+}
+
+func logic() error {
+	ifc, err := net.InterfaceByName(*iface)
+	if err != nil {
+		return err
+	}
+	d := &rogue.Detector{
+		HardwareAddr: ifc.HardwareAddr,
+		Allowed:      make(map[string]bool),
+	}
+	for _, mac := range strings.Split(*allowed, ",") {
+		if mac == "" {
+			continue
+		}
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return err
+		}
+		d.Allowed[hwaddr.String()] = true
+	}
+
+	o := rogue.NewOffenders(*forgetAfter, *maxOffenders)
+	alerter := alert.NewAlerter("/perm")
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	http.Handle("/offenders", offendersHandler(o))
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			if err := alerter.Reload(); err != nil {
+				log.Printf("reloading alert config: %v", err)
+			}
+		}
+	}()
+
+	if *block {
+		go func() {
+			for range time.Tick(time.Hour) {
+				if err := syncBlocked(o); err != nil {
+					log.Printf("unblocking offenders: %v", err)
+				}
+			}
+		}()
+	}
+
+	filter, err := bpf.Assemble(rogue.Filter)
+	if err != nil {
+		return err
+	}
+	conn, err := raw.ListenPacket(ifc, syscall.ETH_P_ALL, &raw.Config{
+		Filter: filter,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := make([]byte, ifc.MTU+14) // MTU plus ethernet header
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		ev := d.Inspect(buf[:n], time.Now())
+		if ev == nil {
+			continue
+		}
+		roguePackets.With(prometheus.Labels{"kind": ev.Kind}).Inc()
+		if !o.Record(ev) {
+			continue
+		}
+		log.Printf("rogue %s from %s (%s)", ev.Kind, ev.HardwareAddr, ev.Addr)
+		alerter.Alert("rogue-"+ev.HardwareAddr, fmt.Sprintf("rogue %s detected", kindNames[ev.Kind]),
+			fmt.Sprintf("A rogue %s was detected on %s:\n\nhardware address: %s\naddress: %s\n", kindNames[ev.Kind], *iface, ev.HardwareAddr, ev.Addr))
+		if *webhookURL != "" {
+			go func(ev rogue.Event) {
+				if err := webhook.Post(context.Background(), *webhookURL, ev); err != nil {
+					log.Printf("webhook: %v", err)
+				}
+			}(*ev)
+		}
+		if *block {
+			if err := syncBlocked(o); err != nil {
+				log.Printf("blocking %s: %v", ev.HardwareAddr, err)
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("rogued", logic); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary router7 runs dhcp4d, dnsd, radvd, netconfigd, dyndns and diagd in one
+// process, which saves memory on small devices compared to running them as
+// separate binaries. Install either router7 or the separate binaries.
+//
+// The daemons keep their management ports, except for /metrics and /healthz:
+// router7 serves those once for all daemons on its own management port (8064).
+//
+// The daemons to run are selected with -daemons, which defaults to none.
+// Flags of the daemons are prefixed with the daemon name, e.g.:
+//
+//	router7 -daemons=netconfigd,dhcp4d,dnsd,radvd -dhcp4d.interface=lan0
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/daemons/dhcp4d"
+	"github.com/rtr7/router7/internal/daemons/diagd"
+	"github.com/rtr7/router7/internal/daemons/dnsd"
+	"github.com/rtr7/router7/internal/daemons/dyndns"
+	"github.com/rtr7/router7/internal/daemons/netconfigd"
+	"github.com/rtr7/router7/internal/daemons/radvd"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/supervise"
+)
+
+// daemons are the daemons which router7 can run.
+var daemons = []*daemon.Daemon{
+	netconfigd.Daemon,
+	dhcp4d.Daemon,
+	dnsd.Daemon,
+	radvd.Daemon,
+	dyndns.Daemon,
+	diagd.Daemon,
+}
+
+func names(daemons []*daemon.Daemon) string {
+	result := make([]string, len(daemons))
+	for i, d := range daemons {
+		result[i] = d.Name
+	}
+	return strings.Join(result, ",")
+}
+
+var enabled = flag.String("daemons",
+	"",
+	"comma-separated list of daemons to run (e.g. "+names(daemons)+"), which must not be installed as separate binaries, too")
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "router7", daemon.SharedPort)
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	handler := daemon.SharedHandler()
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = handler
+		return srv
+	})
+	return nil
+}
+
+func main() {
+	daemon.RegisterFlags(flag.CommandLine, daemons)
+	flag.Parse()
+	if *enabled == "" {
+		// Installed via github.com/rtr7/router7/cmd/... alongside the
+		// separate binaries: stay out of their way.
+		log.Printf("no daemons enabled (-daemons), idling")
+		select {}
+	}
+	selected, err := daemon.Select(daemons, strings.Split(*enabled, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("running %s", names(selected))
+	if err := updateListeners(); err != nil {
+		log.Fatal(err)
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	if err := supervise.Run("router7", func() error {
+		return daemon.RunAll(selected)
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
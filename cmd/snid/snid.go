@@ -0,0 +1,239 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary snid passively records which hostnames LAN clients contact (TLS
+// server name indication and HTTP Host headers, without decrypting traffic)
+// if enabled in /perm/sni.json, and serves a per-client activity page.
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/raw"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/bpf"
+
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/sni"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+var iface = flag.String("interface", "lan0", "ethernet interface to watch")
+
+const activityPath = "/perm/snid/activity.json"
+
+var log = teelogger.NewConsole()
+
+var observations = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "sni",
+		Name:      "observations_total",
+		Help:      "Hostnames observed in LAN client traffic",
+	},
+	[]string{"proto"})
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "snid", "8082")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+//go:embed activity.html.tmpl
+var activityHTML string
+
+var activityTmpl = webui.Must(webui.Parse("snid", activityHTML, nil))
+
+func activityTable(entries []sni.Entry) *webui.Table {
+	t := &webui.Table{
+		Columns: []string{"hostname", "last_seen", "first_seen", "connections", "protocol"},
+		Empty:   "no_activity",
+	}
+	for _, e := range entries {
+		t.Append(
+			webui.Text(e.Host),
+			webui.Text(e.Last.Format("2006-01-02 15:04")),
+			webui.Text(e.First.Format("2006-01-02 15:04")),
+			webui.Text(e.Count),
+			webui.Text(e.Proto))
+	}
+	return t
+}
+
+type client struct {
+	HardwareAddr string
+	Name         string
+}
+
+func deviceName(hwaddr string) string {
+	reg, err := devices.Read("/perm")
+	if err != nil {
+		return ""
+	}
+	if d, ok := reg.Lookup(hwaddr); ok {
+		return d.Name
+	}
+	return ""
+}
+
+// serveActivity serves the browsing history of the clients, which is private:
+// both endpoints require the gokrazy password.
+func serveActivity(l *sni.Log) {
+	http.Handle("/", auth.RequirePassword("snid", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hwaddr := r.FormValue("hwaddr")
+		var clients []client
+		for _, c := range l.Clients() {
+			clients = append(clients, client{HardwareAddr: c, Name: deviceName(c)})
+		}
+		var entries *webui.Table
+		if hwaddr != "" {
+			entries = activityTable(l.Activity(hwaddr))
+		}
+		if err := activityTmpl.Execute(w, r, struct {
+			Clients      []client
+			HardwareAddr string
+			Name         string
+			Entries      *webui.Table
+		}{
+			Clients:      clients,
+			HardwareAddr: hwaddr,
+			Name:         deviceName(hwaddr),
+			Entries:      entries,
+		}); err != nil {
+			log.Printf("rendering activity: %v", err)
+		}
+	})))
+	http.Handle("/activity.json", auth.RequirePassword("snid", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(l.Activity(r.FormValue("hwaddr")), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})))
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}()
+
+	cfg, err := sni.ReadConfig("/perm")
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("SNI logging not enabled in /perm/sni.json, idling")
+		select {}
+	}
+	retention, _ := cfg.RetentionDuration() // verified by ReadConfig
+	l := sni.NewLog(retention, cfg.Max())
+	if err := l.Load(activityPath); err != nil {
+		log.Printf("loading activity: %v", err)
+	}
+	serveActivity(l)
+	go func() {
+		for range time.Tick(5 * time.Minute) {
+			l.Prune(time.Now())
+			if err := l.Save(activityPath); err != nil {
+				log.Printf("saving activity: %v", err)
+			}
+		}
+	}()
+
+	ifc, err := net.InterfaceByName(*iface)
+	if err != nil {
+		return err
+	}
+	o := &sni.Observer{HardwareAddr: ifc.HardwareAddr}
+	filter, err := bpf.Assemble(sni.Filter)
+	if err != nil {
+		return err
+	}
+	conn, err := raw.ListenPacket(ifc, syscall.ETH_P_ALL, &raw.Config{
+		Filter: filter,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := make([]byte, ifc.MTU+14) // MTU plus ethernet header
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		obs := o.Inspect(buf[:n], time.Now())
+		if obs == nil {
+			continue
+		}
+		observations.With(prometheus.Labels{"proto": obs.Proto}).Inc()
+		l.Add(obs)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("snid", logic); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary tailnetd joins router7 to a tailnet if enabled in
+// /perm/tailscale.json: it supervises tailscaled, advertises the LAN subnet
+// and exposes router7’s management interfaces on its tailnet address.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/tailscale"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var perm = flag.String("perm",
+	"/perm",
+	"path to replace /perm")
+
+var log = teelogger.NewConsole()
+
+var (
+	tailscaledRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "tailnet",
+		Name:      "tailscaled_running",
+		Help:      "Whether tailscaled is running",
+	})
+	tailscaledRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "tailnet",
+		Name:      "tailscaled_restarts_total",
+		Help:      "Restarts of tailscaled after it exited",
+	})
+	forwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "tailnet",
+		Name:      "forwarded_connections_total",
+		Help:      "Connections from the tailnet forwarded to router7, by port",
+	}, []string{"port"})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "tailnetd", "8084")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+// lanSubnet returns the lan0 subnet configured in interfaces.json.
+func lanSubnet() *net.IPNet {
+	details, err := netconfig.Interface(*perm, "lan0")
+	if err != nil {
+		log.Printf("not advertising lan0: %v", err)
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(details.Addr)
+	if err != nil {
+		log.Printf("not advertising lan0: %v", err)
+		return nil
+	}
+	return subnet
+}
+
+// up configures tailscaled (which might still be starting up) via
+// “tailscale up”.
+func up(cfg *tailscale.Config) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		cmd := exec.Command(cfg.Tailscale, cfg.UpArgs(lanSubnet())...)
+		var out []byte
+		out, err = cmd.CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		// Do not log the auth key.
+		err = fmt.Errorf("tailscale up: %v: %s", err, strings.TrimSpace(string(out)))
+		time.Sleep(1 * time.Second)
+	}
+	return err
+}
+
+// tailnetAddr returns router7’s IPv4 address within the tailnet.
+func tailnetAddr(cfg *tailscale.Config) (net.IP, error) {
+	out, err := exec.Command(cfg.Tailscale, "--socket="+tailscale.Socket, "ip", "-4").Output()
+	if err != nil {
+		return nil, fmt.Errorf("tailscale ip: %v", err)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(out)))
+	if ip == nil {
+		return nil, fmt.Errorf("tailscale ip: unexpected output %q", out)
+	}
+	return ip, nil
+}
+
+// runTailscaled runs tailscaled, restarting it whenever it exits.
+func runTailscaled(cfg *tailscale.Config, stateDir string) {
+	for {
+		tailscaled := exec.Command(cfg.Tailscaled, cfg.TailscaledArgs(stateDir)...)
+		tailscaled.Stdout = os.Stdout
+		tailscaled.Stderr = os.Stderr
+		if err := tailscaled.Start(); err != nil {
+			log.Printf("starting tailscaled: %v", err)
+		} else {
+			tailscaledRunning.Set(1)
+			go func() {
+				if err := up(cfg); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				if err := expose(cfg); err != nil {
+					log.Printf("exposing ports: %v", err)
+				}
+			}()
+			log.Printf("tailscaled exited: %v", tailscaled.Wait())
+			tailscaledRunning.Set(0)
+		}
+		tailscaledRestarts.Inc()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+var (
+	exposedMu sync.Mutex
+	exposed   = make(map[string]net.Listener) // by listen address
+)
+
+// expose forwards cfg.ExposePorts from router7’s tailnet address to
+// localhost, where all router7 daemons (and the gokrazy web interface)
+// listen.
+func expose(cfg *tailscale.Config) error {
+	ip, err := tailnetAddr(cfg)
+	if err != nil {
+		return err
+	}
+	exposedMu.Lock()
+	defer exposedMu.Unlock()
+	want := make(map[string]bool)
+	for _, port := range cfg.ExposePorts {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		want[addr] = true
+		if _, ok := exposed[addr]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		exposed[addr] = ln
+		go forward(ln, net.JoinHostPort("localhost", strconv.Itoa(port)))
+	}
+	for addr, ln := range exposed {
+		if !want[addr] {
+			ln.Close()
+			delete(exposed, addr)
+		}
+	}
+	return nil
+}
+
+func forward(ln net.Listener, target string) {
+	_, port, _ := net.SplitHostPort(target)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		forwarded.With(prometheus.Labels{"port": port}).Inc()
+		go func() {
+			defer conn.Close()
+			backend, err := net.Dial("tcp", target)
+			if err != nil {
+				log.Printf("forwarding to %s: %v", target, err)
+				return
+			}
+			defer backend.Close()
+			done := make(chan struct{})
+			go func() {
+				io.Copy(backend, conn)
+				close(done)
+			}()
+			io.Copy(conn, backend)
+			<-done
+		}()
+	}
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	cfg, err := tailscale.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("tailnet not enabled in /perm/tailscale.json, idling")
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}
+	stateDir := filepath.Join(*perm, "tailscale")
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	healthz.Register("tailscaled", func() error {
+		if _, err := os.Stat(tailscale.Socket); err != nil {
+			return fmt.Errorf("tailscaled not running: %v", err)
+		}
+		return nil
+	})
+	go runTailscaled(cfg, stateDir)
+
+	// On SIGUSR1 (e.g. after netconfigd changed lan0), re-apply the
+	// configuration. Changing the tailscaled paths requires a restart.
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		updated, err := tailscale.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("reading tailscale.json: %v", err)
+			continue
+		}
+		if err := up(updated); err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		if err := expose(updated); err != nil {
+			log.Printf("exposing ports: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("tailnetd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
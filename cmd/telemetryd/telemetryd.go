@@ -0,0 +1,299 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary telemetryd publishes router events and metrics (WAN address, uplink
+// status and bandwidth, new devices, per-client bandwidth) to an MQTT broker
+// as configured in /perm/telemetry.json, e.g. for Node-RED or dashboards.
+//
+// Topics (below the configured prefix, “router7” by default):
+//
+//	wan/addr                   WAN IPv4 address (retained)
+//	wan/addr6                  WAN IPv6 address (retained)
+//	uplink/status              “up” or “down” (retained)
+//	uplink/bandwidth           JSON, see telemetry.Bandwidth
+//	clients/<addr>/bandwidth   JSON, requires /perm/accounting.json
+//	events                     JSON, see telemetry.Event
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/mqtt"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/statefile"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/telemetry"
+)
+
+var (
+	perm = flag.String("perm",
+		"/perm",
+		"path to replace /perm")
+
+	uplink = flag.String("uplink",
+		"uplink0",
+		"name of the uplink network interface")
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	published = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "telemetry",
+		Name:      "published_total",
+		Help:      "MQTT messages published",
+	})
+
+	publishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "telemetry",
+		Name:      "publish_errors_total",
+		Help:      "Errors connecting to the broker or publishing messages",
+	})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "telemetryd", "8080")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+func readUint(fn string) (uint64, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 0, 64)
+}
+
+func snapshot() (*telemetry.Snapshot, error) {
+	s := &telemetry.Snapshot{Time: time.Now()}
+
+	wan, err := netconfig.ReadWANAddrs(*perm)
+	if err != nil {
+		return nil, err
+	}
+	s.WANAddr = wan.IPv4
+	s.WANAddr6 = wan.IPv6
+
+	sys := filepath.Join("/sys/class/net", *uplink)
+	if b, err := ioutil.ReadFile(filepath.Join(sys, "operstate")); err == nil {
+		s.UplinkUp = strings.TrimSpace(string(b)) == "up"
+	}
+	if s.Uplink.RxBytes, err = readUint(filepath.Join(sys, "statistics/rx_bytes")); err != nil {
+		log.Printf("%v", err)
+	}
+	if s.Uplink.TxBytes, err = readUint(filepath.Join(sys, "statistics/tx_bytes")); err != nil {
+		log.Printf("%v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(*perm, "dhcp4d/leases.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := statefile.Leases4.Unmarshal(b, &s.Leases); err != nil {
+			return nil, err
+		}
+	}
+
+	clients, err := netconfig.Accounting()
+	if err != nil {
+		log.Printf("reading per-client traffic counters: %v", err)
+	}
+	s.Clients = make(map[string]telemetry.Traffic, len(clients))
+	for _, c := range clients {
+		s.Clients[c.Addr] = telemetry.Traffic{
+			RxBytes: c.RxBytes,
+			TxBytes: c.TxBytes,
+		}
+	}
+	return s, nil
+}
+
+func seenPath() string {
+	return filepath.Join(*perm, "telemetryd", "seen.json")
+}
+
+func loadSeen() (map[string]bool, error) {
+	b, err := ioutil.ReadFile(seenPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hwaddrs []string
+	if err := json.Unmarshal(b, &hwaddrs); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(hwaddrs))
+	for _, hwaddr := range hwaddrs {
+		seen[hwaddr] = true
+	}
+	return seen, nil
+}
+
+func persistSeen(seen map[string]bool) error {
+	hwaddrs := make([]string, 0, len(seen))
+	for hwaddr := range seen {
+		hwaddrs = append(hwaddrs, hwaddr)
+	}
+	b, err := json.Marshal(hwaddrs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(seenPath()), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(seenPath(), b, 0644)
+}
+
+func dial(cfg *telemetry.Config) (*mqtt.Client, error) {
+	opts := mqtt.Options{
+		ClientID: "router7-telemetryd",
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		return mqtt.DialTLS(cfg.Broker, tlsCfg, opts)
+	}
+	return mqtt.Dial(cfg.Broker, opts)
+}
+
+func logic() error {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	seen, err := loadSeen()
+	if err != nil {
+		return err
+	}
+	p := &telemetry.Publisher{Seen: seen}
+	var client *mqtt.Client
+
+	// Publish immediately when e.g. dhcp4 obtained a new WAN address.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for {
+		cfg, err := telemetry.ReadConfig(*perm)
+		if err != nil {
+			return err
+		}
+		interval, _ := cfg.IntervalDuration() // verified by ReadConfig
+		if err := func() error {
+			if cfg.Broker == "" {
+				if client != nil {
+					client.Close()
+					client = nil
+				}
+				return nil // telemetry disabled
+			}
+			if client != nil && client.Err() != nil {
+				client = nil // connection broken, reconnect
+			}
+			if client == nil {
+				c, err := dial(cfg)
+				if err != nil {
+					return err
+				}
+				client = c
+				p.Reset() // re-publish retained state
+			}
+			p.Prefix = cfg.TopicPrefix
+			s, err := snapshot()
+			if err != nil {
+				return err
+			}
+			before := len(p.Seen)
+			msgs, err := p.Update(s)
+			if err != nil {
+				return err
+			}
+			for _, m := range msgs {
+				if err := client.Publish(m.Topic, m.Payload, m.Retain); err != nil {
+					client.Close()
+					client = nil
+					return err
+				}
+				published.Inc()
+			}
+			if len(p.Seen) != before {
+				if err := persistSeen(p.Seen); err != nil {
+					log.Printf("persisting seen devices: %v", err)
+				}
+			}
+			return nil
+		}(); err != nil {
+			publishErrors.Inc()
+			log.Printf("publishing telemetry: %v", err)
+		}
+		select {
+		case <-ch:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := supervise.Run("telemetryd", logic); err != nil {
+		log.Fatal(err)
+	}
+}
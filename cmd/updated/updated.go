@@ -0,0 +1,176 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary updated guards gokrazy updates: update tools call its /prepare
+// endpoint before installing an update, which is refused without internet
+// connectivity. After rebooting into the update, updated rolls back to the
+// previous root file system if connectivity does not come back, i.e. if diagd
+// checks fail which passed before the update.
+//
+// Note that gokrazy only keeps two copies of the root file system: the kernel
+// in the boot partition is not rolled back.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/gokrazyctl"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/supervise"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/update"
+)
+
+var (
+	healthURL = flag.String("health_url",
+		"",
+		"diagd health endpoint to assess connectivity (default http://localhost:7733/health.json, with the diagd port configured in "+multilisten.ConfigPath+")")
+
+	grace = flag.Duration("grace",
+		5*time.Minute,
+		"how long connectivity may take to come back after an update before rolling back")
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flag.CommandLine, "updated", "8068")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		return multilisten.NewHTTPServer(addr)
+	})
+	return nil
+}
+
+func rollback() error {
+	if err := gokrazyctl.SwitchRoot(); err != nil {
+		return err
+	}
+	return gokrazyctl.Reboot()
+}
+
+// verifyPending checks connectivity after booting into an update, rolling
+// back if connectivity does not come back within the grace period.
+func verifyPending(g *update.Guard) error {
+	p, err := g.BootedInto(time.Now())
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return nil // not booted into an update
+	}
+	log.Printf("verifying connectivity after the update prepared at %v", p.Prepared)
+	verr := g.Verify(context.Background(), p, *grace, 10*time.Second)
+	// Clear before rolling back so that the previous version does not try to
+	// roll back, too.
+	if err := g.Clear(); err != nil {
+		return err
+	}
+	if verr == nil {
+		log.Printf("connectivity restored, update confirmed")
+		return nil
+	}
+	log.Printf("connectivity not restored within %v (%v), rolling back", *grace, verr)
+	return rollback()
+}
+
+func logic() error {
+	if *healthURL == "" {
+		*healthURL = "http://" + multilisten.Resolve("diagd", "localhost:7733") + "/health.json"
+	}
+	g := &update.Guard{
+		Dir:       "/perm/updated",
+		HealthURL: *healthURL,
+	}
+	http.Handle("/healthz", healthz.Handler())
+	http.Handle("/debug/loglevel", teelogger.Handler())
+	http.Handle(profiling.Prefix, profiling.Handler())
+	audit := auditlog.New("/perm", "updated")
+	http.Handle("/prepare", auth.RequirePassword("updated", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := g.Prepare(r.Context()); err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(update.DegradedError); ok {
+				status = http.StatusServiceUnavailable
+			}
+			log.Printf("refusing update: %v", err)
+			http.Error(w, fmt.Sprintf("refusing update: %v", err), status)
+			return
+		}
+		// Flush the files which daemons wrote to /perm to disk before the
+		// update tool reboots the machine. Daemons are not asked to persist
+		// in-memory state: state which they persist periodically (e.g.
+		// dhcp4d’s last seen timestamps) may be lost since its last write.
+		log.Printf("update prepared")
+		if err := audit.Record(r, "prepare-update", nil, nil); err != nil {
+			log.Printf("audit log: %v", err)
+		}
+		unix.Sync()
+	})))
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	go func() {
+		if err := verifyPending(g); err != nil {
+			log.Printf("verifying update: %v", err)
+		}
+	}()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if err := supervise.Run("updated", logic); err != nil {
+		log.Fatal(err)
+	}
+}
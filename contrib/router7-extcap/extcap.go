@@ -0,0 +1,207 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary router7-extcap is a Wireshark extcap helper which lists the router’s
+// interfaces (“router7: lan0”, “router7: uplink0”) as capture interfaces and
+// streams their packets from captured, via SSH or WebSocket. It is meant to be
+// run on a workstation (not on the router, hence it is not in cmd/). Install it
+// into Wireshark’s personal extcap directory (see Help → About Wireshark →
+// Folders), e.g.:
+//
+//	go build -o ~/.config/wireshark/extcap/router7-extcap github.com/rtr7/router7/contrib/router7-extcap
+//
+// Capture filters are compiled using libpcap on the workstation and evaluated
+// by captured, which only captures configuration-related packets (e.g. DHCP).
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/websocket"
+)
+
+// interfaces are the router interfaces on which captured captures packets.
+var interfaces = []string{"lan0", "uplink0"}
+
+const interfacePrefix = "router7-"
+
+var (
+	// Flags defined by the extcap interface, see
+	// https://www.wireshark.org/docs/wsdg_html_chunked/ChCaptureExtcap.html
+	listInterfaces = flag.Bool("extcap-interfaces", false, "list the extcap interfaces")
+	_              = flag.String("extcap-version", "", "Wireshark version")
+	extcapIface    = flag.String("extcap-interface", "", "extcap interface, e.g. "+interfacePrefix+"lan0")
+	listDLTs       = flag.Bool("extcap-dlts", false, "list the data link types of -extcap-interface")
+	listConfig     = flag.Bool("extcap-config", false, "list the configuration options of -extcap-interface")
+	capture        = flag.Bool("capture", false, "capture packets of -extcap-interface into -fifo")
+	fifo           = flag.String("fifo", "", "path to write the pcap stream to")
+	captureFilter  = flag.String("extcap-capture-filter", "", "capture filter (libpcap syntax)")
+
+	router    = flag.String("router", "router7", "host name or address of the router")
+	transport = flag.String("transport", "ssh", "how to connect to captured: ssh (using the ssh(1) program and its configuration, e.g. keys) or websocket (using the gokrazy password)")
+	sshPort   = flag.Int("ssh-port", 5022, "SSH port of captured")
+	httpPort  = flag.Int("http-port", 8088, "HTTP port of captured")
+	password  = flag.String("password", "", "gokrazy password, for -transport=websocket")
+	snaplen   = flag.Int("snaplen", 1600, "maximum number of bytes captured per packet")
+)
+
+func printInterfaces() {
+	fmt.Println("extcap {version=1.0}{help=https://github.com/rtr7/router7}")
+	for _, ifname := range interfaces {
+		fmt.Printf("interface {value=%s%s}{display=router7: %s}\n", interfacePrefix, ifname, ifname)
+	}
+}
+
+func printDLTs() {
+	fmt.Printf("dlt {number=%d}{name=EN10MB}{display=Ethernet}\n", layers.LinkTypeEthernet)
+}
+
+func printConfig() {
+	fmt.Println("arg {number=0}{call=--router}{display=Router}{type=string}{default=router7}{tooltip=Host name or address of the router}{required=true}")
+	fmt.Println("arg {number=1}{call=--transport}{display=Transport}{type=selector}{tooltip=SSH uses your ssh configuration and keys, WebSocket uses the gokrazy password}")
+	fmt.Println("value {arg=1}{value=ssh}{display=SSH}{default=true}")
+	fmt.Println("value {arg=1}{value=websocket}{display=WebSocket}{default=false}")
+	fmt.Println("arg {number=2}{call=--ssh-port}{display=SSH port}{type=unsigned}{default=5022}")
+	fmt.Println("arg {number=3}{call=--http-port}{display=HTTP port}{type=unsigned}{default=8088}")
+	fmt.Println("arg {number=4}{call=--password}{display=gokrazy password (WebSocket)}{type=password}")
+	fmt.Println("arg {number=5}{call=--snaplen}{display=Snapshot length}{type=integer}{range=1,1600}{default=1600}")
+}
+
+// compileFilter compiles expr into the filter stream option of captured: the
+// instructions in tcpdump -ddd format, separated by commas.
+func compileFilter(expr string) (string, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, *snaplen, expr)
+	if err != nil {
+		return "", err
+	}
+	encoded := make([]string, len(instructions))
+	for i, ins := range instructions {
+		encoded[i] = fmt.Sprintf("%d %d %d %d", ins.Code, ins.Jt, ins.Jf, ins.K)
+	}
+	return strings.Join(encoded, ","), nil
+}
+
+// streamOptions returns the URL query understood by captured.
+func streamOptions(ifname string) (string, error) {
+	v := url.Values{}
+	v.Set("interface", ifname)
+	v.Set("snaplen", strconv.Itoa(*snaplen))
+	if *captureFilter != "" {
+		filter, err := compileFilter(*captureFilter)
+		if err != nil {
+			return "", err
+		}
+		v.Set("filter", filter)
+	}
+	return v.Encode(), nil
+}
+
+func captureSSH(w io.Writer, query string) error {
+	ssh := exec.Command("ssh",
+		"-o", "BatchMode=yes", // Wireshark cannot answer prompts
+		"-p", strconv.Itoa(*sshPort),
+		*router,
+		query)
+	ssh.Stdout = w
+	ssh.Stderr = os.Stderr
+	return ssh.Run()
+}
+
+func captureWebSocket(w io.Writer, query string) error {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     net.JoinHostPort(*router, strconv.Itoa(*httpPort)),
+		Path:     "/capture",
+		RawQuery: query,
+	}
+	config, err := websocket.NewConfig(u.String(), "http://localhost/")
+	if err != nil {
+		return err
+	}
+	config.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("gokrazy:"+*password)))
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	_, err = io.Copy(w, ws)
+	return err
+}
+
+func logic() error {
+	if *listInterfaces {
+		printInterfaces()
+		return nil
+	}
+	if !strings.HasPrefix(*extcapIface, interfacePrefix) {
+		return fmt.Errorf("unknown -extcap-interface %q", *extcapIface)
+	}
+	ifname := strings.TrimPrefix(*extcapIface, interfacePrefix)
+	switch {
+	case *listDLTs:
+		printDLTs()
+		return nil
+
+	case *listConfig:
+		printConfig()
+		return nil
+
+	case !*capture:
+		// Wireshark validates the capture filter: an invalid filter is
+		// indicated by printing an error message.
+		if *captureFilter != "" {
+			if _, err := compileFilter(*captureFilter); err != nil {
+				fmt.Println(err)
+			}
+		}
+		return nil
+	}
+
+	query, err := streamOptions(ifname)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch *transport {
+	case "ssh":
+		return captureSSH(f, query)
+	case "websocket":
+		return captureWebSocket(f, query)
+	default:
+		return fmt.Errorf("unknown -transport %q (want ssh or websocket)", *transport)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary uciconvert converts an OpenWrt network and firewall configuration
+// (copied from /etc/config on the OpenWrt router) into interfaces.json and
+// portforwardings.json for netconfigd. It is meant to be run on a workstation
+// (not on the router, hence it is not in cmd/) when migrating to router7:
+//
+//	scp openwrt:/etc/config/network openwrt:/etc/config/firewall .
+//	uciconvert -network=network -firewall=firewall -output_dir=perm/
+//
+// Configuration which cannot be converted is listed on stderr and needs to be
+// migrated manually (or dropped).
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/rtr7/router7/internal/uci"
+)
+
+var (
+	network = flag.String("network",
+		"network",
+		"path to the OpenWrt network configuration (/etc/config/network)")
+
+	firewall = flag.String("firewall",
+		"firewall",
+		"path to the OpenWrt firewall configuration (/etc/config/firewall), or empty to skip")
+
+	outputDir = flag.String("output_dir",
+		".",
+		"directory in which to create interfaces.json and portforwardings.json")
+)
+
+func parse(fn string) ([]*uci.Section, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := uci.Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return sections, nil
+}
+
+func writeJSON(fn string, v interface{}) error {
+	if _, err := os.Stat(fn); err == nil {
+		return fmt.Errorf("%s already exists, not overwriting", fn)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, append(b, '\n'), 0644)
+}
+
+func logic() error {
+	nw, err := parse(*network)
+	if err != nil {
+		return err
+	}
+	fw, err := parse(*firewall)
+	if err != nil {
+		return err
+	}
+	res, err := uci.Convert(nw, fw)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(*outputDir, "interfaces.json"), res.Interfaces); err != nil {
+		return err
+	}
+	if len(res.PortForwardings.Forwardings) > 0 {
+		if err := writeJSON(filepath.Join(*outputDir, "portforwardings.json"), res.PortForwardings); err != nil {
+			return err
+		}
+	}
+	if len(res.Unsupported) > 0 {
+		fmt.Fprintf(os.Stderr, "Not converted (migrate manually):\n")
+		for _, u := range res.Unsupported {
+			fmt.Fprintf(os.Stderr, "  %s\n", u)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
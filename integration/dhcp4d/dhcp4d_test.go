@@ -0,0 +1,243 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package integration_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/dns"
+	"github.com/rtr7/router7/internal/testing/netns"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/krolaw/dhcp4"
+	"github.com/krolaw/dhcp4/conn"
+	miekgdns "github.com/miekg/dns"
+)
+
+const (
+	ns       = "ns5" // name of the network namespace to use for this test
+	routerIf = "veth5a"
+	clientIf = "veth5b"
+	routerIP = "192.168.42.1"
+)
+
+// waitFor polls fn until it returns true or a timeout expires.
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		if fn() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+// readBound returns the key=value pairs written by a client’s hook script.
+func readBound(fn string) map[string]string {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	bound := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if idx := strings.IndexByte(line, '='); idx > -1 {
+			bound[line[:idx]] = line[idx+1:]
+		}
+	}
+	return bound
+}
+
+// A client obtains a lease within n, sending hostname, configures the
+// address and returns the lease details.
+type client func(t *testing.T, n *netns.Namespace, dir, hostname string) map[string]string
+
+func udhcpc(t *testing.T, n *netns.Namespace, dir, hostname string) map[string]string {
+	if _, err := exec.LookPath("busybox"); err != nil {
+		t.Skip("busybox not found")
+	}
+	out := filepath.Join(dir, "bound")
+	script := filepath.Join(dir, "udhcpc.script")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+[ "$1" = bound ] || exit 0
+ip addr add "$ip/$mask" dev "$interface"
+printf 'ip=%s\nrouter=%s\ndns=%s\ndomain=%s\n' "$ip" "$router" "$dns" "$domain" > `+out+`
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	netns.Run(t, n.Command("busybox", "udhcpc",
+		"-i", clientIf,
+		"-s", script,
+		"-x", "hostname:"+hostname,
+		"-f", // foreground
+		"-q", // quit after obtaining a lease
+		"-n", // fail if no lease could be obtained
+		"-t", "5",
+		"-T", "1"))
+	return readBound(out)
+}
+
+func dhclient(t *testing.T, n *netns.Namespace, dir, hostname string) map[string]string {
+	if _, err := exec.LookPath("dhclient"); err != nil {
+		t.Skip("dhclient not found")
+	}
+	out := filepath.Join(dir, "bound")
+	script := filepath.Join(dir, "dhclient.script")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+[ "$reason" = BOUND ] || exit 0
+ip addr add "$new_ip_address/$new_subnet_mask" dev "$interface"
+printf 'ip=%s\nrouter=%s\ndns=%s\ndomain=%s\n' "$new_ip_address" "$new_routers" "$new_domain_name_servers" "$new_domain_name" > `+out+`
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cf := filepath.Join(dir, "dhclient.conf")
+	if err := ioutil.WriteFile(cf, []byte(fmt.Sprintf("send host-name %q;\n", hostname)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// dhclient(8) keeps running to renew the lease, so wait for the hook
+	// script instead of waiting for dhclient to exit.
+	cmd := n.Command("dhclient",
+		"-d", // foreground
+		"-v",
+		"-sf", script,
+		"-cf", cf,
+		"-lf", filepath.Join(dir, "dhclient.leases"),
+		"-pf", filepath.Join(dir, "dhclient.pid"),
+		clientIf)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	waitFor(t, "dhclient lease", func() bool { return readBound(out) != nil })
+	return readBound(out)
+}
+
+// TestDHCP4D runs dhcp4d and dnsd on the host end of a veth pair and obtains
+// leases using real DHCP clients within a network namespace. Run as root with:
+//
+//	go test -tags=integration ./integration/dhcp4d
+func TestDHCP4D(t *testing.T) {
+	n := netns.New(t, ns)
+	defer n.Delete()
+	n.Veth(t, routerIf, routerIP+"/24", clientIf)
+
+	tmp, err := ioutil.TempDir("", "router7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`{"interfaces":[{"name":"`+routerIf+`","addr":"`+routerIP+`/24"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// dnsd answers for hostnames from dhcp4d leases, like on the router,
+	// where dhcp4d notifies dnsd of new leases.
+	srv := dns.NewServer(routerIP+":53", "lan")
+	s := &miekgdns.Server{Addr: routerIP + ":53", Net: "udp", Handler: srv.Mux}
+	go s.ListenAndServe()
+	defer s.Shutdown()
+
+	handler, err := dhcp4d.NewHandler(tmp, nil, routerIf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := make(chan dhcp4d.Lease, 1)
+	handler.Leases = func(newLeases []*dhcp4d.Lease, l *dhcp4d.Lease) {
+		leases := make([]dhcp4d.Lease, len(newLeases))
+		for idx, nl := range newLeases {
+			leases[idx] = *nl
+		}
+		srv.SetLeases(leases)
+		select {
+		case latest <- *l:
+		default:
+		}
+	}
+	c, err := conn.NewUDP4BoundListener(routerIf, ":67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go dhcp4.Serve(c, handler)
+
+	for _, tt := range []struct {
+		name   string
+		client client
+	}{
+		{"udhcpc", udhcpc},
+		{"dhclient", dhclient},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(tmp, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer netns.Run(t, n.Command("ip", "addr", "flush", "dev", clientIf))
+			select {
+			case <-latest: // drain the previous client’s lease
+			default:
+			}
+
+			hostname := "integration-" + tt.name
+			bound := tt.client(t, n, dir, hostname)
+			ip := net.ParseIP(bound["ip"])
+			if ip == nil || !(&net.IPNet{IP: net.ParseIP(routerIP), Mask: net.CIDRMask(24, 32)}).Contains(ip) {
+				t.Fatalf("client obtained unexpected address %q", bound["ip"])
+			}
+			want := map[string]string{
+				"ip":     ip.String(),
+				"router": routerIP,
+				"dns":    routerIP,
+				"domain": "lan",
+			}
+			if diff := cmp.Diff(want, bound); diff != "" {
+				t.Fatalf("unexpected lease: diff (-want +got):\n%s", diff)
+			}
+
+			select {
+			case l := <-latest:
+				if got, want := l.Hostname, hostname; got != want {
+					t.Errorf("lease hostname: got %q, want %q", got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("dhcp4d did not hand out a lease")
+			}
+
+			dig := n.Command("dig", "+timeout=1", "+short", "@"+routerIP, hostname+".lan")
+			dig.Stderr = os.Stderr
+			out, err := dig.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.TrimSpace(string(out)), ip.String(); got != want {
+				t.Errorf("dig %s.lan: got %q, want %q", hostname, got, want)
+			}
+		})
+	}
+}
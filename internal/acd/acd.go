@@ -0,0 +1,281 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package acd implements IPv4 address conflict detection (RFC 5227) for the
+// addresses router7 assigns to its own interfaces: addresses can be probed
+// before they are assigned, and assigned addresses are watched for ARP
+// packets of other hosts which use them, too (e.g. a device with a static
+// address which was copied from the router’s configuration).
+package acd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+)
+
+// Timing constants from RFC 5227, section 1.1. They are variables so that
+// tests can shorten them.
+var (
+	probeWait        = 1 * time.Second // initial random delay
+	probeNum         = 3               // number of probe packets
+	probeMin         = 1 * time.Second // minimum delay until repeated probe
+	probeMax         = 2 * time.Second // maximum delay until repeated probe
+	announceWait     = 2 * time.Second // delay before announcing
+	announceNum      = 2               // number of announcement packets
+	announceInterval = 2 * time.Second // time between announcement packets
+	defendInterval   = 10 * time.Second
+)
+
+// Config configures address conflict detection, see ReadConfig.
+type Config struct {
+	// Interfaces whose IPv4 addresses are watched for conflicts (default
+	// lan0 and uplink0).
+	Interfaces []string `json:"interfaces"`
+
+	// Refuse makes netconfigd probe addresses before assigning them to
+	// Interfaces, and not assign conflicting addresses. Probing delays
+	// assigning a new address by up to 7 seconds.
+	Refuse bool `json:"refuse"`
+}
+
+// Watched returns whether ifname is one of c.Interfaces.
+func (c *Config) Watched(ifname string) bool {
+	for _, i := range c.Interfaces {
+		if i == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadConfig reads acd.json from dir. A missing file results in the default
+// configuration: conflicts are detected on lan0 and uplink0, but addresses
+// are assigned regardless.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "acd.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var c Config
+	if err == nil {
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	if c.Interfaces == nil {
+		c.Interfaces = []string{"lan0", "uplink0"}
+	}
+	return &c, nil
+}
+
+// Conflict describes another host using an address of router7.
+type Conflict struct {
+	Interface    string    `json:"interface"`
+	Addr         string    `json:"addr"`
+	HardwareAddr string    `json:"hardware_addr"` // of the other host
+	Time         time.Time `json:"time"`
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s on %s is in use by %s", c.Addr, c.Interface, c.HardwareAddr)
+}
+
+var ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// arpRequest returns an ethernet frame containing an ARP request from hwaddr
+// for target. RFC 5227 probes have an all-zero sender address, announcements
+// have the announced address as sender and target address.
+func arpRequest(hwaddr net.HardwareAddr, sender, target net.IP) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{},
+		&layers.Ethernet{
+			SrcMAC:       hwaddr,
+			DstMAC:       ethernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   hwaddr,
+			SourceProtAddress: sender.To4(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    target.To4(),
+		})
+	return buf.Bytes(), err
+}
+
+// conflict returns the hardware address of the host which sent frame if frame
+// is an ARP packet from a host other than hwaddr which uses ip (RFC 5227,
+// section 2.1.1 and 2.4), or nil otherwise. If probing is true, ARP probes
+// for ip sent by other hosts are conflicts, too.
+func conflict(frame []byte, hwaddr net.HardwareAddr, ip net.IP, probing bool) net.HardwareAddr {
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok ||
+		arp.Protocol != layers.EthernetTypeIPv4 ||
+		bytes.Equal(arp.SourceHwAddress, hwaddr) {
+		return nil
+	}
+	sender := net.IP(arp.SourceProtAddress)
+	if sender.Equal(ip) {
+		return net.HardwareAddr(append([]byte(nil), arp.SourceHwAddress...))
+	}
+	if probing &&
+		arp.Operation == layers.ARPRequest &&
+		sender.Equal(net.IPv4zero) &&
+		net.IP(arp.DstProtAddress).Equal(ip) {
+		return net.HardwareAddr(append([]byte(nil), arp.SourceHwAddress...))
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func randDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// probe sends ARP probes for ip on conn and returns the hardware address of
+// the first host which uses ip, or nil if there is none.
+func probe(conn net.PacketConn, hwaddr net.HardwareAddr, ip net.IP) (net.HardwareAddr, error) {
+	frame, err := arpRequest(hwaddr, net.IPv4zero, ip)
+	if err != nil {
+		return nil, err
+	}
+	sendAt := make([]time.Time, probeNum)
+	next := time.Now().Add(randDuration(0, probeWait))
+	for i := range sendAt {
+		sendAt[i] = next
+		next = next.Add(randDuration(probeMin, probeMax))
+	}
+	// After the last probe, wait for replies for announceWait.
+	end := sendAt[len(sendAt)-1].Add(announceWait)
+	buf := make([]byte, 1500)
+	for sent := 0; ; {
+		deadline := end
+		if sent < len(sendAt) {
+			deadline = sendAt[sent]
+		}
+		if !time.Now().Before(deadline) {
+			if sent == len(sendAt) {
+				return nil, nil
+			}
+			if _, err := conn.WriteTo(frame, &raw.Addr{HardwareAddr: ethernetBroadcast}); err != nil {
+				return nil, err
+			}
+			sent++
+			continue
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+		if other := conflict(buf[:n], hwaddr, ip, true); other != nil {
+			return other, nil
+		}
+	}
+}
+
+// announce sends count ARP announcements for ip on conn.
+func announce(conn net.PacketConn, hwaddr net.HardwareAddr, ip net.IP, count int) error {
+	frame, err := arpRequest(hwaddr, ip, ip)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		if _, err := conn.WriteTo(frame, &raw.Addr{HardwareAddr: ethernetBroadcast}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listen(ifname string) (*net.Interface, net.PacketConn, error) {
+	ifc, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := raw.ListenPacket(ifc, syscall.ETH_P_ARP, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ifc, conn, nil
+}
+
+// Probe checks whether another host on ifname uses ip, before ip is assigned
+// to ifname (RFC 5227, section 2.1). It returns the conflict, or nil if ip is
+// not in use.
+func Probe(ifname string, ip net.IP) (*Conflict, error) {
+	ifc, conn, err := listen(ifname)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	other, err := probe(conn, ifc.HardwareAddr, ip)
+	if err != nil || other == nil {
+		return nil, err
+	}
+	return &Conflict{
+		Interface:    ifname,
+		Addr:         ip.String(),
+		HardwareAddr: other.String(),
+		Time:         time.Now(),
+	}, nil
+}
+
+// Announce announces that ip was assigned to ifname (RFC 5227, section 2.3),
+// so that other hosts update stale ARP cache entries. It blocks for
+// announceInterval between announcements.
+func Announce(ifname string, ip net.IP) error {
+	ifc, conn, err := listen(ifname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return announce(conn, ifc.HardwareAddr, ip, announceNum)
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var (
+	ownHWAddr   = net.HardwareAddr{0x00, 0x0d, 0xb9, 0x49, 0x70, 0x18}
+	otherHWAddr = net.HardwareAddr{0xdc, 0x9b, 0x9c, 0xee, 0x72, 0xfd}
+	ownIP       = net.ParseIP("192.168.42.1")
+)
+
+func mustARPRequest(t *testing.T, hwaddr net.HardwareAddr, sender, target net.IP) []byte {
+	t.Helper()
+	frame, err := arpRequest(hwaddr, sender, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestConflict(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		frame   []byte
+		probing bool
+		want    net.HardwareAddr
+	}{
+		{
+			name:  "AnnouncementFromOtherHost",
+			frame: mustARPRequest(t, otherHWAddr, ownIP, ownIP),
+			want:  otherHWAddr,
+		},
+		{
+			name:  "RequestFromOtherHost",
+			frame: mustARPRequest(t, otherHWAddr, ownIP, net.ParseIP("192.168.42.23")),
+			want:  otherHWAddr,
+		},
+		{
+			name:  "OwnAnnouncement",
+			frame: mustARPRequest(t, ownHWAddr, ownIP, ownIP),
+		},
+		{
+			name:  "RequestForOwnAddress",
+			frame: mustARPRequest(t, otherHWAddr, net.ParseIP("192.168.42.23"), ownIP),
+		},
+		{
+			name:  "ProbeWhileNotProbing",
+			frame: mustARPRequest(t, otherHWAddr, net.IPv4zero, ownIP),
+		},
+		{
+			name:    "SimultaneousProbe",
+			frame:   mustARPRequest(t, otherHWAddr, net.IPv4zero, ownIP),
+			probing: true,
+			want:    otherHWAddr,
+		},
+		{
+			name:    "ProbeForOtherAddress",
+			frame:   mustARPRequest(t, otherHWAddr, net.IPv4zero, net.ParseIP("192.168.42.23")),
+			probing: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := conflict(tt.frame, ownHWAddr, ownIP, tt.probing)
+			if got.String() != tt.want.String() {
+				t.Fatalf("conflict() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// fakeConn answers the frames written to it using respond.
+type fakeConn struct {
+	net.PacketConn // nil, panics when unexpected methods are called
+
+	respond func(frame []byte) []byte
+
+	mu       sync.Mutex
+	written  int
+	pending  chan []byte
+	deadline time.Time
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.written++
+	c.mu.Unlock()
+	if reply := c.respond(b); reply != nil {
+		c.pending <- reply
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	select {
+	case frame := <-c.pending:
+		return copy(b, frame), nil, nil
+	case <-time.After(time.Until(deadline)):
+		return 0, nil, timeoutError{}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	defer func(wait, min, max, announce time.Duration) {
+		probeWait, probeMin, probeMax, announceWait = wait, min, max, announce
+	}(probeWait, probeMin, probeMax, announceWait)
+	probeWait = 0
+	probeMin = 1 * time.Millisecond
+	probeMax = 2 * time.Millisecond
+	announceWait = 10 * time.Millisecond
+
+	t.Run("Unused", func(t *testing.T) {
+		conn := &fakeConn{
+			respond: func([]byte) []byte { return nil },
+			pending: make(chan []byte, 1),
+		}
+		got, err := probe(conn, ownHWAddr, ownIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != nil {
+			t.Fatalf("probe() = %v, want nil", got)
+		}
+		if conn.written != probeNum {
+			t.Fatalf("probe() sent %d probes, want %d", conn.written, probeNum)
+		}
+	})
+
+	t.Run("InUse", func(t *testing.T) {
+		conn := &fakeConn{
+			// The other host replies to the probe, using the address.
+			respond: func([]byte) []byte {
+				return mustARPRequest(t, otherHWAddr, ownIP, ownIP)
+			},
+			pending: make(chan []byte, 1),
+		}
+		got, err := probe(conn, ownHWAddr, ownIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != otherHWAddr.String() {
+			t.Fatalf("probe() = %v, want %v", got, otherHWAddr)
+		}
+		if conn.written != 1 {
+			t.Fatalf("probe() sent %d probes, want 1", conn.written)
+		}
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	w := &watcher{
+		ifname: "lan0",
+		hwaddr: ownHWAddr,
+		addrs: func() ([]net.IP, error) {
+			return []net.IP{ownIP}, nil
+		},
+		defended: make(map[string]time.Time),
+	}
+	now := time.Now()
+	frame := mustARPRequest(t, otherHWAddr, ownIP, net.ParseIP("192.168.42.23"))
+	got, err := w.inspect(frame, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Conflict{
+		Interface:    "lan0",
+		Addr:         "192.168.42.1",
+		HardwareAddr: otherHWAddr.String(),
+		Time:         now,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("inspect: unexpected conflict: diff (-want +got):\n%s", diff)
+	}
+
+	// Within defendInterval, the conflict is not reported again.
+	if got, _ := w.inspect(frame, now.Add(defendInterval/2)); got != nil {
+		t.Fatalf("inspect(within defendInterval) = %v, want nil", got)
+	}
+	if got, _ := w.inspect(frame, now.Add(defendInterval)); got == nil {
+		t.Fatalf("inspect(after defendInterval) = nil, want conflict")
+	}
+
+	// router7’s own packets are not conflicts.
+	own := mustARPRequest(t, ownHWAddr, ownIP, ownIP)
+	if got, _ := w.inspect(own, now.Add(2*defendInterval)); got != nil {
+		t.Fatalf("inspect(own announcement) = %v, want nil", got)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "acd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg, err := ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{Interfaces: []string{"lan0", "uplink0"}}
+	if diff := cmp.Diff(want, cfg); diff != "" {
+		t.Fatalf("ReadConfig(missing file): diff (-want +got):\n%s", diff)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "acd.json"), []byte(`{"interfaces": ["lan0"], "refuse": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &Config{Interfaces: []string{"lan0"}, Refuse: true}
+	if diff := cmp.Diff(want, cfg); diff != "" {
+		t.Fatalf("ReadConfig: diff (-want +got):\n%s", diff)
+	}
+	if cfg.Watched("uplink0") {
+		t.Errorf("Watched(uplink0) = true, want false")
+	}
+}
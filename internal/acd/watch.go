@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acd
+
+import (
+	"net"
+	"time"
+)
+
+// addrRefresh is how long the addresses of a watched interface are cached.
+const addrRefresh = 10 * time.Second
+
+// watcher detects conflicts with the addresses of one interface.
+type watcher struct {
+	ifname string
+	hwaddr net.HardwareAddr
+	addrs  func() ([]net.IP, error)
+
+	cached    []net.IP
+	refreshed time.Time
+	defended  map[string]time.Time // key: address
+}
+
+func interfaceAddrs(ifc *net.Interface) func() ([]net.IP, error) {
+	return func() ([]net.IP, error) {
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				ips = append(ips, ip4)
+			}
+		}
+		return ips, nil
+	}
+}
+
+// inspect returns the conflict indicated by frame, if any, whose address is
+// to be defended. Conflicts are only returned once per defendInterval per
+// address, so that a misconfigured host does not flood the log or the
+// network.
+func (w *watcher) inspect(frame []byte, now time.Time) (*Conflict, error) {
+	if now.Sub(w.refreshed) > addrRefresh {
+		addrs, err := w.addrs()
+		if err != nil {
+			return nil, err
+		}
+		w.cached = addrs
+		w.refreshed = now
+	}
+	for _, ip := range w.cached {
+		other := conflict(frame, w.hwaddr, ip, false)
+		if other == nil {
+			continue
+		}
+		key := ip.String()
+		if last, ok := w.defended[key]; ok && now.Sub(last) < defendInterval {
+			return nil, nil
+		}
+		w.defended[key] = now
+		return &Conflict{
+			Interface:    w.ifname,
+			Addr:         key,
+			HardwareAddr: other.String(),
+			Time:         now,
+		}, nil
+	}
+	return nil, nil
+}
+
+// Watch watches ifname for ARP packets of other hosts which use one of its
+// IPv4 addresses, until reading packets fails. report is called for each
+// conflict (at most once per 10 seconds per address), after router7 defended
+// its address by announcing it: like other routers, router7 keeps its
+// addresses instead of giving them up (RFC 5227, section 2.4 (c)).
+func Watch(ifname string, report func(Conflict)) error {
+	ifc, conn, err := listen(ifname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	w := &watcher{
+		ifname:   ifname,
+		hwaddr:   ifc.HardwareAddr,
+		addrs:    interfaceAddrs(ifc),
+		defended: make(map[string]time.Time),
+	}
+	buf := make([]byte, ifc.MTU+14) // MTU plus ethernet header
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		c, err := w.inspect(buf[:n], time.Now())
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		if err := announce(conn, ifc.HardwareAddr, net.ParseIP(c.Addr), 1); err != nil {
+			return err
+		}
+		report(*c)
+	}
+}
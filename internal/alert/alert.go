@@ -0,0 +1,286 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alert sends e-mail alerts for critical events (e.g. the WAN
+// connection being down) via an SMTP relay.
+package alert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the alerting configuration, stored in alert.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	SMTP SMTPConfig `json:"smtp"`
+
+	From string   `json:"from"` // e.g. router7@example.com
+	To   []string `json:"to"`
+
+	// WANDownAfter is how long the WAN connection needs to be down before
+	// diagd sends an alert, e.g. “10m”, defaults to 5m.
+	WANDownAfter string `json:"wan_down_after"`
+
+	// DiskFullPercent is the usage of /perm above which diagd sends an
+	// alert, defaults to 90.
+	DiskFullPercent float64 `json:"disk_full_percent"`
+
+	// Interval is the minimum time between two alerts for the same event,
+	// e.g. “6h”, defaults to 1h.
+	Interval string `json:"interval"`
+}
+
+// SMTPConfig configures the SMTP relay.
+type SMTPConfig struct {
+	// Server is the host:port of the relay, e.g. smtp.example.com:587.
+	Server string `json:"server"`
+
+	// TLS is “starttls” (default), “tls” (implicit TLS, typically port
+	// 465) or “none” (only for relays on the LAN).
+	TLS string `json:"tls"`
+
+	// Username and Password are used for PLAIN authentication, if set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// WANDownAfterDuration returns the parsed WANDownAfter.
+func (c *Config) WANDownAfterDuration() (time.Duration, error) {
+	if c.WANDownAfter == "" {
+		return 5 * time.Minute, nil
+	}
+	return time.ParseDuration(c.WANDownAfter)
+}
+
+// IntervalDuration returns the parsed Interval.
+func (c *Config) IntervalDuration() (time.Duration, error) {
+	if c.Interval == "" {
+		return 1 * time.Hour, nil
+	}
+	return time.ParseDuration(c.Interval)
+}
+
+// DiskFull returns the configured DiskFullPercent or its default.
+func (c *Config) DiskFull() float64 {
+	if c.DiskFullPercent == 0 {
+		return 90
+	}
+	return c.DiskFullPercent
+}
+
+// ReadConfig reads alert.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "alert.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if !cfg.Enabled {
+		return &cfg, nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.SMTP.Server); err != nil {
+		return nil, fmt.Errorf("%s: smtp.server: %v", fn, err)
+	}
+	switch cfg.SMTP.TLS {
+	case "", "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("%s: smtp.tls: unknown mode %q", fn, cfg.SMTP.TLS)
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("%s: from and to must be set", fn)
+	}
+	for _, d := range []func() (time.Duration, error){cfg.WANDownAfterDuration, cfg.IntervalDuration} {
+		if _, err := d(); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// Message returns the RFC 5322 e-mail for an alert.
+func (c *Config) Message(subject, body string, now time.Time) []byte {
+	var buf bytes.Buffer
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "router7"
+	}
+	fmt.Fprintf(&buf, "From: %s\r\n", c.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "["+hostname+"] "+subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	if !strings.HasSuffix(body, "\n") {
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// Send delivers msg via the configured SMTP relay.
+func (c *Config) Send(msg []byte) error {
+	host, _, err := net.SplitHostPort(c.SMTP.Server)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if c.SMTP.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.SMTP.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.SMTP.Server)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(1 * time.Minute))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if c.SMTP.TLS == "" || c.SMTP.TLS == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS: %v", err)
+		}
+	}
+	if c.SMTP.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.SMTP.Username, c.SMTP.Password, host)); err != nil {
+			return fmt.Errorf("AUTH: %v", err)
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Alerter sends alerts, suppressing repeated alerts for the same event.
+type Alerter struct {
+	dir string
+
+	// send is Config.Send, overridden in tests.
+	send func(cfg *Config, msg []byte) error
+
+	mu   sync.Mutex
+	cfg  *Config
+	last map[string]time.Time // by event key
+}
+
+// NewAlerter returns an Alerter configured by alert.json in dir.
+func NewAlerter(dir string) *Alerter {
+	a := &Alerter{
+		dir:  dir,
+		send: (*Config).Send,
+		cfg:  &Config{},
+		last: make(map[string]time.Time),
+	}
+	if err := a.Reload(); err != nil {
+		log.Printf("alert: %v", err)
+	}
+	return a
+}
+
+// Reload re-reads alert.json, e.g. on SIGUSR1.
+func (a *Alerter) Reload() error {
+	cfg, err := ReadConfig(a.dir)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = cfg
+	return nil
+}
+
+// Config returns the current configuration.
+func (a *Alerter) Config() *Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+// Alert sends an e-mail with subject and body (in a separate goroutine) unless
+// alerting is disabled or an alert for the same key (e.g. “wan-down”) was
+// sent within the configured Interval.
+func (a *Alerter) Alert(key, subject, body string) {
+	now := time.Now()
+	a.mu.Lock()
+	cfg := a.cfg
+	if !cfg.Enabled {
+		a.mu.Unlock()
+		return
+	}
+	interval, _ := cfg.IntervalDuration() // validated in ReadConfig
+	if last, ok := a.last[key]; ok && now.Sub(last) < interval {
+		a.mu.Unlock()
+		return
+	}
+	a.last[key] = now
+	a.mu.Unlock()
+
+	msg := cfg.Message(subject, body, now)
+	go func() {
+		if err := a.send(cfg, msg); err != nil {
+			log.Printf("alert: sending %q: %v", subject, err)
+		}
+	}()
+}
+
+// Resolved allows the next alert for key to be sent immediately, e.g. once
+// the WAN connection is back up.
+func (a *Alerter) Resolved(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.last, key)
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "alert.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"enabled": true, "smtp": {"server": "smtp.example.com"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(dir); err == nil {
+		t.Errorf("ReadConfig unexpectedly accepted a server without port")
+	}
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "enabled": true,
+  "smtp": {"server": "smtp.example.com:587"},
+  "from": "router7@example.com",
+  "to": ["admin@example.com", "oncall@example.com"]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 10)
+	a := NewAlerter(dir)
+	a.send = func(cfg *Config, msg []byte) error {
+		sent <- msg
+		return nil
+	}
+	if !a.Config().Enabled {
+		t.Fatalf("alerting unexpectedly disabled")
+	}
+
+	a.Alert("wan-down", "WAN connection down", "uplink0: no carrier\n")
+	msg := string(<-sent)
+	for _, want := range []string{
+		"From: router7@example.com\r\n",
+		"To: admin@example.com, oncall@example.com\r\n",
+		"WAN connection down\r\n",
+		"\r\n\r\nuplink0: no carrier\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q does not contain %q", msg, want)
+		}
+	}
+
+	a.Alert("disk-full", "/perm nearly full", "")
+	// Repeated alerts are suppressed for the configured interval…
+	a.Alert("wan-down", "WAN connection down", "")
+	// …unless the event was resolved in the meantime.
+	a.Resolved("wan-down")
+	a.Alert("wan-down", "WAN connection down", "")
+	var got []string
+	for len(got) < 2 {
+		select {
+		case msg := <-sent:
+			got = append(got, string(msg))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for alerts, got %q", got)
+		}
+	}
+	for _, want := range []string{"/perm nearly full", "WAN connection down"} {
+		if !strings.Contains(strings.Join(got, ""), want) {
+			t.Errorf("no %q alert sent, got %q", want, got)
+		}
+	}
+	select {
+	case msg := <-sent:
+		t.Errorf("unexpected message %q", msg)
+	default:
+	}
+}
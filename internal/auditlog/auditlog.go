@@ -0,0 +1,217 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auditlog records state-changing administrative actions (e.g.
+// importing static leases or cutting a device’s internet access) in an
+// append-only log, so that it can be reconstructed who changed what, and when.
+package auditlog
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/auth"
+)
+
+// Entry is an administrative action.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Daemon string    `json:"daemon"` // e.g. netconfigd
+	Action string    `json:"action"` // e.g. killswitch-cut
+
+	// User is the authenticated user (see auth.RequirePassword), which
+	// audited endpoints require.
+	User string `json:"user,omitempty"`
+	Addr string `json:"addr"` // IP address of the client
+
+	// Before and After are the affected state before and after the
+	// action, if applicable (e.g. null before adding an entry).
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Actor returns who performed the action: the authenticated user (if any)
+// and the client IP address.
+func (e *Entry) Actor() string {
+	if e.User != "" {
+		return e.User + "@" + e.Addr
+	}
+	return e.Addr
+}
+
+// Log appends the entries of one daemon to <dir>/audit/<daemon>.jsonl. The
+// file is only ever appended to, one JSON object per line.
+type Log struct {
+	daemon string
+	path   string
+	now    func() time.Time
+
+	mu sync.Mutex
+}
+
+// Path returns the file name of the audit log of daemon in dir (e.g. /perm).
+func Path(dir, daemon string) string {
+	return filepath.Join(dir, "audit", daemon+".jsonl")
+}
+
+// New returns the audit log of daemon in dir (e.g. /perm).
+func New(dir, daemon string) *Log {
+	return &Log{
+		daemon: daemon,
+		path:   Path(dir, daemon),
+		now:    time.Now,
+	}
+}
+
+// clientAddr returns the IP address of the client which sent r.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// Record appends action, performed by the client of r, to the log. before and
+// after are marshaled as JSON; nil values are omitted.
+func (l *Log) Record(r *http.Request, action string, before, after interface{}) error {
+	e := Entry{
+		Time:   l.now(),
+		Daemon: l.daemon,
+		Action: action,
+		User:   auth.UserOf(r),
+		Addr:   clientAddr(r),
+	}
+	for _, v := range []struct {
+		val interface{}
+		dst *json.RawMessage
+	}{
+		{before, &e.Before},
+		{after, &e.After},
+	} {
+		if v.val == nil {
+			continue
+		}
+		b, err := json.Marshal(v.val)
+		if err != nil {
+			return err
+		}
+		*v.dst = b
+	}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns the entries of all daemons in dir, oldest first. Lines which
+// cannot be parsed are skipped.
+func Read(dir string) ([]Entry, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(dir, "audit"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []Entry
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".jsonl") {
+			continue
+		}
+		fn := filepath.Join(dir, "audit", fi.Name())
+		read, err := readFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		entries = append(entries, read...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+func readFile(fn string) ([]Entry, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // e.g. partially written before a power loss
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// WriteCSV writes entries as CSV, e.g. for importing into a spreadsheet.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"time", "daemon", "action", "user", "addr", "before", "after"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := cw.Write([]string{
+			e.Time.Format(time.RFC3339),
+			e.Daemon,
+			e.Action,
+			e.User,
+			e.Addr,
+			string(e.Before),
+			string(e.After),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
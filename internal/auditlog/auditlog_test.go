@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecordRead(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	netconfigd := New(tmp, "netconfigd")
+	netconfigd.now = func() time.Time { return now.Add(1 * time.Minute) }
+	dhcp4d := New(tmp, "dhcp4d")
+	dhcp4d.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("POST", "/killswitch", nil)
+	r.RemoteAddr = "192.168.42.23:51234"
+	type client struct {
+		Addr string `json:"addr"`
+	}
+	if err := netconfigd.Record(r, "killswitch-cut", nil, client{"192.168.42.99"}); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("POST", "/import", nil)
+	r.RemoteAddr = "127.0.0.1:4711"
+	// Any local process could forge X-Forwarded-For, so it is ignored.
+	r.Header.Set("X-Forwarded-For", "10.0.0.5")
+	if err := dhcp4d.Record(r, "import-static", []string{"a"}, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partially written line is skipped.
+	f, err := os.OpenFile(filepath.Join(tmp, "audit", "dhcp4d.jsonl"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"time": "2018-`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{
+			Time:   now,
+			Daemon: "dhcp4d",
+			Action: "import-static",
+			Addr:   "127.0.0.1",
+			Before: json.RawMessage(`["a"]`),
+			After:  json.RawMessage(`["b"]`),
+		},
+		{
+			Time:   now.Add(1 * time.Minute),
+			Daemon: "netconfigd",
+			Action: "killswitch-cut",
+			Addr:   "192.168.42.23",
+			After:  json.RawMessage(`{"addr":"192.168.42.99"}`),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Read: unexpected entries: diff (-want +got):\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, got); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if got, want := len(lines), 3; got != want {
+		t.Fatalf("WriteCSV: got %d lines, want %d", got, want)
+	}
+	if got, want := lines[2], `2018-07-01T12:01:00Z,netconfigd,killswitch-cut,,192.168.42.23,,"{""addr"":""192.168.42.99""}"`; got != want {
+		t.Errorf("WriteCSV: unexpected line: got %q, want %q", got, want)
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	entries, err := Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Read(empty dir) = %v, want no entries", entries)
+	}
+}
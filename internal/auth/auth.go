@@ -0,0 +1,78 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth protects sensitive HTTP endpoints of router7 daemons (e.g.
+// packet captures or runtime profiles) with the gokrazy web interface
+// password.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// User is the HTTP basic authentication user name, as used by the gokrazy web
+// interface.
+const User = "gokrazy"
+
+// passwordPath is where gokrazy stores its web interface password. It is a
+// variable so that tests can override it.
+var passwordPath = "/etc/gokr-pw.txt"
+
+// Password returns the gokrazy web interface password, e.g. for daemons
+// calling protected endpoints of other daemons.
+func Password() (string, error) {
+	b, err := ioutil.ReadFile(passwordPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// RequirePassword protects h with HTTP basic authentication using the gokrazy
+// web interface password. realm identifies the daemon in the browser’s
+// password prompt.
+//
+// The password is read on each request, so daemons do not fail to start if it
+// is not (yet) available: requests are rejected until it is.
+func RequirePassword(realm string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw, err := Password()
+		if err != nil {
+			log.Printf("reading gokrazy password: %v", err)
+			http.Error(w, "gokrazy password unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != User || pw == "" || subtle.ConstantTimeCompare([]byte(pass), []byte(pw)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+type userKey struct{}
+
+// UserOf returns the user which authenticated r via RequirePassword, or the
+// empty string if r was not authenticated.
+func UserOf(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequirePassword(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	defer func(path string) { passwordPath = path }(passwordPath)
+	passwordPath = filepath.Join(tmp, "gokr-pw.txt")
+
+	h := RequirePassword("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := UserOf(r), User; got != want {
+			t.Errorf("UserOf(authenticated request) = %q, want %q", got, want)
+		}
+		w.Write([]byte("secret"))
+	}))
+
+	status := func(user, pass string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a password file, all requests are rejected.
+	if got, want := status(User, ""), http.StatusServiceUnavailable; got != want {
+		t.Fatalf("without password file: got HTTP status %d, want %d", got, want)
+	}
+
+	if err := ioutil.WriteFile(passwordPath, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{User, "wrong", http.StatusUnauthorized},
+		{"root", "hunter2", http.StatusUnauthorized},
+		{User, "hunter2", http.StatusOK},
+	} {
+		if got := status(tt.user, tt.pass); got != tt.want {
+			t.Errorf("status(%q, %q) = %d, want %d", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestUserOfUnauthenticated(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(User, "unverified")
+	if got := UserOf(req); got != "" {
+		t.Errorf("UserOf(unauthenticated request) = %q, want \"\"", got)
+	}
+}
@@ -68,3 +68,80 @@ func TestArchive(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestExportImportConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "backuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const wireguard = `{"interfaces":[{"name":"wg0","private_key":"gBCoSz3DbmNaw0LHLBs2vW3iiybh/4vGQ/NkwvdsbFw=","port":51820}]}`
+	for fn, contents := range map[string]string{
+		"wireguard.json":      wireguard,
+		"interfaces.json":     `{"interfaces":[{"name":"lan0","addr":"192.168.42.1/24"}]}`,
+		"dhcp4d/leases.json":  "[]", // state, not configuration
+		"threatintel.json":    `{"feeds":[],"webhook_url":""}`,
+		"maintenance.json":    `{}`,
+		"rogued/blocked.json": "{}",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, fn)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := backup.ExportConfig(&buf, tmp, true); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.Bytes()
+
+	tmpout, err := ioutil.TempDir("", "backuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpout)
+	tar := exec.Command("tar", "xzf", "-", "-C", tmpout)
+	tar.Stdin = bytes.NewReader(export)
+	tar.Stderr = os.Stderr
+	if err := tar.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpout, "dhcp4d", "leases.json")); !os.IsNotExist(err) {
+		t.Errorf("state file dhcp4d/leases.json unexpectedly exported")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmpout, "wireguard.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("gBCoSz3D")) {
+		t.Fatalf("private key not redacted: %s", b)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(tmpout, "REDACTED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "wireguard.json.interfaces[0].private_key\n"; got != want {
+		t.Errorf("unexpected REDACTED file: got %q, want %q", got, want)
+	}
+
+	// Importing a redacted export retains the current secrets.
+	if _, err := backup.ImportConfig(bytes.NewReader(export), tmp); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(tmp, "wireguard.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("gBCoSz3DbmNaw0LHLBs2vW3iiybh/4vGQ/NkwvdsbFw=")) {
+		t.Fatalf("private key not retained: %s", b)
+	}
+
+	// Importing a redacted export into a router without those secrets fails.
+	if _, err := backup.ImportConfig(bytes.NewReader(export), tmpout); err == nil {
+		t.Fatalf("ImportConfig unexpectedly succeeded without secrets to retain")
+	}
+}
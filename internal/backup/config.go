@@ -0,0 +1,289 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// ConfigFiles are the configuration files (relative to /perm) which
+// ExportConfig includes. State files (e.g. leases) are not included.
+var ConfigFiles = []string{
+	"interfaces.json",
+	"networks.json",
+	"portforwardings.json",
+	"wireguard.json",
+	"dhcp4d.json",
+	"radvd.json",
+	"dhcp6d.json",
+	"dhcp6/duid",
+	"devices.json",
+	"geoblock.json",
+	"nfqueue.json",
+	"dnsd.json",
+	"threatintel.json",
+	"dyndns.json",
+	"certd.json",
+	"alert.json",
+	"status.json",
+	"presence.json",
+	"telemetry.json",
+	"accounting.json",
+	"savi.json",
+	"forcedns.json",
+	"nptv6.json",
+	"services.json",
+	"sni.json",
+	"ikev2.json",
+	"tailscale.json",
+	"maintenance.json",
+	"metricspush.json",
+}
+
+// Redacted replaces secret values in redacted configuration exports.
+const Redacted = "<redacted>"
+
+// secretKey returns whether the JSON object key holds a secret (e.g. a
+// WireGuard private key, a password or an API token).
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"private_key", "preshared_key", "auth_key", "password", "secret", "token"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	// Webhook URLs typically contain a token (e.g. Slack, Discord).
+	return key == "webhook_url"
+}
+
+// redact replaces all secret string values in v and returns their paths.
+func redact(v interface{}, path string) []string {
+	var paths []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if s, ok := v[key].(string); ok && s != "" && secretKey(key) {
+				v[key] = Redacted
+				paths = append(paths, path+"."+key)
+				continue
+			}
+			paths = append(paths, redact(v[key], path+"."+key)...)
+		}
+	case []interface{}:
+		for idx, el := range v {
+			paths = append(paths, redact(el, fmt.Sprintf("%s[%d]", path, idx))...)
+		}
+	}
+	return paths
+}
+
+// unredact replaces all Redacted values in v with the value at the same
+// location in current.
+func unredact(v, current interface{}, path string) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		cur, _ := current.(map[string]interface{})
+		for key, val := range v {
+			if s, ok := val.(string); ok && s == Redacted {
+				orig, ok := cur[key].(string)
+				if !ok || orig == Redacted {
+					return fmt.Errorf("%s.%s: redacted, but not currently configured", path, key)
+				}
+				v[key] = orig
+				continue
+			}
+			if err := unredact(val, cur[key], path+"."+key); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		cur, _ := current.([]interface{})
+		for idx, el := range v {
+			var c interface{}
+			if idx < len(cur) {
+				c = cur[idx]
+			}
+			if err := unredact(el, c, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// marshal is like json.MarshalIndent, but does not escape Redacted.
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExportConfig writes a tarball of the ConfigFiles present in dir to w. If
+// redactSecrets is true, secret values in JSON files are replaced with
+// Redacted (and listed in the file REDACTED), so that the export can be shared
+// e.g. in bug reports.
+func ExportConfig(w io.Writer, dir string, redactSecrets bool) error {
+	gw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+
+	now := time.Now()
+	add := func(name string, b []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	var redacted []string
+	for _, fn := range ConfigFiles {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if redactSecrets && strings.HasSuffix(fn, ".json") {
+			var v interface{}
+			if err := json.Unmarshal(b, &v); err != nil {
+				return fmt.Errorf("%s: %v", fn, err)
+			}
+			paths := redact(v, fn)
+			if len(paths) > 0 {
+				redacted = append(redacted, paths...)
+				if b, err = marshal(v); err != nil {
+					return err
+				}
+			}
+		}
+		if err := add(fn, b); err != nil {
+			return err
+		}
+	}
+	if len(redacted) > 0 {
+		if err := add("REDACTED", []byte(strings.Join(redacted, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ImportConfig restores the configuration files contained in the tarball r
+// (as created by ExportConfig) into dir and returns their names. Redacted
+// values are retained from the current configuration, and the import fails
+// without modifying dir if that is not possible or if the tarball contains
+// files other than ConfigFiles.
+func ImportConfig(r io.Reader, dir string) ([]string, error) {
+	known := make(map[string]bool, len(ConfigFiles))
+	for _, fn := range ConfigFiles {
+		known[fn] = true
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	contents := make(map[string][]byte)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == "REDACTED" {
+			continue
+		}
+		if !known[hdr.Name] {
+			return nil, fmt.Errorf("%s: not a configuration file", hdr.Name)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(hdr.Name, ".json") && bytes.Contains(b, []byte(Redacted)) {
+			var v interface{}
+			if err := json.Unmarshal(b, &v); err != nil {
+				return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+			var current interface{}
+			if cur, err := ioutil.ReadFile(filepath.Join(dir, hdr.Name)); err == nil {
+				if err := json.Unmarshal(cur, &current); err != nil {
+					return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+				}
+			}
+			if err := unredact(v, current, hdr.Name); err != nil {
+				return nil, err
+			}
+			if b, err = marshal(v); err != nil {
+				return nil, err
+			}
+		}
+		contents[hdr.Name] = b
+		names = append(names, hdr.Name)
+	}
+	for _, fn := range names {
+		path := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		perm := os.FileMode(0600) // may contain secrets
+		if fi, err := os.Stat(path); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		if err := renameio.WriteFile(path, contents[fn], perm); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
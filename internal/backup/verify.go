@@ -0,0 +1,157 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyResult describes a verified backup archive, see Verify.
+type VerifyResult struct {
+	SHA256 string `json:"sha256"` // of the compressed archive
+	Files  int    `json:"files"`  // number of regular files
+	Bytes  int64  `json:"bytes"`  // uncompressed size of the regular files
+
+	// Restored is whether the archive was restored into a directory (dry
+	// run), and the restored files were compared with the archive.
+	Restored bool `json:"restored"`
+}
+
+// Verify reads the backup archive r (as created by Archive) until its end and
+// returns an error if it is not a complete and intact gzip-compressed tarball
+// (e.g. truncated or corrupted while stored), or if it contains unsafe file
+// names. If restoreDir is not empty, the archive is restored into restoreDir,
+// the restored files are compared with the archive and the restored
+// configuration files must be valid JSON.
+func Verify(r io.Reader, restoreDir string) (*VerifyResult, error) {
+	archiveHash := sha256.New()
+	gr, err := gzip.NewReader(io.TeeReader(r, archiveHash))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	res := &VerifyResult{Restored: restoreDir != ""}
+	hashes := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%s: unsafe file name", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if restoreDir != "" {
+				if err := os.MkdirAll(filepath.Join(restoreDir, name), 0755); err != nil {
+					return nil, err
+				}
+			}
+		case tar.TypeReg:
+			h := sha256.New()
+			var w io.Writer = h
+			var f *os.File
+			if restoreDir != "" {
+				fn := filepath.Join(restoreDir, name)
+				if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+					return nil, err
+				}
+				if f, err = os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+					return nil, err
+				}
+				w = io.MultiWriter(h, f)
+			}
+			n, err := io.Copy(w, tr)
+			if f != nil {
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+			res.Files++
+			res.Bytes += n
+			hashes[name] = h.Sum(nil)
+		default:
+			return nil, fmt.Errorf("%s: unexpected file type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+	// Read up to the end of the gzip stream, which verifies its checksum.
+	if _, err := io.Copy(ioutil.Discard, gr); err != nil {
+		return nil, err
+	}
+	if err := gr.Close(); err != nil {
+		return nil, err
+	}
+	res.SHA256 = hex.EncodeToString(archiveHash.Sum(nil))
+	if restoreDir == "" {
+		return res, nil
+	}
+
+	for name, want := range hashes {
+		b, err := ioutil.ReadFile(filepath.Join(restoreDir, name))
+		if err != nil {
+			return nil, err
+		}
+		if got := sha256.Sum256(b); !bytes.Equal(got[:], want) {
+			return nil, fmt.Errorf("%s: restored file differs from archive", name)
+		}
+	}
+	for _, fn := range ConfigFiles {
+		if _, ok := hashes[fn]; !ok || !strings.HasSuffix(fn, ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(restoreDir, fn))
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return res, nil
+}
+
+// ParseChecksum returns the SHA-256 hash contained in b, the contents of a
+// checksum file as created by sha256sum (e.g. backup.tar.gz.sha256).
+func ParseChecksum(b []byte) (string, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	sum := strings.ToLower(fields[0])
+	if h, err := hex.DecodeString(sum); err != nil || len(h) != sha256.Size {
+		return "", fmt.Errorf("malformed SHA-256 checksum %q", fields[0])
+	}
+	return sum, nil
+}
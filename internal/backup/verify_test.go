@@ -0,0 +1,166 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rtr7/router7/internal/backup"
+)
+
+func TestVerify(t *testing.T) {
+	tmpin, err := ioutil.TempDir("", "backuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpin)
+	for fn, contents := range map[string]string{
+		"interfaces.json":    `{"interfaces":[]}`,
+		"dhcp4d/leases.json": "[]",
+		"random.seed":        "\xaa\xbb",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmpin, fn)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpin, fn), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := backup.Archive(&buf, tmpin); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	sum := sha256.Sum256(archive)
+
+	t.Run("intact", func(t *testing.T) {
+		res, err := backup.Verify(bytes.NewReader(archive), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.SHA256, hex.EncodeToString(sum[:]); got != want {
+			t.Errorf("unexpected SHA256: got %s, want %s", got, want)
+		}
+		if got, want := res.Files, 3; got != want {
+			t.Errorf("unexpected number of files: got %d, want %d", got, want)
+		}
+		if res.Restored {
+			t.Errorf("unexpectedly restored")
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		tmpout, err := ioutil.TempDir("", "backuptest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpout)
+		res, err := backup.Verify(bytes.NewReader(archive), tmpout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Restored {
+			t.Errorf("not restored")
+		}
+		b, err := ioutil.ReadFile(filepath.Join(tmpout, "dhcp4d", "leases.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "[]"; got != want {
+			t.Errorf("unexpected restored contents: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		if _, err := backup.Verify(bytes.NewReader(archive[:len(archive)-10]), ""); err == nil {
+			t.Fatalf("Verify unexpectedly succeeded")
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		corrupted := append([]byte(nil), archive...)
+		corrupted[len(corrupted)-5] ^= 0xff // part of the gzip CRC-32
+		if _, err := backup.Verify(bytes.NewReader(corrupted), ""); err == nil {
+			t.Fatalf("Verify unexpectedly succeeded")
+		}
+	})
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	archive := func(name, contents string) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	if _, err := backup.Verify(bytes.NewReader(archive("../etc/passwd", "x")), ""); err == nil {
+		t.Errorf("Verify unexpectedly succeeded for an unsafe file name")
+	}
+
+	tmpout, err := ioutil.TempDir("", "backuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpout)
+	broken := archive("interfaces.json", `{"interfaces":`)
+	if _, err := backup.Verify(bytes.NewReader(broken), ""); err != nil {
+		t.Errorf("Verify without restore: %v", err)
+	}
+	if _, err := backup.Verify(bytes.NewReader(broken), tmpout); err == nil {
+		t.Errorf("Verify unexpectedly succeeded for an invalid configuration file")
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	got, err := backup.ParseChecksum([]byte(sum + "  backup.tar.gz\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != sum {
+		t.Errorf("ParseChecksum = %q, want %q", got, sum)
+	}
+	for _, invalid := range []string{"", "abc  backup.tar.gz"} {
+		if _, err := backup.ParseChecksum([]byte(invalid)); err == nil {
+			t.Errorf("ParseChecksum(%q) unexpectedly succeeded", invalid)
+		}
+	}
+}
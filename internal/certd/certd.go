@@ -0,0 +1,229 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certd obtains a certificate for router7’s public hostname via ACME
+// (e.g. from Let’s Encrypt), proving control of the hostname with DNS-01
+// challenge records published in the dyndns zone.
+package certd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LetsEncrypt is the ACME directory of Let’s Encrypt’s production
+// environment.
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Config is the certificate manager configuration, stored in certd.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// Hostname is router7’s public hostname, e.g. router7.example.com, which
+	// must be within the zone configured in dyndns.json.
+	Hostname string `json:"hostname"`
+
+	// Email is the contact address of the ACME account (optional).
+	Email string `json:"email"`
+
+	// Directory is the ACME directory URL, defaults to LetsEncrypt.
+	Directory string `json:"directory"`
+
+	// RenewBefore is how long before expiry the certificate is renewed,
+	// defaults to 30 days (720h).
+	RenewBefore string `json:"renew_before"`
+
+	renewBefore time.Duration
+}
+
+// ReadConfig reads certd.json from dir and fills in defaults.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "certd.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if cfg.Directory == "" {
+		cfg.Directory = LetsEncrypt
+	}
+	cfg.renewBefore = 30 * 24 * time.Hour
+	if cfg.RenewBefore != "" {
+		d, err := time.ParseDuration(cfg.RenewBefore)
+		if err != nil {
+			return nil, fmt.Errorf("%s: renew_before: %v", fn, err)
+		}
+		cfg.renewBefore = d
+	}
+	if cfg.Enabled && cfg.Hostname == "" {
+		return nil, fmt.Errorf("%s: hostname not configured", fn)
+	}
+	return &cfg, nil
+}
+
+// Expiry returns the expiry of the leaf certificate in the PEM-encoded
+// certificate chain certPEM.
+func Expiry(certPEM []byte) (time.Time, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("no PEM-encoded certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// NeedsRenewal returns whether the certificate in certPEM needs to be
+// renewed (or obtained, if certPEM is empty) at now.
+func (c *Config) NeedsRenewal(certPEM []byte, now time.Time) bool {
+	if len(certPEM) == 0 {
+		return true
+	}
+	expiry, err := Expiry(certPEM)
+	if err != nil {
+		return true
+	}
+	return expiry.Sub(now) < c.renewBefore
+}
+
+// Issuer obtains certificates via ACME.
+type Issuer struct {
+	Client *acme.Client
+
+	// SetTXT publishes the TXT records name (or removes them if values is
+	// empty), e.g. using dyndns.
+	SetTXT func(name string, values []string) error
+
+	// PropagationDelay is how long to wait for the challenge records to
+	// reach all authoritative name servers before asking the ACME server to
+	// validate them.
+	PropagationDelay time.Duration
+}
+
+// Register creates the ACME account (if it does not exist yet).
+func (i *Issuer) Register(ctx context.Context, email string) error {
+	acct := &acme.Account{}
+	if email != "" {
+		acct.Contact = []string{"mailto:" + email}
+	}
+	if _, err := i.Client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	return nil
+}
+
+func (i *Issuer) authorize(ctx context.Context, url string) error {
+	z, err := i.Client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil // e.g. validated recently for a previous certificate
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME server does not offer a dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := i.Client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + z.Identifier.Value
+	if err := i.SetTXT(name, []string{value}); err != nil {
+		return fmt.Errorf("publishing %s: %v", name, err)
+	}
+	defer i.SetTXT(name, nil) // best effort: the record is useless afterwards
+	select {
+	case <-time.After(i.PropagationDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := i.Client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	if _, err := i.Client.WaitAuthorization(ctx, z.URI); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Obtain returns a new certificate (PEM-encoded, including intermediates) and
+// its private key (PEM-encoded) for hostname.
+func (i *Issuer) Obtain(ctx context.Context, hostname string) (certPEM, keyPEM []byte, _ error) {
+	order, err := i.Client.AuthorizeOrder(ctx, acme.DomainIDs(hostname))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := i.authorize(ctx, url); err != nil {
+			return nil, nil, err
+		}
+	}
+	order, err = i.Client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := i.Client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certd_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/certd"
+)
+
+func TestNeedsRenewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "certd.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"enabled": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certd.ReadConfig(dir); err == nil {
+		t.Errorf("ReadConfig unexpectedly accepted a configuration without hostname")
+	}
+	if err := ioutil.WriteFile(fn, []byte(`{"enabled": true, "hostname": "router7.example.com"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := certd.ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Directory, certd.LetsEncrypt; got != want {
+		t.Errorf("unexpected default directory: got %q, want %q", got, want)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     []string{"router7.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	expiry, err := certd.Expiry(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.Equal(notAfter) {
+		t.Errorf("Expiry: got %v, want %v", expiry, notAfter)
+	}
+
+	for _, tt := range []struct {
+		certPEM []byte
+		now     time.Time
+		want    bool
+	}{
+		{nil, notAfter, true},
+		{certPEM, notAfter.Add(-60 * 24 * time.Hour), false},
+		{certPEM, notAfter.Add(-29 * 24 * time.Hour), true},
+	} {
+		if got := cfg.NeedsRenewal(tt.certPEM, tt.now); got != tt.want {
+			t.Errorf("NeedsRenewal(%d bytes, %v) = %v, want %v", len(tt.certPEM), tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package console implements a restricted set of commands for inspecting and
+// operating router7 when its HTTP interfaces are unreachable.
+package console
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/statefile"
+)
+
+// ErrExit is returned by Exec when the user ends the session.
+var ErrExit = errors.New("exit")
+
+// Console executes console commands.
+type Console struct {
+	// Dir is the directory containing configuration and state, typically
+	// /perm.
+	Dir string
+
+	// FlushDNS discards the cache of dnsd.
+	FlushDNS func() error
+
+	// TailLog writes the output of daemon (e.g. dnsd) to w until ctx is
+	// done.
+	TailLog func(ctx context.Context, w io.Writer, daemon string) error
+
+	// InterfaceAddrs returns the addresses of the network interface ifname,
+	// defaults to using net.InterfaceByName.
+	InterfaceAddrs func(ifname string) ([]net.Addr, error)
+
+	// Now defaults to time.Now.
+	Now func() time.Time
+}
+
+type command struct {
+	name string
+	args string // usage of arguments
+	help string
+	run  func(c *Console, ctx context.Context, w io.Writer, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"help", "", "show this help", (*Console).help},
+		{"show leases", "", "show DHCPv4 leases", (*Console).showLeases},
+		{"show wan", "", "show uplink0 addresses and DHCP leases", (*Console).showWAN},
+		{"flush dns", "", "discard the dnsd cache", (*Console).flushDNS},
+		{"tail logs", "<daemon>", "follow the output of a daemon (e.g. dnsd), stop with ^C", (*Console).tailLogs},
+		{"exit", "", "end the session", func(*Console, context.Context, io.Writer, []string) error { return ErrExit }},
+	}
+}
+
+// Exec executes the command line, writing its output to w.
+func (c *Console) Exec(ctx context.Context, w io.Writer, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if fields[0] == "quit" {
+		return ErrExit
+	}
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(fields) < len(words) || strings.Join(fields[:len(words)], " ") != cmd.name {
+			continue
+		}
+		args := fields[len(words):]
+		if cmd.args == "" && len(args) > 0 {
+			return fmt.Errorf("usage: %s", cmd.name)
+		}
+		if cmd.args != "" && len(args) != len(strings.Fields(cmd.args)) {
+			return fmt.Errorf("usage: %s %s", cmd.name, cmd.args)
+		}
+		return cmd.run(c, ctx, w, args)
+	}
+	return fmt.Errorf("unknown command %q, try “help”", line)
+}
+
+func (c *Console) help(ctx context.Context, w io.Writer, args []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "%s\t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.help)
+	}
+	return tw.Flush()
+}
+
+func (c *Console) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *Console) showLeases(ctx context.Context, w io.Writer, args []string) error {
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, "dhcp4d", "leases.json"))
+	if err != nil {
+		return err
+	}
+	var leases []dhcp4d.Lease
+	if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+		return err
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return bytes.Compare(leases[i].Addr.To16(), leases[j].Addr.To16()) < 0
+	})
+	now := c.now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ADDRESS\tHOSTNAME\tHARDWARE ADDRESS\tEXPIRES\n")
+	for _, l := range leases {
+		hostname := l.Hostname
+		if l.HostnameOverride != "" {
+			hostname = l.HostnameOverride
+		}
+		expiry := "expired"
+		if !l.Expired(now) {
+			expiry = l.Expiry.Sub(now).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Addr, hostname, l.HardwareAddr, expiry)
+	}
+	return tw.Flush()
+}
+
+func (c *Console) interfaceAddrs(ifname string) ([]net.Addr, error) {
+	if c.InterfaceAddrs != nil {
+		return c.InterfaceAddrs(ifname)
+	}
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// readLease unmarshals the JSON file fn (relative to c.Dir) into v, returning
+// false if it does not exist.
+func (c *Console) readLease(fn string, v interface{}) (bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, fn))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("%s: %v", fn, err)
+	}
+	return true, nil
+}
+
+func (c *Console) showWAN(ctx context.Context, w io.Writer, args []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	addrs, err := c.interfaceAddrs("uplink0")
+	if err != nil {
+		fmt.Fprintf(tw, "uplink0:\t%v\n", err)
+	}
+	for _, addr := range addrs {
+		fmt.Fprintf(tw, "uplink0:\t%s\n", addr)
+	}
+
+	var lease4 dhcp4.Config
+	ok, err := c.readLease("dhcp4/wire/lease.json", &lease4)
+	if err != nil {
+		return err
+	}
+	if ok {
+		fmt.Fprintf(tw, "DHCPv4 address:\t%s (netmask %s)\n", lease4.ClientIP, lease4.SubnetMask)
+		fmt.Fprintf(tw, "DHCPv4 router:\t%s\n", lease4.Router)
+		fmt.Fprintf(tw, "DHCPv4 DNS:\t%s\n", strings.Join(lease4.DNS, ", "))
+		fmt.Fprintf(tw, "DHCPv4 renewal:\t%s\n", lease4.RenewAfter.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(tw, "DHCPv4:\tno lease\n")
+	}
+
+	var lease6 dhcp6.Config
+	ok, err = c.readLease("dhcp6/wire/lease.json", &lease6)
+	if err != nil {
+		return err
+	}
+	if ok {
+		for _, p := range lease6.Prefixes {
+			fmt.Fprintf(tw, "DHCPv6 prefix:\t%s\n", p.String())
+		}
+		fmt.Fprintf(tw, "DHCPv6 DNS:\t%s\n", strings.Join(lease6.DNS, ", "))
+		fmt.Fprintf(tw, "DHCPv6 renewal:\t%s\n", lease6.RenewAfter.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(tw, "DHCPv6:\tno lease\n")
+	}
+	return tw.Flush()
+}
+
+func (c *Console) flushDNS(ctx context.Context, w io.Writer, args []string) error {
+	if c.FlushDNS == nil {
+		return fmt.Errorf("not supported")
+	}
+	if err := c.FlushDNS(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "dnsd cache flushed\n")
+	return nil
+}
+
+func (c *Console) tailLogs(ctx context.Context, w io.Writer, args []string) error {
+	if c.TailLog == nil {
+		return fmt.Errorf("not supported")
+	}
+	daemon := args[0]
+	if strings.ContainsAny(daemon, "/?&") {
+		return fmt.Errorf("invalid daemon name %q", daemon)
+	}
+	return c.TailLog(ctx, w, daemon)
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/console"
+)
+
+func TestConsole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 11, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(dir, "dhcp4d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dhcp4d", "leases.json"), []byte(`[
+  {"num": 3, "addr": "192.168.42.5", "hardware_addr": "02:00:00:00:00:05", "hostname": "laptop", "expiry": "2018-11-01T13:00:00Z"},
+  {"num": 1, "addr": "192.168.42.3", "hardware_addr": "02:00:00:00:00:03", "hostname": "android-1234", "hostname_override": "phone", "expiry": "2018-11-01T11:00:00Z"}
+]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var flushed bool
+	c := &console.Console{
+		Dir: dir,
+		FlushDNS: func() error {
+			flushed = true
+			return nil
+		},
+		TailLog: func(ctx context.Context, w io.Writer, daemon string) error {
+			_, err := io.WriteString(w, "log of "+daemon+"\n")
+			return err
+		},
+		InterfaceAddrs: func(ifname string) ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP("203.0.113.7"), Mask: net.CIDRMask(24, 32)}}, nil
+		},
+		Now: func() time.Time { return now },
+	}
+
+	exec := func(line string) (string, error) {
+		var buf bytes.Buffer
+		err := c.Exec(context.Background(), &buf, line)
+		return buf.String(), err
+	}
+
+	out, err := exec("show leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := len(lines), 3; got != want {
+		t.Fatalf("show leases: got %d lines, want %d:\n%s", got, want, out)
+	}
+	// Sorted by address, hostname overrides take precedence:
+	if got, want := strings.Fields(lines[1]), []string{"192.168.42.3", "phone", "02:00:00:00:00:03", "expired"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("show leases: got %q, want %q", got, want)
+	}
+	if got, want := strings.Fields(lines[2]), []string{"192.168.42.5", "laptop", "02:00:00:00:00:05", "1h0m0s"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("show leases: got %q, want %q", got, want)
+	}
+
+	out, err = exec("show wan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"203.0.113.7/24", "DHCPv4:", "no lease"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("show wan: output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	if _, err := exec("flush dns"); err != nil {
+		t.Fatal(err)
+	}
+	if !flushed {
+		t.Errorf("flush dns did not call FlushDNS")
+	}
+
+	out, err = exec("tail logs dnsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, "log of dnsd\n"; got != want {
+		t.Errorf("tail logs: got %q, want %q", got, want)
+	}
+
+	for _, invalid := range []string{
+		"reboot",
+		"show",
+		"show leases now",
+		"tail logs",
+		"tail logs ../dnsd?path=/etc",
+	} {
+		if _, err := exec(invalid); err == nil || err == console.ErrExit {
+			t.Errorf("Exec(%q) = %v, want error", invalid, err)
+		}
+	}
+	if _, err := exec("exit"); err != console.ErrExit {
+		t.Errorf("Exec(exit) = %v, want ErrExit", err)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemon describes router7 daemons, so that they can run either as
+// standalone binaries (cmd/<daemon>) or as components of the combined router7
+// binary (cmd/router7), which saves memory on small devices: all daemons share
+// one Go runtime, one copy of the libraries and e.g. one netlink subscription
+// (see linkstate).
+//
+// Daemons which can run as components keep their state out of process-wide
+// singletons: flags are in Daemon.Flags, HTTP handlers in a per-daemon
+// http.ServeMux and notifications use notify.Signal instead of
+// signal.Notify.
+//
+// In the combined binary, all components share the default prometheus
+// registry and the health checks (see healthz.Register), so the components do
+// not serve /metrics and /healthz themselves: router7 serves them once, see
+// HandleShared.
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/supervise"
+)
+
+// Daemon is a router7 daemon.
+type Daemon struct {
+	// Name is the name of the daemon binary, e.g. dhcp4d.
+	Name string
+
+	// Flags are the command line flags of the daemon. The combined binary
+	// prefixes them with the daemon name, e.g. -dhcp4d.interface.
+	Flags *flag.FlagSet
+
+	// Logic runs the daemon until it fails.
+	Logic func() error
+
+	// Supervise makes the standalone binary record its restarts, see
+	// supervise.Run. The combined binary is always supervised.
+	Supervise bool
+}
+
+// ParseFlags parses args into d.Flags, which are extended by the process-wide
+// flags registered in flag.CommandLine (e.g. -v, see teelogger): standalone
+// binaries support those, too.
+func (d *Daemon) ParseFlags(args []string) error {
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if d.Flags.Lookup(f.Name) == nil {
+			d.Flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	return d.Flags.Parse(args)
+}
+
+// Main runs d as a standalone binary.
+func Main(d *Daemon) {
+	if err := d.ParseFlags(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	run := d.Logic
+	if d.Supervise {
+		run = func() error { return supervise.Run(d.Name, d.Logic) }
+	}
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var (
+	combinedMu sync.Mutex
+	combined   bool
+	components []string
+	gatherers  []prometheus.Gatherer // registered via HandleShared
+)
+
+// Combined returns whether the daemons run as components of the combined
+// router7 binary, i.e. share their process with other daemons. Daemons must
+// not change process-wide state (e.g. drop privileges) in that case.
+func Combined() bool {
+	combinedMu.Lock()
+	defer combinedMu.Unlock()
+	return combined
+}
+
+// Components returns the names of the daemons which run as components of the
+// combined router7 binary, if any.
+func Components() []string {
+	combinedMu.Lock()
+	defer combinedMu.Unlock()
+	return append([]string(nil), components...)
+}
+
+// SharedPort is the default port on which the combined router7 binary serves
+// SharedHandler.
+const SharedPort = "8064"
+
+// HandleShared registers /metrics (the default prometheus registry and
+// additional registries, e.g. of dnsd) and /healthz on mux. In the combined
+// binary, it only adds registries to SharedHandler instead: otherwise, every
+// component would serve the metrics and health checks of all components.
+func HandleShared(mux *http.ServeMux, additional ...prometheus.Gatherer) {
+	combinedMu.Lock()
+	defer combinedMu.Unlock()
+	if combined {
+		gatherers = append(gatherers, additional...)
+		return
+	}
+	mux.Handle("/metrics", metricsHandler(additional))
+	mux.Handle("/healthz", healthz.Handler())
+}
+
+func metricsHandler(additional []prometheus.Gatherer) http.Handler {
+	if len(additional) == 0 {
+		return promhttp.Handler()
+	}
+	return promhttp.HandlerFor(
+		append(prometheus.Gatherers{prometheus.DefaultGatherer}, additional...),
+		promhttp.HandlerOpts{})
+}
+
+// SharedHandler serves /metrics and /healthz of all components of the
+// combined binary, see HandleShared.
+func SharedHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		combinedMu.Lock()
+		additional := append([]prometheus.Gatherer(nil), gatherers...)
+		combinedMu.Unlock()
+		metricsHandler(additional).ServeHTTP(w, r)
+	})
+	mux.Handle("/healthz", healthz.Handler())
+	return mux
+}
+
+// RunAll runs daemons as components of one process. Daemons cannot be
+// restarted individually (they register metrics and listeners for the
+// lifetime of the process), so RunAll returns once any daemon fails (returns
+// an error or panics), for the process to be restarted. Daemons which return
+// without error (e.g. netconfigd -linger=false) are done.
+func RunAll(daemons []*Daemon) error {
+	combinedMu.Lock()
+	combined = true
+	components = components[:0]
+	for _, d := range daemons {
+		components = append(components, d.Name)
+	}
+	combinedMu.Unlock()
+	errs := make(chan error, len(daemons))
+	for _, d := range daemons {
+		go func(d *Daemon) {
+			defer func() {
+				if r := recover(); r != nil {
+					errs <- fmt.Errorf("%s: panic: %v", d.Name, r)
+				}
+			}()
+			if err := d.Logic(); err != nil {
+				errs <- fmt.Errorf("%s: %v", d.Name, err)
+				return
+			}
+			log.Printf("%s: done", d.Name)
+			errs <- nil
+		}(d)
+	}
+	for range daemons {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select returns the daemons whose names are listed in names, in order.
+func Select(daemons []*Daemon, names []string) ([]*Daemon, error) {
+	byName := make(map[string]*Daemon, len(daemons))
+	for _, d := range daemons {
+		byName[d.Name] = d
+	}
+	var result []*Daemon
+	for _, name := range names {
+		d, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown daemon %q", name)
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// RegisterFlags registers the flags of daemons in fs, prefixed with the daemon
+// name, e.g. -dhcp4d.interface.
+func RegisterFlags(fs *flag.FlagSet, daemons []*Daemon) {
+	for _, d := range daemons {
+		d.Flags.VisitAll(func(f *flag.Flag) {
+			fs.Var(f.Value, d.Name+"."+f.Name, f.Usage)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon_test
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+func testDaemon(name string, logic func() error) *daemon.Daemon {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("interface", "lan0", "network interface")
+	return &daemon.Daemon{Name: name, Flags: fs, Logic: logic}
+}
+
+func TestRunAll(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	blocking := func() error { <-block; return nil }
+
+	for _, tt := range []struct {
+		desc  string
+		logic func() error
+		want  string
+	}{
+		{
+			desc:  "error",
+			logic: func() error { return errors.New("listen: address in use") },
+			want:  "b: listen: address in use",
+		},
+
+		{
+			desc:  "panic",
+			logic: func() error { panic("oops") },
+			want:  "b: panic: oops",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := daemon.RunAll([]*daemon.Daemon{
+				testDaemon("a", blocking),
+				testDaemon("b", tt.logic),
+			})
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("RunAll = %v, want %v", err, tt.want)
+			}
+			if !daemon.Combined() {
+				t.Errorf("Combined() = false, want true")
+			}
+		})
+	}
+
+	t.Run("done", func(t *testing.T) {
+		done := func() error { return nil }
+		if err := daemon.RunAll([]*daemon.Daemon{
+			testDaemon("a", done),
+			testDaemon("b", done),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestHandleShared(t *testing.T) {
+	done := func() error { return nil }
+	if err := daemon.RunAll([]*daemon.Daemon{
+		testDaemon("a", done),
+		testDaemon("b", done),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(daemon.Components(), ","), "a,b"; got != want {
+		t.Errorf("Components() = %v, want %v", got, want)
+	}
+
+	mux := http.NewServeMux()
+	daemon.HandleShared(mux)
+	for _, tt := range []struct {
+		handler http.Handler
+		want    int
+	}{
+		{mux, http.StatusNotFound}, // served once by router7
+		{daemon.SharedHandler(), http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if got := rec.Code; got != tt.want {
+			t.Errorf("GET /healthz: got HTTP status %d, want %d", got, tt.want)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	d := testDaemon("dhcp4d", nil)
+	// -v is registered in flag.CommandLine by teelogger.
+	if err := d.ParseFlags([]string{"-v=debug", "-interface=lan1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer teelogger.SetLevel("", teelogger.Info, 0)
+	if got, want := d.Flags.Lookup("v").Value.String(), "debug"; got != want {
+		t.Errorf("-v = %q, want %q", got, want)
+	}
+	if got, want := d.Flags.Lookup("interface").Value.String(), "lan1"; got != want {
+		t.Errorf("-interface = %q, want %q", got, want)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	daemons := []*daemon.Daemon{
+		testDaemon("dhcp4d", nil),
+		testDaemon("dnsd", nil),
+		testDaemon("radvd", nil),
+	}
+	selected, err := daemon.Select(daemons, []string{"radvd", "dhcp4d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range selected {
+		names = append(names, d.Name)
+	}
+	if got, want := strings.Join(names, ","), "radvd,dhcp4d"; got != want {
+		t.Errorf("Select = %v, want %v", got, want)
+	}
+
+	if _, err := daemon.Select(daemons, []string{"dhcp6"}); err == nil {
+		t.Errorf("Select(dhcp6) unexpectedly succeeded")
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	dhcp4d := testDaemon("dhcp4d", nil)
+	dnsd := testDaemon("dnsd", nil)
+	fs := flag.NewFlagSet("router7", flag.ContinueOnError)
+	daemon.RegisterFlags(fs, []*daemon.Daemon{dhcp4d, dnsd})
+	if err := fs.Parse([]string{"-dhcp4d.interface=lan1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dhcp4d.Flags.Lookup("interface").Value.String(), "lan1"; got != want {
+		t.Errorf("dhcp4d -interface = %q, want %q", got, want)
+	}
+	if got, want := dnsd.Flags.Lookup("interface").Value.String(), "lan0"; got != want {
+		t.Errorf("dnsd -interface = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"context"
+	_ "embed"
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+var consistencyViolations = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Subsystem: "dhcp4d",
+	Name:      "consistency_violations",
+	Help:      "Violations found by the most recent DHCP/DNS consistency audit, by kind (e.g. forward_dns)",
+}, []string{"kind"})
+
+//go:embed consistency.html.tmpl
+var consistencyHTML string
+
+var consistencyTmpl = webui.Must(webui.Parse("dhcp4d", consistencyHTML, template.FuncMap{
+	"timefmt": timefmt,
+}))
+
+// auditor periodically checks the leases for consistency with the
+// configuration and with the answers of dnsd.
+type auditor struct {
+	handler  *dhcp4d.Handler
+	domain   string          // primary local domain, e.g. “lan”
+	resolver dhcp4d.Resolver // nil skips the DNS checks
+
+	mu         sync.Mutex
+	checked    time.Time
+	violations []dhcp4d.Violation
+}
+
+// dnsdResolver returns a resolver which queries dnsd on addr (e.g.
+// 192.168.42.1) instead of the system resolver.
+func dnsdResolver(addr net.IP) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, net.JoinHostPort(addr.String(), "53"))
+		},
+	}
+}
+
+func (a *auditor) audit() {
+	ctx, canc := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer canc()
+	violations := a.handler.Audit(ctx, interfaceLeases(*iface), a.domain, a.resolver)
+	byKind := make(map[string]int)
+	for _, v := range violations {
+		byKind[v.Kind]++
+	}
+	for _, kind := range dhcp4d.ViolationKinds {
+		consistencyViolations.With(prometheus.Labels{"kind": kind}).Set(float64(byKind[kind]))
+	}
+	if len(violations) > 0 {
+		log.Warnf("consistency audit: %d violations, see /consistency", len(violations))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checked = time.Now()
+	a.violations = violations
+}
+
+func (a *auditor) run(interval time.Duration) {
+	// Give dnsd time to load the leases after a restart of both daemons.
+	time.Sleep(1 * time.Minute)
+	for {
+		a.audit()
+		time.Sleep(interval)
+	}
+}
+
+func violationsTable(violations []dhcp4d.Violation) *webui.Table {
+	t := &webui.Table{
+		Columns: []string{"kind", "ip_address", "mac_address", "hostname", "detail"},
+		Empty:   "no_violations",
+	}
+	for _, v := range violations {
+		t.Append(
+			webui.Text(v.Kind),
+			webui.Addr(v.Addr),
+			webui.Addr(v.HardwareAddr),
+			webui.Text(v.Hostname),
+			webui.Text(v.Detail))
+	}
+	return t
+}
+
+func (a *auditor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !privateOnly(w, r) {
+		return
+	}
+	a.mu.Lock()
+	checked, violations := a.checked, a.violations
+	a.mu.Unlock()
+	if err := consistencyTmpl.Execute(w, r, struct {
+		Checked time.Time
+		Table   *webui.Table
+	}{
+		Checked: checked,
+		Table:   violationsTable(violations),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
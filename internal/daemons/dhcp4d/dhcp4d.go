@@ -0,0 +1,790 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhcp4d implements dhcp4d, which hands out DHCPv4 leases to clients.
+package dhcp4d
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/google/renameio"
+	"github.com/krolaw/dhcp4"
+	"github.com/krolaw/dhcp4/conn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/linkstate"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/oui"
+	"github.com/rtr7/router7/internal/privdrop"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/statefile"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+var flags = flag.NewFlagSet("dhcp4d", flag.ExitOnError)
+
+var (
+	iface = flags.String("interface", "lan0", "ethernet interface to listen for DHCPv4 requests on")
+
+	advertiseNTP = flags.Bool("advertise_ntp", true, "advertise the router (i.e. ntpd) as NTP server (option 42)")
+
+	subnet    = flags.String("subnet", "", "subnet to serve (e.g. 192.168.42.0/24), overrides dhcp4d.json (default: subnet of the LAN interface)")
+	router    = flags.String("router", "", "router address to advertise (option 3), overrides dhcp4d.json (default: LAN interface address)")
+	poolStart = flags.String("pool_start", "", "first address to hand out, overrides dhcp4d.json")
+	poolEnd   = flags.String("pool_end", "", "last address to hand out, overrides dhcp4d.json")
+	exclude   = flags.String("exclude", "", "comma-separated addresses or address ranges (e.g. 192.168.42.5-192.168.42.9) not to hand out, overrides dhcp4d.json")
+
+	uid = flags.Int("uid", 67, "user id to switch to once all sockets are open (-1 to keep running as root)")
+	gid = flags.Int("gid", 67, "group id to switch to once all sockets are open")
+
+	auditInterval = flags.Duration("audit_interval", 5*time.Minute, "how often to check leases for consistency with the configuration and dnsd (duplicate addresses, static leases within the pool, forward and reverse DNS)")
+
+	dryRun = flags.Bool("dry_run", false, "log the replies which would be sent instead of sending them, and do not persist leases, e.g. to validate the configuration on a network which is still served by another DHCP server")
+
+	debugTransactions = flags.Int("debug_transactions", 0, "number of recent DHCP transactions to retain for download as pcap from /debug/transactions.pcap (0 disables), protected by the gokrazy password")
+
+	receive = flags.String("receive", "udp", "how to receive DHCP requests: “udp” (a UDP socket bound to the interface) or “packet” (an AF_PACKET socket, which also works on interfaces without IPv4 address, e.g. bridge ports)")
+
+	ignoreBroadcastFlag = flags.Bool("ignore_broadcast_flag", false, "send offers and acknowledgements to the client’s hardware address even if the client requested a broadcast reply, for clients which set the broadcast flag needlessly")
+
+	lastSeenInterval = flags.Duration("last_seen_interval", 5*time.Minute, "how often to persist when devices were last seen (via ARP, NDP or DHCP) to /perm/dhcp4d/lastseen.json and update the last seen metrics")
+)
+
+var log = teelogger.NewConsole()
+
+var nonExpiredLeases = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "non_expired_leases",
+	Help: "Number of non-expired DHCP leases",
+})
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dhcp4d",
+		Name:      "requests_total",
+		Help:      "DHCP messages received, by message type (e.g. DISCOVER)",
+	}, []string{"type"})
+
+	replies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dhcp4d",
+		Name:      "replies_total",
+		Help:      "DHCP messages sent, by message type (e.g. OFFER, NAK)",
+	}, []string{"type"})
+
+	handlingLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "dhcp4d",
+		Name:      "request_duration_seconds",
+		Help:      "Time spent handling a DHCP message, including sending the reply",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 14), // 100µs to ~1.6s
+	})
+)
+
+// instrumentedHandler measures how long handling each message takes.
+type instrumentedHandler struct {
+	*dhcp4d.Handler
+}
+
+func (h instrumentedHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	start := time.Now()
+	reply := h.Handler.ServeDHCP(p, msgType, options)
+	handlingLatency.Observe(time.Since(start).Seconds())
+	return reply
+}
+
+func transactionsHandler(l *dhcp4d.TransactionLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", `attachment; filename="dhcp4d-transactions.pcap"`)
+		if err := l.WritePcap(w); err != nil {
+			log.Printf("writing pcap: %v", err)
+		}
+	})
+}
+
+func updateNonExpired(leases []*dhcp4d.Lease) {
+	now := time.Now()
+	nonExpired := 0
+	for _, l := range leases {
+		if l.Expired(now) {
+			continue
+		}
+		nonExpired++
+	}
+	nonExpiredLeases.Set(float64(nonExpired))
+}
+
+var ouiDB = oui.NewDB("/perm/dhcp4d/oui")
+
+// leases are the leases of all interfaces, see setLeases and currentLeases.
+var leases []*dhcp4d.Lease
+
+var (
+	devicesMu sync.Mutex
+	registry  *devices.Registry
+)
+
+func loadedDevices() *devices.Registry {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	return registry
+}
+
+// loadDevices reads the device registry and applies it to handlers.
+func loadDevices(handlers ...*dhcp4d.Handler) error {
+	r, err := devices.Read("/perm")
+	if err != nil {
+		return err
+	}
+	devicesMu.Lock()
+	registry = r
+	devicesMu.Unlock()
+	for _, h := range handlers {
+		h.SetDevices(r)
+	}
+	return nil
+}
+
+var (
+	timefmt = func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	}
+	leasesTmpl = webui.Must(webui.Parse("dhcp4d", leasesHTML, template.FuncMap{
+		"timefmt": timefmt,
+		"since": func(t time.Time) string {
+			dur := time.Since(t)
+			if dur.Hours() > 24 {
+				return timefmt(t)
+			}
+			return dur.Truncate(1 * time.Second).String()
+		},
+	}))
+)
+
+//go:embed leases.html.tmpl
+var leasesHTML string
+
+// privateOnly returns whether r originates from a private network, replying
+// with an HTTP error otherwise.
+func privateOnly(w http.ResponseWriter, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return false
+	}
+	ip := net.ParseIP(host)
+	if xff := r.Header.Get("X-Forwarded-For"); ip.IsLoopback() && xff != "" {
+		ip = net.ParseIP(xff)
+	}
+	if !gokrazy.IsInPrivateNet(ip) {
+		http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func loadLeases(h *dhcp4d.Handler, fn string, networks []netconfig.Network) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var all []*dhcp4d.Lease
+	if err := statefile.Leases4.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	for ifname, l := range leasesByInterface(all, networks) {
+		setLeases(ifname, l)
+	}
+	h.SetLeases(interfaceLeases(*iface))
+	updateNonExpired(all)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !privateOnly(w, r) {
+			return
+		}
+		q := parseLeaseQuery(r.URL.Query())
+		matching := q.filter(leaseViews(r))
+		if err := leasesTmpl.Execute(w, r, struct {
+			Leases []leaseView
+			Query  leaseQuery
+			States []string
+			Total  int
+			Pages  int
+		}{
+			Leases: q.paginate(matching),
+			Query:  q,
+			States: []string{"active", "expired", "static"},
+			Total:  len(matching),
+			Pages:  q.Pages(len(matching)),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+	mux.HandleFunc("/api/v1/leases", func(w http.ResponseWriter, r *http.Request) {
+		if !privateOnly(w, r) {
+			return
+		}
+		q := parseLeaseQuery(r.URL.Query())
+		matching := q.filter(leaseViews(r))
+		page := matching
+		if r.FormValue("page") != "" || r.FormValue("per_page") != "" {
+			page = q.paginate(matching)
+		}
+		b, err := json.MarshalIndent(newAPILeases(page, len(matching)), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	mux.HandleFunc("/leases.csv", func(w http.ResponseWriter, r *http.Request) {
+		if !privateOnly(w, r) {
+			return
+		}
+		q := parseLeaseQuery(r.URL.Query())
+		if err := writeLeasesCSV(w, q.filter(leaseViews(r))); err != nil {
+			log.Printf("writing CSV: %v", err)
+		}
+	})
+
+	return nil
+}
+
+// persistLeases makes newLeases the current leases of interface ifname, writes
+// the leases of all interfaces to /perm/dhcp4d/leases.json and notifies dnsd.
+func persistLeases(ifname string, newLeases []*dhcp4d.Lease) error {
+	all := setLeases(ifname, newLeases)
+	b, err := statefile.Leases4.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile("/perm/dhcp4d/leases.json", b, 0644); err != nil {
+		return err
+	}
+	updateNonExpired(all)
+	notifyDNS()
+	return nil
+}
+
+var dnsNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "dhcp4d",
+	Name:      "dnsd_notifications_total",
+	Help:      "Notifications of dnsd about changed leases, by result (ok, error)",
+}, []string{"result"})
+
+var dnsPending = make(chan struct{}, 1)
+
+// notifyDNS makes dnsd reload the leases in the background: DHCP replies must
+// not wait for dnsd. Notifications which are requested while one is in
+// progress are coalesced.
+func notifyDNS() {
+	select {
+	case dnsPending <- struct{}{}:
+	default: // already pending
+	}
+}
+
+func notifyDNSLoop() {
+	for range dnsPending {
+		ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+		err := notify.Notify(ctx, "dnsd")
+		canc()
+		if err != nil {
+			log.Printf("notifying dnsd: %v (hostnames of new leases are not resolvable)", err)
+			dnsNotifications.With(prometheus.Labels{"result": "error"}).Inc()
+			continue
+		}
+		dnsNotifications.With(prometheus.Labels{"result": "ok"}).Inc()
+	}
+}
+
+// leasesOf returns copies of the leases of the hardware addresses of hosts.
+func leasesOf(leases []*dhcp4d.Lease, hosts []dhcp4d.StaticHost) []dhcp4d.Lease {
+	hwaddrs := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		hwaddrs[h.HardwareAddr] = true
+	}
+	var matching []dhcp4d.Lease
+	for _, l := range leases {
+		if hwaddrs[l.HardwareAddr] {
+			matching = append(matching, *l)
+		}
+	}
+	return matching
+}
+
+// importHandler converts the static assignments of a dnsmasq (dhcp-host lines)
+// or ISC dhcpd (host declarations) configuration file in the request body into
+// permanent leases, e.g.:
+//
+//	curl -u gokrazy --data-binary @/etc/dnsmasq.conf 'http://router7:8067/import?format=dnsmasq'
+//
+// With dry_run=1, the parsed assignments are returned without importing them.
+// Imports are recorded in audit.
+func importHandler(handler *dhcp4d.Handler, audit *auditlog.Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if ip := net.ParseIP(host); !gokrazy.IsInPrivateNet(ip) {
+			http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+			return
+		}
+		var res *dhcp4d.ImportResult
+		switch format := r.FormValue("format"); format {
+		case "dnsmasq":
+			res, err = dhcp4d.ParseDnsmasq(r.Body)
+		case "isc":
+			res, err = dhcp4d.ParseISC(r.Body)
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q, expected dnsmasq or isc", format), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("dry_run") != "1" {
+			before := leasesOf(interfaceLeases(*iface), res.Hosts)
+			newLeases, err := handler.ImportStatic(res.Hosts)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := persistLeases(*iface, newLeases); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("imported %d static leases (%d entries skipped)", len(res.Hosts), len(res.Skipped))
+			if err := audit.Record(r, "import-static-leases", before, leasesOf(newLeases, res.Hosts)); err != nil {
+				log.Printf("audit log: %v", err)
+			}
+			if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+				log.Printf("notifying netconfigd: %v", err)
+			}
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flags, "dhcp4d", "8067")
+)
+
+func updateListeners() error {
+	var extra []string
+	if net1, err := multilisten.IPv6Net1("/perm"); err == nil {
+		extra = append(extra, net1)
+	}
+	addrs, err := management.Addrs(extra...)
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = mux
+		return srv
+	})
+	return nil
+}
+
+func logic() error {
+	go notifyDNSLoop()
+	daemon.HandleShared(mux)
+	mux.Handle("/debug/loglevel", teelogger.Handler())
+	mux.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	if err := os.MkdirAll("/perm/dhcp4d", 0755); err != nil {
+		return err
+	}
+	errs := make(chan error)
+	ifc, err := net.InterfaceByName(*iface)
+	if err != nil {
+		return err
+	}
+	handler, err := dhcp4d.NewHandler("/perm", ifc, *iface, nil)
+	if err != nil {
+		return err
+	}
+	neighbors = dhcp4d.NewNeighbors(ifc.HardwareAddr)
+	if err := neighbors.Load("/perm"); err != nil {
+		log.Printf("loading last seen timestamps: %v", err)
+	}
+	updateAddrs := func() {
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			log.Printf("reading %s addresses: %v", *iface, err)
+			return
+		}
+		handler.SetInterfaceAddrs(addrs)
+	}
+	updateAddrs()
+	// Pick up secondary addresses (e.g. while migrating to another subnet)
+	// without a restart.
+	if err := linkstate.NotifySettled(linkstate.Filter{
+		Kinds:     linkstate.Addr,
+		Interface: *iface,
+	}, 1*time.Second, updateAddrs); err != nil {
+		log.Printf("not updating %s addresses on changes: %v", *iface, err)
+	}
+	if *advertiseNTP {
+		handler.AdvertiseNTP()
+	}
+	if *dryRun {
+		log.Printf("dry run: not sending replies, not persisting leases")
+		handler.DryRun = true
+	}
+	handler.IgnoreBroadcastFlag = *ignoreBroadcastFlag
+	if *debugTransactions > 0 {
+		handler.Transactions = dhcp4d.NewTransactionLog(*debugTransactions)
+		mux.Handle("/debug/transactions.pcap", auth.RequirePassword("dhcp4d", transactionsHandler(handler.Transactions)))
+	}
+	cfg, err := dhcp4d.ReadConfig("/perm")
+	if err != nil {
+		return err
+	}
+	for _, override := range []struct {
+		flag  string
+		field *string
+	}{
+		{*subnet, &cfg.Subnet},
+		{*router, &cfg.Router},
+		{*poolStart, &cfg.PoolStart},
+		{*poolEnd, &cfg.PoolEnd},
+	} {
+		if override.flag != "" {
+			*override.field = override.flag
+		}
+	}
+	if *exclude != "" {
+		cfg.Exclude = strings.Split(*exclude, ",")
+	}
+	if err := handler.SetConfig(cfg); err != nil {
+		return fmt.Errorf("dhcp4d.json: %v", err)
+	}
+	domains, err := netconfig.ReadDomains("/perm")
+	if err != nil {
+		return err
+	}
+	if err := handler.SetDomains(domains.Domains()); err != nil {
+		return fmt.Errorf("domains.json: %v", err)
+	}
+	networks, err := netconfig.ReadNetworks("/perm")
+	if err != nil {
+		return err
+	}
+	if err := loadLeases(handler, "/perm/dhcp4d/leases.json", networks); err != nil {
+		return err
+	}
+	// Networks (networks.json) are served with settings derived from the
+	// network. Changing the networks requires a restart.
+	var networkHandlers []*networkHandler
+	for _, n := range networks {
+		if n.DHCP4.Disabled {
+			continue
+		}
+		nh, err := newNetworkHandler(n, domains.Domains())
+		if err != nil {
+			// The VLAN interface might not exist (yet), which must not
+			// prevent serving the other interfaces.
+			log.Printf("not serving network %s: %v", n.Name, err)
+			continue
+		}
+		networkHandlers = append(networkHandlers, nh)
+	}
+	handlers := []*dhcp4d.Handler{handler}
+	for _, nh := range networkHandlers {
+		handlers = append(handlers, nh.Handler)
+	}
+	a := &auditor{handler: handler, domain: domains.Domains()[0]}
+	if !*dryRun {
+		// In dry-run mode, dnsd does not know about the leases.
+		lanIP, err := netconfig.LinkAddress("/perm", *iface)
+		if err != nil {
+			return err
+		}
+		a.resolver = dnsdResolver(lanIP)
+	}
+	mux.Handle("/consistency", a)
+	go a.run(*auditInterval)
+	if err := loadDevices(handlers...); err != nil {
+		return err
+	}
+	alerter := alert.NewAlerter("/perm")
+	go func() {
+		ch := make(chan os.Signal, 1)
+		notify.Signal(ch, "dhcp4d", syscall.SIGUSR1)
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			if err := loadDevices(handlers...); err != nil {
+				log.Printf("loadDevices: %v", err)
+			}
+			if err := alerter.Reload(); err != nil {
+				log.Printf("reloading alert config: %v", err)
+			}
+		}
+	}()
+	mux.Handle("/import", auth.RequirePassword("dhcp4d", importHandler(handler, auditlog.New("/perm", "dhcp4d"))))
+	served := func(h *dhcp4d.Handler, ifname string) func(req, reply dhcp4.MessageType) {
+		alertKey := "dhcp4-pool-exhausted"
+		if ifname != *iface {
+			alertKey += "-" + ifname
+		}
+		return func(req, reply dhcp4.MessageType) {
+			requests.WithLabelValues(dhcp4d.MessageTypeName(req)).Inc()
+			if reply != 0 {
+				replies.WithLabelValues(dhcp4d.MessageTypeName(reply)).Inc()
+			}
+			if req == dhcp4.Discover && reply == 0 {
+				if used, size := h.PoolUsage(); size > 0 && used >= size {
+					alerter.Alert(alertKey, "DHCPv4 address pool exhausted",
+						fmt.Sprintf("All %d addresses of the DHCPv4 pool on %s are leased, new clients do not get an address.\n", size, ifname))
+				}
+			}
+		}
+	}
+	handler.Served = served(handler, *iface)
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "dhcp4d",
+		Name:      "pool_utilization_percent",
+		Help:      "Percentage of the address pool leased to clients",
+	}, func() float64 {
+		used, size := handler.PoolUsage()
+		if size == 0 {
+			return 0
+		}
+		return 100 * float64(used) / float64(size)
+	})
+	leasesChanged := func(ifname string) func(newLeases []*dhcp4d.Lease, latest *dhcp4d.Lease) {
+		return func(newLeases []*dhcp4d.Lease, latest *dhcp4d.Lease) {
+			neighbors.Seen(latest.HardwareAddr, time.Now())
+			newAddr := true
+			for _, l := range interfaceLeases(ifname) {
+				if l.Addr.Equal(latest.Addr) {
+					newAddr = false
+					break
+				}
+			}
+			if *dryRun {
+				// Display the simulated leases on the status page, but
+				// keep them from other daemons, which would act on them.
+				updateNonExpired(setLeases(ifname, newLeases))
+				return
+			}
+			log.Printf("DHCPACK %+v", latest)
+			if err := persistLeases(ifname, newLeases); err != nil {
+				errs <- err
+			}
+			if newAddr {
+				// netconfigd installs per-client traffic accounting
+				// rules for each leased address.
+				if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+					log.Printf("notifying netconfigd: %v", err)
+				}
+			}
+		}
+	}
+	handler.Leases = leasesChanged(*iface)
+	for _, nh := range networkHandlers {
+		nh.Served = served(nh.Handler, nh.ifname)
+		nh.Leases = leasesChanged(nh.ifname)
+	}
+	conn, err := listen(*iface)
+	if err != nil {
+		return err
+	}
+	neighborConns, err := listenNeighbors(ifc)
+	if err != nil {
+		return err
+	}
+	for _, c := range neighborConns {
+		go watchNeighbors(c, ifc.MTU)
+	}
+	go persistNeighbors(*lastSeenInterval, !*dryRun)
+	// Privileges are per process: as part of the combined router7 binary,
+	// dhcp4d keeps them for the other daemons (e.g. netconfigd).
+	if *uid != -1 && !daemon.Combined() {
+		// The raw and UDP sockets are open at this point, so the only
+		// capability we still need is CAP_KILL for notifying netconfigd.
+		if err := reclaimAuditLogs(*uid); err != nil {
+			log.Printf("reclaiming audit logs: %v", err)
+		}
+		if err := privdrop.Drop(privdrop.Config{
+			UID:           *uid,
+			GID:           *gid,
+			Caps:          []int{unix.CAP_KILL},
+			Writable:      []string{"/perm/dhcp4d"},
+			WritableFiles: []string{auditlog.Path("/perm", "dhcp4d")},
+		}); err != nil {
+			return err
+		}
+	}
+	go func() {
+		errs <- dhcp4.Serve(conn, instrumentedHandler{handler})
+	}()
+	for _, nh := range networkHandlers {
+		go func(nh *networkHandler) {
+			errs <- nh.serve()
+		}(nh)
+	}
+	return <-errs
+}
+
+// reclaimAuditLogs chowns the audit logs of other daemons, which earlier
+// versions of dhcp4d chowned to uid along with /perm/audit, back to root.
+func reclaimAuditLogs(uid int) error {
+	dir := filepath.Dir(auditlog.Path("/perm", "dhcp4d"))
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	paths := []string{dir}
+	for _, fi := range fis {
+		if fi.Name() != "dhcp4d.jsonl" {
+			paths = append(paths, filepath.Join(dir, fi.Name()))
+		}
+	}
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) == uid {
+			if err := os.Lchown(path, 0, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listen returns the connection on which to receive DHCP requests on
+// interface ifname, as configured by -receive.
+func listen(ifname string) (net.PacketConn, error) {
+	switch *receive {
+	case "udp":
+		return conn.NewUDP4BoundListener(ifname, ":67")
+	case "packet":
+		ifc, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return nil, err
+		}
+		pc, err := dhcp4d.ListenPacket(ifc)
+		if err != nil {
+			return nil, err
+		}
+		// Without a UDP socket on port 67, the kernel answers unicast
+		// requests (e.g. renewals) with ICMP port unreachable. The
+		// AF_PACKET socket receives the same requests, so the UDP
+		// socket is only drained.
+		udp, err := conn.NewUDP4BoundListener(ifname, ":67")
+		if err != nil {
+			log.Printf("%s: not draining UDP port 67 (unicast requests might be answered with ICMP port unreachable): %v", ifname, err)
+			return pc, nil
+		}
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := udp.ReadFrom(buf); err != nil {
+					return
+				}
+			}
+		}()
+		return &drainedConn{PacketConn: pc, udp: udp}, nil
+	default:
+		return nil, fmt.Errorf("unknown -receive value %q, expected “udp” or “packet”", *receive)
+	}
+}
+
+// drainedConn is a packet connection which closes the UDP socket drained
+// alongside it when closed.
+type drainedConn struct {
+	net.PacketConn
+	udp net.PacketConn
+}
+
+func (c *drainedConn) Close() error {
+	c.udp.Close()
+	return c.PacketConn.Close()
+}
+
+// mux serves the HTTP endpoints of dhcp4d.
+var mux = http.NewServeMux()
+
+// Daemon is dhcp4d, see package daemon.
+var Daemon = &daemon.Daemon{
+	Name:      "dhcp4d",
+	Flags:     flags,
+	Logic:     logic,
+	Supervise: true,
+}
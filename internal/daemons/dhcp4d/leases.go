@@ -0,0 +1,434 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/killswitch"
+)
+
+// leaseView is a lease with the details shown on the status page.
+type leaseView struct {
+	dhcp4d.Lease
+
+	Vendor  string
+	Expired bool
+	Static  bool
+
+	// DNSName is the name under which dnsd resolves the lease, which differs
+	// from Hostname if other devices claim the same hostname.
+	DNSName string
+
+	// LastSeen is when the device last sent ARP, NDP or DHCP messages, or
+	// the zero time if it was not seen since router7 started tracking.
+	LastSeen time.Time
+
+	Device *devices.Device
+
+	Cut           bool
+	KillswitchURL string
+	RedirectURL   string
+}
+
+// State returns “static”, “expired” or “active”.
+func (l *leaseView) State() string {
+	if l.Static {
+		return "static"
+	}
+	if l.Expired {
+		return "expired"
+	}
+	return "active"
+}
+
+// leaseViews returns the current leases for displaying them in response to r.
+func leaseViews(r *http.Request) []leaseView {
+	// The kill switch is implemented by netconfigd, which modifies the
+	// firewall.
+	reqHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		reqHost = r.Host
+	}
+	killswitchURL := "http://" + net.JoinHostPort(reqHost, "8066") + "/killswitch"
+	redirectURL := "http://" + r.Host + r.URL.RequestURI()
+	cut := make(map[string]bool)
+	if state, err := killswitch.Read("/perm"); err == nil {
+		for _, c := range state.Active(time.Now()) {
+			cut[c.HardwareAddr] = true
+		}
+	}
+
+	reg := loadedDevices()
+	now := time.Now()
+	leases := currentLeases()
+	names := dhcp4d.DNSNames(leases, now)
+	views := make([]leaseView, 0, len(leases))
+	for idx, l := range leases {
+		d, _ := reg.Lookup(l.HardwareAddr)
+		views = append(views, leaseView{
+			Lease:   *l,
+			Vendor:  ouiDB.Lookup(l.HardwareAddr[:8]),
+			Expired: l.Expired(now),
+			Static:  l.Expiry.IsZero(),
+			DNSName: names[idx],
+
+			LastSeen: neighbors.LastSeen(l.HardwareAddr),
+
+			Device: d,
+
+			Cut:           cut[l.HardwareAddr],
+			KillswitchURL: killswitchURL,
+			RedirectURL:   redirectURL,
+		})
+	}
+	return views
+}
+
+// leaseColumns are the columns by which leases can be sorted.
+var leaseColumns = map[string]func(a, b *leaseView) bool{
+	"addr": func(a, b *leaseView) bool {
+		return bytes.Compare(a.Addr.To16(), b.Addr.To16()) < 0
+	},
+	"device": func(a, b *leaseView) bool {
+		return deviceName(a) < deviceName(b)
+	},
+	"hostname": func(a, b *leaseView) bool {
+		return strings.ToLower(a.Hostname) < strings.ToLower(b.Hostname)
+	},
+	"hwaddr": func(a, b *leaseView) bool {
+		return a.HardwareAddr < b.HardwareAddr
+	},
+	"vendor": func(a, b *leaseView) bool {
+		return a.Vendor < b.Vendor
+	},
+	"expiry": func(a, b *leaseView) bool {
+		if a.Static != b.Static {
+			return a.Static // static leases never expire
+		}
+		return a.Expiry.Before(b.Expiry)
+	},
+	"seen": func(a, b *leaseView) bool {
+		return a.LastSeen.Before(b.LastSeen)
+	},
+}
+
+func deviceName(l *leaseView) string {
+	if l.Device == nil {
+		return ""
+	}
+	return strings.ToLower(l.Device.Name)
+}
+
+// leaseQuery selects, orders and paginates leases for the status page and the
+// CSV export.
+type leaseQuery struct {
+	Search  string // case-insensitive substring of MAC address, client ID, vendor, hostname or device
+	State   string // “static”, “active” or “expired”, empty for all leases
+	Sort    string // key of leaseColumns, empty for static leases first, then most recent
+	Desc    bool
+	Page    int // starting at 1
+	PerPage int
+	Lang    string // explicitly chosen user interface language, if any
+}
+
+func parseLeaseQuery(v url.Values) leaseQuery {
+	q := leaseQuery{
+		Search:  strings.TrimSpace(v.Get("q")),
+		State:   v.Get("state"),
+		Sort:    strings.TrimPrefix(v.Get("sort"), "-"),
+		Desc:    strings.HasPrefix(v.Get("sort"), "-"),
+		Page:    1,
+		PerPage: 50,
+		Lang:    v.Get("lang"),
+	}
+	if _, ok := leaseColumns[q.Sort]; !ok {
+		q.Sort = ""
+		q.Desc = false
+	}
+	if page, err := strconv.Atoi(v.Get("page")); err == nil && page > 0 {
+		q.Page = page
+	}
+	if perPage, err := strconv.Atoi(v.Get("per_page")); err == nil && perPage > 0 {
+		q.PerPage = perPage
+	}
+	return q
+}
+
+func (q leaseQuery) values() url.Values {
+	v := make(url.Values)
+	if q.Search != "" {
+		v.Set("q", q.Search)
+	}
+	if q.State != "" {
+		v.Set("state", q.State)
+	}
+	if q.Sort != "" {
+		sort := q.Sort
+		if q.Desc {
+			sort = "-" + sort
+		}
+		v.Set("sort", sort)
+	}
+	if q.Page != 1 {
+		v.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PerPage != 50 {
+		v.Set("per_page", strconv.Itoa(q.PerPage))
+	}
+	if q.Lang != "" {
+		v.Set("lang", q.Lang)
+	}
+	return v
+}
+
+// URL returns the query string of q, for use in links.
+func (q leaseQuery) URL() string {
+	if enc := q.values().Encode(); enc != "" {
+		return "?" + enc
+	}
+	return "?"
+}
+
+// SortURL returns the URL of the first page sorted by column, toggling the
+// sort order if already sorted by column.
+func (q leaseQuery) SortURL(column string) string {
+	q.Desc = q.Sort == column && !q.Desc
+	q.Sort = column
+	q.Page = 1
+	return q.URL()
+}
+
+// PrevURL returns the URL of the previous page.
+func (q leaseQuery) PrevURL() string {
+	q.Page--
+	return q.URL()
+}
+
+// NextURL returns the URL of the next page.
+func (q leaseQuery) NextURL() string {
+	q.Page++
+	return q.URL()
+}
+
+func (q leaseQuery) matches(l *leaseView) bool {
+	if q.State != "" && l.State() != q.State {
+		return false
+	}
+	if q.Search == "" {
+		return true
+	}
+	search := strings.ToLower(q.Search)
+	for _, field := range []string{
+		l.HardwareAddr,
+		l.ClientID,
+		l.Vendor,
+		l.Hostname,
+		deviceName(l),
+		l.Addr.String(),
+	} {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the leases matching q, in the order requested by q.
+func (q leaseQuery) filter(views []leaseView) []leaseView {
+	var result []leaseView
+	for _, l := range views {
+		if q.matches(&l) {
+			result = append(result, l)
+		}
+	}
+	less := leaseColumns[q.Sort]
+	if less == nil {
+		less = func(a, b *leaseView) bool {
+			if a.Static != b.Static {
+				return a.Static
+			}
+			if a.Static {
+				return a.Num < b.Num
+			}
+			return !a.Expiry.Before(b.Expiry)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if q.Desc {
+			return less(&result[j], &result[i])
+		}
+		return less(&result[i], &result[j])
+	})
+	return result
+}
+
+// Pages returns the number of pages for total leases.
+func (q leaseQuery) Pages(total int) int {
+	if total == 0 {
+		return 1
+	}
+	return (total + q.PerPage - 1) / q.PerPage
+}
+
+// paginate returns the leases on the requested page.
+func (q leaseQuery) paginate(views []leaseView) []leaseView {
+	start := (q.Page - 1) * q.PerPage
+	if start >= len(views) {
+		return nil
+	}
+	end := start + q.PerPage
+	if end > len(views) {
+		end = len(views)
+	}
+	return views[start:end]
+}
+
+// csvCell returns s such that spreadsheet applications do not interpret it as
+// a formula: client-supplied values like hostnames could otherwise execute
+// e.g. =HYPERLINK(…) when an exported file is opened.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeLeasesCSV writes views as CSV, escaping cells which spreadsheet
+// applications would interpret as formulas (see csvCell).
+func writeLeasesCSV(w http.ResponseWriter, views []leaseView) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="leases.csv"`)
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{
+		"addr",
+		"hostname",
+		"hostname_override",
+		"hardware_addr",
+		"client_id",
+		"vendor",
+		"device",
+		"state",
+		"expiry",
+		"dns_name",
+		"last_seen",
+	}); err != nil {
+		return err
+	}
+	for _, l := range views {
+		var device, expiry, seen string
+		if l.Device != nil {
+			device = l.Device.Name
+		}
+		if !l.Static {
+			expiry = l.Expiry.Format(time.RFC3339)
+		}
+		if !l.LastSeen.IsZero() {
+			seen = l.LastSeen.Format(time.RFC3339)
+		}
+		record := []string{
+			l.Addr.String(),
+			l.Hostname,
+			l.HostnameOverride,
+			l.HardwareAddr,
+			l.ClientID,
+			l.Vendor,
+			device,
+			l.State(),
+			expiry,
+			l.DNSName,
+			seen,
+		}
+		for i, cell := range record {
+			record[i] = csvCell(cell)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// apiLease is a lease as returned by /api/v1/leases. The schema is stable:
+// fields are only ever added, never renamed or removed.
+type apiLease struct {
+	Addr             string     `json:"addr"`
+	HardwareAddr     string     `json:"hardware_addr"`
+	ClientID         string     `json:"client_id"`
+	Hostname         string     `json:"hostname"`
+	HostnameOverride string     `json:"hostname_override"`
+	Vendor           string     `json:"vendor"`
+	Device           string     `json:"device"`
+	DeviceGroup      string     `json:"device_group"`
+	State            string     `json:"state"` // “static”, “active” or “expired”
+	Static           bool       `json:"static"`
+	Active           bool       `json:"active"`
+	Expiry           *time.Time `json:"expiry"` // null for static leases
+	InternetCut      bool       `json:"internet_cut"`
+	DNSName          string     `json:"dns_name"`  // empty if not resolvable
+	LastSeen         *time.Time `json:"last_seen"` // null if never seen
+}
+
+type apiLeases struct {
+	Leases []apiLease `json:"leases"`
+	Total  int        `json:"total"` // number of matching leases (on all pages)
+}
+
+func newAPILeases(views []leaseView, total int) apiLeases {
+	result := apiLeases{
+		Leases: make([]apiLease, 0, len(views)),
+		Total:  total,
+	}
+	for _, l := range views {
+		al := apiLease{
+			Addr:             l.Addr.String(),
+			HardwareAddr:     l.HardwareAddr,
+			ClientID:         l.ClientID,
+			Hostname:         l.Hostname,
+			HostnameOverride: l.HostnameOverride,
+			Vendor:           l.Vendor,
+			State:            l.State(),
+			Static:           l.Static,
+			Active:           l.State() == "active",
+			InternetCut:      l.Cut,
+			DNSName:          l.DNSName,
+		}
+		if l.Device != nil {
+			al.Device = l.Device.Name
+			al.DeviceGroup = l.Device.Group
+		}
+		if !l.Static {
+			expiry := l.Expiry
+			al.Expiry = &expiry
+		}
+		if !l.LastSeen.IsZero() {
+			seen := l.LastSeen
+			al.LastSeen = &seen
+		}
+		result.Leases = append(result.Leases, al)
+	}
+	return result
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"encoding/csv"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+func TestParseLeaseQuery(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  leaseQuery
+	}{
+		{"", leaseQuery{Page: 1, PerPage: 50}},
+		{"q=+xps+&state=active", leaseQuery{Search: "xps", State: "active", Page: 1, PerPage: 50}},
+		{"sort=-seen&page=3&per_page=10", leaseQuery{Sort: "seen", Desc: true, Page: 3, PerPage: 10}},
+		{"sort=-password&page=-1&per_page=x", leaseQuery{Page: 1, PerPage: 50}},
+		{"lang=de", leaseQuery{Page: 1, PerPage: 50, Lang: "de"}},
+	} {
+		v, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, parseLeaseQuery(v)); diff != "" {
+			t.Errorf("parseLeaseQuery(%q): unexpected result: diff (-want +got):\n%s", tt.query, diff)
+		}
+	}
+}
+
+func TestLeaseQueryURLs(t *testing.T) {
+	q := leaseQuery{Search: "xps", Sort: "addr", Page: 2, PerPage: 50}
+	for _, tt := range []struct {
+		desc string
+		got  string
+		want string
+	}{
+		{"URL", q.URL(), "?page=2&q=xps&sort=addr"},
+		{"SortURL(addr)", q.SortURL("addr"), "?q=xps&sort=-addr"},
+		{"SortURL(hostname)", q.SortURL("hostname"), "?q=xps&sort=hostname"},
+		{"PrevURL", q.PrevURL(), "?q=xps&sort=addr"},
+		{"NextURL", q.NextURL(), "?page=3&q=xps&sort=addr"},
+		{"empty", leaseQuery{Page: 1, PerPage: 50}.URL(), "?"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.desc, tt.got, tt.want)
+		}
+	}
+	// Parsing the URLs must result in the original query.
+	desc := q.SortURL("addr")
+	v, err := url.ParseQuery(desc[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseLeaseQuery(v); got.Sort != "addr" || !got.Desc || got.Page != 1 {
+		t.Errorf("parseLeaseQuery(%q) = %+v, want sorted by addr, descending, page 1", desc, got)
+	}
+}
+
+func testLeaseViews() []leaseView {
+	now := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	view := func(num int, hostname, hwaddr string, expiry time.Time, expired bool) leaseView {
+		return leaseView{
+			Lease: dhcp4d.Lease{
+				Num:          num,
+				Addr:         net.IPv4(192, 168, 42, byte(num+2)),
+				HardwareAddr: hwaddr,
+				Hostname:     hostname,
+				Expiry:       expiry,
+			},
+			Static:  expiry.IsZero(),
+			Expired: expired,
+		}
+	}
+	views := []leaseView{
+		view(10, "xps", "02:00:00:00:00:10", now.Add(time.Hour), false),
+		view(1, "printer", "02:00:00:00:00:01", time.Time{}, false),
+		view(20, "phone", "02:00:00:00:00:20", now.Add(-time.Hour), true),
+		view(0, "nas", "02:00:00:00:00:00", time.Time{}, false),
+		view(30, "Tablet", "02:00:00:00:00:30", now.Add(2*time.Hour), false),
+	}
+	views[0].Vendor = "Dell Inc."
+	views[4].Device = &devices.Device{Name: "Living room tablet"}
+	return views
+}
+
+func hostnames(views []leaseView) []string {
+	names := make([]string, 0, len(views))
+	for _, l := range views {
+		names = append(names, l.Hostname)
+	}
+	return names
+}
+
+func TestLeaseQueryFilter(t *testing.T) {
+	views := testLeaseViews()
+	for _, tt := range []struct {
+		desc string
+		q    leaseQuery
+		want []string
+	}{
+		{
+			desc: "default order: static first, then most recent",
+			want: []string{"nas", "printer", "Tablet", "xps", "phone"},
+		},
+		{
+			desc: "state",
+			q:    leaseQuery{State: "active"},
+			want: []string{"Tablet", "xps"},
+		},
+		{
+			desc: "search hostname, case-insensitive",
+			q:    leaseQuery{Search: "TAB"},
+			want: []string{"Tablet"},
+		},
+		{
+			desc: "search vendor",
+			q:    leaseQuery{Search: "dell"},
+			want: []string{"xps"},
+		},
+		{
+			desc: "search device",
+			q:    leaseQuery{Search: "living room"},
+			want: []string{"Tablet"},
+		},
+		{
+			desc: "search address",
+			q:    leaseQuery{Search: "192.168.42.22"},
+			want: []string{"phone"},
+		},
+		{
+			desc: "sort by hostname",
+			q:    leaseQuery{Sort: "hostname"},
+			want: []string{"nas", "phone", "printer", "Tablet", "xps"},
+		},
+		{
+			desc: "sort by address, descending",
+			q:    leaseQuery{Sort: "addr", Desc: true},
+			want: []string{"Tablet", "phone", "xps", "printer", "nas"},
+		},
+		{
+			desc: "sort by expiry: static leases never expire",
+			q:    leaseQuery{Sort: "expiry", Desc: true},
+			want: []string{"Tablet", "xps", "phone", "printer", "nas"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, hostnames(tt.q.filter(views))); diff != "" {
+				t.Errorf("filter: unexpected result: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLeaseQueryPaginate(t *testing.T) {
+	views := testLeaseViews()
+	for _, tt := range []struct {
+		page, perPage int
+		want          []string
+		pages         int
+	}{
+		{1, 50, []string{"xps", "printer", "phone", "nas", "Tablet"}, 1},
+		{1, 2, []string{"xps", "printer"}, 3},
+		{3, 2, []string{"Tablet"}, 3},
+		{4, 2, []string{}, 3},
+	} {
+		q := leaseQuery{Page: tt.page, PerPage: tt.perPage}
+		if diff := cmp.Diff(tt.want, hostnames(q.paginate(views))); diff != "" {
+			t.Errorf("paginate(page %d, %d per page): unexpected result: diff (-want +got):\n%s", tt.page, tt.perPage, diff)
+		}
+		if got := q.Pages(len(views)); got != tt.pages {
+			t.Errorf("Pages(%d per page) = %d, want %d", tt.perPage, got, tt.pages)
+		}
+	}
+	if got, want := (leaseQuery{PerPage: 50}).Pages(0), 1; got != want {
+		t.Errorf("Pages(0) = %d, want %d", got, want)
+	}
+}
+
+func TestWriteLeasesCSV(t *testing.T) {
+	views := testLeaseViews()[:2]
+	views[0].Hostname = "=HYPERLINK(\"http://example.com\")"
+	views[0].ClientID = "@SUM(1)"
+	rec := httptest.NewRecorder()
+	if err := writeLeasesCSV(rec, views); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "text/csv; charset=utf-8"; got != want {
+		t.Errorf("unexpected Content-Type: got %q, want %q", got, want)
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(records), 3; got != want {
+		t.Fatalf("got %d records, want %d (header and 2 leases)", got, want)
+	}
+	want := []string{
+		"192.168.42.12",
+		"'=HYPERLINK(\"http://example.com\")",
+		"",
+		"02:00:00:00:00:10",
+		"'@SUM(1)",
+		"Dell Inc.",
+		"",
+		"active",
+		"2018-07-04T13:00:00Z",
+		"",
+		"",
+	}
+	if diff := cmp.Diff(want, records[1]); diff != "" {
+		t.Errorf("unexpected record: diff (-want +got):\n%s", diff)
+	}
+	if got, want := records[2][7], "static"; got != want {
+		t.Errorf("unexpected state: got %q, want %q", got, want)
+	}
+	if got, want := records[2][8], ""; got != want {
+		t.Errorf("unexpected expiry of static lease: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/raw"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/bpf"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+var lastSeen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Subsystem: "dhcp4d",
+	Name:      "last_seen_timestamp_seconds",
+	Help:      "When the device of a non-expired lease last sent ARP, NDP or DHCP messages, in seconds since the epoch",
+}, []string{"hwaddr", "device"})
+
+// neighbors tracks when devices were last seen on the LAN.
+var neighbors *dhcp4d.Neighbors
+
+// listenNeighbors opens packet sockets for ARP and NDP frames on ifc. This
+// must happen before dropping privileges.
+func listenNeighbors(ifc *net.Interface) ([]net.PacketConn, error) {
+	ndp, err := bpf.Assemble(dhcp4d.NDPFilter)
+	if err != nil {
+		return nil, err
+	}
+	var conns []net.PacketConn
+	for _, sock := range []struct {
+		proto  int
+		filter []bpf.RawInstruction
+	}{
+		{syscall.ETH_P_ARP, nil},
+		{syscall.ETH_P_IPV6, ndp},
+	} {
+		conn, err := raw.ListenPacket(ifc, uint16(sock.proto), &raw.Config{
+			Filter: sock.filter,
+		})
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// watchNeighbors records the senders of ARP and NDP messages received on conn
+// in neighbors.
+func watchNeighbors(conn net.PacketConn, mtu int) {
+	buf := make([]byte, mtu+14) // MTU plus ethernet header
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("not tracking neighbors: %v", err)
+			return
+		}
+		neighbors.Inspect(buf[:n], time.Now())
+	}
+}
+
+// persistNeighbors periodically updates the last seen metrics and writes the
+// last seen timestamps to /perm/dhcp4d/lastseen.json (unless persist is
+// false, e.g. in dry-run mode), so that they survive restarts.
+func persistNeighbors(interval time.Duration, persist bool) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		if persist {
+			if err := neighbors.Persist("/perm", now); err != nil {
+				log.Printf("persisting last seen timestamps: %v", err)
+			}
+		}
+		reg := loadedDevices()
+		lastSeen.Reset()
+		for _, l := range currentLeases() {
+			if l.Expired(now) {
+				continue
+			}
+			seen := neighbors.LastSeen(l.HardwareAddr)
+			if seen.IsZero() {
+				continue
+			}
+			name := l.Hostname
+			if d, ok := reg.Lookup(l.HardwareAddr); ok {
+				name = d.Name
+			}
+			lastSeen.With(prometheus.Labels{
+				"hwaddr": l.HardwareAddr,
+				"device": name,
+			}).Set(float64(seen.Unix()))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/krolaw/dhcp4"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+var (
+	// leasesMu guards ifaceLeases and leases. Both hold copies of the
+	// handlers’ leases, which the handlers modify under their own lock.
+	leasesMu sync.Mutex
+
+	// ifaceLeases are the leases of each served interface: the -interface
+	// flag and the networks of networks.json. They are persisted together
+	// in /perm/dhcp4d/leases.json.
+	ifaceLeases = make(map[string][]*dhcp4d.Lease)
+)
+
+// leasesByInterface splits all into the leases within the subnet of each
+// network, keyed by interface name, and the remaining leases of the -interface
+// flag.
+func leasesByInterface(all []*dhcp4d.Lease, networks []netconfig.Network) map[string][]*dhcp4d.Lease {
+	var subnets []*net.IPNet
+	for _, n := range networks {
+		_, ipnet, _ := net.ParseCIDR(n.Addr) // validated by ReadNetworks
+		subnets = append(subnets, ipnet)
+	}
+	byIface := make(map[string][]*dhcp4d.Lease)
+	for _, l := range all {
+		ifname := *iface
+		for i, subnet := range subnets {
+			if subnet.Contains(l.Addr) {
+				ifname = networks[i].Name
+				break
+			}
+		}
+		byIface[ifname] = append(byIface[ifname], l)
+	}
+	return byIface
+}
+
+// copyLeases returns copies of leases.
+func copyLeases(leases []*dhcp4d.Lease) []*dhcp4d.Lease {
+	copies := make([]*dhcp4d.Lease, len(leases))
+	for i, l := range leases {
+		c := *l
+		copies[i] = &c
+	}
+	return copies
+}
+
+// setLeases makes (copies of) newLeases the current leases of interface ifname
+// and returns the leases of all interfaces, which are also stored in leases.
+// The returned leases must not be modified.
+func setLeases(ifname string, newLeases []*dhcp4d.Lease) []*dhcp4d.Lease {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	ifaceLeases[ifname] = copyLeases(newLeases)
+	names := make([]string, 0, len(ifaceLeases))
+	for name := range ifaceLeases {
+		if name != *iface {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	all := append([]*dhcp4d.Lease(nil), ifaceLeases[*iface]...)
+	for _, name := range names {
+		all = append(all, ifaceLeases[name]...)
+	}
+	leases = all
+	return all
+}
+
+// interfaceLeases returns copies of the current leases of interface ifname.
+func interfaceLeases(ifname string) []*dhcp4d.Lease {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	return copyLeases(ifaceLeases[ifname])
+}
+
+// currentLeases returns the current leases of all interfaces, which must not
+// be modified.
+func currentLeases() []*dhcp4d.Lease {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	return leases
+}
+
+// networkHandler serves DHCPv4 on the VLAN interface of a network from
+// networks.json.
+type networkHandler struct {
+	*dhcp4d.Handler
+	ifname string
+	conn   net.PacketConn
+}
+
+// newNetworkHandler configures a handler for network n, whose settings are
+// derived from the network: the subnet and router are those of the network
+// interface, and the domains and device registry are shared with the
+// -interface flag.
+func newNetworkHandler(n netconfig.Network, domains []string) (*networkHandler, error) {
+	h, err := dhcp4d.NewHandler("/perm", nil, n.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.SetConfig(dhcp4d.NetworkConfig(n)); err != nil {
+		return nil, fmt.Errorf("networks.json: network %s: %v", n.Name, err)
+	}
+	if err := h.SetDomains(domains); err != nil {
+		return nil, err
+	}
+	h.SetLeases(interfaceLeases(n.Name))
+	if *advertiseNTP {
+		h.AdvertiseNTP()
+	}
+	h.DryRun = *dryRun
+	h.IgnoreBroadcastFlag = *ignoreBroadcastFlag
+	c, err := listen(n.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &networkHandler{Handler: h, ifname: n.Name, conn: c}, nil
+}
+
+func (h *networkHandler) serve() error {
+	return dhcp4.Serve(h.conn, instrumentedHandler{h.Handler})
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diagd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/diag"
+)
+
+// wanAlerts sends an alert once the connectivity diagnostics failed for longer
+// than the configured duration, and another one once they recover.
+type wanAlerts struct {
+	alerter   *alert.Alerter
+	downSince time.Time
+	alerted   bool
+}
+
+func (w *wanAlerts) update(fe *diag.EvalResult, now time.Time) {
+	if fe == nil {
+		if w.alerted {
+			w.alerter.Resolved("wan-down")
+			w.alerter.Alert("wan-up", "WAN connection restored",
+				fmt.Sprintf("The WAN connection was down from %v to %v.\n", w.downSince.Format(time.RFC1123), now.Format(time.RFC1123)))
+		}
+		w.downSince = time.Time{}
+		w.alerted = false
+		return
+	}
+	if w.downSince.IsZero() {
+		w.downSince = now
+	}
+	after, err := w.alerter.Config().WANDownAfterDuration()
+	if err != nil || w.alerted || now.Sub(w.downSince) < after {
+		return
+	}
+	w.alerted = true
+	w.alerter.Alert("wan-down", "WAN connection down",
+		fmt.Sprintf("The WAN connection is down since %v:\n\n%s: %s\n", w.downSince.Format(time.RFC1123), fe.Name, fe.Status))
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diagd
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+//go:embed audit.html.tmpl
+var auditHTML string
+
+var auditTmpl = webui.Must(webui.Parse("diagd", auditHTML, nil))
+
+// handleAudit serves the audit log of administrative actions of all daemons
+// (most recent first), and exports it as CSV or JSON (oldest first).
+func handleAudit() {
+	mux.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := auditlog.Read("/perm")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		table := &webui.Table{
+			Columns: []string{"time", "daemon", "action", "actor", "before", "after"},
+			Empty:   "no_audit_entries",
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			table.Append(
+				webui.Text(e.Time.Format("2006-01-02 15:04:05")),
+				webui.Text(e.Daemon),
+				webui.Text(e.Action),
+				webui.Addr(e.Actor()),
+				webui.Addr(string(e.Before)),
+				webui.Addr(string(e.After)))
+		}
+		if err := auditTmpl.Execute(w, r, struct {
+			Entries *webui.Table
+		}{table}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/audit.csv", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := auditlog.Read("/perm")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		if err := auditlog.WriteCSV(w, entries); err != nil {
+			log.Printf("writing CSV: %v", err)
+		}
+	})
+	mux.HandleFunc("/audit.json", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := auditlog.Read("/perm")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []auditlog.Entry{}
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
@@ -0,0 +1,357 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diagd implements diagd, which provides automated network
+// diagnostics.
+package diagd
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/diag"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/history"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/status"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flags, "diagd", "7733")
+
+	// statusListeners serve the public status page on the addresses
+	// configured in /perm/status.json, which are typically not private.
+	statusListeners = multilisten.NewPool()
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = mux
+		// Traceroutes can take longer than the default write timeout.
+		srv.WriteTimeout = 5 * time.Minute
+		return srv
+	})
+	return nil
+}
+
+// updateStatusListeners (re-)configures the public status page from
+// /perm/status.json.
+func updateStatusListeners(page *status.Page) error {
+	cfg, err := status.ReadConfig("/perm")
+	if err != nil {
+		return err
+	}
+	page.SetConfig(cfg)
+	statusListeners.ListenAndServe(cfg.Listen, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = page
+		return srv
+	})
+	return nil
+}
+
+func firstError(re *diag.EvalResult) *diag.EvalResult {
+	if re.Error {
+		return re
+	}
+	for _, ch := range re.Children {
+		if fe := firstError(ch); fe != nil {
+			return fe
+		}
+	}
+	return nil
+}
+
+var nodeHealthy = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "diag_node_healthy",
+		Help: "Whether the diagnostics node succeeded (1) or failed (0) in the most recent evaluation",
+	},
+	[]string{"node", "layer"},
+)
+
+func updateMetrics(re *diag.EvalResult) {
+	re.Walk(func(r *diag.EvalResult) {
+		healthy := 1.0
+		if r.Error {
+			healthy = 0
+		}
+		nodeHealthy.WithLabelValues(r.Name, string(r.Layer)).Set(healthy)
+	})
+}
+
+// flushWriter flushes after each write so that probe results are streamed to
+// the browser as they come in.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// maxProbes bounds the number of concurrently running pings and traceroutes:
+// each of them sends packets until it finishes or the client disconnects.
+const maxProbes = 2
+
+var probes = make(chan struct{}, maxProbes)
+
+func probeHandler(probe func(ctx context.Context, w io.Writer, network, target string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target parameter missing", http.StatusBadRequest)
+			return
+		}
+		network := "ip4"
+		if r.FormValue("family") == "6" {
+			network = "ip6"
+		}
+		select {
+		case probes <- struct{}{}:
+			defer func() { <-probes }()
+		default:
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "too many concurrent probes, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fw := flushWriter{w}
+		if err := probe(r.Context(), fw, network, target); err != nil {
+			fmt.Fprintf(fw, "error: %v\n", err)
+		}
+	}
+}
+
+//go:embed diagd.html.tmpl
+var diagdHTML string
+
+var diagdTmpl = webui.Must(webui.Parse("diagd", diagdHTML, nil))
+
+func logic() error {
+	const (
+		uplink        = "uplink0" /* enp0s31f6 */
+		ip6allrouters = "ff02::2" // no /etc/hosts on gokrazy
+	)
+	m := diag.NewMonitor(diag.Link(uplink).
+		Then(diag.DHCPv4().
+			Then(diag.DefaultRoute4().
+				Then(diag.Ping4Gateway().
+					Then(diag.DNS("google.ch").
+						Then(diag.Ping4("google.ch").
+							Then(diag.TCP4("www.google.ch:80"))))))).
+		Then(diag.DHCPv6().
+			Then(diag.Ping6("lan0", "google.ch"))).
+		Then(diag.RouterAdvertisments(uplink).
+			Then(diag.DefaultRoute6().
+				Then(diag.Ping6Gateway().
+					Then(diag.Ping6(uplink, "google.ch").
+						Then(diag.TCP6("www.google.ch:80")))))).
+		Then(diag.Ping6("", ip6allrouters+"%"+uplink)))
+	var mu sync.Mutex
+	evaluate := func() *diag.EvalResult {
+		mu.Lock()
+		defer mu.Unlock()
+		re := m.Evaluate()
+		updateMetrics(re)
+		return re
+	}
+	alerter := alert.NewAlerter("/perm")
+	perm := newDiskMonitor("/perm", alerter)
+	healthz.Register("perm", perm.healthy)
+	page := status.NewPage(&status.Config{})
+	if err := updateStatusListeners(page); err != nil {
+		log.Printf("status page: %v", err)
+	}
+	go func() {
+		// Keep the metrics current even when nobody looks at the web page.
+		wan := &wanAlerts{alerter: alerter}
+		for {
+			fe := firstError(evaluate())
+			wan.update(fe, time.Now())
+			page.SetWAN(fe == nil, wanAddr())
+			if err := perm.check(); err != nil {
+				log.Printf("checking /perm: %v", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+	store, err := history.Open("/perm/diagd/history", time.Duration(*historyDays)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	go recordHistory(store, uplink)
+	handleHistory(store)
+	reports, err := newReporter(store, alerter)
+	if err != nil {
+		return err
+	}
+	go reports.run()
+	mux.Handle("/report", reports)
+	handleAudit()
+	daemon.HandleShared(mux)
+	mux.Handle(profiling.Prefix, profiling.Handler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := diagdTmpl.Execute(w, r, struct {
+			Result *diag.EvalResult
+			Perm   string
+		}{
+			Result: evaluate(),
+			Perm:   perm.status(),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.Handle("/ping", auth.RequirePassword("diagd", probeHandler(func(ctx context.Context, w io.Writer, network, target string) error {
+		return diag.StreamPing(ctx, w, network, target, 10)
+	})))
+	mux.Handle("/traceroute", auth.RequirePassword("diagd", probeHandler(func(ctx context.Context, w io.Writer, network, target string) error {
+		return diag.Traceroute(ctx, w, network, target, 30, 3)
+	})))
+	mux.HandleFunc("/health.json", func(w http.ResponseWriter, r *http.Request) {
+		re := evaluate()
+		reply := struct {
+			FirstError      string     `json:"first_error"`
+			FirstErrorLayer diag.Layer `json:"first_error_layer,omitempty"`
+			Failures        []string   `json:"failures"` // names of all failing nodes
+			Internet        bool       `json:"internet"` // whether any internet node succeeded
+		}{
+			Failures: []string{},
+		}
+		if fe := firstError(re); fe != nil {
+			reply.FirstError = fmt.Sprintf("%s: %s", fe.Name, fe.Status)
+			reply.FirstErrorLayer = fe.Layer
+		}
+		re.Walk(func(r *diag.EvalResult) {
+			if r.Error {
+				reply.Failures = append(reply.Failures, r.Name)
+			} else if r.Layer == diag.LayerInternet {
+				reply.Internet = true
+			}
+		})
+		b, err := json.Marshal(&reply)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+	// /readyz aggregates the /healthz endpoints of all daemons and the
+	// connectivity diagnostics into the overall router readiness, e.g. for
+	// failover or update orchestration.
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		targets := make(map[string]string)
+		for name, addr := range multilisten.ResolveAll(healthz.DefaultTargets) {
+			if name != "diagd" {
+				targets[name] = addr
+			}
+		}
+		if daemon.Combined() {
+			// The components share one /healthz, see daemon.HandleShared.
+			for _, name := range daemon.Components() {
+				delete(targets, name)
+			}
+			targets["router7"] = multilisten.Resolve("router7", "localhost:"+daemon.SharedPort)
+		}
+		ctx, canc := context.WithTimeout(r.Context(), 10*time.Second)
+		defer canc()
+		status := healthz.Aggregate(ctx, http.DefaultClient, targets)
+		if fe := firstError(evaluate()); fe != nil {
+			status.Healthy = false
+			status.Failures = append(status.Failures, healthz.Failure{
+				Daemon: "diagd",
+				Check:  fe.Name,
+				Reason: fe.Status,
+			})
+		}
+		healthz.Write(w, status)
+	})
+	mux.HandleFunc("/graph.json", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(evaluate())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	ch := make(chan os.Signal, 1)
+	notify.Signal(ch, "diagd", syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		if err := alerter.Reload(); err != nil {
+			log.Printf("reloading alert config: %v", err)
+		}
+		if err := reports.reload(); err != nil {
+			log.Printf("reloading report config: %v", err)
+		}
+		if err := updateStatusListeners(page); err != nil {
+			log.Printf("status page: %v", err)
+		}
+	}
+	return nil
+}
+
+// mux serves the HTTP endpoints of diagd.
+var mux = http.NewServeMux()
+
+// Daemon is diagd, see package daemon.
+var Daemon = &daemon.Daemon{
+	Name:      "diagd",
+	Flags:     flags,
+	Logic:     logic,
+	Supervise: true,
+}
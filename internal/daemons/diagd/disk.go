@@ -0,0 +1,155 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diagd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/disk"
+)
+
+var (
+	diskLifeTimeUsed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "disk_life_time_used_percent",
+			Help: "Estimated used life time of the eMMC device (upper bound, in steps of 10%), by memory type",
+		},
+		[]string{"device", "type"},
+	)
+
+	diskPreEOL = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "disk_pre_eol_info",
+			Help: "Reserved block consumption of the eMMC device: 1 (normal), 2 (warning) or 3 (urgent)",
+		},
+		[]string{"device"},
+	)
+)
+
+// diskMonitor exports metrics about the file system holding dir (e.g. /perm)
+// and sends alerts when it is nearly full or its flash device wears out:
+// leases, logs and history are written continuously and can silently fill
+// small devices.
+type diskMonitor struct {
+	dir     string
+	dev     string // e.g. mmcblk0p4, empty if unknown
+	alerter *alert.Alerter
+}
+
+func newDiskMonitor(dir string, alerter *alert.Alerter) *diskMonitor {
+	m := &diskMonitor{dir: dir, alerter: alerter}
+	if f, err := os.Open("/proc/self/mounts"); err == nil {
+		m.dev, err = disk.Device(f, dir)
+		f.Close()
+		if err != nil {
+			log.Printf("not monitoring writes: %v", err)
+		}
+	}
+
+	labels := prometheus.Labels{"mountpoint": dir}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "disk_size_bytes",
+		Help:        "Size of the file system",
+		ConstLabels: labels,
+	}, func() float64 {
+		u, _ := disk.StatUsage(dir)
+		return float64(u.Size)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "disk_free_bytes",
+		Help:        "Free space of the file system",
+		ConstLabels: labels,
+	}, func() float64 {
+		u, _ := disk.StatUsage(dir)
+		return float64(u.Free)
+	})
+	if m.dev != "" {
+		promauto.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "disk_written_bytes_total",
+			Help:        "Bytes written to the device since boot",
+			ConstLabels: prometheus.Labels{"device": m.dev},
+		}, func() float64 {
+			written, _ := m.written()
+			return float64(written)
+		})
+	}
+	return m
+}
+
+func (m *diskMonitor) written() (uint64, error) {
+	f, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return disk.Written(f, m.dev)
+}
+
+// healthy is a healthz check which fails when the file system is nearly full.
+func (m *diskMonitor) healthy() error {
+	u, err := disk.StatUsage(m.dir)
+	if err != nil {
+		return err
+	}
+	if limit := m.alerter.Config().DiskFull(); u.Percent() >= limit {
+		return fmt.Errorf("%s is %.1f%% full", m.dir, u.Percent())
+	}
+	return nil
+}
+
+// status returns a human-readable summary for the diagd web page.
+func (m *diskMonitor) status() string {
+	u, err := disk.StatUsage(m.dir)
+	if err != nil {
+		return err.Error()
+	}
+	status := fmt.Sprintf("%.1f%% used, %d MiB free", u.Percent(), u.Free>>20)
+	if written, err := m.written(); err == nil {
+		status += fmt.Sprintf(", %d MiB written since boot", written>>20)
+	}
+	return status
+}
+
+// check updates the wear metrics and sends alerts, if necessary.
+func (m *diskMonitor) check() error {
+	if err := m.healthy(); err != nil {
+		m.alerter.Alert("disk-full", m.dir+" nearly full",
+			fmt.Sprintf("%v (alert threshold: %.0f%%).\n", err, m.alerter.Config().DiskFull()))
+	}
+	if m.dev == "" {
+		return nil
+	}
+	wear, err := disk.ReadWear("/sys", m.dev)
+	if err != nil {
+		return err
+	}
+	if wear == nil {
+		return nil // not an eMMC device
+	}
+	diskLifeTimeUsed.With(prometheus.Labels{"device": m.dev, "type": "A"}).Set(float64(wear.LifeTimeA))
+	diskLifeTimeUsed.With(prometheus.Labels{"device": m.dev, "type": "B"}).Set(float64(wear.LifeTimeB))
+	diskPreEOL.With(prometheus.Labels{"device": m.dev}).Set(float64(wear.PreEOL))
+	if wear.PreEOL >= 2 {
+		m.alerter.Alert("disk-wear", "flash storage wearing out",
+			fmt.Sprintf("The eMMC device %s reports pre-EOL state %d: its reserved blocks are (nearly) used up, replace it soon.\n\nestimated life time used: %d%% (type A), %d%% (type B)\n", m.dev, wear.PreEOL, wear.LifeTimeA, wear.LifeTimeB))
+	}
+	return nil
+}
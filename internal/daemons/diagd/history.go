@@ -0,0 +1,184 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diagd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/diag"
+	"github.com/rtr7/router7/internal/history"
+	"github.com/rtr7/router7/internal/linkstate"
+)
+
+var flags = flag.NewFlagSet("diagd", flag.ExitOnError)
+
+var (
+	historyTarget = flags.String("history_target",
+		"google.ch",
+		"host to ping once a minute for the uplink health history")
+
+	historyDays = flags.Int("history_days",
+		30,
+		"number of days of uplink health history to keep in /perm/diagd/history")
+)
+
+const historyProbes = 10
+
+// wanAddr returns the IPv4 address currently leased on the uplink.
+func wanAddr() string {
+	b, err := ioutil.ReadFile("/perm/dhcp4/wire/lease.json")
+	if err != nil {
+		return ""
+	}
+	var cfg dhcp4.Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return ""
+	}
+	return cfg.ClientIP
+}
+
+func uplinkUp(ifname string) bool {
+	b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifname, "operstate"))
+	return err == nil && strings.TrimSpace(string(b)) == "up"
+}
+
+// uplinkState records uplink flaps as events.
+type uplinkState struct {
+	store *history.Store
+
+	mu sync.Mutex
+	up bool
+}
+
+// set records an event if up differs from the previous state, returning
+// whether it did.
+func (u *uplinkState) set(up bool, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if up == u.up {
+		return false
+	}
+	kind := history.EventUplinkDown
+	if up {
+		kind = history.EventUplinkUp
+	}
+	u.store.AddEvent(history.Event{Time: now, Kind: kind})
+	u.up = up
+	return true
+}
+
+// recordHistory samples the uplink health once a minute and records WAN
+// address changes and uplink flaps in store. Flaps are recorded as soon as
+// netlink reports them; the samples only catch flaps which were missed.
+func recordHistory(store *history.Store, uplink string) {
+	last, lastWAN := store.Last(history.EventWANAddr)
+	state := &uplinkState{
+		store: store,
+		up:    last.Time.IsZero() || last.Up,
+	}
+	if err := linkstate.Subscribe(linkstate.Filter{
+		Kinds:     linkstate.Link,
+		Interface: uplink,
+	}, func(ev linkstate.Event) {
+		if !state.set(ev.Up, time.Now()) {
+			return
+		}
+		if err := store.Flush(); err != nil {
+			log.Printf("history: %v", err)
+		}
+	}); err != nil {
+		log.Printf("history: not watching %s: %v", uplink, err)
+	}
+	prevWAN := lastWAN.Detail
+	lastFlush := time.Now()
+	for range time.Tick(1 * time.Minute) {
+		now := time.Now()
+		sample := history.Sample{
+			Time: now,
+			Up:   uplinkUp(uplink),
+			Loss: 1,
+		}
+		if sample.Up {
+			ctx, canc := context.WithTimeout(context.Background(), 30*time.Second)
+			received, avg, err := diag.PingStats(ctx, "ip4", *historyTarget, historyProbes)
+			canc()
+			if err != nil {
+				log.Printf("history: ping %s: %v", *historyTarget, err)
+			} else {
+				sample.Loss = float64(historyProbes-received) / historyProbes
+				sample.RTT = float64(avg) / float64(time.Millisecond)
+			}
+		}
+		store.Add(sample)
+
+		changed := state.set(sample.Up, now)
+		if addr := wanAddr(); addr != "" && addr != prevWAN {
+			store.AddEvent(history.Event{Time: now, Kind: history.EventWANAddr, Detail: addr})
+			prevWAN = addr
+			changed = true
+		}
+
+		// Limit writes to the permanent partition.
+		if changed || time.Since(lastFlush) > 10*time.Minute {
+			if err := store.Flush(); err != nil {
+				log.Printf("history: %v", err)
+			}
+			lastFlush = time.Now()
+		}
+	}
+}
+
+func handleHistory(store *history.Store) {
+	rangeParam := func(r *http.Request) string {
+		if rng := r.FormValue("range"); rng != "" {
+			return rng
+		}
+		return "1d"
+	}
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		if err := store.WritePage(w, r, rangeParam(r), time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/history.json", func(w http.ResponseWriter, r *http.Request) {
+		d, ok := history.Ranges[rangeParam(r)]
+		if !ok {
+			http.Error(w, "unknown range", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		samples, events := store.Range(now.Add(-d), now)
+		b, err := json.Marshal(struct {
+			Samples []history.Sample `json:"samples"`
+			Events  []history.Event  `json:"events"`
+		}{samples, events})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diagd
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/history"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/report"
+	"github.com/rtr7/router7/internal/statefile"
+	"github.com/rtr7/router7/internal/threatintel"
+	"github.com/rtr7/router7/internal/webhook"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+//go:embed report.html.tmpl
+var reportHTML string
+
+var reportTmpl = webui.Must(webui.Parse("diagd", reportHTML, template.FuncMap{
+	"timefmt": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.1f%%", f*100)
+	},
+}))
+
+// reportLeases returns the non-expired DHCPv4 leases of dhcp4d.
+func reportLeases() ([]report.Lease, error) {
+	b, err := ioutil.ReadFile("/perm/dhcp4d/leases.json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// Subset of dhcp4d.Lease.
+	var leases []struct {
+		Addr         net.IP    `json:"addr"`
+		HardwareAddr string    `json:"hardware_addr"`
+		Hostname     string    `json:"hostname"`
+		Expiry       time.Time `json:"expiry"`
+	}
+	if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := make([]report.Lease, 0, len(leases))
+	for _, l := range leases {
+		if !l.Expiry.IsZero() && now.After(l.Expiry) {
+			continue
+		}
+		result = append(result, report.Lease{
+			Addr:         l.Addr.String(),
+			HardwareAddr: l.HardwareAddr,
+			Hostname:     l.Hostname,
+		})
+	}
+	return result, nil
+}
+
+// blockedQueries returns the threat-intelligence hits which dnsd retained.
+func blockedQueries() ([]threatintel.Hit, error) {
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer canc()
+	req, err := http.NewRequest("GET", "http://"+multilisten.Resolve("dnsd", "localhost:8053")+"/threatintel", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dnsd: unexpected HTTP status: %v", resp.Status)
+	}
+	var hits []threatintel.Hit
+	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// reporter sends the reports configured in /perm/report.json and renders
+// reports on demand.
+type reporter struct {
+	store   *history.Store
+	alerter *alert.Alerter
+
+	mu    sync.Mutex
+	cfg   *report.Config
+	state *report.State
+}
+
+func newReporter(store *history.Store, alerter *alert.Alerter) (*reporter, error) {
+	cfg, err := report.ReadConfig("/perm")
+	if err != nil {
+		return nil, err
+	}
+	state, err := report.ReadState("/perm")
+	if err != nil {
+		return nil, err
+	}
+	return &reporter{
+		store:   store,
+		alerter: alerter,
+		cfg:     cfg,
+		state:   state,
+	}, nil
+}
+
+// reload re-reads /perm/report.json.
+func (rp *reporter) reload() error {
+	cfg, err := report.ReadConfig("/perm")
+	if err != nil {
+		return err
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.cfg = cfg
+	return nil
+}
+
+// input gathers the data of the period ending at to. Unavailable sources
+// (e.g. dnsd) are logged and left out of the report.
+func (rp *reporter) input(period string, to time.Time) report.Input {
+	var in report.Input
+	in.Samples, _ = rp.store.Range(to.Add(-report.Length(period)), to)
+	var err error
+	if in.Leases, err = reportLeases(); err != nil {
+		log.Printf("report: leases: %v", err)
+	}
+	traffic, err := netconfig.Accounting()
+	if err != nil {
+		log.Printf("report: traffic accounting: %v", err)
+	}
+	for _, t := range traffic {
+		in.Traffic = append(in.Traffic, report.Traffic{
+			Addr:    t.Addr,
+			RxBytes: t.RxBytes,
+			TxBytes: t.TxBytes,
+		})
+	}
+	if in.Blocked, err = blockedQueries(); err != nil {
+		log.Printf("report: blocked DNS queries: %v", err)
+	}
+	return in
+}
+
+// send delivers r via e-mail and/or webhook, as configured.
+func (rp *reporter) send(cfg *report.Config, r *report.Report) error {
+	if cfg.Email {
+		ac := rp.alerter.Config()
+		if err := ac.Send(ac.Message(r.Subject(), r.Text(), time.Now())); err != nil {
+			return fmt.Errorf("sending e-mail: %v", err)
+		}
+	}
+	if cfg.WebhookURL != "" {
+		if err := webhook.Post(context.Background(), cfg.WebhookURL, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check records new devices and sends reports which are due.
+func (rp *reporter) check(now time.Time) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	cfg, state := rp.cfg, rp.state
+	leases, err := reportLeases()
+	if err != nil {
+		return err
+	}
+	changed := state.Observe(leases, now)
+	for _, period := range cfg.Periods() {
+		due := cfg.Due(period, now)
+		sent, ok := state.Sent[period]
+		if ok && !due.After(sent) {
+			continue
+		}
+		in := rp.input(period, due)
+		if !ok {
+			// The period was just enabled: start counting traffic now
+			// instead of sending a report covering the entire uptime.
+			state.Commit(period, due, in)
+			changed = true
+			continue
+		}
+		r := state.Build(cfg, period, due, in)
+		if err := rp.send(cfg, r); err != nil {
+			log.Printf("report: %s: %v", period, err)
+			continue // retry in the next check
+		}
+		log.Printf("sent %s report", period)
+		state.Commit(period, due, in)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return report.WriteState("/perm", state)
+}
+
+func (rp *reporter) run() {
+	for {
+		if err := rp.check(time.Now()); err != nil {
+			log.Printf("report: %v", err)
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+func reportTables(r *report.Report) (outages, devices, talkers, blocked *webui.Table) {
+	outages = &webui.Table{
+		Columns: []string{"from", "to", "duration"},
+		Empty:   "no_outages",
+	}
+	for _, o := range r.Outages {
+		outages.Append(
+			webui.Text(o.From.Format("2006-01-02 15:04")),
+			webui.Text(o.To.Format("2006-01-02 15:04")),
+			webui.Text(o.To.Sub(o.From)))
+	}
+	devices = &webui.Table{
+		Columns: []string{"mac_address", "ip_address", "hostname", "first_seen"},
+		Empty:   "no_new_devices",
+	}
+	for _, d := range r.NewDevices {
+		devices.Append(
+			webui.Addr(d.HardwareAddr),
+			webui.Addr(d.Addr),
+			webui.Text(d.Hostname),
+			webui.Text(d.FirstSeen.Format("2006-01-02 15:04")))
+	}
+	talkers = &webui.Table{
+		Columns: []string{"ip_address", "hostname", "received", "sent"},
+		Empty:   "no_traffic",
+	}
+	for _, t := range r.TopTalkers {
+		talkers.Append(
+			webui.Addr(t.Addr),
+			webui.Text(t.Hostname),
+			webui.Text(report.MB(t.RxBytes)),
+			webui.Text(report.MB(t.TxBytes)))
+	}
+	blocked = &webui.Table{
+		Columns: []string{"domain", "feed", "count", "clients"},
+		Empty:   "no_blocked_queries",
+	}
+	for _, b := range r.BlockedDNS {
+		blocked.Append(
+			webui.Text(b.Name),
+			webui.Text(b.Feed),
+			webui.Text(b.Count),
+			webui.Text(strings.Join(b.Clients, ", ")))
+	}
+	return outages, devices, talkers, blocked
+}
+
+// ServeHTTP renders the report of the period ending now. A POST request
+// additionally sends it (without affecting the scheduled reports).
+func (rp *reporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	period := r.FormValue("period")
+	if period == "" {
+		period = report.Daily
+	}
+	if period != report.Daily && period != report.Weekly {
+		http.Error(w, "unknown period", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	in := rp.input(period, now)
+	rp.mu.Lock()
+	cfg := rp.cfg
+	rep := rp.state.Build(cfg, period, now, in)
+	rp.mu.Unlock()
+	var sent bool
+	if r.Method == http.MethodPost {
+		if err := rp.send(cfg, rep); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sent = true
+	}
+	outages, devices, talkers, blocked := reportTables(rep)
+	if err := reportTmpl.Execute(w, r, struct {
+		Report   *report.Report
+		Downtime time.Duration
+		Sent     bool
+		Outages  *webui.Table
+		Devices  *webui.Table
+		Talkers  *webui.Table
+		Blocked  *webui.Table
+	}{
+		Report:   rep,
+		Downtime: rep.Downtime(),
+		Sent:     sent,
+		Outages:  outages,
+		Devices:  devices,
+		Talkers:  talkers,
+		Blocked:  blocked,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,479 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnsd implements dnsd, which answers DNS requests by forwarding or
+// consulting DHCP leases.
+package dnsd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	miekgdns "github.com/miekg/dns"
+
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/dns"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/statefile"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/threatintel"
+	"github.com/rtr7/router7/internal/webhook"
+)
+
+var flags = flag.NewFlagSet("dnsd", flag.ExitOnError)
+
+var threatintelInterval = flags.Duration("threatintel_interval",
+	6*time.Hour,
+	"how often to download the threat-intelligence feeds configured in /perm/threatintel.json")
+
+var rpzCheckInterval = flags.Duration("rpz_check_interval",
+	1*time.Minute,
+	"how often to check the RPZ zone files configured in /perm/dnsd.json for changes")
+
+const threatintelCache = "/perm/dnsd/threatintel"
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flags, "dnsd", "8053")
+	dnsListeners  = multilisten.NewPool()
+	acmeListeners = multilisten.NewPool()
+)
+
+func updateListeners(dnsMux *miekgdns.ServeMux) error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	dnsListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &listenerAdapter{&miekgdns.Server{
+			Addr:    net.JoinHostPort(host, "53"),
+			Net:     "udp",
+			Handler: dnsMux,
+		}}
+	})
+
+	var extra []string
+	if net1, err := multilisten.IPv6Net1("/perm"); err == nil {
+		extra = append(extra, net1)
+	}
+	addrs, err := management.Addrs(extra...)
+	if err != nil {
+		return err
+	}
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = mux
+		return srv
+	})
+
+	return nil
+}
+
+// updateACMEListeners serves the ACME domain (only) on the public addresses of
+// uplink0 so that ACME servers can query the challenge records, or stops
+// serving if ACME is not configured.
+func updateACMEListeners(acme *dns.ACME) error {
+	var hosts []string
+	if acme.Domain() != "" {
+		iface, err := net.InterfaceByName("uplink0")
+		if err != nil {
+			return err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+
+	acmeListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &listenerAdapter{&miekgdns.Server{
+			Addr:    net.JoinHostPort(host, "53"),
+			Net:     "udp",
+			Handler: acme,
+		}}
+	})
+	return nil
+}
+
+const (
+	// alertInterval is the minimum time between two webhook alerts for the
+	// same client and domain: malware typically queries its domains
+	// repeatedly.
+	alertInterval = 1 * time.Hour
+
+	// maxAlerted bounds the number of remembered alerts.
+	maxAlerted = 4096
+)
+
+// threatHits keeps the most recent threat-intelligence hits and sends webhook
+// alerts for them.
+type threatHits struct {
+	mu         sync.Mutex
+	hits       []threatintel.Hit // most recent last
+	alerted    map[string]time.Time
+	webhookURL string
+}
+
+func (t *threatHits) setWebhookURL(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.webhookURL = url
+}
+
+func (t *threatHits) add(hit threatintel.Hit) {
+	t.mu.Lock()
+	const max = 100
+	if len(t.hits) == max {
+		t.hits = t.hits[1:]
+	}
+	t.hits = append(t.hits, hit)
+	key := hit.Client + " " + hit.Name
+	last, ok := t.alerted[key]
+	alert := t.webhookURL != "" && (!ok || hit.Time.Sub(last) > alertInterval)
+	if alert {
+		if !ok {
+			t.expire(hit.Time)
+		}
+		t.alerted[key] = hit.Time
+	}
+	url := t.webhookURL
+	t.mu.Unlock()
+	if !alert {
+		return
+	}
+	if err := webhook.Post(context.Background(), url, hit); err != nil {
+		log.Printf("webhook: %v", err)
+	}
+}
+
+// expire forgets alerts which no longer suppress another alert and, if there
+// are still too many, the oldest one, making room for a new alert. t.mu must be
+// held.
+func (t *threatHits) expire(now time.Time) {
+	var (
+		oldest string
+		last   time.Time
+	)
+	for key, alerted := range t.alerted {
+		if now.Sub(alerted) > alertInterval {
+			delete(t.alerted, key)
+			continue
+		}
+		if oldest == "" || alerted.Before(last) {
+			oldest, last = key, alerted
+		}
+	}
+	if len(t.alerted) >= maxAlerted {
+		delete(t.alerted, oldest)
+	}
+}
+
+func (t *threatHits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	b, err := json.MarshalIndent(t.hits, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+type listenerAdapter struct {
+	*miekgdns.Server
+}
+
+func (a *listenerAdapter) Close() error { return a.Shutdown() }
+
+func logic() error {
+	ip, err := netconfig.LinkAddress("/perm", "lan0")
+	if err != nil {
+		return err
+	}
+	srv := dns.NewServer(ip.String()+":53", netconfig.DefaultDomain)
+	readLeases := func() error {
+		b, err := ioutil.ReadFile("/perm/dhcp4d/leases.json")
+		if err != nil {
+			return err
+		}
+		var leases []dhcp4d.Lease
+		if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+			return err
+		}
+		srv.SetLeases(leases)
+		return nil
+	}
+	if err := readLeases(); err != nil {
+		log.Printf("cannot resolve DHCP hostnames: %v", err)
+	}
+	readDevices := func() error {
+		r, err := devices.Read("/perm")
+		if err != nil {
+			return err
+		}
+		srv.SetDevices(r)
+		return nil
+	}
+	if err := readDevices(); err != nil {
+		log.Printf("cannot apply device policies: %v", err)
+	}
+	readUpstreams := func() error {
+		upstreams := dns.DefaultUpstreams()
+		// The DNS servers of the uplink lease are only used if the DHCP
+		// policy accepts them, see /perm/dhcp4/policy.json.
+		lease, err := dhcp4.ReadAccepted("/perm")
+		if err != nil {
+			return err
+		}
+		if lease != nil {
+			for _, server := range lease.DNS {
+				upstreams = append(upstreams, net.JoinHostPort(server, "53"))
+			}
+		}
+		srv.SetUpstreams(upstreams)
+		return nil
+	}
+	if err := readUpstreams(); err != nil {
+		log.Printf("cannot use DNS servers of the DHCP lease: %v", err)
+	}
+	acme, err := dns.NewACME("/perm/dnsd/acme.json")
+	if err != nil {
+		return err
+	}
+	var acmeDomain string
+	readConfig := func() error {
+		cfg, err := dns.ReadConfig("/perm")
+		if err != nil {
+			return err
+		}
+		services, err := netconfig.ReadServices("/perm")
+		if err != nil {
+			return err
+		}
+		domains, err := netconfig.ReadDomains("/perm")
+		if err != nil {
+			return err
+		}
+		srv.SetDomains(domains.Domains())
+		networks, err := netconfig.ReadNetworks("/perm")
+		if err != nil {
+			return err
+		}
+		var localOnly []string
+		for _, n := range networks {
+			if n.DNS.LocalOnly {
+				localOnly = append(localOnly, n.Name)
+			}
+		}
+		srv.SetLocalOnly(localOnly)
+		for name, addr := range services.Records() {
+			cfg.Records = append(cfg.Records, dns.Record{Name: name, Addr: addr})
+		}
+		if domain := acme.SetConfig(cfg.ACME); domain != acmeDomain {
+			if acmeDomain != "" {
+				srv.Mux.HandleRemove(acmeDomain)
+			}
+			if domain != "" {
+				// Answer LAN queries for the ACME domain locally, too.
+				srv.Mux.Handle(domain, acme)
+			}
+			acmeDomain = domain
+		}
+		if err := srv.SetConfig(cfg); err != nil {
+			return err
+		}
+		return srv.ReloadRPZ()
+	}
+	if err := readConfig(); err != nil {
+		log.Printf("cannot apply dnsd.json: %v", err)
+	}
+	hits := &threatHits{alerted: make(map[string]time.Time)}
+	srv.ThreatHit = hits.add
+	loadThreats := func() error {
+		cfg, err := threatintel.ReadConfig("/perm")
+		if err != nil {
+			return err
+		}
+		hits.setWebhookURL(cfg.WebhookURL)
+		l, err := threatintel.Load(threatintelCache, cfg)
+		if err != nil {
+			return err
+		}
+		srv.SetThreats(l)
+		log.Printf("loaded %d domains from threat-intelligence feeds", l.Len())
+		return nil
+	}
+	if err := loadThreats(); err != nil {
+		log.Printf("cannot load threat-intelligence feeds: %v", err)
+	}
+	go func() {
+		for {
+			cfg, err := threatintel.ReadConfig("/perm")
+			if err != nil {
+				log.Printf("threatintel: %v", err)
+			} else {
+				for _, f := range cfg.Feeds {
+					if !f.Enabled {
+						continue
+					}
+					if err := threatintel.Update(context.Background(), threatintelCache, f); err != nil {
+						log.Printf("updating feed %s: %v", f.Name, err)
+					}
+				}
+				if err := loadThreats(); err != nil {
+					log.Printf("loadThreats: %v", err)
+				}
+			}
+			time.Sleep(*threatintelInterval)
+		}
+	}()
+	go func() {
+		for range time.Tick(*rpzCheckInterval) {
+			if err := srv.ReloadRPZ(); err != nil {
+				log.Printf("ReloadRPZ: %v", err)
+			}
+		}
+	}()
+	daemon.HandleShared(mux, srv.PrometheusGatherer())
+	mux.Handle("/debug/loglevel", teelogger.Handler())
+	mux.Handle(profiling.Prefix, profiling.Handler())
+	mux.HandleFunc("/dyndns", srv.DyndnsHandler)
+	mux.Handle("/threatintel", hits)
+	mux.HandleFunc("/lookup", lookupHandler(srv))
+	mux.HandleFunc("/lookup.json", lookupJSONHandler(srv))
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(srv.UpstreamStats(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/lookup", http.StatusFound)
+	})
+	mux.Handle("/acme/", http.StripPrefix("/acme", acme))
+	audit := auditlog.New("/perm", "dnsd")
+	mux.Handle("/flush", auth.RequirePassword("dnsd", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		srv.FlushCache()
+		if err := audit.Record(r, "flush-cache", nil, nil); err != nil {
+			log.Printf("audit log: %v", err)
+		}
+	})))
+	if err := updateListeners(srv.Mux); err != nil {
+		return err
+	}
+	if err := updateACMEListeners(acme); err != nil {
+		log.Printf("updateACMEListeners: %v", err)
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(srv.Mux); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		if err := updateACMEListeners(acme); err != nil {
+			log.Printf("updateACMEListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+	// reload re-reads all state. It returns the error of reading the
+	// leases (if any), which dhcp4d waits for, see below.
+	var reloadMu sync.Mutex
+	reload := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		if err := updateListeners(srv.Mux); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		leasesErr := readLeases()
+		if leasesErr != nil {
+			log.Printf("readLeases: %v", leasesErr)
+		}
+		if err := loadThreats(); err != nil {
+			log.Printf("loadThreats: %v", err)
+		}
+		if err := readDevices(); err != nil {
+			log.Printf("readDevices: %v", err)
+		}
+		if err := readUpstreams(); err != nil {
+			log.Printf("readUpstreams: %v", err)
+		}
+		if err := readConfig(); err != nil {
+			log.Printf("readConfig: %v", err)
+		}
+		if err := updateACMEListeners(acme); err != nil {
+			log.Printf("updateACMEListeners: %v", err)
+		}
+		return leasesErr
+	}
+	// dhcp4d notifies dnsd via an acknowledged notification, so that it
+	// learns whether the new leases are resolvable. Other daemons send
+	// SIGUSR1.
+	if _, err := notify.Listen("dnsd", reload); err != nil {
+		log.Printf("not accepting acknowledged notifications: %v", err)
+	}
+	ch := make(chan os.Signal, 1)
+	notify.Signal(ch, "dnsd", syscall.SIGUSR1)
+	for range ch {
+		reload()
+	}
+	return nil
+}
+
+// mux serves the HTTP endpoints of dnsd.
+var mux = http.NewServeMux()
+
+// Daemon is dnsd, see package daemon.
+var Daemon = &daemon.Daemon{
+	Name:      "dnsd",
+	Flags:     flags,
+	Logic:     logic,
+	Supervise: true,
+}
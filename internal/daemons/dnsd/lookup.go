@@ -0,0 +1,128 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnsd
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+
+	"github.com/rtr7/router7/internal/dns"
+	"github.com/rtr7/router7/internal/webui"
+)
+
+//go:embed lookup.html.tmpl
+var lookupHTML string
+
+var lookupTmpl = webui.Must(webui.Parse("dnsd", lookupHTML, nil))
+
+// lookupTypes are offered on the lookup page. Other types can be specified
+// in the URL, e.g. /lookup?name=example.com&type=CAA.
+var lookupTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "PTR", "SOA", "SRV", "TXT"}
+
+// parseLookup returns the name and query type of the lookup request r.
+func parseLookup(r *http.Request) (name, qtypeName string, qtype uint16, err error) {
+	name = strings.TrimSpace(r.FormValue("name"))
+	qtypeName = strings.ToUpper(r.FormValue("type"))
+	if qtypeName == "" {
+		qtypeName = "A"
+	}
+	qtype, ok := miekgdns.StringToType[qtypeName]
+	if !ok {
+		return "", "", 0, fmt.Errorf("unknown type %q", qtypeName)
+	}
+	if name != "" {
+		if _, ok := miekgdns.IsDomainName(name); !ok {
+			return "", "", 0, fmt.Errorf("invalid name %q", name)
+		}
+	}
+	return name, qtypeName, qtype, nil
+}
+
+func stepsTable(tr *dns.Trace) *webui.Table {
+	t := &webui.Table{
+		Columns: []string{"stage", "detail", "rtt"},
+		Empty:   "no_steps",
+	}
+	for _, step := range tr.Steps {
+		var rtt string
+		if step.RTT > 0 {
+			rtt = step.RTT.Round(100 * time.Microsecond).String()
+		}
+		t.Append(
+			webui.Text(step.Stage),
+			webui.Text(step.Detail),
+			webui.Text(rtt))
+	}
+	return t
+}
+
+// lookupHandler serves the lookup page, which shows how srv resolves a
+// query, e.g. to debug blocklist false positives.
+func lookupHandler(srv *dns.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, qtypeName, qtype, err := parseLookup(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data := struct {
+			Name  string
+			Type  string
+			Types []string
+			Trace *dns.Trace
+			Steps *webui.Table
+		}{
+			Name:  name,
+			Type:  qtypeName,
+			Types: lookupTypes,
+		}
+		if name != "" {
+			data.Trace = srv.Lookup(name, qtype)
+			data.Steps = stepsTable(data.Trace)
+		}
+		if err := lookupTmpl.Execute(w, r, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// lookupJSONHandler serves the trace of a lookup as JSON, e.g.
+// /lookup.json?name=example.com&type=AAAA.
+func lookupJSONHandler(srv *dns.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _, qtype, err := parseLookup(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name == "" {
+			http.Error(w, "name parameter missing", http.StatusBadRequest)
+			return
+		}
+		b, err := json.MarshalIndent(srv.Lookup(name, qtype), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
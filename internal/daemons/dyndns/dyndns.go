@@ -0,0 +1,229 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dyndns implements dyndns, which publishes AAAA records for the LAN
+// hosts configured in /perm/dyndns.json, so that e.g. a home server’s public
+// AAAA record follows changes of the delegated IPv6 prefix.
+package dyndns
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/dyndns"
+	"github.com/rtr7/router7/internal/healthz"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var flags = flag.NewFlagSet("dyndns", flag.ExitOnError)
+
+var (
+	perm = flags.String("perm",
+		"/perm",
+		"path to replace /perm")
+
+	interval = flags.Duration("interval",
+		1*time.Minute,
+		"how often to check the NDP neighbor table for address changes")
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	updates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dyndns",
+		Name:      "updates_total",
+		Help:      "DNS UPDATE messages sent, by result",
+	}, []string{"result"})
+	records = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "dyndns",
+		Name:      "records",
+		Help:      "Number of currently published AAAA records",
+	})
+)
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flags, "dyndns", "8085")
+)
+
+func updateListeners() error {
+	addrs, err := management.Addrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = mux
+		return srv
+	})
+	return nil
+}
+
+// neighbors returns the IPv6 neighbors of lan0.
+func neighbors() ([]dyndns.Neighbor, error) {
+	link, err := netlink.LinkByName("lan0")
+	if err != nil {
+		return nil, err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]dyndns.Neighbor, 0, len(neighs))
+	for _, n := range neighs {
+		if n.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 ||
+			len(n.HardwareAddr) == 0 {
+			continue
+		}
+		result = append(result, dyndns.Neighbor{
+			IP:           n.IP,
+			HardwareAddr: n.HardwareAddr,
+		})
+	}
+	return result, nil
+}
+
+type publisher struct {
+	published map[string][]net.IP
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+func (p *publisher) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// publish sends a DNS UPDATE if the records differ from the last published
+// records, e.g. because the prefix changed or hosts were (re-)discovered.
+func (p *publisher) publish(cfg *dyndns.Config) error {
+	prefix, err := dyndns.Prefix(*perm)
+	if err != nil {
+		return err
+	}
+	if prefix == nil {
+		return nil // dhcp6 might not have obtained a lease yet
+	}
+	neighs, err := neighbors()
+	if err != nil {
+		log.Printf("cannot learn addresses via NDP: %v", err)
+	}
+	recs := cfg.Records(prefix, neighs)
+	if p.published != nil && dyndns.Equal(p.published, recs) {
+		return nil
+	}
+	if err := cfg.Update(recs); err != nil {
+		updates.With(prometheus.Labels{"result": "error"}).Inc()
+		return err
+	}
+	updates.With(prometheus.Labels{"result": "success"}).Inc()
+	var num int
+	for name, addrs := range recs {
+		log.Printf("published %s AAAA %v", name, addrs)
+		num += len(addrs)
+	}
+	records.Set(float64(num))
+	p.published = recs
+	return nil
+}
+
+func logic() error {
+	daemon.HandleShared(mux)
+	mux.Handle("/debug/loglevel", teelogger.Handler())
+	mux.Handle(profiling.Prefix, profiling.Handler())
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	if err := multilisten.NotifyAddrChange(func() {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}); err != nil {
+		log.Printf("not updating listeners on address changes: %v", err)
+	}
+
+	cfg, err := dyndns.ReadConfig(*perm)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	notify.Signal(ch, "dyndns", syscall.SIGUSR1)
+	if !cfg.Enabled {
+		// Keep serving /healthz and /metrics.
+		log.Printf("dyndns not enabled in /perm/dyndns.json, idling")
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}
+	}
+
+	p := &publisher{}
+	healthz.Register("update", p.err)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		err := p.publish(cfg)
+		if err != nil {
+			log.Printf("publishing records: %v", err)
+		}
+		p.mu.Lock()
+		p.lastErr = err
+		p.mu.Unlock()
+		select {
+		case <-ticker.C:
+		case <-ch:
+			// netconfigd applied a new configuration, e.g. after dhcp6
+			// obtained a different prefix.
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			updated, err := dyndns.ReadConfig(*perm)
+			if err != nil {
+				log.Printf("reading dyndns.json: %v", err)
+				continue
+			}
+			cfg = updated
+			p.published = nil // force an update
+		}
+	}
+}
+
+// mux serves the HTTP endpoints of dyndns.
+var mux = http.NewServeMux()
+
+// Daemon is dyndns, see package daemon.
+var Daemon = &daemon.Daemon{
+	Name:      "dyndns",
+	Flags:     flags,
+	Logic:     logic,
+	Supervise: true,
+}
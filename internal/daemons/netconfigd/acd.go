@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfigd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/acd"
+	"github.com/rtr7/router7/internal/alert"
+)
+
+var acdConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "acd",
+	Name:      "conflicts_total",
+	Help:      "Other hosts using an IPv4 address of router7 (detected at most once per 10 seconds per address)",
+}, []string{"interface"})
+
+const (
+	// conflictsWindow is how long conflicts are listed on /conflicts.
+	conflictsWindow = 24 * time.Hour
+
+	// maxConflicts bounds the number of listed conflicts: a misbehaving
+	// network can produce conflicts with arbitrary hardware addresses.
+	maxConflicts = 256
+)
+
+// conflicts records address conflicts and alerts about them.
+type conflicts struct {
+	alerter *alert.Alerter
+
+	mu   sync.Mutex
+	last map[string]acd.Conflict // key: interface, address and hardware address
+}
+
+func (c *conflicts) report(conflict acd.Conflict) {
+	log.Printf("address conflict: %v", conflict)
+	acdConflicts.With(prometheus.Labels{"interface": conflict.Interface}).Inc()
+	key := conflict.Interface + " " + conflict.Addr + " " + conflict.HardwareAddr
+	c.mu.Lock()
+	if _, ok := c.last[key]; !ok {
+		c.expire(conflict.Time)
+	}
+	c.last[key] = conflict
+	c.mu.Unlock()
+	c.alerter.Alert("acd-"+conflict.Addr,
+		fmt.Sprintf("address conflict on %s", conflict.Interface),
+		fmt.Sprintf("Another host uses the address of router7 on %s:\n\naddress: %s\nhardware address: %s\n",
+			conflict.Interface, conflict.Addr, conflict.HardwareAddr))
+}
+
+// expire forgets conflicts older than conflictsWindow and, if there are still
+// too many, the oldest one, making room for a new conflict. c.mu must be held.
+func (c *conflicts) expire(now time.Time) {
+	var oldest string
+	for key, conflict := range c.last {
+		if now.Sub(conflict.Time) > conflictsWindow {
+			delete(c.last, key)
+			continue
+		}
+		if oldest == "" || conflict.Time.Before(c.last[oldest].Time) {
+			oldest = key
+		}
+	}
+	if len(c.last) >= maxConflicts {
+		delete(c.last, oldest)
+	}
+}
+
+// watch watches ifname for conflicts, retrying when the interface does not
+// exist (yet) or reading from it fails.
+func (c *conflicts) watch(ifname string) {
+	for {
+		if err := acd.Watch(ifname, c.report); err != nil {
+			log.Printf("watching %s for address conflicts: %v", ifname, err)
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+func (c *conflicts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	c.mu.Lock()
+	list := make([]acd.Conflict, 0, len(c.last))
+	for _, conflict := range c.last {
+		if now.Sub(conflict.Time) > conflictsWindow {
+			continue
+		}
+		list = append(list, conflict)
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.After(list[j].Time)
+	})
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,459 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netconfigd implements netconfigd, which reads state from dhcp4,
+// dhcp6, … and applies it.
+package netconfigd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/acd"
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/auditlog"
+	"github.com/rtr7/router7/internal/auth"
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/killswitch"
+	"github.com/rtr7/router7/internal/linkstate"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var flags = flag.NewFlagSet("netconfigd", flag.ExitOnError)
+
+var (
+	linger = flags.Bool("linger", true, "linger around after applying the configuration (until killed)")
+
+	quotaInterval = flags.Duration("quota_interval", 5*time.Minute, "how often to account traffic to the device quotas configured in /perm/devices.json")
+)
+
+func init() {
+	var c nftables.Conn
+	for _, metric := range []struct {
+		name           string
+		labels         prometheus.Labels
+		obj            *nftables.CounterObj
+		packets, bytes uint64
+	}{
+		{
+			name:   "filter_forward",
+			labels: prometheus.Labels{"family": "ipv4"},
+			obj: &nftables.CounterObj{
+				Table: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"},
+				Name:  "fwded",
+			},
+		},
+		{
+			name:   "filter_forward",
+			labels: prometheus.Labels{"family": "ipv6"},
+			obj: &nftables.CounterObj{
+				Table: &nftables.Table{Family: nftables.TableFamilyIPv6, Name: "filter"},
+				Name:  "fwded",
+			},
+		},
+	} {
+		metric := metric // copy
+		var mu sync.Mutex
+		updateCounter := func() {
+			mu.Lock()
+			defer mu.Unlock()
+			objs, err := c.GetObjReset(metric.obj)
+			if err != nil ||
+				len(objs) != 1 {
+				return
+			}
+			if co, ok := objs[0].(*nftables.CounterObj); ok {
+				metric.packets += co.Packets
+				metric.bytes += co.Bytes
+			}
+		}
+		promauto.NewCounterFunc(
+			prometheus.CounterOpts{
+				Subsystem:   "nftables",
+				Name:        metric.name + "_packets",
+				Help:        "packet count",
+				ConstLabels: metric.labels,
+			},
+			func() float64 {
+				updateCounter()
+				return float64(metric.packets)
+			})
+		promauto.NewCounterFunc(
+			prometheus.CounterOpts{
+				Subsystem:   "nftables",
+				Name:        metric.name + "_bytes",
+				Help:        "bytes count",
+				ConstLabels: metric.labels,
+			},
+			func() float64 {
+				updateCounter()
+				return float64(metric.bytes)
+			})
+	}
+}
+
+var (
+	httpListeners = multilisten.NewPool()
+	management    = multilisten.NewManagement(flags, "netconfigd", "8066")
+)
+
+func updateListeners() error {
+	var extra []string
+	if net1, err := multilisten.IPv6Net1("/perm"); err == nil {
+		extra = append(extra, net1)
+	}
+	addrs, err := management.Addrs(extra...)
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(addrs, func(addr string) multilisten.Listener {
+		srv := multilisten.NewHTTPServer(addr)
+		srv.Handler = mux
+		return srv
+	})
+	return nil
+}
+
+// killswitchHandler serves the kill switch state (GET) and cuts (POST
+// action=cut) or restores (POST action=restore) the internet access of the
+// client with MAC or IP address addr. Cuts last until restored or for the
+// optional duration (e.g. duration=1h). apply is called after modifying the
+// state, which is recorded in audit.
+func killswitchHandler(mu *sync.Mutex, apply func(), audit *auditlog.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if ip := net.ParseIP(host); !gokrazy.IsInPrivateNet(ip) {
+			http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		state, err := killswitch.Read("/perm")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Method == "POST" {
+			var until time.Time
+			if d := r.FormValue("duration"); d != "" {
+				dur, err := time.ParseDuration(d)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				until = time.Now().Add(dur)
+			}
+			client, err := killswitch.Parse(r.FormValue("addr"), until)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var before, after *killswitch.Client
+			for _, c := range state.Clients {
+				if c.Key() == client.Key() {
+					before = c
+				}
+			}
+			action := r.FormValue("action")
+			switch action {
+			case "cut":
+				state.Set(client)
+				after = client
+			case "restore":
+				state.Remove(client.Key())
+			default:
+				http.Error(w, fmt.Sprintf(`unknown action %q, expected "cut" or "restore"`, action), http.StatusBadRequest)
+				return
+			}
+			if err := killswitch.Write("/perm", state); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("killswitch: %s %s (until %v)", action, client.Key(), client.Until)
+			if err := audit.Record(r, "killswitch-"+action, before, after); err != nil {
+				log.Printf("audit log: %v", err)
+			}
+			apply()
+			// Redirect back to e.g. the dhcp4d status page, but only on this
+			// host.
+			if u, err := url.Parse(r.FormValue("redirect")); err == nil && u.Host != "" {
+				reqHost, _, err := net.SplitHostPort(r.Host)
+				if err != nil {
+					reqHost = r.Host
+				}
+				if u.Hostname() == reqHost {
+					http.Redirect(w, r, u.String(), http.StatusFound)
+					return
+				}
+			}
+		}
+		b, err := json.MarshalIndent(state.Active(time.Now()), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// conntrackHandler deletes (POST action=flush) the connection tracking
+// entries of connections from or to addr, or all entries if addr is empty, so
+// that the current firewall rules apply to existing connections. Flushes are
+// recorded in audit.
+func conntrackHandler(audit *auditlog.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if ip := net.ParseIP(host); !gokrazy.IsInPrivateNet(ip) {
+			http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if action := r.FormValue("action"); action != "flush" {
+			http.Error(w, fmt.Sprintf(`unknown action %q, expected "flush"`, action), http.StatusBadRequest)
+			return
+		}
+		addr := r.FormValue("addr")
+		deleted, err := netconfig.FlushConntrack(addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("conntrack: flushed %d entries (addr %q)", deleted, addr)
+		if err := audit.Record(r, "conntrack-flush", nil, struct {
+			Addr    string `json:"addr"`
+			Deleted uint   `json:"deleted"`
+		}{addr, deleted}); err != nil {
+			log.Printf("audit log: %v", err)
+		}
+		b, err := json.Marshal(struct {
+			Deleted uint `json:"deleted"`
+		}{deleted})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// wanAddrHandler serves the current public addresses and their history.
+func wanAddrHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if ip := net.ParseIP(host); !gokrazy.IsInPrivateNet(ip) {
+		http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+		return
+	}
+	current, err := netconfig.ReadWANAddrs("/perm")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history, err := netconfig.ReadWANHistory("/perm")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.MarshalIndent(struct {
+		Current netconfig.WANAddrs    `json:"current"`
+		History []netconfig.WANChange `json:"history"`
+	}{current, history}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// recordWANAddrs records changes of the public addresses and notifies the
+// daemons which act on them.
+func recordWANAddrs() {
+	addrs, err := netconfig.ReadWANAddrs("/perm")
+	if err != nil {
+		log.Printf("reading WAN addresses: %v", err)
+		return
+	}
+	changes, err := netconfig.RecordWANAddrs("/perm", addrs, time.Now())
+	if err != nil {
+		log.Printf("recording WAN addresses: %v", err)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		log.Printf("public %s address changed from %q to %q", c.Family, c.Previous, c.Addr)
+	}
+	// dyndns publishes records for the new prefix, telemetryd publishes a
+	// wan_addr event via MQTT.
+	for _, daemon := range []string{"/user/dyndns", "/user/telemetryd"} {
+		if err := notify.Process(daemon, syscall.SIGUSR1); err != nil {
+			log.Printf("notifying %s: %v", daemon, err)
+		}
+	}
+}
+
+func logic() error {
+	ch := make(chan os.Signal, 1)
+	notify.Signal(ch, "netconfigd", syscall.SIGUSR1)
+	reapply := func() {
+		select {
+		case ch <- syscall.SIGUSR1:
+		default:
+			// a configuration update is already pending
+		}
+	}
+	var killswitchMu sync.Mutex
+	if *linger {
+		daemon.HandleShared(mux)
+		mux.Handle("/debug/loglevel", teelogger.Handler())
+		mux.Handle(profiling.Prefix, profiling.Handler())
+		audit := auditlog.New("/perm", "netconfigd")
+		mux.Handle("/killswitch", auth.RequirePassword("netconfigd", killswitchHandler(&killswitchMu, reapply, audit)))
+		mux.HandleFunc("/wanaddr", wanAddrHandler)
+		mux.Handle("/conntrack", auth.RequirePassword("netconfigd", conntrackHandler(audit)))
+		quotas := &quotaEnforcer{
+			dir:     "/perm",
+			apply:   reapply,
+			alerter: alert.NewAlerter("/perm"),
+		}
+		mux.Handle("/quota", quotas)
+		go quotas.run(*quotaInterval)
+		addrConflicts := &conflicts{
+			alerter: alert.NewAlerter("/perm"),
+			last:    make(map[string]acd.Conflict),
+		}
+		netconfig.ReportConflict = addrConflicts.report
+		mux.Handle("/conflicts", addrConflicts)
+		if cfg, err := acd.ReadConfig("/perm"); err != nil {
+			log.Printf("not watching for address conflicts: %v", err)
+		} else {
+			for _, ifname := range cfg.Interfaces {
+				go addrConflicts.watch(ifname)
+			}
+		}
+		if err := updateListeners(); err != nil {
+			return err
+		}
+		if err := multilisten.NotifyAddrChange(func() {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		}); err != nil {
+			log.Printf("not updating listeners on address changes: %v", err)
+		}
+		// Configure network interfaces which appear (e.g. USB network
+		// cards) or come up (e.g. a cable was plugged in) without waiting
+		// for a signal. Links which Apply brings up result in one more,
+		// idempotent, Apply.
+		if err := linkstate.Subscribe(linkstate.Filter{Kinds: linkstate.Link}, func(ev linkstate.Event) {
+			if ev.Added || ev.Up {
+				log.Printf("link %s appeared or came up, re-applying configuration", ev.Name)
+				reapply()
+			}
+		}); err != nil {
+			log.Printf("not re-applying configuration on link changes: %v", err)
+		}
+	}
+	for {
+		err := netconfig.Apply("/perm/", "/")
+
+		recordWANAddrs()
+
+		// Notify dhcp4d so that it can update its listeners for prometheus
+		// metrics on the external interface.
+		if err := notify.Process("/user/dhcp4d", syscall.SIGUSR1); err != nil {
+			log.Printf("notifying dhcp4d: %v", err)
+		}
+
+		// Notify gokrazy about new addresses (netconfig.Apply might have
+		// modified state before returning an error) so that listeners can be
+		// updated.
+		p, _ := os.FindProcess(1)
+		if err := p.Signal(syscall.SIGHUP); err != nil {
+			log.Printf("kill -HUP 1: %v", err)
+		}
+		if err != nil {
+			return err
+		}
+		if !*linger {
+			break
+		}
+		// Re-apply the configuration when the next kill switch cut expires.
+		var expiry <-chan time.Time
+		killswitchMu.Lock()
+		if state, err := killswitch.Read("/perm"); err == nil {
+			if next, ok := state.NextExpiry(time.Now()); ok {
+				expiry = time.After(time.Until(next))
+			}
+		}
+		killswitchMu.Unlock()
+		select {
+		case <-ch:
+		case <-expiry:
+		}
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}
+	return nil
+}
+
+// mux serves the HTTP endpoints of netconfigd.
+var mux = http.NewServeMux()
+
+// Daemon is netconfigd, see package daemon.
+var Daemon = &daemon.Daemon{
+	Name:      "netconfigd",
+	Flags:     flags,
+	Logic:     logic,
+	Supervise: true,
+}
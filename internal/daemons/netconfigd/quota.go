@@ -0,0 +1,192 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfigd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/quota"
+	"github.com/rtr7/router7/internal/statefile"
+)
+
+var (
+	quotaUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "quota",
+		Name:      "usage_bytes",
+		Help:      "Traffic of devices and groups with a quota within the current period (daily or monthly)",
+	}, []string{"subject", "period"})
+
+	quotaExceeded = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "quota",
+		Name:      "exceeded_devices",
+		Help:      "Number of devices which are blocked or throttled because they exceeded their quota",
+	})
+)
+
+// leaseHardwareAddrs returns the MAC addresses of the non-expired DHCPv4
+// leases in dir, keyed by IP address.
+func leaseHardwareAddrs(dir string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4d/leases.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// Subset of dhcp4d.Lease.
+	var leases []struct {
+		Addr         net.IP    `json:"addr"`
+		HardwareAddr string    `json:"hardware_addr"`
+		Expiry       time.Time `json:"expiry"`
+	}
+	if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	hwaddrs := make(map[string]string, len(leases))
+	for _, l := range leases {
+		if !l.Expiry.IsZero() && now.After(l.Expiry) {
+			continue
+		}
+		hwaddrs[l.Addr.String()] = l.HardwareAddr
+	}
+	return hwaddrs, nil
+}
+
+// quotaEnforcer periodically accounts the traffic of LAN devices to their
+// quotas (see devices.Quota) and re-applies the firewall configuration when
+// devices need to be blocked, throttled or restored.
+type quotaEnforcer struct {
+	dir     string
+	apply   func()
+	alerter *alert.Alerter
+
+	mu sync.Mutex // guards the state file
+}
+
+func (q *quotaEnforcer) update() error {
+	registry, err := devices.Read(q.dir)
+	if err != nil {
+		return err
+	}
+	counters, err := netconfig.Accounting()
+	if err != nil {
+		return err
+	}
+	hwaddrs, err := leaseHardwareAddrs(q.dir)
+	if err != nil {
+		return err
+	}
+	traffic := make([]quota.Traffic, 0, len(counters))
+	for _, c := range counters {
+		traffic = append(traffic, quota.Traffic{
+			Addr:         c.Addr,
+			HardwareAddr: hwaddrs[c.Addr],
+			RxBytes:      c.RxBytes,
+			TxBytes:      c.TxBytes,
+		})
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	state, err := quota.Read(q.dir)
+	if err != nil {
+		return err
+	}
+	if !registry.HasQuotas() && len(state.Exceeded) == 0 {
+		return nil // nothing to do
+	}
+	changed, newly := state.Update(registry, traffic, time.Now())
+	if err := quota.Write(q.dir, state); err != nil {
+		return err
+	}
+
+	quotaUsage.Reset()
+	for subject, u := range state.Usage {
+		quotaUsage.With(prometheus.Labels{"subject": subject, "period": "daily"}).Set(float64(u.DailyBytes))
+		quotaUsage.With(prometheus.Labels{"subject": subject, "period": "monthly"}).Set(float64(u.MonthlyBytes))
+	}
+	quotaExceeded.Set(float64(len(state.Exceeded)))
+
+	for _, e := range newly {
+		name := e.HardwareAddr
+		if d, ok := registry.Lookup(e.HardwareAddr); ok && d.Name != "" {
+			name = d.Name
+		}
+		log.Printf("quota: %s (%s) exceeded its %s, %s until %v", name, e.HardwareAddr, e.Reason, e.Action, e.Until)
+		q.alerter.Alert("quota-"+e.HardwareAddr,
+			fmt.Sprintf("%s exceeded its quota", name),
+			fmt.Sprintf("Device %s (%s, %s) exceeded its %s.\nAction: %s until %v.\n",
+				name, e.HardwareAddr, e.Addr, e.Reason, e.Action, e.Until.Format(time.RFC1123)))
+	}
+	if changed {
+		q.apply()
+	}
+	return nil
+}
+
+func (q *quotaEnforcer) run(interval time.Duration) {
+	for {
+		if err := q.update(); err != nil {
+			log.Printf("quota: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// ServeHTTP serves the quota usage and the devices which exceeded their quota.
+func (q *quotaEnforcer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if ip := net.ParseIP(host); !gokrazy.IsInPrivateNet(ip) {
+		http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+		return
+	}
+	q.mu.Lock()
+	state, err := quota.Read(q.dir)
+	q.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.MarshalIndent(struct {
+		Usage    map[string]*quota.Usage `json:"usage"`
+		Exceeded []*quota.Exceeded       `json:"exceeded"`
+	}{state.Usage, state.Active(time.Now())}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package radvd implements radvd, which sends IPv6 router advertisments.
+package radvd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/rtr7/router7/internal/daemon"
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/lowpower"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/radvd"
+)
+
+func logic() error {
+	srv, err := radvd.NewServer()
+	if err != nil {
+		return err
+	}
+	// guest advertises the guest prefix (if configured) instead of the
+	// delegated prefix. Changing the guest interface requires a restart.
+	var guest *radvd.Server
+	// networks advertise their subnet of the delegated prefix, keyed by
+	// interface name (see networks.json).
+	networks := make(map[string]*radvd.Server)
+	readConfig := func() error {
+		rcfg, err := radvd.ReadConfig("/perm")
+		if err != nil {
+			return err
+		}
+		if err := srv.SetConfig(rcfg); err != nil {
+			return fmt.Errorf("/perm/radvd.json: %v", err)
+		}
+		// maintd notifies radvd when the low-power mode changes.
+		lowPower := lowpower.Active("/perm")
+		srv.SetLowPower(lowPower)
+		guestPrefix, _ := rcfg.GuestPrefix() // validated by SetConfig
+		if guestPrefix != nil {
+			if guest == nil {
+				guest, err = radvd.NewServer()
+				if err != nil {
+					return err
+				}
+				go func(ifname string) {
+					if err := guest.ListenAndServe(ifname); err != nil {
+						log.Printf("guest: %v", err)
+					}
+				}(rcfg.Guest.Interface)
+			}
+			if err := guest.SetConfig(rcfg); err != nil {
+				return err
+			}
+			guest.SetLowPower(lowPower)
+			guest.SetPrefixes([]net.IPNet{*guestPrefix})
+		}
+
+		var additional []net.IPNet
+		if b, err := ioutil.ReadFile("/perm/radvd/prefixes.json"); err == nil {
+			if err := json.Unmarshal(b, &additional); err != nil {
+				return err
+			}
+		}
+
+		var cfg dhcp6.Config
+		b, leaseErr := ioutil.ReadFile("/perm/dhcp6/wire/lease.json")
+		if leaseErr == nil {
+			if err := json.Unmarshal(b, &cfg); err != nil {
+				return err
+			}
+		}
+
+		nets, err := netconfig.ReadNetworks("/perm")
+		if err != nil {
+			return err
+		}
+		for _, n := range nets {
+			prefixes := n.IPv6Prefixes(cfg.Prefixes)
+			if len(prefixes) == 0 {
+				continue
+			}
+			nsrv, ok := networks[n.Name]
+			if !ok {
+				nsrv, err = radvd.NewServer()
+				if err != nil {
+					return err
+				}
+				networks[n.Name] = nsrv
+				go func(ifname string) {
+					if err := nsrv.ListenAndServe(ifname); err != nil {
+						log.Printf("%s: %v", ifname, err)
+					}
+				}(n.Name)
+			}
+			if err := nsrv.SetConfig(rcfg); err != nil {
+				return err
+			}
+			nsrv.SetLowPower(lowPower)
+			nsrv.SetPrefixes(prefixes)
+		}
+
+		// With network prefix translation, the LAN uses the stable internal
+		// prefix instead of the delegated prefix.
+		internal, err := netconfig.NPTv6Prefix("/perm")
+		if err != nil {
+			return err
+		}
+		if internal != nil {
+			srv.SetPrefixes(append([]net.IPNet{*internal}, additional...))
+			return nil
+		}
+
+		if leaseErr != nil {
+			return leaseErr
+		}
+		srv.SetPrefixes(append(cfg.Prefixes, additional...))
+		return nil
+	}
+	if err := readConfig(); err != nil {
+		log.Printf("cannot announce IPv6 prefixes: %v", err)
+	}
+	ch := make(chan os.Signal, 1)
+	notify.Signal(ch, "radvd", syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			if err := readConfig(); err != nil {
+				log.Printf("readConfig: %v", err)
+			}
+		}
+	}()
+	return srv.ListenAndServe("lan0")
+}
+
+var flags = flag.NewFlagSet("radvd", flag.ExitOnError)
+
+// Daemon is radvd, see package daemon.
+var Daemon = &daemon.Daemon{
+	Name:  "radvd",
+	Flags: flags,
+	Logic: logic,
+}
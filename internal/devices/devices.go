@@ -0,0 +1,233 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package devices implements the device registry, which defines names, groups
+// and policy tags of LAN devices (by MAC address) once for all daemons.
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Policy tags which router7 daemons act upon. Tags can be set on devices or on
+// groups (applying to all devices of the group).
+const (
+	// TagNoInternet makes netconfigd drop traffic from the device to the
+	// internet (the router itself remains reachable).
+	TagNoInternet = "no-internet"
+
+	// TagThreatintelExempt makes dnsd forward queries from the device even if
+	// they match a threat-intelligence feed.
+	TagThreatintelExempt = "threatintel-exempt"
+
+	// TagPresence makes presenced report whether the device is home, e.g. to
+	// Home Assistant.
+	TagPresence = "presence"
+
+	// TagIsolationExempt makes netconfigd allow traffic between the device
+	// and clients of interfaces with client isolation, e.g. for a printer.
+	TagIsolationExempt = "isolation-exempt"
+)
+
+// Device describes a LAN device.
+type Device struct {
+	HardwareAddr string   `json:"hardware_addr"` // e.g. “00:1f:16:12:34:56”
+	Name         string   `json:"name"`          // hostname, e.g. “midna”
+	Group        string   `json:"group"`         // e.g. “iot”
+	Icon         string   `json:"icon"`          // e.g. “📺”
+	Tags         []string `json:"tags"`          // e.g. ["no-internet"]
+	Quota        *Quota   `json:"quota"`         // nil means unlimited
+}
+
+// Group carries tags which apply to all devices of the group.
+type Group struct {
+	Tags  []string `json:"tags"`
+	Quota *Quota   `json:"quota"` // shared by all devices of the group
+}
+
+// Quota actions, i.e. what netconfigd does once a quota is exceeded.
+const (
+	QuotaBlock    = "block"
+	QuotaThrottle = "throttle"
+)
+
+// Quota limits the internet traffic (sent plus received) of a device or group
+// per day and/or per month. Usage is reset at midnight (local time), and on
+// ResetDay of each month.
+type Quota struct {
+	DailyMB   uint64 `json:"daily_mb"`   // zero means no daily quota
+	MonthlyMB uint64 `json:"monthly_mb"` // zero means no monthly quota
+	ResetDay  int    `json:"reset_day"`  // 1-28, defaults to 1
+
+	// Action is “block” (the default) or “throttle”.
+	Action string `json:"action"`
+
+	// ThrottleKbps is the bandwidth (in kbit/s, per direction) of throttled
+	// devices, defaults to 1000.
+	ThrottleKbps uint64 `json:"throttle_kbps"`
+}
+
+func (q *Quota) parse() error {
+	if q.ResetDay == 0 {
+		q.ResetDay = 1
+	}
+	if q.ResetDay < 1 || q.ResetDay > 28 {
+		return fmt.Errorf("quota: reset_day %d out of range [1, 28]", q.ResetDay)
+	}
+	switch q.Action {
+	case "":
+		q.Action = QuotaBlock
+	case QuotaBlock, QuotaThrottle:
+	default:
+		return fmt.Errorf("quota: unknown action %q", q.Action)
+	}
+	if q.ThrottleKbps == 0 {
+		q.ThrottleKbps = 1000
+	}
+	return nil
+}
+
+// Registry is the device registry, stored in devices.json. A nil *Registry is
+// valid and knows no devices.
+type Registry struct {
+	Devices []*Device         `json:"devices"`
+	Groups  map[string]*Group `json:"groups"`
+
+	byHardwareAddr map[string]*Device
+}
+
+// Read reads devices.json from dir. A missing file results in an empty
+// Registry.
+func Read(dir string) (*Registry, error) {
+	fn := filepath.Join(dir, "devices.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Registry{}, nil
+		}
+		return nil, err
+	}
+	var r Registry
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	r.byHardwareAddr = make(map[string]*Device, len(r.Devices))
+	for _, d := range r.Devices {
+		hwaddr, err := net.ParseMAC(d.HardwareAddr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		d.HardwareAddr = hwaddr.String() // canonicalize
+		if _, ok := r.byHardwareAddr[d.HardwareAddr]; ok {
+			return nil, fmt.Errorf("%s: duplicate device %s", fn, d.HardwareAddr)
+		}
+		r.byHardwareAddr[d.HardwareAddr] = d
+		if d.Quota != nil {
+			if err := d.Quota.parse(); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", fn, d.HardwareAddr, err)
+			}
+		}
+	}
+	for name, g := range r.Groups {
+		if g.Quota != nil {
+			if err := g.Quota.parse(); err != nil {
+				return nil, fmt.Errorf("%s: group %s: %v", fn, name, err)
+			}
+		}
+	}
+	return &r, nil
+}
+
+// Lookup returns the device with MAC address hwaddr (as formatted by
+// net.HardwareAddr.String).
+func (r *Registry) Lookup(hwaddr string) (*Device, bool) {
+	if r == nil {
+		return nil, false
+	}
+	d, ok := r.byHardwareAddr[hwaddr]
+	return d, ok
+}
+
+// Tags returns the tags of the device with MAC address hwaddr, including the
+// tags of its group.
+func (r *Registry) Tags(hwaddr string) []string {
+	d, ok := r.Lookup(hwaddr)
+	if !ok {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, t := range d.Tags {
+		set[t] = true
+	}
+	if g, ok := r.Groups[d.Group]; ok && d.Group != "" {
+		for _, t := range g.Tags {
+			set[t] = true
+		}
+	}
+	tags := make([]string, 0, len(set))
+	for t := range set {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// HasTag returns whether the device with MAC address hwaddr (or its group)
+// carries tag.
+func (r *Registry) HasTag(hwaddr, tag string) bool {
+	for _, t := range r.Tags(hwaddr) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Tagged returns the MAC addresses of all devices carrying tag.
+func (r *Registry) Tagged(tag string) []string {
+	if r == nil {
+		return nil
+	}
+	var hwaddrs []string
+	for _, d := range r.Devices {
+		if r.HasTag(d.HardwareAddr, tag) {
+			hwaddrs = append(hwaddrs, d.HardwareAddr)
+		}
+	}
+	return hwaddrs
+}
+
+// HasQuotas returns whether any device or group has a quota.
+func (r *Registry) HasQuotas() bool {
+	if r == nil {
+		return false
+	}
+	for _, d := range r.Devices {
+		if d.Quota != nil {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		if g.Quota != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package devices_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rtr7/router7/internal/devices"
+)
+
+const registryJSON = `{
+  "devices": [
+    {"hardware_addr": "00:1F:16:12:34:56", "name": "midna", "icon": "💻"},
+    {"hardware_addr": "00:1f:16:aa:bb:cc", "name": "tv", "group": "iot", "tags": ["threatintel-exempt"]}
+  ],
+  "groups": {
+    "iot": {"tags": ["no-internet"]}
+  }
+}`
+
+func TestRegistry(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	r, err := devices.Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Lookup("00:1f:16:12:34:56"); ok {
+		t.Fatalf("empty registry unexpectedly knows a device")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "devices.json"), []byte(registryJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err = devices.Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, ok := r.Lookup("00:1f:16:12:34:56") // canonicalized
+	if !ok {
+		t.Fatalf("Lookup(midna) failed")
+	}
+	if got, want := d.Name, "midna"; got != want {
+		t.Errorf("unexpected name: got %q, want %q", got, want)
+	}
+
+	if got, want := r.Tags("00:1f:16:aa:bb:cc"), []string{"no-internet", "threatintel-exempt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tags(tv) = %q, want %q", got, want)
+	}
+	if r.HasTag("00:1f:16:12:34:56", devices.TagNoInternet) {
+		t.Errorf("midna unexpectedly tagged %q", devices.TagNoInternet)
+	}
+	if got, want := r.Tagged(devices.TagNoInternet), []string{"00:1f:16:aa:bb:cc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tagged(%q) = %q, want %q", devices.TagNoInternet, got, want)
+	}
+
+	var nilRegistry *devices.Registry
+	if nilRegistry.HasTag("00:1f:16:aa:bb:cc", devices.TagNoInternet) {
+		t.Errorf("nil registry unexpectedly knows tags")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const dup = `{"devices": [
+  {"hardware_addr": "00:1f:16:12:34:56", "name": "a"},
+  {"hardware_addr": "00:1F:16:12:34:56", "name": "b"}
+]}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "devices.json"), []byte(dup), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := devices.Read(tmp); err == nil {
+		t.Fatalf("Read unexpectedly accepted duplicate devices")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fn := filepath.Join(tmp, "devices.json")
+	const quota = `{"devices": [
+  {"hardware_addr": "00:1f:16:12:34:56", "name": "a", "quota": {"daily_mb": 1024}}
+]}`
+	if err := ioutil.WriteFile(fn, []byte(quota), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := devices.Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.HasQuotas() {
+		t.Errorf("HasQuotas() = false, want true")
+	}
+	d, _ := r.Lookup("00:1f:16:12:34:56")
+	want := &devices.Quota{
+		DailyMB:      1024,
+		ResetDay:     1,
+		Action:       devices.QuotaBlock,
+		ThrottleKbps: 1000,
+	}
+	if !reflect.DeepEqual(d.Quota, want) {
+		t.Errorf("unexpected quota defaults: got %+v, want %+v", d.Quota, want)
+	}
+
+	const invalid = `{"groups": {"kids": {"quota": {"monthly_mb": 1024, "action": "shape"}}}}`
+	if err := ioutil.WriteFile(fn, []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := devices.Read(tmp); err == nil {
+		t.Fatalf("Read unexpectedly accepted unknown quota action")
+	}
+}
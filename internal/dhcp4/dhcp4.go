@@ -17,6 +17,7 @@ package dhcp4
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -32,10 +33,11 @@ import (
 
 type Config struct {
 	RenewAfter time.Time `json:"valid_until"`
-	ClientIP   string    `json:"client_ip"`   // e.g. 85.195.207.62
-	SubnetMask string    `json:"subnet_mask"` // e.g. 255.255.255.128
-	Router     string    `json:"router"`      // e.g. 85.195.207.1
-	DNS        []string  `json:"dns"`         // e.g. 77.109.128.2, 213.144.129.20
+	ClientIP   string    `json:"client_ip"`     // e.g. 85.195.207.62
+	SubnetMask string    `json:"subnet_mask"`   // e.g. 255.255.255.128
+	Router     string    `json:"router"`        // e.g. 85.195.207.1
+	DNS        []string  `json:"dns"`           // e.g. 77.109.128.2, 213.144.129.20
+	MTU        int       `json:"mtu,omitempty"` // e.g. 1492, 0 if not provided
 }
 
 type Client struct {
@@ -64,6 +66,23 @@ func serverID(pkt *layers.DHCPv4) []layers.DHCPOption {
 	return nil
 }
 
+// minMTU is the smallest MTU which RFC 2132 permits for option 26.
+const minMTU = 68
+
+// interfaceMTU returns the interface MTU option of pkt, or 0 if it is absent
+// or invalid.
+func interfaceMTU(pkt *layers.DHCPv4) int {
+	for _, o := range pkt.Options {
+		if o.Type != layers.DHCPOptInterfaceMTU || len(o.Data) != 2 {
+			continue
+		}
+		if mtu := int(binary.BigEndian.Uint16(o.Data)); mtu >= minMTU {
+			return mtu
+		}
+	}
+	return 0
+}
+
 func (c *Client) packet(xid uint32, opts []layers.DHCPOption) *layers.DHCPv4 {
 	return &layers.DHCPv4{
 		Operation:    layers.DHCPOpRequest,
@@ -153,6 +172,7 @@ func (c *Client) ObtainOrRenew() bool {
 			c.cfg.DNS[idx] = ip.String()
 		}
 	}
+	c.cfg.MTU = interfaceMTU(ack)
 	c.cfg.RenewAfter = c.timeNow().Add(lease.RenewalTime)
 	return true
 }
@@ -191,7 +211,8 @@ func (c *Client) dhcpRequest() (*layers.DHCPv4, error) {
 			dhcp4.ParamsRequestOpt(
 				layers.DHCPOptDNS,
 				layers.DHCPOptRouter,
-				layers.DHCPOptSubnetMask),
+				layers.DHCPOptSubnetMask,
+				layers.DHCPOptInterfaceMTU),
 		})
 		if err := dhcp4.Write(c.connection, discover); err != nil {
 			return nil, err
@@ -227,7 +248,8 @@ func (c *Client) dhcpRequest() (*layers.DHCPv4, error) {
 		dhcp4.ParamsRequestOpt(
 			layers.DHCPOptDNS,
 			layers.DHCPOptRouter,
-			layers.DHCPOptSubnetMask),
+			layers.DHCPOptSubnetMask,
+			layers.DHCPOptInterfaceMTU),
 	}, serverID(last)...))
 	if err := dhcp4.Write(c.connection, request); err != nil {
 		return nil, err
@@ -0,0 +1,114 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Policy configures which settings of the uplink DHCP lease are applied. The
+// address and subnet of the lease are always applied.
+type Policy struct {
+	// DefaultRoute installs the default route via the router of the
+	// lease. Enabled unless set to false, e.g. when a different uplink
+	// (WireGuard, LTE) provides the default route.
+	DefaultRoute *bool `json:"default_route"`
+
+	// DNS additionally forwards queries to the DNS servers of the lease,
+	// which dnsd otherwise ignores in favor of public resolvers.
+	DNS bool `json:"dns"`
+
+	// MTU applies the interface MTU of the lease (DHCP option 26) to
+	// uplink0, clamped to [MinMTU, MaxMTU] where these are non-zero.
+	MTU    bool `json:"mtu"`
+	MinMTU int  `json:"min_mtu"`
+	MaxMTU int  `json:"max_mtu"`
+}
+
+// ReadPolicy reads the policy from dir/dhcp4/policy.json. A missing file
+// results in the default policy.
+func ReadPolicy(dir string) (*Policy, error) {
+	var p Policy
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4/policy.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &p, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if p.MinMTU != 0 && p.MinMTU < minMTU {
+		return nil, fmt.Errorf("min_mtu %d below %d", p.MinMTU, minMTU)
+	}
+	if p.MaxMTU != 0 && p.MaxMTU < minMTU {
+		return nil, fmt.Errorf("max_mtu %d below %d", p.MaxMTU, minMTU)
+	}
+	if p.MinMTU != 0 && p.MaxMTU != 0 && p.MinMTU > p.MaxMTU {
+		return nil, fmt.Errorf("min_mtu %d above max_mtu %d", p.MinMTU, p.MaxMTU)
+	}
+	return &p, nil
+}
+
+// Apply returns the settings of cfg which p accepts: settings which are not
+// accepted are cleared (e.g. Router is empty if the default route is not
+// accepted).
+func (p *Policy) Apply(cfg Config) Config {
+	if p.DefaultRoute != nil && !*p.DefaultRoute {
+		cfg.Router = ""
+	}
+	if !p.DNS {
+		cfg.DNS = nil
+	}
+	if !p.MTU {
+		cfg.MTU = 0
+	} else if cfg.MTU != 0 {
+		if p.MinMTU != 0 && cfg.MTU < p.MinMTU {
+			cfg.MTU = p.MinMTU
+		}
+		if p.MaxMTU != 0 && cfg.MTU > p.MaxMTU {
+			cfg.MTU = p.MaxMTU
+		}
+	}
+	return cfg
+}
+
+// ReadAccepted reads the lease from dir/dhcp4/wire/lease.json and returns
+// the settings which the policy in dir accepts. It returns nil if no lease
+// was obtained yet.
+func ReadAccepted(dir string) (*Config, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // dhcp4 might not have obtained a lease yet
+		}
+		return nil, err
+	}
+	var lease Config
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, err
+	}
+	policy, err := ReadPolicy(dir)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %v", err)
+	}
+	accepted := policy.Apply(lease)
+	return &accepted, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPolicy(t *testing.T) {
+	lease := Config{
+		ClientIP:   "85.195.207.62",
+		SubnetMask: "255.255.255.128",
+		Router:     "85.195.207.1",
+		DNS:        []string{"77.109.128.2", "213.144.129.20"},
+		MTU:        1400,
+	}
+	no := false
+	for _, tt := range []struct {
+		name   string
+		policy Policy
+		want   Config
+	}{
+		{
+			name:   "Default",
+			policy: Policy{},
+			want: Config{
+				ClientIP:   "85.195.207.62",
+				SubnetMask: "255.255.255.128",
+				Router:     "85.195.207.1",
+			},
+		},
+		{
+			name:   "NoDefaultRoute",
+			policy: Policy{DefaultRoute: &no, DNS: true},
+			want: Config{
+				ClientIP:   "85.195.207.62",
+				SubnetMask: "255.255.255.128",
+				DNS:        []string{"77.109.128.2", "213.144.129.20"},
+			},
+		},
+		{
+			name:   "MTU",
+			policy: Policy{MTU: true},
+			want: Config{
+				ClientIP:   "85.195.207.62",
+				SubnetMask: "255.255.255.128",
+				Router:     "85.195.207.1",
+				MTU:        1400,
+			},
+		},
+		{
+			name:   "MTUClampedUp",
+			policy: Policy{MTU: true, MinMTU: 1492},
+			want: Config{
+				ClientIP:   "85.195.207.62",
+				SubnetMask: "255.255.255.128",
+				Router:     "85.195.207.1",
+				MTU:        1492,
+			},
+		},
+		{
+			name:   "MTUClampedDown",
+			policy: Policy{MTU: true, MaxMTU: 1280},
+			want: Config{
+				ClientIP:   "85.195.207.62",
+				SubnetMask: "255.255.255.128",
+				Router:     "85.195.207.1",
+				MTU:        1280,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Apply(lease)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("Apply: unexpected config: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// A lease without MTU option is not assigned the minimum MTU.
+	noMTU := lease
+	noMTU.MTU = 0
+	policy := Policy{MTU: true, MinMTU: 1280}
+	if got := policy.Apply(noMTU); got.MTU != 0 {
+		t.Fatalf("Apply(lease without MTU).MTU = %d, want 0", got.MTU)
+	}
+}
+
+func TestReadPolicy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dhcp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p, err := ReadPolicy(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&Policy{}, p); diff != "" {
+		t.Fatalf("ReadPolicy(missing file): diff (-want +got):\n%s", diff)
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp4"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(tmp, "dhcp4", "policy.json")
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{`{"default_route": false, "dns": true}`, false},
+		{`{"mtu": true, "min_mtu": 1280, "max_mtu": 1500}`, false},
+		{`{"mtu": true, "min_mtu": 1500, "max_mtu": 1280}`, true},
+		{`{"mtu": true, "max_mtu": 20}`, true},
+		{`{"mtu": true, "min_mtu": 20}`, true},
+	} {
+		if err := ioutil.WriteFile(fn, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ReadPolicy(tmp)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("ReadPolicy(%s): got err %v, want error %v", tt.config, err, tt.wantErr)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp4", "wire"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte(`{"default_route": false}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const lease = `{"client_ip":"85.195.207.62","subnet_mask":"255.255.255.128","router":"85.195.207.1","dns":["77.109.128.2"],"mtu":1492}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4", "wire", "lease.json"), []byte(lease), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadAccepted(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		ClientIP:   "85.195.207.62",
+		SubnetMask: "255.255.255.128",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("ReadAccepted: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// Kinds of violations found by Audit.
+const (
+	ViolationDuplicateAddr = "duplicate_addr" // leases share an address
+	ViolationStaticInPool  = "static_in_pool" // static lease within the pool
+	ViolationForwardDNS    = "forward_dns"    // hostname does not resolve to the lease
+	ViolationReverseDNS    = "reverse_dns"    // address does not resolve to the hostname
+)
+
+// ViolationKinds are all kinds of violations, e.g. for exporting metrics.
+var ViolationKinds = []string{
+	ViolationDuplicateAddr,
+	ViolationStaticInPool,
+	ViolationForwardDNS,
+	ViolationReverseDNS,
+}
+
+// Violation is an inconsistency between leases, configuration and DNS.
+type Violation struct {
+	Kind         string `json:"kind"`
+	Addr         string `json:"addr"`
+	HardwareAddr string `json:"hardware_addr"`
+	Hostname     string `json:"hostname,omitempty"`
+	Detail       string `json:"detail"`
+}
+
+// Resolver resolves names and addresses, typically a net.Resolver which
+// queries dnsd.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Audit checks leases (as passed to the Leases callback) for consistency:
+// non-expired leases must not share an address, static leases must not be
+// within the address pool and, unless r is nil, the hostname of each
+// non-expired lease must resolve to its address under domain (e.g. “lan”) and
+// vice versa.
+func (h *Handler) Audit(ctx context.Context, leases []*Lease, domain string, r Resolver) []Violation {
+	now := h.timeNow()
+	var violations []Violation
+	report := func(l *Lease, kind, format string, args ...interface{}) {
+		violations = append(violations, Violation{
+			Kind:         kind,
+			Addr:         l.Addr.String(),
+			HardwareAddr: l.HardwareAddr,
+			Hostname:     l.Hostname,
+			Detail:       fmt.Sprintf(format, args...),
+		})
+	}
+	byAddr := make(map[string]*Lease)
+	for _, l := range leases {
+		if l.Expired(now) {
+			continue
+		}
+		if other, ok := byAddr[l.Addr.String()]; ok {
+			report(l, ViolationDuplicateAddr, "address also leased to %s", other.HardwareAddr)
+		} else {
+			byAddr[l.Addr.String()] = l
+		}
+		if l.Expiry.IsZero() {
+			num := h.num(l.Addr)
+			if p := h.poolOf(num); p != nil && !h.excludedNum(num) {
+				report(l, ViolationStaticInPool, "static lease within the dynamic pool %v-%v",
+					p.start, dhcp4.IPAdd(p.start, p.size-1))
+			}
+		}
+	}
+	if r == nil {
+		return violations
+	}
+	names := DNSNames(leases, now)
+	for idx, l := range leases {
+		if names[idx] == "" {
+			continue
+		}
+		fqdn := names[idx] + "." + strings.Trim(domain, ".")
+		addrs, err := r.LookupHost(ctx, fqdn+".")
+		if err != nil {
+			report(l, ViolationForwardDNS, "%v", err)
+		} else if !containsAddr(addrs, l.Addr.String()) {
+			report(l, ViolationForwardDNS, "%s resolves to %v", fqdn, addrs)
+		}
+		names, err := r.LookupAddr(ctx, l.Addr.String())
+		if err != nil {
+			report(l, ViolationReverseDNS, "%v", err)
+		} else if !containsName(names, fqdn) {
+			report(l, ViolationReverseDNS, "%v resolves to %v", l.Addr, names)
+		}
+	}
+	return violations
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(strings.TrimSuffix(n, "."), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeResolver answers from static maps, like dnsd would for the leases.
+type fakeResolver struct {
+	hosts map[string][]string // fully qualified name → addresses
+	addrs map[string][]string // address → fully qualified names
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("lookup %s: no such host", host)
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.addrs[addr]; ok {
+		return names, nil
+	}
+	return nil, fmt.Errorf("lookup %s: no such host", addr)
+}
+
+func TestAudit(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	leases := []*Lease{
+		{
+			Addr:         net.IP{192, 168, 42, 23},
+			HardwareAddr: "11:22:33:44:55:66",
+			Hostname:     "consistent",
+			Expiry:       now.Add(1 * time.Hour),
+		},
+		{
+			Addr:         net.IP{192, 168, 42, 23},
+			HardwareAddr: "11:22:33:44:55:77",
+			Expiry:       now.Add(1 * time.Hour),
+		},
+		{
+			// expired leases are not considered
+			Addr:         net.IP{192, 168, 42, 23},
+			HardwareAddr: "11:22:33:44:55:88",
+			Hostname:     "expired",
+			Expiry:       now.Add(-1 * time.Hour),
+		},
+		{
+			// static lease within the pool
+			Addr:         net.IP{192, 168, 42, 42},
+			HardwareAddr: "11:22:33:44:55:99",
+		},
+		{
+			// static lease outside of the pool
+			Addr:         net.IP{192, 168, 42, 240},
+			HardwareAddr: "11:22:33:44:55:aa",
+			Hostname:     "Printer",
+		},
+		{
+			Addr:         net.IP{192, 168, 42, 50},
+			HardwareAddr: "11:22:33:44:55:bb",
+			Hostname:     "stale",
+			Expiry:       now.Add(1 * time.Hour),
+		},
+	}
+
+	want := []Violation{
+		{
+			Kind:         ViolationDuplicateAddr,
+			Addr:         "192.168.42.23",
+			HardwareAddr: "11:22:33:44:55:77",
+			Detail:       "address also leased to 11:22:33:44:55:66",
+		},
+		{
+			Kind:         ViolationStaticInPool,
+			Addr:         "192.168.42.42",
+			HardwareAddr: "11:22:33:44:55:99",
+			Detail:       "static lease within the dynamic pool 192.168.42.2-192.168.42.231",
+		},
+	}
+	if diff := cmp.Diff(want, handler.Audit(context.Background(), leases, "lan", nil)); diff != "" {
+		t.Errorf("Audit (without DNS): unexpected violations: diff (-want +got):\n%s", diff)
+	}
+
+	r := &fakeResolver{
+		hosts: map[string][]string{
+			"consistent.lan.": {"192.168.42.23"},
+			"Printer.lan.":    {"192.168.42.240"},
+			"stale.lan.":      {"192.168.42.51"},
+		},
+		addrs: map[string][]string{
+			"192.168.42.23":  {"consistent.lan."},
+			"192.168.42.240": {"printer.lan."},
+		},
+	}
+	want = append(want,
+		Violation{
+			Kind:         ViolationForwardDNS,
+			Addr:         "192.168.42.50",
+			HardwareAddr: "11:22:33:44:55:bb",
+			Hostname:     "stale",
+			Detail:       "stale.lan resolves to [192.168.42.51]",
+		},
+		Violation{
+			Kind:         ViolationReverseDNS,
+			Addr:         "192.168.42.50",
+			HardwareAddr: "11:22:33:44:55:bb",
+			Hostname:     "stale",
+			Detail:       "lookup 192.168.42.50: no such host",
+		})
+	if diff := cmp.Diff(want, handler.Audit(context.Background(), leases, "lan", r)); diff != "" {
+		t.Errorf("Audit: unexpected violations: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,531 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// Config is the DHCPv4 server configuration, stored in dhcp4d.json. All
+// fields are optional: by default, dhcp4d serves the subnet of the LAN
+// interface (from interfaces.json) and hands out the 230 addresses following
+// the LAN interface address.
+type Config struct {
+	Subnet    string   `json:"subnet"`     // e.g. “192.168.42.0/24”
+	Router    string   `json:"router"`     // e.g. “192.168.42.1”
+	PoolStart string   `json:"pool_start"` // e.g. “192.168.42.100”
+	PoolEnd   string   `json:"pool_end"`   // e.g. “192.168.42.199”
+	Exclude   []string `json:"exclude"`    // e.g. “192.168.42.150-192.168.42.159”
+
+	// WPAD is the URL of the proxy auto-configuration file to advertise via
+	// option 252 (e.g. “http://wpad.lan/wpad.dat”), which Windows clients
+	// request via DHCPINFORM.
+	WPAD string `json:"wpad"`
+
+	// VendorOptions configures vendor-specific information (option 43) for
+	// clients of certain vendor classes (option 60).
+	VendorOptions []VendorOption `json:"vendor_options"`
+
+	// Allocation selects how addresses are picked for new clients: “random”
+	// (default) or “hash”, which derives the address from a hash of the
+	// client identifier or MAC address (like dnsmasq), so that clients tend
+	// to get the same address even after the leases database was lost (e.g.
+	// when reinstalling the router). On collision, the next free address is
+	// used.
+	Allocation string `json:"allocation"`
+
+	// SharedNetworks are additional subnets served on the same LAN segment,
+	// e.g. while migrating clients from an old subnet to the LAN interface
+	// subnet.
+	SharedNetworks []SharedNetwork `json:"shared_networks"`
+
+	// Gateways point selected clients at a different default gateway
+	// (option 3) than Router, e.g. a VPN gateway appliance.
+	Gateways []Gateway `json:"gateways"`
+}
+
+// Gateway is the default gateway (option 3) of the clients with the specified
+// MAC addresses and of the devices in the specified groups of the device
+// registry (devices.json). MAC addresses take precedence over groups. The
+// router must be within the subnet of the client’s address, otherwise the
+// client gets the router of its subnet. E.g., for a VPN gateway appliance:
+//
+//	{"router": "192.168.42.2", "hardware_addrs": ["00:1f:16:12:34:56"], "groups": ["vpn"]}
+type Gateway struct {
+	Router        string   `json:"router"`
+	HardwareAddrs []string `json:"hardware_addrs"`
+	Groups        []string `json:"groups"`
+}
+
+// gateways are the validated Config.Gateways.
+type gateways struct {
+	byHardwareAddr map[string]net.IP // as formatted by net.HardwareAddr.String
+	byGroup        map[string]net.IP
+}
+
+// gateways validates c.Gateways against pools.
+func (c *Config) gateways(pools []*pool) (*gateways, error) {
+	gw := &gateways{
+		byHardwareAddr: make(map[string]net.IP),
+		byGroup:        make(map[string]net.IP),
+	}
+	for i, g := range c.Gateways {
+		router, err := parseIPv4(fmt.Sprintf("gateways[%d]: router", i), g.Router)
+		if err != nil {
+			return nil, err
+		}
+		served := false
+		for _, p := range pools {
+			served = served || p.subnet.Contains(router)
+		}
+		if !served {
+			return nil, fmt.Errorf("gateways[%d]: router %v is not within a served subnet", i, router)
+		}
+		if len(g.HardwareAddrs) == 0 && len(g.Groups) == 0 {
+			return nil, fmt.Errorf("gateways[%d]: hardware_addrs or groups must be set", i)
+		}
+		for _, addr := range g.HardwareAddrs {
+			hwaddr, err := net.ParseMAC(addr)
+			if err != nil {
+				return nil, fmt.Errorf("gateways[%d]: %v", i, err)
+			}
+			if _, ok := gw.byHardwareAddr[hwaddr.String()]; ok {
+				return nil, fmt.Errorf("gateways[%d]: duplicate hardware address %s", i, hwaddr)
+			}
+			gw.byHardwareAddr[hwaddr.String()] = router
+		}
+		for _, group := range g.Groups {
+			if group == "" {
+				return nil, fmt.Errorf("gateways[%d]: groups must not contain empty names", i)
+			}
+			if _, ok := gw.byGroup[group]; ok {
+				return nil, fmt.Errorf("gateways[%d]: duplicate group %q", i, group)
+			}
+			gw.byGroup[group] = router
+		}
+	}
+	return gw, nil
+}
+
+// SharedNetwork is an additional subnet served on the LAN segment. Clients
+// keep addresses they request within its pool. New clients get an address
+// from the first eligible pool: pools whose subnet contains the relay agent
+// address (giaddr) of relayed requests, pools restricted to the vendor class
+// of the client, then the pool of the LAN interface subnet, then the other
+// shared networks. E.g., for an old subnet whose router is still in place:
+//
+//	{"subnet": "10.0.0.0/24", "router": "10.0.0.1", "pool_start": "10.0.0.100", "pool_end": "10.0.0.199"}
+type SharedNetwork struct {
+	Subnet    string   `json:"subnet"`     // required, e.g. “10.0.0.0/24”
+	Router    string   `json:"router"`     // required, e.g. “10.0.0.1”
+	PoolStart string   `json:"pool_start"` // defaults to the router address + 1
+	PoolEnd   string   `json:"pool_end"`   // defaults to 229 addresses after pool_start
+	Exclude   []string `json:"exclude"`
+
+	// VendorClasses restricts the pool to clients whose vendor class
+	// identifier (option 60) starts with one of the prefixes, e.g.
+	// “ubnt” or “MSFT”.
+	VendorClasses []string `json:"vendor_classes"`
+}
+
+// pool validates n and fills in defaults.
+func (n *SharedNetwork) pool() (*pool, error) {
+	if n.Subnet == "" || n.Router == "" {
+		return nil, fmt.Errorf("subnet and router must be set")
+	}
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("subnet: %v", err)
+	}
+	router, err := parseIPv4("router", n.Router)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := subnet.Mask.Size()
+	// The router takes the place of the LAN interface address.
+	p, err := (&Config{
+		Subnet:    n.Subnet,
+		PoolStart: n.PoolStart,
+		PoolEnd:   n.PoolEnd,
+		Exclude:   n.Exclude,
+	}).pool(fmt.Sprintf("%v/%d", router, ones))
+	if err != nil {
+		return nil, err
+	}
+	for _, class := range n.VendorClasses {
+		if class == "" {
+			return nil, fmt.Errorf("vendor_classes must not contain empty prefixes")
+		}
+	}
+	p.classes = n.VendorClasses
+	return p, nil
+}
+
+// VendorSuboption is an encapsulated vendor-specific option. Exactly one of
+// Hex, IP or String must be set.
+type VendorSuboption struct {
+	Code   byte   `json:"code"`
+	Hex    string `json:"hex,omitempty"`    // e.g. “0a0b”
+	IP     string `json:"ip,omitempty"`     // e.g. “192.168.42.2”
+	String string `json:"string,omitempty"` // e.g. “http://unifi:8080/inform”
+}
+
+// VendorOption is the vendor-specific information (option 43) sent to clients
+// whose vendor class identifier (option 60) starts with VendorClass. The
+// payload is either Hex (raw bytes) or encoded from Suboptions. E.g., for
+// adopting UniFi access points with a controller at 192.168.42.2:
+//
+//	{"vendor_class": "ubnt", "suboptions": [{"code": 1, "ip": "192.168.42.2"}]}
+type VendorOption struct {
+	VendorClass string            `json:"vendor_class"`
+	Hex         string            `json:"hex,omitempty"`
+	Suboptions  []VendorSuboption `json:"suboptions,omitempty"`
+}
+
+func (s *VendorSuboption) value() ([]byte, error) {
+	set := 0
+	var b []byte
+	if s.Hex != "" {
+		set++
+		var err error
+		if b, err = hex.DecodeString(s.Hex); err != nil {
+			return nil, err
+		}
+	}
+	if s.IP != "" {
+		set++
+		ip, err := parseIPv4("ip", s.IP)
+		if err != nil {
+			return nil, err
+		}
+		b = []byte(ip)
+	}
+	if s.String != "" {
+		set++
+		b = []byte(s.String)
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of hex, ip or string must be set")
+	}
+	return b, nil
+}
+
+func (v *VendorOption) payload() ([]byte, error) {
+	if v.VendorClass == "" {
+		return nil, fmt.Errorf("vendor_class must not be empty")
+	}
+	if (v.Hex == "") == (len(v.Suboptions) == 0) {
+		return nil, fmt.Errorf("vendor class %q: exactly one of hex or suboptions must be set", v.VendorClass)
+	}
+	var b []byte
+	if v.Hex != "" {
+		var err error
+		if b, err = hex.DecodeString(v.Hex); err != nil {
+			return nil, fmt.Errorf("vendor class %q: %v", v.VendorClass, err)
+		}
+	}
+	for _, s := range v.Suboptions {
+		if s.Code == 0 || s.Code == 255 {
+			return nil, fmt.Errorf("vendor class %q: suboption code %d is reserved (pad/end)", v.VendorClass, s.Code)
+		}
+		val, err := s.value()
+		if err != nil {
+			return nil, fmt.Errorf("vendor class %q: suboption %d: %v", v.VendorClass, s.Code, err)
+		}
+		if len(val) > 255 {
+			return nil, fmt.Errorf("vendor class %q: suboption %d: value too long", v.VendorClass, s.Code)
+		}
+		b = append(b, s.Code, byte(len(val)))
+		b = append(b, val...)
+	}
+	if len(b) > 255 {
+		return nil, fmt.Errorf("vendor class %q: payload too long (%d bytes, max 255)", v.VendorClass, len(b))
+	}
+	return b, nil
+}
+
+// vendorOption is a validated VendorOption.
+type vendorOption struct {
+	class   string
+	payload []byte
+}
+
+func (c *Config) vendorOptions() ([]vendorOption, error) {
+	var result []vendorOption
+	for _, v := range c.VendorOptions {
+		payload, err := v.payload()
+		if err != nil {
+			return nil, fmt.Errorf("vendor_options: %v", err)
+		}
+		result = append(result, vendorOption{class: v.VendorClass, payload: payload})
+	}
+	return result, nil
+}
+
+// wpad validates c.WPAD and returns the option 252 payload, if any.
+func (c *Config) wpad() ([]byte, error) {
+	if c.WPAD == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.WPAD)
+	if err != nil {
+		return nil, fmt.Errorf("wpad: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("wpad: %q is not an http(s) URL", c.WPAD)
+	}
+	if len(c.WPAD) > 255 {
+		return nil, fmt.Errorf("wpad: URL too long (%d bytes, max 255)", len(c.WPAD))
+	}
+	return []byte(c.WPAD), nil
+}
+
+// hashAllocation validates c.Allocation and returns whether addresses are
+// derived from a hash of the client.
+func (c *Config) hashAllocation() (bool, error) {
+	switch c.Allocation {
+	case "", "random":
+		return false, nil
+	case "hash":
+		return true, nil
+	}
+	return false, fmt.Errorf("allocation: unknown strategy %q (want random or hash)", c.Allocation)
+}
+
+// ReadConfig reads dhcp4d.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "dhcp4d.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+// NetworkConfig returns the configuration for serving network n (from
+// networks.json), whose subnet and router are those of the network interface.
+func NetworkConfig(n netconfig.Network) *Config {
+	return &Config{
+		PoolStart:  n.DHCP4.PoolStart,
+		PoolEnd:    n.DHCP4.PoolEnd,
+		Exclude:    n.DHCP4.Exclude,
+		WPAD:       n.DHCP4.WPAD,
+		Allocation: n.DHCP4.Allocation,
+	}
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func parseIPv4(field, s string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%s: %q is not an IPv4 address", field, s)
+	}
+	return ip, nil
+}
+
+// addrRange is an inclusive range of IPv4 addresses.
+type addrRange struct {
+	first, last uint32
+}
+
+func (r addrRange) contains(ip net.IP) bool {
+	n := ipToUint32(ip)
+	return n >= r.first && n <= r.last
+}
+
+// parseRange parses an address (e.g. 192.168.42.5) or an address range (e.g.
+// 192.168.42.5-192.168.42.9).
+func parseRange(s string) (addrRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	first, err := parseIPv4("exclude", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return addrRange{}, err
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = parseIPv4("exclude", strings.TrimSpace(parts[1])); err != nil {
+			return addrRange{}, err
+		}
+	}
+	r := addrRange{ipToUint32(first), ipToUint32(last)}
+	if r.first > r.last {
+		return addrRange{}, fmt.Errorf("exclude: %q: first address after last address", s)
+	}
+	return r, nil
+}
+
+// pool is a validated Config or SharedNetwork.
+type pool struct {
+	subnet   *net.IPNet
+	mask     net.IPMask
+	router   net.IP
+	start    net.IP
+	size     int
+	excluded []addrRange
+	classes  []string // vendor class prefixes, empty if unrestricted
+	offset   int      // lease number of start
+}
+
+// contains returns whether lease number num is within p.
+func (p *pool) contains(num int) bool {
+	return num >= p.offset && num < p.offset+p.size
+}
+
+// pools validates c against the LAN interface address lan and returns the
+// pool of the LAN interface subnet, followed by the pools of the shared
+// networks. Lease numbers are consecutive across pools.
+func (c *Config) pools(lan string) ([]*pool, error) {
+	primary, err := c.pool(lan)
+	if err != nil {
+		return nil, err
+	}
+	pools := []*pool{primary}
+	for i, n := range c.SharedNetworks {
+		p, err := n.pool()
+		if err != nil {
+			return nil, fmt.Errorf("shared_networks[%d]: %v", i, err)
+		}
+		first, last := ipToUint32(p.start), ipToUint32(p.start)+uint32(p.size)-1
+		for _, other := range pools {
+			ofirst, olast := ipToUint32(other.start), ipToUint32(other.start)+uint32(other.size)-1
+			if first <= olast && ofirst <= last {
+				return nil, fmt.Errorf("shared_networks[%d]: pool %v-%v overlaps pool %v-%v",
+					i, uint32ToIP(first), uint32ToIP(last), uint32ToIP(ofirst), uint32ToIP(olast))
+			}
+		}
+		prev := pools[len(pools)-1]
+		p.offset = prev.offset + prev.size
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// pool validates c against the LAN interface address lan (e.g.
+// 192.168.42.1/24) and fills in defaults.
+func (c *Config) pool(lan string) (*pool, error) {
+	serverIP, lanNet, err := net.ParseCIDR(lan)
+	if err != nil {
+		return nil, fmt.Errorf("LAN interface address: %v", err)
+	}
+	serverIP = serverIP.To4()
+	if serverIP == nil {
+		return nil, fmt.Errorf("LAN interface address %q is not an IPv4 address", lan)
+	}
+	subnet := lanNet
+	if c.Subnet != "" {
+		_, subnet, err = net.ParseCIDR(c.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("subnet: %v", err)
+		}
+		if subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("subnet: %q is not an IPv4 subnet", c.Subnet)
+		}
+		if !subnet.Contains(serverIP) {
+			return nil, fmt.Errorf("subnet %v does not contain the LAN interface address %v", subnet, serverIP)
+		}
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %v too small", subnet)
+	}
+	network := ipToUint32(subnet.IP)
+	broadcast := network | ^ipToUint32(net.IP(subnet.Mask))
+	// usable returns whether ip is a host address within subnet.
+	usable := func(ip net.IP) bool {
+		n := ipToUint32(ip)
+		return n > network && n < broadcast
+	}
+
+	p := &pool{subnet: subnet, mask: subnet.Mask, router: serverIP}
+	if c.Router != "" {
+		if p.router, err = parseIPv4("router", c.Router); err != nil {
+			return nil, err
+		}
+		if !usable(p.router) {
+			return nil, fmt.Errorf("router %v is not a host address in subnet %v", p.router, subnet)
+		}
+	}
+
+	p.start = uint32ToIP(ipToUint32(serverIP) + 1)
+	if c.PoolStart != "" {
+		if p.start, err = parseIPv4("pool_start", c.PoolStart); err != nil {
+			return nil, err
+		}
+	}
+	if !usable(p.start) {
+		return nil, fmt.Errorf("pool_start %v is not a host address in subnet %v", p.start, subnet)
+	}
+	var end uint32
+	if c.PoolEnd != "" {
+		ip, err := parseIPv4("pool_end", c.PoolEnd)
+		if err != nil {
+			return nil, err
+		}
+		if !usable(ip) {
+			return nil, fmt.Errorf("pool_end %v is not a host address in subnet %v", ip, subnet)
+		}
+		end = ipToUint32(ip)
+	} else {
+		end = ipToUint32(p.start) + 229
+		if end >= broadcast {
+			end = broadcast - 1
+		}
+	}
+	if end < ipToUint32(p.start) {
+		return nil, fmt.Errorf("pool_end %v before pool_start %v", uint32ToIP(end), p.start)
+	}
+	p.size = int(end-ipToUint32(p.start)) + 1
+
+	// The server and router addresses are never handed out.
+	for _, ip := range []net.IP{serverIP, p.router} {
+		n := ipToUint32(ip)
+		p.excluded = append(p.excluded, addrRange{n, n})
+	}
+	for _, e := range c.Exclude {
+		r, err := parseRange(e)
+		if err != nil {
+			return nil, err
+		}
+		p.excluded = append(p.excluded, r)
+	}
+	return p, nil
+}
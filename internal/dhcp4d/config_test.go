@@ -0,0 +1,297 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	p, err := (&Config{}).pool("192.168.42.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.start, (net.IP{192, 168, 42, 2}); !got.Equal(want) {
+		t.Errorf("unexpected pool start: got %v, want %v", got, want)
+	}
+	if got, want := p.size, 230; got != want {
+		t.Errorf("unexpected pool size: got %d, want %d", got, want)
+	}
+	if got, want := p.mask.String(), "ffffff00"; got != want {
+		t.Errorf("unexpected subnet mask: got %v, want %v", got, want)
+	}
+
+	// The default pool is capped at the end of the subnet.
+	p, err = (&Config{}).pool("10.0.0.1/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.size, 13; got != want {
+		t.Errorf("unexpected pool size: got %d, want %d", got, want)
+	}
+}
+
+func TestConfigPool(t *testing.T) {
+	cfg := &Config{
+		Subnet:    "192.168.0.0/16",
+		Router:    "192.168.42.254",
+		PoolStart: "192.168.42.100",
+		PoolEnd:   "192.168.43.99",
+		Exclude:   []string{"192.168.42.150-192.168.42.159", "192.168.43.1"},
+	}
+	p, err := cfg.pool("192.168.42.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.size, 256; got != want {
+		t.Errorf("unexpected pool size: got %d, want %d", got, want)
+	}
+	if got, want := p.router, (net.IP{192, 168, 42, 254}); !got.Equal(want) {
+		t.Errorf("unexpected router: got %v, want %v", got, want)
+	}
+	if got, want := p.mask.String(), "ffff0000"; got != want {
+		t.Errorf("unexpected subnet mask: got %v, want %v", got, want)
+	}
+	for _, tt := range []struct {
+		ip       net.IP
+		excluded bool
+	}{
+		{net.IP{192, 168, 42, 1}, true},   // server
+		{net.IP{192, 168, 42, 254}, true}, // router
+		{net.IP{192, 168, 42, 149}, false},
+		{net.IP{192, 168, 42, 155}, true},
+		{net.IP{192, 168, 43, 1}, true},
+	} {
+		excluded := false
+		for _, r := range p.excluded {
+			if r.contains(tt.ip) {
+				excluded = true
+			}
+		}
+		if excluded != tt.excluded {
+			t.Errorf("%v: excluded = %v, want %v", tt.ip, excluded, tt.excluded)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		cfg  Config
+	}{
+		{"subnet without LAN address", Config{Subnet: "10.0.0.0/8"}},
+		{"router outside subnet", Config{Router: "10.0.0.1"}},
+		{"pool start outside subnet", Config{PoolStart: "192.168.43.2"}},
+		{"pool end is broadcast", Config{PoolEnd: "192.168.42.255"}},
+		{"pool end before pool start", Config{PoolStart: "192.168.42.100", PoolEnd: "192.168.42.50"}},
+		{"malformed exclude", Config{Exclude: []string{"192.168.42.9-192.168.42.5"}}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, err := tt.cfg.pool("192.168.42.1/24"); err == nil {
+				t.Fatalf("pool(%+v) unexpectedly succeeded", tt.cfg)
+			}
+		})
+	}
+}
+
+func TestNetworkConfig(t *testing.T) {
+	cfg := NetworkConfig(netconfig.Network{
+		Name: "iot0",
+		VLAN: 10,
+		Addr: "10.0.10.1/24",
+		DHCP4: netconfig.NetworkDHCP4{
+			PoolStart: "10.0.10.100",
+			PoolEnd:   "10.0.10.199",
+			Exclude:   []string{"10.0.10.150"},
+		},
+	})
+	p, err := cfg.pool("10.0.10.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.start, (net.IP{10, 0, 10, 100}); !got.Equal(want) {
+		t.Errorf("unexpected pool start: got %v, want %v", got, want)
+	}
+	if got, want := p.size, 100; got != want {
+		t.Errorf("unexpected pool size: got %d, want %d", got, want)
+	}
+	if got, want := p.router, (net.IP{10, 0, 10, 1}); !got.Equal(want) {
+		t.Errorf("unexpected router: got %v, want %v", got, want)
+	}
+}
+
+func TestConfigSharedNetworks(t *testing.T) {
+	cfg := &Config{
+		SharedNetworks: []SharedNetwork{
+			{Subnet: "10.0.0.0/24", Router: "10.0.0.1"},
+			{Subnet: "10.1.0.0/24", Router: "10.1.0.1", PoolStart: "10.1.0.100", PoolEnd: "10.1.0.109"},
+		},
+	}
+	pools, err := cfg.pools("192.168.42.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(pools), 3; got != want {
+		t.Fatalf("unexpected number of pools: got %d, want %d", got, want)
+	}
+	if got, want := pools[1].start, (net.IP{10, 0, 0, 2}); !got.Equal(want) {
+		t.Errorf("unexpected pool start: got %v, want %v", got, want)
+	}
+	if got, want := pools[1].router, (net.IP{10, 0, 0, 1}); !got.Equal(want) {
+		t.Errorf("unexpected router: got %v, want %v", got, want)
+	}
+	// Lease numbers are consecutive across pools.
+	if got, want := pools[1].offset, 230; got != want {
+		t.Errorf("unexpected offset: got %d, want %d", got, want)
+	}
+	if got, want := pools[2].offset, 230+230; got != want {
+		t.Errorf("unexpected offset: got %d, want %d", got, want)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		n    SharedNetwork
+	}{
+		{"no router", SharedNetwork{Subnet: "10.0.0.0/24"}},
+		{"router outside subnet", SharedNetwork{Subnet: "10.0.0.0/24", Router: "10.0.1.1"}},
+		{"overlapping pool", SharedNetwork{Subnet: "192.168.42.0/24", Router: "192.168.42.254", PoolStart: "192.168.42.200", PoolEnd: "192.168.42.210"}},
+		{"empty vendor class", SharedNetwork{Subnet: "10.0.0.0/24", Router: "10.0.0.1", VendorClasses: []string{""}}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := &Config{SharedNetworks: []SharedNetwork{tt.n}}
+			if _, err := cfg.pools("192.168.42.1/24"); err == nil {
+				t.Fatalf("pools(%+v) unexpectedly succeeded", tt.n)
+			}
+		})
+	}
+}
+
+func TestVendorOptions(t *testing.T) {
+	cfg := &Config{
+		VendorOptions: []VendorOption{
+			{
+				VendorClass: "ubnt",
+				Suboptions: []VendorSuboption{
+					{Code: 1, IP: "192.168.42.2"},
+				},
+			},
+			{
+				VendorClass: "MSFT",
+				Hex:         "010400000002ff",
+			},
+		},
+	}
+	opts, err := cfg.vendorOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(opts), 2; got != want {
+		t.Fatalf("unexpected number of vendor options: got %d, want %d", got, want)
+	}
+	if got, want := opts[0].payload, []byte{1, 4, 192, 168, 42, 2}; !bytes.Equal(got, want) {
+		t.Errorf("unexpected ubnt payload: got %x, want %x", got, want)
+	}
+	if got, want := opts[1].payload, []byte{1, 4, 0, 0, 0, 2, 0xff}; !bytes.Equal(got, want) {
+		t.Errorf("unexpected MSFT payload: got %x, want %x", got, want)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		opt  VendorOption
+	}{
+		{"no vendor class", VendorOption{Hex: "01"}},
+		{"no payload", VendorOption{VendorClass: "ubnt"}},
+		{"hex and suboptions", VendorOption{VendorClass: "ubnt", Hex: "01", Suboptions: []VendorSuboption{{Code: 1, String: "x"}}}},
+		{"malformed hex", VendorOption{VendorClass: "ubnt", Hex: "zz"}},
+		{"reserved code", VendorOption{VendorClass: "ubnt", Suboptions: []VendorSuboption{{Code: 255, String: "x"}}}},
+		{"ambiguous suboption", VendorOption{VendorClass: "ubnt", Suboptions: []VendorSuboption{{Code: 1, String: "x", IP: "192.168.42.2"}}}},
+		{"too long", VendorOption{VendorClass: "ubnt", Suboptions: []VendorSuboption{{Code: 1, String: strings.Repeat("x", 254)}}}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := &Config{VendorOptions: []VendorOption{tt.opt}}
+			if _, err := cfg.vendorOptions(); err == nil {
+				t.Fatalf("vendorOptions(%+v) unexpectedly succeeded", tt.opt)
+			}
+		})
+	}
+}
+
+func TestWPAD(t *testing.T) {
+	b, err := (&Config{WPAD: "http://wpad.lan/wpad.dat"}).wpad()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "http://wpad.lan/wpad.dat"; got != want {
+		t.Errorf("unexpected option 252 payload: got %q, want %q", got, want)
+	}
+	for _, u := range []string{"wpad.lan/wpad.dat", "ftp://wpad.lan/wpad.dat", "http:///wpad.dat"} {
+		if _, err := (&Config{WPAD: u}).wpad(); err == nil {
+			t.Errorf("wpad(%q) unexpectedly succeeded", u)
+		}
+	}
+}
+
+func TestGateways(t *testing.T) {
+	pools, err := (&Config{}).pools("192.168.42.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := (&Config{
+		Gateways: []Gateway{
+			{Router: "192.168.42.2", HardwareAddrs: []string{"00:1F:16:12:34:56"}, Groups: []string{"vpn"}},
+			{Router: "192.168.42.3", Groups: []string{"guests"}},
+		},
+	}).gateways(pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gw.byHardwareAddr["00:1f:16:12:34:56"], (net.IP{192, 168, 42, 2}); !got.Equal(want) {
+		t.Errorf("unexpected gateway by hardware address: got %v, want %v", got, want)
+	}
+	if got, want := gw.byGroup["guests"], (net.IP{192, 168, 42, 3}); !got.Equal(want) {
+		t.Errorf("unexpected gateway by group: got %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		gw   Gateway
+	}{
+		{"no router", Gateway{HardwareAddrs: []string{"00:1f:16:12:34:56"}}},
+		{"router outside subnets", Gateway{Router: "10.0.0.1", Groups: []string{"vpn"}}},
+		{"no clients", Gateway{Router: "192.168.42.2"}},
+		{"malformed hardware address", Gateway{Router: "192.168.42.2", HardwareAddrs: []string{"00:1f"}}},
+		{"empty group", Gateway{Router: "192.168.42.2", Groups: []string{""}}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := &Config{Gateways: []Gateway{tt.gw}}
+			if _, err := cfg.gateways(pools); err == nil {
+				t.Fatalf("gateways(%+v) unexpectedly succeeded", tt.gw)
+			}
+		})
+	}
+
+	cfg := &Config{Gateways: []Gateway{
+		{Router: "192.168.42.2", Groups: []string{"vpn"}},
+		{Router: "192.168.42.3", Groups: []string{"vpn"}},
+	}}
+	if _, err := cfg.gateways(pools); err == nil {
+		t.Errorf("gateways with duplicate group unexpectedly succeeded")
+	}
+}
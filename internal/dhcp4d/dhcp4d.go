@@ -16,12 +16,17 @@
 package dhcp4d
 
 import (
+	"fmt"
+	"hash/fnv"
 	"log"
 	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/rtr7/router7/internal/devices"
 	"github.com/rtr7/router7/internal/netconfig"
 
 	"github.com/google/gopacket"
@@ -31,9 +36,10 @@ import (
 )
 
 type Lease struct {
-	Num              int       `json:"num"` // relative to Handler.start
+	Num              int       `json:"num"` // index into the address pools of Handler
 	Addr             net.IP    `json:"addr"`
 	HardwareAddr     string    `json:"hardware_addr"`
+	ClientID         string    `json:"client_id,omitempty"` // option 61, e.g. “01:aa:bb:cc:dd:ee:ff”
 	Hostname         string    `json:"hostname"`
 	HostnameOverride string    `json:"hostname_override"`
 	Expiry           time.Time `json:"expiry"`
@@ -43,25 +49,91 @@ func (l *Lease) Expired(at time.Time) bool {
 	return !l.Expiry.IsZero() && at.After(l.Expiry)
 }
 
+// ownedBy returns whether l belongs to the client with the specified client
+// identifier (empty if none was sent) and hardware address. Leases of clients
+// which send a client identifier belong to that identifier instead of the
+// hardware address, which might change (e.g. MAC address randomization) or be
+// the address of a relay. Leases without client identifier (e.g. created
+// before client identifiers were supported, or imported static leases) belong
+// to the hardware address.
+func (l *Lease) ownedBy(clientID, hwaddr string) bool {
+	if l.ClientID != "" && clientID != "" {
+		return l.ClientID == clientID
+	}
+	return l.HardwareAddr == hwaddr
+}
+
+// clientID formats the client identifier option b like a hardware address.
+func clientID(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// optionWPAD is the (unofficial, but widely supported) option for the Web Proxy
+// Auto-Discovery Protocol, carrying the URL of a proxy auto-configuration file.
+const optionWPAD dhcp4.OptionCode = 252
+
 type Handler struct {
 	serverIP    net.IP
-	start       net.IP // first IP address to hand out
-	leaseRange  int    // number of IP addresses to hand out
+	lanAddr     string   // e.g. 192.168.42.1/24
+	pools       []*pool  // LAN interface subnet first, then shared networks
+	addrPools   []*pool  // subnets of further LAN interface addresses
+	addrs       []net.IP // further LAN interface addresses, see SetInterfaceAddrs
+	leaseRange  int      // number of IP addresses to hand out
+	hashAlloc   bool     // derive addresses from a hash of the client
+	vendor      []vendorOption
+	gateways    *gateways
 	leasePeriod time.Duration
 	options     dhcp4.Options
+	leasesMu    sync.Mutex     // guards leasesHW and leasesIP once serving
 	leasesHW    map[string]int // points into leasesIP
+	leasesID    map[string]int // by client identifier, points into leasesIP
 	leasesIP    map[int]*Lease
 	rawConn     net.PacketConn
 	iface       *net.Interface
 
+	devicesMu sync.Mutex
+	devices   *devices.Registry
+
 	timeNow func() time.Time
 
 	// Leases is called whenever a new lease is handed out
 	Leases func([]*Lease, *Lease)
+
+	// Served is called for each request with the message type of the
+	// request and of the reply (0 if no reply was sent), e.g. for metrics.
+	Served func(req, reply dhcp4.MessageType)
+
+	// Transactions, if non-nil, retains the most recent requests and replies
+	// for debugging.
+	Transactions *TransactionLog
+
+	// DryRun, if true, makes the handler log the replies it would send
+	// instead of sending them, e.g. to validate the configuration on a
+	// network which is still served by another DHCP server.
+	DryRun bool
+
+	// IgnoreBroadcastFlag, if true, makes the handler send offers and
+	// acknowledgements to the client’s hardware address even if the client
+	// set the broadcast flag, for clients which set it although they can
+	// receive unicast replies (broadcasts are unreliable on e.g. Wi-Fi).
+	IgnoreBroadcastFlag bool
 }
 
 func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.PacketConn) (*Handler, error) {
-	serverIP, err := netconfig.LinkAddress(dir, ifaceName)
+	details, err := netconfig.Interface(dir, ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := (&Config{}).pools(details.Addr)
+	if err != nil {
+		return nil, err
+	}
+	p := pools[0]
+	serverIP, _, err := net.ParseCIDR(details.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -78,21 +150,20 @@ func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.Pac
 		}
 	}
 	serverIP = serverIP.To4()
-	start := make(net.IP, len(serverIP))
-	copy(start, serverIP)
-	start[len(start)-1] += 1
 	return &Handler{
 		rawConn:     conn,
 		iface:       iface,
 		leasesHW:    make(map[string]int),
+		leasesID:    make(map[string]int),
 		leasesIP:    make(map[int]*Lease),
 		serverIP:    serverIP,
-		start:       start,
-		leaseRange:  230,
+		lanAddr:     details.Addr,
+		pools:       pools,
+		leaseRange:  p.size,
 		leasePeriod: 2 * time.Hour,
 		options: dhcp4.Options{
-			dhcp4.OptionSubnetMask:       []byte{255, 255, 255, 0},
-			dhcp4.OptionRouter:           []byte(serverIP),
+			dhcp4.OptionSubnetMask:       []byte(p.mask),
+			dhcp4.OptionRouter:           []byte(p.router),
 			dhcp4.OptionDomainNameServer: []byte(serverIP),
 			dhcp4.OptionDomainName:       []byte("lan"),
 			dhcp4.OptionDomainSearch:     []byte{0x03, 'l', 'a', 'n', 0x00},
@@ -101,52 +172,440 @@ func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.Pac
 	}, nil
 }
 
+// SetConfig validates cfg against the LAN interface address and configures the
+// served subnet, router, address pool, shared networks, WPAD URL,
+// vendor-specific options and gateway overrides accordingly.
+// There is no locking, so SetConfig must be called before SetLeases and
+// Serve.
+func (h *Handler) SetConfig(cfg *Config) error {
+	pools, err := cfg.pools(h.lanAddr)
+	if err != nil {
+		return err
+	}
+	p := pools[0]
+	vendor, err := cfg.vendorOptions()
+	if err != nil {
+		return err
+	}
+	wpad, err := cfg.wpad()
+	if err != nil {
+		return err
+	}
+	hashAllocation, err := cfg.hashAllocation()
+	if err != nil {
+		return err
+	}
+	gateways, err := cfg.gateways(pools)
+	if err != nil {
+		return err
+	}
+	h.vendor = vendor
+	h.gateways = gateways
+	h.hashAlloc = hashAllocation
+	h.pools = pools
+	last := pools[len(pools)-1]
+	h.leaseRange = last.offset + last.size
+	h.options[dhcp4.OptionSubnetMask] = []byte(p.mask)
+	h.options[dhcp4.OptionRouter] = []byte(p.router)
+	if wpad != nil {
+		h.options[optionWPAD] = wpad
+	} else {
+		delete(h.options, optionWPAD)
+	}
+	return nil
+}
+
+// gateway returns the default gateway configured for the client with
+// hardware address hwaddr (directly or via its device group), if any.
+func (h *Handler) gateway(hwaddr string) net.IP {
+	if h.gateways == nil {
+		return nil
+	}
+	if router, ok := h.gateways.byHardwareAddr[hwaddr]; ok {
+		return router
+	}
+	if d, ok := h.device(hwaddr); ok && d.Group != "" {
+		return h.gateways.byGroup[d.Group]
+	}
+	return nil
+}
+
+// replyOptions returns the options to send in reply to a request of the
+// client with hardware address hwaddr with the specified options for an
+// address of pool p, in the order requested by the client.
+func (h *Handler) replyOptions(p *pool, hwaddr string, options dhcp4.Options) []dhcp4.Option {
+	opts := h.options
+	override := make(dhcp4.Options)
+	if p != h.pools[0] {
+		override[dhcp4.OptionSubnetMask] = []byte(p.mask)
+		override[dhcp4.OptionRouter] = []byte(p.router)
+	}
+	if router := h.gateway(hwaddr); router != nil && p.subnet.Contains(router) {
+		override[dhcp4.OptionRouter] = []byte(router)
+	}
+	if serverIP := h.serverIPFor(p); !serverIP.Equal(h.serverIP) {
+		override[dhcp4.OptionDomainNameServer] = []byte(serverIP)
+		if _, ok := h.options[dhcp4.OptionNetworkTimeProtocolServers]; ok {
+			override[dhcp4.OptionNetworkTimeProtocolServers] = []byte(serverIP)
+		}
+	}
+	if class := string(options[dhcp4.OptionVendorClassIdentifier]); class != "" {
+		for _, v := range h.vendor {
+			if !strings.HasPrefix(class, v.class) {
+				continue
+			}
+			override[dhcp4.OptionVendorSpecificInformation] = v.payload
+			break
+		}
+	}
+	if len(override) > 0 {
+		opts = make(dhcp4.Options, len(h.options)+len(override))
+		for code, val := range h.options {
+			opts[code] = val
+		}
+		for code, val := range override {
+			opts[code] = val
+		}
+	}
+	reply := opts.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+	if id, ok := options[dhcp4.OptionClientIdentifier]; ok {
+		// Servers must echo the client identifier, see RFC 6842.
+		reply = append(reply, dhcp4.Option{
+			Code:  dhcp4.OptionClientIdentifier,
+			Value: id,
+		})
+	}
+	return reply
+}
+
+// poolOf returns the pool containing lease number num, or nil if num is
+// outside of the pools (e.g. a static lease).
+func (h *Handler) poolOf(num int) *pool {
+	for _, p := range h.pools {
+		if p.contains(num) {
+			return p
+		}
+	}
+	return nil
+}
+
+// num returns the lease number of ip. Addresses outside of the pools are
+// numbered relative to the first pool, skipping the numbers of the other
+// pools, so that lease numbers stay unique.
+func (h *Handler) num(ip net.IP) int {
+	for _, p := range h.pools {
+		if num := dhcp4.IPRange(p.start, ip) - 1; num >= 0 && num < p.size {
+			return p.offset + num
+		}
+	}
+	primary := h.pools[0]
+	num := dhcp4.IPRange(primary.start, ip) - 1
+	if num >= primary.size {
+		num += h.leaseRange - primary.size
+	}
+	return num
+}
+
+// addr returns the address of lease number num, see num.
+func (h *Handler) addr(num int) net.IP {
+	if p := h.poolOf(num); p != nil {
+		return dhcp4.IPAdd(p.start, num-p.offset)
+	}
+	primary := h.pools[0]
+	if num >= h.leaseRange {
+		num -= h.leaseRange - primary.size
+	}
+	return dhcp4.IPAdd(primary.start, num)
+}
+
+// subnetPool returns the pool whose subnet contains ip, defaulting to the
+// pool of the LAN interface subnet. Subnets of further LAN interface
+// addresses count as (empty) pools, so that e.g. static leases within them
+// are served with their subnet mask and router.
+func (h *Handler) subnetPool(ip net.IP) *pool {
+	for _, p := range h.pools {
+		if p.subnet.Contains(ip) {
+			return p
+		}
+	}
+	for _, p := range h.addrPools {
+		if p.subnet.Contains(ip) {
+			return p
+		}
+	}
+	return h.pools[0]
+}
+
+// SetInterfaceAddrs configures the addresses of the LAN interface, as
+// returned by net.Interface.Addrs. If the LAN interface carries more than one
+// IPv4 address (e.g. while migrating to another subnet, or for a secondary
+// subnet), clients are served with the address within the subnet of their
+// pool as server identifier, DNS and NTP server.
+func (h *Handler) SetInterfaceAddrs(addrs []net.Addr) {
+	var (
+		ips   []net.IP
+		pools []*pool
+	)
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP.To4()
+		if ip == nil || ip.Equal(h.serverIP) {
+			continue
+		}
+		ips = append(ips, ip)
+		mask := ipnet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		pools = append(pools, &pool{
+			subnet: &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			mask:   mask,
+			router: ip,
+		})
+	}
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	h.addrs = ips
+	h.addrPools = pools
+}
+
+// serverIPFor returns the address of the LAN interface within the subnet of
+// p, defaulting to the configured LAN interface address.
+func (h *Handler) serverIPFor(p *pool) net.IP {
+	if p == nil || p.subnet.Contains(h.serverIP) {
+		return h.serverIP
+	}
+	for _, ip := range h.addrs {
+		if p.subnet.Contains(ip) {
+			return ip
+		}
+	}
+	return h.serverIP
+}
+
+// ownAddr returns whether ip is an address of the LAN interface.
+func (h *Handler) ownAddr(ip net.IP) bool {
+	if ip.Equal(h.serverIP) {
+		return true
+	}
+	for _, a := range h.addrs {
+		if ip.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// eligible returns whether new leases for a client of the specified vendor
+// class (option 60), relayed via giaddr (zero if not relayed), may be handed
+// out from p.
+func (p *pool) eligible(giaddr net.IP, class string) bool {
+	if giaddr != nil && !giaddr.Equal(net.IPv4zero) && !p.subnet.Contains(giaddr) {
+		return false
+	}
+	if len(p.classes) == 0 {
+		return true
+	}
+	for _, prefix := range p.classes {
+		if strings.HasPrefix(class, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidatePools returns the pools from which new leases for a client may be
+// handed out, in order of preference: pools restricted to the client’s vendor
+// class come first.
+func (h *Handler) candidatePools(giaddr net.IP, class string) []*pool {
+	var restricted, unrestricted []*pool
+	for _, p := range h.pools {
+		if !p.eligible(giaddr, class) {
+			continue
+		}
+		if len(p.classes) > 0 {
+			restricted = append(restricted, p)
+		} else {
+			unrestricted = append(unrestricted, p)
+		}
+	}
+	return append(restricted, unrestricted...)
+}
+
+// excludedNum returns whether the address of lease number num must not be
+// handed out dynamically.
+func (h *Handler) excludedNum(num int) bool {
+	p := h.poolOf(num)
+	if p == nil {
+		return false
+	}
+	ip := h.addr(num)
+	for _, r := range p.excluded {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdvertiseNTP makes h advertise its own address as NTP server (option 42),
+// for LAN clients to synchronize with ntpd.
+func (h *Handler) AdvertiseNTP() {
+	h.options[dhcp4.OptionNetworkTimeProtocolServers] = []byte(h.serverIP)
+}
+
+// SetDomains makes h advertise domains[0] as domain name (option 15) and all
+// domains as domain search list (option 119, RFC 3397), e.g. “home.arpa” and
+// “lan”. There is no locking, so SetDomains must be called before Serve.
+func (h *Handler) SetDomains(domains []string) error {
+	if len(domains) == 0 {
+		return fmt.Errorf("no domains specified")
+	}
+	search, err := encodeDomainSearch(domains)
+	if err != nil {
+		return err
+	}
+	h.options[dhcp4.OptionDomainName] = []byte(strings.Trim(domains[0], "."))
+	h.options[dhcp4.OptionDomainSearch] = search
+	return nil
+}
+
+// encodeDomainSearch encodes domains in DNS wire format (without compression),
+// e.g. “lan” as 0x03 'l' 'a' 'n' 0x00.
+func encodeDomainSearch(domains []string) ([]byte, error) {
+	var b []byte
+	for _, domain := range domains {
+		for _, label := range strings.Split(strings.Trim(domain, "."), ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain %q", domain)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	if len(b) > 255 {
+		return nil, fmt.Errorf("domain search list too long (%d bytes, max 255)", len(b))
+	}
+	return b, nil
+}
+
+// SetDevices makes h name clients after their device registry entry, if any,
+// regardless of the hostname they send.
+func (h *Handler) SetDevices(r *devices.Registry) {
+	h.devicesMu.Lock()
+	defer h.devicesMu.Unlock()
+	h.devices = r
+}
+
+func (h *Handler) device(hwaddr string) (*devices.Device, bool) {
+	h.devicesMu.Lock()
+	defer h.devicesMu.Unlock()
+	return h.devices.Lookup(hwaddr)
+}
+
 // SetLeases overwrites the leases database with the specified leases, typically
 // loaded from persistent storage. There is no locking, so SetLeases must be
 // called before Serve.
 func (h *Handler) SetLeases(leases []*Lease) {
 	h.leasesHW = make(map[string]int)
+	h.leasesID = make(map[string]int)
 	h.leasesIP = make(map[int]*Lease)
 	for _, l := range leases {
+		// The lease number depends on the pools, which might have been
+		// re-configured since the lease was persisted.
+		l.Num = h.num(l.Addr)
 		h.leasesHW[l.HardwareAddr] = l.Num
+		if l.ClientID != "" {
+			h.leasesID[l.ClientID] = l.Num
+		}
 		h.leasesIP[l.Num] = l
 	}
 }
 
-func (h *Handler) findLease() int {
+// findLease returns a free lease number for the client identified by key (its
+// client identifier, or its hardware address if it did not send one) within
+// the first of pools which has a free address.
+func (h *Handler) findLease(key string, pools []*pool) int {
+	if len(h.leasesIP) >= h.leaseRange {
+		return -1
+	}
+	for _, p := range pools {
+		if num := h.findLeaseIn(key, p); num != -1 {
+			return num
+		}
+	}
+	return -1
+}
+
+func (h *Handler) findLeaseIn(key string, p *pool) int {
 	now := h.timeNow()
-	if len(h.leasesIP) < h.leaseRange {
-		// TODO: hash the hwaddr like dnsmasq
-		i := rand.Intn(h.leaseRange)
-		if l, ok := h.leasesIP[i]; !ok || l.Expired(now) {
-			return i
-		}
-		for i := 0; i < h.leaseRange; i++ {
-			if l, ok := h.leasesIP[i]; !ok || l.Expired(now) {
-				return i
+	free := func(i int) bool {
+		num := p.offset + i
+		l, ok := h.leasesIP[num]
+		return (!ok || l.Expired(now)) && !h.excludedNum(num)
+	}
+	if h.hashAlloc {
+		// Like dnsmasq, derive the address from the client so that it is
+		// stable across losing the leases database, probing the following
+		// addresses on collision.
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		start := int(hash.Sum32() % uint32(p.size))
+		for j := 0; j < p.size; j++ {
+			if i := (start + j) % p.size; free(i) {
+				return p.offset + i
 			}
 		}
+		return -1
+	}
+	i := rand.Intn(p.size)
+	if free(i) {
+		return p.offset + i
+	}
+	for i := 0; i < p.size; i++ {
+		if free(i) {
+			return p.offset + i
+		}
 	}
 	return -1
 }
 
-func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
+// canLease returns the lease number of reqIP if the client may use it, or -1
+// otherwise. pools are the pools from which the client may obtain new leases.
+func (h *Handler) canLease(reqIP net.IP, clientID, hwaddr string, pools []*pool) int {
 	if len(reqIP) != 4 || reqIP.Equal(net.IPv4zero) {
 		return -1
 	}
 
-	leaseNum := dhcp4.IPRange(h.start, reqIP) - 1
-	if leaseNum < 0 || leaseNum >= h.leaseRange {
+	leaseNum := h.num(reqIP)
+	p := h.poolOf(leaseNum)
+	if p == nil {
 		return -1
 	}
 
 	l, ok := h.leasesIP[leaseNum]
-	if !ok {
-		return leaseNum // lease available
+	if ok && l.ownedBy(clientID, hwaddr) {
+		return leaseNum // lease already owned by requestor
 	}
 
-	if l.HardwareAddr == hwaddr {
-		return leaseNum // lease already owned by requestor
+	eligible := false
+	for _, c := range pools {
+		eligible = eligible || c == p
+	}
+	if !eligible {
+		return -1 // pool not available to the client
+	}
+
+	if h.excludedNum(leaseNum) {
+		return -1 // address excluded from the pool
+	}
+
+	if !ok {
+		return leaseNum // lease available
 	}
 
 	if l.Expired(h.timeNow()) {
@@ -157,8 +616,21 @@ func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
 }
 
 func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	received := h.timeNow()
+	h.leasesMu.Lock()
 	reply := h.serveDHCP(p, msgType, options)
+	h.leasesMu.Unlock()
+	if h.Served != nil {
+		var replyType dhcp4.MessageType
+		if reply != nil {
+			if t := reply.ParseOptions()[dhcp4.OptionDHCPMessageType]; len(t) == 1 {
+				replyType = dhcp4.MessageType(t[0])
+			}
+		}
+		h.Served(msgType, replyType)
+	}
 	if reply == nil {
+		h.recordTransaction(received, p, nil)
 		return nil // unsupported request
 	}
 	buf := gopacket.NewSerializeBuffer()
@@ -168,7 +640,11 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 	}
 	destMAC := p.CHAddr()
 	destIP := reply.YIAddr()
-	if p.Broadcast() {
+	if msgType == dhcp4.Inform {
+		// The client already has an address, see RFC 2131, section 4.3.5.
+		destIP = p.CIAddr()
+	}
+	if p.Broadcast() && (!h.IgnoreBroadcastFlag || destIP.Equal(net.IPv4zero)) {
 		destMAC = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 		destIP = net.IPv4bcast
 	}
@@ -178,10 +654,16 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		EthernetType: layers.EthernetTypeIPv4,
 	}
 
+	// Send from the address used as server identifier, which depends on the
+	// subnet of the client, see SetInterfaceAddrs.
+	srcIP := h.serverIP
+	if id := reply.ParseOptions()[dhcp4.OptionServerIdentifier]; len(id) == net.IPv4len {
+		srcIP = net.IP(id)
+	}
 	ip := &layers.IPv4{
 		Version:  4,
 		TTL:      255,
-		SrcIP:    h.serverIP,
+		SrcIP:    srcIP,
 		DstIP:    destIP,
 		Protocol: layers.IPProtocolUDP,
 		Flags:    layers.IPv4DontFragment,
@@ -197,13 +679,34 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		udp,
 		gopacket.Payload(reply))
 
-	if _, err := h.rawConn.WriteTo(buf.Bytes(), &raw.Addr{destMAC}); err != nil {
+	if h.DryRun {
+		h.logDryRun(msgType, p, reply)
+	} else if _, err := h.rawConn.WriteTo(buf.Bytes(), &raw.Addr{destMAC}); err != nil {
 		log.Printf("WriteTo: %v", err)
 	}
+	h.recordTransaction(received, p, buf.Bytes())
 
 	return nil
 }
 
+// PoolUsage returns the number of non-expired leases within the address pool
+// and the number of addresses in the pool (excluded addresses do not count).
+func (h *Handler) PoolUsage() (used, size int) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	now := h.timeNow()
+	for num := 0; num < h.leaseRange; num++ {
+		if h.excludedNum(num) {
+			continue
+		}
+		size++
+		if l, ok := h.leasesIP[num]; ok && !l.Expired(now) {
+			used++
+		}
+	}
+	return used, size
+}
+
 func (h *Handler) leaseHW(hwAddr string) (*Lease, bool) {
 	num, ok := h.leasesHW[hwAddr]
 	if !ok {
@@ -213,6 +716,22 @@ func (h *Handler) leaseHW(hwAddr string) (*Lease, bool) {
 	return l, ok && l.HardwareAddr == hwAddr
 }
 
+// leaseClient returns the lease of the client with the specified client
+// identifier (empty if none was sent) and hardware address. Leases of the
+// hardware address without client identifier are returned, too, so that
+// clients keep their address once they are identified by client identifier.
+func (h *Handler) leaseClient(clientID, hwAddr string) (*Lease, bool) {
+	if clientID != "" {
+		if num, ok := h.leasesID[clientID]; ok {
+			if l, ok := h.leasesIP[num]; ok && l.ClientID == clientID {
+				return l, true
+			}
+		}
+	}
+	l, ok := h.leaseHW(hwAddr)
+	return l, ok && l.ownedBy(clientID, hwAddr)
+}
+
 // TODO: is ServeDHCP always run from the same goroutine, or do we need locking?
 func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
 	reqIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
@@ -220,6 +739,9 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		reqIP = net.IP(p.CIAddr())
 	}
 
+	id := clientID(options[dhcp4.OptionClientIdentifier])
+	pools := h.candidatePools(p.GIAddr(), string(options[dhcp4.OptionVendorClassIdentifier]))
+
 	switch msgType {
 	case dhcp4.Discover:
 		free := -1
@@ -227,18 +749,22 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 
 		// try to offer the requested IP, if any and available
 		if !reqIP.To4().Equal(net.IPv4zero) {
-			free = h.canLease(reqIP, hwAddr)
+			free = h.canLease(reqIP, id, hwAddr, pools)
 			//log.Printf("canLease(%v, %s) = %d", reqIP, hwAddr, free)
 		}
 
-		// offer previous lease for this HardwareAddr, if any
-		if lease, ok := h.leaseHW(hwAddr); ok && !lease.Expired(h.timeNow()) {
+		// offer previous lease for this client, if any
+		if lease, ok := h.leaseClient(id, hwAddr); ok && !lease.Expired(h.timeNow()) {
 			free = lease.Num
 			//log.Printf("h.leasesHW[%s] = %d", hwAddr, free)
 		}
 
 		if free == -1 {
-			free = h.findLease()
+			key := id
+			if key == "" {
+				key = hwAddr
+			}
+			free = h.findLease(key, pools)
 			//log.Printf("findLease = %d", free)
 		}
 
@@ -247,32 +773,42 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 			return nil // no free leases
 		}
 
+		leasePool := h.poolOf(free)
+		if leasePool == nil {
+			leasePool = h.subnetPool(h.addr(free)) // static lease
+		}
 		return dhcp4.ReplyPacket(p,
 			dhcp4.Offer,
-			h.serverIP,
-			dhcp4.IPAdd(h.start, free),
+			h.serverIPFor(leasePool),
+			h.addr(free),
 			h.leasePeriod,
-			h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+			h.replyOptions(leasePool, hwAddr, options))
 
 	case dhcp4.Request:
-		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP) {
+		server, ok := options[dhcp4.OptionServerIdentifier]
+		if ok && !h.ownAddr(net.IP(server)) {
 			return nil // message not for this dhcp server
 		}
-		leaseNum := h.canLease(reqIP, p.CHAddr().String())
+		serverIP := h.serverIPFor(h.subnetPool(reqIP))
+		if ok {
+			serverIP = net.IP(server) // selected by the client
+		}
+		leaseNum := h.canLease(reqIP, id, p.CHAddr().String(), pools)
 		if leaseNum == -1 {
-			return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP, nil, 0, nil)
+			return dhcp4.ReplyPacket(p, dhcp4.NAK, serverIP, nil, 0, nil)
 		}
 
 		lease := &Lease{
 			Num:          leaseNum,
 			Addr:         make([]byte, 4),
 			HardwareAddr: p.CHAddr().String(),
+			ClientID:     id,
 			Expiry:       h.timeNow().Add(h.leasePeriod),
 			Hostname:     string(options[dhcp4.OptionHostName]),
 		}
 		copy(lease.Addr, reqIP.To4())
 
-		if l, ok := h.leaseHW(lease.HardwareAddr); ok {
+		if l, ok := h.leaseClient(id, lease.HardwareAddr); ok {
 			if l.Expiry.IsZero() {
 				// Retain permanent lease properties
 				lease.Expiry = time.Time{}
@@ -287,8 +823,16 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 			delete(h.leasesIP, l.Num)
 		}
 
+		if d, ok := h.device(lease.HardwareAddr); ok && d.Name != "" {
+			lease.Hostname = d.Name
+			lease.HostnameOverride = d.Name
+		}
+
 		h.leasesIP[leaseNum] = lease
 		h.leasesHW[lease.HardwareAddr] = leaseNum
+		if id != "" {
+			h.leasesID[id] = leaseNum
+		}
 		if h.Leases != nil {
 			var leases []*Lease
 			for _, l := range h.leasesIP {
@@ -296,8 +840,38 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 			}
 			h.Leases(leases, lease)
 		}
-		return dhcp4.ReplyPacket(p, dhcp4.ACK, h.serverIP, reqIP, h.leasePeriod,
-			h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+		return dhcp4.ReplyPacket(p, dhcp4.ACK, serverIP, reqIP, h.leasePeriod,
+			h.replyOptions(h.poolOf(leaseNum), lease.HardwareAddr, options))
+
+	case dhcp4.Inform:
+		// The client obtained its address elsewhere (e.g. static
+		// configuration) and only asks for configuration parameters, so no
+		// lease is allocated and neither yiaddr nor a lease time are sent.
+		if p.CIAddr().To4().Equal(net.IPv4zero) {
+			return nil // RFC 2131: ciaddr must be set
+		}
+		pool := h.subnetPool(p.CIAddr())
+		return dhcp4.ReplyPacket(p, dhcp4.ACK, h.serverIPFor(pool), net.IPv4zero, 0,
+			h.replyOptions(pool, p.CHAddr().String(), options))
 	}
 	return nil
 }
+
+var messageTypes = map[dhcp4.MessageType]string{
+	dhcp4.Discover: "DISCOVER",
+	dhcp4.Offer:    "OFFER",
+	dhcp4.Request:  "REQUEST",
+	dhcp4.Decline:  "DECLINE",
+	dhcp4.ACK:      "ACK",
+	dhcp4.NAK:      "NAK",
+	dhcp4.Release:  "RELEASE",
+	dhcp4.Inform:   "INFORM",
+}
+
+// MessageTypeName returns the name of t (e.g. DISCOVER), or “unknown”.
+func MessageTypeName(t dhcp4.MessageType) string {
+	if name, ok := messageTypes[t]; ok {
+		return name
+	}
+	return "unknown"
+}
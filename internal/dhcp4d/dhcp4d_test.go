@@ -24,6 +24,8 @@ import (
 	"time"
 
 	"github.com/krolaw/dhcp4"
+
+	"github.com/rtr7/router7/internal/devices"
 )
 
 func messageType(p dhcp4.Packet) dhcp4.MessageType {
@@ -456,3 +458,694 @@ func TestPersistentStorage(t *testing.T) {
 		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
 	}
 }
+
+func TestAdvertiseNTP(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	ntpRequested := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionNetworkTimeProtocolServers)},
+	}
+
+	p := discover(net.IPv4zero, hardwareAddr, ntpRequested)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, ok := resp.ParseOptions()[dhcp4.OptionNetworkTimeProtocolServers]; ok {
+		t.Errorf("DHCPOFFER unexpectedly contains NTP servers %v", net.IP(got))
+	}
+
+	handler.AdvertiseNTP()
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	want := net.IP{192, 168, 42, 1}
+	if got := resp.ParseOptions()[dhcp4.OptionNetworkTimeProtocolServers]; !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER: unexpected NTP servers: got %v, want %v", net.IP(got), want)
+	}
+}
+
+func TestSetDomains(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetDomains([]string{"home.arpa", "lan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	domainRequested := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionDomainName), byte(dhcp4.OptionDomainSearch)},
+	}
+	p := discover(net.IPv4zero, hardwareAddr, domainRequested)
+	opts := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()).ParseOptions()
+	if got, want := string(opts[dhcp4.OptionDomainName]), "home.arpa"; got != want {
+		t.Errorf("DHCPOFFER: unexpected domain name: got %q, want %q", got, want)
+	}
+	want := []byte{
+		0x04, 'h', 'o', 'm', 'e', 0x04, 'a', 'r', 'p', 'a', 0x00,
+		0x03, 'l', 'a', 'n', 0x00,
+	}
+	if got := opts[dhcp4.OptionDomainSearch]; !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER: unexpected domain search list: got %x, want %x", got, want)
+	}
+
+	if err := handler.SetDomains([]string{"home..arpa"}); err == nil {
+		t.Errorf("SetDomains(home..arpa) unexpectedly succeeded")
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	tmpdir, err := ioutil.TempDir("", "dhcp4dtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	const registry = `{"devices": [{"hardware_addr": "11:22:33:44:55:66", "name": "midna"}]}`
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "devices.json"), []byte(registry), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := devices.Read(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetDevices(r)
+
+	var latest *Lease
+	handler.Leases = func(leases []*Lease, l *Lease) {
+		latest = l
+	}
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	p := request(net.IP{192, 168, 42, 23}, hardwareAddr, dhcp4.Option{
+		Code:  dhcp4.OptionHostName,
+		Value: []byte("android-23"),
+	})
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in wrong message type: got %v, want %v", got, want)
+	}
+	if latest == nil {
+		t.Fatalf("leases callback not called")
+	}
+	if got, want := latest.Hostname, "midna"; got != want {
+		t.Errorf("unexpected lease.Hostname: got %q, want %q", got, want)
+	}
+}
+
+func TestExcludedAddresses(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(&Config{
+		PoolStart: "192.168.42.100",
+		PoolEnd:   "192.168.42.102",
+		Exclude:   []string{"192.168.42.100-192.168.42.101"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		excluded     = net.IP{192, 168, 42, 100}
+		hardwareAddr = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	)
+
+	p := request(excluded, hardwareAddr)
+	resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST for excluded address resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	p = discover(net.IPv4zero, hardwareAddr)
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), (net.IP{192, 168, 42, 102}); !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
+	}
+
+	// Permanent leases are honored even within excluded ranges.
+	handler.SetLeases([]*Lease{
+		{
+			Addr:         excluded,
+			HardwareAddr: hardwareAddr.String(),
+		},
+	})
+	p = request(excluded, hardwareAddr)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Errorf("DHCPREQUEST for permanent lease resulted in unexpected message type: got %v, want %v", got, want)
+	}
+}
+
+func TestVendorSpecificInformation(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(&Config{
+		VendorOptions: []VendorOption{
+			{
+				VendorClass: "ubnt",
+				Suboptions: []VendorSuboption{
+					{Code: 1, IP: "192.168.42.2"},
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	requested := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionVendorSpecificInformation)},
+	}
+
+	p := discover(net.IPv4zero, hardwareAddr, requested)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, ok := resp.ParseOptions()[dhcp4.OptionVendorSpecificInformation]; ok {
+		t.Errorf("DHCPOFFER for other vendor class unexpectedly contains option 43: %x", got)
+	}
+
+	p = discover(net.IPv4zero, hardwareAddr, requested, dhcp4.Option{
+		Code:  dhcp4.OptionVendorClassIdentifier,
+		Value: []byte("ubnt UAP-AC-Lite"),
+	})
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	want := []byte{1, 4, 192, 168, 42, 2}
+	if got := resp.ParseOptions()[dhcp4.OptionVendorSpecificInformation]; !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER: unexpected option 43: got %x, want %x", got, want)
+	}
+}
+
+func TestGatewayOverride(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	tmpdir, err := ioutil.TempDir("", "dhcp4dtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	const registry = `{"devices": [{"hardware_addr": "11:22:33:44:55:77", "group": "vpn"}]}`
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "devices.json"), []byte(registry), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := devices.Read(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetDevices(r)
+
+	if err := handler.SetConfig(&Config{
+		Gateways: []Gateway{
+			{Router: "192.168.42.2", HardwareAddrs: []string{"11:22:33:44:55:66"}},
+			{Router: "192.168.42.3", Groups: []string{"vpn"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	requested := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionRouter)},
+	}
+	for _, tt := range []struct {
+		desc   string
+		hwaddr net.HardwareAddr
+		want   net.IP
+	}{
+		{"by hardware address", net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}, net.IP{192, 168, 42, 2}},
+		{"by group", net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x77}, net.IP{192, 168, 42, 3}},
+		{"default", net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x88}, net.IP{192, 168, 42, 1}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := discover(net.IPv4zero, tt.hwaddr, requested)
+			offer := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+			if got := net.IP(offer.ParseOptions()[dhcp4.OptionRouter]); !got.Equal(tt.want) {
+				t.Errorf("DHCPOFFER: unexpected router: got %v, want %v", got, tt.want)
+			}
+
+			p = request(offer.YIAddr(), tt.hwaddr, requested)
+			ack := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+			if got, want := messageType(ack), dhcp4.ACK; got != want {
+				t.Fatalf("DHCPREQUEST resulted in wrong message type: got %v, want %v", got, want)
+			}
+			if got := net.IP(ack.ParseOptions()[dhcp4.OptionRouter]); !got.Equal(tt.want) {
+				t.Errorf("DHCPACK: unexpected router: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInform(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	const wpad = "http://wpad.lan/wpad.dat"
+	if err := handler.SetConfig(&Config{WPAD: wpad}); err != nil {
+		t.Fatal(err)
+	}
+	var leased bool
+	handler.Leases = func([]*Lease, *Lease) { leased = true }
+
+	var (
+		addr         = net.IP{192, 168, 42, 42}
+		hardwareAddr = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	)
+	p := packet(dhcp4.Inform, addr, hardwareAddr, []dhcp4.Option{
+		{
+			Code:  dhcp4.OptionParameterRequestList,
+			Value: []byte{byte(dhcp4.OptionSubnetMask), byte(optionWPAD)},
+		},
+	})
+	resp := handler.serveDHCP(p, dhcp4.Inform, p.ParseOptions())
+	if resp == nil {
+		t.Fatalf("DHCPINFORM unexpectedly not answered")
+	}
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Errorf("DHCPINFORM resulted in wrong message type: got %v, want %v", got, want)
+	}
+	if got := resp.YIAddr().To4(); !got.Equal(net.IPv4zero) {
+		t.Errorf("DHCPACK unexpectedly contains yiaddr %v", got)
+	}
+	opts := resp.ParseOptions()
+	if got, ok := opts[dhcp4.OptionIPAddressLeaseTime]; ok {
+		t.Errorf("DHCPACK unexpectedly contains lease time %x", got)
+	}
+	if got, want := string(opts[optionWPAD]), wpad; got != want {
+		t.Errorf("DHCPACK: unexpected WPAD URL: got %q, want %q", got, want)
+	}
+	if got, want := opts[dhcp4.OptionSubnetMask], []byte{255, 255, 255, 0}; !bytes.Equal(got, want) {
+		t.Errorf("DHCPACK: unexpected subnet mask: got %v, want %v", got, want)
+	}
+	if leased {
+		t.Errorf("DHCPINFORM unexpectedly resulted in a lease")
+	}
+}
+
+func TestServedAndPoolUsage(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(&Config{
+		PoolStart: "192.168.42.100",
+		PoolEnd:   "192.168.42.103",
+		Exclude:   []string{"192.168.42.100"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	type served struct{ req, reply dhcp4.MessageType }
+	var got []served
+	handler.Served = func(req, reply dhcp4.MessageType) {
+		got = append(got, served{req, reply})
+	}
+
+	var (
+		addr         = net.IP{192, 168, 42, 101}
+		hardwareAddr = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	)
+	for _, p := range []dhcp4.Packet{
+		discover(addr, hardwareAddr),
+		request(addr, hardwareAddr),
+		request(net.IP{192, 168, 42, 100}, hardwareAddr), // excluded
+		packet(dhcp4.Release, addr, hardwareAddr, nil),
+	} {
+		opts := p.ParseOptions()
+		handler.ServeDHCP(p, dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]), opts)
+	}
+	want := []served{
+		{dhcp4.Discover, dhcp4.Offer},
+		{dhcp4.Request, dhcp4.ACK},
+		{dhcp4.Request, dhcp4.NAK},
+		{dhcp4.Release, 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Served called %d times, want %d", len(got), len(want))
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Errorf("Served call %d: got %v, want %v", idx, got[idx], want[idx])
+		}
+	}
+
+	used, size := handler.PoolUsage()
+	if used != 1 || size != 3 {
+		t.Errorf("PoolUsage() = %d, %d, want 1, 3", used, size)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var (
+		addr          = net.IP{192, 168, 42, 23}
+		hardwareAddr1 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		hardwareAddr2 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x77}
+		clientID      = dhcp4.Option{
+			Code:  dhcp4.OptionClientIdentifier,
+			Value: []byte{0x01, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+		}
+		otherClientID = dhcp4.Option{
+			Code:  dhcp4.OptionClientIdentifier,
+			Value: []byte{0xff, 0x00, 0x00, 0x00, 0x01},
+		}
+	)
+
+	// A lease persisted before client identifiers were supported.
+	handler.SetLeases([]*Lease{
+		{
+			Addr:         addr,
+			HardwareAddr: hardwareAddr1.String(),
+			Expiry:       time.Now().Add(1 * time.Hour),
+		},
+	})
+
+	// The client keeps its address once it sends a client identifier.
+	p := request(addr, hardwareAddr1, clientID)
+	resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	if got, want := resp.ParseOptions()[dhcp4.OptionClientIdentifier], clientID.Value; !bytes.Equal(got, want) {
+		t.Errorf("client identifier not echoed: got %x, want %x", got, want)
+	}
+	l, ok := handler.leaseClient("01:11:22:33:44:55:66", "")
+	if !ok {
+		t.Fatalf("lease not found by client identifier")
+	}
+	if got, want := l.HardwareAddr, hardwareAddr1.String(); got != want {
+		t.Errorf("unexpected lease.HardwareAddr: got %q, want %q", got, want)
+	}
+
+	// The lease belongs to the client identifier, not the hardware address.
+	p = request(net.IPv4zero, hardwareAddr2, clientID)
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), addr.To4(); !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
+	}
+
+	p = request(addr, hardwareAddr1, otherClientID)
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), addr.To4(); bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER for wrong IP: got %v, want anything else", got)
+	}
+}
+
+func TestHashAllocation(t *testing.T) {
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	offer := func(handler *Handler) net.IP {
+		p := discover(net.IPv4zero, hardwareAddr)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		return resp.YIAddr().To4()
+	}
+
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	if err := handler.SetConfig(&Config{Allocation: "sequential"}); err == nil {
+		t.Fatalf("SetConfig unexpectedly accepted an unknown allocation strategy")
+	}
+	if err := handler.SetConfig(&Config{Allocation: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	first := offer(handler)
+
+	// The same address is offered after losing the leases database.
+	handler2, cleanup2 := testHandler(t)
+	defer cleanup2()
+	if err := handler2.SetConfig(&Config{Allocation: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := offer(handler2), first; !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
+	}
+
+	// On collision, the next address is offered.
+	handler2.SetLeases([]*Lease{
+		{
+			Addr:         first,
+			HardwareAddr: "11:22:33:44:55:77",
+			Expiry:       time.Now().Add(1 * time.Hour),
+		},
+	})
+	if got, want := offer(handler2), dhcp4.IPAdd(first, 1).To4(); !bytes.Equal(got, want) {
+		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
+	}
+}
+
+func TestSharedNetworks(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(&Config{
+		SharedNetworks: []SharedNetwork{
+			{
+				Subnet:    "10.0.0.0/24",
+				Router:    "10.0.0.1",
+				PoolStart: "10.0.0.100",
+				PoolEnd:   "10.0.0.109",
+			},
+			{
+				Subnet:        "10.1.0.0/16",
+				Router:        "10.1.0.1",
+				PoolStart:     "10.1.0.100",
+				PoolEnd:       "10.1.0.109",
+				VendorClasses: []string{"ubnt"},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	requested := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask), byte(dhcp4.OptionRouter)},
+	}
+	ubnt := dhcp4.Option{
+		Code:  dhcp4.OptionVendorClassIdentifier,
+		Value: []byte("ubnt UAP-AC-Lite"),
+	}
+	checkReply := func(t *testing.T, resp dhcp4.Packet, wantType dhcp4.MessageType, subnet string, router net.IP) {
+		t.Helper()
+		if got := messageType(resp); got != wantType {
+			t.Fatalf("unexpected message type: got %v, want %v", got, wantType)
+		}
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ipnet.Contains(resp.YIAddr()) {
+			t.Errorf("unexpected address: got %v, want an address in %v", resp.YIAddr(), ipnet)
+		}
+		opts := resp.ParseOptions()
+		if got, want := opts[dhcp4.OptionSubnetMask], []byte(ipnet.Mask); !bytes.Equal(got, want) {
+			t.Errorf("unexpected subnet mask: got %v, want %v", net.IP(got), net.IP(want))
+		}
+		if got, want := opts[dhcp4.OptionRouter], []byte(router); !bytes.Equal(got, want) {
+			t.Errorf("unexpected router: got %v, want %v", net.IP(got), router)
+		}
+	}
+
+	t.Run("default pool", func(t *testing.T) {
+		p := discover(net.IPv4zero, hardwareAddr, requested)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, "192.168.42.0/24", net.IP{192, 168, 42, 1})
+	})
+
+	t.Run("requested address", func(t *testing.T) {
+		addr := net.IP{10, 0, 0, 105}
+		p := discover(addr, hardwareAddr, requested)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, "10.0.0.0/24", net.IP{10, 0, 0, 1})
+
+		p = request(addr, hardwareAddr, requested)
+		resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		checkReply(t, resp, dhcp4.ACK, "10.0.0.0/24", net.IP{10, 0, 0, 1})
+		if got, want := resp.YIAddr().To4(), addr.To4(); !bytes.Equal(got, want) {
+			t.Errorf("DHCPACK for wrong IP: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("vendor class", func(t *testing.T) {
+		hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x77}
+		p := discover(net.IPv4zero, hardwareAddr, requested, ubnt)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, "10.1.0.0/16", net.IP{10, 1, 0, 1})
+
+		// Clients of other vendor classes cannot use the pool.
+		p = request(net.IP{10, 1, 0, 100}, hardwareAddr, requested)
+		resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		if got, want := messageType(resp), dhcp4.NAK; got != want {
+			t.Errorf("unexpected message type: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("relay agent", func(t *testing.T) {
+		hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x88}
+		p := discover(net.IPv4zero, hardwareAddr, requested)
+		p.SetGIAddr(net.IP{10, 0, 0, 1})
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, "10.0.0.0/24", net.IP{10, 0, 0, 1})
+	})
+
+	t.Run("lease numbers", func(t *testing.T) {
+		static := &Lease{
+			Addr:         net.IP{192, 168, 42, 250}, // outside of the pools
+			HardwareAddr: "11:22:33:44:55:99",
+		}
+		dynamic := &Lease{
+			Addr:         net.IP{10, 0, 0, 100},
+			HardwareAddr: "11:22:33:44:55:aa",
+			Expiry:       time.Now().Add(1 * time.Hour),
+		}
+		handler.SetLeases([]*Lease{static, dynamic})
+		if got, want := handler.addr(static.Num), static.Addr; !got.Equal(want) {
+			t.Errorf("static lease: addr(%d) = %v, want %v", static.Num, got, want)
+		}
+		if handler.poolOf(static.Num) != nil {
+			t.Errorf("static lease number %d unexpectedly within a pool", static.Num)
+		}
+		if got, want := handler.addr(dynamic.Num), dynamic.Addr; !got.Equal(want) {
+			t.Errorf("dynamic lease: addr(%d) = %v, want %v", dynamic.Num, got, want)
+		}
+	})
+}
+
+func TestInterfaceAddrs(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(&Config{
+		SharedNetworks: []SharedNetwork{
+			{
+				Subnet:    "10.0.0.0/24",
+				Router:    "10.0.0.1",
+				PoolStart: "10.0.0.100",
+				PoolEnd:   "10.0.0.109",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []net.Addr
+	for _, cidr := range []string{"192.168.42.1/24", "10.0.0.1/24", "172.16.0.1/24", "fe80::1/64"} {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+		addrs = append(addrs, ipnet)
+	}
+	handler.SetInterfaceAddrs(addrs)
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	requested := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask), byte(dhcp4.OptionRouter), byte(dhcp4.OptionDomainNameServer)},
+	}
+	checkReply := func(t *testing.T, resp dhcp4.Packet, wantType dhcp4.MessageType, server, router net.IP, mask net.IPMask) {
+		t.Helper()
+		if got := messageType(resp); got != wantType {
+			t.Fatalf("unexpected message type: got %v, want %v", got, wantType)
+		}
+		opts := resp.ParseOptions()
+		if got := opts[dhcp4.OptionServerIdentifier]; !bytes.Equal(got, server) {
+			t.Errorf("unexpected server identifier: got %v, want %v", net.IP(got), server)
+		}
+		if got := opts[dhcp4.OptionDomainNameServer]; !bytes.Equal(got, server) {
+			t.Errorf("unexpected DNS server: got %v, want %v", net.IP(got), server)
+		}
+		if got := opts[dhcp4.OptionRouter]; !bytes.Equal(got, router) {
+			t.Errorf("unexpected router: got %v, want %v", net.IP(got), router)
+		}
+		if got := opts[dhcp4.OptionSubnetMask]; !bytes.Equal(got, mask) {
+			t.Errorf("unexpected subnet mask: got %v, want %v", net.IP(got), net.IP(mask))
+		}
+	}
+	mask := net.CIDRMask(24, 32)
+
+	t.Run("primary address", func(t *testing.T) {
+		p := discover(net.IPv4zero, hardwareAddr, requested)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 1}, mask)
+	})
+
+	t.Run("shared network", func(t *testing.T) {
+		addr := net.IP{10, 0, 0, 105}
+		p := discover(addr, hardwareAddr, requested)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 1}, mask)
+
+		p = request(addr, hardwareAddr, requested, dhcp4.Option{
+			Code:  dhcp4.OptionServerIdentifier,
+			Value: net.IP{10, 0, 0, 1},
+		})
+		resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		checkReply(t, resp, dhcp4.ACK, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 1}, mask)
+
+		// Renewals do not carry a server identifier.
+		p = request(addr, hardwareAddr, requested)
+		resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		checkReply(t, resp, dhcp4.ACK, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 1}, mask)
+	})
+
+	t.Run("static lease in secondary subnet", func(t *testing.T) {
+		hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x77}
+		handler.SetLeases([]*Lease{
+			{
+				Addr:         net.IP{172, 16, 0, 23},
+				HardwareAddr: hardwareAddr.String(),
+			},
+		})
+		p := discover(net.IPv4zero, hardwareAddr, requested)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		checkReply(t, resp, dhcp4.Offer, net.IP{172, 16, 0, 1}, net.IP{172, 16, 0, 1}, mask)
+	})
+
+	t.Run("other server", func(t *testing.T) {
+		p := request(net.IP{10, 0, 0, 105}, hardwareAddr, requested, dhcp4.Option{
+			Code:  dhcp4.OptionServerIdentifier,
+			Value: net.IP{10, 0, 0, 2},
+		})
+		if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); resp != nil {
+			t.Errorf("unexpected reply to a request for another server")
+		}
+	})
+}
+
+type countingSink struct {
+	noopSink
+	writes int
+}
+
+func (s *countingSink) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	s.writes++
+	return len(b), nil
+}
+
+func TestDryRun(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	sink := &countingSink{}
+	handler.rawConn = sink
+	handler.DryRun = true
+
+	hardwareAddr := net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}
+	p := discover(net.IPv4zero, hardwareAddr)
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if sink.writes != 0 {
+		t.Fatalf("dry run: %d packets sent, want none", sink.writes)
+	}
+
+	reply := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	want := "dry run: would reply to DISCOVER from 22:22:22:22:22:22 with OFFER of " + reply.YIAddr().String() + " for 2h0m0s"
+	if got := dryRunMessage(dhcp4.Discover, p, reply); got != want {
+		t.Errorf("dryRunMessage: got %q, want %q", got, want)
+	}
+
+	handler.DryRun = false
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := sink.writes, 1; got != want {
+		t.Errorf("unexpected number of packets sent: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSNames returns the names under which dnsd resolves the non-expired leases
+// at the time now, in the order of leases (empty for expired leases and
+// leases without hostname).
+//
+// When multiple devices claim the same hostname (e.g. “android”), the first
+// lease keeps the hostname and the others are numbered (“android-2”,
+// “android-3”) in a deterministic order which does not change when leases are
+// renewed: overridden hostnames first, then static leases, then by address.
+// Of multiple leases of the same device with the same hostname, only the most
+// recent one is resolvable.
+func DNSNames(leases []*Lease, now time.Time) []string {
+	type claim struct {
+		client   string
+		hostname string
+	}
+	newest := make(map[claim]int)
+	for idx, l := range leases {
+		if l.Expired(now) || l.Hostname == "" {
+			continue
+		}
+		c := claim{l.HardwareAddr, strings.ToLower(l.Hostname)}
+		if l.ClientID != "" {
+			c.client = l.ClientID
+		}
+		if other, ok := newest[c]; ok && !newer(l, leases[other]) {
+			continue
+		}
+		newest[c] = idx
+	}
+	order := make([]int, 0, len(newest))
+	for _, idx := range newest {
+		order = append(order, idx)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := leases[order[i]], leases[order[j]]
+		if (a.HostnameOverride != "") != (b.HostnameOverride != "") {
+			return a.HostnameOverride != ""
+		}
+		if a.Expiry.IsZero() != b.Expiry.IsZero() {
+			return a.Expiry.IsZero()
+		}
+		if c := bytes.Compare(a.Addr.To16(), b.Addr.To16()); c != 0 {
+			return c < 0
+		}
+		if a.HardwareAddr != b.HardwareAddr {
+			return a.HardwareAddr < b.HardwareAddr
+		}
+		return order[i] < order[j]
+	})
+
+	// Hostnames are reserved before numbering, so that a numbered name never
+	// shadows a device which claims e.g. “android-2” itself.
+	taken := make(map[string]bool)
+	for _, idx := range order {
+		taken[strings.ToLower(leases[idx].Hostname)] = true
+	}
+	assigned := make(map[string]bool)
+	names := make([]string, len(leases))
+	for _, idx := range order {
+		hostname := leases[idx].Hostname
+		lower := strings.ToLower(hostname)
+		if !assigned[lower] {
+			assigned[lower] = true
+			names[idx] = hostname
+			continue
+		}
+		for n := 2; ; n++ {
+			suffix := "-" + strconv.Itoa(n)
+			if !taken[lower+suffix] && !assigned[lower+suffix] {
+				assigned[lower+suffix] = true
+				names[idx] = hostname + suffix
+				break
+			}
+		}
+	}
+	return names
+}
+
+// newer returns whether lease a is more recent than lease b. Static leases
+// never expire and hence are the most recent.
+func newer(a, b *Lease) bool {
+	if a.Expiry.IsZero() || b.Expiry.IsZero() {
+		return a.Expiry.IsZero() && !b.Expiry.IsZero()
+	}
+	return a.Expiry.After(b.Expiry)
+}
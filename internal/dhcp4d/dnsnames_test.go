@@ -0,0 +1,75 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDNSNames(t *testing.T) {
+	now := time.Now()
+	lease := func(addr, hwaddr, hostname string, expiry time.Duration) *Lease {
+		l := &Lease{
+			Addr:         net.ParseIP(addr).To4(),
+			HardwareAddr: hwaddr,
+			Hostname:     hostname,
+		}
+		if expiry != 0 {
+			l.Expiry = now.Add(expiry)
+		}
+		return l
+	}
+	leases := []*Lease{
+		lease("192.168.42.30", "02:00:00:00:00:03", "android", 1*time.Hour),
+		lease("192.168.42.20", "02:00:00:00:00:02", "Android", 2*time.Hour),
+		lease("192.168.42.40", "02:00:00:00:00:04", "android", 0),             // static
+		lease("192.168.42.50", "02:00:00:00:00:05", "android-2", 1*time.Hour), // claims the numbered name
+		lease("192.168.42.60", "02:00:00:00:00:06", "android", -1*time.Hour),  // expired
+		lease("192.168.42.70", "02:00:00:00:00:07", "", 1*time.Hour),
+		lease("192.168.42.21", "02:00:00:00:00:02", "android", 1*time.Hour), // older lease of .20
+		lease("192.168.42.80", "02:00:00:00:00:08", "xps", 1*time.Hour),
+	}
+	want := []string{
+		"android-4",
+		"Android-3",
+		"android", // static leases first
+		"android-2",
+		"",
+		"",
+		"",
+		"xps",
+	}
+	got := DNSNames(leases, now)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("DNSNames: unexpected result: diff (-want +got):\n%s", diff)
+	}
+
+	// The result does not depend on the order of leases, nor on renewals.
+	reversed := make([]*Lease, len(leases))
+	for idx, l := range leases {
+		reversed[len(leases)-1-idx] = l
+	}
+	leases[0].Expiry = now.Add(3 * time.Hour)
+	got = DNSNames(reversed, now)
+	for idx := range got {
+		if got[idx] != want[len(want)-1-idx] {
+			t.Fatalf("DNSNames(reversed)[%d] = %q, want %q", idx, got[idx], want[len(want)-1-idx])
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// dryRunMessage describes reply, which ServeDHCP did not send in response to
+// request p of type req.
+func dryRunMessage(req dhcp4.MessageType, p, reply dhcp4.Packet) string {
+	opts := reply.ParseOptions()
+	var replyType dhcp4.MessageType
+	if t := opts[dhcp4.OptionDHCPMessageType]; len(t) == 1 {
+		replyType = dhcp4.MessageType(t[0])
+	}
+	msg := fmt.Sprintf("dry run: would reply to %s from %v", MessageTypeName(req), p.CHAddr())
+	if hostname := p.ParseOptions()[dhcp4.OptionHostName]; len(hostname) > 0 {
+		msg += fmt.Sprintf(" (%s)", hostname)
+	}
+	msg += " with " + MessageTypeName(replyType)
+	if replyType == dhcp4.Offer || replyType == dhcp4.ACK {
+		msg += fmt.Sprintf(" of %v", reply.YIAddr())
+		if lt := opts[dhcp4.OptionIPAddressLeaseTime]; len(lt) == 4 {
+			msg += fmt.Sprintf(" for %v", time.Duration(binary.BigEndian.Uint32(lt))*time.Second)
+		}
+	}
+	return msg
+}
+
+func (h *Handler) logDryRun(req dhcp4.MessageType, p, reply dhcp4.Packet) {
+	log.Print(dryRunMessage(req, p, reply))
+}
@@ -0,0 +1,318 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"unicode"
+)
+
+// StaticHost is a static DHCP assignment imported from another DHCP server’s
+// configuration.
+type StaticHost struct {
+	HardwareAddr string `json:"hardware_addr"`
+	Addr         net.IP `json:"addr"`
+	Hostname     string `json:"hostname"`
+}
+
+// ImportResult is the outcome of parsing a foreign configuration file.
+type ImportResult struct {
+	Hosts []StaticHost `json:"hosts"`
+
+	// Skipped describes configuration entries which cannot be expressed as
+	// router7 static leases (e.g. assignments by client ID or without an IP
+	// address), so that they can be migrated manually.
+	Skipped []string `json:"skipped"`
+}
+
+// ParseDnsmasq parses the dhcp-host lines of a dnsmasq configuration file,
+// e.g.:
+//
+//	dhcp-host=00:1f:16:12:34:56,192.168.42.23,printer,infinite
+func ParseDnsmasq(r io.Reader) (*ImportResult, error) {
+	var res ImportResult
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.IndexByte(line, '#'); idx > -1 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if !strings.HasPrefix(line, "dhcp-host=") {
+			continue
+		}
+		var (
+			host    StaticHost
+			hwaddrs []string
+		)
+		for _, field := range strings.Split(strings.TrimPrefix(line, "dhcp-host="), ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if hwaddr, err := net.ParseMAC(field); err == nil && len(hwaddr) == 6 {
+				hwaddrs = append(hwaddrs, hwaddr.String())
+				continue
+			}
+			if ip := net.ParseIP(field); ip != nil && ip.To4() != nil {
+				host.Addr = ip.To4()
+				continue
+			}
+			switch {
+			case strings.HasPrefix(field, "id:"),
+				strings.HasPrefix(field, "set:"),
+				strings.HasPrefix(field, "tag:"),
+				strings.HasPrefix(field, "["), // IPv6 address
+				strings.Contains(field, "*"),  // MAC address wildcard
+				field == "ignore":
+				res.Skipped = append(res.Skipped, fmt.Sprintf("line %d: unsupported field %q: %s", lineno, field, line))
+				hwaddrs = nil
+			case field == "infinite" || isLeaseTime(field):
+				// router7 static leases never expire
+			default:
+				host.Hostname = field
+			}
+		}
+		if len(hwaddrs) == 0 {
+			if !skipped(res.Skipped, lineno) {
+				res.Skipped = append(res.Skipped, fmt.Sprintf("line %d: no MAC address: %s", lineno, line))
+			}
+			continue
+		}
+		if host.Addr == nil {
+			res.Skipped = append(res.Skipped, fmt.Sprintf("line %d: no IPv4 address: %s", lineno, line))
+			continue
+		}
+		for _, hwaddr := range hwaddrs {
+			h := host
+			h.HardwareAddr = hwaddr
+			res.Hosts = append(res.Hosts, h)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func skipped(notes []string, lineno int) bool {
+	return len(notes) > 0 && strings.HasPrefix(notes[len(notes)-1], fmt.Sprintf("line %d:", lineno))
+}
+
+// isLeaseTime returns whether s is a dnsmasq lease time such as 12h or 3600.
+func isLeaseTime(s string) bool {
+	s = strings.TrimRight(s, "smhdw")
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// iscTokens splits an ISC dhcpd configuration file into tokens: words, quoted
+// strings (with quotes), and the punctuation characters {, } and ;.
+func iscTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var word bytes.Buffer
+		flush := func() {
+			if word.Len() > 0 {
+				tokens = append(tokens, word.String())
+				word.Reset()
+			}
+		}
+	Line:
+		for i := 0; i < len(line); i++ {
+			switch c := line[i]; c {
+			case '#':
+				break Line
+			case '"':
+				flush()
+				end := strings.IndexByte(line[i+1:], '"')
+				if end == -1 {
+					return nil, fmt.Errorf("unterminated string: %s", line)
+				}
+				tokens = append(tokens, line[i:i+end+2])
+				i += end + 1
+			case '{', '}', ';':
+				flush()
+				tokens = append(tokens, string(c))
+			case ' ', '\t', '\r':
+				flush()
+			default:
+				word.WriteByte(c)
+			}
+		}
+		flush()
+	}
+	return tokens, scanner.Err()
+}
+
+// ParseISC parses the host declarations of an ISC dhcpd configuration file,
+// e.g.:
+//
+//	host printer {
+//		hardware ethernet 00:1f:16:12:34:56;
+//		fixed-address 192.168.42.23;
+//	}
+func ParseISC(r io.Reader) (*ImportResult, error) {
+	tokens, err := iscTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	var res ImportResult
+	// statement returns the tokens up to (excluding) the next ;
+	statement := func(i int) ([]string, int) {
+		start := i
+		for i < len(tokens) && tokens[i] != ";" {
+			i++
+		}
+		return tokens[start:i], i + 1
+	}
+	depth := 0
+	for i := 0; i < len(tokens); {
+		switch tokens[i] {
+		case "{":
+			depth++
+			i++
+			continue
+		case "}":
+			depth--
+			i++
+			continue
+		}
+		if tokens[i] != "host" || i+2 >= len(tokens) || tokens[i+2] != "{" {
+			i++
+			continue
+		}
+		name := strings.Trim(tokens[i+1], `"`)
+		host := StaticHost{Hostname: name}
+		var unsupported []string
+		for i += 3; i < len(tokens) && tokens[i] != "}"; {
+			var stmt []string
+			stmt, i = statement(i)
+			if len(stmt) == 0 {
+				continue
+			}
+			switch {
+			case len(stmt) == 3 && stmt[0] == "hardware" && stmt[1] == "ethernet":
+				hwaddr, err := net.ParseMAC(stmt[2])
+				if err != nil {
+					return nil, fmt.Errorf("host %s: %v", name, err)
+				}
+				host.HardwareAddr = hwaddr.String()
+			case len(stmt) == 2 && stmt[0] == "fixed-address":
+				ip := net.ParseIP(stmt[1]).To4()
+				if ip == nil {
+					// e.g. a DNS name or a list of addresses
+					unsupported = append(unsupported, strings.Join(stmt, " "))
+					continue
+				}
+				host.Addr = ip
+			case len(stmt) == 3 && stmt[0] == "option" && stmt[1] == "host-name":
+				host.Hostname = strings.Trim(stmt[2], `"`)
+			case stmt[0] == "ddns-hostname" && len(stmt) == 2:
+				host.Hostname = strings.Trim(stmt[1], `"`)
+			default:
+				unsupported = append(unsupported, strings.Join(stmt, " "))
+			}
+		}
+		i++ // skip }
+		for _, u := range unsupported {
+			res.Skipped = append(res.Skipped, fmt.Sprintf("host %s: unsupported statement %q", name, u))
+		}
+		switch {
+		case host.HardwareAddr == "":
+			res.Skipped = append(res.Skipped, fmt.Sprintf("host %s: no hardware ethernet address", name))
+		case host.Addr == nil:
+			res.Skipped = append(res.Skipped, fmt.Sprintf("host %s: no IPv4 fixed-address", name))
+		default:
+			res.Hosts = append(res.Hosts, host)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced braces")
+	}
+	return &res, nil
+}
+
+// ImportStatic adds (or replaces) permanent leases for hosts and returns all
+// leases, which should be persisted. Hosts whose address is outside of the
+// range h hands out are rejected, and so is the import as a whole if any host
+// conflicts with another host or a permanent lease of a different client.
+func (h *Handler) ImportStatic(hosts []StaticHost) ([]*Lease, error) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	byNum := make(map[int]*Lease, len(hosts))
+	byHW := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		hwaddr, err := net.ParseMAC(host.HardwareAddr)
+		if err != nil {
+			return nil, err
+		}
+		ip := host.Addr.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("%s: %v is not an IPv4 address", hwaddr, host.Addr)
+		}
+		num := h.num(ip)
+		if h.poolOf(num) == nil {
+			return nil, fmt.Errorf("%s: %v is outside of the DHCP pools", hwaddr, ip)
+		}
+		if byHW[hwaddr.String()] {
+			return nil, fmt.Errorf("%s: duplicate hardware address", hwaddr)
+		}
+		if other, ok := byNum[num]; ok {
+			return nil, fmt.Errorf("%v: assigned to both %s and %s", ip, other.HardwareAddr, hwaddr)
+		}
+		if l, ok := h.leasesIP[num]; ok && l.Expiry.IsZero() && l.HardwareAddr != hwaddr.String() {
+			return nil, fmt.Errorf("%v: already statically assigned to %s", ip, l.HardwareAddr)
+		}
+		byHW[hwaddr.String()] = true
+		byNum[num] = &Lease{
+			Num:          num,
+			Addr:         ip,
+			HardwareAddr: hwaddr.String(),
+			Hostname:     host.Hostname,
+		}
+	}
+	for num, lease := range byNum {
+		if l, ok := h.leaseHW(lease.HardwareAddr); ok {
+			delete(h.leasesIP, l.Num) // release the client’s previous lease
+		}
+		// Any dynamic lease of a different client is replaced; that client
+		// will get a DHCPNAK when renewing and obtain a new address.
+		if l, ok := h.leasesIP[num]; ok {
+			delete(h.leasesHW, l.HardwareAddr)
+			delete(h.leasesID, l.ClientID)
+		}
+		h.leasesIP[num] = lease
+		h.leasesHW[lease.HardwareAddr] = num
+	}
+	leases := make([]*Lease, 0, len(h.leasesIP))
+	for _, l := range h.leasesIP {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
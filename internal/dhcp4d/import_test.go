@@ -0,0 +1,130 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestParseDnsmasq(t *testing.T) {
+	const config = `
+# static assignments
+dhcp-range=192.168.42.50,192.168.42.150,12h
+dhcp-host=00:1f:16:12:34:56,192.168.42.23,printer,infinite
+dhcp-host=00:1F:16:AA:BB:CC,00:1f:16:aa:bb:cd,192.168.42.24,laptop # wifi+ethernet
+dhcp-host=id:01:02:03,192.168.42.25
+dhcp-host=00:1f:16:12:34:99,nas,12h
+`
+	res, err := ParseDnsmasq(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StaticHost{
+		{HardwareAddr: "00:1f:16:12:34:56", Addr: net.IP{192, 168, 42, 23}, Hostname: "printer"},
+		{HardwareAddr: "00:1f:16:aa:bb:cc", Addr: net.IP{192, 168, 42, 24}, Hostname: "laptop"},
+		{HardwareAddr: "00:1f:16:aa:bb:cd", Addr: net.IP{192, 168, 42, 24}, Hostname: "laptop"},
+	}
+	if !reflect.DeepEqual(res.Hosts, want) {
+		t.Fatalf("unexpected hosts: got %+v, want %+v", res.Hosts, want)
+	}
+	if got, want := len(res.Skipped), 2; got != want {
+		t.Fatalf("unexpected number of skipped entries: got %d, want %d (%q)", got, want, res.Skipped)
+	}
+}
+
+func TestParseISC(t *testing.T) {
+	const config = `
+subnet 192.168.42.0 netmask 255.255.255.0 {
+  range 192.168.42.50 192.168.42.150;
+}
+host printer {
+  hardware ethernet 00:1f:16:12:34:56;
+  fixed-address 192.168.42.23; # office
+}
+host "laptop" {
+  hardware ethernet 00:1f:16:aa:bb:cc;
+  fixed-address 192.168.42.24;
+  option host-name "thinkpad";
+  option domain-name-servers 192.168.42.2;
+}
+host nas {
+  hardware ethernet 00:1f:16:12:34:99;
+  fixed-address nas.example.net;
+}
+`
+	res, err := ParseISC(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StaticHost{
+		{HardwareAddr: "00:1f:16:12:34:56", Addr: net.IP{192, 168, 42, 23}, Hostname: "printer"},
+		{HardwareAddr: "00:1f:16:aa:bb:cc", Addr: net.IP{192, 168, 42, 24}, Hostname: "thinkpad"},
+	}
+	if !reflect.DeepEqual(res.Hosts, want) {
+		t.Fatalf("unexpected hosts: got %+v, want %+v", res.Hosts, want)
+	}
+	if got, want := len(res.Skipped), 3; got != want {
+		t.Fatalf("unexpected number of skipped entries: got %d, want %d (%q)", got, want, res.Skipped)
+	}
+}
+
+func TestImportStatic(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var (
+		addr         = net.IP{192, 168, 42, 23}
+		hardwareAddr = net.HardwareAddr{0x00, 0x1f, 0x16, 0x12, 0x34, 0x56}
+	)
+
+	if _, err := handler.ImportStatic([]StaticHost{
+		{HardwareAddr: hardwareAddr.String(), Addr: net.IP{10, 0, 0, 1}},
+	}); err == nil {
+		t.Fatalf("ImportStatic unexpectedly accepted an address outside of the DHCP range")
+	}
+
+	leases, err := handler.ImportStatic([]StaticHost{
+		{HardwareAddr: hardwareAddr.String(), Addr: addr, Hostname: "printer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(leases), 1; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+	if !leases[0].Expiry.IsZero() {
+		t.Fatalf("imported lease is not permanent: %+v", leases[0])
+	}
+
+	p := discover(net.IPv4zero, hardwareAddr)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), addr.To4(); !bytes.Equal(got, want) {
+		t.Errorf("DHCPDISCOVER resulted in wrong IP: got %v, want %v", got, want)
+	}
+	p = request(addr, hardwareAddr, dhcp4.Option{
+		Code:  dhcp4.OptionHostName,
+		Value: []byte("client-supplied"),
+	})
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if l, _ := handler.leaseHW(hardwareAddr.String()); l.Hostname != "printer" {
+		t.Errorf("unexpected hostname: got %q, want %q", l.Hostname, "printer")
+	}
+}
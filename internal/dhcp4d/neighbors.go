@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/renameio"
+	"golang.org/x/net/bpf"
+
+	"github.com/rtr7/router7/internal/statefile"
+)
+
+// NDPFilter passes only IPv6 neighbor discovery messages (ICMPv6 types 133 to
+// 136) to userspace, for packet sockets on which Neighbors inspects IPv6
+// frames: the routed traffic of LAN clients is not copied.
+var NDPFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2}, // ethertype
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x86dd, SkipTrue: 6},
+	bpf.LoadAbsolute{Off: 14 + 6, Size: 1}, // IPv6 next header
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 58, SkipTrue: 4},
+	bpf.LoadAbsolute{Off: 14 + 40, Size: 1}, // ICMPv6 type
+	bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 133, SkipTrue: 2},
+	bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 136, SkipTrue: 1},
+	bpf.RetConstant{Val: 262144},
+	bpf.RetConstant{Val: 0},
+}
+
+// neighborRetention is how long devices which are no longer seen are
+// remembered.
+const neighborRetention = 30 * 24 * time.Hour
+
+// maxNeighbors is how many devices are remembered at most: as source hardware
+// addresses are easily spoofed, the least recently seen devices are forgotten
+// first beyond that.
+const maxNeighbors = 4096
+
+// Neighbors tracks when devices were last seen on the LAN. Devices renew their
+// DHCP lease only every few hours, but send ARP and NDP (IPv6 neighbor
+// discovery) messages whenever they are active, so these reflect whether a
+// device is actually present.
+type Neighbors struct {
+	// HardwareAddr is router7’s own LAN MAC address, whose frames are
+	// ignored.
+	HardwareAddr net.HardwareAddr
+
+	mu    sync.Mutex
+	seen  map[string]time.Time // key: hardware address
+	max   int
+	dirty bool
+}
+
+// NewNeighbors returns Neighbors which ignore frames from hwaddr.
+func NewNeighbors(hwaddr net.HardwareAddr) *Neighbors {
+	return &Neighbors{
+		HardwareAddr: hwaddr,
+		seen:         make(map[string]time.Time),
+		max:          maxNeighbors,
+	}
+}
+
+// evict forgets the least recently seen devices until at most max remain.
+// n.mu must be held.
+func (n *Neighbors) evict(max int) {
+	for len(n.seen) > max {
+		var oldest string
+		for hwaddr, at := range n.seen {
+			if oldest == "" || at.Before(n.seen[oldest]) {
+				oldest = hwaddr
+			}
+		}
+		delete(n.seen, oldest)
+	}
+}
+
+// Inspect records the sender of frame as seen at the time at if frame is an
+// ARP message or an IPv6 neighbor discovery message (router solicitation,
+// neighbor solicitation or advertisement), and returns the sender’s hardware
+// address, or the empty string for other frames.
+func (n *Neighbors) Inspect(frame []byte, at time.Time) string {
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok ||
+		bytes.Equal(eth.SrcMAC, n.HardwareAddr) ||
+		len(eth.SrcMAC) != 6 ||
+		eth.SrcMAC[0]&0x01 != 0 { // multicast source addresses are invalid
+		return ""
+	}
+	switch {
+	case pkt.Layer(layers.LayerTypeARP) != nil:
+	case pkt.Layer(layers.LayerTypeICMPv6RouterSolicitation) != nil:
+	case pkt.Layer(layers.LayerTypeICMPv6NeighborSolicitation) != nil:
+	case pkt.Layer(layers.LayerTypeICMPv6NeighborAdvertisement) != nil:
+	default:
+		return ""
+	}
+	hwaddr := eth.SrcMAC.String()
+	n.Seen(hwaddr, at)
+	return hwaddr
+}
+
+// Seen records hwaddr as seen at the time at, e.g. when the device sends a
+// DHCP request.
+func (n *Neighbors) Seen(hwaddr string, at time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	last, ok := n.seen[hwaddr]
+	if !ok {
+		n.evict(n.max - 1)
+	}
+	if at.After(last) {
+		n.seen[hwaddr] = at
+		n.dirty = true
+	}
+}
+
+// LastSeen returns when hwaddr was last seen, or the zero time if it was
+// never seen.
+func (n *Neighbors) LastSeen(hwaddr string) time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.seen[hwaddr]
+}
+
+// Load reads dhcp4d/lastseen.json from dir, keeping more recent in-memory
+// observations. A missing file is not an error.
+func (n *Neighbors) Load(dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4d", "lastseen.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var seen map[string]time.Time
+	if err := statefile.LastSeen.Unmarshal(b, &seen); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for hwaddr, at := range seen {
+		if at.After(n.seen[hwaddr]) {
+			n.seen[hwaddr] = at
+		}
+	}
+	n.evict(n.max)
+	return nil
+}
+
+// Persist atomically replaces dhcp4d/lastseen.json in dir if devices were
+// seen since the last call, forgetting devices which were not seen for 30
+// days.
+func (n *Neighbors) Persist(dir string, now time.Time) error {
+	n.mu.Lock()
+	if !n.dirty {
+		n.mu.Unlock()
+		return nil
+	}
+	for hwaddr, at := range n.seen {
+		if now.Sub(at) > neighborRetention {
+			delete(n.seen, hwaddr)
+		}
+	}
+	b, err := statefile.LastSeen.Marshal(n.seen)
+	n.dirty = false
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(filepath.Join(dir, "dhcp4d", "lastseen.json"), b, 0644); err != nil {
+		n.mu.Lock()
+		n.dirty = true // retry on the next call
+		n.mu.Unlock()
+		return err
+	}
+	return nil
+}
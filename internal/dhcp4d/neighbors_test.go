@@ -0,0 +1,201 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+func serializeFrame(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func arpRequest(t *testing.T, src net.HardwareAddr) []byte {
+	return serializeFrame(t,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   src,
+			SourceProtAddress: []byte{192, 168, 42, 23},
+			DstHwAddress:      []byte{0, 0, 0, 0, 0, 0},
+			DstProtAddress:    []byte{192, 168, 42, 1},
+		})
+}
+
+func icmpv6(t *testing.T, src net.HardwareAddr, typ uint8) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		SrcIP:      net.ParseIP("fe80::23"),
+		DstIP:      net.ParseIP("ff02::1:ff00:1"),
+		NextHeader: layers.IPProtocolICMPv6,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(typ, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ip)
+	var body gopacket.SerializableLayer
+	switch typ {
+	case layers.ICMPv6TypeNeighborSolicitation:
+		body = &layers.ICMPv6NeighborSolicitation{
+			TargetAddress: net.ParseIP("fe80::1"),
+		}
+	case layers.ICMPv6TypeEchoRequest:
+		body = &layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1}
+	}
+	return serializeFrame(t,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       net.HardwareAddr{0x33, 0x33, 0xff, 0x00, 0x00, 0x01},
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		ip,
+		icmp,
+		body)
+}
+
+func TestNeighbors(t *testing.T) {
+	var (
+		routerMAC = net.HardwareAddr{0x02, 0x73, 0x53, 0x00, 0xb0, 0x0c}
+		phoneMAC  = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x23}
+		laptopMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x42}
+	)
+	n := NewNeighbors(routerMAC)
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+		want  string
+	}{
+		{"arp", arpRequest(t, phoneMAC), phoneMAC.String()},
+		{"own arp", arpRequest(t, routerMAC), ""},
+		{"neighbor solicitation", icmpv6(t, laptopMAC, layers.ICMPv6TypeNeighborSolicitation), laptopMAC.String()},
+		{"echo request", icmpv6(t, laptopMAC, layers.ICMPv6TypeEchoRequest), ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := n.Inspect(tt.frame, now), tt.want; got != want {
+				t.Fatalf("Inspect() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	if got := n.LastSeen(routerMAC.String()); !got.IsZero() {
+		t.Fatalf("router unexpectedly seen at %v", got)
+	}
+	if got, want := n.LastSeen(phoneMAC.String()), now; !got.Equal(want) {
+		t.Fatalf("LastSeen(phone) = %v, want %v", got, want)
+	}
+	// Observations out of order must not move the timestamp back.
+	n.Seen(phoneMAC.String(), now.Add(-1*time.Minute))
+	if got, want := n.LastSeen(phoneMAC.String()), now; !got.Equal(want) {
+		t.Fatalf("LastSeen(phone) = %v, want %v", got, want)
+	}
+
+	tmp, err := ioutil.TempDir("", "dhcp4d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const staleMAC = "02:00:00:00:00:99"
+	n.Seen(staleMAC, now.Add(-2*neighborRetention))
+	if err := n.Persist(tmp, now); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewNeighbors(routerMAC)
+	if err := loaded.Load(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.LastSeen(laptopMAC.String()), now; !got.Equal(want) {
+		t.Fatalf("LastSeen(laptop) after Load = %v, want %v", got, want)
+	}
+	if got := loaded.LastSeen(staleMAC); !got.IsZero() {
+		t.Fatalf("stale device unexpectedly persisted (last seen %v)", got)
+	}
+}
+
+func TestNeighborsMax(t *testing.T) {
+	n := NewNeighbors(nil)
+	n.max = 2
+	now := time.Now()
+	n.Seen("02:00:00:00:00:01", now.Add(-2*time.Minute))
+	n.Seen("02:00:00:00:00:02", now.Add(-3*time.Minute))
+	n.Seen("02:00:00:00:00:01", now)
+	n.Seen("02:00:00:00:00:03", now) // forgets 02, seen least recently
+	for hwaddr, want := range map[string]bool{
+		"02:00:00:00:00:01": true,
+		"02:00:00:00:00:02": false,
+		"02:00:00:00:00:03": true,
+	} {
+		if got := !n.LastSeen(hwaddr).IsZero(); got != want {
+			t.Errorf("%s remembered = %v, want %v", hwaddr, got, want)
+		}
+	}
+}
+
+func TestNDPFilter(t *testing.T) {
+	vm, err := bpf.NewVM(NDPFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardwareAddr := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x42}
+	for _, tt := range []struct {
+		desc  string
+		frame []byte
+		want  bool
+	}{
+		{"neighbor solicitation", icmpv6(t, hardwareAddr, layers.ICMPv6TypeNeighborSolicitation), true},
+		{"echo request", icmpv6(t, hardwareAddr, layers.ICMPv6TypeEchoRequest), false},
+		{"DHCP request", udpFrame(t, hardwareAddr, 67, discover(net.IPv4zero, hardwareAddr)), false},
+	} {
+		n, err := vm.Run(tt.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n > 0; got != tt.want {
+			t.Errorf("%s: passed = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+	"golang.org/x/net/bpf"
+)
+
+// requestFilter passes only DHCP requests (UDP datagrams to port 67 in
+// unfragmented IPv4 packets) to userspace, so that the frames forwarded
+// through the interface are not copied.
+var requestFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2}, // ethertype
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x0800, SkipTrue: 8},
+	bpf.LoadAbsolute{Off: 14 + 9, Size: 1}, // IPv4 protocol
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 17, SkipTrue: 6},
+	bpf.LoadAbsolute{Off: 14 + 6, Size: 2}, // IPv4 fragment offset
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+	bpf.LoadMemShift{Off: 14},              // X = IPv4 header length
+	bpf.LoadIndirect{Off: 14 + 2, Size: 2}, // UDP destination port
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 67, SkipTrue: 1},
+	bpf.RetConstant{Val: 262144},
+	bpf.RetConstant{Val: 0},
+}
+
+// ListenPacket returns a connection for dhcp4.Serve which receives DHCP
+// requests on iface via an AF_PACKET socket instead of a UDP socket. Unlike
+// UDP sockets, it receives requests on interfaces without IPv4 address (e.g.
+// the ports of a bridge) and independently of the kernel’s routing decisions.
+//
+// The connection cannot send: Handler sends replies as Ethernet frames
+// addressed to the client’s hardware address, so clients receive them before
+// they have an IP address.
+func ListenPacket(iface *net.Interface) (net.PacketConn, error) {
+	filter, err := bpf.Assemble(requestFilter)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := raw.ListenPacket(iface, syscall.ETH_P_IP, &raw.Config{
+		Filter: filter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(conn, iface.MTU), nil
+}
+
+// packetConn receives the DHCP requests of Ethernet frames read from an
+// AF_PACKET socket.
+type packetConn struct {
+	net.PacketConn
+	frame []byte
+}
+
+func newPacketConn(conn net.PacketConn, mtu int) *packetConn {
+	if mtu < 1500 {
+		mtu = 1500
+	}
+	return &packetConn{
+		PacketConn: conn,
+		frame:      make([]byte, mtu+14), // MTU plus ethernet header
+	}
+}
+
+// parseRequest returns the DHCP message and the sender of frame, or ok false
+// if frame is not a DHCP request (i.e. not a UDP datagram to port 67).
+func parseRequest(frame []byte) (msg []byte, from *net.UDPAddr, ok bool) {
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return nil, nil, false
+	}
+	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || udp.DstPort != 67 {
+		return nil, nil, false
+	}
+	return udp.Payload, &net.UDPAddr{IP: ip.SrcIP, Port: int(udp.SrcPort)}, true
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, _, err := c.PacketConn.ReadFrom(c.frame)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg, from, ok := parseRequest(c.frame[:n])
+		if !ok {
+			continue
+		}
+		return copy(b, msg), from, nil
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, errors.New("dhcp4d: replies are sent by Handler, not via the packet connection")
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/krolaw/dhcp4"
+	"golang.org/x/net/bpf"
+)
+
+// frameSource returns frames from ReadFrom, then io.EOF.
+type frameSource struct {
+	noopSink
+	frames [][]byte
+}
+
+func (s *frameSource) ReadFrom(buf []byte) (int, net.Addr, error) {
+	if len(s.frames) == 0 {
+		return 0, nil, io.EOF
+	}
+	frame := s.frames[0]
+	s.frames = s.frames[1:]
+	return copy(buf, frame), nil, nil
+}
+
+func udpFrame(t *testing.T, src net.HardwareAddr, dstPort layers.UDPPort, payload []byte) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IPv4zero,
+		DstIP:    net.IPv4bcast,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: 68,
+		DstPort: dstPort,
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serializeFrame(t,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip,
+		udp,
+		gopacket.Payload(payload))
+}
+
+func TestPacketConn(t *testing.T) {
+	hardwareAddr := net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}
+	p := discover(net.IPv4zero, hardwareAddr)
+	src := &frameSource{
+		frames: [][]byte{
+			arpRequest(t, hardwareAddr),
+			udpFrame(t, hardwareAddr, 68, []byte("reply of another server")),
+			udpFrame(t, hardwareAddr, 67, p),
+		},
+	}
+	conn := newPacketConn(src, 1500)
+	buf := make([]byte, 1500)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], p) {
+		t.Errorf("ReadFrom: got %x, want %x", buf[:n], []byte(p))
+	}
+	if got, want := addr.String(), "0.0.0.0:68"; got != want {
+		t.Errorf("ReadFrom: unexpected sender: got %s, want %s", got, want)
+	}
+	if _, _, err := conn.ReadFrom(buf); err != io.EOF {
+		t.Errorf("ReadFrom: got %v, want io.EOF", err)
+	}
+	if _, err := conn.WriteTo(p, addr); err == nil {
+		t.Errorf("WriteTo unexpectedly succeeded")
+	}
+}
+
+func TestRequestFilter(t *testing.T) {
+	vm, err := bpf.NewVM(requestFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardwareAddr := net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}
+	p := discover(net.IPv4zero, hardwareAddr)
+	for _, tt := range []struct {
+		desc  string
+		frame []byte
+		want  bool
+	}{
+		{"DHCP request", udpFrame(t, hardwareAddr, 67, p), true},
+		{"DHCP reply", udpFrame(t, hardwareAddr, 68, p), false},
+		{"ARP request", arpRequest(t, hardwareAddr), false},
+		{"ICMPv6", icmpv6(t, hardwareAddr, layers.ICMPv6TypeNeighborSolicitation), false},
+	} {
+		n, err := vm.Run(tt.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n > 0; got != tt.want {
+			t.Errorf("%s: passed = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+type frameSink struct {
+	noopSink
+	last []byte
+}
+
+func (s *frameSink) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	s.last = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestIgnoreBroadcastFlag(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	sink := &frameSink{}
+	handler.rawConn = sink
+
+	hardwareAddr := net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}
+	p := discover(net.IPv4zero, hardwareAddr)
+	p.SetBroadcast(true)
+	dst := func() (net.HardwareAddr, net.IP) {
+		t.Helper()
+		pkt := gopacket.NewPacket(sink.last, layers.LayerTypeEthernet, gopacket.Default)
+		eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if !ok {
+			t.Fatalf("no reply sent")
+		}
+		return eth.DstMAC, pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	}
+
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if mac, ip := dst(); !bytes.Equal(mac, layers.EthernetBroadcast) || !ip.Equal(net.IPv4bcast) {
+		t.Errorf("broadcast flag honored: reply sent to %v (%v), want broadcast", mac, ip)
+	}
+
+	handler.IgnoreBroadcastFlag = true
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if mac, ip := dst(); !bytes.Equal(mac, hardwareAddr) || ip.Equal(net.IPv4bcast) {
+		t.Errorf("broadcast flag ignored: reply sent to %v (%v), want %v", mac, ip, hardwareAddr)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/krolaw/dhcp4"
+)
+
+type frame struct {
+	time time.Time
+	data []byte // ethernet frame
+}
+
+type transaction struct {
+	request frame
+	reply   frame // data is nil if no reply was sent
+}
+
+// TransactionLog retains the most recent DHCP transactions (requests and their
+// replies), so that interoperability problems with clients can be reported
+// with a packet capture.
+type TransactionLog struct {
+	max int
+
+	mu  sync.Mutex
+	txs []transaction
+}
+
+// NewTransactionLog returns a TransactionLog which retains the max most recent
+// transactions.
+func NewTransactionLog(max int) *TransactionLog {
+	return &TransactionLog{max: max}
+}
+
+func (l *TransactionLog) add(tx transaction) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.txs = append(l.txs, tx)
+	if len(l.txs) > l.max {
+		l.txs = l.txs[len(l.txs)-l.max:]
+	}
+}
+
+// Len returns the number of retained transactions.
+func (l *TransactionLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.txs)
+}
+
+// WritePcap writes the retained transactions, oldest first, in pcap format.
+func (l *TransactionLog) WritePcap(w io.Writer) error {
+	l.mu.Lock()
+	txs := append([]transaction(nil), l.txs...)
+	l.mu.Unlock()
+
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		for _, f := range []frame{tx.request, tx.reply} {
+			if f.data == nil {
+				continue
+			}
+			if err := pw.WritePacket(gopacket.CaptureInfo{
+				Timestamp:     f.time,
+				CaptureLength: len(f.data),
+				Length:        len(f.data),
+			}, f.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requestFrame reconstructs the ethernet frame of request p: the DHCP payload
+// is verbatim, the headers (which the UDP socket does not expose) are derived
+// from it.
+func (h *Handler) requestFrame(p dhcp4.Packet) []byte {
+	srcIP := p.CIAddr()
+	dstIP := net.IPv4bcast
+	if !srcIP.Equal(net.IPv4zero) {
+		dstIP = h.serverIP // e.g. a renewal, see RFC 2131, section 4.4.5
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	ethernet := &layers.Ethernet{
+		DstMAC:       layers.EthernetBroadcast,
+		SrcMAC:       p.CHAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: 68,
+		DstPort: 67,
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	gopacket.SerializeLayers(buf, opts,
+		ethernet,
+		ip,
+		udp,
+		gopacket.Payload(p))
+	return buf.Bytes()
+}
+
+// recordTransaction adds request p and reply (an ethernet frame, nil if no
+// reply was sent) to h.Transactions, if set.
+func (h *Handler) recordTransaction(received time.Time, p dhcp4.Packet, reply []byte) {
+	if h.Transactions == nil {
+		return
+	}
+	tx := transaction{
+		request: frame{time: received, data: h.requestFrame(p)},
+	}
+	if reply != nil {
+		tx.reply = frame{time: h.timeNow(), data: reply}
+	}
+	h.Transactions.add(tx)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/krolaw/dhcp4"
+)
+
+func TestTransactionLog(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	handler.Transactions = NewTransactionLog(2)
+
+	var requests []dhcp4.Packet
+	for i := 0; i < 3; i++ {
+		p := discover(net.IPv4zero, net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, byte(i)})
+		requests = append(requests, p)
+		handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	}
+	if got, want := handler.Transactions.Len(), 2; got != want {
+		t.Fatalf("unexpected number of transactions: got %d, want %d", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := handler.Transactions.WritePcap(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := pcapgo.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.LinkType(), layers.LinkTypeEthernet; got != want {
+		t.Fatalf("unexpected link type: got %v, want %v", got, want)
+	}
+	var frames []gopacket.Packet
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		frames = append(frames, gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	}
+	if got, want := len(frames), 4; got != want {
+		t.Fatalf("unexpected number of frames: got %d, want %d", got, want)
+	}
+	for i, f := range frames {
+		udp, ok := f.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok {
+			t.Fatalf("frame %d: no UDP layer", i)
+		}
+		if i%2 == 1 {
+			if got, want := udp.SrcPort, layers.UDPPort(67); got != want {
+				t.Errorf("frame %d: unexpected source port: got %d, want %d", i, got, want)
+			}
+			continue
+		}
+		// Requests contain the DHCP payload verbatim.
+		if got, want := udp.DstPort, layers.UDPPort(67); got != want {
+			t.Errorf("frame %d: unexpected destination port: got %d, want %d", i, got, want)
+		}
+		if got, want := udp.Payload, []byte(requests[1+i/2]); !bytes.Equal(got, want) {
+			t.Errorf("frame %d: unexpected payload: got %x, want %x", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp6
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/webhook"
+)
+
+// Hooks are run when the delegated prefixes change, e.g. to update ACLs on
+// downstream devices. They are configured in dhcp6/hooks.json.
+type Hooks struct {
+	// Scripts are executables which are run in order, with the environment
+	// variables INTERFACE, OLD_PREFIXES and NEW_PREFIXES (space-separated,
+	// e.g. “2a02:168:4a00::/48”), like dhclient exit hooks.
+	Scripts []string `json:"scripts"`
+
+	// WebhookURLs receive the PrefixChange as JSON in an HTTP POST request.
+	WebhookURLs []string `json:"webhook_urls"`
+}
+
+// ReadHooks reads dhcp6/hooks.json from dir. A missing file results in no
+// hooks.
+func ReadHooks(dir string) (*Hooks, error) {
+	fn := filepath.Join(dir, "dhcp6", "hooks.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Hooks{}, nil
+		}
+		return nil, err
+	}
+	var h Hooks
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &h, nil
+}
+
+// PrefixChange describes a change of the delegated prefixes.
+type PrefixChange struct {
+	Interface   string    `json:"interface"`
+	OldPrefixes []string  `json:"old_prefixes"`
+	NewPrefixes []string  `json:"new_prefixes"`
+	Time        time.Time `json:"time"`
+}
+
+func prefixStrings(cfg Config) []string {
+	result := make([]string, 0, len(cfg.Prefixes))
+	for _, p := range cfg.Prefixes {
+		result = append(result, p.String())
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NewPrefixChange returns the change from the prefixes of old to the prefixes
+// of new, or nil if they are the same (e.g. on a lease renewal).
+func NewPrefixChange(iface string, old, new Config, now time.Time) *PrefixChange {
+	ch := &PrefixChange{
+		Interface:   iface,
+		OldPrefixes: prefixStrings(old),
+		NewPrefixes: prefixStrings(new),
+		Time:        now,
+	}
+	if strings.Join(ch.OldPrefixes, " ") == strings.Join(ch.NewPrefixes, " ") {
+		return nil
+	}
+	return ch
+}
+
+// Run runs all hooks for ch. Failing hooks do not prevent the remaining hooks
+// from running; the first error is returned.
+func (h *Hooks) Run(ctx context.Context, ch *PrefixChange) error {
+	var errs []error
+	for _, script := range h.Scripts {
+		cmd := exec.CommandContext(ctx, script)
+		cmd.Env = append(os.Environ(),
+			"INTERFACE="+ch.Interface,
+			"OLD_PREFIXES="+strings.Join(ch.OldPrefixes, " "),
+			"NEW_PREFIXES="+strings.Join(ch.NewPrefixes, " "))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v (output: %s)", script, err, strings.TrimSpace(string(out))))
+		}
+	}
+	for _, url := range h.WebhookURLs {
+		if err := webhook.Post(ctx, url, ch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d hooks failed, first error: %v", len(errs), len(h.Scripts)+len(h.WebhookURLs), errs[0])
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp6
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func TestNewPrefixChange(t *testing.T) {
+	now := time.Now()
+	old := Config{Prefixes: []net.IPNet{mustParseCIDR(t, "2a02:168:4a00::/48")}}
+	renewed := Config{
+		Prefixes:   []net.IPNet{mustParseCIDR(t, "2a02:168:4a00::/48")},
+		RenewAfter: now.Add(1 * time.Hour),
+	}
+	if ch := NewPrefixChange("uplink0", old, renewed, now); ch != nil {
+		t.Fatalf("NewPrefixChange(renewal) = %+v, want nil", ch)
+	}
+
+	changed := Config{Prefixes: []net.IPNet{mustParseCIDR(t, "2a02:168:4b00::/48")}}
+	got := NewPrefixChange("uplink0", old, changed, now)
+	want := &PrefixChange{
+		Interface:   "uplink0",
+		OldPrefixes: []string{"2a02:168:4a00::/48"},
+		NewPrefixes: []string{"2a02:168:4b00::/48"},
+		Time:        now,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("NewPrefixChange: unexpected result: diff (-want +got):\n%s", diff)
+	}
+
+	// The first lease (no previous lease) is a change, too.
+	if ch := NewPrefixChange("uplink0", Config{}, old, now); ch == nil {
+		t.Fatalf("NewPrefixChange(first lease) = nil, want a change")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dhcp6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	h, err := ReadHooks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Scripts) > 0 || len(h.WebhookURLs) > 0 {
+		t.Fatalf("ReadHooks without hooks.json = %+v, want no hooks", h)
+	}
+
+	envFile := filepath.Join(tmp, "env")
+	script := filepath.Join(tmp, "hook.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$INTERFACE|$OLD_PREFIXES|$NEW_PREFIXES\" > "+envFile+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	posted := make(chan PrefixChange, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ch PrefixChange
+		if err := json.NewDecoder(r.Body).Decode(&ch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		posted <- ch
+	}))
+	defer srv.Close()
+
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp6"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(&Hooks{
+		Scripts:     []string{script},
+		WebhookURLs: []string{srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp6", "hooks.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err = ReadHooks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := &PrefixChange{
+		Interface:   "uplink0",
+		OldPrefixes: []string{"2a02:168:4a00::/48"},
+		NewPrefixes: []string{"2a02:168:4b00::/48", "2a02:168:4c00::/56"},
+	}
+	if err := h.Run(context.Background(), ch); err != nil {
+		t.Fatal(err)
+	}
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(env)), "uplink0|2a02:168:4a00::/48|2a02:168:4b00::/48 2a02:168:4c00::/56"; got != want {
+		t.Fatalf("unexpected hook environment: got %q, want %q", got, want)
+	}
+	if got := <-posted; got.Interface != "uplink0" || len(got.NewPrefixes) != 2 {
+		t.Fatalf("unexpected webhook payload: %+v", got)
+	}
+
+	// A failing script does not keep the webhook from being called.
+	h.Scripts = []string{filepath.Join(tmp, "nonexistent"), script}
+	if err := h.Run(context.Background(), ch); err == nil {
+		t.Fatalf("Run unexpectedly succeeded with a missing script")
+	}
+	<-posted
+}
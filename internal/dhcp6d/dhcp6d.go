@@ -0,0 +1,335 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhcp6d implements a DHCPv6 server which sub-delegates parts of the
+// prefix delegated to router7 to downstream routers (DHCPv6 prefix
+// delegation, RFC 8415).
+package dhcp6d
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lease is a prefix delegated to a downstream router.
+type Lease struct {
+	ClientID string    `json:"client_id"` // DUID, hex-encoded
+	IAID     uint32    `json:"iaid"`
+	Prefix   string    `json:"prefix"`   // e.g. 2001:db8:0:10::/60
+	NextHop  net.IP    `json:"next_hop"` // link-local address of the router
+	Expiry   time.Time `json:"expiry"`
+}
+
+func (l *Lease) Expired(at time.Time) bool {
+	return at.After(l.Expiry)
+}
+
+func (l *Lease) key() string {
+	return fmt.Sprintf("%s/%d", l.ClientID, l.IAID)
+}
+
+// Config is the prefix delegation configuration, stored in dhcp6d.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// PrefixLength is the length of the delegated prefixes (default 60).
+	PrefixLength int `json:"prefix_length"`
+}
+
+// ReadConfig reads dhcp6d.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "dhcp6d.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+const (
+	preferredLifetime = 1 * time.Hour
+	validLifetime     = 2 * time.Hour
+)
+
+type Handler struct {
+	serverID     []byte
+	prefixLength int
+
+	mu     sync.Mutex
+	prefix *net.IPNet // delegated to router7, nil if none
+	leases map[string]*Lease
+
+	timeNow func() time.Time
+
+	// Leases is called whenever leases were added, renewed or released.
+	Leases func([]*Lease)
+}
+
+// NewHandler returns a Handler identifying itself with the DUID serverID.
+func NewHandler(serverID []byte, cfg *Config) (*Handler, error) {
+	length := cfg.PrefixLength
+	if length == 0 {
+		length = 60
+	}
+	if length < 1 || length > 64 {
+		return nil, fmt.Errorf("prefix_length %d not within [1, 64]", length)
+	}
+	return &Handler{
+		serverID:     serverID,
+		prefixLength: length,
+		leases:       make(map[string]*Lease),
+		timeNow:      time.Now,
+	}, nil
+}
+
+// SetPrefix sets the prefix delegated to router7, of which parts are
+// sub-delegated. Leases outside of prefix are discarded.
+func (h *Handler) SetPrefix(prefix net.IPNet) error {
+	if ones, _ := prefix.Mask.Size(); ones >= h.prefixLength {
+		return fmt.Errorf("prefix %v too small to sub-delegate /%d prefixes", &prefix, h.prefixLength)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prefix = &prefix
+	for key, l := range h.leases {
+		if !h.delegatable(l.Prefix) {
+			delete(h.leases, key)
+		}
+	}
+	return nil
+}
+
+// SetLeases replaces the current leases, e.g. with those loaded from disk.
+func (h *Handler) SetLeases(leases []*Lease) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leases = make(map[string]*Lease)
+	for _, l := range leases {
+		if h.prefix != nil && !h.delegatable(l.Prefix) {
+			continue
+		}
+		h.leases[l.key()] = l
+	}
+}
+
+// chunk returns the prefix with index idx within h.prefix.
+func (h *Handler) chunk(idx int64) net.IPNet {
+	base := new(big.Int).SetBytes(h.prefix.IP.To16())
+	offset := new(big.Int).Lsh(big.NewInt(idx), uint(128-h.prefixLength))
+	ip := make(net.IP, net.IPv6len)
+	b := base.Add(base, offset).Bytes()
+	copy(ip[net.IPv6len-len(b):], b)
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(h.prefixLength, 128)}
+}
+
+// delegatable returns whether prefix is a chunk within h.prefix other than the
+// first, which contains the LAN’s /64 subnet.
+func (h *Handler) delegatable(prefix string) bool {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return false
+	}
+	ones, _ := ipnet.Mask.Size()
+	return ones == h.prefixLength &&
+		ip.Equal(ipnet.IP) &&
+		h.prefix.Contains(ip) &&
+		!ipnet.Contains(h.prefix.IP)
+}
+
+// inUse returns whether prefix is delegated to anyone but key.
+func (h *Handler) inUse(prefix, key string) bool {
+	now := h.timeNow()
+	for k, l := range h.leases {
+		if k != key && l.Prefix == prefix && !l.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate returns a prefix for key, preferring the existing lease, then the
+// prefix hinted at by the client.
+func (h *Handler) allocate(key string, hints []iaPrefix) (string, bool) {
+	if l, ok := h.leases[key]; ok && !h.inUse(l.Prefix, key) {
+		return l.Prefix, true
+	}
+	for _, hint := range hints {
+		p := hint.prefix.String()
+		if h.delegatable(p) && !h.inUse(p, key) {
+			return p, true
+		}
+	}
+	ones, _ := h.prefix.Mask.Size()
+	chunks := int64(1) << uint(h.prefixLength-ones)
+	if chunks > 1<<16 {
+		chunks = 1 << 16
+	}
+	for idx := int64(1); idx < chunks; idx++ { // chunk 0 contains the LAN
+		chunk := h.chunk(idx)
+		if p := chunk.String(); !h.inUse(p, key) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// CurrentLeases returns all leases, sorted by prefix.
+func (h *Handler) CurrentLeases() []*Lease {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.leasesLocked()
+}
+
+func (h *Handler) leasesLocked() []*Lease {
+	leases := make([]*Lease, 0, len(h.leases))
+	for _, l := range h.leases {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Prefix < leases[j].Prefix
+	})
+	return leases
+}
+
+// ServeDHCPv6 processes the DHCPv6 message req received from peer (the
+// requesting router’s link-local address) and returns the reply to send, or
+// nil if the message should be ignored.
+func (h *Handler) ServeDHCPv6(req []byte, peer net.IP) ([]byte, error) {
+	m, err := parseMessage(req)
+	if err != nil {
+		return nil, err
+	}
+	clientID := m.option(optClientID)
+	if clientID == nil {
+		return nil, nil // RFC 8415, section 16: discard
+	}
+	serverID := m.option(optServerID)
+	switch m.typ {
+	case msgSolicit, msgRebind:
+		if serverID != nil {
+			return nil, nil
+		}
+	case msgRequest, msgRenew, msgRelease:
+		if !bytes.Equal(serverID, h.serverID) {
+			return nil, nil // message not for this server
+		}
+	default:
+		return nil, nil // e.g. Information-request (no configuration to offer)
+	}
+
+	var ias []*iaPD
+	for _, o := range m.options {
+		if o.code != optIAPD {
+			continue
+		}
+		ia, err := parseIAPD(o.data)
+		if err != nil {
+			return nil, err
+		}
+		ias = append(ias, ia)
+	}
+	if len(ias) == 0 {
+		return nil, nil // only prefix delegation is offered
+	}
+
+	reply := &message{typ: msgReply, xid: m.xid}
+	commit := true
+	switch {
+	case m.typ == msgSolicit && m.hasOption(optRapidCommit):
+		reply.options = append(reply.options, option{code: optRapidCommit})
+	case m.typ == msgSolicit:
+		reply.typ = msgAdvertise
+		commit = false
+	}
+	reply.options = append(reply.options,
+		option{code: optServerID, data: h.serverID},
+		option{code: optClientID, data: clientID})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.timeNow()
+	changed := false
+	for _, ia := range ias {
+		key := (&Lease{ClientID: hex.EncodeToString(clientID), IAID: ia.iaid}).key()
+		resp := &iaPD{iaid: ia.iaid}
+		if m.typ == msgRelease {
+			if _, ok := h.leases[key]; ok {
+				delete(h.leases, key)
+				changed = true
+				resp.status = &statusCode{code: statusSuccess}
+			} else {
+				resp.status = &statusCode{code: statusNoBinding, message: "no binding for this IA"}
+			}
+			reply.options = append(reply.options, resp.marshal())
+			continue
+		}
+
+		if h.prefix == nil {
+			resp.status = &statusCode{code: statusNoPrefixAvail, message: "no prefix delegated to the router"}
+			reply.options = append(reply.options, resp.marshal())
+			continue
+		}
+		prefix, ok := h.allocate(key, ia.prefixes)
+		if !ok {
+			resp.status = &statusCode{code: statusNoPrefixAvail, message: "no prefixes available"}
+			reply.options = append(reply.options, resp.marshal())
+			continue
+		}
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		resp.t1 = uint32(preferredLifetime.Seconds() / 2)
+		resp.t2 = uint32(preferredLifetime.Seconds() * 0.8)
+		resp.prefixes = []iaPrefix{
+			{
+				preferred: uint32(preferredLifetime.Seconds()),
+				valid:     uint32(validLifetime.Seconds()),
+				prefix:    *ipnet,
+			},
+		}
+		reply.options = append(reply.options, resp.marshal())
+		if commit {
+			h.leases[key] = &Lease{
+				ClientID: hex.EncodeToString(clientID),
+				IAID:     ia.iaid,
+				Prefix:   prefix,
+				NextHop:  peer,
+				Expiry:   now.Add(validLifetime),
+			}
+			changed = true
+		}
+	}
+	if m.typ == msgRelease {
+		reply.options = append(reply.options, (&statusCode{code: statusSuccess}).marshal())
+	}
+	if changed && h.Leases != nil {
+		h.Leases(h.leasesLocked())
+	}
+	return reply.marshal(), nil
+}
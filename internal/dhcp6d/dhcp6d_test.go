@@ -0,0 +1,186 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp6d
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	serverID = []byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x73, 0x53, 0x00, 0xb0, 0x0c}
+	clientID = []byte{0x00, 0x03, 0x00, 0x01, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	peer     = net.ParseIP("fe80::1322:33ff:fe44:5566")
+)
+
+func testHandler(t *testing.T) *Handler {
+	h, err := NewHandler(serverID, &Config{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prefix, err := net.ParseCIDR("2001:db8:4a00::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetPrefix(*prefix); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func request(typ byte, opts ...option) []byte {
+	m := &message{
+		typ:     typ,
+		xid:     [3]byte{0xaa, 0xbb, 0xcc},
+		options: append([]option{{code: optClientID, data: clientID}}, opts...),
+	}
+	return m.marshal()
+}
+
+func serve(t *testing.T, h *Handler, req []byte) *message {
+	t.Helper()
+	b, err := h.ServeDHCPv6(req, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == nil {
+		t.Fatalf("request unexpectedly not answered")
+	}
+	m, err := parseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func delegated(t *testing.T, m *message) *iaPD {
+	t.Helper()
+	ia, err := parseIAPD(m.option(optIAPD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ia
+}
+
+func TestDelegation(t *testing.T) {
+	h := testHandler(t)
+	var leases []*Lease
+	h.Leases = func(l []*Lease) { leases = l }
+
+	ia := (&iaPD{iaid: 1}).marshal()
+	adv := serve(t, h, request(msgSolicit, ia))
+	if got, want := adv.typ, byte(msgAdvertise); got != want {
+		t.Fatalf("unexpected reply type: got %d, want %d", got, want)
+	}
+	offered := delegated(t, adv)
+	if got, want := len(offered.prefixes), 1; got != want {
+		t.Fatalf("unexpected number of prefixes: got %d, want %d", got, want)
+	}
+	// The first /60 contains the LAN’s /64 and is not delegated.
+	if got, want := offered.prefixes[0].prefix.String(), "2001:db8:4a00:10::/60"; got != want {
+		t.Errorf("unexpected prefix: got %v, want %v", got, want)
+	}
+	if leases != nil {
+		t.Fatalf("Solicit unexpectedly resulted in a lease")
+	}
+
+	reply := serve(t, h, request(msgRequest, option{code: optServerID, data: serverID}, offered.marshal()))
+	if got, want := reply.typ, byte(msgReply); got != want {
+		t.Fatalf("unexpected reply type: got %d, want %d", got, want)
+	}
+	if got, want := delegated(t, reply).prefixes[0].prefix.String(), "2001:db8:4a00:10::/60"; got != want {
+		t.Errorf("unexpected prefix: got %v, want %v", got, want)
+	}
+	if got, want := len(leases), 1; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+	if got, want := leases[0].NextHop, peer; !got.Equal(want) {
+		t.Errorf("unexpected next hop: got %v, want %v", got, want)
+	}
+
+	// A different IA of the same client is delegated the next prefix.
+	reply = serve(t, h, request(msgRequest, option{code: optServerID, data: serverID}, (&iaPD{iaid: 2}).marshal()))
+	if got, want := delegated(t, reply).prefixes[0].prefix.String(), "2001:db8:4a00:20::/60"; got != want {
+		t.Errorf("unexpected prefix: got %v, want %v", got, want)
+	}
+
+	// Messages for other servers are ignored.
+	if b, _ := h.ServeDHCPv6(request(msgRenew, option{code: optServerID, data: clientID}, ia), peer); b != nil {
+		t.Errorf("Renew for other server unexpectedly answered")
+	}
+
+	later := time.Now().Add(30 * time.Minute)
+	h.timeNow = func() time.Time { return later }
+	serve(t, h, request(msgRenew, option{code: optServerID, data: serverID}, ia))
+	if got, want := leases[0].Expiry, later.Add(validLifetime); !got.Equal(want) {
+		t.Errorf("Renew did not extend lease: got %v, want %v", got, want)
+	}
+
+	serve(t, h, request(msgRelease, option{code: optServerID, data: serverID}, ia))
+	if got, want := len(leases), 1; got != want {
+		t.Fatalf("unexpected number of leases after Release: got %d, want %d", got, want)
+	}
+}
+
+func TestRapidCommit(t *testing.T) {
+	h := testHandler(t)
+	var leases []*Lease
+	h.Leases = func(l []*Lease) { leases = l }
+	reply := serve(t, h, request(msgSolicit, option{code: optRapidCommit}, (&iaPD{iaid: 1}).marshal()))
+	if got, want := reply.typ, byte(msgReply); got != want {
+		t.Fatalf("unexpected reply type: got %d, want %d", got, want)
+	}
+	if got, want := len(leases), 1; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+}
+
+func TestPrefixChange(t *testing.T) {
+	h := testHandler(t)
+	serve(t, h, request(msgSolicit, option{code: optRapidCommit}, (&iaPD{iaid: 1}).marshal()))
+
+	_, prefix, err := net.ParseCIDR("2001:db8:4b00::/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetPrefix(*prefix); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(h.leases); got != 0 {
+		t.Fatalf("leases of the previous prefix unexpectedly retained: %d", got)
+	}
+	reply := serve(t, h, request(msgSolicit, option{code: optRapidCommit}, (&iaPD{iaid: 1}).marshal()))
+	if got, want := delegated(t, reply).prefixes[0].prefix.String(), "2001:db8:4b00:10::/60"; got != want {
+		t.Errorf("unexpected prefix: got %v, want %v", got, want)
+	}
+
+	_, tiny, _ := net.ParseCIDR("2001:db8:4c00::/64")
+	if err := h.SetPrefix(*tiny); err == nil {
+		t.Errorf("SetPrefix(%v) unexpectedly succeeded", tiny)
+	}
+}
+
+func TestNoPrefix(t *testing.T) {
+	h, err := NewHandler(serverID, &Config{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adv := serve(t, h, request(msgSolicit, (&iaPD{iaid: 1}).marshal()))
+	ia := delegated(t, adv)
+	if ia.status == nil && len(ia.prefixes) > 0 {
+		t.Errorf("prefix unexpectedly offered without a delegated prefix")
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp6d
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Message types, see RFC 8415, section 7.3.
+const (
+	msgSolicit   = 1
+	msgAdvertise = 2
+	msgRequest   = 3
+	msgRenew     = 5
+	msgRebind    = 6
+	msgReply     = 7
+	msgRelease   = 8
+)
+
+// Option codes, see RFC 8415, section 21.
+const (
+	optClientID    = 1
+	optServerID    = 2
+	optStatusCode  = 13
+	optRapidCommit = 14
+	optIAPD        = 25
+	optIAPrefix    = 26
+)
+
+// Status codes, see RFC 8415, section 21.13.
+const (
+	statusSuccess       = 0
+	statusNoBinding     = 3
+	statusNoPrefixAvail = 6
+)
+
+type option struct {
+	code uint16
+	data []byte
+}
+
+func parseOptions(b []byte) ([]option, error) {
+	var opts []option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated option header")
+		}
+		code := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < length {
+			return nil, fmt.Errorf("option %d: truncated (%d bytes, want %d)", code, len(b), length)
+		}
+		opts = append(opts, option{code: code, data: b[:length]})
+		b = b[length:]
+	}
+	return opts, nil
+}
+
+func marshalOptions(opts []option) []byte {
+	var b []byte
+	for _, o := range opts {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-4:], o.code)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(o.data)))
+		b = append(b, o.data...)
+	}
+	return b
+}
+
+// message is a DHCPv6 client/server message (relay messages are not
+// supported).
+type message struct {
+	typ     byte
+	xid     [3]byte
+	options []option
+}
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("message too short (%d bytes)", len(b))
+	}
+	m := &message{typ: b[0]}
+	copy(m.xid[:], b[1:4])
+	var err error
+	if m.options, err = parseOptions(b[4:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *message) marshal() []byte {
+	return append([]byte{m.typ, m.xid[0], m.xid[1], m.xid[2]}, marshalOptions(m.options)...)
+}
+
+// option returns the data of the first option with the specified code, or nil.
+func (m *message) option(code uint16) []byte {
+	for _, o := range m.options {
+		if o.code == code {
+			return o.data
+		}
+	}
+	return nil
+}
+
+func (m *message) hasOption(code uint16) bool {
+	for _, o := range m.options {
+		if o.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// iaPD is an Identity Association for Prefix Delegation (RFC 8415, section
+// 21.21).
+type iaPD struct {
+	iaid     uint32
+	t1, t2   uint32 // seconds
+	prefixes []iaPrefix
+	status   *statusCode
+}
+
+// iaPrefix is an IA Prefix option (RFC 8415, section 21.22).
+type iaPrefix struct {
+	preferred, valid uint32 // seconds
+	prefix           net.IPNet
+}
+
+type statusCode struct {
+	code    uint16
+	message string
+}
+
+func (s *statusCode) marshal() option {
+	data := make([]byte, 2, 2+len(s.message))
+	binary.BigEndian.PutUint16(data, s.code)
+	return option{code: optStatusCode, data: append(data, s.message...)}
+}
+
+func parseIAPD(b []byte) (*iaPD, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("IA_PD too short (%d bytes)", len(b))
+	}
+	ia := &iaPD{
+		iaid: binary.BigEndian.Uint32(b),
+		t1:   binary.BigEndian.Uint32(b[4:]),
+		t2:   binary.BigEndian.Uint32(b[8:]),
+	}
+	opts, err := parseOptions(b[12:])
+	if err != nil {
+		return nil, fmt.Errorf("IA_PD: %v", err)
+	}
+	for _, o := range opts {
+		if o.code != optIAPrefix {
+			continue
+		}
+		if len(o.data) < 25 {
+			return nil, fmt.Errorf("IA Prefix too short (%d bytes)", len(o.data))
+		}
+		length := int(o.data[8])
+		if length > 128 {
+			return nil, fmt.Errorf("IA Prefix: invalid prefix length %d", length)
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, o.data[9:25])
+		mask := net.CIDRMask(length, 128)
+		ia.prefixes = append(ia.prefixes, iaPrefix{
+			preferred: binary.BigEndian.Uint32(o.data),
+			valid:     binary.BigEndian.Uint32(o.data[4:]),
+			prefix:    net.IPNet{IP: ip.Mask(mask), Mask: mask},
+		})
+	}
+	return ia, nil
+}
+
+func (ia *iaPD) marshal() option {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, ia.iaid)
+	binary.BigEndian.PutUint32(data[4:], ia.t1)
+	binary.BigEndian.PutUint32(data[8:], ia.t2)
+	var opts []option
+	for _, p := range ia.prefixes {
+		b := make([]byte, 25)
+		binary.BigEndian.PutUint32(b, p.preferred)
+		binary.BigEndian.PutUint32(b[4:], p.valid)
+		ones, _ := p.prefix.Mask.Size()
+		b[8] = byte(ones)
+		copy(b[9:], p.prefix.IP.To16())
+		opts = append(opts, option{code: optIAPrefix, data: b})
+	}
+	if ia.status != nil {
+		opts = append(opts, ia.status.marshal())
+	}
+	return option{code: optIAPD, data: append(data, marshalOptions(opts)...)}
+}
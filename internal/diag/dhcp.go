@@ -55,6 +55,10 @@ func (d *dhcpv4) Children() []Node {
 	return d.children
 }
 
+func (d *dhcpv4) Layer() Layer {
+	return LayerDHCP
+}
+
 func (d *dhcpv4) Evaluate() (string, error) {
 	return leaseValid("/perm/dhcp4/wire/lease.json")
 }
@@ -82,6 +86,10 @@ func (d *dhcpv6) Children() []Node {
 	return d.children
 }
 
+func (d *dhcpv6) Layer() Layer {
+	return LayerDHCP
+}
+
 func (d *dhcpv6) Evaluate() (string, error) {
 	return leaseValid("/perm/dhcp6/wire/lease.json")
 }
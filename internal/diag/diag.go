@@ -23,6 +23,24 @@ type Node interface {
 	Evaluate() (status string, _ error)
 }
 
+// Layer classifies nodes by what they check, so that monitoring can pinpoint
+// which layer of the dependency graph (link → DHCP → default route → DNS →
+// internet) is broken.
+type Layer string
+
+const (
+	LayerLink     Layer = "link"
+	LayerDHCP     Layer = "dhcp" // address configuration (DHCP or SLAAC)
+	LayerRoute    Layer = "route"
+	LayerDNS      Layer = "dns"
+	LayerInternet Layer = "internet"
+)
+
+// layered is implemented by all nodes in this package.
+type layered interface {
+	Layer() Layer
+}
+
 type Monitor struct {
 	root Node
 }
@@ -32,10 +50,19 @@ func NewMonitor(n Node) *Monitor {
 }
 
 type EvalResult struct {
-	Name     string
-	Error    bool
-	Status   string
-	Children []*EvalResult
+	Name     string        `json:"name"`
+	Layer    Layer         `json:"layer,omitempty"`
+	Error    bool          `json:"error"`
+	Status   string        `json:"status"`
+	Children []*EvalResult `json:"children,omitempty"`
+}
+
+// Walk calls fn for r and all of its (transitive) children, parents first.
+func (r *EvalResult) Walk(fn func(*EvalResult)) {
+	fn(r)
+	for _, ch := range r.Children {
+		ch.Walk(fn)
+	}
 }
 
 func evaluate(n Node, err string) *EvalResult {
@@ -44,6 +71,9 @@ func evaluate(n Node, err string) *EvalResult {
 		Status: err,
 		Error:  err != "",
 	}
+	if l, ok := n.(layered); ok {
+		r.Layer = l.Layer()
+	}
 	if r.Status == "" {
 		status, err := n.Evaluate()
 		if err != nil {
@@ -38,11 +38,13 @@ func TestDiagMonitor(t *testing.T) {
 	got := m.Evaluate()
 	want := &diag.EvalResult{
 		Name:   "link/nonexistant",
+		Layer:  diag.LayerLink,
 		Error:  true,
 		Status: "Link not found",
 		Children: []*diag.EvalResult{
 			{
 				Name:   "dhcp4",
+				Layer:  diag.LayerDHCP,
 				Error:  true,
 				Status: "dependency link/nonexistant failed",
 			},
@@ -0,0 +1,65 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type dnsLookup struct {
+	children []Node
+	name     string
+}
+
+func (d *dnsLookup) String() string {
+	return "dns/" + d.name
+}
+
+func (d *dnsLookup) Then(t Node) Node {
+	d.children = append(d.children, t)
+	return d
+}
+
+func (d *dnsLookup) Children() []Node {
+	return d.children
+}
+
+func (d *dnsLookup) Layer() Layer {
+	return LayerDNS
+}
+
+func (d *dnsLookup) Evaluate() (string, error) {
+	const timeout = 2 * time.Second
+	ctx, canc := context.WithTimeout(context.Background(), timeout)
+	defer canc()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses for %s", d.name)
+	}
+	return strings.Join(addrs, ", "), nil
+}
+
+// DNS returns a Node which succeeds when name can be resolved using the system
+// resolver (i.e. router7’s dnsd and its upstream servers).
+func DNS(name string) Node {
+	return &dnsLookup{name: name}
+}
@@ -39,6 +39,10 @@ func (l *link) Children() []Node {
 	return l.children
 }
 
+func (l *link) Layer() Layer {
+	return LayerLink
+}
+
 func (l *link) Evaluate() (string, error) {
 	link, err := netlink.LinkByName(l.ifname)
 	if err != nil {
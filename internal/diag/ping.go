@@ -46,6 +46,10 @@ func (d *ping4gw) Children() []Node {
 	return d.children
 }
 
+func (d *ping4gw) Layer() Layer {
+	return LayerRoute
+}
+
 func defaultIPv4Gateway() (string, error) {
 	rl, err := netlink.RouteGet(net.ParseIP("8.8.8.8"))
 	if err != nil {
@@ -63,7 +67,7 @@ func (d *ping4gw) Evaluate() (string, error) {
 	const timeout = 1 * time.Second
 	gw, err := defaultIPv4Gateway()
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	addr, err := net.ResolveIPAddr("ip4", gw)
 	if err != nil {
@@ -105,6 +109,10 @@ func (d *ping4) Children() []Node {
 	return d.children
 }
 
+func (d *ping4) Layer() Layer {
+	return LayerInternet
+}
+
 func (d *ping4) Evaluate() (string, error) {
 	const timeout = 1 * time.Second
 	addr, err := net.ResolveIPAddr("ip4", d.addr)
@@ -146,6 +154,10 @@ func (d *ping6gw) Children() []Node {
 	return d.children
 }
 
+func (d *ping6gw) Layer() Layer {
+	return LayerRoute
+}
+
 func defaultIPv6Gateway() (string, error) {
 	rl, err := netlink.RouteGet(net.IPv6zero)
 	if err != nil {
@@ -212,6 +224,13 @@ func (d *ping6) Children() []Node {
 	return d.children
 }
 
+func (d *ping6) Layer() Layer {
+	if strings.HasPrefix(d.addr, "ff02::") {
+		return LayerRoute // link-local multicast, e.g. all routers
+	}
+	return LayerInternet
+}
+
 func (d *ping6) Evaluate() (string, error) {
 	const timeout = 1 * time.Second
 	addr, err := net.ResolveIPAddr("ip6", d.addr)
@@ -0,0 +1,324 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/digineo/go-ping"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// probeTimeout is how long to wait for a reply to each individual probe.
+const probeTimeout = 1 * time.Second
+
+// StreamPing sends count ICMP echo requests to target (resolved within network,
+// i.e. ip4 or ip6), one per second, and writes one line per reply to w,
+// followed by a summary.
+func StreamPing(ctx context.Context, w io.Writer, network, target string, count int) error {
+	addr, err := net.ResolveIPAddr(network, target)
+	if err != nil {
+		return err
+	}
+	pc, err := newProbeConn(network)
+	if err != nil {
+		return err
+	}
+	defer pc.conn.Close()
+
+	fmt.Fprintf(w, "PING %s (%s)\n", target, addr)
+	var (
+		received int
+		total    time.Duration
+	)
+	id := nextProbeID()
+	for seq := 1; seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(1 * time.Second):
+			}
+		}
+		peer, rtt, final, err := pc.probe(ctx, addr, 64, id, seq&0xffff)
+		if err != nil {
+			return err
+		}
+		switch {
+		case peer == nil:
+			fmt.Fprintf(w, "seq=%d: timeout\n", seq)
+			continue
+		case !final:
+			fmt.Fprintf(w, "seq=%d: time exceeded (from %s)\n", seq, peer)
+			continue
+		case peer.String() != addr.String():
+			fmt.Fprintf(w, "seq=%d: destination unreachable (from %s)\n", seq, peer)
+			continue
+		}
+		received++
+		total += rtt
+		fmt.Fprintf(w, "seq=%d time=%s\n", seq, formatRTT(rtt))
+	}
+	fmt.Fprintf(w, "%d packets transmitted, %d received, %d%% packet loss",
+		count, received, 100*(count-received)/count)
+	if received > 0 {
+		fmt.Fprintf(w, ", avg %s", formatRTT(total/time.Duration(received)))
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+// PingStats sends count ICMP echo requests to target (resolved within
+// network), one per second, and returns the number of replies received and
+// their average round-trip time.
+func PingStats(ctx context.Context, network, target string, count int) (received int, avg time.Duration, _ error) {
+	addr, err := net.ResolveIPAddr(network, target)
+	if err != nil {
+		return 0, 0, err
+	}
+	bind4, bind6 := "0.0.0.0", ""
+	if network == "ip6" {
+		bind4, bind6 = "", "::"
+	}
+	p, err := ping.New(bind4, bind6)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer p.Close()
+
+	var total time.Duration
+	for seq := 1; seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+				return 0, 0, ctx.Err()
+			case <-time.After(1 * time.Second):
+			}
+		}
+		pctx, canc := context.WithTimeout(ctx, probeTimeout)
+		rtt, err := p.PingContext(pctx, addr)
+		canc()
+		if err != nil {
+			continue
+		}
+		received++
+		total += rtt
+	}
+	if received > 0 {
+		avg = total / time.Duration(received)
+	}
+	return received, avg, nil
+}
+
+// lastProbeID is the most recently allocated ICMP echo identifier offset, see
+// nextProbeID.
+var lastProbeID uint32
+
+// nextProbeID returns the ICMP echo identifier for a StreamPing or Traceroute
+// call. All raw ICMP sockets receive all echo replies, so concurrent calls
+// (e.g. several /ping requests) tell their replies apart by identifier. The
+// process ID keeps identifiers of different processes apart.
+func nextProbeID() int {
+	return (os.Getpid() + int(atomic.AddUint32(&lastProbeID, 1))) & 0xffff
+}
+
+type probeConn struct {
+	conn        *icmp.PacketConn
+	proto       int // IANA protocol number for icmp.ParseMessage
+	headerLen   int // length of the IP header quoted in ICMP errors
+	echo        icmp.Type
+	reply       icmp.Type
+	exceeded    icmp.Type
+	unreach     icmp.Type
+	setHopLimit func(int) error
+}
+
+func newProbeConn(network string) (*probeConn, error) {
+	if network == "ip6" {
+		conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+		if err != nil {
+			return nil, err
+		}
+		return &probeConn{
+			conn:        conn,
+			proto:       58,
+			headerLen:   40,
+			echo:        ipv6.ICMPTypeEchoRequest,
+			reply:       ipv6.ICMPTypeEchoReply,
+			exceeded:    ipv6.ICMPTypeTimeExceeded,
+			unreach:     ipv6.ICMPTypeDestinationUnreachable,
+			setHopLimit: conn.IPv6PacketConn().SetHopLimit,
+		}, nil
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	return &probeConn{
+		conn:        conn,
+		proto:       1,
+		headerLen:   -1, // variable, see quotedEcho
+		echo:        ipv4.ICMPTypeEcho,
+		reply:       ipv4.ICMPTypeEchoReply,
+		exceeded:    ipv4.ICMPTypeTimeExceeded,
+		unreach:     ipv4.ICMPTypeDestinationUnreachable,
+		setHopLimit: conn.IPv4PacketConn().SetTTL,
+	}, nil
+}
+
+// quotedEcho extracts the ICMP echo identifier and sequence number from the
+// original datagram which ICMP error messages quote (IP header plus at least
+// the first 8 bytes of the ICMP message).
+func quotedEcho(data []byte, headerLen int) (id, seq int, ok bool) {
+	if headerLen == -1 {
+		// IPv4 header length varies with options.
+		if len(data) < 1 {
+			return 0, 0, false
+		}
+		headerLen = int(data[0]&0x0f) * 4
+	}
+	if len(data) < headerLen+8 {
+		return 0, 0, false
+	}
+	icmpHdr := data[headerLen:]
+	return int(binary.BigEndian.Uint16(icmpHdr[4:])), int(binary.BigEndian.Uint16(icmpHdr[6:])), true
+}
+
+// probe sends one ICMP echo request with the specified hop limit and returns
+// the address which replied, and whether that address is the destination.
+func (pc *probeConn) probe(ctx context.Context, dst *net.IPAddr, hopLimit, id, seq int) (peer net.Addr, rtt time.Duration, final bool, _ error) {
+	if err := pc.setHopLimit(hopLimit); err != nil {
+		return nil, 0, false, err
+	}
+	msg := icmp.Message{
+		Type: pc.echo,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: []byte("router7 diagd"),
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	start := time.Now()
+	if _, err := pc.conn.WriteTo(b, dst); err != nil {
+		return nil, 0, false, err
+	}
+	deadline := start.Add(probeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := pc.conn.SetReadDeadline(deadline); err != nil {
+		return nil, 0, false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := pc.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, 0, false, nil // lost
+			}
+			return nil, 0, false, err
+		}
+		rtt := time.Since(start)
+		m, err := icmp.ParseMessage(pc.proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		switch m.Type {
+		case pc.reply:
+			if echo, ok := m.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+				return peer, rtt, true, nil
+			}
+		case pc.exceeded, pc.unreach:
+			var data []byte
+			switch body := m.Body.(type) {
+			case *icmp.TimeExceeded:
+				data = body.Data
+			case *icmp.DstUnreach:
+				data = body.Data
+			}
+			if qid, qseq, ok := quotedEcho(data, pc.headerLen); ok && qid == id && qseq == seq {
+				return peer, rtt, m.Type == pc.unreach, nil
+			}
+		}
+	}
+}
+
+// Traceroute discovers the path to target (resolved within network, i.e. ip4
+// or ip6) by sending probes ICMP echo requests per hop with increasing hop
+// limits. For each hop, it writes the responding address, the packet loss and
+// the average round-trip time to w, similar to mtr(8) in report mode.
+func Traceroute(ctx context.Context, w io.Writer, network, target string, maxHops, probes int) error {
+	dst, err := net.ResolveIPAddr(network, target)
+	if err != nil {
+		return err
+	}
+	pc, err := newProbeConn(network)
+	if err != nil {
+		return err
+	}
+	defer pc.conn.Close()
+
+	fmt.Fprintf(w, "traceroute to %s (%s), %d hops max, %d probes per hop\n", target, dst, maxHops, probes)
+	id := nextProbeID()
+	seq := 0
+	for hop := 1; hop <= maxHops; hop++ {
+		var (
+			peer     net.Addr
+			received int
+			total    time.Duration
+			reached  bool
+		)
+		for i := 0; i < probes; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			seq++
+			p, rtt, final, err := pc.probe(ctx, dst, hop, id, seq&0xffff)
+			if err != nil {
+				return err
+			}
+			if p == nil {
+				continue // lost
+			}
+			peer = p
+			received++
+			total += rtt
+			reached = reached || final
+		}
+		if peer == nil {
+			fmt.Fprintf(w, "%2d. ???\t100%% loss\n", hop)
+			continue
+		}
+		fmt.Fprintf(w, "%2d. %s\t%d%% loss, avg %s\n",
+			hop, peer, 100*(probes-received)/probes, formatRTT(total/time.Duration(received)))
+		if reached {
+			return nil
+		}
+	}
+	return nil
+}
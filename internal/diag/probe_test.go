@@ -0,0 +1,70 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestQuotedEcho(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 0x1234, Seq: 42},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IPv4 header with IHL=6 (one 4-byte option)
+	hdr := make([]byte, 24)
+	hdr[0] = 0x46
+	id, seq, ok := quotedEcho(append(hdr, b...), -1)
+	if !ok {
+		t.Fatalf("quotedEcho(ipv4) = !ok, want ok")
+	}
+	if got, want := id, 0x1234; got != want {
+		t.Errorf("unexpected id: got %#x, want %#x", got, want)
+	}
+	if got, want := seq, 42; got != want {
+		t.Errorf("unexpected seq: got %d, want %d", got, want)
+	}
+
+	id, seq, ok = quotedEcho(append(make([]byte, 40), b...), 40)
+	if !ok || id != 0x1234 || seq != 42 {
+		t.Errorf("quotedEcho(ipv6) = %#x, %d, %v, want 0x1234, 42, true", id, seq, ok)
+	}
+
+	if _, _, ok := quotedEcho(hdr[:10], 40); ok {
+		t.Errorf("quotedEcho(truncated) = ok, want !ok")
+	}
+}
+
+func TestNextProbeID(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		id := nextProbeID()
+		if id < 0 || id > 0xffff {
+			t.Fatalf("nextProbeID() = %d, want a 16-bit identifier", id)
+		}
+		if seen[id] {
+			t.Fatalf("nextProbeID() = %d, which was already allocated", id)
+		}
+		seen[id] = true
+	}
+}
@@ -37,6 +37,10 @@ func (d *ra6) Children() []Node {
 	return d.children
 }
 
+func (d *ra6) Layer() Layer {
+	return LayerDHCP
+}
+
 func isEUI64(ip net.IP) bool {
 	if ip.To16() == nil {
 		return false
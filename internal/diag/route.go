@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+type route4 struct {
+	children []Node
+}
+
+func (d *route4) String() string {
+	return "route4/default"
+}
+
+func (d *route4) Then(t Node) Node {
+	d.children = append(d.children, t)
+	return d
+}
+
+func (d *route4) Children() []Node {
+	return d.children
+}
+
+func (d *route4) Layer() Layer {
+	return LayerRoute
+}
+
+func (d *route4) Evaluate() (string, error) {
+	gw, err := defaultIPv4Gateway()
+	if err != nil {
+		return "", err
+	}
+	return "via " + gw, nil
+}
+
+// DefaultRoute4 returns a Node which succeeds when there is an IPv4 default
+// route.
+func DefaultRoute4() Node {
+	return &route4{}
+}
+
+type route6 struct {
+	children []Node
+}
+
+func (d *route6) String() string {
+	return "route6/default"
+}
+
+func (d *route6) Then(t Node) Node {
+	d.children = append(d.children, t)
+	return d
+}
+
+func (d *route6) Children() []Node {
+	return d.children
+}
+
+func (d *route6) Layer() Layer {
+	return LayerRoute
+}
+
+func (d *route6) Evaluate() (string, error) {
+	gw, err := defaultIPv6Gateway()
+	if err != nil {
+		return "", err
+	}
+	return "via " + gw, nil
+}
+
+// DefaultRoute6 returns a Node which succeeds when there is an IPv6 default
+// route.
+func DefaultRoute6() Node {
+	return &route6{}
+}
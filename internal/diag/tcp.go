@@ -36,6 +36,10 @@ func (d *tcp4) Children() []Node {
 	return d.children
 }
 
+func (d *tcp4) Layer() Layer {
+	return LayerInternet
+}
+
 func (d *tcp4) Evaluate() (string, error) {
 	conn, err := net.Dial("tcp4", d.addr)
 	if err != nil {
@@ -69,6 +73,10 @@ func (d *tcp6) Children() []Node {
 	return d.children
 }
 
+func (d *tcp6) Layer() Layer {
+	return LayerInternet
+}
+
 func (d *tcp6) Evaluate() (string, error) {
 	conn, err := net.Dial("tcp6", d.addr)
 	if err != nil {
@@ -0,0 +1,168 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package disk reports the usage, write activity and (on eMMC devices) wear of
+// the file system holding router7’s persistent data, which is typically on a
+// small flash device.
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Usage describes the capacity of a file system.
+type Usage struct {
+	Size uint64 // bytes
+	Free uint64 // bytes available to unprivileged users
+}
+
+// Percent returns the used percentage of the file system.
+func (u Usage) Percent() float64 {
+	if u.Size == 0 {
+		return 0
+	}
+	return 100 * float64(u.Size-u.Free) / float64(u.Size)
+}
+
+// StatUsage returns the usage of the file system containing dir.
+func StatUsage(dir string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		Size: st.Blocks * uint64(st.Bsize),
+		Free: st.Bavail * uint64(st.Bsize),
+	}, nil
+}
+
+// Device returns the name of the block device (e.g. “mmcblk0p4”) of the file
+// system mounted at dir, based on mounts (in /proc/self/mounts format).
+func Device(mounts io.Reader, dir string) (string, error) {
+	var dev string
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1] != dir {
+			continue
+		}
+		if !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		dev = strings.TrimPrefix(fields[0], "/dev/") // the last mount wins
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if dev == "" {
+		return "", fmt.Errorf("no block device mounted at %s", dir)
+	}
+	return dev, nil
+}
+
+// Written returns the number of bytes written to dev since boot, based on
+// diskstats (in /proc/diskstats format).
+func Written(diskstats io.Reader, dev string) (uint64, error) {
+	scanner := bufio.NewScanner(diskstats)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// major minor name reads merged sectors ms writes merged sectors …
+		if len(fields) < 10 || fields[2] != dev {
+			continue
+		}
+		sectors, err := strconv.ParseUint(fields[9], 0, 64)
+		if err != nil {
+			return 0, err
+		}
+		return sectors * 512, nil // diskstats always counts 512 byte sectors
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("device %s not found in diskstats", dev)
+}
+
+// Wear describes the health of an eMMC device, as reported by its
+// EXT_CSD_DEVICE_LIFE_TIME_EST and EXT_CSD_PRE_EOL_INFO registers.
+type Wear struct {
+	// LifeTimeA and LifeTimeB estimate the used percentage of the device’s
+	// life time (for SLC and MLC memory, respectively) in steps of 10%,
+	// e.g. 20 means 10–20% used. Values above 100 mean that the estimated
+	// life time was exceeded.
+	LifeTimeA int
+	LifeTimeB int
+
+	// PreEOL is 1 (normal), 2 (warning: 80% of reserved blocks consumed) or 3
+	// (urgent).
+	PreEOL int
+}
+
+func readHex(fn string) ([]int, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var vals []int
+	for _, f := range strings.Fields(string(b)) {
+		v, err := strconv.ParseInt(f, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		vals = append(vals, int(v))
+	}
+	return vals, nil
+}
+
+// ReadWear returns the wear of the device containing dev (e.g. “mmcblk0p4”)
+// from sysfs (usually /sys), or nil if the device does not report its wear
+// (e.g. because it is not an eMMC device).
+func ReadWear(sysfs, dev string) (*Wear, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysfs, "class", "block", dev))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		dir = filepath.Dir(dir) // the disk containing the partition
+	}
+	lifeTime, err := readHex(filepath.Join(dir, "device", "life_time"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(lifeTime) != 2 {
+		return nil, fmt.Errorf("unexpected life_time format: %v", lifeTime)
+	}
+	preEOL, err := readHex(filepath.Join(dir, "device", "pre_eol_info"))
+	if err != nil {
+		return nil, err
+	}
+	if len(preEOL) != 1 {
+		return nil, fmt.Errorf("unexpected pre_eol_info format: %v", preEOL)
+	}
+	return &Wear{
+		LifeTimeA: 10 * lifeTime[0],
+		LifeTimeB: 10 * lifeTime[1],
+		PreEOL:    preEOL[0],
+	}, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rtr7/router7/internal/disk"
+)
+
+const mounts = `/dev/root / squashfs ro,relatime 0 0
+devtmpfs /dev devtmpfs rw,relatime,size=1923268k,nr_inodes=480817,mode=755 0 0
+proc /proc proc rw,relatime 0 0
+/dev/mmcblk0p4 /perm ext4 rw,relatime 0 0
+`
+
+const diskstats = `   1       0 ram0 0 0 0 0 0 0 0 0 0 0 0
+ 179       0 mmcblk0 5338 2171 502318 5716 22402 25303 743936 107124 0 40092 112844
+ 179       1 mmcblk0p1 141 0 9152 116 0 0 0 0 0 216 116
+ 179       4 mmcblk0p4 1120 2141 34518 2160 22402 25303 743928 107124 0 38732 109280
+`
+
+func TestDevice(t *testing.T) {
+	dev, err := disk.Device(strings.NewReader(mounts), "/perm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dev, "mmcblk0p4"; got != want {
+		t.Fatalf("Device(/perm) = %q, want %q", got, want)
+	}
+	if _, err := disk.Device(strings.NewReader(mounts), "/tmp"); err == nil {
+		t.Errorf("Device(/tmp) unexpectedly succeeded")
+	}
+
+	written, err := disk.Written(strings.NewReader(diskstats), dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := written, uint64(743928*512); got != want {
+		t.Errorf("Written(%s) = %d, want %d", dev, got, want)
+	}
+}
+
+func TestReadWear(t *testing.T) {
+	sysfs, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysfs)
+
+	// Mirror the sysfs layout: /sys/class/block entries are symlinks into
+	// /sys/devices, where partitions are subdirectories of their disk.
+	mmc := filepath.Join(sysfs, "devices", "mmc0:0001", "block", "mmcblk0")
+	for fn, contents := range map[string]string{
+		"mmcblk0p4/partition": "4\n",
+		"device/life_time":    "0x02 0x01\n",
+		"device/pre_eol_info": "0x01\n",
+		"mmcblk0p4/size":      "30000000\n",
+	} {
+		fn = filepath.Join(mmc, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"class/block", "devices/sda"} {
+		if err := os.MkdirAll(filepath.Join(sysfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for dev, target := range map[string]string{
+		"mmcblk0p4": filepath.Join(mmc, "mmcblk0p4"),
+		"sda":       filepath.Join(sysfs, "devices", "sda"),
+	} {
+		if err := os.Symlink(target, filepath.Join(sysfs, "class", "block", dev)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wear, err := disk.ReadWear(sysfs, "mmcblk0p4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &disk.Wear{LifeTimeA: 20, LifeTimeB: 10, PreEOL: 1}
+	if diff := cmp.Diff(want, wear); diff != "" {
+		t.Errorf("ReadWear: unexpected result: diff (-want +got):\n%s", diff)
+	}
+
+	wear, err = disk.ReadWear(sysfs, "sda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wear != nil {
+		t.Errorf("ReadWear(sda) = %+v, want nil", wear)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/renameio"
+	"github.com/miekg/dns"
+)
+
+// ACMEConfig configures the ACME DNS-01 responder, see ACME.
+type ACMEConfig struct {
+	// Domain is the zone in which challenge records are published, e.g.
+	// acme.example.com. It must be delegated (NS record) to router7’s
+	// public address.
+	Domain string `json:"domain"`
+
+	// Nameserver is the name of the NS record delegating Domain, defaults
+	// to ns.<Domain>.
+	Nameserver string `json:"nameserver"`
+}
+
+type acmeAccount struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"` // hex-encoded SHA-256
+	Subdomain    string   `json:"subdomain"`
+	AllowFrom    []string `json:"allowfrom"`
+	TXT          []string `json:"txt"` // at most 2, most recent last
+}
+
+// ACME answers _acme-challenge TXT records for ACME DNS-01 validation (RFC
+// 8555), so that LAN services can obtain certificates (e.g. from Let’s
+// Encrypt) without being reachable from the internet. The HTTP API is
+// compatible with acme-dns (https://github.com/joohoi/acme-dns), which many
+// ACME clients support: a client registers an account, creates a CNAME from
+// _acme-challenge.<its domain> to the returned fulldomain and pushes challenge
+// tokens via the update endpoint.
+type ACME struct {
+	stateFile string
+
+	mu       sync.Mutex
+	domain   string // lower-case, fully qualified
+	ns       string
+	accounts []acmeAccount
+}
+
+// NewACME returns an ACME responder which persists accounts in stateFile.
+func NewACME(stateFile string) (*ACME, error) {
+	a := &ACME{stateFile: stateFile}
+	b, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a.accounts); err != nil {
+		return nil, fmt.Errorf("%s: %v", stateFile, err)
+	}
+	return a, nil
+}
+
+// SetConfig applies cfg and returns the (fully qualified) domain to serve, or
+// the empty string if cfg is nil.
+func (a *ACME) SetConfig(cfg *ACMEConfig) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cfg == nil || cfg.Domain == "" {
+		a.domain = ""
+		return ""
+	}
+	a.domain = strings.ToLower(dns.Fqdn(cfg.Domain))
+	a.ns = dns.Fqdn(cfg.Nameserver)
+	if cfg.Nameserver == "" {
+		a.ns = "ns." + a.domain
+	}
+	return a.domain
+}
+
+// Domain returns the (fully qualified) domain to serve, or the empty string if
+// not configured.
+func (a *ACME) Domain() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.domain
+}
+
+func (a *ACME) persistLocked() error {
+	b, err := json.MarshalIndent(a.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.stateFile), 0700); err != nil {
+		return err
+	}
+	return renameio.WriteFile(a.stateFile, b, 0600)
+}
+
+func hashPassword(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// allowed returns whether remoteAddr is within one of the allowfrom networks.
+func allowed(allowFrom []string, remoteAddr string) bool {
+	if len(allowFrom) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, cidr := range allowFrom {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (a *ACME) register(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "malformed_json_payload"})
+			return
+		}
+	}
+	for _, cidr := range req.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_allowfrom_cidr"})
+			return
+		}
+	}
+	username, err := randomUUID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	subdomain, err := randomUUID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	password, err := randomString(30) // 40 characters
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.domain == "" {
+		http.Error(w, "acme not configured in dnsd.json", http.StatusServiceUnavailable)
+		return
+	}
+	a.accounts = append(a.accounts, acmeAccount{
+		Username:     username,
+		PasswordHash: hashPassword(password),
+		Subdomain:    subdomain,
+		AllowFrom:    req.AllowFrom,
+	})
+	if err := a.persistLocked(); err != nil {
+		a.accounts = a.accounts[:len(a.accounts)-1]
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.AllowFrom == nil {
+		req.AllowFrom = []string{}
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"username":   username,
+		"password":   password,
+		"fulldomain": subdomain + "." + strings.TrimSuffix(a.domain, "."),
+		"subdomain":  subdomain,
+		"allowfrom":  req.AllowFrom,
+	})
+}
+
+func (a *ACME) update(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "malformed_json_payload"})
+		return
+	}
+	user := r.Header.Get("X-Api-User")
+	hash := hashPassword(r.Header.Get("X-Api-Key"))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var acc *acmeAccount
+	for idx := range a.accounts {
+		if a.accounts[idx].Username == user {
+			acc = &a.accounts[idx]
+			break
+		}
+	}
+	if acc == nil ||
+		subtle.ConstantTimeCompare([]byte(acc.PasswordHash), []byte(hash)) != 1 ||
+		!allowed(acc.AllowFrom, r.RemoteAddr) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "forbidden"})
+		return
+	}
+	if req.Subdomain != acc.Subdomain {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "forbidden"})
+		return
+	}
+	// Key authorization digests are base64url-encoded SHA-256 hashes.
+	if len(req.TXT) != 43 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_txt"})
+		return
+	}
+	// Keep the previous value so that a certificate for both a domain and its
+	// wildcard (two challenges) can be validated.
+	acc.TXT = append(acc.TXT, req.TXT)
+	if len(acc.TXT) > 2 {
+		acc.TXT = acc.TXT[len(acc.TXT)-2:]
+	}
+	if err := a.persistLocked(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"txt": req.TXT})
+}
+
+// ServeHTTP implements the acme-dns API endpoints /register and /update.
+func (a *ACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "register":
+		a.register(w, r)
+	case "update":
+		a.update(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ServeDNS answers authoritatively for the ACME domain.
+func (a *ACME) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.domain == "" || !dns.IsSubDomain(a.domain, name) {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: a.domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 1},
+		Ns:      a.ns,
+		Mbox:    "hostmaster." + a.domain,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  1,
+	}
+	if name == a.domain {
+		switch q.Qtype {
+		case dns.TypeSOA:
+			m.Answer = append(m.Answer, soa)
+		case dns.TypeNS:
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: a.domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  a.ns,
+			})
+		default:
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+		return
+	}
+	var acc *acmeAccount
+	for idx := range a.accounts {
+		if a.accounts[idx].Subdomain+"."+a.domain == name {
+			acc = &a.accounts[idx]
+			break
+		}
+	}
+	if acc == nil {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soa)
+		w.WriteMsg(m)
+		return
+	}
+	if q.Qtype != dns.TypeTXT || len(acc.TXT) == 0 {
+		m.Ns = append(m.Ns, soa)
+		w.WriteMsg(m)
+		return
+	}
+	for _, txt := range acc.TXT {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+			Txt: []string{txt},
+		})
+	}
+	w.WriteMsg(m)
+}
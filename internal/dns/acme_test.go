@@ -0,0 +1,125 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestACME(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "dnsd", "acme.json")
+
+	a, err := NewACME(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.SetConfig(&ACMEConfig{Domain: "ACME.example.com"}), "acme.example.com."; got != want {
+		t.Fatalf("SetConfig: got %q, want %q", got, want)
+	}
+
+	post := func(path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/register", "", nil)
+	if got, want := rec.Code, http.StatusCreated; got != want {
+		t.Fatalf("register: unexpected status: got %d, want %d (%s)", got, want, rec.Body.String())
+	}
+	var account struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		Fulldomain string `json:"fulldomain"`
+		Subdomain  string `json:"subdomain"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &account); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := account.Fulldomain, account.Subdomain+".acme.example.com"; got != want {
+		t.Errorf("register: unexpected fulldomain: got %q, want %q", got, want)
+	}
+
+	const token = "LPsIwTo7o8BoG0-vjCyGQGBWSVIPxI-i_X336eUOQZo"
+	update := `{"subdomain": "` + account.Subdomain + `", "txt": "` + token + `"}`
+	rec = post("/update", update, map[string]string{
+		"X-Api-User": account.Username,
+		"X-Api-Key":  "wrong",
+	})
+	if got, want := rec.Code, http.StatusUnauthorized; got != want {
+		t.Errorf("update with wrong key: unexpected status: got %d, want %d", got, want)
+	}
+	rec = post("/update", update, map[string]string{
+		"X-Api-User": account.Username,
+		"X-Api-Key":  account.Password,
+	})
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("update: unexpected status: got %d, want %d (%s)", got, want, rec.Body.String())
+	}
+
+	// Accounts and records survive restarts:
+	a, err = NewACME(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetConfig(&ACMEConfig{Domain: "acme.example.com"})
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		r := &recorder{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		a.ServeDNS(r, m)
+		return r.response
+	}
+
+	resp := query(account.Fulldomain+".", dns.TypeTXT)
+	if got, want := len(resp.Answer), 1; got != want {
+		t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+	}
+	if got, want := resp.Answer[0].(*dns.TXT).Txt, []string{token}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("unexpected TXT record: got %q, want %q", got, want)
+	}
+	if !resp.Authoritative {
+		t.Errorf("answer unexpectedly not authoritative")
+	}
+
+	if got, want := query("unknown.acme.example.com.", dns.TypeTXT).Rcode, dns.RcodeNameError; got != want {
+		t.Errorf("unexpected rcode for unknown subdomain: got %v, want %v", got, want)
+	}
+	if got, want := query("www.example.com.", dns.TypeA).Rcode, dns.RcodeRefused; got != want {
+		t.Errorf("unexpected rcode outside of the ACME domain: got %v, want %v", got, want)
+	}
+	if got, want := len(query("acme.example.com.", dns.TypeNS).Answer), 1; got != want {
+		t.Errorf("unexpected number of NS answers: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHalfLife is the age after which upstream observations count
+	// half as much, unless configured otherwise.
+	defaultHalfLife = 10 * time.Minute
+
+	// failureCost is the expected latency of querying an upstream which
+	// does not answer: the dns.Client timeout, after which the next
+	// upstream is queried.
+	failureCost = 2 * time.Second
+
+	// alpha is the weight of a new observation in the moving averages.
+	alpha = 0.3
+
+	// minZoneSamples is the number of observations for a zone after which
+	// the per-zone statistics of an upstream are used instead of its
+	// overall statistics.
+	minZoneSamples = 3
+
+	// maxZones bounds the memory used for per-zone statistics: the least
+	// recently updated zone is forgotten first.
+	maxZones = 1000
+)
+
+// UpstreamConfig configures how upstream DNS servers are selected. By
+// default, the upstream with the lowest expected latency (learned from the
+// round-trip times and failures of recent queries) is queried first.
+type UpstreamConfig struct {
+	// PerZone additionally learns latencies per zone (the last two labels of
+	// the query name, e.g. “example.com”), for upstreams which answer some
+	// domains faster than others.
+	PerZone bool `json:"per_zone"`
+
+	// HalfLife is the age after which observations count half as much (e.g.
+	// “10m”, the default): older observations decay, so that upstreams
+	// which failed are tried again eventually.
+	HalfLife string `json:"half_life"`
+
+	// Pins override the learned order: the pinned upstream is queried
+	// first for the zone (and its subdomains, the longest zone wins), the
+	// remaining upstreams are queried if it fails. An empty zone pins the
+	// upstream for all queries.
+	Pins []UpstreamPin `json:"pins"`
+}
+
+// UpstreamPin pins an upstream (e.g. “9.9.9.9:53”) for a zone.
+type UpstreamPin struct {
+	Zone     string `json:"zone"`
+	Upstream string `json:"upstream"`
+}
+
+// UpstreamStat are the learned statistics of an upstream.
+type UpstreamStat struct {
+	RTT      time.Duration `json:"rtt"`      // moving average of answered queries
+	Failures float64       `json:"failures"` // moving average failure rate, 0 to 1
+	Samples  int           `json:"samples"`
+	Updated  time.Time     `json:"updated"`
+}
+
+// decay returns how much observations of age count.
+func decay(age, halfLife time.Duration) float64 {
+	if age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
+
+func (st *UpstreamStat) observe(rtt time.Duration, failed bool, now time.Time, halfLife time.Duration) {
+	var failure float64
+	if failed {
+		failure = 1
+	}
+	if st.Samples == 0 {
+		st.Failures = failure
+		if !failed {
+			st.RTT = rtt
+		}
+	} else {
+		// Older statistics count less than recent ones, so that a single
+		// query after a long time largely replaces them.
+		keep := (1 - alpha) * decay(now.Sub(st.Updated), halfLife)
+		st.Failures = keep*st.Failures + (1-keep)*failure
+		if !failed {
+			if st.RTT == 0 {
+				st.RTT = rtt
+			} else {
+				st.RTT = time.Duration(keep*float64(st.RTT) + (1-keep)*float64(rtt))
+			}
+		}
+	}
+	st.Samples++
+	st.Updated = now
+}
+
+// expected returns the expected latency of querying the upstream at now.
+// Failures fade with age, so that upstreams which failed are tried again.
+func (st *UpstreamStat) expected(now time.Time, halfLife time.Duration) time.Duration {
+	f := st.Failures * decay(now.Sub(st.Updated), halfLife)
+	return time.Duration((1-f)*float64(st.RTT) + f*float64(failureCost))
+}
+
+// zoneOf returns the zone of name for per-zone statistics: its last two
+// labels, lower case and fully qualified.
+func zoneOf(name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return dns.Fqdn(strings.Join(labels, "."))
+}
+
+type upstreamPin struct {
+	zone     string // lower case, fully qualified; "." for all queries
+	upstream string
+}
+
+// upstreamScheduler learns the latency and failure rate of upstreams and
+// orders them by expected latency.
+type upstreamScheduler struct {
+	mu       sync.Mutex
+	perZone  bool
+	halfLife time.Duration
+	pins     []upstreamPin // longest zone first
+	stats    map[string]*UpstreamStat
+	zones    map[string]map[string]*UpstreamStat // zone → upstream → stat
+
+	now func() time.Time // for tests
+}
+
+func newUpstreamScheduler() *upstreamScheduler {
+	return &upstreamScheduler{
+		halfLife: defaultHalfLife,
+		stats:    make(map[string]*UpstreamStat),
+		zones:    make(map[string]map[string]*UpstreamStat),
+		now:      time.Now,
+	}
+}
+
+func (u *upstreamScheduler) configure(cfg *UpstreamConfig) error {
+	halfLife := defaultHalfLife
+	var pins []upstreamPin
+	var perZone bool
+	if cfg != nil {
+		if cfg.HalfLife != "" {
+			var err error
+			halfLife, err = time.ParseDuration(cfg.HalfLife)
+			if err != nil {
+				return fmt.Errorf("upstream: half_life: %v", err)
+			}
+			if halfLife <= 0 {
+				return fmt.Errorf("upstream: half_life must be positive")
+			}
+		}
+		for _, p := range cfg.Pins {
+			if p.Upstream == "" {
+				return fmt.Errorf("upstream: pin for zone %q: upstream not set", p.Zone)
+			}
+			pins = append(pins, upstreamPin{
+				zone:     strings.ToLower(dns.Fqdn(p.Zone)),
+				upstream: p.Upstream,
+			})
+		}
+		perZone = cfg.PerZone
+	}
+	sort.SliceStable(pins, func(i, j int) bool {
+		return len(pins[i].zone) > len(pins[j].zone)
+	})
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.perZone = perZone
+	u.halfLife = halfLife
+	u.pins = pins
+	if !perZone {
+		u.zones = make(map[string]map[string]*UpstreamStat)
+	}
+	return nil
+}
+
+// pinned returns the upstream pinned for name, if any.
+func (u *upstreamScheduler) pinned(name string) string {
+	name = strings.ToLower(name)
+	for _, p := range u.pins {
+		if p.zone == "." || name == p.zone || strings.HasSuffix(name, "."+p.zone) {
+			return p.upstream
+		}
+	}
+	return ""
+}
+
+// order returns upstreams in the order in which they should be queried for
+// name: the pinned upstream (if any) first, followed by the remaining
+// upstreams by expected latency. Upstreams without observations are
+// queried first to learn their latency, in configured order.
+func (u *upstreamScheduler) order(upstreams []string, name string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := u.now()
+	zone := u.zones[zoneOf(name)]
+	expected := make(map[string]time.Duration, len(upstreams))
+	for _, upstream := range upstreams {
+		st := zone[upstream]
+		if st == nil || st.Samples < minZoneSamples {
+			st = u.stats[upstream]
+		}
+		if st != nil {
+			expected[upstream] = st.expected(now, u.halfLife)
+		}
+	}
+	result := make([]string, 0, len(upstreams)+1)
+	pinned := u.pinned(name)
+	if pinned != "" {
+		result = append(result, pinned)
+	}
+	for _, upstream := range upstreams {
+		if upstream != pinned {
+			result = append(result, upstream)
+		}
+	}
+	rest := result
+	if pinned != "" {
+		rest = result[1:]
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		return expected[rest[i]] < expected[rest[j]]
+	})
+	return result
+}
+
+// observe records that upstream answered a query for name after rtt, or
+// failed to answer if failed is true. It returns the updated overall
+// statistics of upstream.
+func (u *upstreamScheduler) observe(upstream, name string, rtt time.Duration, failed bool) UpstreamStat {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := u.now()
+	st, ok := u.stats[upstream]
+	if !ok {
+		st = &UpstreamStat{}
+		u.stats[upstream] = st
+	}
+	st.observe(rtt, failed, now, u.halfLife)
+	if u.perZone && name != "" {
+		zone := zoneOf(name)
+		z, ok := u.zones[zone]
+		if !ok {
+			if len(u.zones) >= maxZones {
+				u.forgetOldestZoneLocked()
+			}
+			z = make(map[string]*UpstreamStat)
+			u.zones[zone] = z
+		}
+		zst, ok := z[upstream]
+		if !ok {
+			zst = &UpstreamStat{}
+			z[upstream] = zst
+		}
+		zst.observe(rtt, failed, now, u.halfLife)
+	}
+	return *st
+}
+
+func (u *upstreamScheduler) forgetOldestZoneLocked() {
+	var (
+		oldest  string
+		updated time.Time
+	)
+	for zone, z := range u.zones {
+		var latest time.Time
+		for _, st := range z {
+			if st.Updated.After(latest) {
+				latest = st.Updated
+			}
+		}
+		if oldest == "" || latest.Before(updated) {
+			oldest = zone
+			updated = latest
+		}
+	}
+	delete(u.zones, oldest)
+}
+
+// UpstreamStats are the learned statistics of the upstreams, see
+// Server.UpstreamStats.
+type UpstreamStats struct {
+	Upstreams map[string]UpstreamStat            `json:"upstreams"`
+	Zones     map[string]map[string]UpstreamStat `json:"zones,omitempty"`
+}
+
+func (u *upstreamScheduler) snapshot() UpstreamStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := UpstreamStats{
+		Upstreams: make(map[string]UpstreamStat, len(u.stats)),
+	}
+	for upstream, st := range u.stats {
+		result.Upstreams[upstream] = *st
+	}
+	if len(u.zones) > 0 {
+		result.Zones = make(map[string]map[string]UpstreamStat, len(u.zones))
+		for zone, z := range u.zones {
+			result.Zones[zone] = make(map[string]UpstreamStat, len(z))
+			for upstream, st := range z {
+				result.Zones[zone][upstream] = *st
+			}
+		}
+	}
+	return result
+}
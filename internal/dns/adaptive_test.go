@@ -0,0 +1,138 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUpstreamScheduler(t *testing.T) {
+	now := time.Date(2018, 7, 14, 12, 0, 0, 0, time.UTC)
+	u := newUpstreamScheduler()
+	u.now = func() time.Time { return now }
+
+	upstreams := []string{"slow:53", "fast:53", "failing:53", "new:53"}
+	for i := 0; i < 5; i++ {
+		u.observe("slow:53", "example.com.", 50*time.Millisecond, false)
+		u.observe("fast:53", "example.com.", 5*time.Millisecond, false)
+		u.observe("failing:53", "example.com.", failureCost, true)
+	}
+
+	// Upstreams without observations are tried first, then the fastest.
+	want := []string{"new:53", "fast:53", "slow:53", "failing:53"}
+	if diff := cmp.Diff(want, u.order(upstreams, "example.com.")); diff != "" {
+		t.Fatalf("order: unexpected result: diff (-want +got):\n%s", diff)
+	}
+
+	// A single slow answer does not outweigh the history.
+	u.observe("fast:53", "example.com.", 60*time.Millisecond, false)
+	if got, want := u.order(upstreams[:3], "example.com.")[0], "fast:53"; got != want {
+		t.Errorf("after one slow answer: preferred upstream = %q, want %q", got, want)
+	}
+
+	t.Run("Decay", func(t *testing.T) {
+		// Failures fade: after a few half-lives, the failing upstream is
+		// expected to answer faster than the slow one and is tried again.
+		now = now.Add(10 * defaultHalfLife)
+		got := u.order([]string{"slow:53", "failing:53"}, "example.com.")
+		if diff := cmp.Diff([]string{"failing:53", "slow:53"}, got); diff != "" {
+			t.Fatalf("order: unexpected result: diff (-want +got):\n%s", diff)
+		}
+
+		// A new observation after a long time largely replaces the
+		// history.
+		st := u.observe("slow:53", "example.com.", 1*time.Millisecond, false)
+		if st.RTT > 2*time.Millisecond {
+			t.Errorf("RTT after a long time = %v, want ≈ 1ms", st.RTT)
+		}
+	})
+}
+
+func TestUpstreamSchedulerPerZone(t *testing.T) {
+	now := time.Date(2018, 7, 14, 12, 0, 0, 0, time.UTC)
+	u := newUpstreamScheduler()
+	u.now = func() time.Time { return now }
+	if err := u.configure(&UpstreamConfig{PerZone: true}); err != nil {
+		t.Fatal(err)
+	}
+	upstreams := []string{"a:53", "b:53"}
+	// a is faster overall (recent queries count more), but b is faster for
+	// cdn.example.
+	for i := 0; i < minZoneSamples; i++ {
+		u.observe("a:53", "img.cdn.example.", 30*time.Millisecond, false)
+		u.observe("b:53", "img.cdn.example.", 10*time.Millisecond, false)
+	}
+	for i := 0; i < minZoneSamples; i++ {
+		u.observe("a:53", "www.example.com.", 5*time.Millisecond, false)
+		u.observe("b:53", "www.example.com.", 20*time.Millisecond, false)
+	}
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"www.example.com.", "a:53"},
+		{"video.cdn.example.", "b:53"},
+		{"unknown.example.net.", "a:53"}, // overall statistics
+	} {
+		if got := u.order(upstreams, tt.name)[0]; got != tt.want {
+			t.Errorf("order(%s): preferred upstream = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	stats := u.snapshot()
+	if _, ok := stats.Zones["cdn.example."]; !ok {
+		t.Errorf("snapshot does not contain per-zone statistics for cdn.example.: %+v", stats)
+	}
+}
+
+func TestUpstreamSchedulerPins(t *testing.T) {
+	u := newUpstreamScheduler()
+	if err := u.configure(&UpstreamConfig{
+		Pins: []UpstreamPin{
+			{Zone: "", Upstream: "b:53"},
+			{Zone: "corp.example", Upstream: "10.8.0.1:53"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		u.observe("a:53", "", 5*time.Millisecond, false)
+		u.observe("b:53", "", 50*time.Millisecond, false)
+	}
+	upstreams := []string{"a:53", "b:53"}
+	for _, tt := range []struct {
+		name string
+		want []string
+	}{
+		{"example.com.", []string{"b:53", "a:53"}},
+		{"wiki.corp.example.", []string{"10.8.0.1:53", "a:53", "b:53"}},
+		{"CORP.example.", []string{"10.8.0.1:53", "a:53", "b:53"}},
+		{"notcorp.example.", []string{"b:53", "a:53"}},
+	} {
+		if diff := cmp.Diff(tt.want, u.order(upstreams, tt.name)); diff != "" {
+			t.Errorf("order(%s): unexpected result: diff (-want +got):\n%s", tt.name, diff)
+		}
+	}
+
+	if err := u.configure(&UpstreamConfig{Pins: []UpstreamPin{{Zone: "example.com"}}}); err == nil {
+		t.Errorf("configure unexpectedly accepted a pin without upstream")
+	}
+	if err := u.configure(&UpstreamConfig{HalfLife: "-1m"}); err == nil {
+		t.Errorf("configure unexpectedly accepted a negative half_life")
+	}
+}
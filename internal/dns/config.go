@@ -0,0 +1,331 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Config is the dnsd configuration, stored in dnsd.json.
+type Config struct {
+	// RebindProtection strips private, loopback and link-local addresses
+	// from upstream answers (DNS rebinding protection). Enabled unless set
+	// to false.
+	RebindProtection *bool `json:"rebind_protection"`
+
+	// RebindAllowlist are domains (including their subdomains) which may
+	// legitimately resolve to private addresses, e.g. VPN endpoints.
+	RebindAllowlist []string `json:"rebind_allowlist"`
+
+	// Records are answered locally, taking precedence over DHCP hostnames
+	// and upstream DNS servers.
+	Records []Record `json:"records"`
+
+	// ACME, if set, enables the ACME DNS-01 responder, see ACME.
+	ACME *ACMEConfig `json:"acme"`
+
+	// RPZ are response policy zones (e.g. from security feed providers),
+	// which are consulted in order before forwarding queries upstream.
+	RPZ []RPZ `json:"rpz"`
+
+	// Upstream configures the selection of upstream DNS servers.
+	Upstream *UpstreamConfig `json:"upstream"`
+
+	// Prefetch, if set, answers queries from the cache and refreshes
+	// popular answers before they expire, see PrefetchConfig. Otherwise,
+	// all queries are forwarded upstream.
+	Prefetch *PrefetchConfig `json:"prefetch"`
+}
+
+// RPZ is a response policy zone file. Files are re-read when they change,
+// see Server.ReloadRPZ.
+type RPZ struct {
+	Zone string `json:"zone"` // origin of the zone, e.g. “rpz.example.net”
+	File string `json:"file"` // path to the zone file, relative to /perm
+}
+
+// Record is a local A or AAAA record.
+type Record struct {
+	// Name is a domain name (e.g. “nas.lan”) or a wildcard (e.g.
+	// “*.lab.lan”), which matches all subdomains of the domain following
+	// the asterisk, but not the domain itself.
+	Name string `json:"name"`
+
+	// Regexp, if set instead of Name, is matched against the query name
+	// without trailing dot, e.g. “^[a-z]+-proxy\.lan$”.
+	Regexp string `json:"regexp"`
+
+	Addr string `json:"addr"` // IPv4 or IPv6 address
+
+	// Interfaces, if set, restricts the record to queries arriving on these
+	// network interfaces (e.g. “guest0”), allowing for split-horizon DNS.
+	// Interface-specific records take precedence over records without
+	// Interfaces.
+	Interfaces []string `json:"interfaces"`
+}
+
+// ReadConfig reads dnsd.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "dnsd.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for idx, rpz := range cfg.RPZ {
+		if rpz.File != "" && !filepath.IsAbs(rpz.File) {
+			cfg.RPZ[idx].File = filepath.Join(dir, rpz.File)
+		}
+	}
+	return &cfg, nil
+}
+
+type localRecord struct {
+	ip         net.IP
+	interfaces map[string]bool // nil means all interfaces
+}
+
+type regexpRecord struct {
+	re *regexp.Regexp
+	localRecord
+}
+
+// localRecords are the compiled Config.Records. Exact names take precedence
+// over the most specific wildcard, which takes precedence over regular
+// expressions.
+type localRecords struct {
+	exact    map[string][]localRecord // lower-case fully qualified name
+	wildcard map[string][]localRecord // lower-case suffix, e.g. “.lab.lan.”
+	regexps  []regexpRecord
+
+	// splitHorizon is true if any record is restricted to interfaces.
+	splitHorizon bool
+}
+
+func compileRecords(records []Record) (*localRecords, error) {
+	lr := &localRecords{
+		exact:    make(map[string][]localRecord),
+		wildcard: make(map[string][]localRecord),
+	}
+	for _, r := range records {
+		ip := net.ParseIP(r.Addr)
+		if ip == nil {
+			return nil, fmt.Errorf("record %q: invalid addr %q", r.Name+r.Regexp, r.Addr)
+		}
+		rec := localRecord{ip: ip}
+		if len(r.Interfaces) > 0 {
+			lr.splitHorizon = true
+			rec.interfaces = make(map[string]bool, len(r.Interfaces))
+			for _, ifname := range r.Interfaces {
+				rec.interfaces[ifname] = true
+			}
+		}
+		switch {
+		case r.Name != "" && r.Regexp != "":
+			return nil, fmt.Errorf("record %q: name and regexp are mutually exclusive", r.Name)
+		case r.Regexp != "":
+			re, err := regexp.Compile(r.Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("record %q: %v", r.Regexp, err)
+			}
+			lr.regexps = append(lr.regexps, regexpRecord{re: re, localRecord: rec})
+		case strings.HasPrefix(r.Name, "*."):
+			suffix := strings.ToLower(dns.Fqdn(strings.TrimPrefix(r.Name, "*")))
+			lr.wildcard[suffix] = append(lr.wildcard[suffix], rec)
+		case r.Name != "":
+			if strings.Contains(r.Name, "*") {
+				return nil, fmt.Errorf("record %q: wildcards are only supported as the first label", r.Name)
+			}
+			name := strings.ToLower(dns.Fqdn(r.Name))
+			lr.exact[name] = append(lr.exact[name], rec)
+		default:
+			return nil, fmt.Errorf("record for %s: neither name nor regexp set", r.Addr)
+		}
+	}
+	return lr, nil
+}
+
+// pick returns the addresses of the records applying to ifname, preferring
+// records restricted to ifname over unrestricted records.
+func pick(recs []localRecord, ifname string) []net.IP {
+	var specific, all []net.IP
+	for _, rec := range recs {
+		switch {
+		case rec.interfaces == nil:
+			all = append(all, rec.ip)
+		case rec.interfaces[ifname]:
+			specific = append(specific, rec.ip)
+		}
+	}
+	if len(specific) > 0 {
+		return specific
+	}
+	return all
+}
+
+// lookup returns the addresses of name (fully qualified) for queries arriving
+// on interface ifname, if it matches a record.
+func (lr *localRecords) lookup(name, ifname string) ([]net.IP, bool) {
+	if lr == nil {
+		return nil, false
+	}
+	name = strings.ToLower(name)
+	if ips := pick(lr.exact[name], ifname); len(ips) > 0 {
+		return ips, true
+	}
+	// Try the most specific wildcard first: for a.b.lab.lan., try
+	// .b.lab.lan., then .lab.lan., then .lan.
+	for idx := strings.IndexByte(name, '.'); idx > -1 && idx < len(name)-1; {
+		if ips := pick(lr.wildcard[name[idx:]], ifname); len(ips) > 0 {
+			return ips, true
+		}
+		next := strings.IndexByte(name[idx+1:], '.')
+		if next == -1 {
+			break
+		}
+		idx += 1 + next
+	}
+	var matching []localRecord
+	for _, r := range lr.regexps {
+		if r.re.MatchString(strings.TrimSuffix(name, ".")) {
+			matching = append(matching, r.localRecord)
+		}
+	}
+	if ips := pick(matching, ifname); len(ips) > 0 {
+		return ips, true
+	}
+	return nil, false
+}
+
+// interfaceOf returns the name of the network interface which has the local
+// address addr, i.e. on which a query arrived.
+func interfaceOf(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return ""
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// SetConfig applies cfg.
+func (s *Server) SetConfig(cfg *Config) error {
+	records, err := compileRecords(cfg.Records)
+	if err != nil {
+		return err
+	}
+	for _, rpz := range cfg.RPZ {
+		if rpz.Zone == "" || rpz.File == "" {
+			return fmt.Errorf("rpz %q: zone and file must be set", rpz.Zone+rpz.File)
+		}
+	}
+	if err := s.sched.configure(cfg.Upstream); err != nil {
+		return err
+	}
+	prefetch, err := newPrefetchPolicy(cfg.Prefetch)
+	if err != nil {
+		return err
+	}
+	s.stale.setPrefetch(prefetch)
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.rebindProtection = cfg.RebindProtection == nil || *cfg.RebindProtection
+	s.rebindAllowlist = make([]string, 0, len(cfg.RebindAllowlist))
+	for _, d := range cfg.RebindAllowlist {
+		s.rebindAllowlist = append(s.rebindAllowlist, strings.ToLower(dns.Fqdn(d)))
+	}
+	s.records = records
+	s.rpzConfig = cfg.RPZ
+	return nil
+}
+
+// answerLocal answers r from the configured records and returns true, or
+// returns false if the question does not match any record.
+func (s *Server) answerLocal(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(r.Question) != 1 {
+		return false
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+	s.policyMu.RLock()
+	records := s.records
+	s.policyMu.RUnlock()
+	var ifname string
+	if records != nil && records.splitHorizon {
+		ifname = s.interfaceOf(w.LocalAddr())
+	}
+	ips, ok := records.lookup(q.Name, ifname)
+	if !ok {
+		return false
+	}
+	traceOf(w).add("local", 0, "matched a record in dnsd.json")
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, ip := range ips {
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   ip.To4(),
+			})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 3600},
+				AAAA: ip,
+			})
+		}
+	}
+	// An empty answer (NODATA) for other types, e.g. AAAA for an IPv4-only
+	// record.
+	w.WriteMsg(m)
+	return true
+}
@@ -18,7 +18,6 @@ package dns
 import (
 	"errors"
 	"fmt"
-	"math"
 	"net"
 	"net/http"
 	"os"
@@ -27,12 +26,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rtr7/router7/internal/devices"
 	"github.com/rtr7/router7/internal/dhcp4d"
 	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/threatintel"
 
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/time/rate"
 )
 
@@ -45,44 +45,92 @@ type lcHostname string
 type Server struct {
 	Mux *dns.ServeMux
 
+	// ThreatHit, if non-nil, is called (in a separate goroutine) for each
+	// query which was sinkholed because it matched a threat-intelligence feed.
+	ThreatHit func(threatintel.Hit)
+
 	client    *dns.Client
-	domain    string
 	sometimes *rate.Limiter
 	prom      struct {
 		registry  *prometheus.Registry
 		queries   prometheus.Counter
 		upstream  *prometheus.CounterVec
 		questions prometheus.Histogram
+		threats   *prometheus.CounterVec
+		rebind    prometheus.Counter
+		stale     prometheus.Counter
+		rpz       *prometheus.CounterVec
+
+		prefetches   *prometheus.CounterVec
+		prefetchHits prometheus.Counter
+
+		upstreamRTT      *prometheus.GaugeVec
+		upstreamFailures *prometheus.GaugeVec
 	}
 
 	mu           sync.Mutex
 	hostname, ip string
+	domains      []string // lower case, without trailing dot; primary first
 	hostsByName  map[lcHostname]string
 	hostsByIP    map[string]string
 	subnames     map[lcHostname]map[string]net.IP // hostname → subname → ip
 
 	upstreamMu sync.RWMutex
-	upstream   []string
+	upstream   []string // configured order, see sched
+
+	sched *upstreamScheduler
+
+	stale      *staleCache
+	prefetches chan struct{} // semaphore, see prefetch
+
+	policyMu sync.RWMutex
+	threats  *threatintel.List
+	devices  *devices.Registry
+	hwaddrs  map[string]string // client IP address → MAC address
+
+	rebindProtection bool
+	rebindAllowlist  []string // fully qualified, lower case
+	records          *localRecords
+	rpzConfig        []RPZ
+	rpz              []*rpzZone      // in order of rpzConfig
+	localOnly        map[string]bool // interface names, see SetLocalOnly
+
+	rpzMu sync.Mutex // serializes ReloadRPZ
+
+	interfaceOf func(net.Addr) string // for split-horizon records
 }
 
+// DefaultUpstreams returns the public resolvers to which queries are
+// forwarded unless SetUpstreams is called.
+func DefaultUpstreams() []string {
+	return []string{
+		// https://developers.google.com/speed/public-dns/docs/using#google_public_dns_ip_addresses
+		"8.8.8.8:53",
+		"8.8.4.4:53",
+		"[2001:4860:4860::8888]:53",
+		"[2001:4860:4860::8844]:53",
+	}
+}
+
+// NewServer returns a server which answers for the hostnames of DHCP clients
+// under domain (e.g. “lan”), see also SetDomains.
 func NewServer(addr, domain string) *Server {
 	hostname, _ := os.Hostname()
 	ip, _, _ := net.SplitHostPort(addr)
 	server := &Server{
-		Mux:    dns.NewServeMux(),
-		client: &dns.Client{},
-		domain: domain,
-		upstream: []string{
-			// https://developers.google.com/speed/public-dns/docs/using#google_public_dns_ip_addresses
-			"8.8.8.8:53",
-			"8.8.4.4:53",
-			"[2001:4860:4860::8888]:53",
-			"[2001:4860:4860::8844]:53",
-		},
+		Mux:       dns.NewServeMux(),
+		client:    &dns.Client{},
+		upstream:  DefaultUpstreams(),
 		sometimes: rate.NewLimiter(rate.Every(1*time.Second), 1), // at most once per second
 		hostname:  hostname,
 		ip:        ip,
+		domains:   []string{strings.ToLower(strings.Trim(domain, "."))},
 		subnames:  make(map[lcHostname]map[string]net.IP),
+
+		sched:       newUpstreamScheduler(),
+		stale:       newStaleCache(),
+		prefetches:  make(chan struct{}, maxPrefetches),
+		interfaceOf: interfaceOf,
 	}
 	server.prom.registry = prometheus.NewRegistry()
 
@@ -108,10 +156,75 @@ func NewServer(addr, domain string) *Server {
 	})
 	server.prom.registry.MustRegister(server.prom.questions)
 
+	server.prom.threats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_threatintel_hits",
+			Help: "Number of DNS queries sinkholed by threat-intelligence feed",
+		},
+		[]string{"feed"},
+	)
+	server.prom.registry.MustRegister(server.prom.threats)
+
+	server.prom.rebind = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_rebind_stripped",
+		Help: "Number of private addresses stripped from upstream answers (DNS rebinding protection)",
+	})
+	server.prom.registry.MustRegister(server.prom.rebind)
+
+	server.prom.stale = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_stale_answers",
+		Help: "Number of queries answered from expired cache entries because no upstream was reachable (RFC 8767)",
+	})
+	server.prom.registry.MustRegister(server.prom.stale)
+
+	server.prom.rpz = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_rpz_hits",
+			Help: "Number of DNS queries matching a response policy zone, by zone and policy action",
+		},
+		[]string{"zone", "action"},
+	)
+	server.prom.registry.MustRegister(server.prom.rpz)
+
+	server.prom.prefetches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_prefetches",
+			Help: "Number of cached answers refreshed before they expired, by result (ok, failed or skipped)",
+		},
+		[]string{"result"},
+	)
+	server.prom.registry.MustRegister(server.prom.prefetches)
+
+	server.prom.prefetchHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_prefetch_hits",
+		Help: "Number of prefetched answers which were used by at least one query (hit ratio: divide by dns_prefetches{result=\"ok\"})",
+	})
+	server.prom.registry.MustRegister(server.prom.prefetchHits)
+
+	server.prom.upstreamRTT = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_rtt_seconds",
+			Help: "Moving average of the round-trip time of answered queries, by upstream",
+		},
+		[]string{"upstream"},
+	)
+	server.prom.registry.MustRegister(server.prom.upstreamRTT)
+
+	server.prom.upstreamFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_failure_ratio",
+			Help: "Moving average of the fraction of queries which an upstream failed to answer",
+		},
+		[]string{"upstream"},
+	)
+	server.prom.registry.MustRegister(server.prom.upstreamFailures)
+
 	server.prom.registry.MustRegister(prometheus.NewGoCollector())
 	server.initHostsLocked()
 	server.Mux.HandleFunc(".", server.handleRequest)
-	server.Mux.HandleFunc("lan.", server.handleInternal)
+	for _, domain := range server.domains {
+		server.Mux.HandleFunc(domain+".", server.handleInternal)
+	}
 	server.Mux.HandleFunc("localhost.", server.handleInternal)
 	go func() {
 		for range time.Tick(10 * time.Second) {
@@ -131,19 +244,76 @@ func (s *Server) initHostsLocked() {
 			s.hostsByIP[rev] = s.hostname
 		}
 		s.Mux.HandleFunc(lower+".", s.subnameHandler(s.hostname))
-		s.Mux.HandleFunc(lower+"."+s.domain+".", s.subnameHandler(s.hostname))
+		for _, domain := range s.domains {
+			s.Mux.HandleFunc(lower+"."+domain+".", s.subnameHandler(s.hostname))
+		}
+	}
+}
+
+// SetDomains sets the local domains (e.g. “home.arpa” and “lan”) under which
+// the hostnames of DHCP clients are resolvable. The first domain is the
+// primary domain, which is used in answers to reverse lookups.
+func (s *Server) SetDomains(domains []string) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(strings.Trim(domain, ".")))
+	}
+	if len(normalized) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, domain := range s.domains {
+		s.Mux.HandleRemove(domain + ".")
+		for hostname := range s.hostsByName {
+			s.Mux.HandleRemove(string(hostname) + "." + domain + ".")
+		}
+	}
+	s.domains = normalized
+	for _, domain := range s.domains {
+		s.Mux.HandleFunc(domain+".", s.handleInternal)
+		for hostname := range s.hostsByName {
+			s.Mux.HandleFunc(string(hostname)+"."+domain+".", s.subnameHandler(string(hostname)))
+		}
 	}
 }
 
+// trimDomain returns name (without trailing dot) without the local domain
+// suffix, if any.
+func (s *Server) trimDomain(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lower := strings.ToLower(name)
+	for _, domain := range s.domains {
+		if strings.HasSuffix(lower, "."+domain) {
+			return name[:len(name)-len(domain)-1]
+		}
+	}
+	return name
+}
+
+// primaryDomain returns the domain used in answers to reverse lookups.
+func (s *Server) primaryDomain() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domains[0]
+}
+
 type measurement struct {
 	upstream string
 	rtt      time.Duration
+	failed   bool
 }
 
 func (m measurement) String() string {
+	if m.failed {
+		return fmt.Sprintf("{upstream: %s, failed}", m.upstream)
+	}
 	return fmt.Sprintf("{upstream: %s, rtt: %v}", m.upstream, m.rtt)
 }
 
+// probeUpstreamLatency queries all upstreams, so that the latency of
+// upstreams which are not currently preferred is learned, too.
 func (s *Server) probeUpstreamLatency() {
 	upstreams := s.upstreams()
 	results := make([]measurement, len(upstreams))
@@ -157,28 +327,28 @@ func (s *Server) probeUpstreamLatency() {
 			m.SetQuestion("google.ch.", dns.TypeA)
 			start := time.Now()
 			_, _, err := s.client.Exchange(m, u)
-			rtt := time.Since(start)
-			if err != nil {
-				// including unresponsive upstreams in results makes the update
-				// code simpler:
-				results[idx] = measurement{u, time.Duration(math.MaxInt64)}
-				return
-			}
-			results[idx] = measurement{u, rtt}
+			results[idx] = measurement{u, time.Since(start), err != nil}
 		}(idx, u)
 	}
 	wg.Wait()
-	// Re-order by resolving latency:
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].rtt < results[j].rtt
-	})
-	log.Printf("probe results: %v", results)
-	for idx, result := range results {
-		upstreams[idx] = result.upstream
+	log.Debugf("probe results: %v", results)
+	for _, result := range results {
+		// Probes are not attributed to a zone: google.ch is not
+		// representative of the queries for any zone.
+		s.observeUpstream(result.upstream, "", result.rtt, result.failed)
 	}
-	s.upstreamMu.Lock()
-	defer s.upstreamMu.Unlock()
-	s.upstream = upstreams
+}
+
+func (s *Server) observeUpstream(upstream, name string, rtt time.Duration, failed bool) {
+	st := s.sched.observe(upstream, name, rtt, failed)
+	s.prom.upstreamRTT.WithLabelValues(upstream).Set(st.RTT.Seconds())
+	s.prom.upstreamFailures.WithLabelValues(upstream).Set(st.Failures)
+}
+
+// UpstreamStats returns the learned latencies and failure rates of the
+// upstreams, by which they are ordered.
+func (s *Server) UpstreamStats() UpstreamStats {
+	return s.sched.snapshot()
 }
 
 func (s *Server) hostByName(n string) (string, bool) {
@@ -202,8 +372,78 @@ func (s *Server) subname(hostname, host string) (net.IP, bool) {
 	return r, ok
 }
 
-func (s *Server) PrometheusHandler() http.Handler {
-	return promhttp.HandlerFor(s.prom.registry, promhttp.HandlerOpts{})
+// FlushCache discards all cached upstream answers.
+func (s *Server) FlushCache() {
+	s.stale.flush()
+}
+
+// SetThreats replaces the list of domains which are sinkholed.
+func (s *Server) SetThreats(l *threatintel.List) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.threats = l
+}
+
+// SetDevices sets the device registry, whose policy tags (e.g.
+// devices.TagThreatintelExempt) apply to queries from the respective devices.
+func (s *Server) SetDevices(r *devices.Registry) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.devices = r
+}
+
+func (s *Server) threatFeed(name string, client net.Addr) (string, bool) {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	feed, ok := s.threats.Match(name)
+	if !ok || client == nil {
+		return feed, ok
+	}
+	if host, _, err := net.SplitHostPort(client.String()); err == nil {
+		if hwaddr, ok := s.hwaddrs[host]; ok && s.devices.HasTag(hwaddr, devices.TagThreatintelExempt) {
+			return "", false
+		}
+	}
+	return feed, ok
+}
+
+// sinkhole answers r with NXDOMAIN and reports the hit.
+func (s *Server) sinkhole(w dns.ResponseWriter, r *dns.Msg, feed string) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetRcode(r, dns.RcodeNameError)
+	w.WriteMsg(m)
+	if tr := traceOf(w); tr != nil {
+		// Lookups are not reported: they are no threat.
+		tr.add("threatintel", 0, "blocked by feed %s", feed)
+		return
+	}
+	s.prom.threats.WithLabelValues(feed).Inc()
+
+	hit := threatintel.Hit{
+		Time: time.Now(),
+		Name: r.Question[0].Name,
+		Feed: feed,
+	}
+	if addr := w.RemoteAddr(); addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			hit.Client = host
+			if rev, err := dns.ReverseAddr(host); err == nil {
+				hit.Hostname, _ = s.hostByIP(rev)
+			}
+		}
+	}
+	log.Printf("sinkholed %s (feed %s) for client %s (%s)", hit.Name, hit.Feed, hit.Client, hit.Hostname)
+	if s.ThreatHit != nil {
+		go s.ThreatHit(hit)
+	}
+}
+
+// PrometheusGatherer returns the registry of the DNS server metrics, which are
+// served in addition to the default registry (process-wide metrics, e.g.
+// supervise_*).
+func (s *Server) PrometheusGatherer() prometheus.Gatherer {
+	return s.prom.registry
 }
 
 func (s *Server) DyndnsHandler(w http.ResponseWriter, r *http.Request) {
@@ -247,34 +487,48 @@ func (s *Server) SetLeases(leases []dhcp4d.Lease) {
 	defer s.mu.Unlock()
 	s.initHostsLocked()
 	now := time.Now()
-	{
-		// defensive copy
-		slice := make([]dhcp4d.Lease, len(leases))
-		copy(slice, leases)
-		leases = slice
-	}
-	// First entry wins, so we order by expiration descendingly to put the
-	// newest entry for any given name into s.hostsByName.
-	sort.Slice(leases, func(i, j int) bool {
-		return !leases[i].Expiry.Before(leases[j].Expiry)
+	ptrs := make([]*dhcp4d.Lease, len(leases))
+	for idx := range leases {
+		l := leases[idx] // defensive copy
+		ptrs[idx] = &l
+	}
+	// Of leases for the same address, the newest one wins.
+	byExpiry := make([]*dhcp4d.Lease, len(ptrs))
+	copy(byExpiry, ptrs)
+	sort.Slice(byExpiry, func(i, j int) bool {
+		return !byExpiry[i].Expiry.Before(byExpiry[j].Expiry)
 	})
-	for _, l := range leases {
+	hwaddrs := make(map[string]string)
+	for _, l := range byExpiry {
 		if l.Expired(now) {
 			continue
 		}
-		if l.Hostname == "" {
+		if _, ok := hwaddrs[l.Addr.String()]; !ok {
+			hwaddrs[l.Addr.String()] = l.HardwareAddr
+		}
+	}
+	s.policyMu.Lock()
+	s.hwaddrs = hwaddrs
+	s.policyMu.Unlock()
+	// Devices claiming the same hostname are disambiguated (e.g. android,
+	// android-2) instead of shadowing each other.
+	for idx, name := range dhcp4d.DNSNames(ptrs, now) {
+		if name == "" {
 			continue
 		}
-		lower := strings.ToLower(l.Hostname)
+		l := ptrs[idx]
+		lower := strings.ToLower(name)
 		if _, ok := s.hostsByName[lcHostname(lower)]; ok {
 			continue // don’t overwrite e.g. the hostname entry
 		}
 		s.hostsByName[lcHostname(lower)] = l.Addr.String()
 		if rev, err := dns.ReverseAddr(l.Addr.String()); err == nil {
-			s.hostsByIP[rev] = l.Hostname
+			s.hostsByIP[rev] = name
 		}
 		s.Mux.HandleFunc(lower+".", s.subnameHandler(lower))
-		s.Mux.HandleFunc(lower+"."+s.domain+".", s.subnameHandler(lower))
+		for _, domain := range s.domains {
+			s.Mux.HandleFunc(lower+"."+domain+".", s.subnameHandler(lower))
+		}
 	}
 }
 
@@ -344,8 +598,7 @@ func (s *Server) resolve(q dns.Question) (rr dns.RR, err error) {
 	if q.Qtype == dns.TypeA ||
 		q.Qtype == dns.TypeAAAA ||
 		q.Qtype == dns.TypeMX {
-		name := strings.TrimSuffix(q.Name, ".")
-		name = strings.TrimSuffix(name, "."+s.domain)
+		name := s.trimDomain(strings.TrimSuffix(q.Name, "."))
 		if host, ok := s.hostByName(name); ok {
 			if q.Qtype == dns.TypeA {
 				return dns.NewRR(q.Name + " 3600 IN A " + host)
@@ -355,7 +608,7 @@ func (s *Server) resolve(q dns.Question) (rr dns.RR, err error) {
 	}
 	if q.Qtype == dns.TypePTR {
 		if host, ok := s.hostByIP(q.Name); ok {
-			return dns.NewRR(q.Name + " 3600 IN PTR " + host + "." + s.domain)
+			return dns.NewRR(q.Name + " 3600 IN PTR " + host + "." + s.primaryDomain() + ".")
 		}
 		if strings.HasSuffix(q.Name, "127.in-addr.arpa.") {
 			return dns.NewRR(q.Name + " 3600 IN PTR localhost.")
@@ -371,6 +624,10 @@ func (s *Server) handleInternal(w dns.ResponseWriter, r *dns.Msg) {
 	if len(r.Question) != 1 { // TODO: answer all questions we can answer
 		return
 	}
+	if s.answerLocal(w, r) {
+		return
+	}
+	traceOf(w).add("local", 0, "answered from DHCP leases (local domain)")
 	rr, err := s.resolve(r.Question[0])
 	if err != nil {
 		if err == sentinelEmpty {
@@ -395,6 +652,14 @@ func (s *Server) handleInternal(w dns.ResponseWriter, r *dns.Msg) {
 	w.WriteMsg(m)
 }
 
+// SetUpstreams replaces the upstream DNS servers (host:port) to which queries
+// are forwarded, see UpstreamConfig for the order in which they are queried.
+func (s *Server) SetUpstreams(upstreams []string) {
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+	s.upstream = upstreams
+}
+
 func (s *Server) upstreams() []string {
 	s.upstreamMu.RLock()
 	defer s.upstreamMu.RUnlock()
@@ -414,28 +679,88 @@ func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 	s.prom.queries.Inc()
 	s.prom.questions.Observe(float64(len(r.Question)))
+	if s.answerLocal(w, r) {
+		s.prom.upstream.WithLabelValues("local").Inc()
+		return
+	}
+	if s.applyRPZ(w, r) {
+		s.prom.upstream.WithLabelValues("rpz").Inc()
+		return
+	}
+	if len(r.Question) == 1 {
+		if feed, ok := s.threatFeed(r.Question[0].Name, w.RemoteAddr()); ok {
+			s.sinkhole(w, r, feed)
+			return
+		}
+	}
+	if s.refuseForward(w, r) {
+		s.prom.upstream.WithLabelValues("refused").Inc()
+		return
+	}
+	tr := traceOf(w)
+	if m, refresh, prefetchHit := s.stale.fresh(r); m != nil {
+		s.prom.upstream.WithLabelValues("cache").Inc()
+		if prefetchHit {
+			s.prom.prefetchHits.Inc()
+		}
+		tr.add("cache", 0, "answered from the cache")
+		if refresh {
+			tr.add("cache", 0, "prefetching the popular answer before it expires")
+			s.prefetch(r)
+		}
+		w.WriteMsg(m)
+		return
+	}
 	s.prom.upstream.WithLabelValues("DNS").Inc()
 
-	for idx, u := range s.upstreams() {
+	var name string
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+	}
+	for _, u := range s.sched.order(s.upstreams(), name) {
+		start := time.Now()
 		in, _, err := s.client.Exchange(r, u)
+		s.observeUpstream(u, name, time.Since(start), err != nil)
 		if err != nil {
+			tr.add("upstream", time.Since(start), "%s: %v", u, err)
 			if s.sometimes.Allow() {
-				log.Printf("resolving %v failed: %v", r.Question, err)
+				log.Warnf("resolving %v failed: %v", r.Question, err)
 			}
 			continue // fall back to next-slower upstream
 		}
-		w.WriteMsg(in)
-		if idx > 0 {
-			// re-order this upstream to the front of s.upstream.
-			s.upstreamMu.Lock()
-			s.upstream = append(append([]string{u}, s.upstream[:idx]...), s.upstream[idx+1:]...)
-			s.upstreamMu.Unlock()
+		tr.add("upstream", time.Since(start), "%s answered %s", u, dns.RcodeToString[in.Rcode])
+		if stripped := s.stripRebind(in); stripped > 0 {
+			tr.add("rebind", 0, "stripped %d private addresses", stripped)
+			s.prom.rebind.Add(float64(stripped))
+			if s.sometimes.Allow() {
+				log.Printf("rebind protection: stripped %d private addresses from answer for %v", stripped, r.Question)
+			}
 		}
+		if in.Rcode == dns.RcodeServerFailure && s.serveStale(w, r) {
+			return
+		}
+		s.stale.put(in)
+		w.WriteMsg(in)
+		return
+	}
+	if s.serveStale(w, r) {
 		return
 	}
 	// DNS has no reply for resolving errors
 }
 
+// serveStale answers r from the stale cache, if possible.
+func (s *Server) serveStale(w dns.ResponseWriter, r *dns.Msg) bool {
+	m, ok := s.stale.get(r)
+	if !ok {
+		return false
+	}
+	s.prom.stale.Inc()
+	traceOf(w).add("stale", 0, "answered from the stale cache (RFC 8767)")
+	w.WriteMsg(m)
+	return true
+}
+
 func (s *Server) resolveSubname(hostname string, q dns.Question) (dns.RR, error) {
 	if q.Qclass != dns.ClassINET {
 		return nil, nil
@@ -443,11 +768,12 @@ func (s *Server) resolveSubname(hostname string, q dns.Question) (dns.RR, error)
 	if q.Qtype == dns.TypeA ||
 		q.Qtype == dns.TypeAAAA ||
 		q.Qtype == dns.TypeMX {
-		name := strings.TrimSuffix(q.Name, "."+hostname+".")
-		name = strings.TrimSuffix(name, "."+hostname+"."+s.domain+".")
+		// Subnames are registered relative to the hostname, e.g. “www” for
+		// www.nas.lan.
+		name := s.trimDomain(strings.TrimSuffix(q.Name, "."))
+		name = strings.TrimSuffix(name, "."+hostname)
 
-		if lower := strings.ToLower(q.Name); lower == hostname+"." ||
-			lower == hostname+"."+s.domain+"." {
+		if lower := strings.ToLower(name); lower == hostname {
 			host, ok := s.hostByName(hostname)
 			if !ok {
 				// The corresponding DHCP lease might have expired, but this
@@ -478,6 +804,10 @@ func (s *Server) subnameHandler(hostname string) func(w dns.ResponseWriter, r *d
 		if len(r.Question) != 1 { // TODO: answer all questions we can answer
 			return
 		}
+		if s.answerLocal(w, r) {
+			return
+		}
+		traceOf(w).add("local", 0, "answered from DHCP leases and dyndns subnames of %s", hostname)
 
 		rr, err := s.resolveSubname(hostname, r.Question[0])
 		if err != nil {
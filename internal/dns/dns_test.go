@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/threatintel"
 
 	"github.com/miekg/dns"
 )
@@ -87,6 +88,278 @@ func TestResolveFallback(t *testing.T) {
 	}
 }
 
+func TestServeStale(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	now := time.Now()
+	s.stale.now = func() time.Time { return now }
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply(w, r, " 60 IN A 203.0.113.1")
+		})),
+	}
+	if err := resolveTestTarget(s, "google.ch.", net.ParseIP("203.0.113.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// All upstreams are unreachable, the answer has expired:
+	s.upstream = []string{"266.266.266.266:53"}
+	now = now.Add(1 * time.Hour)
+	if err := resolveTestTarget(s, "Google.ch.", net.ParseIP("203.0.113.1")); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	m := new(dns.Msg)
+	m.SetQuestion("google.ch.", dns.TypeA)
+	s.Mux.ServeDNS(r, m)
+	if got, want := r.response.Answer[0].Header().Ttl, uint32(staleTTL); got != want {
+		t.Errorf("unexpected TTL of stale answer: got %d, want %d", got, want)
+	}
+
+	now = now.Add(maxStale)
+	if err := resolveTestTarget(s, "google.ch.", net.ParseIP("203.0.113.1")); err == nil {
+		t.Errorf("answer served after maxStale")
+	}
+}
+
+func TestThreatSinkhole(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	var upstreamHits uint32
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddUint32(&upstreamHits, 1)
+			reply(w, r, " 3600 IN A 127.0.0.1")
+		})),
+	}
+	l := threatintel.NewList()
+	l.Add("urlhaus", []string{"malware.example.com"})
+	s.SetThreats(l)
+	hits := make(chan threatintel.Hit, 1)
+	s.ThreatHit = func(hit threatintel.Hit) { hits <- hit }
+
+	r := &recorder{}
+	m := new(dns.Msg)
+	m.SetQuestion("www.malware.example.com.", dns.TypeA)
+	s.Mux.ServeDNS(r, m)
+	if got, want := r.response.MsgHdr.Rcode, dns.RcodeNameError; got != want {
+		t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+	}
+	if got, want := atomic.LoadUint32(&upstreamHits), uint32(0); got != want {
+		t.Fatalf("sinkholed query unexpectedly forwarded upstream")
+	}
+	select {
+	case hit := <-hits:
+		if got, want := hit.Feed, "urlhaus"; got != want {
+			t.Fatalf("unexpected hit feed: got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ThreatHit not called")
+	}
+
+	if err := resolveTestTarget(s, "google.ch.", net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebindProtection(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Qtype == dns.TypeAAAA {
+				reply(w, r, " 3600 IN AAAA fd00::1")
+				return
+			}
+			reply(w, r, " 3600 IN A 192.168.1.1")
+		})),
+	}
+	if err := s.SetConfig(&Config{RebindAllowlist: []string{"vpn.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r := &recorder{}
+		m := new(dns.Msg)
+		m.SetQuestion("evil.example.net.", typ)
+		s.Mux.ServeDNS(r, m)
+		if r.response == nil {
+			t.Fatalf("nil response")
+		}
+		if got, want := len(r.response.Answer), 0; got != want {
+			t.Errorf("%s: private address not stripped: got %v", dns.TypeToString[typ], r.response.Answer)
+		}
+	}
+
+	for _, name := range []string{"vpn.example.com.", "gw.VPN.example.com."} {
+		if err := resolveTestTarget(s, name, net.ParseIP("192.168.1.1")); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	disabled := false
+	if err := s.SetConfig(&Config{RebindProtection: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveTestTarget(s, "evil.example.net.", net.ParseIP("192.168.1.1")); err != nil {
+		t.Errorf("rebind protection disabled: %v", err)
+	}
+}
+
+func TestLocalRecords(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply(w, r, " 3600 IN A 203.0.113.1")
+		})),
+	}
+	if err := s.SetConfig(&Config{
+		Records: []Record{
+			{Name: "*.lab.lan", Addr: "10.0.0.5"},
+			{Name: "nas.lab.lan", Addr: "10.0.0.6"},
+			{Name: "*.example.com", Addr: "10.0.0.7"},
+			{Regexp: `^[a-z]+-proxy\.example\.net$`, Addr: "10.0.0.8"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want net.IP
+	}{
+		{"a.lab.lan.", net.ParseIP("10.0.0.5")},
+		{"b.A.lab.lan.", net.ParseIP("10.0.0.5")},
+		{"nas.lab.lan.", net.ParseIP("10.0.0.6")},
+		{"grafana.example.com.", net.ParseIP("10.0.0.7")},
+		{"web-proxy.example.net.", net.ParseIP("10.0.0.8")},
+		{"example.com.", net.ParseIP("203.0.113.1")},         // upstream
+		{"1-proxy.example.net.", net.ParseIP("203.0.113.1")}, // upstream
+	} {
+		if err := resolveTestTarget(s, tt.name, tt.want); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	t.Run("NoWildcardApex", func(t *testing.T) {
+		r := &recorder{}
+		m := new(dns.Msg)
+		m.SetQuestion("lab.lan.", dns.TypeA)
+		s.Mux.ServeDNS(r, m)
+		if got, want := r.response.Rcode, dns.RcodeNameError; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		r := &recorder{}
+		m := new(dns.Msg)
+		m.SetQuestion("a.lab.lan.", dns.TypeAAAA)
+		s.Mux.ServeDNS(r, m)
+		if got, want := r.response.Rcode, dns.RcodeSuccess; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+		if got, want := len(r.response.Answer), 0; got != want {
+			t.Fatalf("unexpected answer: got %v", r.response.Answer)
+		}
+	})
+
+	if err := s.SetConfig(&Config{Records: []Record{{Regexp: "(", Addr: "10.0.0.5"}}}); err == nil {
+		t.Errorf("SetConfig unexpectedly accepted an invalid regexp")
+	}
+}
+
+// localAddrRecorder is a recorder for queries arriving on local.
+type localAddrRecorder struct {
+	recorder
+	local net.Addr
+}
+
+func (r *localAddrRecorder) LocalAddr() net.Addr { return r.local }
+
+func TestSplitHorizon(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.interfaceOf = func(addr net.Addr) string {
+		if addr.(*net.UDPAddr).IP.Equal(net.ParseIP("192.168.23.1")) {
+			return "guest0"
+		}
+		return "lan0"
+	}
+	if err := s.SetConfig(&Config{
+		Records: []Record{
+			{Name: "nas.lan", Addr: "10.0.0.10"},
+			{Name: "nas.lan", Addr: "192.168.23.1", Interfaces: []string{"guest0"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		local string
+		want  net.IP
+	}{
+		{"10.0.0.1", net.ParseIP("10.0.0.10")},
+		{"192.168.23.1", net.ParseIP("192.168.23.1")},
+	} {
+		t.Run(tt.local, func(t *testing.T) {
+			r := &localAddrRecorder{local: &net.UDPAddr{IP: net.ParseIP(tt.local), Port: 53}}
+			m := new(dns.Msg)
+			m.SetQuestion("nas.lan.", dns.TypeA)
+			s.Mux.ServeDNS(r, m)
+			if r.response == nil {
+				t.Fatalf("nil response")
+			}
+			if got, want := len(r.response.Answer), 1; got != want {
+				t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+			}
+			if got := r.response.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Errorf("unexpected response IP: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.interfaceOf = func(addr net.Addr) string {
+		if addr.(*net.UDPAddr).IP.Equal(net.ParseIP("10.0.10.1")) {
+			return "iot0"
+		}
+		return "lan0"
+	}
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply(w, r, " 3600 IN A 203.0.113.1")
+		})),
+	}
+	if err := s.SetConfig(&Config{
+		Records: []Record{{Name: "nas.lan", Addr: "10.0.0.10"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetLocalOnly([]string{"iot0"})
+
+	for _, tt := range []struct {
+		local string
+		name  string
+		want  int
+	}{
+		{"10.0.0.1", "www.example.com.", dns.RcodeSuccess},
+		{"10.0.10.1", "www.example.com.", dns.RcodeRefused},
+		{"10.0.10.1", "nas.lan.", dns.RcodeSuccess},
+	} {
+		t.Run(tt.local+"/"+tt.name, func(t *testing.T) {
+			r := &localAddrRecorder{local: &net.UDPAddr{IP: net.ParseIP(tt.local), Port: 53}}
+			m := new(dns.Msg)
+			m.SetQuestion(tt.name, dns.TypeA)
+			s.Mux.ServeDNS(r, m)
+			if r.response == nil {
+				t.Fatalf("nil response")
+			}
+			if got := r.response.Rcode; got != tt.want {
+				t.Errorf("unexpected rcode: got %s, want %s", dns.RcodeToString[got], dns.RcodeToString[tt.want])
+			}
+		})
+	}
+}
+
 func dnsServerAddr(t *testing.T, h dns.Handler) string {
 	t.Helper()
 
@@ -325,6 +598,61 @@ func TestHostname(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		now := time.Now()
+		s.SetLeases([]dhcp4d.Lease{
+			{
+				Hostname:     "android",
+				HardwareAddr: "02:00:00:00:00:02",
+				Addr:         net.IP{192, 168, 42, 52},
+				Expiry:       now.Add(2 * time.Second),
+			},
+			{
+				Hostname:     "android",
+				HardwareAddr: "02:00:00:00:00:01",
+				Addr:         net.IP{192, 168, 42, 51},
+				Expiry:       now.Add(1 * time.Second),
+			},
+		})
+		for _, tt := range []struct {
+			name string
+			ip   string
+		}{
+			{"android.lan.", "192.168.42.51"},
+			{"android-2.lan.", "192.168.42.52"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				m := new(dns.Msg)
+				m.SetQuestion(tt.name, dns.TypeA)
+				s.Mux.ServeDNS(r, m)
+				if got, want := len(r.response.Answer), 1; got != want {
+					t.Fatalf("unexpected number of answers for %v: got %d, want %d", m.Question, got, want)
+				}
+				a, ok := r.response.Answer[0].(*dns.A)
+				if !ok {
+					t.Fatalf("unexpected response type: got %T, want dns.A", r.response.Answer[0])
+				}
+				if got, want := a.A, net.ParseIP(tt.ip); !got.Equal(want) {
+					t.Fatalf("unexpected response IP: got %v, want %v", got, want)
+				}
+
+				rev, err := dns.ReverseAddr(tt.ip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m = new(dns.Msg)
+				m.SetQuestion(rev, dns.TypePTR)
+				s.Mux.ServeDNS(r, m)
+				if got, want := len(r.response.Answer), 1; got != want {
+					t.Fatalf("unexpected number of answers for %v: got %d, want %d", m.Question, got, want)
+				}
+				if got, want := r.response.Answer[0].(*dns.PTR).Ptr, tt.name; got != want {
+					t.Fatalf("unexpected PTR: got %q, want %q", got, want)
+				}
+			})
+		}
+	})
 }
 
 func TestHostnameDHCP(t *testing.T) {
@@ -621,3 +949,68 @@ func TestSubname(t *testing.T) {
 		}
 	})
 }
+
+func TestDomains(t *testing.T) {
+	s := NewServer("127.0.0.2:0", "lan")
+	s.SetLeases([]dhcp4d.Lease{
+		{
+			Hostname: "testtarget",
+			Addr:     net.IP{192, 168, 42, 23},
+		},
+	})
+	s.SetDomains([]string{"home.arpa", "Internal."})
+	// Queries for names outside of the local domains fail instead of being
+	// answered by an upstream:
+	s.upstream = []string{"266.266.266.266:53"}
+
+	for _, name := range []string{
+		"testtarget.home.arpa.",
+		"testtarget.internal.",
+		"TestTarget.Internal.",
+		"testtarget.",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := resolveTestTarget(s, name, net.ParseIP("192.168.42.23")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	for _, name := range []string{
+		"notfound.home.arpa.",
+		"notfound.internal.",
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := &recorder{}
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			s.Mux.ServeDNS(r, m)
+			if got, want := r.response.Rcode, dns.RcodeNameError; got != want {
+				t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("testtarget.lan. (removed)", func(t *testing.T) {
+		if err := resolveTestTarget(s, "testtarget.lan.", net.ParseIP("192.168.42.23")); err == nil {
+			t.Fatalf("testtarget.lan. unexpectedly resolved after removing the domain")
+		}
+	})
+
+	t.Run("PTR", func(t *testing.T) {
+		r := &recorder{}
+		m := new(dns.Msg)
+		m.SetQuestion("23.42.168.192.in-addr.arpa.", dns.TypePTR)
+		s.Mux.ServeDNS(r, m)
+		if got, want := len(r.response.Answer), 1; got != want {
+			t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+		}
+		a := r.response.Answer[0]
+		if _, ok := a.(*dns.PTR); !ok {
+			t.Fatalf("unexpected response type: got %T, want dns.PTR", a)
+		}
+		if got, want := a.(*dns.PTR).Ptr, "testtarget.home.arpa."; got != want {
+			t.Errorf("unexpected PTR: got %q, want %q", got, want)
+		}
+	})
+}
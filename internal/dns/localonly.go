@@ -0,0 +1,50 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import "github.com/miekg/dns"
+
+// SetLocalOnly configures the interfaces (e.g. of networks with a local-only
+// DNS policy, see netconfig.NetworkDNS) on which only local names are
+// answered. Queries which would be forwarded to the upstreams are refused.
+func (s *Server) SetLocalOnly(ifnames []string) {
+	localOnly := make(map[string]bool, len(ifnames))
+	for _, ifname := range ifnames {
+		localOnly[ifname] = true
+	}
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.localOnly = localOnly
+}
+
+// refuseForward answers r with REFUSED if it arrived on a local-only
+// interface, see SetLocalOnly.
+func (s *Server) refuseForward(w dns.ResponseWriter, r *dns.Msg) bool {
+	s.policyMu.RLock()
+	localOnly := s.localOnly
+	s.policyMu.RUnlock()
+	if len(localOnly) == 0 {
+		return false
+	}
+	ifname := s.interfaceOf(w.LocalAddr())
+	if !localOnly[ifname] {
+		return false
+	}
+	traceOf(w).add("local", 0, "refused: %s only resolves local names", ifname)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	w.WriteMsg(m)
+	return true
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultPrefetchHits is the default PrefetchConfig.MinHits.
+	defaultPrefetchHits = 3
+
+	// defaultPrefetchPercent is the default PrefetchConfig.Percent, as in
+	// unbound.
+	defaultPrefetchPercent = 10
+
+	// maxPrefetches bounds the number of concurrent prefetches, so that
+	// many answers expiring at once (e.g. after a restart) do not compete
+	// with client queries for the upstreams.
+	maxPrefetches = 4
+)
+
+// PrefetchConfig enables answering queries from the cache of upstream
+// answers, and refreshing popular answers shortly before they expire, so that
+// clients do not wait for slow upstreams when frequently used names expire.
+type PrefetchConfig struct {
+	// MinHits is how many queries an answer must have been served from the
+	// cache for (within its TTL) to be prefetched (default 3).
+	MinHits int `json:"min_hits"`
+
+	// Percent is the remaining TTL, as percentage of the original TTL,
+	// below which a query for a popular answer triggers a prefetch (default
+	// 10).
+	Percent int `json:"percent"`
+}
+
+// prefetchPolicy is the validated PrefetchConfig. The zero value disables
+// answering from the cache.
+type prefetchPolicy struct {
+	minHits int
+	percent int
+}
+
+func newPrefetchPolicy(cfg *PrefetchConfig) (prefetchPolicy, error) {
+	if cfg == nil {
+		return prefetchPolicy{}, nil
+	}
+	p := prefetchPolicy{
+		minHits: cfg.MinHits,
+		percent: cfg.Percent,
+	}
+	if p.minHits == 0 {
+		p.minHits = defaultPrefetchHits
+	}
+	if p.percent == 0 {
+		p.percent = defaultPrefetchPercent
+	}
+	if p.minHits < 0 {
+		return prefetchPolicy{}, fmt.Errorf("prefetch: min_hits must be positive")
+	}
+	if p.percent < 0 || p.percent >= 100 {
+		return prefetchPolicy{}, fmt.Errorf("prefetch: percent must be in [1, 99]")
+	}
+	return p, nil
+}
+
+// setPrefetch replaces the prefetch policy.
+func (c *staleCache) setPrefetch(p prefetchPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefetch = p
+}
+
+// fresh returns an answer to r from an unexpired entry (only if prefetching is
+// enabled), with TTLs reduced by the time since the answer was received.
+// prefetchHit is true if the entry was prefetched and is used for the first
+// time. If refresh is true, the entry is popular and about to expire: the
+// caller must prefetch it and call store or abortRefresh.
+func (c *staleCache) fresh(r *dns.Msg) (m *dns.Msg, refresh, prefetchHit bool) {
+	if len(r.Question) != 1 {
+		return nil, false, false
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		// Cached answers might lack the requested DNSSEC records.
+		return nil, false, false
+	}
+	key := staleKey(r.Question[0])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.prefetch.minHits == 0 {
+		return nil, false, false
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	now := c.now()
+	if !now.Before(e.expires) {
+		return nil, false, false
+	}
+	e.hits++
+	prefetchHit = e.prefetched && e.hits == 1
+	ttl := e.expires.Sub(e.stored)
+	remaining := e.expires.Sub(now)
+	if !e.refreshing &&
+		e.hits >= c.prefetch.minHits &&
+		remaining*100 <= ttl*time.Duration(c.prefetch.percent) {
+		e.refreshing = true
+		refresh = true
+	}
+	c.entries[key] = e
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	m = new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	for _, rr := range e.msg.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl -= elapsed // entries expire with their lowest TTL
+		m.Answer = append(m.Answer, rr)
+	}
+	return m, refresh, prefetchHit
+}
+
+// abortRefresh allows the next query for q to trigger a prefetch again, after
+// a prefetch failed.
+func (c *staleCache) abortRefresh(q dns.Question) {
+	key := staleKey(q)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.refreshing = false
+		c.entries[key] = e
+	}
+}
+
+// prefetch refreshes the cached answer to r in the background. Like regular
+// queries, prefetches query the upstreams in the order of the upstream
+// scheduler, and their round-trip times are learned.
+func (s *Server) prefetch(r *dns.Msg) {
+	q := r.Question[0]
+	select {
+	case s.prefetches <- struct{}{}:
+	default:
+		// Too many prefetches in progress: a later query for q triggers
+		// the prefetch instead.
+		s.stale.abortRefresh(q)
+		s.prom.prefetches.WithLabelValues("skipped").Inc()
+		return
+	}
+	m := r.Copy()
+	m.Id = dns.Id()
+	go func() {
+		defer func() { <-s.prefetches }()
+		for _, u := range s.sched.order(s.upstreams(), q.Name) {
+			start := time.Now()
+			in, _, err := s.client.Exchange(m, u)
+			s.observeUpstream(u, q.Name, time.Since(start), err != nil)
+			if err != nil {
+				continue // fall back to next-slower upstream
+			}
+			if stripped := s.stripRebind(in); stripped > 0 {
+				s.prom.rebind.Add(float64(stripped))
+			}
+			if !s.stale.store(in, true) {
+				break // e.g. SERVFAIL: keep serving the cached answer
+			}
+			s.prom.prefetches.WithLabelValues("ok").Inc()
+			return
+		}
+		s.stale.abortRefresh(q)
+		s.prom.prefetches.WithLabelValues("failed").Inc()
+	}()
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrefetch(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	var (
+		nowMu sync.Mutex // now is read by prefetches, too
+		now   = time.Now()
+	)
+	s.stale.now = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		now = now.Add(d)
+	}
+	var upstreamHits uint32
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddUint32(&upstreamHits, 1)
+			reply(w, r, " 100 IN A 203.0.113.1")
+		})),
+	}
+
+	query := func(do bool) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		if do {
+			m.SetEdns0(4096, true)
+		}
+		r := &recorder{}
+		s.Mux.ServeDNS(r, m)
+		if r.response == nil || len(r.response.Answer) != 1 {
+			t.Fatalf("unexpected response: %v", r.response)
+		}
+		return r.response
+	}
+	ttl := func(m *dns.Msg) uint32 { return m.Answer[0].Header().Ttl }
+
+	t.Run("Disabled", func(t *testing.T) {
+		query(false)
+		query(false)
+		if got, want := atomic.LoadUint32(&upstreamHits), uint32(2); got != want {
+			t.Fatalf("upstream queried %d times, want %d", got, want)
+		}
+	})
+
+	if err := s.SetConfig(&Config{Prefetch: &PrefetchConfig{MinHits: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreUint32(&upstreamHits, 0)
+	s.FlushCache()
+
+	query(false) // cache miss
+	query(true)  // DNSSEC records requested: not answered from the cache
+	advance(10 * time.Second)
+	if got, want := ttl(query(false)), uint32(90); got != want {
+		t.Errorf("TTL of cached answer: got %d, want %d", got, want)
+	}
+	if got, want := atomic.LoadUint32(&upstreamHits), uint32(2); got != want {
+		t.Fatalf("upstream queried %d times, want %d", got, want)
+	}
+
+	// The answer is popular and about to expire: it is answered from the
+	// cache, and refreshed in the background.
+	advance(85 * time.Second)
+	if got, want := ttl(query(false)), uint32(5); got != want {
+		t.Errorf("TTL of cached answer: got %d, want %d", got, want)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint32(&upstreamHits) < 3 || len(s.prefetches) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("answer not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	advance(10 * time.Second) // the original answer has expired
+	if got, want := ttl(query(false)), uint32(90); got != want {
+		t.Errorf("TTL of prefetched answer: got %d, want %d", got, want)
+	}
+	if got, want := atomic.LoadUint32(&upstreamHits), uint32(3); got != want {
+		t.Fatalf("upstream queried %d times, want %d", got, want)
+	}
+}
+
+func TestPrefetchPolicy(t *testing.T) {
+	p, err := newPrefetchPolicy(&PrefetchConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p, (prefetchPolicy{minHits: defaultPrefetchHits, percent: defaultPrefetchPercent}); got != want {
+		t.Errorf("newPrefetchPolicy(defaults) = %+v, want %+v", got, want)
+	}
+	for _, cfg := range []PrefetchConfig{
+		{MinHits: -1},
+		{Percent: 100},
+		{Percent: -5},
+	} {
+		if _, err := newPrefetchPolicy(&cfg); err == nil {
+			t.Errorf("newPrefetchPolicy(%+v) unexpectedly succeeded", cfg)
+		}
+	}
+}
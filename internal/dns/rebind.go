@@ -0,0 +1,90 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rebindNets are the networks to which names resolved by upstream DNS
+// servers must not point.
+var rebindNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT, RFC 6598
+	mustParseCIDR("127.0.0.0/8"),
+	mustParseCIDR("169.254.0.0/16"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("::/128"),
+	mustParseCIDR("::1/128"),
+	mustParseCIDR("fc00::/7"),  // unique local addresses, RFC 4193
+	mustParseCIDR("fe80::/10"), // link-local
+}
+
+func rebindAddr(ip net.IP) bool {
+	for _, n := range rebindNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindAllowed returns whether name may resolve to private addresses.
+func (s *Server) rebindAllowed(name string) bool {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	if !s.rebindProtection {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, d := range s.rebindAllowlist {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripRebind removes A and AAAA records pointing to private addresses from
+// the upstream answer in, unless the question name is allowlisted. It returns
+// the number of removed records.
+func (s *Server) stripRebind(in *dns.Msg) int {
+	if len(in.Question) == 0 || s.rebindAllowed(in.Question[0].Name) {
+		return 0
+	}
+	answer := in.Answer[:0]
+	var stripped int
+	for _, rr := range in.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip != nil && rebindAddr(ip) {
+			stripped++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	in.Answer = answer
+	return stripped
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RPZ policy actions, see
+// https://tools.ietf.org/html/draft-vixie-dnsop-dns-rpz-00#section-3
+const (
+	rpzNXDOMAIN  = "nxdomain"   // CNAME .
+	rpzNODATA    = "nodata"     // CNAME *.
+	rpzPassthru  = "passthru"   // CNAME rpz-passthru.
+	rpzDrop      = "drop"       // CNAME rpz-drop.
+	rpzLocalData = "local-data" // any other records
+)
+
+type rpzPolicy struct {
+	action string
+	data   []dns.RR // for rpzLocalData
+}
+
+// rpzZone is a parsed response policy zone. Only QNAME triggers are
+// supported: IP address, NSDNAME, NSIP and client IP triggers are skipped.
+type rpzZone struct {
+	zone string // origin, fully qualified, e.g. rpz.example.net.
+	file string
+
+	modTime time.Time
+	size    int64
+
+	exact    map[string]*rpzPolicy // lower-case fully qualified name
+	wildcard map[string]*rpzPolicy // lower-case suffix, e.g. “.example.com.”
+	skipped  int                   // number of unsupported records
+}
+
+// parseRPZ parses the RPZ zone file contents r of zone (e.g.
+// “rpz.example.net”). file is only used in error messages.
+func parseRPZ(r io.Reader, zone, file string) (*rpzZone, error) {
+	origin := strings.ToLower(dns.Fqdn(zone))
+	z := &rpzZone{
+		zone:     origin,
+		file:     file,
+		exact:    make(map[string]*rpzPolicy),
+		wildcard: make(map[string]*rpzPolicy),
+	}
+	zp := dns.NewZoneParser(r, origin, file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		owner := strings.ToLower(hdr.Name)
+		if owner == origin {
+			continue // SOA and NS records of the zone itself
+		}
+		if !strings.HasSuffix(owner, "."+origin) {
+			z.skipped++
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, origin)
+		if strings.HasSuffix(trigger, ".rpz-ip.") ||
+			strings.HasSuffix(trigger, ".rpz-nsdname.") ||
+			strings.HasSuffix(trigger, ".rpz-nsip.") ||
+			strings.HasSuffix(trigger, ".rpz-client-ip.") {
+			z.skipped++
+			continue
+		}
+		policy := &rpzPolicy{action: rpzLocalData}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				policy.action = rpzNXDOMAIN
+			case "*.":
+				policy.action = rpzNODATA
+			case "rpz-passthru.":
+				policy.action = rpzPassthru
+			case "rpz-drop.":
+				policy.action = rpzDrop
+			case "rpz-tcp-only.":
+				z.skipped++
+				continue
+			}
+		}
+		if policy.action == rpzLocalData {
+			rr = dns.Copy(rr)
+			rr.Header().Name = "" // replaced with the query name in answers
+			policy.data = []dns.RR{rr}
+		}
+		m, key := z.exact, trigger
+		if strings.HasPrefix(trigger, "*.") {
+			m, key = z.wildcard, strings.TrimPrefix(trigger, "*")
+		}
+		existing, ok := m[key]
+		switch {
+		case !ok:
+			m[key] = policy
+		case existing.action == rpzLocalData && policy.action == rpzLocalData:
+			existing.data = append(existing.data, policy.data...)
+		case existing.action == rpzLocalData:
+			// A policy action takes precedence over local data.
+			m[key] = policy
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// match returns the policy for name (fully qualified), preferring exact
+// triggers over the most specific wildcard trigger.
+func (z *rpzZone) match(name string) (*rpzPolicy, bool) {
+	name = strings.ToLower(name)
+	if p, ok := z.exact[name]; ok {
+		return p, true
+	}
+	for idx := strings.IndexByte(name, '.'); idx > -1 && idx < len(name)-1; {
+		if p, ok := z.wildcard[name[idx:]]; ok {
+			return p, true
+		}
+		next := strings.IndexByte(name[idx+1:], '.')
+		if next == -1 {
+			break
+		}
+		idx += 1 + next
+	}
+	return nil, false
+}
+
+// ReloadRPZ (re-)loads the RPZ zone files configured in dnsd.json whose
+// modification time or size changed since they were last loaded. Zones which
+// fail to load keep their previous contents (if any).
+func (s *Server) ReloadRPZ() error {
+	s.rpzMu.Lock()
+	defer s.rpzMu.Unlock()
+	s.policyMu.RLock()
+	configs := s.rpzConfig
+	loaded := make(map[string]*rpzZone, len(s.rpz))
+	for _, z := range s.rpz {
+		loaded[z.zone+" "+z.file] = z
+	}
+	s.policyMu.RUnlock()
+
+	var firstErr error
+	zones := make([]*rpzZone, 0, len(configs))
+	for _, c := range configs {
+		old := loaded[strings.ToLower(dns.Fqdn(c.Zone))+" "+c.File]
+		z, err := loadRPZ(c, old)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("rpz %s: %v", c.Zone, err)
+			}
+			z = old
+		}
+		if z == nil {
+			continue
+		}
+		if z != old {
+			log.Printf("loaded %d policies from RPZ %s (%d unsupported records skipped)",
+				len(z.exact)+len(z.wildcard), c.Zone, z.skipped)
+		}
+		zones = append(zones, z)
+	}
+
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.rpz = zones
+	return firstErr
+}
+
+// loadRPZ parses the zone file of c, unless it is unchanged compared to old.
+func loadRPZ(c RPZ, old *rpzZone) (*rpzZone, error) {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && old.modTime.Equal(st.ModTime()) && old.size == st.Size() {
+		return old, nil
+	}
+	z, err := parseRPZ(f, c.Zone, c.File)
+	if err != nil {
+		return nil, err
+	}
+	z.modTime = st.ModTime()
+	z.size = st.Size()
+	return z, nil
+}
+
+// rpzMatch returns the policy of the first configured zone matching name.
+func (s *Server) rpzMatch(name string) (zone string, p *rpzPolicy, ok bool) {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	for _, z := range s.rpz {
+		if p, ok := z.match(name); ok {
+			return z.zone, p, true
+		}
+	}
+	return "", nil, false
+}
+
+// applyRPZ answers r according to the response policy zones and returns true,
+// or returns false if no policy applies (or the policy is passthru).
+func (s *Server) applyRPZ(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(r.Question) != 1 {
+		return false
+	}
+	q := r.Question[0]
+	zone, p, ok := s.rpzMatch(q.Name)
+	if !ok {
+		return false
+	}
+	s.prom.rpz.WithLabelValues(strings.TrimSuffix(zone, "."), p.action).Inc()
+	log.Debugf("rpz %s: %s for %s", zone, p.action, q.Name)
+	traceOf(w).add("rpz", 0, "zone %s: %s", strings.TrimSuffix(zone, "."), p.action)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	switch p.action {
+	case rpzPassthru:
+		return false
+	case rpzDrop:
+		return true // no reply at all
+	case rpzNXDOMAIN:
+		m.SetRcode(r, dns.RcodeNameError)
+	case rpzNODATA:
+		// empty answer
+	case rpzLocalData:
+		var cname *dns.CNAME
+		for _, rr := range p.data {
+			hdr := rr.Header()
+			if hdr.Rrtype != q.Qtype && hdr.Rrtype != dns.TypeCNAME {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			m.Answer = append(m.Answer, rr)
+			if c, ok := rr.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+				cname = c
+			}
+		}
+		if cname != nil {
+			m.Answer = append(m.Answer, s.chase(cname.Target, q)...)
+		}
+	}
+	w.WriteMsg(m)
+	return true
+}
+
+// chase resolves target (the CNAME target of local data) via the upstream
+// servers, so that clients receive the addresses along with the CNAME.
+func (s *Server) chase(target string, q dns.Question) []dns.RR {
+	req := new(dns.Msg)
+	req.SetQuestion(target, q.Qtype)
+	for _, u := range s.upstreams() {
+		in, _, err := s.client.Exchange(req, u)
+		if err != nil {
+			continue
+		}
+		s.stripRebind(in)
+		return in.Answer
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const rpzZoneFile = `$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+@ NS localhost.
+
+malware.example.com      CNAME .
+*.malware.example.com    CNAME .
+tracker.example.com      CNAME *.
+ok.malware.example.com   CNAME rpz-passthru.
+dropped.example.com      CNAME rpz-drop.
+walled.example.com       A 10.0.0.1
+walled.example.com       AAAA fd00::1
+alias.example.com        CNAME walled.example.net.
+32.1.0.0.10.rpz-ip       CNAME .
+`
+
+func TestParseRPZ(t *testing.T) {
+	z, err := parseRPZ(strings.NewReader(rpzZoneFile), "rpz.example.net", "test.rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := z.skipped, 1; got != want {
+		t.Errorf("unexpected number of skipped records: got %d, want %d", got, want)
+	}
+	for _, tt := range []struct {
+		name   string
+		action string
+	}{
+		{"malware.example.com.", rpzNXDOMAIN},
+		{"WWW.Malware.example.com.", rpzNXDOMAIN},
+		{"a.b.malware.example.com.", rpzNXDOMAIN},
+		{"ok.malware.example.com.", rpzPassthru},
+		{"tracker.example.com.", rpzNODATA},
+		{"dropped.example.com.", rpzDrop},
+		{"walled.example.com.", rpzLocalData},
+		{"example.com.", ""},
+		{"www.tracker.example.com.", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := z.match(tt.name)
+			if tt.action == "" {
+				if ok {
+					t.Fatalf("match(%q) = %v, want no match", tt.name, p.action)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("match(%q): no match, want %v", tt.name, tt.action)
+			}
+			if got, want := p.action, tt.action; got != want {
+				t.Fatalf("match(%q) = %v, want %v", tt.name, got, want)
+			}
+		})
+	}
+	if p, _ := z.match("walled.example.com."); len(p.data) != 2 {
+		t.Errorf("unexpected local data: got %d records, want 2", len(p.data))
+	}
+}
+
+func TestRPZ(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fn := filepath.Join(tmp, "test.rpz")
+	if err := ioutil.WriteFile(fn, []byte(rpzZoneFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("localhost:0", "lan")
+	var upstreamHits uint32
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddUint32(&upstreamHits, 1)
+			reply(w, r, " 3600 IN A 192.0.2.1")
+		})),
+	}
+	if err := s.SetConfig(&Config{
+		RPZ: []RPZ{{Zone: "rpz.example.net", File: fn}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadRPZ(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		r := &recorder{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		s.Mux.ServeDNS(r, m)
+		return r.response
+	}
+
+	t.Run("nxdomain", func(t *testing.T) {
+		resp := query("www.malware.example.com.", dns.TypeA)
+		if got, want := resp.Rcode, dns.RcodeNameError; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("nodata", func(t *testing.T) {
+		resp := query("tracker.example.com.", dns.TypeA)
+		if got, want := resp.Rcode, dns.RcodeSuccess; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+		if len(resp.Answer) != 0 {
+			t.Fatalf("unexpected answer: %v", resp.Answer)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if resp := query("dropped.example.com.", dns.TypeA); resp != nil {
+			t.Fatalf("unexpected response: %v", resp)
+		}
+	})
+
+	t.Run("local-data", func(t *testing.T) {
+		resp := query("walled.example.com.", dns.TypeAAAA)
+		if got, want := len(resp.Answer), 1; got != want {
+			t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+		}
+		aaaa, ok := resp.Answer[0].(*dns.AAAA)
+		if !ok {
+			t.Fatalf("unexpected answer type: %T", resp.Answer[0])
+		}
+		if got, want := aaaa.Hdr.Name, "walled.example.com."; got != want {
+			t.Fatalf("unexpected owner: got %q, want %q", got, want)
+		}
+		if got, want := aaaa.AAAA.String(), "fd00::1"; got != want {
+			t.Fatalf("unexpected address: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("local-data cname", func(t *testing.T) {
+		resp := query("alias.example.com.", dns.TypeA)
+		if got, want := len(resp.Answer), 2; got != want {
+			t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+		}
+		if _, ok := resp.Answer[0].(*dns.CNAME); !ok {
+			t.Fatalf("unexpected answer type: %T", resp.Answer[0])
+		}
+	})
+
+	t.Run("passthru", func(t *testing.T) {
+		before := atomic.LoadUint32(&upstreamHits)
+		resp := query("ok.malware.example.com.", dns.TypeA)
+		if got, want := len(resp.Answer), 1; got != want {
+			t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+		}
+		if atomic.LoadUint32(&upstreamHits) == before {
+			t.Fatalf("passthru query not forwarded upstream")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		if err := ioutil.WriteFile(fn, []byte("www.example.org 300 CNAME .\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Ensure a different modification time on coarse file systems.
+		future := time.Now().Add(1 * time.Minute)
+		if err := os.Chtimes(fn, future, future); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ReloadRPZ(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := query("www.example.org.", dns.TypeA).Rcode, dns.RcodeNameError; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+		if got, want := query("malware.example.com.", dns.TypeA).Rcode, dns.RcodeSuccess; got != want {
+			t.Fatalf("unexpected rcode after reload: got %v, want %v", got, want)
+		}
+
+		// Invalid zone files keep the previously loaded policies.
+		if err := ioutil.WriteFile(fn, []byte("www.example.org 300 IN BOGUS .\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ReloadRPZ(); err == nil {
+			t.Fatalf("ReloadRPZ unexpectedly succeeded")
+		}
+		if got, want := query("www.example.org.", dns.TypeA).Rcode, dns.RcodeNameError; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+	})
+}
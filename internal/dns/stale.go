@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// staleTTL is the TTL of stale answers, as recommended by RFC 8767.
+	staleTTL = 30
+
+	// maxStale is how long after expiration answers are still served when
+	// no upstream is reachable (RFC 8767 suggests 1 to 3 days).
+	maxStale = 24 * time.Hour
+
+	// maxStaleEntries bounds the memory usage of the stale cache.
+	maxStaleEntries = 10000
+)
+
+type staleEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	hits       int  // queries answered from the entry, see fresh
+	prefetched bool // stored by a prefetch
+	refreshing bool // a prefetch is in progress
+}
+
+// staleCache keeps the most recent upstream answer for each question so that
+// it can be served stale (RFC 8767) while upstreams are unreachable. Unless
+// prefetching is enabled (see PrefetchConfig), it is not used for answering
+// queries while upstreams are reachable.
+type staleCache struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	entries  map[dns.Question]staleEntry
+	prefetch prefetchPolicy
+}
+
+func newStaleCache() *staleCache {
+	return &staleCache{
+		now:     time.Now,
+		entries: make(map[dns.Question]staleEntry),
+	}
+}
+
+func staleKey(q dns.Question) dns.Question {
+	q.Name = strings.ToLower(q.Name)
+	return q
+}
+
+// put stores the upstream answer in.
+func (c *staleCache) put(in *dns.Msg) {
+	c.store(in, false)
+}
+
+// store stores the upstream answer in, which was obtained by a prefetch if
+// prefetched is true. It returns whether in was stored.
+func (c *staleCache) store(in *dns.Msg, prefetched bool) bool {
+	if len(in.Question) != 1 || in.Rcode != dns.RcodeSuccess || len(in.Answer) == 0 {
+		return false
+	}
+	ttl := in.Answer[0].Header().Ttl
+	for _, rr := range in.Answer {
+		if t := rr.Header().Ttl; t < ttl {
+			ttl = t
+		}
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxStaleEntries {
+		for q, e := range c.entries {
+			if now.Sub(e.expires) > maxStale {
+				delete(c.entries, q)
+			}
+		}
+		// Still full: evict a random entry (map iteration order is random).
+		for q := range c.entries {
+			if len(c.entries) < maxStaleEntries {
+				break
+			}
+			delete(c.entries, q)
+		}
+	}
+	c.entries[staleKey(in.Question[0])] = staleEntry{
+		msg:        in.Copy(),
+		stored:     now,
+		expires:    now.Add(time.Duration(ttl) * time.Second),
+		prefetched: prefetched,
+	}
+	return true
+}
+
+// get returns a stale answer to r, with all TTLs set to staleTTL.
+func (c *staleCache) get(r *dns.Msg) (*dns.Msg, bool) {
+	if len(r.Question) != 1 {
+		return nil, false
+	}
+	key := staleKey(r.Question[0])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().Sub(e.expires) > maxStale {
+		delete(c.entries, key)
+		return nil, false
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, rr := range e.msg.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = staleTTL
+		m.Answer = append(m.Answer, rr)
+	}
+	return m, true
+}
+
+// flush removes all entries.
+func (c *staleCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[dns.Question]staleEntry)
+}
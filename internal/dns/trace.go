@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Trace describes how a query was resolved, see Server.Lookup.
+type Trace struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Steps []TraceStep `json:"steps"`
+
+	// Rcode is the response code, e.g. NOERROR or NXDOMAIN, or empty if
+	// the query was not answered (e.g. dropped by an RPZ policy, or no
+	// upstream was reachable).
+	Rcode    string        `json:"rcode"`
+	Answer   []string      `json:"answer"` // in zone file format
+	Duration time.Duration `json:"duration"`
+}
+
+// TraceStep is a step in the resolution of a query.
+type TraceStep struct {
+	// Stage is one of local, rpz, threatintel, cache, upstream, rebind or
+	// stale.
+	Stage  string        `json:"stage"`
+	Detail string        `json:"detail"`
+	RTT    time.Duration `json:"rtt,omitempty"` // for upstream
+}
+
+// add records a step. It is a no-op on a nil *Trace, i.e. for regular
+// queries.
+func (t *Trace) add(stage string, rtt time.Duration, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{
+		Stage:  stage,
+		Detail: fmt.Sprintf(format, args...),
+		RTT:    rtt,
+	})
+}
+
+// traceWriter is the dns.ResponseWriter of Server.Lookup. The handlers record
+// their steps in the trace of the writer, see traceOf.
+type traceWriter struct {
+	trace    *Trace
+	response *dns.Msg
+}
+
+func (w *traceWriter) WriteMsg(m *dns.Msg) error {
+	w.response = m
+	return nil
+}
+
+func (w *traceWriter) LocalAddr() net.Addr       { return nil }
+func (w *traceWriter) RemoteAddr() net.Addr      { return nil }
+func (w *traceWriter) Write([]byte) (int, error) { return 0, nil }
+func (w *traceWriter) Close() error              { return nil }
+func (w *traceWriter) TsigStatus() error         { return nil }
+func (w *traceWriter) TsigTimersOnly(bool)       {}
+func (w *traceWriter) Hijack()                   {}
+
+// traceOf returns the trace of w, or nil if w belongs to a regular query.
+func traceOf(w dns.ResponseWriter) *Trace {
+	if tw, ok := w.(*traceWriter); ok {
+		return tw.trace
+	}
+	return nil
+}
+
+// Lookup resolves name (e.g. “example.com”) with type qtype (e.g.
+// dns.TypeA) like a query from a LAN client without device policies, and
+// returns how the query was resolved.
+func (s *Server) Lookup(name string, qtype uint16) *Trace {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	w := &traceWriter{trace: &Trace{
+		Name: m.Question[0].Name,
+		Type: dns.TypeToString[qtype],
+	}}
+	start := time.Now()
+	s.Mux.ServeDNS(w, m)
+	tr := w.trace
+	tr.Duration = time.Since(start)
+	if resp := w.response; resp != nil {
+		tr.Rcode = dns.RcodeToString[resp.Rcode]
+		for _, rr := range resp.Answer {
+			tr.Answer = append(tr.Answer, rr.String())
+		}
+	}
+	return tr
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/rtr7/router7/internal/threatintel"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookup(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.upstream = []string{
+		"266.266.266.266:53", // fails to resolve
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply(w, r, " 3600 IN A 192.0.2.1")
+		})),
+	}
+	l := threatintel.NewList()
+	l.Add("urlhaus", []string{"malware.example.com"})
+	s.SetThreats(l)
+	s.ThreatHit = func(hit threatintel.Hit) {
+		t.Errorf("ThreatHit unexpectedly called for a lookup: %+v", hit)
+	}
+	if err := s.SetConfig(&Config{
+		Records: []Record{{Name: "nas.lan", Addr: "10.0.0.5"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stages := func(tr *Trace) []string {
+		var result []string
+		for _, step := range tr.Steps {
+			result = append(result, step.Stage)
+		}
+		return result
+	}
+
+	for _, tt := range []struct {
+		name   string
+		rcode  string
+		stages []string
+	}{
+		{"google.ch", "NOERROR", []string{"upstream", "upstream"}},
+		{"www.malware.example.com", "NXDOMAIN", []string{"threatintel"}},
+		{"nas.lan", "NOERROR", []string{"local"}},
+		{"unknown.lan", "NXDOMAIN", []string{"local"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := s.Lookup(tt.name, dns.TypeA)
+			if got, want := tr.Rcode, tt.rcode; got != want {
+				t.Fatalf("unexpected rcode: got %q, want %q (trace: %+v)", got, want, tr)
+			}
+			got := stages(tr)
+			if len(got) != len(tt.stages) {
+				t.Fatalf("unexpected stages: got %v, want %v", got, tt.stages)
+			}
+			for i := range got {
+				if got[i] != tt.stages[i] {
+					t.Fatalf("unexpected stages: got %v, want %v", got, tt.stages)
+				}
+			}
+		})
+	}
+
+	tr := s.Lookup("google.ch", dns.TypeA)
+	if got, want := len(tr.Answer), 1; got != want {
+		t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+	}
+}
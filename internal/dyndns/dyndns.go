@@ -0,0 +1,332 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dyndns publishes AAAA records for LAN hosts, whose addresses are
+// made up of the currently delegated IPv6 prefix and either a configured
+// interface identifier or the addresses learned via NDP. Records are updated
+// using DNS UPDATE (RFC 2136), which most authoritative name servers (and
+// many DNS providers) support.
+package dyndns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/rtr7/router7/internal/dhcp6"
+)
+
+// Config is the dynamic DNS configuration, stored in dyndns.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// Server is the name server accepting updates, e.g. ns1.example.com:53.
+	Server string `json:"server"`
+
+	// Zone is the zone containing the records, e.g. example.com.
+	Zone string `json:"zone"`
+
+	// TTL of the published records in seconds, defaults to 300.
+	TTL uint32 `json:"ttl"`
+
+	// TSIG authenticates the updates (RFC 2845).
+	TSIG TSIG `json:"tsig"`
+
+	Hosts []Host `json:"hosts"`
+}
+
+// TSIG is a transaction signature key, e.g. as generated by tsig-keygen.
+type TSIG struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"` // defaults to hmac-sha256
+	Secret    string `json:"secret"`    // base64
+}
+
+// Host is a LAN host whose AAAA record follows prefix changes.
+type Host struct {
+	// Name is the record name, e.g. server.example.com.
+	Name string `json:"name"`
+
+	// InterfaceIdentifier is the host part of the address (lower 64 bits),
+	// e.g. ::1234:5678:9abc:def0, for hosts with static addresses or
+	// tokenized interface identifiers.
+	InterfaceIdentifier string `json:"interface_identifier"`
+
+	// HardwareAddr is used to learn the addresses of hosts using SLAAC from
+	// the NDP neighbor table of lan0 if InterfaceIdentifier is not set.
+	HardwareAddr string `json:"hardware_addr"`
+}
+
+// ReadConfig reads dyndns.json from dir and fills in defaults.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "dyndns.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 300
+	}
+	if cfg.TSIG.Algorithm == "" {
+		cfg.TSIG.Algorithm = "hmac-sha256"
+	}
+	cfg.Zone = dns.Fqdn(cfg.Zone)
+	cfg.TSIG.Name = dns.Fqdn(cfg.TSIG.Name)
+	cfg.TSIG.Algorithm = dns.Fqdn(cfg.TSIG.Algorithm)
+	for idx := range cfg.Hosts {
+		cfg.Hosts[idx].Name = dns.Fqdn(cfg.Hosts[idx].Name)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("server: %v", err)
+	}
+	if c.Zone == "." {
+		return fmt.Errorf("zone not configured")
+	}
+	for _, h := range c.Hosts {
+		if !dns.IsSubDomain(c.Zone, h.Name) {
+			return fmt.Errorf("host %q is not within zone %q", h.Name, c.Zone)
+		}
+		if h.InterfaceIdentifier != "" {
+			if ip := net.ParseIP(h.InterfaceIdentifier); ip == nil || ip.To4() != nil {
+				return fmt.Errorf("host %q: invalid interface_identifier %q", h.Name, h.InterfaceIdentifier)
+			}
+			continue
+		}
+		if _, err := net.ParseMAC(h.HardwareAddr); err != nil {
+			return fmt.Errorf("host %q: neither interface_identifier nor a valid hardware_addr configured", h.Name)
+		}
+	}
+	return nil
+}
+
+// Prefix returns the /64 prefix which netconfigd configures on lan0, i.e. the
+// first /64 of the prefix delegated via DHCPv6, or nil if dhcp6 has not
+// obtained a lease yet.
+func Prefix(dir string) (*net.IPNet, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lease dhcp6.Config
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, fmt.Errorf("dhcp6/wire/lease.json: %v", err)
+	}
+	if len(lease.Prefixes) == 0 {
+		return nil, nil
+	}
+	// See netconfig.applyDhcp6
+	mask := net.CIDRMask(64, 128)
+	return &net.IPNet{
+		IP:   lease.Prefixes[0].IP.To16().Mask(mask),
+		Mask: mask,
+	}, nil
+}
+
+// Combine returns the address consisting of the upper 64 bits of prefix and
+// the lower 64 bits of iid.
+func Combine(prefix *net.IPNet, iid net.IP) net.IP {
+	addr := make(net.IP, net.IPv6len)
+	copy(addr[:8], prefix.IP.To16()[:8])
+	copy(addr[8:], iid.To16()[8:])
+	return addr
+}
+
+// eui64 returns the modified EUI-64 interface identifier (RFC 4291, appendix
+// A) derived from the 48-bit MAC address hwaddr.
+func eui64(hwaddr net.HardwareAddr) net.IP {
+	iid := make(net.IP, net.IPv6len)
+	copy(iid[8:11], hwaddr[:3])
+	iid[8] ^= 0x02
+	iid[11] = 0xff
+	iid[12] = 0xfe
+	copy(iid[13:], hwaddr[3:])
+	return iid
+}
+
+// Neighbor is an entry of the NDP neighbor table.
+type Neighbor struct {
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+}
+
+// Records returns the addresses to publish by record name. Hosts with an
+// InterfaceIdentifier are combined with prefix. Otherwise, the EUI-64 address
+// of the host is used if the host was seen using it, or all of its addresses
+// within prefix (e.g. privacy extensions, RFC 4941) which are in neighbors.
+func (c *Config) Records(prefix *net.IPNet, neighbors []Neighbor) map[string][]net.IP {
+	records := make(map[string][]net.IP)
+	for _, h := range c.Hosts {
+		if h.InterfaceIdentifier != "" {
+			records[h.Name] = append(records[h.Name], Combine(prefix, net.ParseIP(h.InterfaceIdentifier)))
+			continue
+		}
+		hwaddr, err := net.ParseMAC(h.HardwareAddr)
+		if err != nil {
+			continue // rejected by validate
+		}
+		var seen []net.IP
+		var stable net.IP
+		if len(hwaddr) == 6 {
+			stable = Combine(prefix, eui64(hwaddr))
+		}
+		for _, n := range neighbors {
+			if !bytes.Equal(n.HardwareAddr, hwaddr) || !prefix.Contains(n.IP) {
+				continue
+			}
+			if n.IP.Equal(stable) {
+				seen = []net.IP{stable}
+				break
+			}
+			seen = append(seen, n.IP)
+		}
+		sort.Slice(seen, func(i, j int) bool {
+			return bytes.Compare(seen[i], seen[j]) < 0
+		})
+		if len(seen) > 0 {
+			records[h.Name] = append(records[h.Name], seen...)
+		}
+	}
+	return records
+}
+
+// Equal returns whether the records a and b are identical.
+func Equal(a, b map[string][]net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, addrs := range a {
+		other, ok := b[name]
+		if !ok || len(other) != len(addrs) {
+			return false
+		}
+		for idx, addr := range addrs {
+			if !addr.Equal(other[idx]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Update replaces the AAAA records of all configured hosts with records (hosts
+// without addresses have their AAAA records removed) in one DNS UPDATE
+// message.
+func (c *Config) Update(records map[string][]net.IP) error {
+	m := new(dns.Msg)
+	m.SetUpdate(c.Zone)
+	var remove, insert []dns.RR
+	for _, h := range c.Hosts {
+		remove = append(remove, &dns.ANY{Hdr: dns.RR_Header{
+			Name:   h.Name,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+		}})
+	}
+	for name, addrs := range records {
+		for _, addr := range addrs {
+			insert = append(insert, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    c.TTL,
+				},
+				AAAA: addr,
+			})
+		}
+	}
+	m.RemoveRRset(remove)
+	m.Insert(insert)
+	return c.exchange(m)
+}
+
+// SetTXT replaces the TXT records of name (e.g. the ACME DNS-01 challenge
+// record _acme-challenge.router7.example.com.) with values, or removes them if
+// values is empty.
+func (c *Config) SetTXT(name string, values []string) error {
+	name = dns.Fqdn(name)
+	if !dns.IsSubDomain(c.Zone, name) {
+		return fmt.Errorf("%q is not within zone %q", name, c.Zone)
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(c.Zone)
+	m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeTXT,
+		Class:  dns.ClassINET,
+	}}})
+	var insert []dns.RR
+	for _, v := range values {
+		insert = append(insert, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Txt: []string{v},
+		})
+	}
+	if len(insert) > 0 {
+		m.Insert(insert)
+	}
+	return c.exchange(m)
+}
+
+// exchange sends the DNS UPDATE message m (signed if a TSIG key is
+// configured) to c.Server.
+func (c *Config) exchange(m *dns.Msg) error {
+	client := &dns.Client{Net: "tcp"}
+	if c.TSIG.Secret != "" {
+		client.TsigSecret = map[string]string{c.TSIG.Name: c.TSIG.Secret}
+		m.SetTsig(c.TSIG.Name, c.TSIG.Algorithm, 300, time.Now().Unix())
+	}
+	resp, _, err := client.Exchange(m, c.Server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update rejected: %s", strings.ToLower(dns.RcodeToString[resp.Rcode]))
+	}
+	return nil
+}
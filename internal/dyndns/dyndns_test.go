@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dyndns_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/dyndns"
+)
+
+func TestRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dyndns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "dyndns.json")
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "enabled": true,
+  "server": "ns1.example.com:53",
+  "zone": "example.com",
+  "hosts": [{"name": "other.example.net"}]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dyndns.ReadConfig(dir); err == nil {
+		t.Errorf("ReadConfig unexpectedly accepted a host outside of the zone")
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "enabled": true,
+  "server": "ns1.example.com:53",
+  "zone": "example.com",
+  "hosts": [
+    {"name": "server.example.com", "interface_identifier": "::1234:5678:9abc:def0"},
+    {"name": "nas.example.com", "hardware_addr": "02:00:00:00:00:05"},
+    {"name": "laptop.example.com", "hardware_addr": "02:00:00:00:00:06"},
+    {"name": "offline.example.com", "hardware_addr": "02:00:00:00:00:07"}
+  ]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dyndns.ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.TTL, uint32(300); got != want {
+		t.Errorf("unexpected default TTL: got %d, want %d", got, want)
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8:4a00::/64")
+	neighbors := []dyndns.Neighbor{
+		// EUI-64 address of nas, preferred over its privacy address:
+		{IP: net.ParseIP("2001:db8:4a00::ab:cd"), HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 5}},
+		{IP: net.ParseIP("2001:db8:4a00::ff:fe00:5"), HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 5}},
+		// privacy addresses of laptop:
+		{IP: net.ParseIP("2001:db8:4a00::2"), HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 6}},
+		{IP: net.ParseIP("2001:db8:4a00::1"), HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 6}},
+		// outside of the prefix:
+		{IP: net.ParseIP("fe80::1"), HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 6}},
+	}
+	got := cfg.Records(prefix, neighbors)
+	want := map[string][]net.IP{
+		"server.example.com.": {net.ParseIP("2001:db8:4a00::1234:5678:9abc:def0")},
+		"nas.example.com.":    {net.ParseIP("2001:db8:4a00::ff:fe00:5")},
+		"laptop.example.com.": {net.ParseIP("2001:db8:4a00::1"), net.ParseIP("2001:db8:4a00::2")},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Records: diff (-want +got):\n%s", diff)
+	}
+	if !dyndns.Equal(want, got) {
+		t.Errorf("Equal(want, got) = false, want true")
+	}
+
+	// After a prefix change, all records follow:
+	_, prefix, _ = net.ParseCIDR("2001:db8:5b00::/64")
+	got = cfg.Records(prefix, nil)
+	want = map[string][]net.IP{
+		"server.example.com.": {net.ParseIP("2001:db8:5b00::1234:5678:9abc:def0")},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Records: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fwlog turns packets logged by the firewall (via NFLOG) into
+// structured, rate limited and aggregated events.
+package fwlog
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+)
+
+// Group is the NFLOG group to which netconfig’s log statements send packets.
+const Group = 7
+
+// Event is a structured representation of a logged packet.
+type Event struct {
+	Rule     string    `json:"rule"` // e.g. “rogue”
+	Time     time.Time `json:"time"`
+	InIface  string    `json:"in_iface"` // e.g. “uplink0”
+	OutIface string    `json:"out_iface"`
+	Proto    string    `json:"proto"` // e.g. “tcp”
+	Src      string    `json:"src"`   // e.g. “192.0.2.23”
+	Dst      string    `json:"dst"`
+	SrcPort  uint16    `json:"src_port"`
+	DstPort  uint16    `json:"dst_port"`
+
+	// Country is the ISO code of the country of the remote (internet) address,
+	// if known.
+	Country string `json:"country"`
+}
+
+// Remote returns the address of the internet peer of ev, if any, based on the
+// interface the packet was received on or sent to.
+func (ev *Event) Remote() net.IP {
+	if ev.InIface == "uplink0" {
+		return net.ParseIP(ev.Src)
+	}
+	if ev.OutIface == "uplink0" {
+		return net.ParseIP(ev.Dst)
+	}
+	return nil
+}
+
+// Decode turns p into an Event. ifname resolves interface indices to names.
+func Decode(p *Packet, ifname func(index uint32) string) Event {
+	ev := Event{
+		Rule: p.Prefix,
+		Time: p.Time,
+	}
+	if p.InIndex != 0 {
+		ev.InIface = ifname(p.InIndex)
+	}
+	if p.OutIndex != 0 {
+		ev.OutIface = ifname(p.OutIndex)
+	}
+	first := layers.LayerTypeIPv4
+	if p.Family == unix.NFPROTO_IPV6 ||
+		(len(p.Payload) > 0 && p.Payload[0]>>4 == 6) {
+		first = layers.LayerTypeIPv6
+	}
+	pkt := gopacket.NewPacket(p.Payload, first, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		ev.Src, ev.Dst = ip.SrcIP.String(), ip.DstIP.String()
+		ev.Proto = ip.Protocol.String()
+	case *layers.IPv6:
+		ev.Src, ev.Dst = ip.SrcIP.String(), ip.DstIP.String()
+		ev.Proto = ip.NextHeader.String()
+	}
+	switch l4 := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		ev.Proto = "tcp"
+		ev.SrcPort, ev.DstPort = uint16(l4.SrcPort), uint16(l4.DstPort)
+	case *layers.UDP:
+		ev.Proto = "udp"
+		ev.SrcPort, ev.DstPort = uint16(l4.SrcPort), uint16(l4.DstPort)
+	}
+	return ev
+}
+
+// Aggregate summarizes events which only differ in their time and source port.
+type Aggregate struct {
+	Event           // most recent event
+	First time.Time `json:"first"`
+	Count uint64    `json:"count"`
+}
+
+type aggKey struct {
+	rule, inIface, proto, src, dst string
+	dstPort                        uint16
+}
+
+// Aggregator collects events. Each rule may produce at most Burst new
+// aggregates at once and Limit new aggregates per second, so that port scans
+// or floods cannot exhaust memory. Events which only update existing
+// aggregates are not limited.
+type Aggregator struct {
+	Limit rate.Limit
+	Burst int
+	// Max is the maximum number of aggregates to retain. When exceeded, the
+	// least recently updated aggregates are discarded.
+	Max int
+
+	mu         sync.Mutex
+	aggregates map[aggKey]*Aggregate
+	limiters   map[string]*rate.Limiter
+}
+
+// NewAggregator returns an Aggregator with defaults suitable for home
+// networks.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		Limit:      rate.Every(1 * time.Second),
+		Burst:      10,
+		Max:        1000,
+		aggregates: make(map[aggKey]*Aggregate),
+		limiters:   make(map[string]*rate.Limiter),
+	}
+}
+
+// Add records ev. It returns false if ev was dropped due to rate limiting.
+func (a *Aggregator) Add(ev Event) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := aggKey{ev.Rule, ev.InIface, ev.Proto, ev.Src, ev.Dst, ev.DstPort}
+	if agg, ok := a.aggregates[key]; ok {
+		agg.Event = ev
+		agg.Count++
+		return true
+	}
+	lim, ok := a.limiters[ev.Rule]
+	if !ok {
+		lim = rate.NewLimiter(a.Limit, a.Burst)
+		a.limiters[ev.Rule] = lim
+	}
+	if !lim.AllowN(ev.Time, 1) {
+		return false
+	}
+	a.aggregates[key] = &Aggregate{
+		Event: ev,
+		First: ev.Time,
+		Count: 1,
+	}
+	if len(a.aggregates) > a.Max {
+		a.evictLocked()
+	}
+	return true
+}
+
+func (a *Aggregator) evictLocked() {
+	keys := make([]aggKey, 0, len(a.aggregates))
+	for key := range a.aggregates {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return a.aggregates[keys[i]].Time.Before(a.aggregates[keys[j]].Time)
+	})
+	for _, key := range keys[:len(keys)-a.Max] {
+		delete(a.aggregates, key)
+	}
+}
+
+// Aggregates returns a copy of all aggregates, most recently updated first.
+func (a *Aggregator) Aggregates() []Aggregate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make([]Aggregate, 0, len(a.aggregates))
+	for _, agg := range a.aggregates {
+		result = append(result, *agg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	return result
+}
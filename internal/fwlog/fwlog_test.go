@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func tcpSYN(t *testing.T) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{192, 0, 2, 23},
+		DstIP:    net.IP{198, 51, 100, 1},
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{SrcPort: 42042, DstPort: 22, SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParsePacket(t *testing.T) {
+	payload := tcpSYN(t)
+	ifindex := make([]byte, 4)
+	binary.BigEndian.PutUint32(ifindex, 2)
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfulaPrefix, Data: []byte("rogue\x00")},
+		{Type: nfulaIfindexIn, Data: ifindex},
+		{Type: nfulaPayload, Data: payload},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parsePacket(append(nfgenmsg(unix.NFPROTO_IPV4, Group), attrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := Decode(p, func(index uint32) string { return fmt.Sprintf("if%d", index) })
+	want := Event{
+		Rule:    "rogue",
+		Time:    ev.Time,
+		InIface: "if2",
+		Proto:   "tcp",
+		Src:     "192.0.2.23",
+		Dst:     "198.51.100.1",
+		SrcPort: 42042,
+		DstPort: 22,
+	}
+	if ev != want {
+		t.Fatalf("Decode: got %+v, want %+v", ev, want)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator()
+	a.Burst = 2
+	now := time.Now()
+	ev := func(src string) Event {
+		return Event{
+			Rule:    "wan-inbound",
+			Time:    now,
+			Proto:   "tcp",
+			Src:     src,
+			DstPort: 22,
+		}
+	}
+	for _, src := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		if !a.Add(ev(src)) {
+			t.Fatalf("Add(%s): unexpectedly rate limited", src)
+		}
+	}
+	if a.Add(ev("192.0.2.3")) {
+		t.Fatalf("Add(192.0.2.3): unexpectedly not rate limited")
+	}
+	// Existing aggregates are updated regardless of the rate limit.
+	if !a.Add(ev("192.0.2.1")) {
+		t.Fatalf("Add(192.0.2.1): unexpectedly rate limited")
+	}
+	counts := make(map[string]uint64)
+	for _, agg := range a.Aggregates() {
+		counts[agg.Src] = agg.Count
+	}
+	if got, want := counts["192.0.2.1"], uint64(3); got != want {
+		t.Errorf("192.0.2.1: got count %d, want %d", got, want)
+	}
+	if got, want := len(counts), 2; got != want {
+		t.Errorf("unexpected number of aggregates: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// from include/uapi/linux/netfilter/nfnetlink_log.h
+const (
+	nfnlSubsysULOG = 4
+
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind = 1
+
+	nfulnlCopyPacket = 2
+
+	nfulaPacketHdr   = 1
+	nfulaTimestamp   = 3
+	nfulaIfindexIn   = 4
+	nfulaIfindexOut  = 5
+	nfulaPayload     = 9
+	nfulaPrefix      = 10
+	nfnetlinkVersion = 0
+)
+
+// Packet is a packet logged by an nftables log statement.
+type Packet struct {
+	Prefix   string // log prefix, router7 uses the rule name
+	Family   byte   // e.g. unix.NFPROTO_IPV4
+	Time     time.Time
+	InIndex  uint32 // input interface index, 0 if unknown
+	OutIndex uint32 // output interface index, 0 if unknown
+	Payload  []byte // starting with the network layer header
+}
+
+// nfgenmsg returns a struct nfgenmsg.
+func nfgenmsg(family byte, resID uint16) []byte {
+	b := []byte{family, nfnetlinkVersion, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], resID)
+	return b
+}
+
+// parsePacket parses the data of an NFULNL_MSG_PACKET message.
+func parsePacket(data []byte) (*Packet, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message too short for nfgenmsg: %d bytes", len(data))
+	}
+	p := &Packet{Family: data[0]}
+	attrs, err := netlink.UnmarshalAttributes(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		// Strip NLA_F_NESTED and NLA_F_NET_BYTEORDER.
+		switch attr.Type & ^uint16(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER) {
+		case nfulaPrefix:
+			p.Prefix = strings.TrimRight(string(attr.Data), "\x00")
+		case nfulaTimestamp:
+			if len(attr.Data) == 16 {
+				sec := binary.BigEndian.Uint64(attr.Data)
+				usec := binary.BigEndian.Uint64(attr.Data[8:])
+				p.Time = time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+			}
+		case nfulaIfindexIn:
+			if len(attr.Data) == 4 {
+				p.InIndex = binary.BigEndian.Uint32(attr.Data)
+			}
+		case nfulaIfindexOut:
+			if len(attr.Data) == 4 {
+				p.OutIndex = binary.BigEndian.Uint32(attr.Data)
+			}
+		case nfulaPayload:
+			p.Payload = attr.Data
+		}
+	}
+	if p.Time.IsZero() {
+		// The kernel only includes timestamps for packets which have one.
+		p.Time = time.Now()
+	}
+	return p, nil
+}
+
+// Conn receives packets logged to an NFLOG group.
+type Conn struct {
+	c *netlink.Conn
+}
+
+// Listen subscribes to the NFLOG group, as used in nftables log statements
+// (log group <group>).
+func Listen(group uint16) (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, 0xffff) // copy range
+	mode[4] = nfulnlCopyPacket
+	for _, attr := range []netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}},
+		{Type: nfulaCfgMode, Data: mode},
+	} {
+		b, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		msg := netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(nfnlSubsysULOG<<8 | nfulnlMsgConfig),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: append(nfgenmsg(unix.AF_UNSPEC, group), b...),
+		}
+		if _, err := c.Execute(msg); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("configuring NFLOG group %d: %v", group, err)
+		}
+	}
+	return &Conn{c: c}, nil
+}
+
+// Receive blocks until logged packets are available.
+func (c *Conn) Receive() ([]*Packet, error) {
+	msgs, err := c.c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	var packets []*Packet
+	for _, msg := range msgs {
+		if msg.Header.Type != netlink.HeaderType(nfnlSubsysULOG<<8|nfulnlMsgPacket) {
+			continue
+		}
+		p, err := parsePacket(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package geoip maps IP addresses to countries using MaxMind DB (MMDB) files,
+// e.g. GeoLite2-Country.mmdb or the db-ip.com country database.
+package geoip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// DB is a country database. A nil *DB is valid and knows no countries, so
+// that GeoIP support remains optional.
+type DB struct {
+	r *maxminddb.Reader
+}
+
+// Open opens the MMDB file at path.
+func Open(path string) (*DB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{r: r}, nil
+}
+
+// Close releases the resources of db.
+func (db *DB) Close() error {
+	if db == nil {
+		return nil
+	}
+	return db.r.Close()
+}
+
+// Country returns the ISO 3166-1 alpha-2 code (e.g. “CH”) of the country ip
+// is located in, or the empty string if unknown.
+func (db *DB) Country(ip net.IP) string {
+	if db == nil || ip == nil {
+		return ""
+	}
+	var rec record
+	if err := db.r.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// Networks returns all networks located in one of countries (ISO codes).
+func (db *DB) Networks(countries []string) ([]*net.IPNet, error) {
+	if db == nil {
+		return nil, nil
+	}
+	want := make(map[string]bool)
+	for _, c := range countries {
+		want[strings.ToUpper(c)] = true
+	}
+	var result []*net.IPNet
+	networks := db.r.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var rec record
+		n, err := networks.Network(&rec)
+		if err != nil {
+			return nil, err
+		}
+		if want[rec.Country.ISOCode] {
+			result = append(result, n)
+		}
+	}
+	if err := networks.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BlockConfig is the country-based blocking configuration, stored in
+// geoblock.json.
+type BlockConfig struct {
+	// DB is the path to the MMDB file, e.g.
+	// /perm/geoip/GeoLite2-Country.mmdb.
+	DB string `json:"db"`
+
+	// Countries lists the ISO codes of countries from which inbound WAN
+	// traffic is dropped, e.g. ["XX", "YY"].
+	Countries []string `json:"countries"`
+
+	// LogOutbound enables logging new outbound connections, so that fwlogd
+	// can tag them by country.
+	LogOutbound bool `json:"log_outbound"`
+}
+
+// ReadBlockConfig reads geoblock.json from dir. A missing file results in a
+// configuration which blocks nothing.
+func ReadBlockConfig(dir string) (*BlockConfig, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "geoblock.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &BlockConfig{}, nil
+		}
+		return nil, err
+	}
+	var cfg BlockConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gokrazyctl controls the local gokrazy instance (rebooting, restarting
+// processes, switching root partitions) via its web interface.
+package gokrazyctl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const baseURL = "http://localhost"
+
+func newRequest(method, path string) (*http.Request, error) {
+	pw, err := ioutil.ReadFile("/etc/gokr-pw.txt")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("gokrazy", strings.TrimSpace(string(pw)))
+	return req, nil
+}
+
+func post(path string) error {
+	req, err := newRequest("POST", path)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected HTTP status: got %v (%s), want %v", path, resp.Status, strings.TrimSpace(string(b)), want)
+	}
+	return nil
+}
+
+// Reboot reboots the machine.
+func Reboot() error {
+	return post("/reboot")
+}
+
+// Restart restarts the process with the specified path, e.g. /user/dnsd.
+func Restart(path string) error {
+	return post("/restart?path=" + url.QueryEscape(path))
+}
+
+// Stop stops the process with the specified path, e.g. /user/snid, until it is
+// restarted (see Restart).
+func Stop(path string) error {
+	return post("/stop?path=" + url.QueryEscape(path))
+}
+
+// SwitchRoot makes the inactive root partition active for the next boot.
+func SwitchRoot() error {
+	return post("/update/switch")
+}
+
+// Log writes the output (stream is “stdout” or “stderr”) of the process with
+// the specified path (e.g. /user/dnsd) to w, one line at a time, until ctx is
+// done. gokrazy sends the buffered output first, followed by new output.
+func Log(ctx context.Context, w io.Writer, path, stream string) error {
+	req, err := newRequest("GET", "/log?path="+url.QueryEscape(path)+"&stream="+url.QueryEscape(stream))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("log: unexpected HTTP status: got %v (%s), want %v", resp.Status, strings.TrimSpace(string(b)), want)
+	}
+	// The log is sent as server-sent events (text/event-stream).
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimPrefix(line, "data: ")); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil // canceled by the caller
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package healthz implements the /healthz endpoint of router7 daemons and
+// aggregates the health of all daemons into the overall router readiness.
+package healthz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// DefaultTargets are the HTTP endpoints of the router7 daemons, by daemon
+// name, with their default ports (see multilisten.ResolveAll for the
+// configured ports).
+var DefaultTargets = map[string]string{
+	"backupd":      "localhost:8077",
+	"certd":        "localhost:8086",
+	"diagd":        "localhost:7733",
+	"dhcp4d":       "localhost:8067",
+	"dhcp6d":       "localhost:8069",
+	"dnsd":         "localhost:8053",
+	"dyndns":       "localhost:8085",
+	"fwlogd":       "localhost:8075",
+	"ikev2d":       "localhost:8083",
+	"lted":         "localhost:8087",
+	"maintd":       "localhost:8079",
+	"metricspushd": "localhost:8081",
+	"netconfigd":   "localhost:8066",
+	"nfqueued":     "localhost:8076",
+	"ntpd":         "localhost:8123",
+	"presenced":    "localhost:8078",
+	"rogued":       "localhost:8074",
+	"snid":         "localhost:8082",
+	"tailnetd":     "localhost:8084",
+	"telemetryd":   "localhost:8080",
+	"updated":      "localhost:8068",
+}
+
+// Check returns an error describing why a daemon is unhealthy, or nil.
+type Check func() error
+
+var (
+	checksMu sync.Mutex
+	checks   = make(map[string]Check)
+)
+
+// Register adds check to the checks reported by Handler. A daemon without
+// checks is healthy as long as it serves HTTP requests.
+func Register(name string, check Check) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	checks[name] = check
+}
+
+// Failure is a failed health check.
+type Failure struct {
+	Daemon string `json:"daemon,omitempty"` // set by Aggregate
+	Check  string `json:"check"`
+	Reason string `json:"reason"`
+}
+
+// Status is the reply of a /healthz endpoint.
+type Status struct {
+	Healthy  bool      `json:"healthy"`
+	Failures []Failure `json:"failures,omitempty"`
+}
+
+// Evaluate runs all registered checks.
+func Evaluate() Status {
+	checksMu.Lock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	current := make(map[string]Check, len(checks))
+	for name, check := range checks {
+		current[name] = check
+	}
+	checksMu.Unlock()
+	sort.Strings(names)
+
+	status := Status{Healthy: true}
+	for _, name := range names {
+		if err := current[name](); err != nil {
+			status.Healthy = false
+			status.Failures = append(status.Failures, Failure{
+				Check:  name,
+				Reason: err.Error(),
+			})
+		}
+	}
+	return status
+}
+
+// Write serves status as JSON, with HTTP status 503 if it is not healthy.
+func Write(w http.ResponseWriter, status Status) {
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// Handler serves the result of Evaluate.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, Evaluate())
+	})
+}
+
+func query(ctx context.Context, client *http.Client, addr string) (*Status, error) {
+	req, err := http.NewRequest("GET", "http://"+addr+"/healthz", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err := json.Unmarshal(b, &status); err != nil {
+		return nil, fmt.Errorf("unexpected reply (HTTP status %s): %v", resp.Status, err)
+	}
+	return &status, nil
+}
+
+// Aggregate queries the /healthz endpoints of targets (daemon name to
+// host:port) concurrently. The router is healthy if all daemons are
+// reachable and healthy.
+func Aggregate(ctx context.Context, client *http.Client, targets map[string]string) Status {
+	daemons := make([]string, 0, len(targets))
+	for daemon := range targets {
+		daemons = append(daemons, daemon)
+	}
+	sort.Strings(daemons)
+	results := make([][]Failure, len(daemons))
+	var wg sync.WaitGroup
+	for idx, daemon := range daemons {
+		wg.Add(1)
+		go func(idx int, daemon string) {
+			defer wg.Done()
+			status, err := query(ctx, client, targets[daemon])
+			if err != nil {
+				results[idx] = []Failure{{Daemon: daemon, Check: "reachable", Reason: err.Error()}}
+				return
+			}
+			if status.Healthy {
+				return
+			}
+			failures := status.Failures
+			if len(failures) == 0 {
+				failures = []Failure{{Check: "healthy", Reason: "reported unhealthy"}}
+			}
+			for _, f := range failures {
+				f.Daemon = daemon
+				results[idx] = append(results[idx], f)
+			}
+		}(idx, daemon)
+	}
+	wg.Wait()
+	status := Status{Healthy: true}
+	for _, failures := range results {
+		if len(failures) > 0 {
+			status.Healthy = false
+			status.Failures = append(status.Failures, failures...)
+		}
+	}
+	return status
+}
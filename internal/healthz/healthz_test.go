@@ -0,0 +1,72 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthz
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, Status{Healthy: true})
+	}))
+	defer healthy.Close()
+
+	Register("upstream", func() error { return errors.New("no upstream reachable") })
+	Register("ok", func() error { return nil })
+	unhealthy := httptest.NewServer(Handler())
+	defer unhealthy.Close()
+
+	resp, err := http.Get(unhealthy.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+
+	// Find a port on which nothing listens:
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := ln.Addr().String()
+	ln.Close()
+
+	status := Aggregate(context.Background(), http.DefaultClient, map[string]string{
+		"dnsd":  strings.TrimPrefix(healthy.URL, "http://"),
+		"ntpd":  strings.TrimPrefix(unhealthy.URL, "http://"),
+		"rogue": unreachable,
+	})
+	if status.Healthy {
+		t.Fatalf("Aggregate unexpectedly reported healthy")
+	}
+	if got, want := len(status.Failures), 2; got != want {
+		t.Fatalf("Aggregate: got %d failures, want %d: %+v", got, want, status.Failures)
+	}
+	if got, want := status.Failures[0], (Failure{Daemon: "ntpd", Check: "upstream", Reason: "no upstream reachable"}); got != want {
+		t.Errorf("Aggregate: failure 0: got %+v, want %+v", got, want)
+	}
+	if got, want := status.Failures[1].Daemon+"/"+status.Failures[1].Check, "rogue/reachable"; got != want {
+		t.Errorf("Aggregate: failure 1: got %s, want %s", got, want)
+	}
+}
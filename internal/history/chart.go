@@ -0,0 +1,147 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/webui"
+)
+
+const (
+	chartWidth  = 960
+	chartHeight = 200
+)
+
+// chart is an SVG line chart of one metric over [from, to].
+type chart struct {
+	Title    string // message ID
+	Max      string // label of the y axis maximum
+	Points   string // SVG polyline points
+	Down     []rect // periods during which the uplink was down
+	Events   []marker
+	From, To string
+}
+
+type rect struct {
+	X, Width float64
+}
+
+type marker struct {
+	X     float64
+	Title string
+}
+
+func buildChart(title, unit string, samples []Sample, events []Event, from, to time.Time, value func(Sample) float64) chart {
+	span := to.Sub(from).Seconds()
+	x := func(t time.Time) float64 {
+		return t.Sub(from).Seconds() / span * chartWidth
+	}
+	max := 0.0
+	for _, s := range samples {
+		if v := value(s); v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	c := chart{
+		Title: title,
+		Max:   fmt.Sprintf("%.1f %s", max, unit),
+		From:  from.Format("2006-01-02 15:04"),
+		To:    to.Format("2006-01-02 15:04"),
+	}
+	var points []string
+	for _, s := range samples {
+		y := chartHeight - value(s)/max*chartHeight
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(s.Time), y))
+		if !s.Up {
+			c.Down = append(c.Down, rect{X: x(s.Time), Width: 2})
+		}
+	}
+	c.Points = strings.Join(points, " ")
+	for _, ev := range events {
+		title := ev.Kind
+		if ev.Detail != "" {
+			title += ": " + ev.Detail
+		}
+		c.Events = append(c.Events, marker{
+			X:     x(ev.Time),
+			Title: ev.Time.Format(time.RFC3339) + " " + title,
+		})
+	}
+	return c
+}
+
+//go:embed page.html.tmpl
+var pageHTML string
+
+var pageTmpl = webui.Must(webui.Parse("diagd", pageHTML, nil))
+
+func eventsTable(events []Event) *webui.Table {
+	t := &webui.Table{
+		Columns: []string{"time", "event", "detail"},
+		Empty:   "no_events",
+	}
+	for _, ev := range events {
+		t.Append(
+			webui.Text(ev.Time.Format("2006-01-02 15:04:05")),
+			webui.Text(ev.Kind),
+			webui.Text(ev.Detail))
+	}
+	return t
+}
+
+// Ranges are the time ranges offered by WritePage.
+var Ranges = map[string]time.Duration{
+	"1d":  24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// WritePage writes an HTML page charting latency and loss of the last rng
+// (one of Ranges) in response to r.
+func (s *Store) WritePage(w http.ResponseWriter, r *http.Request, rng string, now time.Time) error {
+	d, ok := Ranges[rng]
+	if !ok {
+		return fmt.Errorf("unknown range %q", rng)
+	}
+	from := now.Add(-d)
+	samples, events := s.Range(from, now)
+	// Keep the number of points per chart in the order of the chart width.
+	step := d / chartWidth
+	if step > time.Minute {
+		samples = Aggregate(samples, step)
+	}
+	return pageTmpl.Execute(w, r, struct {
+		Range  string
+		Ranges []string
+		Charts []chart
+		Events *webui.Table
+	}{
+		Range:  rng,
+		Ranges: []string{"1d", "7d", "30d"},
+		Charts: []chart{
+			buildChart("latency", "ms", samples, events, from, now, func(s Sample) float64 { return s.RTT }),
+			buildChart("packet_loss", "%", samples, events, from, now, func(s Sample) float64 { return s.Loss * 100 }),
+		},
+		Events: eventsTable(events),
+	})
+}
@@ -0,0 +1,274 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package history stores a compressed time series of WAN uplink health
+// (latency, packet loss, link state) and events (WAN address changes, uplink
+// flaps) on the permanent partition, one file per day.
+package history
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Sample is one measurement of the uplink health.
+type Sample struct {
+	Time time.Time `json:"t"`
+	Up   bool      `json:"up"`
+	// RTT is the average round-trip time in milliseconds of the replies
+	// received, 0 if none were received.
+	RTT  float64 `json:"rtt,omitempty"`
+	Loss float64 `json:"loss"` // fraction of lost probes, 0 to 1
+}
+
+// Event kinds.
+const (
+	EventWANAddr    = "wan_addr"
+	EventUplinkDown = "uplink_down"
+	EventUplinkUp   = "uplink_up"
+)
+
+// Event is a change of the uplink state.
+type Event struct {
+	Time   time.Time `json:"t"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"` // e.g. the new WAN address
+}
+
+type day struct {
+	Samples []Sample `json:"samples"`
+	Events  []Event  `json:"events"`
+
+	dirty bool
+}
+
+const dayLayout = "2006-01-02"
+
+// Store holds the history of the last retention period, persisted in dir.
+type Store struct {
+	dir       string
+	retention time.Duration
+
+	mu   sync.Mutex
+	days map[string]*day
+}
+
+// Open loads the history files within retention from dir.
+func Open(dir string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:       dir,
+		retention: retention,
+		days:      make(map[string]*day),
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-retention).Format(dayLayout)
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), ".json.gz")
+		if name == fi.Name() || name < cutoff {
+			continue
+		}
+		if _, err := time.Parse(dayLayout, name); err != nil {
+			continue
+		}
+		d, err := readDay(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fi.Name(), err)
+		}
+		s.days[name] = d
+	}
+	return s, nil
+}
+
+func readDay(fn string) (*day, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var d day
+	if err := json.NewDecoder(gr).Decode(&d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *Store) dayLocked(t time.Time) *day {
+	key := t.UTC().Format(dayLayout)
+	d, ok := s.days[key]
+	if !ok {
+		d = &day{}
+		s.days[key] = d
+	}
+	d.dirty = true
+	return d
+}
+
+// Add records sample.
+func (s *Store) Add(sample Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.dayLocked(sample.Time)
+	d.Samples = append(d.Samples, sample)
+}
+
+// AddEvent records ev.
+func (s *Store) AddEvent(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.dayLocked(ev.Time)
+	d.Events = append(d.Events, ev)
+}
+
+// Last returns the most recent sample and the most recent event of kind (zero
+// values if there are none).
+func (s *Store) Last(kind string) (Sample, Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		sample Sample
+		ev     Event
+	)
+	for _, d := range s.days {
+		if n := len(d.Samples); n > 0 && d.Samples[n-1].Time.After(sample.Time) {
+			sample = d.Samples[n-1]
+		}
+		for _, e := range d.Events {
+			if e.Kind == kind && e.Time.After(ev.Time) {
+				ev = e
+			}
+		}
+	}
+	return sample, ev
+}
+
+// Range returns the samples and events between from and to, in chronological
+// order.
+func (s *Store) Range(from, to time.Time) ([]Sample, []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		samples []Sample
+		events  []Event
+	)
+	in := func(t time.Time) bool { return !t.Before(from) && !t.After(to) }
+	for _, d := range s.days {
+		for _, sample := range d.Samples {
+			if in(sample.Time) {
+				samples = append(samples, sample)
+			}
+		}
+		for _, ev := range d.Events {
+			if in(ev.Time) {
+				events = append(events, ev)
+			}
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return samples, events
+}
+
+// Flush writes modified days to disk and removes days older than the
+// retention period.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-s.retention).Format(dayLayout)
+	for key, d := range s.days {
+		fn := filepath.Join(s.dir, key+".json.gz")
+		if key < cutoff {
+			delete(s.days, key)
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if !d.dirty {
+			continue
+		}
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(gw).Encode(d); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		if err := renameio.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		d.dirty = false
+	}
+	return nil
+}
+
+// Aggregate averages samples (in chronological order) into buckets of step,
+// so that long time ranges can be displayed. An aggregated sample is up only
+// if all of its samples are up.
+func Aggregate(samples []Sample, step time.Duration) []Sample {
+	var (
+		result []Sample
+		cur    Sample
+		n      int // samples in cur
+		rttN   int // samples with an RTT in cur
+	)
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		cur.Loss /= float64(n)
+		if rttN > 0 {
+			cur.RTT /= float64(rttN)
+		}
+		result = append(result, cur)
+	}
+	for _, s := range samples {
+		bucket := s.Time.Truncate(step)
+		if n == 0 || !bucket.Equal(cur.Time) {
+			flush()
+			cur = Sample{Time: bucket, Up: true}
+			n, rttN = 0, 0
+		}
+		n++
+		cur.Up = cur.Up && s.Up
+		cur.Loss += s.Loss
+		if s.RTT > 0 {
+			cur.RTT += s.RTT
+			rttN++
+		}
+	}
+	flush()
+	return result
+}
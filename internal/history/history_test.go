@@ -0,0 +1,105 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	old := now.Add(-40 * 24 * time.Hour)
+	s, err := Open(tmp, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Sample{Time: old, Up: true, RTT: 10})
+	s.Add(Sample{Time: now.Add(-1 * time.Minute), Up: true, RTT: 10})
+	s.Add(Sample{Time: now, Up: false, Loss: 1})
+	s.AddEvent(Event{Time: now, Kind: EventWANAddr, Detail: "192.0.2.1"})
+	s.AddEvent(Event{Time: now, Kind: EventUplinkDown})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	oldFn := filepath.Join(tmp, old.Format(dayLayout)+".json.gz")
+	if _, err := os.Stat(oldFn); !os.IsNotExist(err) {
+		t.Errorf("%s not pruned: %v", oldFn, err)
+	}
+
+	// Load the history from disk:
+	s, err = Open(tmp, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, events := s.Range(now.Add(-1*time.Hour), now)
+	wantSamples := []Sample{
+		{Time: now.Add(-1 * time.Minute), Up: true, RTT: 10},
+		{Time: now, Up: false, Loss: 1},
+	}
+	if diff := cmp.Diff(wantSamples, samples); diff != "" {
+		t.Errorf("Range: unexpected samples: diff (-want +got):\n%s", diff)
+	}
+	if got, want := len(events), 2; got != want {
+		t.Fatalf("Range: got %d events, want %d", got, want)
+	}
+
+	last, ev := s.Last(EventWANAddr)
+	if !last.Time.Equal(now) {
+		t.Errorf("Last: sample time = %v, want %v", last.Time, now)
+	}
+	if got, want := ev.Detail, "192.0.2.1"; got != want {
+		t.Errorf("Last: WAN address = %q, want %q", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := s.WritePage(rec, httptest.NewRequest("GET", "/history", nil), "1d", now); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rec.Body.String(), "192.0.2.1") {
+		t.Errorf("WritePage: WAN address change not displayed")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	base := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	samples := []Sample{
+		{Time: base, Up: true, RTT: 10},
+		{Time: base.Add(1 * time.Minute), Up: true, RTT: 20},
+		{Time: base.Add(2 * time.Minute), Up: false, Loss: 1},
+		{Time: base.Add(10 * time.Minute), Up: true, RTT: 5, Loss: 0.5},
+	}
+	got := Aggregate(samples, 5*time.Minute)
+	want := []Sample{
+		{Time: base, Up: false, RTT: 15, Loss: 1.0 / 3},
+		{Time: base.Add(10 * time.Minute), Up: true, RTT: 5, Loss: 0.5},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Aggregate: unexpected result: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ikev2 generates the configuration of the strongSwan IKEv2 daemon
+// (charon), which negotiates security associations with the VPN clients
+// built into iOS, macOS and Windows and programs them into the kernel (XFRM)
+// via netlink.
+package ikev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Config is the IKEv2 VPN configuration, stored in ikev2.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// ServerName is the DNS name under which clients connect, e.g.
+	// vpn.example.com. The certificate must be valid for this name.
+	ServerName string `json:"server_name"`
+
+	// Certificate and Key are PEM files, default to
+	// /perm/ikev2/cert.pem and /perm/ikev2/key.pem.
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+
+	// Pool is the subnet from which clients obtain their virtual IP
+	// address, e.g. 10.0.9.0/24.
+	Pool string `json:"pool"`
+
+	// DNS are the DNS servers assigned to clients, defaulting to dnsd on
+	// lan0.
+	DNS []string `json:"dns"`
+
+	// Users authenticate using EAP-MSCHAPv2 (user name and password), which
+	// the built-in clients of iOS and Windows support.
+	Users []User `json:"users"`
+
+	// Charon and Swanctl are the paths of the (statically linked)
+	// strongSwan binaries, default to /perm/ikev2/bin/charon and
+	// /perm/ikev2/bin/swanctl.
+	Charon  string `json:"charon"`
+	Swanctl string `json:"swanctl"`
+}
+
+// User is a VPN user.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// ViciSocket is the control socket of charon, via which swanctl loads the
+// configuration.
+const ViciSocket = "unix:///tmp/charon.vici"
+
+// ReadConfig reads ikev2.json from dir and fills in defaults.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "ikev2.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, d := range []struct {
+		field *string
+		def   string
+	}{
+		{&cfg.Certificate, filepath.Join(dir, "ikev2", "cert.pem")},
+		{&cfg.Key, filepath.Join(dir, "ikev2", "key.pem")},
+		{&cfg.Charon, filepath.Join(dir, "ikev2", "bin", "charon")},
+		{&cfg.Swanctl, filepath.Join(dir, "ikev2", "bin", "swanctl")},
+	} {
+		if *d.field == "" {
+			*d.field = d.def
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+// quotable returns whether s can be used within a quoted strongSwan
+// configuration value.
+func quotable(s string) bool {
+	return !strings.ContainsAny(s, "\"\\\n\r")
+}
+
+func (c *Config) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.ServerName == "" || !quotable(c.ServerName) {
+		return fmt.Errorf("invalid server_name %q", c.ServerName)
+	}
+	for _, fn := range []string{c.Certificate, c.Key} {
+		if !quotable(fn) {
+			return fmt.Errorf("invalid file name %q", fn)
+		}
+	}
+	_, pool, err := net.ParseCIDR(c.Pool)
+	if err != nil {
+		return fmt.Errorf("pool: %v", err)
+	}
+	if pool.IP.To4() == nil {
+		return fmt.Errorf("pool %v is not an IPv4 subnet", pool)
+	}
+	for _, d := range c.DNS {
+		if net.ParseIP(d) == nil {
+			return fmt.Errorf("dns: invalid IP address %q", d)
+		}
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("no users configured")
+	}
+	names := make(map[string]bool)
+	for _, u := range c.Users {
+		if u.Name == "" || !quotable(u.Name) {
+			return fmt.Errorf("invalid user name %q", u.Name)
+		}
+		if names[u.Name] {
+			return fmt.Errorf("duplicate user %q", u.Name)
+		}
+		names[u.Name] = true
+		if u.Password == "" || !quotable(u.Password) {
+			return fmt.Errorf("user %s: invalid password", u.Name)
+		}
+	}
+	return nil
+}
+
+var swanctlTmpl = template.Must(template.New("").Parse(`# Generated by router7 ikev2d from ikev2.json, do not edit.
+connections {
+  rtr7 {
+    version = 2
+    pools = rtr7
+    send_certreq = no
+    # Windows and iOS fragment large (certificate-carrying) messages.
+    fragmentation = yes
+    # The first proposals match the defaults of iOS and Windows.
+    proposals = aes256-sha256-modp2048,aes256-sha1-modp1024,aes128-sha1-modp1024,default
+    local {
+      auth = pubkey
+      certs = "{{ .Certificate }}"
+      id = "{{ .ServerName }}"
+    }
+    remote {
+      auth = eap-mschapv2
+      eap_id = %any
+    }
+    children {
+      rtr7 {
+        local_ts = 0.0.0.0/0
+        esp_proposals = aes256-sha256,aes256-sha1,aes128-sha1,default
+        dpd_action = clear
+      }
+    }
+  }
+}
+
+pools {
+  rtr7 {
+    addrs = {{ .Pool }}
+{{- if .DNSServers }}
+    dns = {{ .DNSServers }}
+{{- end }}
+  }
+}
+
+secrets {
+  private-rtr7 {
+    file = "{{ .Key }}"
+  }
+{{- range $idx, $u := .Users }}
+  eap-{{ $idx }} {
+    id = "{{ $u.Name }}"
+    secret = "{{ $u.Password }}"
+  }
+{{- end }}
+}
+`))
+
+// SwanctlConf returns the swanctl.conf(5) content for c. dns is used if c.DNS is
+// empty, e.g. the lan0 address.
+func (c *Config) SwanctlConf(dns net.IP) ([]byte, error) {
+	servers := c.DNS
+	if len(servers) == 0 && dns != nil {
+		servers = []string{dns.String()}
+	}
+	var buf bytes.Buffer
+	if err := swanctlTmpl.Execute(&buf, struct {
+		*Config
+		DNSServers string
+	}{
+		Config:     c,
+		DNSServers: strings.Join(servers, ","),
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// StrongswanConf returns the strongswan.conf(5) content for charon, which
+// charon locates via the STRONGSWAN_CONF environment variable.
+func StrongswanConf() []byte {
+	return []byte(`# Generated by router7 ikev2d, do not edit.
+charon {
+  plugins {
+    vici {
+      socket = ` + ViciSocket + `
+    }
+  }
+}
+`)
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ikev2_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rtr7/router7/internal/ikev2"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "ikev2.json")
+	for _, invalid := range []string{
+		`{"enabled": true, "pool": "10.0.9.0/24", "users": [{"name": "alice", "password": "secret"}]}`,
+		`{"enabled": true, "server_name": "vpn.example.com", "pool": "fd00::/64", "users": [{"name": "alice", "password": "secret"}]}`,
+		`{"enabled": true, "server_name": "vpn.example.com", "pool": "10.0.9.0/24"}`,
+		`{"enabled": true, "server_name": "vpn.example.com", "pool": "10.0.9.0/24", "users": [{"name": "alice", "password": "se\"cret"}]}`,
+		`{"enabled": true, "server_name": "vpn.example.com", "pool": "10.0.9.0/24", "dns": ["dnsd"], "users": [{"name": "alice", "password": "secret"}]}`,
+	} {
+		if err := ioutil.WriteFile(fn, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ikev2.ReadConfig(dir); err == nil {
+			t.Errorf("ReadConfig(%s) unexpectedly succeeded", invalid)
+		}
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "enabled": true,
+  "server_name": "vpn.example.com",
+  "pool": "10.0.9.0/24",
+  "users": [{"name": "alice", "password": "secret"}]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ikev2.ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Certificate, filepath.Join(dir, "ikev2", "cert.pem"); got != want {
+		t.Errorf("unexpected default certificate: got %q, want %q", got, want)
+	}
+	b, err := cfg.SwanctlConf(net.ParseIP("192.168.42.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`id = "vpn.example.com"`,
+		`addrs = 10.0.9.0/24`,
+		`dns = 192.168.42.1`,
+		`auth = eap-mschapv2`,
+		`id = "alice"`,
+		`secret = "secret"`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("swanctl.conf does not contain %q:\n%s", want, b)
+		}
+	}
+}
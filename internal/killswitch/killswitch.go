@@ -0,0 +1,137 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package killswitch manages the list of LAN clients whose internet access is
+// cut, e.g. for dinner time or to quarantine a suspicious device.
+package killswitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Client identifies a client by MAC address or IP address.
+type Client struct {
+	HardwareAddr string    `json:"hardware_addr,omitempty"` // e.g. “00:1f:16:12:34:56”
+	Addr         string    `json:"addr,omitempty"`          // e.g. “192.168.42.23”
+	Until        time.Time `json:"until,omitempty"`         // zero means indefinitely
+}
+
+// Key returns the MAC or IP address identifying c.
+func (c *Client) Key() string {
+	if c.HardwareAddr != "" {
+		return c.HardwareAddr
+	}
+	return c.Addr
+}
+
+// Expired returns whether the access of c was restored by now.
+func (c *Client) Expired(now time.Time) bool {
+	return !c.Until.IsZero() && now.After(c.Until)
+}
+
+// Parse returns a Client for addr, which is either a MAC address or an IP
+// address, blocked until until.
+func Parse(addr string, until time.Time) (*Client, error) {
+	if hwaddr, err := net.ParseMAC(addr); err == nil {
+		return &Client{HardwareAddr: hwaddr.String(), Until: until}, nil
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		return &Client{Addr: ip.String(), Until: until}, nil
+	}
+	return nil, fmt.Errorf("%q is neither a MAC address nor an IP address", addr)
+}
+
+// State is the kill switch state, stored in killswitch.json.
+type State struct {
+	Clients []*Client `json:"clients"`
+}
+
+// Active returns the clients whose access is cut at now.
+func (s *State) Active(now time.Time) []*Client {
+	var active []*Client
+	for _, c := range s.Clients {
+		if !c.Expired(now) {
+			active = append(active, c)
+		}
+	}
+	return active
+}
+
+// Set cuts the access of c, replacing any previous entry for the same client.
+func (s *State) Set(c *Client) {
+	s.Remove(c.Key())
+	s.Clients = append(s.Clients, c)
+}
+
+// Remove restores the access of the client identified by key (see
+// Client.Key).
+func (s *State) Remove(key string) {
+	clients := s.Clients[:0]
+	for _, c := range s.Clients {
+		if c.Key() != key {
+			clients = append(clients, c)
+		}
+	}
+	s.Clients = clients
+}
+
+// NextExpiry returns the time at which the next client’s access will be
+// restored, or false if no client’s access will be restored automatically.
+func (s *State) NextExpiry(now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, c := range s.Active(now) {
+		if c.Until.IsZero() {
+			continue
+		}
+		if next.IsZero() || c.Until.Before(next) {
+			next = c.Until
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Read reads killswitch.json from dir. A missing file results in an empty
+// State.
+func Read(dir string) (*State, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "killswitch.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{}, nil
+		}
+		return nil, err
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Write atomically replaces killswitch.json in dir with s, dropping expired
+// clients.
+func Write(dir string, s *State) error {
+	b, err := json.MarshalIndent(&State{Clients: s.Active(time.Now())}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(dir, "killswitch.json"), b, 0644)
+}
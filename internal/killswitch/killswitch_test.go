@@ -0,0 +1,101 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package killswitch_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/killswitch"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		addr    string
+		wantKey string
+		wantErr bool
+	}{
+		{addr: "00:1F:16:12:34:56", wantKey: "00:1f:16:12:34:56"},
+		{addr: "192.168.42.23", wantKey: "192.168.42.23"},
+		{addr: "fdf5:3606:2a21::23", wantKey: "fdf5:3606:2a21::23"},
+		{addr: "laptop", wantErr: true},
+	} {
+		c, err := killswitch.Parse(tt.addr, time.Time{})
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("Parse(%q): got err %v, want error: %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.Key() != tt.wantKey {
+			t.Errorf("Parse(%q).Key() = %q, want %q", tt.addr, c.Key(), tt.wantKey)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "killswitch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Now()
+	s, err := killswitch.Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.NextExpiry(now); ok {
+		t.Fatalf("NextExpiry unexpectedly returned an expiry for empty state")
+	}
+
+	laptop, _ := killswitch.Parse("00:1f:16:12:34:56", now.Add(1*time.Hour))
+	phone, _ := killswitch.Parse("192.168.42.23", time.Time{})
+	expired, _ := killswitch.Parse("192.168.42.42", now.Add(-1*time.Minute))
+	s.Set(laptop)
+	s.Set(phone)
+	s.Set(expired)
+	// Cutting again replaces the previous entry:
+	laptop2, _ := killswitch.Parse("00:1f:16:12:34:56", now.Add(30*time.Minute))
+	s.Set(laptop2)
+
+	if got, want := len(s.Active(now)), 2; got != want {
+		t.Fatalf("unexpected number of active clients: got %d, want %d", got, want)
+	}
+	next, ok := s.NextExpiry(now)
+	if !ok || !next.Equal(laptop2.Until) {
+		t.Fatalf("NextExpiry = %v, %v, want %v, true", next, ok, laptop2.Until)
+	}
+
+	if err := killswitch.Write(tmp, s); err != nil {
+		t.Fatal(err)
+	}
+	s, err = killswitch.Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(s.Clients), 2; got != want {
+		t.Fatalf("Write did not drop expired clients: got %d clients, want %d", got, want)
+	}
+
+	s.Remove(phone.Key())
+	if _, ok := s.NextExpiry(now); !ok {
+		t.Fatalf("NextExpiry unexpectedly returned no expiry")
+	}
+	s.Remove(laptop.Key())
+	if got := len(s.Active(now)); got != 0 {
+		t.Fatalf("unexpected number of active clients after Remove: got %d, want 0", got)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package linkstate notifies subscribers of network interface state changes
+// (links appearing, vanishing, coming up or going down, addresses and routes
+// being added or removed) via netlink, so that daemons neither need to poll
+// nor to be signaled by netconfigd. All subscribers of a process share one
+// netlink subscription per kind of change.
+package linkstate
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Kind is the kind of change an Event describes. Kinds can be combined in a
+// Filter.
+type Kind int
+
+const (
+	Link  Kind = 1 << iota // a link appeared, vanished, came up or went down
+	Addr                   // an address was added or removed
+	Route                  // a route was added or removed
+)
+
+// Event is a change of network interface state.
+type Event struct {
+	Kind  Kind
+	Index int    // interface index
+	Name  string // interface name, empty if unknown (e.g. already vanished)
+
+	// Up is whether the link is up, i.e. its operational state is up, or
+	// unknown while the interface is administratively up (e.g. WireGuard
+	// interfaces, which do not report an operational state). Only set for
+	// Link events.
+	Up bool
+
+	// Added is set for links which appeared and addresses or routes which
+	// were added, Removed for links which vanished and addresses or routes
+	// which were removed. Link events with neither report a change of Up.
+	Added   bool
+	Removed bool
+
+	Addr *net.IPNet // Addr events only
+	Dst  *net.IPNet // Route events only, nil for default routes
+}
+
+// Filter selects events.
+type Filter struct {
+	Kinds     Kind   // combination of kinds, all kinds if zero
+	Interface string // interface name, all interfaces if empty
+}
+
+func (f Filter) match(ev Event) bool {
+	if f.Kinds != 0 && f.Kinds&ev.Kind == 0 {
+		return false
+	}
+	return f.Interface == "" || f.Interface == ev.Name
+}
+
+// subscriber queues events, so that slow subscribers neither block the
+// watcher nor miss events.
+type subscriber struct {
+	filter Filter
+	fn     func(Event)
+
+	mu    sync.Mutex
+	queue []Event
+	wake  chan struct{}
+}
+
+func (s *subscriber) push(ev Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, ev)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already woken up
+	}
+}
+
+func (s *subscriber) run() {
+	for range s.wake {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, ev := range queue {
+			s.fn(ev)
+		}
+	}
+}
+
+type link struct {
+	name string
+	up   bool
+}
+
+// watcher translates netlink updates into events and dispatches them to its
+// subscribers.
+type watcher struct {
+	mu      sync.Mutex
+	started bool
+	links   map[int]link // by interface index
+	subs    []*subscriber
+}
+
+func newWatcher() *watcher {
+	return &watcher{links: make(map[int]link)}
+}
+
+// isUp returns whether the link described by attrs is up, see Event.Up.
+func isUp(attrs *netlink.LinkAttrs) bool {
+	return attrs.OperState == netlink.OperUp ||
+		(attrs.OperState == netlink.OperUnknown && attrs.Flags&net.FlagUp != 0)
+}
+
+// linkEvent converts u, returning false if u does not change whether the link
+// exists or is up (e.g. statistics or name changes). w.mu must be held.
+func (w *watcher) linkEvent(u netlink.LinkUpdate) (Event, bool) {
+	attrs := u.Attrs()
+	prev, known := w.links[attrs.Index]
+	ev := Event{
+		Kind:  Link,
+		Index: attrs.Index,
+		Name:  attrs.Name,
+		Up:    isUp(attrs),
+	}
+	if u.Header.Type == unix.RTM_DELLINK {
+		delete(w.links, attrs.Index)
+		ev.Up = false
+		ev.Removed = true
+		return ev, known
+	}
+	w.links[attrs.Index] = link{name: attrs.Name, up: ev.Up}
+	if !known {
+		ev.Added = true
+		return ev, true
+	}
+	return ev, prev.up != ev.Up
+}
+
+// addrEvent converts u. w.mu must be held.
+func (w *watcher) addrEvent(u netlink.AddrUpdate) Event {
+	addr := u.LinkAddress
+	return Event{
+		Kind:    Addr,
+		Index:   u.LinkIndex,
+		Name:    w.links[u.LinkIndex].name,
+		Added:   u.NewAddr,
+		Removed: !u.NewAddr,
+		Addr:    &addr,
+	}
+}
+
+// routeEvent converts u. w.mu must be held.
+func (w *watcher) routeEvent(u netlink.RouteUpdate) Event {
+	return Event{
+		Kind:    Route,
+		Index:   u.LinkIndex,
+		Name:    w.links[u.LinkIndex].name,
+		Added:   u.Type == unix.RTM_NEWROUTE,
+		Removed: u.Type == unix.RTM_DELROUTE,
+		Dst:     u.Dst,
+	}
+}
+
+// dispatch passes ev to all subscribers whose filter matches. w.mu must be
+// held.
+func (w *watcher) dispatch(ev Event) {
+	for _, s := range w.subs {
+		if s.filter.match(ev) {
+			s.push(ev)
+		}
+	}
+}
+
+// start subscribes to netlink updates. w.mu must be held.
+func (w *watcher) start() error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		attrs := l.Attrs()
+		w.links[attrs.Index] = link{name: attrs.Name, up: isUp(attrs)}
+	}
+	linkCh := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(linkCh, nil); err != nil {
+		return err
+	}
+	addrCh := make(chan netlink.AddrUpdate)
+	if err := netlink.AddrSubscribe(addrCh, nil); err != nil {
+		return err
+	}
+	routeCh := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(routeCh, nil); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case u, ok := <-linkCh:
+				if !ok {
+					return
+				}
+				w.mu.Lock()
+				if ev, changed := w.linkEvent(u); changed {
+					w.dispatch(ev)
+				}
+				w.mu.Unlock()
+			case u, ok := <-addrCh:
+				if !ok {
+					return
+				}
+				w.mu.Lock()
+				w.dispatch(w.addrEvent(u))
+				w.mu.Unlock()
+			case u, ok := <-routeCh:
+				if !ok {
+					return
+				}
+				w.mu.Lock()
+				w.dispatch(w.routeEvent(u))
+				w.mu.Unlock()
+			}
+		}
+	}()
+	w.started = true
+	return nil
+}
+
+func (w *watcher) subscribe(f Filter, fn func(Event)) *subscriber {
+	s := &subscriber{
+		filter: f,
+		fn:     fn,
+		wake:   make(chan struct{}, 1),
+	}
+	w.subs = append(w.subs, s)
+	go s.run()
+	return s
+}
+
+var defaultWatcher = newWatcher()
+
+// Subscribe calls fn (from a separate goroutine, in order) for each event
+// matching f.
+func Subscribe(f Filter, fn func(Event)) error {
+	w := defaultWatcher
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	w.subscribe(f, fn)
+	return nil
+}
+
+// settle calls fn once no event was received on ch for delay, coalescing
+// bursts of events (e.g. all addresses of an interface being added at once)
+// into one call.
+func settle(ch <-chan Event, delay time.Duration, fn func()) {
+	for range ch {
+		timer := time.NewTimer(delay)
+	wait:
+		for {
+			select {
+			case _, ok := <-ch:
+				if !ok {
+					break wait
+				}
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(delay)
+			case <-timer.C:
+				break wait
+			}
+		}
+		fn()
+	}
+}
+
+// NotifySettled calls fn (from a separate goroutine) once events matching f
+// stopped arriving for delay.
+func NotifySettled(f Filter, delay time.Duration, fn func()) error {
+	ch := make(chan Event)
+	if err := Subscribe(f, func(ev Event) { ch <- ev }); err != nil {
+		return err
+	}
+	go settle(ch, delay, fn)
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linkstate
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFilter(t *testing.T) {
+	ev := Event{Kind: Addr, Name: "lan0"}
+	for _, tt := range []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{Kinds: Addr}, true},
+		{Filter{Kinds: Link | Addr}, true},
+		{Filter{Kinds: Link}, false},
+		{Filter{Interface: "lan0"}, true},
+		{Filter{Interface: "uplink0"}, false},
+		{Filter{Kinds: Addr, Interface: "uplink0"}, false},
+	} {
+		if got := tt.filter.match(ev); got != tt.want {
+			t.Errorf("%+v.match(%+v) = %v, want %v", tt.filter, ev, got, tt.want)
+		}
+	}
+}
+
+func linkUpdate(typ uint16, index int, name string, state netlink.LinkOperState) netlink.LinkUpdate {
+	var u netlink.LinkUpdate
+	u.Header.Type = typ
+	u.Link = &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+		Index:     index,
+		Name:      name,
+		OperState: state,
+	}}
+	return u
+}
+
+func TestLinkEvents(t *testing.T) {
+	w := newWatcher()
+	w.links[2] = link{name: "uplink0", up: true}
+	for _, tt := range []struct {
+		desc    string
+		update  netlink.LinkUpdate
+		want    Event
+		changed bool
+	}{
+		{
+			desc:    "statistics update",
+			update:  linkUpdate(unix.RTM_NEWLINK, 2, "uplink0", netlink.OperUp),
+			changed: false,
+		},
+		{
+			desc:    "cable unplugged",
+			update:  linkUpdate(unix.RTM_NEWLINK, 2, "uplink0", netlink.OperDown),
+			want:    Event{Kind: Link, Index: 2, Name: "uplink0"},
+			changed: true,
+		},
+		{
+			desc:    "cable plugged in",
+			update:  linkUpdate(unix.RTM_NEWLINK, 2, "uplink0", netlink.OperUp),
+			want:    Event{Kind: Link, Index: 2, Name: "uplink0", Up: true},
+			changed: true,
+		},
+		{
+			desc:    "USB network card plugged in",
+			update:  linkUpdate(unix.RTM_NEWLINK, 5, "eth1", netlink.OperDown),
+			want:    Event{Kind: Link, Index: 5, Name: "eth1", Added: true},
+			changed: true,
+		},
+		{
+			desc:    "USB network card unplugged",
+			update:  linkUpdate(unix.RTM_DELLINK, 5, "eth1", netlink.OperDown),
+			want:    Event{Kind: Link, Index: 5, Name: "eth1", Removed: true},
+			changed: true,
+		},
+		{
+			desc:    "unknown link vanished",
+			update:  linkUpdate(unix.RTM_DELLINK, 6, "eth2", netlink.OperDown),
+			changed: false,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, changed := w.linkEvent(tt.update)
+			if changed != tt.changed {
+				t.Fatalf("linkEvent: changed = %v, want %v", changed, tt.changed)
+			}
+			if changed && got != tt.want {
+				t.Fatalf("linkEvent: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUp(t *testing.T) {
+	for _, tt := range []struct {
+		attrs netlink.LinkAttrs
+		want  bool
+	}{
+		{netlink.LinkAttrs{OperState: netlink.OperUp}, true},
+		{netlink.LinkAttrs{OperState: netlink.OperDown, Flags: net.FlagUp}, false},
+		{netlink.LinkAttrs{OperState: netlink.OperUnknown, Flags: net.FlagUp}, true},
+		{netlink.LinkAttrs{OperState: netlink.OperUnknown}, false},
+	} {
+		if got := isUp(&tt.attrs); got != tt.want {
+			t.Errorf("isUp(%v, %v) = %v, want %v", tt.attrs.OperState, tt.attrs.Flags, got, tt.want)
+		}
+	}
+}
+
+func TestAddrRouteEvents(t *testing.T) {
+	w := newWatcher()
+	w.links[3] = link{name: "lan0", up: true}
+	_, ipnet, _ := net.ParseCIDR("2a02:168:4a00::1/64")
+
+	ev := w.addrEvent(netlink.AddrUpdate{LinkAddress: *ipnet, LinkIndex: 3, NewAddr: true})
+	if ev.Kind != Addr || ev.Name != "lan0" || !ev.Added || ev.Removed || ev.Addr.String() != ipnet.String() {
+		t.Errorf("addrEvent: unexpected event %+v", ev)
+	}
+	ev = w.addrEvent(netlink.AddrUpdate{LinkAddress: *ipnet, LinkIndex: 3})
+	if !ev.Removed || ev.Added {
+		t.Errorf("addrEvent: unexpected event %+v", ev)
+	}
+
+	var u netlink.RouteUpdate
+	u.Type = unix.RTM_DELROUTE
+	u.LinkIndex = 3
+	u.Dst = ipnet
+	ev = w.routeEvent(u)
+	if ev.Kind != Route || ev.Name != "lan0" || !ev.Removed || ev.Added || ev.Dst != ipnet {
+		t.Errorf("routeEvent: unexpected event %+v", ev)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	w := newWatcher()
+	got := make(chan Event, 10)
+	w.subscribe(Filter{Kinds: Addr, Interface: "lan0"}, func(ev Event) { got <- ev })
+	w.dispatch(Event{Kind: Link, Name: "lan0", Up: true})
+	w.dispatch(Event{Kind: Addr, Name: "uplink0", Added: true})
+	w.dispatch(Event{Kind: Addr, Name: "lan0", Added: true})
+	w.dispatch(Event{Kind: Addr, Name: "lan0", Removed: true})
+	for _, want := range []Event{
+		{Kind: Addr, Name: "lan0", Added: true},
+		{Kind: Addr, Name: "lan0", Removed: true},
+	} {
+		select {
+		case ev := <-got:
+			if ev != want {
+				t.Fatalf("got event %+v, want %+v", ev, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %+v", want)
+		}
+	}
+	select {
+	case ev := <-got:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSettle(t *testing.T) {
+	ch := make(chan Event)
+	calls := make(chan struct{}, 10)
+	go settle(ch, 50*time.Millisecond, func() { calls <- struct{}{} })
+	// A burst of events results in one call.
+	for i := 0; i < 5; i++ {
+		ch <- Event{Kind: Addr}
+	}
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for call")
+	}
+	select {
+	case <-calls:
+		t.Fatal("unexpected second call")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(ch)
+}
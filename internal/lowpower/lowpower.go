@@ -0,0 +1,182 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lowpower implements the low-power mode of router7 for running on
+// battery (e.g. on a UPS): maintd enters it when a power loss is reported via
+// its API or read from a GPIO, records it in lowpower/state.json and notifies
+// the daemons, which then reduce their activity (fewer router advertisements
+// and metrics pushes, no packet captures) until power returns.
+package lowpower
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Power sources, see State.Source.
+const (
+	SourceAPI  = "api"
+	SourceGPIO = "gpio"
+)
+
+// Adapting is the daemons (gokrazy paths) which adapt to the low-power mode
+// when notified (SIGUSR1).
+var Adapting = []string{"/user/radvd", "/user/captured"}
+
+// Config is the low-power mode configuration, read from lowpower.json.
+type Config struct {
+	// GPIO is the value file of a sysfs GPIO which reads 1 while running on
+	// battery, e.g. /sys/class/gpio/gpio17/value. If empty, the power
+	// source is only set via maintd’s /power API.
+	GPIO string `json:"gpio"`
+
+	// ActiveLow inverts GPIO: it reads 0 while running on battery.
+	ActiveLow bool `json:"active_low"`
+
+	// PollInterval is how often GPIO is read, defaults to 5s.
+	PollInterval string `json:"poll_interval"`
+
+	// Stop are the non-essential daemons (e.g. /user/snid) which are
+	// stopped on battery and started again once power returns.
+	Stop []string `json:"stop"`
+
+	// MetricsInterval is the interval at which metricspushd pushes metrics
+	// on battery, defaults to 5m.
+	MetricsInterval string `json:"metrics_interval"`
+
+	pollInterval    time.Duration
+	metricsInterval time.Duration
+}
+
+// PollIntervalDuration returns the parsed PollInterval.
+func (c *Config) PollIntervalDuration() time.Duration { return c.pollInterval }
+
+// MetricsIntervalDuration returns the parsed MetricsInterval.
+func (c *Config) MetricsIntervalDuration() time.Duration { return c.metricsInterval }
+
+func duration(field, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", field, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s: %v must be positive", field, d)
+	}
+	return d, nil
+}
+
+// ReadConfig reads lowpower.json from dir. A missing file results in a Config
+// without GPIO and without daemons to stop.
+func ReadConfig(dir string) (*Config, error) {
+	cfg := &Config{}
+	fn := filepath.Join(dir, "lowpower.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	if cfg.pollInterval, err = duration("poll_interval", cfg.PollInterval, 5*time.Second); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if cfg.metricsInterval, err = duration("metrics_interval", cfg.MetricsInterval, 5*time.Minute); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, path := range cfg.Stop {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%s: stop: %q is not a path (e.g. /user/snid)", fn, path)
+		}
+		if path == "/user/maintd" {
+			return nil, fmt.Errorf("%s: stop: maintd cannot stop itself", fn)
+		}
+	}
+	return cfg, nil
+}
+
+// ReadGPIO returns whether the GPIO of cfg indicates running on battery.
+func (c *Config) ReadGPIO() (onBattery bool, _ error) {
+	b, err := ioutil.ReadFile(c.GPIO)
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(b)) {
+	case "0":
+		return c.ActiveLow, nil
+	case "1":
+		return !c.ActiveLow, nil
+	default:
+		return false, fmt.Errorf("%s: unexpected value %q", c.GPIO, strings.TrimSpace(string(b)))
+	}
+}
+
+// State is the current power state, stored in lowpower/state.json.
+type State struct {
+	OnBattery bool      `json:"on_battery"`
+	Since     time.Time `json:"since"`  // when the power source last changed
+	Source    string    `json:"source"` // how the change was reported
+}
+
+func statePath(dir string) string {
+	return filepath.Join(dir, "lowpower", "state.json")
+}
+
+// ReadState reads the power state from dir. A missing file means running on
+// mains power.
+func ReadState(dir string) (State, error) {
+	var st State
+	b, err := ioutil.ReadFile(statePath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, fmt.Errorf("%s: %v", statePath(dir), err)
+	}
+	return st, nil
+}
+
+// WriteState atomically replaces the power state in dir.
+func WriteState(dir string, st State) error {
+	b, err := json.MarshalIndent(&st, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath(dir)), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(statePath(dir), b, 0644)
+}
+
+// Active returns whether the low-power mode is active, i.e. whether the
+// router runs on battery. Unreadable state is treated as mains power, so that
+// daemons keep their regular behavior.
+func Active(dir string) bool {
+	st, err := ReadState(dir)
+	return err == nil && st.OnBattery
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lowpower
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lowpower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.PollIntervalDuration(), 5*time.Second; got != want {
+		t.Errorf("default poll interval: got %v, want %v", got, want)
+	}
+	if got, want := cfg.MetricsIntervalDuration(), 5*time.Minute; got != want {
+		t.Errorf("default metrics interval: got %v, want %v", got, want)
+	}
+
+	for _, invalid := range []string{
+		`{"poll_interval": "-1s"}`,
+		`{"metrics_interval": "soon"}`,
+		`{"stop": ["snid"]}`,
+		`{"stop": ["/user/maintd"]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "lowpower.json"), []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(dir); err == nil {
+			t.Errorf("ReadConfig(%s) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func TestReadGPIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lowpower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "value")
+
+	for _, tt := range []struct {
+		value     string
+		activeLow bool
+		want      bool
+	}{
+		{"1\n", false, true},
+		{"0\n", false, false},
+		{"0\n", true, true},
+		{"1\n", true, false},
+	} {
+		if err := ioutil.WriteFile(fn, []byte(tt.value), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &Config{GPIO: fn, ActiveLow: tt.activeLow}
+		got, err := cfg.ReadGPIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("ReadGPIO(%q, active_low=%v) = %v, want %v", tt.value, tt.activeLow, got, tt.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(fn, []byte("high\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Config{GPIO: fn}).ReadGPIO(); err == nil {
+		t.Errorf("ReadGPIO(high) unexpectedly succeeded")
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lowpower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if Active(dir) {
+		t.Errorf("Active without state file: got true, want false")
+	}
+	since := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	if err := WriteState(dir, State{OnBattery: true, Since: since, Source: SourceGPIO}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := ReadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.OnBattery || !st.Since.Equal(since) || st.Source != SourceGPIO {
+		t.Errorf("ReadState = %+v, want on battery since %v via gpio", st, since)
+	}
+	if !Active(dir) {
+		t.Errorf("Active on battery: got false, want true")
+	}
+
+	if err := ioutil.WriteFile(statePath(dir), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if Active(dir) {
+		t.Errorf("Active with corrupt state file: got true, want false")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lte manages USB LTE modems (QMI or MBIM) as backup uplink.
+package lte
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Protocols in which router7 talks to LTE modems.
+const (
+	ProtocolQMI  = "qmi"
+	ProtocolMBIM = "mbim"
+)
+
+// Config is the LTE uplink configuration, stored in lte.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// Protocol is “qmi” (the default) or “mbim”.
+	Protocol string `json:"protocol"`
+
+	// Device is the control device of the modem, defaults to
+	// /dev/cdc-wdm0.
+	Device string `json:"device"`
+
+	// Interface is the network interface of the modem, defaults to wwan0.
+	Interface string `json:"interface"`
+
+	APN      string `json:"apn"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	PIN      string `json:"pin"` // SIM PIN, if the SIM card is locked
+
+	// Probe is the TCP address which is dialed via uplink0 to check whether
+	// the primary uplink works, defaults to 8.8.8.8:53.
+	Probe string `json:"probe"`
+
+	// FailoverAfter is how long the probe must fail before traffic is routed
+	// via LTE, defaults to 30s.
+	FailoverAfter string `json:"failover_after"`
+
+	// FailbackAfter is how long the probe must succeed before traffic is
+	// routed via uplink0 again, defaults to 2m.
+	FailbackAfter string `json:"failback_after"`
+
+	// Qmicli and Mbimcli are the paths of the libqmi/libmbim command line
+	// tools, default to /perm/lte/bin/qmicli and /perm/lte/bin/mbimcli.
+	Qmicli  string `json:"qmicli"`
+	Mbimcli string `json:"mbimcli"`
+}
+
+// FailoverAfterDuration returns the parsed FailoverAfter.
+func (c *Config) FailoverAfterDuration() (time.Duration, error) {
+	if c.FailoverAfter == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(c.FailoverAfter)
+}
+
+// FailbackAfterDuration returns the parsed FailbackAfter.
+func (c *Config) FailbackAfterDuration() (time.Duration, error) {
+	if c.FailbackAfter == "" {
+		return 2 * time.Minute, nil
+	}
+	return time.ParseDuration(c.FailbackAfter)
+}
+
+// ReadConfig reads lte.json from dir and fills in defaults.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "lte.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, d := range []struct {
+		field *string
+		def   string
+	}{
+		{&cfg.Protocol, ProtocolQMI},
+		{&cfg.Device, "/dev/cdc-wdm0"},
+		{&cfg.Interface, "wwan0"},
+		{&cfg.Probe, "8.8.8.8:53"},
+		{&cfg.Qmicli, filepath.Join(dir, "lte", "bin", "qmicli")},
+		{&cfg.Mbimcli, filepath.Join(dir, "lte", "bin", "mbimcli")},
+	} {
+		if *d.field == "" {
+			*d.field = d.def
+		}
+	}
+	if cfg.Protocol != ProtocolQMI && cfg.Protocol != ProtocolMBIM {
+		return nil, fmt.Errorf("%s: unknown protocol %q, expected %q or %q", fn, cfg.Protocol, ProtocolQMI, ProtocolMBIM)
+	}
+	if cfg.Enabled && cfg.APN == "" {
+		return nil, fmt.Errorf("%s: apn not set", fn)
+	}
+	if _, _, err := net.SplitHostPort(cfg.Probe); err != nil {
+		return nil, fmt.Errorf("%s: probe: %v", fn, err)
+	}
+	for _, d := range []func() (time.Duration, error){cfg.FailoverAfterDuration, cfg.FailbackAfterDuration} {
+		if _, err := d(); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// Lease is the connection which the modem established, stored in
+// lte/wire/lease.json.
+type Lease struct {
+	Interface string   `json:"interface"` // e.g. wwan0
+	Addr      string   `json:"addr"`      // e.g. 10.134.204.190/30
+	Gateway   string   `json:"gateway"`   // e.g. 10.134.204.189
+	DNS       []string `json:"dns"`
+	MTU       int      `json:"mtu"`
+
+	// Active is true while the primary uplink is down and traffic is routed
+	// via LTE. Otherwise, the LTE default route is only used when uplink0 has
+	// no default route at all.
+	Active bool `json:"active"`
+}
+
+// ReadLease reads lte/wire/lease.json from dir. A missing file (no
+// connection) results in a nil Lease.
+func ReadLease(dir string) (*Lease, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "lte", "wire", "lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var l Lease
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// WriteLease atomically replaces lte/wire/lease.json in dir with l, or
+// removes it if l is nil.
+func WriteLease(dir string, l *Lease) error {
+	fn := filepath.Join(dir, "lte", "wire", "lease.json")
+	if l == nil {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(l, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(fn, b, 0644)
+}
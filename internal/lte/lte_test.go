@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lte
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lte")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Enabled {
+		t.Fatalf("LTE unexpectedly enabled without lte.json")
+	}
+
+	fn := filepath.Join(dir, "lte.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"enabled": true, "apn": "internet", "pin": "1234"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-d", "/dev/cdc-wdm0", "-p", "--wds-start-network=apn=internet,ip-type=4", "--client-no-release-cid"}
+	if diff := cmp.Diff(want, cfg.ConnectArgs()); diff != "" {
+		t.Errorf("ConnectArgs: diff (-want +got):\n%s", diff)
+	}
+	if got, want := cfg.Binary(), filepath.Join(dir, "lte", "bin", "qmicli"); got != want {
+		t.Errorf("Binary() = %q, want %q", got, want)
+	}
+
+	for _, invalid := range []string{
+		`{"enabled": true}`,
+		`{"enabled": true, "apn": "internet", "protocol": "at"}`,
+		`{"enabled": true, "apn": "internet", "failover_after": "soon"}`,
+	} {
+		if err := ioutil.WriteFile(fn, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(dir); err == nil {
+			t.Errorf("ReadConfig(%s) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lte")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if l, err := ReadLease(dir); err != nil || l != nil {
+		t.Fatalf("ReadLease() = %v, %v, want nil, nil", l, err)
+	}
+	want := &Lease{
+		Interface: "wwan0",
+		Addr:      "10.134.204.190/30",
+		Gateway:   "10.134.204.189",
+		Active:    true,
+	}
+	if err := WriteLease(dir, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadLease(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadLease: diff (-want +got):\n%s", diff)
+	}
+	if err := WriteLease(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := ReadLease(dir); err != nil || l != nil {
+		t.Fatalf("ReadLease() after removal = %v, %v, want nil, nil", l, err)
+	}
+}
+
+const qmiStartNetwork = `[/dev/cdc-wdm0] Network started
+	Packet data handle: '2264367696'
+[/dev/cdc-wdm0] Client ID not released:
+	Service: 'wds'
+	    CID: '20'
+`
+
+const qmiSettings = `[/dev/cdc-wdm0] Current settings retrieved:
+           IP Family: IPv4
+        IPv4 address: 10.134.204.190
+    IPv4 subnet mask: 255.255.255.252
+IPv4 gateway address: 10.134.204.189
+    IPv4 primary DNS: 212.113.0.3
+  IPv4 secondary DNS: 212.113.0.5
+                 MTU: 1500
+             Domains: none
+`
+
+const qmiSignal = `[/dev/cdc-wdm0] Successfully got signal info
+LTE:
+	RSSI: '-63 dBm'
+	RSRQ: '-8 dB'
+	RSRP: '-91 dBm'
+	SNR: '11.4 dB'
+`
+
+const mbimIPConfiguration = `[/dev/cdc-wdm0] IPv4 configuration available: 'address, gateway, dns, mtu'
+     IP [0]: '10.134.204.190/30'
+    Gateway: '10.134.204.189'
+    DNS [0]: '212.113.0.3'
+    DNS [1]: '212.113.0.5'
+        MTU: '1500'
+
+[/dev/cdc-wdm0] IPv6 configuration available: 'address, gateway, dns, mtu'
+     IP [0]: '2a02:168:4a00::1/64'
+    Gateway: 'fe80::1'
+    DNS [0]: '2a02:168:4a00::53'
+        MTU: '1500'
+`
+
+const mbimSignal = `[/dev/cdc-wdm0] Signal state:
+	          RSSI [0-31,99]: '14'
+	    Error rate [0-7,99]: '0'
+`
+
+func TestParse(t *testing.T) {
+	conn, err := ParseConnection(qmiStartNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Connection{PacketDataHandle: "2264367696", CID: "20"}, conn); diff != "" {
+		t.Errorf("ParseConnection: diff (-want +got):\n%s", diff)
+	}
+
+	want := &Lease{
+		Addr:    "10.134.204.190/30",
+		Gateway: "10.134.204.189",
+		DNS:     []string{"212.113.0.3", "212.113.0.5"},
+		MTU:     1500,
+	}
+	qmi := &Config{Protocol: ProtocolQMI}
+	mbim := &Config{Protocol: ProtocolMBIM}
+	for _, tt := range []struct {
+		cfg *Config
+		out string
+	}{
+		{qmi, qmiSettings},
+		{mbim, mbimIPConfiguration},
+	} {
+		got, err := tt.cfg.ParseSettings(tt.out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("ParseSettings(%s): diff (-want +got):\n%s", tt.cfg.Protocol, diff)
+		}
+	}
+	if _, err := qmi.ParseSettings("[/dev/cdc-wdm0] error: couldn't get current settings"); err == nil {
+		t.Errorf("ParseSettings unexpectedly succeeded without settings")
+	}
+
+	signal, err := qmi.ParseSignal(qmiSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Signal{RSSI: -63, RSRQ: -8, RSRP: -91, SNR: 11.4}, signal); diff != "" {
+		t.Errorf("ParseSignal(qmi): diff (-want +got):\n%s", diff)
+	}
+	signal, err = mbim.ParseSignal(mbimSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Signal{RSSI: -85}, signal); diff != "" {
+		t.Errorf("ParseSignal(mbim): diff (-want +got):\n%s", diff)
+	}
+}
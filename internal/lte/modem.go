@@ -0,0 +1,256 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lte
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The modem is controlled via qmicli (libqmi) or mbimcli (libmbim), which are
+// not part of router7. Both are run in proxy mode (-p) so that consecutive
+// invocations share the device.
+
+// Binary returns the path of the command line tool for the protocol.
+func (c *Config) Binary() string {
+	if c.Protocol == ProtocolMBIM {
+		return c.Mbimcli
+	}
+	return c.Qmicli
+}
+
+func (c *Config) args(args ...string) []string {
+	return append([]string{"-d", c.Device, "-p"}, args...)
+}
+
+// UnlockArgs returns the arguments which unlock the SIM card, or nil if no PIN
+// is configured.
+func (c *Config) UnlockArgs() []string {
+	if c.PIN == "" {
+		return nil
+	}
+	if c.Protocol == ProtocolMBIM {
+		return c.args("--enter-pin=" + c.PIN)
+	}
+	return c.args("--uim-verify-pin=PIN1," + c.PIN)
+}
+
+// ConnectArgs returns the arguments which establish the data connection.
+func (c *Config) ConnectArgs() []string {
+	settings := []string{"apn=" + c.APN}
+	if c.Username != "" {
+		settings = append(settings, "username="+c.Username, "password="+c.Password)
+	}
+	if c.Protocol == ProtocolMBIM {
+		return c.args("--connect=" + strings.Join(settings, ","))
+	}
+	settings = append(settings, "ip-type=4")
+	return c.args("--wds-start-network="+strings.Join(settings, ","), "--client-no-release-cid")
+}
+
+// Connection identifies an established QMI data connection, which is needed
+// to stop it. MBIM connections need no identification.
+type Connection struct {
+	PacketDataHandle string
+	CID              string
+}
+
+// DisconnectArgs returns the arguments which stop the data connection conn.
+func (c *Config) DisconnectArgs(conn Connection) []string {
+	if c.Protocol == ProtocolMBIM {
+		return c.args("--disconnect")
+	}
+	return c.args("--wds-stop-network="+conn.PacketDataHandle, "--client-cid="+conn.CID)
+}
+
+// SettingsArgs returns the arguments which print the IP settings of the data
+// connection, see ParseSettings.
+func (c *Config) SettingsArgs() []string {
+	if c.Protocol == ProtocolMBIM {
+		return c.args("--query-ip-configuration")
+	}
+	return c.args("--wds-get-current-settings")
+}
+
+// SignalArgs returns the arguments which print the signal quality, see
+// ParseSignal.
+func (c *Config) SignalArgs() []string {
+	if c.Protocol == ProtocolMBIM {
+		return c.args("--query-signal-state")
+	}
+	return c.args("--nas-get-signal-info")
+}
+
+// field is a “key: 'value'” line of qmicli/mbimcli output.
+type field struct {
+	key, value string
+}
+
+// fields returns the “key: 'value'” lines of out. Bracketed ranges or
+// indices are removed from keys, e.g. “RSSI [0-31,99]” becomes “RSSI”.
+func fields(out string) []field {
+	var result []field
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		if idx := strings.Index(key, " ["); idx > -1 {
+			key = key[:idx]
+		}
+		result = append(result, field{
+			key:   key,
+			value: strings.Trim(strings.TrimSpace(parts[1]), "'"),
+		})
+	}
+	return result
+}
+
+// ParseConnection returns the connection identification printed by qmicli
+// when starting the network.
+func ParseConnection(out string) (Connection, error) {
+	var conn Connection
+	for _, f := range fields(out) {
+		switch f.key {
+		case "Packet data handle":
+			conn.PacketDataHandle = f.value
+		case "CID":
+			conn.CID = f.value
+		}
+	}
+	if conn.PacketDataHandle == "" || conn.CID == "" {
+		return Connection{}, fmt.Errorf("no packet data handle and client ID found in %q", out)
+	}
+	return conn, nil
+}
+
+// ParseSettings returns the IPv4 settings of the data connection from the
+// output of the SettingsArgs command. The Interface and Active fields of the
+// result are not set.
+func (c *Config) ParseSettings(out string) (*Lease, error) {
+	var (
+		l    Lease
+		ip   net.IP
+		mask net.IPMask
+	)
+	ipv4 := c.Protocol != ProtocolMBIM // qmicli only prints IPv4 settings
+	for _, f := range fields(out) {
+		if strings.Contains(f.key, "IPv4 configuration") {
+			ipv4 = true
+			continue
+		}
+		if strings.Contains(f.key, "IPv6 configuration") {
+			ipv4 = false
+			continue
+		}
+		if !ipv4 {
+			continue
+		}
+		switch f.key {
+		case "IPv4 address": // qmicli
+			ip = net.ParseIP(f.value)
+		case "IPv4 subnet mask": // qmicli
+			mask = net.IPMask(net.ParseIP(f.value).To4())
+		case "IP": // mbimcli, e.g. 10.134.204.190/30
+			if l.Addr == "" {
+				l.Addr = f.value
+			}
+		case "IPv4 gateway address", "Gateway":
+			l.Gateway = f.value
+		case "IPv4 primary DNS", "IPv4 secondary DNS", "DNS":
+			l.DNS = append(l.DNS, f.value)
+		case "MTU":
+			mtu, err := strconv.Atoi(f.value)
+			if err != nil {
+				return nil, fmt.Errorf("MTU: %v", err)
+			}
+			l.MTU = mtu
+		}
+	}
+	if ip != nil && mask != nil {
+		l.Addr = (&net.IPNet{IP: ip.To4(), Mask: mask}).String()
+	}
+	if _, _, err := net.ParseCIDR(l.Addr); err != nil {
+		return nil, fmt.Errorf("no IPv4 address found: %v", err)
+	}
+	if net.ParseIP(l.Gateway) == nil {
+		return nil, fmt.Errorf("no IPv4 gateway found")
+	}
+	return &l, nil
+}
+
+// Signal is the signal quality reported by the modem. Zero values are
+// unknown: MBIM modems only report the RSSI, and the LTE-specific values are
+// missing while the modem is connected to a 2G/3G network.
+type Signal struct {
+	RSSI float64 // received signal strength indicator, in dBm
+	RSRQ float64 // LTE reference signal received quality, in dB
+	RSRP float64 // LTE reference signal received power, in dBm
+	SNR  float64 // LTE signal-to-noise ratio, in dB
+}
+
+// ParseSignal returns the signal quality from the output of the SignalArgs
+// command.
+func (c *Config) ParseSignal(out string) (Signal, error) {
+	var s Signal
+	for _, f := range fields(out) {
+		if c.Protocol == ProtocolMBIM {
+			if f.key != "RSSI" {
+				continue
+			}
+			// MBIM reports the RSSI as coded value, see 3GPP TS 27.007.
+			rssi, err := strconv.Atoi(f.value)
+			if err != nil {
+				return Signal{}, fmt.Errorf("RSSI: %v", err)
+			}
+			if rssi != 99 { // unknown
+				s.RSSI = float64(-113 + 2*rssi)
+			}
+			continue
+		}
+		var val *float64
+		switch f.key {
+		case "RSSI":
+			val = &s.RSSI
+		case "RSRQ":
+			val = &s.RSRQ
+		case "RSRP":
+			val = &s.RSRP
+		case "SNR":
+			val = &s.SNR
+		default:
+			continue
+		}
+		if *val != 0 {
+			continue // only consider the first radio interface listed
+		}
+		// e.g. “-63 dBm”
+		num := strings.Fields(f.value)
+		if len(num) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(num[0], 64)
+		if err != nil {
+			return Signal{}, fmt.Errorf("%s: %v", f.key, err)
+		}
+		*val = v
+	}
+	return s, nil
+}
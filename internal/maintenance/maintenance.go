@@ -0,0 +1,224 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package maintenance schedules maintenance tasks (rebooting the router,
+// restarting individual daemons) within configured maintenance windows.
+package maintenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Task is a maintenance task, e.g. rebooting the router every Sunday between
+// 04:00 and 05:00.
+type Task struct {
+	Name     string   `json:"name"`     // e.g. “weekly-reboot”
+	Action   string   `json:"action"`   // “reboot” or “restart”
+	Path     string   `json:"path"`     // e.g. /user/dnsd, for action “restart”
+	Weekdays []string `json:"weekdays"` // e.g. ["sun"], empty means every day
+	Start    string   `json:"start"`    // e.g. “04:00” (local time)
+	Duration string   `json:"duration"` // e.g. “1h”
+
+	weekdays map[time.Weekday]bool
+	start    time.Duration // since midnight
+	duration time.Duration
+}
+
+// Config is the maintenance configuration, read from maintenance.json.
+type Config struct {
+	// MaxUplinkBytesPerSecond is the uplink traffic (received and sent)
+	// above which tasks are postponed within their window, and skipped once
+	// their window closes. Zero disables the traffic check.
+	MaxUplinkBytesPerSecond uint64  `json:"max_uplink_bytes_per_second"`
+	Tasks                   []*Task `json:"tasks"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseClock(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("malformed time of day %q: expected HH:MM", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("malformed time of day %q: invalid hour", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("malformed time of day %q: invalid minute", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (t *Task) parse() error {
+	switch t.Action {
+	case "reboot":
+	case "restart":
+		if t.Path == "" {
+			return fmt.Errorf("action restart requires a path")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", t.Action)
+	}
+	t.weekdays = make(map[time.Weekday]bool)
+	for _, d := range t.Weekdays {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", d)
+		}
+		t.weekdays[wd] = true
+	}
+	start, err := parseClock(t.Start)
+	if err != nil {
+		return err
+	}
+	t.start = start
+	duration, err := time.ParseDuration(t.Duration)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 || duration > 24*time.Hour {
+		return fmt.Errorf("duration %v out of range (0, 24h]", duration)
+	}
+	t.duration = duration
+	return nil
+}
+
+// Next returns the start and end of the next window (or the currently open
+// window) of task t after now.
+func (t *Task) Next(now time.Time) (start, end time.Time) {
+	// A window which started yesterday might still be open.
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+	for i := 0; i < 9; i++ {
+		d := day.AddDate(0, 0, i)
+		if len(t.weekdays) > 0 && !t.weekdays[d.Weekday()] {
+			continue
+		}
+		// Use time.Date instead of adding to midnight so that the wall clock
+		// time is preserved across daylight saving time transitions.
+		start = time.Date(d.Year(), d.Month(), d.Day(), 0, int(t.start/time.Minute), 0, 0, d.Location())
+		end = start.Add(t.duration)
+		if end.After(now) {
+			return start, end
+		}
+	}
+	panic("BUG: no window within 9 days")
+}
+
+// String returns the name of task t.
+func (t *Task) String() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if t.Action == "restart" {
+		return t.Action + " " + t.Path
+	}
+	return t.Action
+}
+
+// LoadConfig reads maintenance.json from dir.
+func LoadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "maintenance.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, t := range cfg.Tasks {
+		if err := t.parse(); err != nil {
+			return nil, fmt.Errorf("%s: task %v: %v", fn, t, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// LastRuns records when each task (keyed by its String) was last performed,
+// stored in maintd/lastrun.json, so that a task is performed once per window
+// even when maintd restarts (e.g. after a reboot task) or reloads its
+// configuration within the window.
+type LastRuns map[string]time.Time
+
+// Ran returns whether task t was performed at or after start.
+func (lr LastRuns) Ran(t *Task, start time.Time) bool {
+	last, ok := lr[t.String()]
+	return ok && !last.Before(start)
+}
+
+// ReadLastRuns reads maintd/lastrun.json from dir. A missing file results in
+// empty LastRuns.
+func ReadLastRuns(dir string) (LastRuns, error) {
+	lr := make(LastRuns)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "maintd", "lastrun.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lr, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &lr); err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+// WriteLastRuns atomically replaces maintd/lastrun.json in dir.
+func WriteLastRuns(dir string, lr LastRuns) error {
+	b, err := json.MarshalIndent(lr, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "maintd"), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(dir, "maintd", "lastrun.json"), b, 0644)
+}
+
+// UplinkBytes returns the number of bytes received and sent on the network
+// interface ifname so far.
+func UplinkBytes(ifname string) (uint64, error) {
+	var total uint64
+	for _, stat := range []string{"rx_bytes", "tx_bytes"} {
+		b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifname, "statistics", stat))
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 0, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/maintenance"
+)
+
+func loadConfig(t *testing.T, contents string) (*maintenance.Config, error) {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "maintenancetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "maintenance.json"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return maintenance.LoadConfig(tmp)
+}
+
+func TestNext(t *testing.T) {
+	cfg, err := loadConfig(t, `{
+  "tasks": [
+    {"action": "reboot", "weekdays": ["sun"], "start": "04:00", "duration": "1h"},
+    {"action": "restart", "path": "/user/dnsd", "start": "23:30", "duration": "1h"}
+  ]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reboot, restart := cfg.Tasks[0], cfg.Tasks[1]
+	// 2018-07-14 is a Saturday.
+	date := func(day, hour, min int) time.Time {
+		return time.Date(2018, time.July, day, hour, min, 0, 0, time.UTC)
+	}
+
+	for _, tt := range []struct {
+		task      *maintenance.Task
+		now       time.Time
+		wantStart time.Time
+	}{
+		{reboot, date(14, 12, 0), date(15, 4, 0)},
+		{reboot, date(15, 4, 30), date(15, 4, 0)}, // window open
+		{reboot, date(15, 5, 0), date(22, 4, 0)},
+		{restart, date(14, 12, 0), date(14, 23, 30)},
+		{restart, date(15, 0, 15), date(14, 23, 30)}, // open since yesterday
+		{restart, date(15, 0, 30), date(15, 23, 30)},
+	} {
+		start, end := tt.task.Next(tt.now)
+		if !start.Equal(tt.wantStart) {
+			t.Errorf("%v.Next(%v): got start %v, want %v", tt.task, tt.now, start, tt.wantStart)
+		}
+		if got, want := end.Sub(start), time.Hour; got != want {
+			t.Errorf("%v.Next(%v): got window of %v, want %v", tt.task, tt.now, got, want)
+		}
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, task := range []string{
+		`{"action": "shutdown", "start": "04:00", "duration": "1h"}`,
+		`{"action": "restart", "start": "04:00", "duration": "1h"}`,
+		`{"action": "reboot", "weekdays": ["sunday"], "start": "04:00", "duration": "1h"}`,
+		`{"action": "reboot", "start": "24:00", "duration": "1h"}`,
+		`{"action": "reboot", "start": "04:00", "duration": "48h"}`,
+	} {
+		if _, err := loadConfig(t, `{"tasks": [`+task+`]}`); err == nil {
+			t.Errorf("LoadConfig(%s): unexpectedly succeeded", task)
+		}
+	}
+}
+
+func TestLastRuns(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "maintenancetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg, err := loadConfig(t, `{"tasks": [{"action": "reboot", "start": "04:00", "duration": "1h"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reboot := cfg.Tasks[0]
+	start := time.Date(2018, time.July, 15, 4, 0, 0, 0, time.UTC)
+
+	lr, err := maintenance.ReadLastRuns(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Ran(reboot, start) {
+		t.Errorf("Ran without last runs: got true, want false")
+	}
+	lr[reboot.String()] = start.Add(10 * time.Minute)
+	if err := maintenance.WriteLastRuns(tmp, lr); err != nil {
+		t.Fatal(err)
+	}
+	lr, err = maintenance.ReadLastRuns(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lr.Ran(reboot, start) {
+		t.Errorf("Ran(window of the last run): got false, want true")
+	}
+	if next := start.AddDate(0, 0, 1); lr.Ran(reboot, next) {
+		t.Errorf("Ran(next window): got true, want false")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Scheduler performs Task once in each of its windows, postponing it while the
+// uplink is busy and skipping it if the uplink stays busy until the window
+// closes.
+type Scheduler struct {
+	Task *Task
+
+	// RetryInterval is how long to wait before re-checking the uplink when
+	// the task was postponed.
+	RetryInterval time.Duration
+
+	// Busy returns whether the uplink carries significant traffic.
+	Busy func(context.Context) (bool, error)
+
+	// Ran returns whether the task was already performed in the window
+	// starting at start, e.g. before maintd was restarted.
+	Ran func(start time.Time) bool
+
+	// Perform performs the task (and records having done so).
+	Perform func() error
+
+	// Scheduled, if non-nil, is called with each window the scheduler waits
+	// for.
+	Scheduled func(start, end time.Time)
+
+	// Now and Sleep default to time.Now and sleeping until ctx is done,
+	// respectively. Sleep returns false if ctx is done.
+	Now   func() time.Time
+	Sleep func(ctx context.Context, d time.Duration) bool
+}
+
+func (s *Scheduler) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *Scheduler) sleep(ctx context.Context, d time.Duration) bool {
+	if s.Sleep != nil {
+		return s.Sleep(ctx, d)
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Run schedules the task until ctx is canceled.
+func (s *Scheduler) Run(ctx context.Context) {
+	t := s.Task
+	after := s.now()
+	for {
+		start, end := t.Next(after)
+		if start.Before(s.now()) && s.Ran(start) {
+			// The window is already open and the task was performed
+			// in it: maintd was restarted within the window, possibly
+			// by this very task rebooting the router.
+			start, end = t.Next(end)
+		}
+		if s.Scheduled != nil {
+			s.Scheduled(start, end)
+		}
+		log.Printf("%v: next window from %v to %v", t, start, end)
+		if !s.sleep(ctx, start.Sub(s.now())) {
+			return
+		}
+		if !s.window(ctx, end) {
+			return
+		}
+		// Whether the task was performed or skipped, it is done for
+		// this window.
+		after = end
+	}
+}
+
+// window performs the task within the window ending at end. It returns false
+// if ctx is done.
+func (s *Scheduler) window(ctx context.Context, end time.Time) bool {
+	t := s.Task
+	for {
+		busy, err := s.Busy(ctx)
+		if err != nil {
+			log.Printf("%v: checking uplink traffic: %v", t, err)
+		}
+		if err == nil && !busy {
+			log.Printf("%v: performing task", t)
+			if err := s.Perform(); err != nil {
+				log.Printf("%v: %v", t, err)
+			}
+			return true
+		}
+		if !s.now().Add(s.RetryInterval).Before(end) {
+			log.Printf("%v: window closes, skipping task", t)
+			return true
+		}
+		if !s.sleep(ctx, s.RetryInterval) {
+			return false
+		}
+	}
+}
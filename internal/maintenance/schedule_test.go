@@ -0,0 +1,106 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/maintenance"
+)
+
+func TestSchedulerBusyWindow(t *testing.T) {
+	cfg, err := loadConfig(t, `{
+  "tasks": [
+    {"action": "reboot", "weekdays": ["sun"], "start": "04:00", "duration": "1h"}
+  ]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2018-07-14 is a Saturday.
+	date := func(day, hour, min int) time.Time {
+		return time.Date(2018, time.July, day, hour, min, 0, 0, time.UTC)
+	}
+	windowEnd := date(15, 5, 0)
+
+	for _, tt := range []struct {
+		desc string
+		busy func(context.Context) (bool, error)
+	}{
+		{"busy", func(context.Context) (bool, error) { return true, nil }},
+		{"error", func(context.Context) (bool, error) { return false, errors.New("no such device") }},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			ctx, canc := context.WithCancel(context.Background())
+			defer canc()
+			now := date(14, 12, 0)
+			var (
+				checks    []time.Time
+				performed int
+				scheduled []time.Time
+			)
+			s := &maintenance.Scheduler{
+				Task:          cfg.Tasks[0],
+				RetryInterval: 10 * time.Minute,
+				Busy: func(ctx context.Context) (bool, error) {
+					checks = append(checks, now)
+					return tt.busy(ctx)
+				},
+				Ran: func(time.Time) bool { return false },
+				Perform: func() error {
+					performed++
+					return nil
+				},
+				Scheduled: func(start, end time.Time) {
+					scheduled = append(scheduled, start)
+				},
+				Now: func() time.Time { return now },
+				Sleep: func(ctx context.Context, d time.Duration) bool {
+					if now.Add(d).After(windowEnd) {
+						canc() // waiting for the next window
+						return false
+					}
+					now = now.Add(d)
+					return true
+				},
+			}
+			s.Run(ctx)
+
+			if performed != 0 {
+				t.Errorf("task performed %d times, want 0", performed)
+			}
+			if got, want := len(checks), 6; got != want {
+				t.Errorf("uplink checked %d times, want %d: %v", got, want, checks)
+			}
+			for _, c := range checks {
+				if !c.Before(windowEnd) {
+					t.Errorf("uplink checked at %v, after the window closed", c)
+				}
+			}
+			want := []time.Time{date(15, 4, 0), date(22, 4, 0)}
+			if len(scheduled) != len(want) {
+				t.Fatalf("scheduled windows: got %v, want %v", scheduled, want)
+			}
+			for i := range want {
+				if !scheduled[i].Equal(want[i]) {
+					t.Errorf("scheduled windows: got %v, want %v", scheduled, want)
+				}
+			}
+		})
+	}
+}
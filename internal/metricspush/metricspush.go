@@ -0,0 +1,241 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metricspush pushes the metrics of the router7 daemons to a
+// Prometheus remote_write endpoint (e.g. Grafana Cloud, VictoriaMetrics) or a
+// Prometheus Pushgateway, for deployments without a scraping Prometheus.
+package metricspush
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rtr7/router7/internal/multilisten"
+)
+
+// DefaultTargets are the metrics endpoints of the router7 daemons, by job
+// name, with the ports configured in multilisten.ConfigPath (if any) applied
+// by ReadConfig.
+var DefaultTargets = map[string]string{
+	"certd":        "localhost:8086",
+	"diagd":        "localhost:7733",
+	"dhcp4d":       "localhost:8067",
+	"dhcp6d":       "localhost:8069",
+	"dnsd":         "localhost:8053",
+	"dyndns":       "localhost:8085",
+	"fwlogd":       "localhost:8075",
+	"ikev2d":       "localhost:8083",
+	"lted":         "localhost:8087",
+	"maintd":       "localhost:8079",
+	"metricspushd": "localhost:8081",
+	"netconfigd":   "localhost:8066",
+	"nfqueued":     "localhost:8076",
+	"ntpd":         "localhost:8123",
+	"presenced":    "localhost:8078",
+	"rogued":       "localhost:8074",
+	"snid":         "localhost:8082",
+	"tailnetd":     "localhost:8084",
+	"telemetryd":   "localhost:8080",
+}
+
+// Config is the metrics push configuration, stored in metricspush.json.
+// Pushing is disabled unless URL is set.
+type Config struct {
+	// URL is the remote_write endpoint, e.g.
+	// “https://prometheus-prod-01-eu-west-0.grafana.net/api/prom/push” or
+	// “http://victoriametrics.example:8428/api/v1/write”, or the Pushgateway
+	// base URL if Pushgateway is set.
+	URL         string `json:"url"`
+	Pushgateway bool   `json:"pushgateway"`
+
+	// Username and Password enable HTTP basic authentication (e.g. Grafana
+	// Cloud instance ID and API key), BearerToken enables bearer token
+	// authentication.
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	BearerToken string `json:"bearer_token"`
+
+	Interval string `json:"interval"` // e.g. “30s”, defaults to 1m
+
+	// Buffer is how long to retain samples which could not be pushed (e.g.
+	// during a WAN outage), defaults to 6h. Samples are not buffered when
+	// pushing to a Pushgateway, which only stores the most recent values.
+	Buffer string `json:"buffer"`
+
+	// Instance is the instance label, defaults to the hostname.
+	Instance string `json:"instance"`
+
+	// Targets overrides DefaultTargets (job name to host:port).
+	Targets map[string]string `json:"targets"`
+}
+
+// IntervalDuration returns the parsed Interval.
+func (c *Config) IntervalDuration() (time.Duration, error) {
+	if c.Interval == "" {
+		return 1 * time.Minute, nil
+	}
+	return time.ParseDuration(c.Interval)
+}
+
+// BufferDuration returns the parsed Buffer.
+func (c *Config) BufferDuration() (time.Duration, error) {
+	if c.Buffer == "" {
+		return 6 * time.Hour, nil
+	}
+	return time.ParseDuration(c.Buffer)
+}
+
+// ReadConfig reads metricspush.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "metricspush.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if _, err := cfg.IntervalDuration(); err != nil {
+		return nil, fmt.Errorf("%s: interval: %v", fn, err)
+	}
+	if _, err := cfg.BufferDuration(); err != nil {
+		return nil, fmt.Errorf("%s: buffer: %v", fn, err)
+	}
+	if cfg.Instance == "" {
+		cfg.Instance, _ = os.Hostname()
+	}
+	if len(cfg.Targets) == 0 {
+		cfg.Targets = multilisten.ResolveAll(DefaultTargets)
+	}
+	return &cfg, nil
+}
+
+// Label is a Prometheus label, e.g. __name__="dns_requests_total".
+type Label struct {
+	Name, Value string
+}
+
+// Series is a single sample of a time series.
+type Series struct {
+	Labels    []Label
+	Value     float64
+	Timestamp int64 // milliseconds since the epoch
+}
+
+// Batch is the result of scraping all targets once.
+type Batch []Series
+
+// Buffer retains batches which could not be pushed yet, discarding batches
+// older than its maximum age.
+type Buffer struct {
+	maxAge  time.Duration
+	batches []Batch
+	times   []time.Time
+}
+
+// NewBuffer returns a Buffer which retains batches for maxAge.
+func NewBuffer(maxAge time.Duration) *Buffer {
+	return &Buffer{maxAge: maxAge}
+}
+
+// Add appends batch, which was scraped at t.
+func (b *Buffer) Add(t time.Time, batch Batch) {
+	b.batches = append(b.batches, batch)
+	b.times = append(b.times, t)
+	var expired int
+	for expired < len(b.times) && t.Sub(b.times[expired]) > b.maxAge {
+		expired++
+	}
+	b.batches = b.batches[expired:]
+	b.times = b.times[expired:]
+}
+
+// Len returns the number of buffered batches.
+func (b *Buffer) Len() int { return len(b.batches) }
+
+// Flush sends the buffered batches, oldest first (remote_write receivers
+// reject out-of-order samples), until send returns an error. Successfully sent
+// batches are removed from the buffer.
+func (b *Buffer) Flush(send func(Batch) error) error {
+	for len(b.batches) > 0 {
+		if err := send(b.batches[0]); err != nil {
+			return err
+		}
+		b.batches = b.batches[1:]
+		b.times = b.times[1:]
+	}
+	return nil
+}
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// marshalWriteRequest encodes batch as a prometheus.WriteRequest protocol
+// buffer message (see prompb/remote.proto and prompb/types.proto in the
+// Prometheus repository).
+func marshalWriteRequest(batch Batch) []byte {
+	var req []byte
+	for _, s := range batch {
+		labels := append([]Label(nil), s.Labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		var ts []byte
+		for _, l := range labels {
+			var label []byte
+			label = appendBytes(label, 1, []byte(l.Name))
+			label = appendBytes(label, 2, []byte(l.Value))
+			ts = appendBytes(ts, 1, label) // TimeSeries.labels
+		}
+		var sample []byte
+		sample = appendTag(sample, 1, wireFixed64) // Sample.value
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], math.Float64bits(s.Value))
+		sample = append(sample, value[:]...)
+		sample = appendTag(sample, 2, wireVarint) // Sample.timestamp
+		sample = appendUvarint(sample, uint64(s.Timestamp))
+		ts = appendBytes(ts, 2, sample) // TimeSeries.samples
+		req = appendBytes(req, 1, ts)   // WriteRequest.timeseries
+	}
+	return req
+}
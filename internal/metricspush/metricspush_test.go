@@ -0,0 +1,92 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metricspush
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMarshalWriteRequest(t *testing.T) {
+	got := marshalWriteRequest(Batch{
+		{
+			Labels:    []Label{{"job", "x"}, {"__name__", "up"}},
+			Value:     1,
+			Timestamp: 1000,
+		},
+	})
+	want := []byte{
+		0x0a, 0x28, // WriteRequest.timeseries
+		0x0a, 0x0e, // TimeSeries.labels
+		0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x12, 0x02, 'u', 'p',
+		0x0a, 0x08, // TimeSeries.labels
+		0x0a, 0x03, 'j', 'o', 'b',
+		0x12, 0x01, 'x',
+		0x12, 0x0c, // TimeSeries.samples
+		0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, // Sample.value (1.0)
+		0x10, 0xe8, 0x07, // Sample.timestamp (1000)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("marshalWriteRequest: got %x, want %x", got, want)
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	b := NewBuffer(1 * time.Hour)
+	base := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		b.Add(base.Add(time.Duration(i)*30*time.Minute), Batch{{Timestamp: int64(i)}})
+	}
+	if got, want := b.Len(), 3; got != want {
+		t.Fatalf("Len() = %d, want %d", got, want)
+	}
+	// The first batch expires:
+	b.Add(base.Add(90*time.Minute), Batch{{Timestamp: 3}})
+	if got, want := b.Len(), 3; got != want {
+		t.Fatalf("Len() = %d, want %d", got, want)
+	}
+
+	// Pushing fails after the first batch (e.g. the WAN went down again):
+	var sent []int64
+	err := b.Flush(func(batch Batch) error {
+		if len(sent) == 1 {
+			return fmt.Errorf("network unreachable")
+		}
+		sent = append(sent, batch[0].Timestamp)
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Flush unexpectedly succeeded")
+	}
+	if got, want := b.Len(), 2; got != want {
+		t.Fatalf("Len() = %d, want %d", got, want)
+	}
+
+	if err := b.Flush(func(batch Batch) error {
+		sent = append(sent, batch[0].Timestamp)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(sent), "[1 2 3]"; got != want {
+		t.Errorf("sent batches %s, want %s (oldest first)", got, want)
+	}
+	if got, want := b.Len(), 0; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
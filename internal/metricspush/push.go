@@ -0,0 +1,86 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metricspush
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// Client pushes metrics to the endpoint configured in Config.
+type Client struct {
+	cfg        *Config
+	httpClient *http.Client
+}
+
+// NewClient returns a Client for cfg.
+func NewClient(cfg *Config, httpClient *http.Client) *Client {
+	return &Client{cfg: cfg, httpClient: httpClient}
+}
+
+func (c *Client) do(ctx context.Context, method, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	switch {
+	case c.cfg.Username != "":
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	case c.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.cfg.BearerToken)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: unexpected HTTP status %s: %s", method, url, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// RemoteWrite sends batch to the remote_write endpoint.
+func (c *Client) RemoteWrite(ctx context.Context, batch Batch) error {
+	return c.do(ctx, "POST", c.cfg.URL, snappy.Encode(nil, marshalWriteRequest(batch)), http.Header{
+		"Content-Encoding":                  {"snappy"},
+		"Content-Type":                      {"application/x-protobuf"},
+		"X-Prometheus-Remote-Write-Version": {"0.1.0"},
+	})
+}
+
+// Pushgateway replaces the metrics of job with text (in the Prometheus text
+// exposition format, as scraped from the job).
+func (c *Client) Pushgateway(ctx context.Context, job string, text []byte) error {
+	u := strings.TrimSuffix(c.cfg.URL, "/") +
+		"/metrics/job/" + url.PathEscape(job) +
+		"/instance/" + url.PathEscape(c.cfg.Instance)
+	return c.do(ctx, "PUT", u, text, http.Header{
+		"Content-Type": {"text/plain; version=0.0.4"},
+	})
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqtt implements a minimal MQTT 3.1.1 client which publishes
+// messages with QoS 0.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// packet types, see section 2.2.1 of the MQTT 3.1.1 specification
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+// Options configure a connection to an MQTT broker.
+type Options struct {
+	ClientID string // e.g. “router7”
+	Username string // optional
+	Password string // optional
+
+	// KeepAlive is the interval in which the client pings the broker.
+	// Defaults to 60 seconds.
+	KeepAlive time.Duration
+}
+
+// Client is a connection to an MQTT broker.
+type Client struct {
+	conn      net.Conn
+	keepAlive time.Duration
+
+	mu  sync.Mutex // serializes writes
+	bw  *bufio.Writer
+	err error
+
+	done chan struct{}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendRemainingLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func encode(header byte, body []byte) []byte {
+	b := appendRemainingLength([]byte{header}, len(body))
+	return append(b, body...)
+}
+
+func encodeConnect(opts Options) []byte {
+	var flags byte = 0x02 // clean session
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+	keepAlive := uint16(opts.KeepAlive / time.Second)
+	body := appendString(nil, "MQTT")
+	body = append(body, 4 /* protocol level */, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+	return encode(typeConnect<<4, body)
+}
+
+func encodePublish(topic string, payload []byte, retain bool) []byte {
+	header := byte(typePublish << 4) // QoS 0
+	if retain {
+		header |= 0x01
+	}
+	body := appendString(nil, topic)
+	return encode(header, append(body, payload...))
+}
+
+// readPacket reads a packet, returning its type and body.
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var length, shift uint
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= uint(digit&0x7f) << shift
+		shift += 7
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// NewClient establishes an MQTT session over conn (e.g. a TCP or TLS
+// connection to the broker). The Client takes ownership of conn.
+func NewClient(conn net.Conn, opts Options) (*Client, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 60 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write(encodeConnect(opts)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	typ, body, err := readPacket(br)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != typeConnack || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected packet type %d, expected CONNACK", typ)
+	}
+	if rc := body[1]; rc != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused by broker: return code %d", rc)
+	}
+	conn.SetDeadline(time.Time{})
+	c := &Client{
+		conn:      conn,
+		keepAlive: opts.KeepAlive,
+		bw:        bufio.NewWriter(conn),
+		done:      make(chan struct{}),
+	}
+	go c.read(br)
+	go c.ping()
+	return c, nil
+}
+
+// Dial connects to the MQTT broker at addr (e.g. “homeassistant.lan:1883”).
+func Dial(addr string, opts Options) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, opts)
+}
+
+// DialTLS is like Dial, but connects to the broker (typically on port 8883)
+// using TLS as configured by cfg.
+func DialTLS(addr string, cfg *tls.Config, opts Options) (*Client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, opts)
+}
+
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	}
+}
+
+// read consumes packets sent by the broker (PINGRESP) until the connection
+// fails, so that a broken connection is noticed.
+func (c *Client) read(br *bufio.Reader) {
+	for {
+		// The broker must reply to a ping within the keep alive interval.
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.keepAlive))
+		if _, _, err := readPacket(br); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Client) ping() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write([]byte{typePingreq << 4, 0}); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.bw.Write(b); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// Publish sends payload to topic with QoS 0. Retained messages are stored by
+// the broker and delivered to future subscribers.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	return c.write(encodePublish(topic, payload, retain))
+}
+
+// Err returns the error which broke the connection, if any.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close disconnects from the broker.
+func (c *Client) Close() error {
+	err := c.write([]byte{typeDisconnect << 4, 0})
+	c.fail(errors.New("client closed"))
+	return err
+}
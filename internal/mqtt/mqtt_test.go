@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRemainingLength(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+	} {
+		if got := appendRemainingLength(nil, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendRemainingLength(%d) = %x, want %x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestConnectPublish(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type packet struct {
+		typ  byte
+		body []byte
+	}
+	packets := make(chan packet)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			typ, body, err := readPacket(br)
+			if err != nil {
+				close(packets)
+				return
+			}
+			if typ == typeConnect {
+				conn.Write([]byte{typeConnack << 4, 2, 0, 0})
+			}
+			packets <- packet{typ, body}
+		}
+	}()
+
+	c, err := Dial(ln.Addr().String(), Options{
+		ClientID: "router7",
+		Username: "user",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := <-packets
+	if got, want := connect.typ, byte(typeConnect); got != want {
+		t.Fatalf("unexpected packet type: got %d, want %d", got, want)
+	}
+	wantConnect := []byte{
+		0, 4, 'M', 'Q', 'T', 'T',
+		4,     // protocol level
+		0xc2,  // username, password, clean session
+		0, 60, // keep alive
+		0, 7, 'r', 'o', 'u', 't', 'e', 'r', '7',
+		0, 4, 'u', 's', 'e', 'r',
+		0, 6, 's', 'e', 'c', 'r', 'e', 't',
+	}
+	if !bytes.Equal(connect.body, wantConnect) {
+		t.Fatalf("unexpected CONNECT: got %x, want %x", connect.body, wantConnect)
+	}
+
+	if err := c.Publish("router7/wan", []byte("up"), true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case publish := <-packets:
+		if got, want := publish.typ, byte(typePublish); got != want {
+			t.Fatalf("unexpected packet type: got %d, want %d", got, want)
+		}
+		want := []byte{0, 11, 'r', 'o', 'u', 't', 'e', 'r', '7', '/', 'w', 'a', 'n', 'u', 'p'}
+		if !bytes.Equal(publish.body, want) {
+			t.Fatalf("unexpected PUBLISH: got %x, want %x", publish.body, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("PUBLISH not received")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if disconnect := <-packets; disconnect.typ != typeDisconnect {
+		t.Fatalf("unexpected packet type: got %d, want %d", disconnect.typ, typeDisconnect)
+	}
+	if err := c.Publish("router7/wan", []byte("down"), true); err == nil {
+		t.Fatalf("Publish unexpectedly succeeded after Close")
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readPacket(bufio.NewReader(conn))
+		conn.Write([]byte{typeConnack << 4, 2, 0, 5 /* not authorized */})
+	}()
+	if _, err := Dial(ln.Addr().String(), Options{ClientID: "router7"}); err == nil {
+		t.Fatalf("Dial unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multilisten
+
+import (
+	"time"
+
+	"github.com/rtr7/router7/internal/linkstate"
+)
+
+// settleDelay is how long to wait for further address changes before calling
+// the update function: an interface coming up typically results in a burst of
+// address changes (IPv4, IPv6 link-local, IPv6 global).
+const settleDelay = 500 * time.Millisecond
+
+// NotifyAddrChange calls update (from a separate goroutine) whenever an address
+// was added to or removed from any network interface, e.g. because a USB
+// network card was plugged in. This makes it unnecessary for daemons to be
+// signaled by netconfigd in order to update their listeners.
+func NotifyAddrChange(update func()) error {
+	return linkstate.NotifySettled(linkstate.Filter{Kinds: linkstate.Addr}, settleDelay, update)
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multilisten
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/gokrazy/gokrazy"
+)
+
+// ConfigPath is where the management listeners of all daemons are configured,
+// by daemon name. Daemons which query each other (e.g. diagd aggregating the
+// health of all daemons) look up the ports there, too.
+const ConfigPath = "/perm/listeners.json"
+
+// configPath is ConfigPath, except in tests.
+var configPath = ConfigPath
+
+// Bind policies of management listeners.
+const (
+	BindPrivate   = "private"   // private addresses of all interfaces (default)
+	BindLocalhost = "localhost" // loopback addresses only
+	BindInterface = "interface" // addresses of Listen.Interface and loopback
+)
+
+// Listen configures the management listener (e.g. HTTP with /metrics and
+// /healthz) of a daemon.
+type Listen struct {
+	Port      string `json:"port,omitempty"`      // e.g. 8067
+	Bind      string `json:"bind,omitempty"`      // BindPrivate, BindLocalhost or BindInterface
+	Interface string `json:"interface,omitempty"` // e.g. lan0, for BindInterface
+}
+
+func (l Listen) validate() error {
+	if l.Port != "" {
+		if _, err := strconv.ParseUint(l.Port, 10, 16); err != nil {
+			return fmt.Errorf("invalid port %q", l.Port)
+		}
+	}
+	switch l.Bind {
+	case "", BindPrivate, BindLocalhost:
+	case BindInterface:
+		if l.Interface == "" {
+			return fmt.Errorf("bind policy %q requires an interface", l.Bind)
+		}
+	default:
+		return fmt.Errorf("unknown bind policy %q, expected %q, %q or %q",
+			l.Bind, BindPrivate, BindLocalhost, BindInterface)
+	}
+	return nil
+}
+
+// ReadConfig reads the management listener configuration of all daemons from
+// path. A missing file results in an empty configuration.
+func ReadConfig(path string) (map[string]Listen, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg map[string]Listen
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for daemon, l := range cfg {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, daemon, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Resolve returns addr (host:port, e.g. localhost:8053) with the port of
+// daemon configured in ConfigPath, if any.
+func Resolve(daemon, addr string) string {
+	return ResolveAll(map[string]string{daemon: addr})[daemon]
+}
+
+// ResolveAll returns targets (daemon name to host:port) with the ports
+// configured in ConfigPath.
+func ResolveAll(targets map[string]string) map[string]string {
+	cfg, err := ReadConfig(configPath)
+	if err != nil {
+		log.Printf("using default ports: %v", err)
+	}
+	result := make(map[string]string, len(targets))
+	for daemon, addr := range targets {
+		result[daemon] = addr
+		if port := cfg[daemon].Port; port != "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				result[daemon] = net.JoinHostPort(host, port)
+			}
+		}
+	}
+	return result
+}
+
+// Management is the management listener of a daemon, configured in ConfigPath
+// and overridable via flags.
+type Management struct {
+	daemon      string
+	defaultPort string
+	flags       Listen
+}
+
+// NewManagement returns the management listener of daemon, which listens on
+// defaultPort unless configured otherwise. It registers the -listen_port,
+// -listen_bind and -listen_interface flags in fs.
+//
+// Ports overridden via flags are only known to the daemon itself: configure
+// them in ConfigPath instead for other daemons to find them.
+func NewManagement(fs *flag.FlagSet, daemon, defaultPort string) *Management {
+	m := &Management{
+		daemon:      daemon,
+		defaultPort: defaultPort,
+	}
+	fs.StringVar(&m.flags.Port, "listen_port", "", "port of the management interface, overrides "+ConfigPath+" (default "+defaultPort+")")
+	fs.StringVar(&m.flags.Bind, "listen_bind", "", "addresses of the management interface: "+BindPrivate+" (all private addresses), "+BindLocalhost+" or "+BindInterface+" (addresses of -listen_interface and localhost), overrides "+ConfigPath+" (default "+BindPrivate+")")
+	fs.StringVar(&m.flags.Interface, "listen_interface", "", "network interface for -listen_bind="+BindInterface+", e.g. lan0")
+	return m
+}
+
+// Config returns the effective configuration of the management listener.
+func (m *Management) Config() (Listen, error) {
+	all, err := ReadConfig(configPath)
+	if err != nil {
+		return Listen{}, err
+	}
+	l := all[m.daemon]
+	if m.flags.Port != "" {
+		l.Port = m.flags.Port
+	}
+	if m.flags.Bind != "" {
+		l.Bind = m.flags.Bind
+	}
+	if m.flags.Interface != "" {
+		l.Interface = m.flags.Interface
+	}
+	if l.Port == "" {
+		l.Port = m.defaultPort
+	}
+	if l.Bind == "" {
+		l.Bind = BindPrivate
+	}
+	if err := l.validate(); err != nil {
+		return Listen{}, err
+	}
+	return l, nil
+}
+
+// interfaceHosts returns the addresses of the network interface named name,
+// with zone for link-local addresses.
+func interfaceHosts(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipnet.IP.String()
+		if ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			host += "%" + name
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// Addrs returns the addresses (host:port) on which to listen according to the
+// bind policy. extra hosts (e.g. the IPv6Net1 address) are only included with
+// BindPrivate. Localhost is always included so that daemons can query each
+// other.
+func (m *Management) Addrs(extra ...string) ([]string, error) {
+	l, err := m.Config()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	switch l.Bind {
+	case BindPrivate:
+		hosts, err = gokrazy.PrivateInterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, extra...)
+
+	case BindLocalhost:
+		hosts, err = interfaceHosts("lo")
+		if err != nil {
+			return nil, err
+		}
+
+	case BindInterface:
+		hosts, err = interfaceHosts("lo")
+		if err != nil {
+			return nil, err
+		}
+		ifaceHosts, err := interfaceHosts(l.Interface)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, ifaceHosts...)
+	}
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, l.Port)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multilisten
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeListenersConfig makes the package use a temporary listeners.json with
+// content until the returned function is called.
+func writeListenersConfig(t *testing.T, content string) func() {
+	dir, err := ioutil.TempDir("", "multilisten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath = filepath.Join(dir, "listeners.json")
+	if err := ioutil.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.RemoveAll(dir)
+		configPath = ConfigPath
+	}
+}
+
+func TestManagementConfig(t *testing.T) {
+	defer writeListenersConfig(t, `{
+  "dhcp4d": {"port": "9067", "bind": "interface", "interface": "lan0"},
+  "dnsd": {"bind": "localhost"}
+}`)()
+
+	for _, tt := range []struct {
+		desc   string
+		daemon string
+		args   []string
+		want   Listen
+	}{
+		{
+			desc:   "defaults",
+			daemon: "radvd",
+			want:   Listen{Port: "8070", Bind: BindPrivate},
+		},
+
+		{
+			desc:   "config",
+			daemon: "dhcp4d",
+			want:   Listen{Port: "9067", Bind: BindInterface, Interface: "lan0"},
+		},
+
+		{
+			desc:   "config with default port",
+			daemon: "dnsd",
+			want:   Listen{Port: "8070", Bind: BindLocalhost},
+		},
+
+		{
+			desc:   "flags override config",
+			daemon: "dhcp4d",
+			args:   []string{"-listen_port=10067", "-listen_interface=lan1"},
+			want:   Listen{Port: "10067", Bind: BindInterface, Interface: "lan1"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			fs := flag.NewFlagSet(tt.daemon, flag.ContinueOnError)
+			m := NewManagement(fs, tt.daemon, "8070")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Config()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("Config: unexpected result: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestManagementConfigInvalid(t *testing.T) {
+	defer writeListenersConfig(t, `{}`)()
+	for _, tt := range []struct {
+		desc string
+		args []string
+		want string
+	}{
+		{"port", []string{"-listen_port=http"}, "invalid port"},
+		{"bind", []string{"-listen_bind=public"}, "unknown bind policy"},
+		{"interface", []string{"-listen_bind=interface"}, "requires an interface"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			fs := flag.NewFlagSet("dhcp4d", flag.ContinueOnError)
+			m := NewManagement(fs, "dhcp4d", "8067")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Config(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Config = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	invalid := writeListenersConfig(t, `{"dnsd": {"port": "99999"}}`)
+	defer invalid()
+	if _, err := ReadConfig(configPath); err == nil {
+		t.Fatalf("ReadConfig unexpectedly succeeded")
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	defer writeListenersConfig(t, `{"dnsd": {"port": "9053"}, "diagd": {"bind": "localhost"}}`)()
+	got := ResolveAll(map[string]string{
+		"dnsd":   "localhost:8053",
+		"diagd":  "localhost:7733",
+		"dhcp4d": "localhost:8067",
+	})
+	want := map[string]string{
+		"dnsd":   "localhost:9053",
+		"diagd":  "localhost:7733",
+		"dhcp4d": "localhost:8067",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("ResolveAll: unexpected result: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddrsLocalhost(t *testing.T) {
+	defer writeListenersConfig(t, `{}`)()
+	fs := flag.NewFlagSet("dnsd", flag.ContinueOnError)
+	m := NewManagement(fs, "dnsd", "8053")
+	if err := fs.Parse([]string{"-listen_bind=localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := m.Addrs("2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) == 0 {
+		t.Fatalf("Addrs returned no addresses")
+	}
+	for _, addr := range addrs {
+		if addr != "127.0.0.1:8053" && addr != "[::1]:8053" {
+			t.Errorf("unexpected address %q", addr)
+		}
+	}
+}
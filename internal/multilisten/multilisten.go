@@ -16,12 +16,15 @@
 package multilisten
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/rtr7/router7/internal/dhcp6"
 )
@@ -31,17 +34,58 @@ type Listener interface {
 	Close() error
 }
 
+// shutdowner is implemented by listeners which can gracefully drain in-flight
+// requests, e.g. *http.Server.
+type shutdowner interface {
+	Shutdown(context.Context) error
+}
+
 type Pool struct {
+	// DrainTimeout is how long listeners which implement Shutdown (e.g.
+	// *http.Server) get to finish in-flight requests when their address
+	// vanishes before they are closed forcefully. Zero means close immediately.
+	DrainTimeout time.Duration
+
 	mu        sync.Mutex
 	listeners map[string]Listener
 }
 
 func NewPool() *Pool {
 	return &Pool{
-		listeners: make(map[string]Listener),
+		DrainTimeout: 10 * time.Second,
+		listeners:    make(map[string]Listener),
+	}
+}
+
+// NewHTTPServer returns an *http.Server for addr with timeouts suitable for the
+// management and metrics endpoints of router7 daemons, so that stuck clients
+// cannot exhaust resources.
+func NewHTTPServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      1 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
 	}
 }
 
+func (p *Pool) closeListener(host string, ln Listener) {
+	s, ok := ln.(shutdowner)
+	if !ok || p.DrainTimeout == 0 {
+		ln.Close()
+		return
+	}
+	go func() {
+		ctx, canc := context.WithTimeout(context.Background(), p.DrainTimeout)
+		defer canc()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("draining listener for %q: %v", host, err)
+			ln.Close()
+		}
+	}()
+}
+
 func (p *Pool) ListenAndServe(hosts []string, listenerFor func(host string) Listener) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -59,17 +103,20 @@ func (p *Pool) ListenAndServe(hosts []string, listenerFor func(host string) List
 			ln := listenerFor(host)
 			p.listeners[host] = ln
 			go func(host string, ln Listener) {
-				err := ln.ListenAndServe()
+				err := listenAndServe(ln)
 				log.Printf("listener for %q died: %v", host, err)
 				p.mu.Lock()
 				defer p.mu.Unlock()
-				delete(p.listeners, host)
+				if p.listeners[host] == ln {
+					// only delete if the host was not re-added in the meantime
+					delete(p.listeners, host)
+				}
 			}(host, ln)
 		}
 	}
 	for host := range vanished {
 		log.Printf("no longer listening on %s", host)
-		p.listeners[host].Close()
+		p.closeListener(host, p.listeners[host])
 		delete(p.listeners, host)
 	}
 }
@@ -0,0 +1,176 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multilisten
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CertificateDir is where certd stores router7’s certificate (cert.pem, with
+// intermediates) and private key (key.pem).
+const CertificateDir = "/perm/certd"
+
+// Certificate loads the certificate from dir, reloading it whenever certd
+// renewed it, so that listeners do not need to be restarted.
+type Certificate struct {
+	dir string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+// NewCertificate returns a Certificate which loads cert.pem and key.pem from
+// dir.
+func NewCertificate(dir string) *Certificate {
+	return &Certificate{dir: dir}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certFile := filepath.Join(c.dir, "cert.pem")
+	keyFile := filepath.Join(c.dir, "key.pem")
+	// certd writes key.pem before cert.pem, so cert.pem is the newest file
+	// once a renewal is complete.
+	st, err := os.Stat(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("no certificate obtained yet: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && st.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	c.modTime = st.ModTime()
+	return c.cert, nil
+}
+
+var defaultCertificate = NewCertificate(CertificateDir)
+
+// sniffListener accepts both plain (e.g. HTTP) and TLS connections on the same
+// port, distinguishing them by their first byte.
+type sniffListener struct {
+	net.Listener
+	config *tls.Config
+
+	once      sync.Once
+	closeOnce sync.Once
+	conns     chan net.Conn
+	done      chan struct{}
+	failed    chan struct{} // closed once Accept of the underlying listener failed
+	err       error
+}
+
+func newSniffListener(ln net.Listener, config *tls.Config) *sniffListener {
+	return &sniffListener{
+		Listener: ln,
+		config:   config,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+}
+
+// peekedConn returns the bytes buffered while sniffing before reading from
+// the connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (l *sniffListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.failed)
+			return
+		}
+		go l.sniff(conn)
+	}
+}
+
+func (l *sniffListener) sniff(conn net.Conn) {
+	// Clients of both HTTP and TLS send data first.
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var c net.Conn = &peekedConn{Conn: conn, r: br}
+	const recordTypeHandshake = 0x16
+	if b[0] == recordTypeHandshake {
+		c = tls.Server(c, l.config)
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.accept() })
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.failed:
+		return nil, l.err
+	}
+}
+
+func (l *sniffListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// listenAndServe serves HTTP servers created by NewHTTPServer via both HTTP
+// and HTTPS (once certd obtained a certificate). Other listeners are started
+// via their ListenAndServe method.
+func listenAndServe(ln Listener) error {
+	srv, ok := ln.(*http.Server)
+	if !ok || srv.TLSConfig != nil {
+		return ln.ListenAndServe()
+	}
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(newSniffListener(l, &tls.Config{
+		GetCertificate: defaultCertificate.GetCertificate,
+	}))
+}
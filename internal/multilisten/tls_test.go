@@ -0,0 +1,132 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multilisten
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for commonName to dir.
+func writeCertificate(t *testing.T, dir, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(certFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSniffListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multilisten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := NewCertificate(dir)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Write([]byte("https"))
+			} else {
+				w.Write([]byte("http"))
+			}
+		}),
+	}
+	go srv.Serve(newSniffListener(l, &tls.Config{GetCertificate: cert.GetCertificate}))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	get := func(scheme string) (string, *tls.ConnectionState, error) {
+		resp, err := client.Get(scheme + "://" + l.Addr().String() + "/")
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), resp.TLS, err
+	}
+
+	if _, _, err := get("https"); err == nil {
+		t.Errorf("HTTPS request unexpectedly succeeded without a certificate")
+	}
+
+	writeCertificate(t, dir, "router7.example.com", time.Now().Add(-1*time.Minute))
+	for _, scheme := range []string{"http", "https"} {
+		body, _, err := get(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := body, scheme; got != want {
+			t.Errorf("unexpected response: got %q, want %q", got, want)
+		}
+	}
+
+	// A renewed certificate is used without restarting the listener:
+	writeCertificate(t, dir, "renewed.example.com", time.Now())
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	_, state, err := get("https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.PeerCertificates[0].Subject.CommonName, "renewed.example.com"; got != want {
+		t.Errorf("unexpected certificate: got %q, want %q", got, want)
+	}
+}
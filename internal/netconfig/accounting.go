@@ -0,0 +1,182 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/rtr7/router7/internal/ruleset"
+	"github.com/rtr7/router7/internal/statefile"
+)
+
+// accountingConfig is the per-client traffic accounting configuration, stored
+// in accounting.json.
+type accountingConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// accountingAddrs returns the IPv4 addresses of all non-expired DHCPv4
+// leases if per-client traffic accounting is enabled, or required for
+// enforcing quotas.
+func accountingAddrs(dir string, quotas bool) ([]net.IP, error) {
+	var cfg accountingConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "accounting.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	if !cfg.Enabled && !quotas {
+		return nil, nil
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "dhcp4d/leases.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// Subset of dhcp4d.Lease (which cannot be imported: dhcp4d imports
+	// netconfig).
+	var leases []struct {
+		Addr   net.IP    `json:"addr"`
+		Expiry time.Time `json:"expiry"`
+	}
+	if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	var addrs []net.IP
+	for _, l := range leases {
+		if !l.Expiry.IsZero() && now.After(l.Expiry) {
+			continue
+		}
+		ip := l.Addr.To4()
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		addrs = append(addrs, ip)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	return addrs, nil
+}
+
+const (
+	accountingRxPrefix = "acct_rx_"
+	accountingTxPrefix = "acct_tx_"
+)
+
+// addAccounting adds counters for traffic sent (tx) and received (rx) by each
+// of addrs to the forward chain of filter (an IPv4 table).
+func addAccounting(filter *ruleset.Table, forward *ruleset.Chain, addrs []net.IP) {
+	const NFT_OBJECT_COUNTER = 1 // TODO: get into x/sys/unix
+	for _, addr := range addrs {
+		for _, counter := range []struct {
+			prefix string
+			offset uint32
+		}{
+			{accountingTxPrefix, 12}, // source address
+			{accountingRxPrefix, 16}, // destination address
+		} {
+			obj := filter.AddCounter(counterObj(counter.prefix + addr.String()))
+			forward.AddRule([]expr.Any{
+				// [ payload load 4b @ network header + 12 => reg 1 ]
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       counter.offset,
+					Len:          net.IPv4len,
+				},
+				// [ cmp eq reg 1 0x172aa8c0 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(addr),
+				},
+				// [ counter name acct_tx_192.168.42.23 ]
+				&expr.Objref{
+					Type: NFT_OBJECT_COUNTER,
+					Name: obj.Name,
+				},
+			})
+		}
+	}
+}
+
+// ClientTraffic is the traffic which a LAN client forwarded through the router
+// since per-client traffic accounting was enabled.
+type ClientTraffic struct {
+	Addr    string `json:"addr"`
+	RxBytes uint64 `json:"rx_bytes"` // received from the internet
+	TxBytes uint64 `json:"tx_bytes"` // sent to the internet
+}
+
+// Accounting returns the per-client traffic counters, sorted by address. The
+// result is empty unless accounting is enabled in accounting.json or quotas
+// are configured in devices.json.
+func Accounting() ([]ClientTraffic, error) {
+	c := &nftables.Conn{}
+	filter := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	objs, err := c.GetObj(&nftables.CounterObj{Table: filter})
+	if err != nil {
+		return nil, err
+	}
+	byAddr := make(map[string]*ClientTraffic)
+	get := func(addr string) *ClientTraffic {
+		ct, ok := byAddr[addr]
+		if !ok {
+			ct = &ClientTraffic{Addr: addr}
+			byAddr[addr] = ct
+		}
+		return ct
+	}
+	for _, obj := range objs {
+		co, ok := obj.(*nftables.CounterObj)
+		if !ok || co.Table.Name != filter.Name {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(co.Name, accountingRxPrefix):
+			get(strings.TrimPrefix(co.Name, accountingRxPrefix)).RxBytes = co.Bytes
+		case strings.HasPrefix(co.Name, accountingTxPrefix):
+			get(strings.TrimPrefix(co.Name, accountingTxPrefix)).TxBytes = co.Bytes
+		}
+	}
+	result := make([]ClientTraffic, 0, len(byAddr))
+	for _, ct := range byAddr {
+		result = append(result, *ct)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr < result[j].Addr
+	})
+	return result, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/acd"
+)
+
+// ReportConflict is called when probing an address before assigning it finds
+// that another host uses the address (see acd.Config.Refuse). netconfigd
+// replaces it to alert about conflicts.
+var ReportConflict = func(c acd.Conflict) {
+	log.Printf("address conflict: %v", c)
+}
+
+func hasAddr(link netlink.Link, ip net.IP) (bool, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// claimAddr is called before assigning ip to link. It returns false if ip
+// must not be assigned because another host uses it. Addresses which link
+// already carries are not probed again, and newly assigned addresses are
+// announced (in the background) once assigned, see the returned function.
+func claimAddr(dir string, link netlink.Link, ip net.IP) (ok bool, assigned func(), _ error) {
+	noop := func() {}
+	if ip.To4() == nil {
+		return true, noop, nil
+	}
+	ifname := link.Attrs().Name
+	cfg, err := acd.ReadConfig(dir)
+	if err != nil {
+		return false, nil, err
+	}
+	if !cfg.Watched(ifname) {
+		return true, noop, nil
+	}
+	has, err := hasAddr(link, ip)
+	if err != nil {
+		return false, nil, err
+	}
+	if has {
+		return true, noop, nil
+	}
+	announce := func() {
+		go func() {
+			if err := acd.Announce(ifname, ip); err != nil {
+				log.Printf("announcing %v on %s: %v", ip, ifname, err)
+			}
+		}()
+	}
+	if !cfg.Refuse {
+		return true, announce, nil
+	}
+	c, err := acd.Probe(ifname, ip)
+	if err != nil {
+		// Not being able to probe (e.g. because the link is not up yet)
+		// must not leave the router without addresses.
+		log.Printf("probing %v on %s: %v", ip, ifname, err)
+		return true, announce, nil
+	}
+	if c != nil {
+		ReportConflict(*c)
+		return false, nil, nil
+	}
+	return true, announce, nil
+}
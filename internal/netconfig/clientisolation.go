@@ -0,0 +1,275 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/ruleset"
+	"github.com/rtr7/router7/internal/statefile"
+)
+
+// clientIsolationConfig is the client isolation configuration, stored in
+// clientisolation.json.
+type clientIsolationConfig struct {
+	// Interfaces are the interfaces (e.g. lan0) whose clients may not
+	// communicate with each other, only with the router and the internet.
+	// Bridged traffic is only isolated if the interface is a bridge (e.g.
+	// of several LAN ports or access points).
+	Interfaces []string `json:"interfaces"`
+
+	// Allow are the MAC addresses of shared devices (e.g. a printer or NAS)
+	// which all clients may communicate with, in addition to devices tagged
+	// isolation-exempt in the device registry.
+	Allow []string `json:"allow"`
+}
+
+// clientIsolation is the parsed clientisolation.json.
+type clientIsolation struct {
+	interfaces []string
+	hwaddrs    []net.HardwareAddr // allowed devices
+	addrs      []net.IP           // IPv4 addresses of allowed devices
+}
+
+// readClientIsolation returns the client isolation configured in
+// clientisolation.json, or nil if client isolation is not configured.
+func readClientIsolation(dir string, registry *devices.Registry) (*clientIsolation, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "clientisolation.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg clientIsolationConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Interfaces) == 0 {
+		return nil, nil
+	}
+	ci := &clientIsolation{interfaces: cfg.Interfaces}
+	allowed := make(map[string]bool)
+	for _, mac := range append(cfg.Allow, registry.Tagged(devices.TagIsolationExempt)...) {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("allow: %v", err)
+		}
+		if allowed[hwaddr.String()] {
+			continue
+		}
+		allowed[hwaddr.String()] = true
+		ci.hwaddrs = append(ci.hwaddrs, hwaddr)
+	}
+	sort.Slice(ci.hwaddrs, func(i, j int) bool {
+		return ci.hwaddrs[i].String() < ci.hwaddrs[j].String()
+	})
+	if len(allowed) == 0 {
+		return ci, nil
+	}
+
+	// Routed traffic can only be matched by IP address: look up the
+	// addresses of the allowed devices in the DHCPv4 leases.
+	b, err = ioutil.ReadFile(filepath.Join(dir, "dhcp4d/leases.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ci, nil
+		}
+		return nil, err
+	}
+	// Subset of dhcp4d.Lease (which cannot be imported: dhcp4d imports
+	// netconfig).
+	var leases []struct {
+		Addr         net.IP    `json:"addr"`
+		HardwareAddr string    `json:"hardware_addr"`
+		Expiry       time.Time `json:"expiry"`
+	}
+	if err := statefile.Leases4.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, l := range leases {
+		if !l.Expiry.IsZero() && now.After(l.Expiry) {
+			continue
+		}
+		hwaddr, err := net.ParseMAC(l.HardwareAddr)
+		if err != nil || !allowed[hwaddr.String()] {
+			continue
+		}
+		ip := l.Addr.To4()
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ci.addrs = append(ci.addrs, ip)
+	}
+	sort.Slice(ci.addrs, func(i, j int) bool {
+		return ci.addrs[i].String() < ci.addrs[j].String()
+	})
+	return ci, nil
+}
+
+// addClientIsolationBridge adds a bridge table to rs whose forward chain logs
+// and drops frames between ports of the isolated bridges, unless the frame is
+// from or to an allowed device.
+func addClientIsolationBridge(rs *ruleset.Ruleset, ci *clientIsolation) {
+	bridge := rs.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyBridge,
+		Name:   "filter",
+	})
+	forward := bridge.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Type:     nftables.ChainTypeFilter,
+	})
+	elements := make([]nftables.SetElement, 0, len(ci.hwaddrs))
+	for _, hwaddr := range ci.hwaddrs {
+		elements = append(elements, nftables.SetElement{Key: []byte(hwaddr)})
+	}
+	set := bridge.AddSet(&nftables.Set{
+		Name:    "isolation_allow",
+		KeyType: nftables.TypeEtherAddr,
+	}, elements)
+	for _, iface := range ci.interfaces {
+		forward.AddRule(clientIsolationBridgeExprs(iface, set))
+	}
+}
+
+func clientIsolationBridgeExprs(iface string, set *nftables.Set) []expr.Any {
+	return []expr.Any{
+		// [ meta load bri_iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyBRIIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(iface),
+		},
+		// [ payload load 6b @ link header + 6 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseLLHeader,
+			Offset:       6, // source address
+			Len:          6,
+		},
+		// [ lookup reg 1 set isolation_allow 0x1 ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+			Invert:         true,
+		},
+		// [ payload load 6b @ link header + 0 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseLLHeader,
+			Offset:       0, // destination address
+			Len:          6,
+		},
+		// [ lookup reg 1 set isolation_allow 0x1 ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+			Invert:         true,
+		},
+		logExpr("isolation"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+// addClientIsolationRouted adds rules to the forward chain of filter (an
+// IPv4 table) which log and drop traffic routed between clients of the same
+// isolated interface (e.g. from a secondary subnet), unless the traffic is
+// from or to an allowed device.
+func addClientIsolationRouted(filter *ruleset.Table, forward *ruleset.Chain, ci *clientIsolation) {
+	elements := make([]nftables.SetElement, 0, len(ci.addrs))
+	for _, addr := range ci.addrs {
+		elements = append(elements, nftables.SetElement{Key: []byte(addr)})
+	}
+	set := filter.AddSet(&nftables.Set{
+		Name:    "isolation_allow",
+		KeyType: nftables.TypeIPAddr,
+	}, elements)
+	for _, iface := range ci.interfaces {
+		forward.AddRule(clientIsolationRoutedExprs(iface, set))
+	}
+}
+
+func clientIsolationRoutedExprs(iface string, set *nftables.Set) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(iface),
+		},
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(iface),
+		},
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       12, // source address
+			Len:          net.IPv4len,
+		},
+		// [ lookup reg 1 set isolation_allow 0x1 ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+			Invert:         true,
+		},
+		// [ payload load 4b @ network header + 16 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       16, // destination address
+			Len:          net.IPv4len,
+		},
+		// [ lookup reg 1 set isolation_allow 0x1 ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+			Invert:         true,
+		},
+		logExpr("isolation"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rtr7/router7/internal/devices"
+)
+
+func TestReadClientIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ci, err := readClientIsolation(dir, &devices.Registry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci != nil {
+		t.Fatalf("client isolation unexpectedly enabled: %+v", ci)
+	}
+
+	for fn, content := range map[string]string{
+		"clientisolation.json": `{"interfaces": ["lan0"], "allow": ["00:1F:16:12:34:56"]}`,
+		"devices.json":         `{"devices": [{"hardware_addr": "00:1f:16:ab:cd:ef", "name": "nas", "tags": ["isolation-exempt"]}]}`,
+		"dhcp4d/leases.json": `[
+  {"addr": "192.168.42.23", "hardware_addr": "00:1f:16:12:34:56"},
+  {"addr": "192.168.42.42", "hardware_addr": "00:1f:16:ab:cd:ef"},
+  {"addr": "192.168.42.99", "hardware_addr": "00:1f:16:99:99:99"},
+  {"addr": "192.168.42.50", "hardware_addr": "00:1f:16:ab:cd:ef", "expiry": "2001-01-01T00:00:00Z"}
+]`,
+	} {
+		path := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry, err := devices.Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err = readClientIsolation(dir, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci == nil {
+		t.Fatalf("client isolation unexpectedly disabled")
+	}
+	if got, want := ci.interfaces, []string{"lan0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected interfaces: got %v, want %v", got, want)
+	}
+	var hwaddrs, addrs []string
+	for _, hwaddr := range ci.hwaddrs {
+		hwaddrs = append(hwaddrs, hwaddr.String())
+	}
+	for _, addr := range ci.addrs {
+		addrs = append(addrs, addr.String())
+	}
+	if want := []string{"00:1f:16:12:34:56", "00:1f:16:ab:cd:ef"}; !reflect.DeepEqual(hwaddrs, want) {
+		t.Errorf("unexpected allowed hardware addresses: got %v, want %v", hwaddrs, want)
+	}
+	if want := []string{"192.168.42.23", "192.168.42.42"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("unexpected allowed addresses: got %v, want %v", addrs, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/ruleset"
+)
+
+// Values of conntrackConfig.FlushOnChange.
+const (
+	flushOff      = "off"      // keep all entries (default)
+	flushAffected = "affected" // delete entries matching changed rules
+	flushAll      = "all"      // delete all entries
+)
+
+// conntrackConfig configures which connection tracking entries are deleted
+// when the firewall changes, stored in conntrack.json.
+//
+// Existing connections are not subject to changed NAT rules (e.g. a new port
+// forwarding) or rules matching new connections only, until their connection
+// tracking entry expires, which can take days for established TCP
+// connections.
+type conntrackConfig struct {
+	FlushOnChange string `json:"flush_on_change"`
+}
+
+func readConntrackConfig(dir string) (*conntrackConfig, error) {
+	cfg := &conntrackConfig{FlushOnChange: flushOff}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "conntrack.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.FlushOnChange {
+	case "", flushOff, flushAffected, flushAll:
+	default:
+		return nil, fmt.Errorf("unknown flush_on_change value %q, expected %q, %q or %q",
+			cfg.FlushOnChange, flushOff, flushAffected, flushAll)
+	}
+	return cfg, nil
+}
+
+// flushConntrack deletes the connection tracking entries which changes
+// affect, as configured in conntrack.json.
+func flushConntrack(cfg *conntrackConfig, changes []ruleset.Change) error {
+	var flows []ruleset.Flows
+	switch cfg.FlushOnChange {
+	case flushAffected:
+		flows = ruleset.AffectedFlows(changes)
+	case flushAll:
+		flows = []ruleset.Flows{{}}
+	}
+	var deleted uint
+	for _, f := range flows {
+		n, err := f.Delete()
+		deleted += n
+		if err != nil {
+			return fmt.Errorf("deleting conntrack entries (%v): %v", f, err)
+		}
+	}
+	if deleted > 0 {
+		log.Printf("conntrack: deleted %d entries affected by firewall changes", deleted)
+	}
+	return nil
+}
+
+// FlushConntrack deletes the connection tracking entries of connections from
+// or to addr, or all entries if addr is empty. It returns how many entries
+// were deleted.
+func FlushConntrack(addr string) (uint, error) {
+	if addr == "" {
+		return ruleset.Flows{}.Delete()
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IP address %q", addr)
+	}
+	family, bits := uint8(unix.AF_INET6), 8*net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		family, ip, bits = unix.AF_INET, ip4, 8*net.IPv4len
+	}
+	host := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	var total uint
+	for _, f := range []ruleset.Flows{
+		{Family: family, Src: host},
+		{Family: family, Dst: host},
+	} {
+		n, err := f.Delete()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
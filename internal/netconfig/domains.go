@@ -0,0 +1,117 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDomain is the local domain used unless domains.json configures a
+// different primary domain.
+const DefaultDomain = "lan"
+
+// DomainsConfig configures the local domains under which dnsd answers for the
+// hostnames of DHCP clients (e.g. nas.lan and nas.home.arpa), stored in
+// domains.json. dhcp4d advertises the primary domain (option 15) and all
+// domains as search list (option 119).
+type DomainsConfig struct {
+	// Primary is the domain used in reverse lookups (PTR records) and
+	// advertised as the clients’ domain name, e.g. “home.arpa”. Defaults
+	// to DefaultDomain.
+	Primary string `json:"primary"`
+
+	// Additional domains are served like Primary, e.g. “lan” and
+	// “internal” when migrating to a new primary domain.
+	Additional []string `json:"additional"`
+}
+
+// ReadDomains reads domains.json from dir. A missing file is treated like a
+// configuration with only DefaultDomain.
+func ReadDomains(dir string) (*DomainsConfig, error) {
+	fn := filepath.Join(dir, "domains.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &DomainsConfig{}, nil
+		}
+		return nil, err
+	}
+	var cfg DomainsConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if _, err := cfg.parse(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+// normalizeDomain returns domain in lower case, without leading or trailing
+// dots, or an error if domain is not a valid domain name.
+func normalizeDomain(domain string) (string, error) {
+	d := strings.ToLower(strings.Trim(domain, "."))
+	if d == "" || len(d) > 253 {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("invalid domain %q", domain)
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return "", fmt.Errorf("invalid domain %q: unexpected character %q", domain, r)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (c *DomainsConfig) parse() ([]string, error) {
+	primary := c.Primary
+	if primary == "" {
+		primary = DefaultDomain
+	}
+	domains := make([]string, 0, 1+len(c.Additional))
+	seen := make(map[string]bool)
+	for _, domain := range append([]string{primary}, c.Additional...) {
+		d, err := normalizeDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		if seen[d] {
+			return nil, fmt.Errorf("duplicate domain %q", d)
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// Domains returns the normalized (lower case, without trailing dot) domains,
+// starting with the primary domain.
+func (c *DomainsConfig) Domains() []string {
+	domains, err := c.parse()
+	if err != nil {
+		// ReadDomains validated the configuration already.
+		return []string{DefaultDomain}
+	}
+	return domains
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadDomains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := ReadDomains(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"lan"}, cfg.Domains()); diff != "" {
+		t.Errorf("default domains: diff (-want +got):\n%s", diff)
+	}
+
+	fn := filepath.Join(dir, "domains.json")
+	for _, invalid := range []string{
+		`{"primary": "home..arpa"}`,
+		`{"primary": "-lan"}`,
+		`{"primary": "home_arpa"}`,
+		`{"primary": "home.arpa", "additional": ["lan", "LAN."]}`,
+		`{"additional": ["lan"]}`,
+	} {
+		if err := ioutil.WriteFile(fn, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadDomains(dir); err == nil {
+			t.Errorf("ReadDomains(%s) unexpectedly succeeded", invalid)
+		}
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "primary": "Home.Arpa.",
+  "additional": ["lan", "internal"]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = ReadDomains(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"home.arpa", "lan", "internal"}
+	if diff := cmp.Diff(want, cfg.Domains()); diff != "" {
+		t.Errorf("Domains: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// defaultDoH are the addresses of well-known public resolvers which offer DNS
+// over HTTPS.
+var defaultDoH = []string{
+	"1.0.0.1/32",
+	"1.1.1.1/32",
+	"8.8.4.4/32",
+	"8.8.8.8/32",
+	"9.9.9.9/32",
+	"149.112.112.112/32",
+	"2001:4860:4860::8844/128",
+	"2001:4860:4860::8888/128",
+	"2606:4700:4700::1001/128",
+	"2606:4700:4700::1111/128",
+	"2620:fe::9/128",
+	"2620:fe::fe/128",
+}
+
+// forceDNSConfig configures whether LAN clients must use dnsd, stored in
+// forcedns.json.
+type forceDNSConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Block drops DNS traffic to external resolvers instead of redirecting
+	// it to dnsd. IPv6 DNS traffic is always dropped, as there is no IPv6
+	// NAT.
+	Block bool `json:"block"`
+
+	// BlockDoH drops HTTPS traffic to the DoH networks, so that clients
+	// fall back to plain DNS.
+	BlockDoH bool `json:"block_doh"`
+
+	// DoH are the networks of DNS over HTTPS resolvers, defaulting to
+	// well-known public resolvers.
+	DoH []string `json:"doh"`
+}
+
+// forceDNS is the parsed forcedns.json.
+type forceDNS struct {
+	block bool
+	dest  net.IP       // lan0 address, for redirecting
+	doh   []*net.IPNet // nil unless BlockDoH is set
+}
+
+// readForceDNS returns the parsed forcedns.json, or nil if forcing DNS
+// through dnsd is disabled.
+func readForceDNS(dir string) (*forceDNS, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "forcedns.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg forceDNSConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	f := &forceDNS{block: cfg.Block}
+	if !f.block {
+		f.dest, err = LinkAddress(dir, "lan0")
+		if err != nil {
+			return nil, err
+		}
+		if f.dest.To4() == nil {
+			return nil, fmt.Errorf("lan0 address %v is not an IPv4 address", f.dest)
+		}
+	}
+	if cfg.BlockDoH {
+		networks := cfg.DoH
+		if len(networks) == 0 {
+			networks = defaultDoH
+		}
+		for _, n := range networks {
+			_, ipnet, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("doh: %v", err)
+			}
+			f.doh = append(f.doh, ipnet)
+		}
+	}
+	return f, nil
+}
+
+// lanPortExprs returns expressions matching proto packets to port which
+// arrive on lan0.
+func lanPortExprs(proto uint8, port uint16) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("lan0"),
+		},
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 0x00000011 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{proto},
+		},
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // destination port
+			Len:          2,
+		},
+		// [ cmp eq reg 1 0x00003500 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(port),
+		},
+	}
+}
+
+// forceDNSRedirectExprs returns expressions for the nat prerouting chain which
+// redirect proto DNS traffic from lan0 to dest (the router).
+func forceDNSRedirectExprs(proto uint8, dest net.IP) []expr.Any {
+	return append(lanPortExprs(proto, 53),
+		// [ immediate reg 1 0x0100a8c0 ]
+		&expr.Immediate{
+			Register: 1,
+			Data:     dest.To4(),
+		},
+		// [ immediate reg 2 0x00003500 ]
+		&expr.Immediate{
+			Register: 2,
+			Data:     binaryutil.BigEndian.PutUint16(53),
+		},
+		// [ nat dnat ip addr_min reg 1 addr_max reg 0 proto_min reg 2 proto_max reg 0 ]
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	)
+}
+
+// forceDNSDropExprs returns expressions for the forward chain which log and
+// drop proto DNS traffic from lan0 to external resolvers.
+func forceDNSDropExprs(proto uint8) []expr.Any {
+	return append(lanPortExprs(proto, 53),
+		logExpr("forcedns"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
+
+// dohExprs returns expressions for the forward chain which log and drop proto
+// HTTPS traffic from lan0 to an address in set.
+func dohExprs(set *nftables.Set, proto uint8) []expr.Any {
+	offset, addrLen := uint32(16), uint32(net.IPv4len) // IPv4 destination address
+	if set.KeyType == nftables.TypeIP6Addr {
+		offset, addrLen = 24, net.IPv6len // IPv6 destination address
+	}
+	return append(lanPortExprs(proto, 443),
+		// [ payload load 4b @ network header + 16 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          addrLen,
+		},
+		// [ lookup reg 1 set doh 0x0 ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+		},
+		logExpr("forcedns"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadForceDNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := readForceDNS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Fatalf("forcing DNS unexpectedly enabled: %+v", f)
+	}
+
+	for fn, content := range map[string]string{
+		"forcedns.json":   `{"enabled": true, "block_doh": true}`,
+		"interfaces.json": `{"interfaces": [{"name": "lan0", "addr": "192.168.42.1/24"}]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err = readForceDNS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.block {
+		t.Errorf("block mode unexpectedly enabled")
+	}
+	if got, want := f.dest, net.ParseIP("192.168.42.1"); !got.Equal(want) {
+		t.Errorf("unexpected redirect destination: got %v, want %v", got, want)
+	}
+	if got, want := len(f.doh), len(defaultDoH); got != want {
+		t.Errorf("unexpected number of DoH networks: got %d, want %d", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "forcedns.json"), []byte(`{"enabled": true, "block": true, "block_doh": true, "doh": ["192.0.2.0/24"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err = readForceDNS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.block {
+		t.Errorf("block mode unexpectedly disabled")
+	}
+	if got, want := len(f.doh), 1; got != want {
+		t.Fatalf("unexpected number of DoH networks: got %d, want %d", got, want)
+	}
+	if got, want := f.doh[0].String(), "192.0.2.0/24"; got != want {
+		t.Errorf("unexpected DoH network: got %v, want %v", got, want)
+	}
+}
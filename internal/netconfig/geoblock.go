@@ -0,0 +1,225 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+
+	"github.com/rtr7/router7/internal/geoip"
+	"github.com/rtr7/router7/internal/ruleset"
+)
+
+type ipRange struct {
+	start, end net.IP // end is exclusive, nil means until the end of the address space
+}
+
+// nextIP returns the address following ip, or nil if ip is the last address.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil // overflow
+}
+
+// mergeRanges converts networks (of the same address family, with IP
+// addresses of the same length) into sorted, non-adjacent ranges, as required
+// by nftables interval sets.
+func mergeRanges(networks []*net.IPNet) []ipRange {
+	ranges := make([]ipRange, 0, len(networks))
+	for _, n := range networks {
+		last := make(net.IP, len(n.IP))
+		for i := range n.IP {
+			last[i] = n.IP[i] | ^n.Mask[i]
+		}
+		ranges = append(ranges, ipRange{start: n.IP.Mask(n.Mask), end: nextIP(last)})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	var merged []ipRange
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			prev := &merged[len(merged)-1]
+			if prev.end == nil {
+				break // previous range extends until the end
+			}
+			if bytes.Compare(r.start, prev.end) <= 0 {
+				if r.end == nil || bytes.Compare(r.end, prev.end) > 0 {
+					prev.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// addGeoblockSet adds an interval set named geoblock containing networks.
+func addGeoblockSet(table *ruleset.Table, networks []*net.IPNet) *nftables.Set {
+	return addNetworkSet(table, "geoblock", networks)
+}
+
+// addNetworkSet adds an interval set named name containing those networks
+// which match the address family of table.
+func addNetworkSet(table *ruleset.Table, name string, networks []*net.IPNet) *nftables.Set {
+	keyType, addrLen := nftables.TypeIPAddr, net.IPv4len
+	if table.Table.Family == nftables.TableFamilyIPv6 {
+		keyType, addrLen = nftables.TypeIP6Addr, net.IPv6len
+	}
+	var family []*net.IPNet
+	for _, n := range networks {
+		ip := n.IP.To4()
+		if addrLen == net.IPv6len {
+			if ip != nil {
+				continue // IPv4 network
+			}
+			ip = n.IP.To16()
+		}
+		if ip == nil {
+			continue // IPv6 network
+		}
+		mask := n.Mask
+		if len(mask) != addrLen {
+			mask = mask[len(mask)-addrLen:]
+		}
+		family = append(family, &net.IPNet{IP: ip, Mask: mask})
+	}
+	set := &nftables.Set{
+		Name:     name,
+		KeyType:  keyType,
+		Interval: true,
+	}
+	var elements []nftables.SetElement
+	ranges := mergeRanges(family)
+	if len(ranges) == 0 || !ranges[0].start.Equal(make(net.IP, addrLen)) {
+		// Interval sets must start with an interval end element covering the
+		// beginning of the address space.
+		elements = append(elements, nftables.SetElement{
+			Key:         make([]byte, addrLen),
+			IntervalEnd: true,
+		})
+	}
+	for _, r := range ranges {
+		elements = append(elements, nftables.SetElement{Key: r.start})
+		if r.end != nil {
+			elements = append(elements, nftables.SetElement{
+				Key:         r.end,
+				IntervalEnd: true,
+			})
+		}
+	}
+	return table.AddSet(set, elements)
+}
+
+// geoblockExprs returns expressions logging and dropping packets which arrive
+// on uplink0 from an address in set.
+func geoblockExprs(set *nftables.Set) []expr.Any {
+	offset, addrLen := uint32(12), uint32(net.IPv4len) // IPv4 source address
+	if set.KeyType == nftables.TypeIP6Addr {
+		offset, addrLen = 8, net.IPv6len // IPv6 source address
+	}
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("uplink0"),
+		},
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          addrLen,
+		},
+		// [ lookup reg 1 set geoblock ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+		},
+		logExpr("geoblock"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+// logOutboundExprs returns expressions logging new connections leaving via
+// uplink0, so that fwlogd can tag outbound flows by country.
+func logOutboundExprs() []expr.Any {
+	return []expr.Any{
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("uplink0"),
+		},
+		// [ ct load state => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		// [ bitwise reg 1 = (reg=1 & 0x00000008 ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW),
+			Xor:            []byte{0, 0, 0, 0},
+		},
+		// [ cmp neq reg 1 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     []byte{0, 0, 0, 0},
+		},
+		logExpr("outbound"),
+	}
+}
+
+// geoblockNetworks returns the configuration in geoblock.json and the networks
+// located in the blocked countries.
+func geoblockNetworks(dir string) (*geoip.BlockConfig, []*net.IPNet, error) {
+	cfg, err := geoip.ReadBlockConfig(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cfg.Countries) == 0 {
+		return cfg, nil, nil
+	}
+	db, err := geoip.Open(cfg.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+	networks, err := db.Networks(cfg.Countries)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, networks, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMergeRanges(t *testing.T) {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"198.51.100.0/25",
+		"192.0.2.0/24",
+		"198.51.100.128/25", // adjacent to 198.51.100.0/25
+		"198.51.100.64/26",  // contained in 198.51.100.0/25
+		"255.255.255.0/24",  // extends until the end
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks = append(networks, n)
+	}
+	got := mergeRanges(networks)
+	want := []struct{ start, end string }{
+		{"192.0.2.0", "192.0.3.0"},
+		{"198.51.100.0", "198.51.101.0"},
+		{"255.255.255.0", "<nil>"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("mergeRanges: got %d ranges (%v), want %d", len(got), got, len(want))
+	}
+	for i, r := range got {
+		if r.start.String() != want[i].start || r.end.String() != want[i].end {
+			t.Errorf("range %d: got [%v, %v), want [%s, %s)", i, r.start, r.end, want[i].start, want[i].end)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/radvd"
+)
+
+// guestNetwork is the IPv6 configuration of the guest interface, as
+// configured in radvd.json.
+type guestNetwork struct {
+	ifname string
+	prefix *net.IPNet // unique local address /64 prefix
+	nat66  net.IP     // nil unless NAT66 is enabled and a prefix was delegated
+}
+
+// readGuestNetwork returns the guest network configured in radvd.json, or nil
+// if none is configured.
+func readGuestNetwork(dir string) (*guestNetwork, error) {
+	cfg, err := radvd.ReadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := cfg.GuestPrefix()
+	if err != nil {
+		return nil, fmt.Errorf("radvd.json: %v", err)
+	}
+	if prefix == nil {
+		return nil, nil
+	}
+	g := &guestNetwork{
+		ifname: cfg.Guest.Interface,
+		prefix: prefix,
+	}
+	if !cfg.Guest.NAT66 {
+		return g, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return g, nil // dhcp6 might not have obtained a lease yet
+		}
+		return nil, err
+	}
+	var lease dhcp6.Config
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, fmt.Errorf("dhcp6/wire/lease.json: %v", err)
+	}
+	if len(lease.Prefixes) > 0 {
+		// The lan0 address, see applyDhcp6.
+		addr := make(net.IP, net.IPv6len)
+		copy(addr, lease.Prefixes[0].IP.To16())
+		addr[len(addr)-1] = 1
+		g.nat66 = addr
+	}
+	return g, nil
+}
+
+func applyGuest(dir string) error {
+	g, err := readGuestNetwork(dir)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		return nil
+	}
+	return applyGuestAddress(g)
+}
+
+// applyGuestAddress configures the first address of the guest prefix on the
+// guest interface, e.g. fd12:3456:789a:1::1/64.
+func applyGuestAddress(g *guestNetwork) error {
+	link, err := netlink.LinkByName(g.ifname)
+	if err != nil {
+		return err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, g.prefix.IP)
+	ip[len(ip)-1] = 1
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: g.prefix.Mask}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+	}
+	return nil
+}
+
+// guestSourceExprs returns expressions matching packets from the guest prefix
+// which leave via uplink0.
+func guestSourceExprs(g *guestNetwork) []expr.Any {
+	return []expr.Any{
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("uplink0"),
+		},
+		// [ payload load 8b @ network header + 8 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       8, // IPv6 source address
+			Len:          8, // the guest prefix is a /64
+		},
+		// [ cmp eq reg 1 0x563412fd 0x01009a78 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte(g.prefix.IP.To16()[:8]),
+		},
+	}
+}
+
+// nat66Exprs returns expressions for the ip6 nat postrouting chain which
+// translate guest traffic to g.nat66.
+func nat66Exprs(g *guestNetwork) []expr.Any {
+	return append(guestSourceExprs(g),
+		// [ immediate reg 1 0x... ]
+		&expr.Immediate{
+			Register: 1,
+			Data:     []byte(g.nat66),
+		},
+		// [ nat snat ip6 addr_min reg 1 addr_max reg 0 ]
+		&expr.NAT{
+			Type:       expr.NATTypeSourceNAT,
+			Family:     unix.NFPROTO_IPV6,
+			RegAddrMin: 1,
+		},
+	)
+}
+
+// guestULAOnlyExprs returns expressions for the ip6 filter forward chain
+// which log and drop guest traffic to the internet, which cannot be routed
+// from a ULA source address anyway.
+func guestULAOnlyExprs(g *guestNetwork) []expr.Any {
+	return append(guestSourceExprs(g),
+		logExpr("guest"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
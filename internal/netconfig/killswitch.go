@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/rtr7/router7/internal/killswitch"
+)
+
+// killswitchExprs returns rules for the forward chain of table which cut the
+// internet access of c. Clients identified by IP address only result in rules
+// in the table of the corresponding address family.
+func killswitchExprs(table *nftables.Table, c *killswitch.Client) [][]expr.Any {
+	if c.HardwareAddr != "" {
+		hwaddr, err := net.ParseMAC(c.HardwareAddr)
+		if err != nil {
+			return nil // verified by killswitch.Parse
+		}
+		return [][]expr.Any{dropHardwareAddrExprs(hwaddr, "killswitch")}
+	}
+	ip := net.ParseIP(c.Addr)
+	if ip == nil {
+		return nil // verified by killswitch.Parse
+	}
+	saddr, daddr, addrLen := uint32(12), uint32(16), uint32(net.IPv4len)
+	if ip4 := ip.To4(); ip4 != nil {
+		if table.Family != nftables.TableFamilyIPv4 {
+			return nil
+		}
+		ip = ip4
+	} else {
+		if table.Family != nftables.TableFamilyIPv6 {
+			return nil
+		}
+		saddr, daddr, addrLen = 8, 24, net.IPv6len
+	}
+	var rules [][]expr.Any
+	for _, offset := range []uint32{saddr, daddr} {
+		rules = append(rules, []expr.Any{
+			// [ payload load 4b @ network header + 12 => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       offset,
+				Len:          addrLen,
+			},
+			// [ cmp eq reg 1 0x172aa8c0 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte(ip),
+			},
+			logExpr("killswitch"),
+			// [ immediate reg 0 drop ]
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		})
+	}
+	return rules
+}
+
+func activeKillswitchClients(dir string) ([]*killswitch.Client, error) {
+	state, err := killswitch.Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	return state.Active(time.Now()), nil
+}
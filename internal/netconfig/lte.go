@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/lte"
+)
+
+// lteBackupMetric is the metric of the LTE default route while uplink0 works:
+// the uplink0 default route (metric 0) takes precedence.
+const lteBackupMetric = 1024
+
+// lteFailoverRoutes cover the entire IPv4 address space, but take precedence
+// over the uplink0 default route (longest prefix match). Unlike replacing the
+// uplink0 default route, this allows lted to keep probing via uplink0.
+var lteFailoverRoutes = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0), Mask: net.CIDRMask(1, 32)},
+}
+
+// applyLTE configures the connection which lted established (if any) and
+// routes traffic via LTE while the lease is active.
+func applyLTE(dir string) error {
+	l, err := lte.ReadLease(dir)
+	if err != nil || l == nil {
+		return err
+	}
+	link, err := netlink.LinkByName(l.Interface)
+	if err != nil {
+		return err
+	}
+	if l.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, l.MTU); err != nil {
+			return fmt.Errorf("LinkSetMTU(%s): %v", l.Interface, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("LinkSetUp(%s): %v", l.Interface, err)
+	}
+	addr, err := netlink.ParseAddr(l.Addr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+	}
+	gw := net.ParseIP(l.Gateway)
+	if err := netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(0, 32)},
+		Gw:        gw,
+		Src:       addr.IP,
+		Priority:  lteBackupMetric,
+	}); err != nil {
+		return fmt.Errorf("RouteReplace(default): %v", err)
+	}
+	for _, dst := range lteFailoverRoutes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Gw:        gw,
+			Src:       addr.IP,
+		}
+		if l.Active {
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("RouteReplace(%v): %v", dst, err)
+			}
+			continue
+		}
+		if err := netlink.RouteDel(route); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("RouteDel(%v): %v", dst, err)
+		}
+	}
+	return nil
+}
+
+// lteInterface returns the network interface of the LTE connection, or the
+// empty string if lted has not established a connection.
+func lteInterface(dir string) (string, error) {
+	l, err := lte.ReadLease(dir)
+	if err != nil || l == nil {
+		return "", err
+	}
+	return l.Interface, nil
+}
+
+// masqExprs returns expressions masquerading all traffic leaving via the
+// specified uplink interface.
+func masqExprs(uplink string) []expr.Any {
+	return []expr.Any{
+		// meta load oifname => reg 1
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(uplink),
+		},
+		// masq
+		&expr.Masq{},
+	}
+}
@@ -34,9 +34,14 @@ import (
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
+	"github.com/rtr7/router7/internal/devices"
 	"github.com/rtr7/router7/internal/dhcp4"
 	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/fwlog"
+	"github.com/rtr7/router7/internal/nfqueue"
 	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/rogue"
+	"github.com/rtr7/router7/internal/ruleset"
 	"github.com/rtr7/router7/internal/teelogger"
 )
 
@@ -60,16 +65,12 @@ func subnetMaskSize(mask string) (int, error) {
 }
 
 func applyDhcp4(dir string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4/wire/lease.json"))
+	got, err := dhcp4.ReadAccepted(dir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // dhcp4 might not have obtained a lease yet
-		}
 		return err
 	}
-	var got dhcp4.Config
-	if err := json.Unmarshal(b, &got); err != nil {
-		return err
+	if got == nil {
+		return nil // dhcp4 might not have obtained a lease yet
 	}
 
 	link, err := netlink.LinkByName("uplink0")
@@ -96,9 +97,24 @@ func applyDhcp4(dir string) error {
 		return fmt.Errorf("netlink.NewHandle: %v", err)
 	}
 	defer h.Delete()
+	ok, assigned, err := claimAddr(dir, link, addr.IP)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Printf("not assigning conflicting DHCP address %v", addr)
+		return nil
+	}
 	if err := h.AddrReplace(link, addr); err != nil {
 		return fmt.Errorf("AddrReplace(%v): %v", addr, err)
 	}
+	assigned()
+
+	if got.MTU != 0 && got.MTU != link.Attrs().MTU {
+		if err := h.LinkSetMTU(link, got.MTU); err != nil {
+			return fmt.Errorf("LinkSetMTU(%d): %v", got.MTU, err)
+		}
+	}
 
 	// from include/uapi/linux/rtnetlink.h
 	const (
@@ -106,6 +122,22 @@ func applyDhcp4(dir string) error {
 		RTPROT_DHCP   = 16
 	)
 
+	if got.Router == "" {
+		// The policy does not accept the default route of the lease: remove
+		// the one installed before the policy was changed, if any.
+		if err := h.RouteDel(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   net.ParseIP("0.0.0.0"),
+				Mask: net.CIDRMask(0, 32),
+			},
+			Protocol: RTPROT_DHCP,
+		}); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("RouteDel(default): %v", err)
+		}
+		return nil
+	}
+
 	if err := h.RouteReplace(&netlink.Route{
 		LinkIndex: link.Attrs().Index,
 		Dst: &net.IPNet{
@@ -148,6 +180,29 @@ func applyDhcp6(dir string) error {
 		return err
 	}
 
+	// Networks (networks.json) use further /64 subnets of the prefix.
+	networks, err := ReadNetworks(dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		prefixes := n.IPv6Prefixes(got.Prefixes)
+		if len(prefixes) == 0 {
+			continue
+		}
+		link, err := netlink.LinkByName(n.Name)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			prefix.IP[len(prefix.IP)-1] = 1
+			addr := &netlink.Addr{IPNet: &prefix}
+			if err := netlink.AddrReplace(link, addr); err != nil {
+				return fmt.Errorf("AddrReplace(%s, %v): %v", n.Name, addr, err)
+			}
+		}
+	}
+
 	link, err := netlink.LinkByName("lan0")
 	if err != nil {
 		return err
@@ -178,6 +233,14 @@ type InterfaceDetails struct {
 	SpoofHardwareAddr string `json:"spoof_hardware_addr"` // e.g. dc:9b:9c:ee:72:fd
 	Name              string `json:"name"`                // e.g. uplink0, or lan0
 	Addr              string `json:"addr"`                // e.g. 192.168.42.1/24
+
+	// Type is empty for physical network cards, or “macvlan”, “veth” or
+	// “vlan” for virtual interfaces which netconfigd creates, see virtual.go.
+	Type   string `json:"type"`
+	Parent string `json:"parent"` // macvlan, vlan: e.g. lan0
+	Peer   string `json:"peer"`   // veth: name of the peer, e.g. ct0
+	VLAN   int    `json:"vlan"`   // vlan: 802.1Q VLAN ID, e.g. 10
+	Zone   string `json:"zone"`   // “lan” (default) or “isolated”
 }
 
 type InterfaceConfig struct {
@@ -185,17 +248,13 @@ type InterfaceConfig struct {
 }
 
 // Interface returns the InterfaceDetails configured for interface ifname in
-// interfaces.json.
+// interfaces.json, or derived from networks.json.
 func Interface(dir, ifname string) (InterfaceDetails, error) {
 	fn := filepath.Join(dir, "interfaces.json")
-	b, err := ioutil.ReadFile(fn)
+	cfg, err := readInterfaceConfig(dir)
 	if err != nil {
 		return InterfaceDetails{}, err
 	}
-	var cfg InterfaceConfig
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return InterfaceDetails{}, err
-	}
 	for _, details := range cfg.Interfaces {
 		if details.Name != ifname {
 			continue
@@ -217,14 +276,10 @@ func LinkAddress(dir, ifname string) (net.IP, error) {
 }
 
 func applyInterfaces(dir, root string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	cfg, err := readInterfaceConfig(dir)
 	if err != nil {
 		return err
 	}
-	var cfg InterfaceConfig
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return err
-	}
 	byName := make(map[string]InterfaceDetails)
 	byHardwareAddr := make(map[string]InterfaceDetails)
 	for _, details := range cfg.Interfaces {
@@ -234,6 +289,9 @@ func applyInterfaces(dir, root string) error {
 		}
 		byName[details.Name] = details
 	}
+	if err := createVirtualInterfaces(cfg.Interfaces); err != nil {
+		return err
+	}
 	links, err := netlink.LinkList()
 	for _, l := range links {
 		attr := l.Attrs()
@@ -245,7 +303,10 @@ func applyInterfaces(dir, root string) error {
 			ok      bool
 		)
 		addr := attr.HardwareAddr.String()
-		if addr == "" {
+		if d, exists := byName[attr.Name]; exists && d.Type != "" {
+			// Virtual interfaces are created under their configured name.
+			details, ok = d, true
+		} else if addr == "" {
 			details, ok = byName[attr.Name]
 			if !ok {
 				continue // not a configurable interface (e.g. sit0)
@@ -288,9 +349,19 @@ func applyInterfaces(dir, root string) error {
 				return fmt.Errorf("ParseAddr(%q): %v", details.Addr, err)
 			}
 
+			ok, assigned, err := claimAddr(dir, l, addr.IP)
+			if err != nil {
+				return fmt.Errorf("claimAddr(%s, %v): %v", attr.Name, addr, err)
+			}
+			if !ok {
+				log.Printf("not assigning conflicting address %v to %s", addr, attr.Name)
+				continue
+			}
+
 			if err := netlink.AddrReplace(l, addr); err != nil {
 				return fmt.Errorf("AddrReplace(%s, %v): %v", attr.Name, addr, err)
 			}
+			assigned()
 
 			if details.Name == "lan0" {
 				b := []byte("nameserver " + addr.IP.String() + "\n")
@@ -415,15 +486,17 @@ func portForwardExpr(proto uint8, portMin, portMax uint16, dest net.IP, dportMin
 	return ex
 }
 
-type portForwarding struct {
+// PortForwarding is a port forwarding rule, configured in portforwardings.json.
+type PortForwarding struct {
 	Proto    string `json:"proto"`     // e.g. “tcp” (or “tcp,udp”)
 	Port     string `json:"port"`      // e.g. “8080” (or “8080-8090”)
 	DestAddr string `json:"dest_addr"` // e.g. “192.168.42.2”
 	DestPort string `json:"dest_port"` // e.g. “80” (or “80-90”)
 }
 
-type portForwardings struct {
-	Forwardings []portForwarding `json:"forwardings"`
+// PortForwardings is the contents of portforwardings.json.
+type PortForwardings struct {
+	Forwardings []PortForwarding `json:"forwardings"`
 }
 
 var rangeRe = regexp.MustCompile(`^([0-9]+)(?:-([0-9]+))?$`)
@@ -447,7 +520,7 @@ func parsePort(p string) (min uint16, max uint16, _ error) {
 	return uint16(min64), uint16(max64), nil
 }
 
-func applyPortForwardings(dir string, c *nftables.Conn, nat *nftables.Table, prerouting *nftables.Chain) error {
+func applyPortForwardings(dir string, prerouting *ruleset.Chain) error {
 	b, err := ioutil.ReadFile(filepath.Join(dir, "portforwardings.json"))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -455,7 +528,7 @@ func applyPortForwardings(dir string, c *nftables.Conn, nat *nftables.Table, pre
 		}
 		return err
 	}
-	var cfg portForwardings
+	var cfg PortForwardings
 	if err := json.Unmarshal(b, &cfg); err != nil {
 		return err
 	}
@@ -481,211 +554,441 @@ func applyPortForwardings(dir string, c *nftables.Conn, nat *nftables.Table, pre
 				return err
 			}
 
-			c.AddRule(&nftables.Rule{
-				Table: nat,
-				Chain: prerouting,
-				Exprs: portForwardExpr(p, min, max, net.ParseIP(fw.DestAddr), dmin, dmax),
-			})
+			prerouting.AddRule(portForwardExpr(p, min, max, net.ParseIP(fw.DestAddr), dmin, dmax))
 		}
 	}
 	return nil
 }
 
-// DefaultCounterObj is overridden while testing
+// DefaultCounterObj holds the initial values of newly created counters. It is
+// overridden while testing.
 var DefaultCounterObj = &nftables.CounterObj{}
 
-func getCounterObj(c *nftables.Conn, o *nftables.CounterObj) *nftables.CounterObj {
-	objs, err := c.GetObj(o)
-	if err != nil {
-		o.Bytes = DefaultCounterObj.Bytes
-		o.Packets = DefaultCounterObj.Packets
-		return o
-	}
-	{
-		// TODO: remove this workaround once travis has workers with a newer kernel
-		// than its current Ubuntu trusty kernel (Linux 4.4.0):
-		var filtered []nftables.Obj
-		for _, obj := range objs {
-			co, ok := obj.(*nftables.CounterObj)
-			if !ok {
-				continue
-			}
-			if co.Table.Name != o.Table.Name {
-				continue
-			}
-			filtered = append(filtered, obj)
-		}
-		objs = filtered
+// counterObj returns a counter named name. Counters which already exist retain
+// their values, see ruleset.Table.AddCounter.
+func counterObj(name string) *nftables.CounterObj {
+	return &nftables.CounterObj{
+		Name:    name,
+		Bytes:   DefaultCounterObj.Bytes,
+		Packets: DefaultCounterObj.Packets,
 	}
-	if got, want := len(objs), 1; got != want {
-		log.Printf("could not carry counter values: unexpected number of objects in table %v: got %d, want %d", o.Table.Name, got, want)
-		o.Bytes = DefaultCounterObj.Bytes
-		o.Packets = DefaultCounterObj.Packets
-		return o
+}
+
+// logExpr returns an expression which sends packets to fwlogd, which uses rule
+// to attribute them.
+func logExpr(rule string) expr.Any {
+	// [ log prefix rogue group 7 snaplen 0 qthreshold 0 ]
+	return &expr.Log{
+		Key:   1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX,
+		Group: fwlog.Group,
+		Data:  []byte(rule),
 	}
-	if co, ok := objs[0].(*nftables.CounterObj); ok {
-		return co
+}
+
+// dropHardwareAddrExprs returns expressions logging (as rule) and dropping all
+// packets which arrive on lan0 from the specified MAC address.
+func dropHardwareAddrExprs(hwaddr net.HardwareAddr, rule string) []expr.Any {
+	return append(lanHardwareAddrExprs(hwaddr),
+		logExpr(rule),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop})
+}
+
+// lanHardwareAddrExprs returns expressions matching packets which arrive on
+// lan0 from the specified MAC address.
+func lanHardwareAddrExprs(hwaddr net.HardwareAddr) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("lan0"),
+		},
+		// [ payload load 6b @ link header + 6 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseLLHeader,
+			Offset:       6, // source address
+			Len:          6,
+		},
+		// [ cmp eq reg 1 0x00000002 0x00002300 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte(hwaddr),
+		},
 	}
-	o.Bytes = DefaultCounterObj.Bytes
-	o.Packets = DefaultCounterObj.Packets
-	return o
 }
 
 func applyFirewall(dir string) error {
-	c := &nftables.Conn{}
+	blocked, err := rogue.ReadBlocked(dir)
+	if err != nil {
+		return err
+	}
+	var blockedAddrs []net.HardwareAddr
+	for _, mac := range blocked.HardwareAddrs {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("rogued/blocked.json: %v", err)
+		}
+		blockedAddrs = append(blockedAddrs, hwaddr)
+	}
+	geoblock, geoblocked, err := geoblockNetworks(dir)
+	if err != nil {
+		return fmt.Errorf("geoblock: %v", err)
+	}
+	killed, err := activeKillswitchClients(dir)
+	if err != nil {
+		return fmt.Errorf("killswitch.json: %v", err)
+	}
+	registry, err := devices.Read(dir)
+	if err != nil {
+		return err
+	}
+	clientIsolation, err := readClientIsolation(dir, registry)
+	if err != nil {
+		return fmt.Errorf("clientisolation.json: %v", err)
+	}
+	var noInternet []net.HardwareAddr
+	for _, mac := range registry.Tagged(devices.TagNoInternet) {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return err
+		}
+		noInternet = append(noInternet, hwaddr)
+	}
+	queueCfg, err := nfqueue.ReadConfig(dir)
+	if err != nil {
+		return err
+	}
+	var queueRules [][]expr.Any
+	for _, r := range queueCfg.Rules {
+		exprs, err := queueExprs(r)
+		if err != nil {
+			return fmt.Errorf("nfqueue.json: %v", err)
+		}
+		queueRules = append(queueRules, exprs)
+	}
+	accounted, err := accountingAddrs(dir, registry.HasQuotas())
+	if err != nil {
+		return fmt.Errorf("accounting: %v", err)
+	}
+	exceeded, err := exceededQuotas(dir)
+	if err != nil {
+		return fmt.Errorf("quota: %v", err)
+	}
+	savi, err := saviPrefixes(dir)
+	if err != nil {
+		return fmt.Errorf("savi: %v", err)
+	}
+	forceDNS, err := readForceDNS(dir)
+	if err != nil {
+		return fmt.Errorf("forcedns.json: %v", err)
+	}
+	guest, err := readGuestNetwork(dir)
+	if err != nil {
+		return fmt.Errorf("guest: %v", err)
+	}
+	isolated, err := isolatedInterfaces(dir)
+	if err != nil {
+		return fmt.Errorf("interfaces.json: %v", err)
+	}
+	conntrackCfg, err := readConntrackConfig(dir)
+	if err != nil {
+		return fmt.Errorf("conntrack.json: %v", err)
+	}
+	svc, err := readServices(dir)
+	if err != nil {
+		return fmt.Errorf("services: %v", err)
+	}
+	npt, err := readNPTv6(dir)
+	if err != nil {
+		return fmt.Errorf("nptv6: %v", err)
+	}
+	lteIface, err := lteInterface(dir)
+	if err != nil {
+		return fmt.Errorf("lte: %v", err)
+	}
 
-	c.FlushRuleset()
+	rs := &ruleset.Ruleset{}
 
-	nat := c.AddTable(&nftables.Table{
+	nat := rs.AddTable(&nftables.Table{
 		Family: nftables.TableFamilyIPv4,
 		Name:   "nat",
 	})
 
-	prerouting := c.AddChain(&nftables.Chain{
+	prerouting := nat.AddChain(&nftables.Chain{
 		Name:     "prerouting",
 		Hooknum:  nftables.ChainHookPrerouting,
 		Priority: nftables.ChainPriorityFilter,
-		Table:    nat,
 		Type:     nftables.ChainTypeNAT,
 	})
 
-	postrouting := c.AddChain(&nftables.Chain{
+	postrouting := nat.AddChain(&nftables.Chain{
 		Name:     "postrouting",
 		Hooknum:  nftables.ChainHookPostrouting,
 		Priority: nftables.ChainPriorityNATSource,
-		Table:    nat,
 		Type:     nftables.ChainTypeNAT,
 	})
 
-	c.AddRule(&nftables.Rule{
-		Table: nat,
-		Chain: postrouting,
-		Exprs: []expr.Any{
-			// meta load oifname => reg 1
-			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-			// cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     ifname("uplink0"),
-			},
-			// masq
-			&expr.Masq{},
-		},
-	})
+	postrouting.AddRule(masqExprs("uplink0"))
+
+	if lteIface != "" {
+		postrouting.AddRule(masqExprs(lteIface))
+	}
 
-	if err := applyPortForwardings(dir, c, nat, prerouting); err != nil {
+	if err := applyPortForwardings(dir, prerouting); err != nil {
 		return err
 	}
 
-	filter4 := c.AddTable(&nftables.Table{
+	// Redirect DNS queries of LAN clients with hardcoded resolvers to dnsd.
+	if forceDNS != nil && !forceDNS.block {
+		for _, proto := range []uint8{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+			prerouting.AddRule(forceDNSRedirectExprs(proto, forceDNS.dest))
+		}
+	}
+
+	// Guests reach the internet via router7’s address within the delegated
+	// prefix, so that they never see the delegated prefix itself.
+	if guest != nil && guest.nat66 != nil {
+		nat6 := rs.AddTable(&nftables.Table{
+			Family: nftables.TableFamilyIPv6,
+			Name:   "nat",
+		})
+		postrouting6 := nat6.AddChain(&nftables.Chain{
+			Name:     "postrouting",
+			Hooknum:  nftables.ChainHookPostrouting,
+			Priority: nftables.ChainPriorityNATSource,
+			Type:     nftables.ChainTypeNAT,
+		})
+		postrouting6.AddRule(nat66Exprs(guest))
+	}
+
+	if npt != nil {
+		addNPTv6(rs, npt)
+	}
+
+	filter4 := rs.AddTable(&nftables.Table{
 		Family: nftables.TableFamilyIPv4,
 		Name:   "filter",
 	})
 
-	filter6 := c.AddTable(&nftables.Table{
+	filter6 := rs.AddTable(&nftables.Table{
 		Family: nftables.TableFamilyIPv6,
 		Name:   "filter",
 	})
 
-	for _, filter := range []*nftables.Table{filter4, filter6} {
-		forward := c.AddChain(&nftables.Chain{
+	for _, filter := range []*ruleset.Table{filter4, filter6} {
+		forward := filter.AddChain(&nftables.Chain{
 			Name:     "forward",
 			Hooknum:  nftables.ChainHookForward,
 			Priority: nftables.ChainPriorityFilter,
-			Table:    filter,
 			Type:     nftables.ChainTypeFilter,
 		})
 
-		c.AddRule(&nftables.Rule{
-			Table: filter,
-			Chain: forward,
-			Exprs: []expr.Any{
-				// [ meta load oifname => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-				// [ cmp eq reg 1 0x30707070 0x00000000 0x00000000 0x00000000 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     ifname("uplink0"),
-				},
-
-				// [ meta load l4proto => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				// [ cmp eq reg 1 0x00000006 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     []byte{unix.IPPROTO_TCP},
-				},
-
-				// [ payload load 1b @ transport header + 13 => reg 1 ]
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseTransportHeader,
-					Offset:       13, // TODO
-					Len:          1,  // TODO
-				},
-				// [ bitwise reg 1 = (reg=1 & 0x00000002 ) ^ 0x00000000 ]
-				&expr.Bitwise{
-					DestRegister:   1,
-					SourceRegister: 1,
-					Len:            1,
-					Mask:           []byte{0x02},
-					Xor:            []byte{0x00},
-				},
-				// [ cmp neq reg 1 0x00000000 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpNeq,
-					Register: 1,
-					Data:     []byte{0x00},
-				},
-
-				// [ rt load tcpmss => reg 1 ]
-				&expr.Rt{
-					Register: 1,
-					Key:      expr.RtTCPMSS,
-				},
-				// [ byteorder reg 1 = hton(reg 1, 2, 2) ]
-				&expr.Byteorder{
-					DestRegister:   1,
-					SourceRegister: 1,
-					Op:             expr.ByteorderHton,
-					Len:            2,
-					Size:           2,
-				},
-				// [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
-				&expr.Exthdr{
-					SourceRegister: 1,
-					Type:           2, // TODO
-					Offset:         2,
-					Len:            2,
-					Op:             expr.ExthdrOpTcpopt,
-				},
+		// The input chain is only created when needed, so that the default
+		// ruleset remains minimal.
+		var input *ruleset.Chain
+		inputChain := func() *ruleset.Chain {
+			if input == nil {
+				input = filter.AddChain(&nftables.Chain{
+					Name:     "input",
+					Hooknum:  nftables.ChainHookInput,
+					Priority: nftables.ChainPriorityFilter,
+					Type:     nftables.ChainTypeFilter,
+				})
+			}
+			return input
+		}
+
+		// Offenders detected by rogued can neither reach the router itself
+		// nor the internet.
+		for _, hwaddr := range blockedAddrs {
+			for _, chain := range []*ruleset.Chain{inputChain(), forward} {
+				chain.AddRule(dropHardwareAddrExprs(hwaddr, "rogue"))
+			}
+		}
+
+		// With source address validation enabled, LAN clients may only
+		// forward IPv6 traffic from the current prefixes, so that stale
+		// addresses (e.g. after a prefix change) do not leak.
+		if filter == filter6 && savi != nil {
+			set := addNetworkSet(filter, "savi", savi)
+			forward.AddRule(saviExprs(set))
+		}
+
+		// Clients whose internet access was cut via the kill switch can still
+		// reach the router itself (e.g. for DHCP and DNS).
+		for _, client := range killed {
+			for _, exprs := range killswitchExprs(filter.Table, client) {
+				forward.AddRule(exprs)
+			}
+		}
+
+		// Devices (or groups) tagged no-internet in the device registry.
+		for _, hwaddr := range noInternet {
+			forward.AddRule(dropHardwareAddrExprs(hwaddr, "devices"))
+		}
+
+		// Devices which exceeded their quota are blocked or throttled until
+		// the quota is reset.
+		for _, e := range exceeded {
+			for _, exprs := range quotaExprs(filter.Table, e) {
+				forward.AddRule(exprs)
+			}
+		}
+
+		// Isolated interfaces (e.g. containers) may only initiate
+		// connections to the internet.
+		for _, iface := range isolated {
+			forward.AddRule(isolatedExprs(iface))
+		}
+
+		// Clients of interfaces with client isolation may not communicate
+		// with each other, except with allowed devices (e.g. a printer).
+		if filter == filter4 && clientIsolation != nil {
+			addClientIsolationRouted(filter, forward, clientIsolation)
+		}
+
+		if filter == filter4 && svc != nil {
+			addServices(filter, forward, svc)
+		}
+
+		if filter == filter6 && guest != nil && guest.nat66 == nil {
+			forward.AddRule(guestULAOnlyExprs(guest))
+		}
+
+		// DNS traffic which was not redirected to dnsd (IPv6, or all traffic
+		// in block mode) must not reach external resolvers.
+		if forceDNS != nil && (forceDNS.block || filter == filter6) {
+			for _, proto := range []uint8{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+				forward.AddRule(forceDNSDropExprs(proto))
+			}
+		}
+		if forceDNS != nil && len(forceDNS.doh) > 0 {
+			set := addNetworkSet(filter, "doh", forceDNS.doh)
+			for _, proto := range []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP} { // UDP: HTTP/3
+				forward.AddRule(dohExprs(set, proto))
+			}
+		}
+
+		if len(geoblocked) > 0 {
+			set := addGeoblockSet(filter, geoblocked)
+			for _, chain := range []*ruleset.Chain{inputChain(), forward} {
+				chain.AddRule(geoblockExprs(set))
+			}
+		}
+
+		if geoblock.LogOutbound {
+			forward.AddRule(logOutboundExprs())
+		}
+
+		// Packets which nfqueued judges (e.g. for intrusion detection) are
+		// queued after the drop rules above, so that blocked traffic never
+		// reaches a judge.
+		for _, exprs := range queueRules {
+			for _, chain := range []*ruleset.Chain{inputChain(), forward} {
+				chain.AddRule(exprs)
+			}
+		}
+
+		if filter == filter4 {
+			addAccounting(filter, forward, accounted)
+		}
+
+		forward.AddRule([]expr.Any{
+			// [ meta load oifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			// [ cmp eq reg 1 0x30707070 0x00000000 0x00000000 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     ifname("uplink0"),
+			},
+
+			// [ meta load l4proto => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			// [ cmp eq reg 1 0x00000006 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{unix.IPPROTO_TCP},
+			},
+
+			// [ payload load 1b @ transport header + 13 => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       13, // TODO
+				Len:          1,  // TODO
+			},
+			// [ bitwise reg 1 = (reg=1 & 0x00000002 ) ^ 0x00000000 ]
+			&expr.Bitwise{
+				DestRegister:   1,
+				SourceRegister: 1,
+				Len:            1,
+				Mask:           []byte{0x02},
+				Xor:            []byte{0x00},
+			},
+			// [ cmp neq reg 1 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     []byte{0x00},
 			},
-		})
 
-		counterObj := getCounterObj(c, &nftables.CounterObj{
-			Table: filter,
-			Name:  "fwded",
+			// [ rt load tcpmss => reg 1 ]
+			&expr.Rt{
+				Register: 1,
+				Key:      expr.RtTCPMSS,
+			},
+			// [ byteorder reg 1 = hton(reg 1, 2, 2) ]
+			&expr.Byteorder{
+				DestRegister:   1,
+				SourceRegister: 1,
+				Op:             expr.ByteorderHton,
+				Len:            2,
+				Size:           2,
+			},
+			// [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
+			&expr.Exthdr{
+				SourceRegister: 1,
+				Type:           2, // TODO
+				Offset:         2,
+				Len:            2,
+				Op:             expr.ExthdrOpTcpopt,
+			},
 		})
-		counter := c.AddObj(counterObj).(*nftables.CounterObj)
+
+		counter := filter.AddCounter(counterObj("fwded"))
 
 		const NFT_OBJECT_COUNTER = 1 // TODO: get into x/sys/unix
-		c.AddRule(&nftables.Rule{
-			Table: filter,
-			Chain: forward,
-			Exprs: []expr.Any{
-				// [ counter name fwded ]
-				&expr.Objref{
-					Type: NFT_OBJECT_COUNTER,
-					Name: counter.Name,
-				},
+		forward.AddRule([]expr.Any{
+			// [ counter name fwded ]
+			&expr.Objref{
+				Type: NFT_OBJECT_COUNTER,
+				Name: counter.Name,
 			},
 		})
 	}
 
-	return c.Flush()
+	if clientIsolation != nil {
+		addClientIsolationBridge(rs, clientIsolation)
+	}
+
+	// Only the differences to the current ruleset are applied (atomically),
+	// so that unchanged rules, sets and counters remain untouched.
+	changes, err := ruleset.Apply(&nftables.Conn{}, rs)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	log.Printf("firewall: applied %d changes", len(changes))
+	return flushConntrack(conntrackCfg, changes)
 }
 
 func applySysctl() error {
@@ -722,6 +1025,14 @@ func Apply(dir, root string) error {
 		}
 	}
 
+	if err := applyLTE(dir); err != nil {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("lte: %v", err)
+		} else {
+			log.Printf("cannot apply lte lease: %v", err)
+		}
+	}
+
 	if err := applyDhcp6(dir); err != nil {
 		if firstErr == nil {
 			firstErr = fmt.Errorf("dhcp6: %v", err)
@@ -730,12 +1041,37 @@ func Apply(dir, root string) error {
 		}
 	}
 
+	if err := applyNPTv6Address(dir); err != nil {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("nptv6: %v", err)
+		} else {
+			log.Printf("cannot apply nptv6 address: %v", err)
+		}
+	}
+
+	if err := applyGuest(dir); err != nil {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("guest: %v", err)
+		} else {
+			log.Printf("cannot apply guest network: %v", err)
+		}
+	}
+
+	if err := applyServices(dir); err != nil {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("services: %v", err)
+		} else {
+			log.Printf("cannot apply services subnet: %v", err)
+		}
+	}
+
 	for _, process := range []string{
-		"dyndns",   // depends on the public IPv4 address
+		"dyndns",   // depends on the public IPv4 address and IPv6 prefix
 		"dnsd",     // listens on private IPv4/IPv6
 		"diagd",    // listens on private IPv4/IPv6
 		"backupd",  // listens on private IPv4/IPv6
 		"captured", // listens on private IPv4/IPv6
+		"tailnetd", // advertises the lan0 subnet
 	} {
 		if err := notify.Process("/user/"+process, syscall.SIGUSR1); err != nil {
 			log.Printf("notifying %s: %v", process, err)
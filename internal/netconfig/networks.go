@@ -0,0 +1,208 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Network is a network profile: a VLAN which is defined once in
+// networks.json, and from which all daemons derive their settings:
+// netconfigd creates and addresses the VLAN interface and applies the
+// firewall zone, dhcp4d serves the subnet, radvd advertises an IPv6 subnet of
+// the delegated prefix and dnsd answers queries according to DNS.
+type Network struct {
+	Name   string `json:"name"`   // interface name, e.g. iot0
+	Parent string `json:"parent"` // default lan0
+	VLAN   int    `json:"vlan"`   // 802.1Q VLAN ID, e.g. 10
+	Addr   string `json:"addr"`   // e.g. 10.0.10.1/24
+	Zone   string `json:"zone"`   // “lan” (default) or “isolated”
+
+	// IPv6Subnet selects the /64 subnet of the delegated prefix to use, e.g.
+	// 1 selects 2001:db8:0:1::/64 of 2001:db8::/56. Subnet 0 is used by
+	// lan0. If nil, or if the delegated prefix is too small, the network
+	// does not get IPv6 connectivity.
+	IPv6Subnet *int `json:"ipv6_subnet"`
+
+	DHCP4 NetworkDHCP4 `json:"dhcp4"`
+	DNS   NetworkDNS   `json:"dns"`
+}
+
+// NetworkDHCP4 configures dhcp4d for a Network, see dhcp4d.Config for the
+// meaning of the fields. The subnet and router are those of the network.
+type NetworkDHCP4 struct {
+	Disabled   bool     `json:"disabled"`
+	PoolStart  string   `json:"pool_start"`
+	PoolEnd    string   `json:"pool_end"`
+	Exclude    []string `json:"exclude"`
+	WPAD       string   `json:"wpad"`
+	Allocation string   `json:"allocation"`
+}
+
+// NetworkDNS is the DNS policy of a Network.
+type NetworkDNS struct {
+	// LocalOnly makes dnsd answer only local names (e.g. DHCP hostnames
+	// and dnsd.json records) for clients of the network and refuse all
+	// other queries, e.g. for IoT devices which should not reach the
+	// internet.
+	LocalOnly bool `json:"local_only"`
+}
+
+// NetworkConfig is the contents of networks.json.
+type NetworkConfig struct {
+	Networks []Network `json:"networks"`
+}
+
+// Interface returns the InterfaceDetails of the VLAN interface of n.
+func (n Network) Interface() InterfaceDetails {
+	parent := n.Parent
+	if parent == "" {
+		parent = "lan0"
+	}
+	return InterfaceDetails{
+		Name:   n.Name,
+		Addr:   n.Addr,
+		Type:   "vlan",
+		Parent: parent,
+		VLAN:   n.VLAN,
+		Zone:   n.Zone,
+	}
+}
+
+// IPv6Prefixes returns the IPv6Subnet of each of the delegated prefixes, or
+// nil if IPv6 is disabled for n.
+func (n Network) IPv6Prefixes(delegated []net.IPNet) []net.IPNet {
+	if n.IPv6Subnet == nil {
+		return nil
+	}
+	var prefixes []net.IPNet
+	for _, prefix := range delegated {
+		if sub := subPrefix(prefix, *n.IPv6Subnet); sub != nil {
+			prefixes = append(prefixes, *sub)
+		}
+	}
+	return prefixes
+}
+
+// subPrefix returns the /64 subnet with index subnet of prefix, or nil if
+// prefix does not contain it.
+func subPrefix(prefix net.IPNet, subnet int) *net.IPNet {
+	ip := prefix.IP.To16()
+	ones, bits := prefix.Mask.Size()
+	if ip == nil || prefix.IP.To4() != nil || bits != 8*net.IPv6len || ones > 64 {
+		return nil
+	}
+	if subnet < 0 || uint64(subnet) >= uint64(1)<<uint(64-ones) {
+		return nil
+	}
+	network := binary.BigEndian.Uint64(ip[:8]) | uint64(subnet)
+	sub := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(sub[:8], network)
+	return &net.IPNet{IP: sub, Mask: net.CIDRMask(64, 8*net.IPv6len)}
+}
+
+func (n Network) validate() error {
+	if n.Name == "" {
+		return fmt.Errorf("network without name")
+	}
+	if len(n.Name) >= 16 { // IFNAMSIZ
+		return fmt.Errorf("network %s: name too long for an interface name", n.Name)
+	}
+	if n.VLAN < 1 || n.VLAN > 4094 {
+		return fmt.Errorf("network %s: vlan must be in [1, 4094]", n.Name)
+	}
+	ip, _, err := net.ParseCIDR(n.Addr)
+	if err != nil {
+		return fmt.Errorf("network %s: %v", n.Name, err)
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("network %s: addr must be an IPv4 address", n.Name)
+	}
+	if n.IPv6Subnet != nil && *n.IPv6Subnet < 1 {
+		return fmt.Errorf("network %s: ipv6_subnet must be positive (subnet 0 is used by lan0)", n.Name)
+	}
+	return validateVirtual(n.Interface())
+}
+
+// ReadNetworks returns the networks configured in networks.json, if any.
+func ReadNetworks(dir string) ([]Network, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "networks.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg NetworkConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("networks.json: %v", err)
+	}
+	names := make(map[string]bool)
+	vlans := make(map[string]bool)
+	subnets := make(map[int]bool)
+	for _, n := range cfg.Networks {
+		if err := n.validate(); err != nil {
+			return nil, fmt.Errorf("networks.json: %v", err)
+		}
+		if names[n.Name] {
+			return nil, fmt.Errorf("networks.json: duplicate network %s", n.Name)
+		}
+		names[n.Name] = true
+		vlan := fmt.Sprintf("%s.%d", n.Interface().Parent, n.VLAN)
+		if vlans[vlan] {
+			return nil, fmt.Errorf("networks.json: network %s: duplicate vlan %d", n.Name, n.VLAN)
+		}
+		vlans[vlan] = true
+		if n.IPv6Subnet != nil {
+			if subnets[*n.IPv6Subnet] {
+				return nil, fmt.Errorf("networks.json: network %s: duplicate ipv6_subnet %d", n.Name, *n.IPv6Subnet)
+			}
+			subnets[*n.IPv6Subnet] = true
+		}
+	}
+	return cfg.Networks, nil
+}
+
+// readInterfaceConfig returns the interfaces configured in interfaces.json,
+// followed by the VLAN interfaces of the networks in networks.json.
+func readInterfaceConfig(dir string) (*InterfaceConfig, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	networks, err := ReadNetworks(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range networks {
+		for _, details := range cfg.Interfaces {
+			if details.Name == n.Name {
+				return nil, fmt.Errorf("network %s is also declared in interfaces.json", n.Name)
+			}
+		}
+		cfg.Interfaces = append(cfg.Interfaces, n.Interface())
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNetworks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "interfaces.json"), []byte(`{
+  "interfaces": [
+    {"name": "lan0", "addr": "192.168.42.1/24"}
+  ]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "networks.json"), []byte(`{
+  "networks": [
+    {"name": "iot0", "vlan": 10, "addr": "10.0.10.1/24", "zone": "isolated", "ipv6_subnet": 1, "dns": {"local_only": true}},
+    {"name": "guest0", "vlan": 20, "addr": "10.0.20.1/24", "dhcp4": {"pool_start": "10.0.20.100"}}
+  ]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	networks, err := ReadNetworks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(networks), 2; got != want {
+		t.Fatalf("ReadNetworks: got %d networks, want %d", got, want)
+	}
+	if !networks[0].DNS.LocalOnly {
+		t.Errorf("iot0: dns.local_only not set")
+	}
+
+	details, err := Interface(dir, "iot0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InterfaceDetails{
+		Name:   "iot0",
+		Addr:   "10.0.10.1/24",
+		Type:   "vlan",
+		Parent: "lan0",
+		VLAN:   10,
+		Zone:   ZoneIsolated,
+	}
+	if diff := cmp.Diff(want, details); diff != "" {
+		t.Errorf("Interface(iot0): diff (-want +got):\n%s", diff)
+	}
+
+	ip, err := LinkAddress(dir, "guest0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ip.String(), "10.0.20.1"; got != want {
+		t.Errorf("LinkAddress(guest0) = %v, want %v", got, want)
+	}
+
+	isolated, err := isolatedInterfaces(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"iot0"}, isolated); diff != "" {
+		t.Errorf("isolatedInterfaces: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadNetworksInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, networks := range []string{
+		`[{"vlan": 10, "addr": "10.0.10.1/24"}]`,
+		`[{"name": "iot0", "addr": "10.0.10.1/24"}]`,
+		`[{"name": "iot0", "vlan": 4095, "addr": "10.0.10.1/24"}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "10.0.10.1"}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "fd00::1/64"}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "10.0.10.1/24", "ipv6_subnet": 0}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "10.0.10.1/24", "zone": "dmz"}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "10.0.10.1/24"}, {"name": "iot0", "vlan": 11, "addr": "10.0.11.1/24"}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "10.0.10.1/24"}, {"name": "iot1", "vlan": 10, "addr": "10.0.11.1/24"}]`,
+		`[{"name": "iot0", "vlan": 10, "addr": "10.0.10.1/24", "ipv6_subnet": 1}, {"name": "iot1", "vlan": 11, "addr": "10.0.11.1/24", "ipv6_subnet": 1}]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "networks.json"), []byte(`{"networks": `+networks+`}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadNetworks(dir); err == nil {
+			t.Errorf("ReadNetworks(%s) unexpectedly succeeded", networks)
+		}
+	}
+}
+
+func TestIPv6Prefixes(t *testing.T) {
+	mustParseCIDR := func(s string) net.IPNet {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *ipnet
+	}
+	subnet := 3
+	n := Network{Name: "iot0", IPv6Subnet: &subnet}
+	got := n.IPv6Prefixes([]net.IPNet{
+		mustParseCIDR("2001:db8:aa00::/56"),
+		mustParseCIDR("2001:db8:bb00::/64"),  // too small
+		mustParseCIDR("2001:db8:cc00::/62"),  // just large enough
+		mustParseCIDR("2001:db8:dd00::/63"),  // too small
+		mustParseCIDR("fd12:3456:789a::/48"), // ULA
+	})
+	want := []net.IPNet{
+		mustParseCIDR("2001:db8:aa00:3::/64"),
+		mustParseCIDR("2001:db8:cc00:3::/64"),
+		mustParseCIDR("fd12:3456:789a:3::/64"),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("IPv6Prefixes: diff (-want +got):\n%s", diff)
+	}
+
+	if got := (Network{Name: "iot0"}).IPv6Prefixes(want); got != nil {
+		t.Errorf("IPv6Prefixes(ipv6_subnet unset) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/nfqueue"
+)
+
+// queueExprs returns expressions passing packets matching r to nfqueued.
+func queueExprs(r nfqueue.Rule) ([]expr.Any, error) {
+	var exprs []expr.Any
+	if r.Iface != "" {
+		exprs = append(exprs,
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     ifname(r.Iface),
+			})
+	}
+	if r.Proto != "" {
+		var proto uint8
+		switch r.Proto {
+		case "tcp":
+			proto = unix.IPPROTO_TCP
+		case "udp":
+			proto = unix.IPPROTO_UDP
+		default:
+			return nil, fmt.Errorf(`rule %q: unknown proto %q, expected "tcp" or "udp"`, r.Name, r.Proto)
+		}
+		exprs = append(exprs,
+			// [ meta load l4proto => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			// [ cmp eq reg 1 0x00000006 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{proto},
+			})
+	}
+	if r.Port != "" {
+		min, max, err := parsePort(r.Port)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+		exprs = append(exprs,
+			// [ payload load 2b @ transport header + 2 => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       2, // destination port
+				Len:          2,
+			},
+			// [ cmp gte reg 1 0x00001600 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpGte,
+				Register: 1,
+				Data:     binaryutil.BigEndian.PutUint16(min),
+			},
+			// [ cmp lte reg 1 0x00001600 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpLte,
+				Register: 1,
+				Data:     binaryutil.BigEndian.PutUint16(max),
+			})
+	}
+	// Unless the rule fails closed, packets are accepted while nfqueued is
+	// not listening on the queue.
+	var flag expr.QueueFlag
+	if !r.FailClosed {
+		flag = expr.QueueFlagBypass
+	}
+	// [ queue num 1 bypass ]
+	exprs = append(exprs, &expr.Queue{Num: r.Queue, Flag: flag})
+	return exprs, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/ruleset"
+)
+
+// NPTv6Config configures IPv6-to-IPv6 network prefix translation (RFC 6296),
+// stored in nptv6.json: the LAN uses a stable (unique local address) prefix,
+// which is translated to the first /64 of the delegated prefix on uplink0,
+// so that prefix changes do not require renumbering the LAN.
+type NPTv6Config struct {
+	Enabled bool   `json:"enabled"`
+	Prefix  string `json:"prefix"` // internal /64, e.g. “fd12:3456:789a::/64”
+}
+
+// NPTv6Prefix returns the internal prefix configured in nptv6.json, or nil if
+// network prefix translation is disabled.
+func NPTv6Prefix(dir string) (*net.IPNet, error) {
+	fn := filepath.Join(dir, "nptv6.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg NPTv6Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	_, prefix, err := net.ParseCIDR(cfg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if ones, bits := prefix.Mask.Size(); ones != 64 || bits != 128 {
+		return nil, fmt.Errorf("%s: prefix %v is not an IPv6 /64 prefix", fn, prefix)
+	}
+	return prefix, nil
+}
+
+// nptv6 is a prefix translation between the LAN and the delegated prefix.
+type nptv6 struct {
+	internal, external []byte // first 8 bytes (/64) of the prefixes
+}
+
+// readNPTv6 returns the configured prefix translation, or nil if it is
+// disabled or no prefix was delegated (yet).
+func readNPTv6(dir string) (*nptv6, error) {
+	internal, err := NPTv6Prefix(dir)
+	if err != nil || internal == nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // dhcp6 might not have obtained a lease yet
+		}
+		return nil, err
+	}
+	var lease dhcp6.Config
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, fmt.Errorf("dhcp6/wire/lease.json: %v", err)
+	}
+	if len(lease.Prefixes) == 0 {
+		return nil, nil
+	}
+	return &nptv6{
+		internal: internal.IP.To16()[:8],
+		// The first /64 subnet within larger prefixes, like in applyDhcp6:
+		external: lease.Prefixes[0].IP.To16()[:8],
+	}, nil
+}
+
+// applyNPTv6Address configures the first address of the internal prefix on
+// lan0, e.g. fd12:3456:789a::1/64.
+func applyNPTv6Address(dir string) error {
+	prefix, err := NPTv6Prefix(dir)
+	if err != nil || prefix == nil {
+		return err
+	}
+	link, err := netlink.LinkByName("lan0")
+	if err != nil {
+		return err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP)
+	ip[len(ip)-1] = 1
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: prefix.Mask}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+	}
+	return nil
+}
+
+// rewritePrefixExprs returns expressions which replace prefix from with to in
+// the IPv6 address at offset (8: source, 24: destination) of packets
+// passing uplink0 (in the direction of key). Translation is stateless: the
+// kernel updates the transport layer checksums, which cover the addresses
+// via the pseudo header.
+func rewritePrefixExprs(key expr.MetaKey, offset uint32, from, to []byte) []expr.Any {
+	return []expr.Any{
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: key, Register: 1},
+		// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("uplink0"),
+		},
+		// [ payload load 8b @ network header + 8 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          8,
+		},
+		// [ cmp eq reg 1 0x563412fd 0x00009a78 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     from,
+		},
+		// [ immediate reg 1 0x68012a02 0x0000004a ]
+		&expr.Immediate{
+			Register: 1,
+			Data:     to,
+		},
+		// [ payload write reg 1 => 8b @ network header + 8 csum_type 0 csum_off 0 csum_flags 0x1 ]
+		&expr.Payload{
+			OperationType:  expr.PayloadWrite,
+			SourceRegister: 1,
+			Base:           expr.PayloadBaseNetworkHeader,
+			Offset:         offset,
+			Len:            8,
+			CsumType:       expr.CsumTypeNone,
+			CsumFlags:      unix.NFT_PAYLOAD_L4CSUM_PSEUDOHDR,
+		},
+	}
+}
+
+// addNPTv6 adds an ip6 table translating the internal prefix to the external
+// prefix for packets leaving via uplink0 and vice versa.
+func addNPTv6(rs *ruleset.Ruleset, n *nptv6) {
+	table := rs.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyIPv6,
+		Name:   "nptv6",
+	})
+	// Inbound packets are translated before connection tracking, so that
+	// conntrack only ever sees internal addresses.
+	prerouting := table.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRaw,
+		Type:     nftables.ChainTypeFilter,
+	})
+	prerouting.AddRule(rewritePrefixExprs(expr.MetaKeyIIFNAME, 24, n.external, n.internal))
+	postrouting := table.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+		Type:     nftables.ChainTypeFilter,
+	})
+	postrouting.AddRule(rewritePrefixExprs(expr.MetaKeyOIFNAME, 8, n.internal, n.external))
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNPTv6(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(fn, content string) {
+		path := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("nptv6.json", `{"enabled": true, "prefix": "fd12:3456:789a::/48"}`)
+	if _, err := NPTv6Prefix(dir); err == nil {
+		t.Errorf("NPTv6Prefix unexpectedly accepted a /48 prefix")
+	}
+
+	write("nptv6.json", `{"enabled": true, "prefix": "fd12:3456:789a::/64"}`)
+	n, err := readNPTv6(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != nil {
+		t.Fatalf("prefix translation unexpectedly enabled without delegated prefix: %+v", n)
+	}
+
+	write("dhcp6/wire/lease.json", `{"prefixes": [{"IP": "2a02:168:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`)
+	n, err = readNPTv6(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == nil {
+		t.Fatalf("prefix translation unexpectedly disabled")
+	}
+	if got, want := n.internal, net.ParseIP("fd12:3456:789a::")[:8]; !bytes.Equal(got, want) {
+		t.Errorf("unexpected internal prefix: got %x, want %x", got, want)
+	}
+	if got, want := n.external, net.ParseIP("2a02:168:4a00::")[:8]; !bytes.Equal(got, want) {
+		t.Errorf("unexpected external prefix: got %x, want %x", got, want)
+	}
+}
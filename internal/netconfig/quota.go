@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/quota"
+)
+
+// quotaExprs returns rules for the forward chain of table which block or
+// throttle the device of e. Traffic received by throttled devices can only be
+// limited via their IPv4 address, as the destination MAC address is not yet
+// known in the forward chain.
+func quotaExprs(table *nftables.Table, e *quota.Exceeded) [][]expr.Any {
+	hwaddr, err := net.ParseMAC(e.HardwareAddr)
+	if err != nil {
+		return nil // verified by devices.Read
+	}
+	if e.Action != devices.QuotaThrottle {
+		return [][]expr.Any{dropHardwareAddrExprs(hwaddr, "quota")}
+	}
+	rate := e.ThrottleKbps * 1000 / 8 // bytes per second
+	// [ limit rate over 125000/second burst 125000 type bytes flags 0x1 ]
+	limit := &expr.Limit{
+		Type:  expr.LimitTypePktBytes,
+		Rate:  rate,
+		Over:  true,
+		Unit:  expr.LimitTimeSecond,
+		Burst: uint32(rate),
+	}
+	rules := [][]expr.Any{
+		append(lanHardwareAddrExprs(hwaddr),
+			limit,
+			// [ immediate reg 0 drop ]
+			&expr.Verdict{Kind: expr.VerdictDrop}),
+	}
+	if ip := net.ParseIP(e.Addr).To4(); ip != nil && table.Family == nftables.TableFamilyIPv4 {
+		download := *limit
+		rules = append(rules, []expr.Any{
+			// [ payload load 4b @ network header + 16 => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       16, // destination address
+				Len:          net.IPv4len,
+			},
+			// [ cmp eq reg 1 0x172aa8c0 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte(ip),
+			},
+			&download,
+			// [ immediate reg 0 drop ]
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		})
+	}
+	return rules
+}
+
+func exceededQuotas(dir string) ([]*quota.Exceeded, error) {
+	state, err := quota.Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	return state.Active(time.Now()), nil
+}
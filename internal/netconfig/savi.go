@@ -0,0 +1,142 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/rtr7/router7/internal/dhcp6"
+)
+
+// saviConfig is the IPv6 source address validation configuration, stored in
+// savi.json.
+type saviConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// ULA are additional prefixes (e.g. a unique local address prefix like
+	// fd12:3456:789a::/48) from which LAN clients may send traffic.
+	ULA []string `json:"ula"`
+}
+
+// saviPrefixes returns the prefixes from which LAN clients may send IPv6
+// traffic if source address validation is enabled in savi.json: the
+// currently delegated prefixes, the additional prefixes announced by radvd,
+// the configured ULA prefixes and the internal NPTv6 prefix. A nil result means source address
+// validation is disabled.
+func saviPrefixes(dir string) ([]*net.IPNet, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "savi.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg saviConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	prefixes := []*net.IPNet{}
+	for _, p := range cfg.ULA {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("ula: %v", err)
+		}
+		if ipnet.IP.To4() != nil {
+			return nil, fmt.Errorf("ula: %v is not an IPv6 prefix", ipnet)
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	internal, err := NPTv6Prefix(dir)
+	if err != nil {
+		return nil, err
+	}
+	if internal != nil {
+		prefixes = append(prefixes, internal)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var lease dhcp6.Config
+		if err := json.Unmarshal(b, &lease); err != nil {
+			return nil, fmt.Errorf("dhcp6/wire/lease.json: %v", err)
+		}
+		for _, p := range lease.Prefixes {
+			p := p // copy
+			prefixes = append(prefixes, &p)
+		}
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "radvd/prefixes.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var additional []net.IPNet
+		if err := json.Unmarshal(b, &additional); err != nil {
+			return nil, fmt.Errorf("radvd/prefixes.json: %v", err)
+		}
+		for _, p := range additional {
+			p := p // copy
+			prefixes = append(prefixes, &p)
+		}
+	}
+	return prefixes, nil
+}
+
+// saviExprs returns expressions logging and dropping packets which arrive on
+// lan0 from an IPv6 address outside of set, e.g. from a stale address of a
+// previously delegated prefix.
+func saviExprs(set *nftables.Set) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("lan0"),
+		},
+		// [ payload load 16b @ network header + 8 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       8, // IPv6 source address
+			Len:          net.IPv6len,
+		},
+		// [ lookup reg 1 set savi 0x1 ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+			Invert:         true,
+		},
+		logExpr("savi"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
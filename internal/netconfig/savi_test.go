@@ -0,0 +1,65 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaviPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prefixes, err := saviPrefixes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefixes != nil {
+		t.Fatalf("source address validation unexpectedly enabled: %v", prefixes)
+	}
+
+	for fn, content := range map[string]string{
+		"savi.json":             `{"enabled": true, "ula": ["fd12:3456:789a::/48"]}`,
+		"dhcp6/wire/lease.json": `{"prefixes": [{"IP": "2a02:168:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`,
+		"radvd/prefixes.json":   `[{"IP": "2001:db8::", "Mask": "//////////8AAAAAAAAAAA=="}]`,
+	} {
+		path := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prefixes, err = saviPrefixes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	want := []string{"fd12:3456:789a::/48", "2a02:168:4a00::/48", "2001:db8::/64"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected prefixes: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/ruleset"
+)
+
+// ServicesDomain is the domain under which dnsd answers for services, e.g.
+// grafana.svc.lan.
+const ServicesDomain = "svc.lan"
+
+// ServicesConfig designates a routed subnet for services running on the
+// router box (e.g. gokrazy apps or podman containers), stored in
+// services.json. LAN clients can only reach the ports which services
+// declare, and services cannot initiate connections to LAN clients.
+type ServicesConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Interface is the interface (typically a veth or macvlan interface
+	// declared in interfaces.json) on which the services are reachable,
+	// e.g. svc0.
+	Interface string `json:"interface"`
+
+	// Subnet is the services subnet, e.g. 10.0.7.0/24. router7 uses the
+	// first address (e.g. 10.0.7.1) as gateway for the services.
+	Subnet string `json:"subnet"`
+
+	// Internet controls whether services may initiate connections to the
+	// internet.
+	Internet bool `json:"internet"`
+
+	Services []Service `json:"services"`
+}
+
+// Service is a service within the services subnet.
+type Service struct {
+	Name  string   `json:"name"`  // e.g. grafana, resolvable as grafana.svc.lan
+	Addr  string   `json:"addr"`  // e.g. 10.0.7.2
+	Ports []uint16 `json:"ports"` // TCP and UDP ports reachable from the LAN
+}
+
+// services is the validated ServicesConfig.
+type services struct {
+	ifname   string
+	subnet   *net.IPNet
+	gateway  net.IP
+	internet bool
+	addrs    []net.IP
+	ports    [][]uint16 // ports[i] are the ports of addrs[i]
+}
+
+// ReadServices reads services.json from dir. A missing file is treated like
+// disabled services.
+func ReadServices(dir string) (*ServicesConfig, error) {
+	fn := filepath.Join(dir, "services.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ServicesConfig{}, nil
+		}
+		return nil, err
+	}
+	var cfg ServicesConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if _, err := cfg.parse(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+func (c *ServicesConfig) parse() (*services, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	if c.Interface == "" {
+		return nil, fmt.Errorf("interface not set")
+	}
+	_, subnet, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %v is not an IPv4 subnet", subnet)
+	}
+	gateway := make(net.IP, net.IPv4len)
+	copy(gateway, subnet.IP.To4())
+	gateway[len(gateway)-1]++
+	s := &services{
+		ifname:   c.Interface,
+		subnet:   subnet,
+		gateway:  gateway,
+		internet: c.Internet,
+	}
+	names := make(map[string]bool)
+	for _, svc := range c.Services {
+		if svc.Name == "" {
+			return nil, fmt.Errorf("service without name")
+		}
+		if names[svc.Name] {
+			return nil, fmt.Errorf("duplicate service %q", svc.Name)
+		}
+		names[svc.Name] = true
+		addr := net.ParseIP(svc.Addr).To4()
+		if addr == nil || !subnet.Contains(addr) {
+			return nil, fmt.Errorf("service %s: address %q is not within %v", svc.Name, svc.Addr, subnet)
+		}
+		if addr.Equal(gateway) {
+			return nil, fmt.Errorf("service %s: address %v is router7’s address", svc.Name, addr)
+		}
+		s.addrs = append(s.addrs, addr)
+		s.ports = append(s.ports, svc.Ports)
+	}
+	return s, nil
+}
+
+// Records returns the DNS names of all services, e.g. grafana.svc.lan, mapped
+// to their address.
+func (c *ServicesConfig) Records() map[string]string {
+	if !c.Enabled {
+		return nil
+	}
+	records := make(map[string]string)
+	for _, svc := range c.Services {
+		records[svc.Name+"."+ServicesDomain] = svc.Addr
+	}
+	return records
+}
+
+func readServices(dir string) (*services, error) {
+	cfg, err := ReadServices(dir)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.parse()
+}
+
+// applyServices configures the gateway address on the services interface and
+// routes the services subnet via the interface.
+func applyServices(dir string) error {
+	s, err := readServices(dir)
+	if err != nil || s == nil {
+		return err
+	}
+	link, err := netlink.LinkByName(s.ifname)
+	if err != nil {
+		return err
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: s.gateway, Mask: s.subnet.Mask}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+	}
+	if err := netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       s.subnet,
+		Src:       s.gateway,
+		Scope:     netlink.SCOPE_LINK,
+	}); err != nil {
+		return fmt.Errorf("RouteReplace(%v): %v", s.subnet, err)
+	}
+	return nil
+}
+
+// servicesOutboundExprs returns expressions for the forward chain which log
+// and drop new connections initiated by services, except for connections to
+// the internet if permitted.
+func servicesOutboundExprs(s *services) []expr.Any {
+	exprs := []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x... ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(s.ifname),
+		},
+	}
+	if s.internet {
+		exprs = append(exprs,
+			// [ meta load oifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			// [ cmp neq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     ifname("uplink0"),
+			})
+	}
+	return append(append(exprs, ctNewExprs()...),
+		logExpr("services"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
+
+// servicePortExprs returns expressions for the services chain which return
+// (i.e. permit) proto connections to port on the service at addr.
+func servicePortExprs(addr net.IP, proto uint8, port uint16) []expr.Any {
+	return []expr.Any{
+		// [ payload load 4b @ network header + 16 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       16, // IPv4 destination address
+			Len:          net.IPv4len,
+		},
+		// [ cmp eq reg 1 0x0207000a ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte(addr),
+		},
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 0x00000006 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{proto},
+		},
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // destination port
+			Len:          2,
+		},
+		// [ cmp eq reg 1 0x00000bb8 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(port),
+		},
+		// [ immediate reg 0 return ]
+		&expr.Verdict{Kind: expr.VerdictReturn},
+	}
+}
+
+// addServices adds firewall policies for the services subnet to the IPv4
+// forward chain: new connections to the services are checked against the
+// declared ports in a separate services chain.
+func addServices(filter *ruleset.Table, forward *ruleset.Chain, s *services) {
+	forward.AddRule(servicesOutboundExprs(s))
+
+	chain := filter.AddChain(&nftables.Chain{
+		Name: "services",
+	})
+	for idx, addr := range s.addrs {
+		for _, port := range s.ports[idx] {
+			for _, proto := range []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+				chain.AddRule(servicePortExprs(addr, proto, port))
+			}
+		}
+	}
+	chain.AddRule([]expr.Any{
+		logExpr("services"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	})
+
+	forward.AddRule(append(append([]expr.Any{
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x... ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(s.ifname),
+		},
+	}, ctNewExprs()...),
+		// [ immediate reg 0 jump -> services ]
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Chain.Name},
+	))
+}
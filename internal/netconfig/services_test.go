@@ -0,0 +1,79 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "services.json")
+	for _, invalid := range []string{
+		`{"enabled": true, "subnet": "10.0.7.0/24"}`,
+		`{"enabled": true, "interface": "svc0", "subnet": "fd00::/64"}`,
+		`{"enabled": true, "interface": "svc0", "subnet": "10.0.7.0/24", "services": [{"name": "grafana", "addr": "10.0.8.2"}]}`,
+		`{"enabled": true, "interface": "svc0", "subnet": "10.0.7.0/24", "services": [{"name": "grafana", "addr": "10.0.7.1"}]}`,
+		`{"enabled": true, "interface": "svc0", "subnet": "10.0.7.0/24", "services": [{"name": "grafana", "addr": "10.0.7.2"}, {"name": "grafana", "addr": "10.0.7.3"}]}`,
+	} {
+		if err := ioutil.WriteFile(fn, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadServices(dir); err == nil {
+			t.Errorf("ReadServices(%s) unexpectedly succeeded", invalid)
+		}
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "enabled": true,
+  "interface": "svc0",
+  "subnet": "10.0.7.0/24",
+  "services": [
+    {"name": "grafana", "addr": "10.0.7.2", "ports": [3000]},
+    {"name": "prometheus", "addr": "10.0.7.3", "ports": [9090]}
+  ]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := readServices(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.gateway, net.ParseIP("10.0.7.1").To4(); !got.Equal(want) {
+		t.Errorf("unexpected gateway: got %v, want %v", got, want)
+	}
+	cfg, err := ReadServices(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"grafana.svc.lan":    "10.0.7.2",
+		"prometheus.svc.lan": "10.0.7.3",
+	}
+	if diff := cmp.Diff(want, cfg.Records()); diff != "" {
+		t.Errorf("Records: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+)
+
+// Firewall zones of interfaces declared in interfaces.json or networks.json.
+const (
+	// ZoneLAN interfaces are treated like lan0: forwarding is unrestricted.
+	ZoneLAN = "lan"
+
+	// ZoneIsolated interfaces may only initiate connections to the internet
+	// (via uplink0), e.g. for containers or services running on the router
+	// box. Connections into the isolated zone are still permitted.
+	ZoneIsolated = "isolated"
+)
+
+// validateVirtual verifies the virtual interface configuration of details.
+func validateVirtual(details InterfaceDetails) error {
+	switch details.Zone {
+	case "", ZoneLAN, ZoneIsolated:
+	default:
+		return fmt.Errorf("interface %s: unknown zone %q", details.Name, details.Zone)
+	}
+	switch details.Type {
+	case "":
+		return nil
+	case "macvlan":
+		if details.Parent == "" {
+			return fmt.Errorf("interface %s: macvlan requires parent", details.Name)
+		}
+	case "veth":
+		if details.Peer == "" {
+			return fmt.Errorf("interface %s: veth requires peer", details.Name)
+		}
+	case "vlan":
+		if details.Parent == "" {
+			return fmt.Errorf("interface %s: vlan requires parent", details.Name)
+		}
+		if details.VLAN < 1 || details.VLAN > 4094 {
+			return fmt.Errorf("interface %s: vlan ID must be in [1, 4094]", details.Name)
+		}
+	default:
+		return fmt.Errorf("interface %s: unknown type %q", details.Name, details.Type)
+	}
+	if details.Name == "" {
+		return fmt.Errorf("%s interface without name", details.Type)
+	}
+	return nil
+}
+
+// virtualLink returns the netlink.Link to create for details, or nil if
+// details does not declare a virtual interface.
+func virtualLink(details InterfaceDetails) (netlink.Link, error) {
+	attrs := netlink.LinkAttrs{Name: details.Name}
+	if details.HardwareAddr != "" {
+		hwaddr, err := net.ParseMAC(details.HardwareAddr)
+		if err != nil {
+			return nil, fmt.Errorf("ParseMAC(%q): %v", details.HardwareAddr, err)
+		}
+		attrs.HardwareAddr = hwaddr
+	}
+	switch details.Type {
+	case "macvlan", "vlan":
+		parent, err := netlink.LinkByName(details.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: parent %s: %v", details.Name, details.Parent, err)
+		}
+		attrs.ParentIndex = parent.Attrs().Index
+		if details.Type == "vlan" {
+			return &netlink.Vlan{
+				LinkAttrs: attrs,
+				VlanId:    details.VLAN,
+			}, nil
+		}
+		return &netlink.Macvlan{
+			LinkAttrs: attrs,
+			Mode:      netlink.MACVLAN_MODE_BRIDGE, // reachable from the router
+		}, nil
+	case "veth":
+		return &netlink.Veth{
+			LinkAttrs: attrs,
+			PeerName:  details.Peer,
+		}, nil
+	}
+	return nil, nil
+}
+
+// createVirtualInterfaces creates the macvlan, veth and vlan interfaces declared
+// in interfaces, unless they already exist. Addresses are configured like for all
+// other interfaces by applyInterfaces.
+func createVirtualInterfaces(interfaces []InterfaceDetails) error {
+	for _, details := range interfaces {
+		if err := validateVirtual(details); err != nil {
+			return err
+		}
+		if details.Type == "" {
+			continue
+		}
+		if _, err := netlink.LinkByName(details.Name); err == nil {
+			continue // already created
+		}
+		link, err := virtualLink(details)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("LinkAdd(%s): %v", details.Name, err)
+		}
+		if details.Type == "veth" {
+			// The peer is typically moved into a container’s network
+			// namespace, which brings it up, but might also be used as-is.
+			peer, err := netlink.LinkByName(details.Peer)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(peer); err != nil {
+				return fmt.Errorf("LinkSetUp(%s): %v", details.Peer, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isolatedInterfaces returns the names of all interfaces in ZoneIsolated, as
+// configured in interfaces.json and networks.json.
+func isolatedInterfaces(dir string) ([]string, error) {
+	cfg, err := readInterfaceConfig(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var isolated []string
+	for _, details := range cfg.Interfaces {
+		if details.Zone == ZoneIsolated {
+			isolated = append(isolated, details.Name)
+		}
+	}
+	return isolated, nil
+}
+
+// isolatedExprs returns expressions for the forward chain which log and drop
+// new connections from the isolated interface iface to any interface other
+// than uplink0.
+func isolatedExprs(iface string) []expr.Any {
+	exprs := []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x... ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(iface),
+		},
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp neq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     ifname("uplink0"),
+		},
+	}
+	return append(append(exprs, ctNewExprs()...),
+		logExpr("isolated"),
+		// [ immediate reg 0 drop ]
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
+
+// ctNewExprs returns expressions matching packets which start a new
+// connection.
+func ctNewExprs() []expr.Any {
+	return []expr.Any{
+		// [ ct load state => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		// [ bitwise reg 1 = (reg=1 & 0x00000008 ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW),
+			Xor:            []byte{0, 0, 0, 0},
+		},
+		// [ cmp neq reg 1 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     []byte{0, 0, 0, 0},
+		},
+	}
+}
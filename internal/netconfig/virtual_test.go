@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateVirtual(t *testing.T) {
+	for _, tt := range []struct {
+		details InterfaceDetails
+		wantErr bool
+	}{
+		{InterfaceDetails{Name: "lan0"}, false},
+		{InterfaceDetails{Name: "mv0", Type: "macvlan", Parent: "lan0"}, false},
+		{InterfaceDetails{Name: "ct0", Type: "veth", Peer: "ct0p", Zone: ZoneIsolated}, false},
+		{InterfaceDetails{Name: "iot0", Type: "vlan", Parent: "lan0", VLAN: 10}, false},
+		{InterfaceDetails{Name: "mv0", Type: "macvlan"}, true},
+		{InterfaceDetails{Name: "iot0", Type: "vlan", Parent: "lan0"}, true},
+		{InterfaceDetails{Name: "iot0", Type: "vlan", VLAN: 10}, true},
+		{InterfaceDetails{Name: "ct0", Type: "veth"}, true},
+		{InterfaceDetails{Type: "veth", Peer: "ct0p"}, true},
+		{InterfaceDetails{Name: "br0", Type: "bridge"}, true},
+		{InterfaceDetails{Name: "lan0", Zone: "dmz"}, true},
+	} {
+		err := validateVirtual(tt.details)
+		if got := err != nil; got != tt.wantErr {
+			t.Errorf("validateVirtual(%+v) = %v, want error: %v", tt.details, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsolatedInterfaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "interfaces.json"), []byte(`{
+  "interfaces": [
+    {"name": "lan0", "addr": "192.168.42.1/24"},
+    {"name": "mv0", "type": "macvlan", "parent": "lan0", "addr": "192.168.43.1/24"},
+    {"name": "ct0", "type": "veth", "peer": "ct0p", "zone": "isolated", "addr": "192.168.44.1/24"}
+  ]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := isolatedInterfaces(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"ct0"}, got); diff != "" {
+		t.Errorf("isolatedInterfaces: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/renameio"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/dhcp6"
+)
+
+// WANAddrs are the public addresses of router7, as obtained by dhcp4 and dhcp6.
+type WANAddrs struct {
+	IPv4       string `json:"ipv4,omitempty"`        // e.g. 85.195.207.62
+	IPv6       string `json:"ipv6,omitempty"`        // e.g. 2a02:168:4a00::1
+	IPv6Prefix string `json:"ipv6_prefix,omitempty"` // e.g. 2a02:168:4a00::/48
+}
+
+// ReadWANAddrs returns the current public addresses from the dhcp4 and dhcp6
+// leases in dir. Addresses of leases which were not obtained yet are empty.
+func ReadWANAddrs(dir string) (WANAddrs, error) {
+	var addrs WANAddrs
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4/wire/lease.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return WANAddrs{}, err
+	}
+	if err == nil {
+		var cfg dhcp4.Config
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return WANAddrs{}, err
+		}
+		addrs.IPv4 = cfg.ClientIP
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return WANAddrs{}, err
+	}
+	if err == nil {
+		var cfg dhcp6.Config
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return WANAddrs{}, err
+		}
+		if len(cfg.Prefixes) > 0 {
+			prefix := cfg.Prefixes[0]
+			addrs.IPv6Prefix = prefix.String()
+			// applyDhcp6 configures the first address of the prefix on lan0.
+			ip := make(net.IP, len(prefix.IP))
+			copy(ip, prefix.IP)
+			ip[len(ip)-1] = 1
+			addrs.IPv6 = ip.String()
+		}
+	}
+	return addrs, nil
+}
+
+// WANChange is a change of a public address.
+type WANChange struct {
+	Time     time.Time `json:"time"`
+	Family   string    `json:"family"` // “ipv4” or “ipv6”
+	Addr     string    `json:"addr"`   // empty if the address was lost
+	Previous string    `json:"previous,omitempty"`
+}
+
+// maxWANHistory is the number of changes retained in wanhistory.json.
+const maxWANHistory = 1000
+
+// ReadWANHistory returns the recorded changes of the public addresses, oldest
+// first.
+func ReadWANHistory(dir string) ([]WANChange, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "netconfigd", "wanhistory.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var history []WANChange
+	if err := json.Unmarshal(b, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// RecordWANAddrs compares addrs with the most recently recorded addresses and
+// appends changes to the history in dir, returning the changes.
+func RecordWANAddrs(dir string, addrs WANAddrs, now time.Time) ([]WANChange, error) {
+	history, err := ReadWANHistory(dir)
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[string]string)
+	for _, c := range history {
+		last[c.Family] = c.Addr
+	}
+	var changes []WANChange
+	for _, cur := range []struct {
+		family, addr string
+	}{
+		{"ipv4", addrs.IPv4},
+		{"ipv6", addrs.IPv6},
+	} {
+		if cur.addr == last[cur.family] {
+			continue
+		}
+		changes = append(changes, WANChange{
+			Time:     now,
+			Family:   cur.family,
+			Addr:     cur.addr,
+			Previous: last[cur.family],
+		})
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	history = append(history, changes...)
+	if len(history) > maxWANHistory {
+		history = history[len(history)-maxWANHistory:]
+	}
+	b, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	fn := filepath.Join(dir, "netconfigd", "wanhistory.json")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return nil, err
+	}
+	if err := renameio.WriteFile(fn, b, 0644); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
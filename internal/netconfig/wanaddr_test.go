@@ -0,0 +1,106 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWANAddrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addrs, err := ReadWANAddrs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(WANAddrs{}, addrs); diff != "" {
+		t.Errorf("ReadWANAddrs (no leases): diff (-want +got):\n%s", diff)
+	}
+
+	for fn, content := range map[string]string{
+		"dhcp4/wire/lease.json": `{"client_ip": "85.195.207.62"}`,
+		"dhcp6/wire/lease.json": `{"prefixes": [{"IP": "2a02:168:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`,
+	} {
+		fn = filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addrs, err = ReadWANAddrs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WANAddrs{
+		IPv4:       "85.195.207.62",
+		IPv6:       "2a02:168:4a00::1",
+		IPv6Prefix: "2a02:168:4a00::/48",
+	}
+	if diff := cmp.Diff(want, addrs); diff != "" {
+		t.Errorf("ReadWANAddrs: diff (-want +got):\n%s", diff)
+	}
+
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	changes, err := RecordWANAddrs(dir, addrs, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := []WANChange{
+		{Time: now, Family: "ipv4", Addr: "85.195.207.62"},
+		{Time: now, Family: "ipv6", Addr: "2a02:168:4a00::1"},
+	}
+	if diff := cmp.Diff(initial, changes); diff != "" {
+		t.Errorf("RecordWANAddrs (initial): diff (-want +got):\n%s", diff)
+	}
+
+	changes, err = RecordWANAddrs(dir, addrs, now.Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("RecordWANAddrs (unchanged): unexpected changes %+v", changes)
+	}
+
+	addrs.IPv4 = "85.195.207.63"
+	later := now.Add(1 * time.Hour)
+	changes, err = RecordWANAddrs(dir, addrs, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := WANChange{Time: later, Family: "ipv4", Addr: "85.195.207.63", Previous: "85.195.207.62"}
+	if diff := cmp.Diff([]WANChange{changed}, changes); diff != "" {
+		t.Errorf("RecordWANAddrs (changed): diff (-want +got):\n%s", diff)
+	}
+
+	history, err := ReadWANHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(append(initial, changed), history); diff != "" {
+		t.Errorf("ReadWANHistory: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Rule selects packets which netconfigd passes to a judge via queue Queue.
+type Rule struct {
+	Name  string `json:"name"`  // e.g. “ssh-inbound”
+	Iface string `json:"iface"` // input interface, e.g. “uplink0”, empty means any
+	Proto string `json:"proto"` // “tcp” or “udp”, empty means any
+	Port  string `json:"port"`  // destination port, e.g. “22” (or “22-23”), requires Proto
+	Queue uint16 `json:"queue"` // nfqueue number, e.g. 1
+
+	// Judge is the path of a program which receives packets on stdin and
+	// writes verdicts to stdout, see ProcessJudge.
+	Judge string `json:"judge"`
+
+	// FailClosed drops packets while no judge is available (e.g. nfqueued is
+	// not running, or the judge does not reply in time). By default, packets
+	// are accepted in that case.
+	FailClosed bool `json:"fail_closed"`
+}
+
+// Config is the nfqueue configuration, stored in nfqueue.json.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ReadConfig reads nfqueue.json from dir. A missing file results in an empty
+// configuration.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "nfqueue.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	queues := make(map[uint16]string)
+	for _, r := range cfg.Rules {
+		if r.Port != "" && r.Proto == "" {
+			return nil, fmt.Errorf("%s: rule %q: port requires proto", fn, r.Name)
+		}
+		if other, ok := queues[r.Queue]; ok && other != r.Judge {
+			return nil, fmt.Errorf("%s: rule %q: queue %d is used with different judges", fn, r.Name, r.Queue)
+		}
+		queues[r.Queue] = r.Judge
+	}
+	return &cfg, nil
+}
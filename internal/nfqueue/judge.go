@@ -0,0 +1,164 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Judge decides the fate of queued packets. Programs embedding this package
+// can implement Judge in Go; ProcessJudge delegates to an external program.
+type Judge interface {
+	Judge(p *Packet) (Verdict, error)
+}
+
+// Request is written (as a single line of JSON) to the standard input of a
+// ProcessJudge program for each queued packet.
+type Request struct {
+	ID       uint32 `json:"id"`
+	Family   byte   `json:"family"`
+	InIndex  uint32 `json:"in_index,omitempty"`
+	OutIndex uint32 `json:"out_index,omitempty"`
+	Payload  []byte `json:"payload"` // base64-encoded in JSON
+}
+
+// Response is read (as a single line of JSON) from the standard output of a
+// ProcessJudge program for each Request.
+type Response struct {
+	ID      uint32 `json:"id"`
+	Verdict string `json:"verdict"` // “accept” or “drop”
+}
+
+// ProcessJudge passes packets to the program at Path, which is started on
+// demand and restarted when it exits or does not reply within Timeout.
+type ProcessJudge struct {
+	Path    string
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan *Response
+}
+
+func (j *ProcessJudge) start() error {
+	cmd := exec.Command(j.Path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	responses := make(chan *Response)
+	go func() {
+		defer close(responses)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var r Response
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				continue // skip malformed lines
+			}
+			responses <- &r
+		}
+	}()
+	j.cmd = cmd
+	j.stdin = stdin
+	j.responses = responses
+	return nil
+}
+
+func (j *ProcessJudge) stop() {
+	if j.cmd == nil {
+		return
+	}
+	j.stdin.Close()
+	j.cmd.Process.Kill()
+	go func(ch chan *Response) {
+		for range ch {
+		} // drain so that the scanner goroutine can exit
+	}(j.responses)
+	j.cmd.Wait()
+	j.cmd = nil
+}
+
+// Judge implements Judge.
+func (j *ProcessJudge) Judge(p *Packet) (Verdict, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cmd == nil {
+		if err := j.start(); err != nil {
+			return Drop, err
+		}
+	}
+	b, err := json.Marshal(&Request{
+		ID:       p.ID,
+		Family:   p.Family,
+		InIndex:  p.InIndex,
+		OutIndex: p.OutIndex,
+		Payload:  p.Payload,
+	})
+	if err != nil {
+		return Drop, err
+	}
+	if _, err := j.stdin.Write(append(b, '\n')); err != nil {
+		j.stop()
+		return Drop, err
+	}
+	timeout := time.NewTimer(j.Timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case r, ok := <-j.responses:
+			if !ok {
+				j.stop()
+				return Drop, fmt.Errorf("%s exited", j.Path)
+			}
+			if r.ID != p.ID {
+				continue // stale response to a request which timed out
+			}
+			switch r.Verdict {
+			case "accept":
+				return Accept, nil
+			case "drop":
+				return Drop, nil
+			}
+			return Drop, fmt.Errorf("%s: unknown verdict %q", j.Path, r.Verdict)
+		case <-timeout.C:
+			j.stop()
+			return Drop, fmt.Errorf("%s did not reply within %v", j.Path, j.Timeout)
+		}
+	}
+}
+
+// Close stops the program.
+func (j *ProcessJudge) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stop()
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nfqueue passes packets which match configurable firewall rules to a
+// judge (e.g. an IDS/IPS experiment) via NFQUEUE, applying its verdicts.
+package nfqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// from include/uapi/linux/netfilter/nfnetlink_queue.h
+const (
+	nfnlSubsysQueue = 3
+
+	nfqnlMsgPacket  = 0
+	nfqnlMsgVerdict = 1
+	nfqnlMsgConfig  = 2
+
+	nfqaPacketHdr  = 1
+	nfqaVerdictHdr = 2
+	nfqaIfindexIn  = 5
+	nfqaIfindexOut = 6
+	nfqaPayload    = 10
+
+	nfqaCfgCmd    = 1
+	nfqaCfgParams = 2
+
+	nfqnlCfgCmdBind = 1
+
+	nfqnlCopyPacket = 2
+)
+
+// Verdict is the fate of a queued packet.
+type Verdict uint32
+
+// from include/uapi/linux/netfilter.h
+const (
+	Drop   Verdict = 0
+	Accept Verdict = 1
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Drop:
+		return "drop"
+	case Accept:
+		return "accept"
+	}
+	return fmt.Sprintf("verdict(%d)", uint32(v))
+}
+
+// Packet is a queued packet awaiting a verdict.
+type Packet struct {
+	ID       uint32
+	Family   byte   // e.g. unix.NFPROTO_IPV4
+	InIndex  uint32 // input interface index, 0 if unknown
+	OutIndex uint32 // output interface index, 0 if unknown
+	Payload  []byte // starting with the network layer header
+}
+
+func nfgenmsg(family byte, resID uint16) []byte {
+	b := []byte{family, 0 /* NFNETLINK_V0 */, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], resID)
+	return b
+}
+
+func parsePacket(data []byte) (*Packet, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message too short for nfgenmsg: %d bytes", len(data))
+	}
+	p := &Packet{Family: data[0]}
+	attrs, err := netlink.UnmarshalAttributes(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	var hdr bool
+	for _, attr := range attrs {
+		switch attr.Type & ^uint16(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER) {
+		case nfqaPacketHdr:
+			if len(attr.Data) >= 4 {
+				p.ID = binary.BigEndian.Uint32(attr.Data)
+				hdr = true
+			}
+		case nfqaIfindexIn:
+			if len(attr.Data) == 4 {
+				p.InIndex = binary.BigEndian.Uint32(attr.Data)
+			}
+		case nfqaIfindexOut:
+			if len(attr.Data) == 4 {
+				p.OutIndex = binary.BigEndian.Uint32(attr.Data)
+			}
+		case nfqaPayload:
+			p.Payload = attr.Data
+		}
+	}
+	if !hdr {
+		return nil, fmt.Errorf("packet without NFQA_PACKET_HDR")
+	}
+	return p, nil
+}
+
+// Conn receives packets from an NFQUEUE queue and sends verdicts.
+type Conn struct {
+	c     *netlink.Conn
+	queue uint16
+}
+
+// Listen binds to queue, as used in nftables queue statements (queue num
+// <queue>).
+func Listen(queue uint16) (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params, 0xffff) // copy range
+	params[4] = nfqnlCopyPacket
+	for _, attr := range []netlink.Attribute{
+		// struct nfqnl_msg_config_cmd: command, padding, protocol family
+		{Type: nfqaCfgCmd, Data: []byte{nfqnlCfgCmdBind, 0, 0, 0}},
+		{Type: nfqaCfgParams, Data: params},
+	} {
+		b, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		msg := netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(nfnlSubsysQueue<<8 | nfqnlMsgConfig),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: append(nfgenmsg(unix.AF_UNSPEC, queue), b...),
+		}
+		if _, err := c.Execute(msg); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("configuring NFQUEUE %d: %v", queue, err)
+		}
+	}
+	return &Conn{c: c, queue: queue}, nil
+}
+
+// Receive blocks until queued packets are available.
+func (c *Conn) Receive() ([]*Packet, error) {
+	msgs, err := c.c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	var packets []*Packet
+	for _, msg := range msgs {
+		if msg.Header.Type != netlink.HeaderType(nfnlSubsysQueue<<8|nfqnlMsgPacket) {
+			continue
+		}
+		p, err := parsePacket(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// SetVerdict applies v to the packet with the specified id.
+func (c *Conn) SetVerdict(id uint32, v Verdict) error {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, uint32(v))
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfqaVerdictHdr, Data: hdr},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.c.Send(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysQueue<<8 | nfqnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: append(nfgenmsg(unix.AF_UNSPEC, c.queue), b...),
+	})
+	return err
+}
+
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestParsePacket(t *testing.T) {
+	hdr := make([]byte, 7) // struct nfqnl_msg_packet_hdr
+	binary.BigEndian.PutUint32(hdr, 42)
+	ifindex := make([]byte, 4)
+	binary.BigEndian.PutUint32(ifindex, 2)
+	payload := []byte{0x45, 0x00, 0x00, 0x14}
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfqaPacketHdr, Data: hdr},
+		{Type: nfqaIfindexIn, Data: ifindex},
+		{Type: nfqaPayload, Data: payload},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parsePacket(append(nfgenmsg(unix.NFPROTO_IPV4, 1), attrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.ID, uint32(42); got != want {
+		t.Errorf("ID: got %d, want %d", got, want)
+	}
+	if got, want := p.InIndex, uint32(2); got != want {
+		t.Errorf("InIndex: got %d, want %d", got, want)
+	}
+	if got, want := p.Family, byte(unix.NFPROTO_IPV4); got != want {
+		t.Errorf("Family: got %d, want %d", got, want)
+	}
+	if !bytes.Equal(p.Payload, payload) {
+		t.Errorf("Payload: got %x, want %x", p.Payload, payload)
+	}
+
+	if _, err := parsePacket(nfgenmsg(unix.NFPROTO_IPV4, 1)); err == nil {
+		t.Errorf("parsePacket(<no NFQA_PACKET_HDR>) unexpectedly succeeded")
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "nfqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg, err := ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(cfg.Rules); got != 0 {
+		t.Fatalf("ReadConfig(<missing>): got %d rules, want 0", got)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		cfg     string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			cfg:  `{"rules":[{"name":"ssh","iface":"uplink0","proto":"tcp","port":"22","queue":1,"judge":"/perm/ids"}]}`,
+		},
+		{
+			name:    "port without proto",
+			cfg:     `{"rules":[{"name":"ssh","port":"22","queue":1,"judge":"/perm/ids"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "queue shared by judges",
+			cfg:     `{"rules":[{"name":"a","queue":1,"judge":"/perm/a"},{"name":"b","queue":1,"judge":"/perm/b"}]}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(filepath.Join(tmp, "nfqueue.json"), []byte(tt.cfg), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadConfig(tmp)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("ReadConfig: got err %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessJudge(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "nfqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The judge drops packets whose ID is even and never replies to ID 3.
+	judgePath := filepath.Join(tmp, "judge")
+	const script = `#!/bin/sh
+while read -r line; do
+	id=$(echo "$line" | sed 's/.*"id":\([0-9]*\).*/\1/')
+	case "$id" in
+	3) ;;
+	*[02468]) echo "{\"id\":$id,\"verdict\":\"drop\"}" ;;
+	*) echo "{\"id\":$id,\"verdict\":\"accept\"}" ;;
+	esac
+done
+`
+	if err := ioutil.WriteFile(judgePath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	j := &ProcessJudge{Path: judgePath, Timeout: 1 * time.Second}
+	defer j.Close()
+	for _, tt := range []struct {
+		id      uint32
+		want    Verdict
+		wantErr bool
+	}{
+		{id: 1, want: Accept},
+		{id: 2, want: Drop},
+		{id: 3, wantErr: true},
+		{id: 5, want: Accept}, // judge was restarted
+	} {
+		got, err := j.Judge(&Packet{ID: tt.id, Payload: []byte{0x45}})
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("Judge(%d): got err %v, want error: %v", tt.id, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("Judge(%d): got %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// addr returns the unix socket address of daemon name. Sockets are in the
+// Linux abstract namespace, so that daemons which dropped privileges or
+// cannot write to the file system can still be notified.
+func addr(name string) string {
+	return "@router7/notify/" + name
+}
+
+// handleTimeout bounds the time a notification connection may take, including
+// the reload.
+const handleTimeout = 30 * time.Second
+
+// Listen accepts notifications for daemon name in the background, calling
+// reload for each notification (one at a time) and replying with its result.
+// Close the returned listener to stop accepting notifications.
+func Listen(name string, reload func() error) (net.Listener, error) {
+	ln, err := net.Listen("unix", addr(name))
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex // serializes reloads
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(handleTimeout))
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+					return
+				}
+				mu.Lock()
+				err := reload()
+				mu.Unlock()
+				reply := "ok\n"
+				if err != nil {
+					// Replies are a single line.
+					reply = "error: " + strings.Replace(err.Error(), "\n", " ", -1) + "\n"
+				}
+				conn.Write([]byte(reply))
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// ReloadError is returned by Notify when the daemon received the notification,
+// but failed to reload.
+type ReloadError struct {
+	Daemon string
+	Reason string
+}
+
+func (e *ReloadError) Error() string {
+	return fmt.Sprintf("%s: reload failed: %s", e.Daemon, e.Reason)
+}
+
+func notifyOnce(ctx context.Context, name string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", addr(name))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte("reload\n")); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "ok" {
+		return nil
+	}
+	return &ReloadError{Daemon: name, Reason: strings.TrimPrefix(reply, "error: ")}
+}
+
+// Notify notifies daemon name (see Listen) and returns once the daemon
+// reloaded. Notify retries (e.g. while the daemon is restarting) until ctx is
+// done, but not when the daemon replied that its reload failed (a
+// *ReloadError).
+func Notify(ctx context.Context, name string) error {
+	backoff := 50 * time.Millisecond
+	for {
+		err := notifyOnce(ctx, name)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*ReloadError); ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("notifying %s: %v (last error: %v)", name, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
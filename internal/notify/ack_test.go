@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/notify"
+)
+
+func TestNotify(t *testing.T) {
+	// Abstract socket names are global, so make them unique per test run.
+	name := fmt.Sprintf("notifytest-%d", os.Getpid())
+
+	// reloads and reloadErr are accessed by the listener goroutine.
+	var (
+		mu        sync.Mutex
+		reloads   int
+		reloadErr error
+	)
+	setReloadErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reloadErr = err
+	}
+	ln, err := notify.Listen(name, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		reloads++
+		return reloadErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, canc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer canc()
+	if err := notify.Notify(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got := reloads
+	mu.Unlock()
+	if want := 1; got != want {
+		t.Fatalf("unexpected number of reloads: got %d, want %d", got, want)
+	}
+
+	t.Run("ReloadError", func(t *testing.T) {
+		want := errors.New("leases.json: unexpected EOF")
+		setReloadErr(want)
+		defer setReloadErr(nil)
+		err := notify.Notify(ctx, name)
+		rerr, ok := err.(*notify.ReloadError)
+		if !ok {
+			t.Fatalf("Notify: got %v (%T), want *notify.ReloadError", err, err)
+		}
+		if got, want := rerr.Reason, want.Error(); got != want {
+			t.Errorf("unexpected reason: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		ctx, canc := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer canc()
+		if err := notify.Notify(ctx, name+"-nonexistent"); err == nil {
+			t.Fatalf("Notify unexpectedly succeeded")
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		// The daemon starts listening only after the first attempt failed,
+		// e.g. because it is restarting.
+		late := name + "-late"
+		lnc := make(chan func() error, 1)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			ln, err := notify.Listen(late, func() error { return nil })
+			if err != nil {
+				lnc <- func() error { return err }
+				return
+			}
+			lnc <- ln.Close
+		}()
+		if err := notify.Notify(ctx, late); err != nil {
+			t.Fatal(err)
+		}
+		if err := (<-lnc)(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -12,24 +12,94 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package notify implements sending signals (such as SIGUSR1) to processes.
+// Package notify implements notifying other daemons of changes: sending signals
+// (such as SIGUSR1) to processes, which is fire-and-forget, and acknowledged
+// notifications via unix sockets (see Listen and Notify).
 package notify
 
 import (
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var numericRe = regexp.MustCompile(`^[0-9]+$`)
 
+// Combined is the process name of the binary which runs several daemons in
+// one process, see cmd/router7.
+const Combined = "/user/router7"
+
+type localHandler struct {
+	ch  chan<- os.Signal
+	sig os.Signal
+}
+
+var (
+	localMu sync.Mutex
+	local   = make(map[string][]localHandler) // by daemon name, e.g. dhcp4d
+)
+
+// Signal relays sig to ch, like signal.Notify. In addition, Process relays
+// sig for daemon name (e.g. dhcp4d) to ch when called from the same process,
+// i.e. when the daemons run as components of the combined router7 binary.
+func Signal(ch chan<- os.Signal, name string, sig os.Signal) {
+	signal.Notify(ch, sig)
+	localMu.Lock()
+	defer localMu.Unlock()
+	local[name] = append(local[name], localHandler{ch: ch, sig: sig})
+}
+
+// deliverLocal relays sig to the daemon called name (e.g. /user/dhcp4d) if it
+// runs in this process, and returns whether it does.
+func deliverLocal(name string, sig os.Signal) bool {
+	localMu.Lock()
+	defer localMu.Unlock()
+	handlers, ok := local[path.Base(name)]
+	if !ok {
+		return false
+	}
+	for _, h := range handlers {
+		if h.sig != sig {
+			continue
+		}
+		select {
+		case h.ch <- sig:
+		default:
+			// Like signal.Notify, do not block: a notification is already
+			// pending.
+		}
+	}
+	return true
+}
+
+// Process sends sig to the process called name (e.g. /user/dhcp4d). If the
+// daemon runs in this process, sig is relayed to it (see Signal). If no such
+// process is running, sig is sent to the combined router7 binary (which then
+// relays it to all its daemons), unless that is this process.
 func Process(name string, sig os.Signal) error {
+	if deliverLocal(name, sig) {
+		return nil
+	}
+	found, err := signalProcess(name, sig)
+	if err != nil || found || name == Combined {
+		return err
+	}
+	_, err = signalProcess(Combined, sig)
+	return err
+}
+
+// signalProcess sends sig to the first process (other than this one) whose
+// command line starts with name, and returns whether it found one.
+func signalProcess(name string, sig os.Signal) (bool, error) {
 	fis, err := ioutil.ReadDir("/proc")
 	if err != nil {
-		return err
+		return false, err
 	}
 	for _, fi := range fis {
 		if !fi.IsDir() {
@@ -43,14 +113,17 @@ func Process(name string, sig os.Signal) error {
 			if os.IsNotExist(err) {
 				continue // process vanished
 			}
-			return err
+			return false, err
 		}
 		if !strings.HasPrefix(string(b), name) {
 			continue
 		}
 		pid, _ := strconv.Atoi(fi.Name()) // already verified to be numeric
+		if pid == os.Getpid() {
+			continue
+		}
 		p, _ := os.FindProcess(pid)
-		return p.Signal(sig)
+		return true, p.Signal(sig)
 	}
-	return nil
+	return false, nil
 }
@@ -0,0 +1,52 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rtr7/router7/internal/notify"
+)
+
+func TestProcessLocal(t *testing.T) {
+	usr1 := make(chan os.Signal, 1)
+	notify.Signal(usr1, "notifytest", syscall.SIGUSR1)
+	usr2 := make(chan os.Signal, 1)
+	notify.Signal(usr2, "notifytest", syscall.SIGUSR2)
+
+	for i := 0; i < 2; i++ {
+		// The second notification is coalesced with the pending one.
+		if err := notify.Process("/user/notifytest", syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case sig := <-usr1:
+		if sig != syscall.SIGUSR1 {
+			t.Errorf("unexpected signal: got %v, want %v", sig, syscall.SIGUSR1)
+		}
+	default:
+		t.Fatalf("notification not relayed")
+	}
+	select {
+	case sig := <-usr1:
+		t.Errorf("unexpected second notification %v", sig)
+	case sig := <-usr2:
+		t.Errorf("notification unexpectedly relayed as %v", sig)
+	default:
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ntp implements an SNTP client for querying upstream servers and an
+// SNTP server (RFC 4330) for LAN clients.
+package ntp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+const (
+	modeClient = 3
+	modeServer = 4
+
+	leapNone           = 0
+	leapUnsynchronized = 3
+
+	// StratumUnsynchronized is served until the upstream was queried
+	// successfully.
+	StratumUnsynchronized = 16
+
+	// MaxOffset is the largest offset of the local clock to the upstream at
+	// which the local clock is served as synchronized. ntpd does not correct
+	// the local clock, so a clock which is off must not be passed on.
+	MaxOffset = 128 * time.Millisecond
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the
+// Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+type timestamp uint64
+
+func toTimestamp(t time.Time) timestamp {
+	nsec := uint64(t.Sub(time.Unix(-ntpEpochOffset, 0)))
+	sec := nsec / uint64(time.Second)
+	frac := (nsec % uint64(time.Second)) << 32 / uint64(time.Second)
+	return timestamp(sec<<32 | frac)
+}
+
+func (ts timestamp) Time() time.Time {
+	sec := int64(ts >> 32)
+	nsec := (int64(ts&0xffffffff)*int64(time.Second) + 1<<31) >> 32
+	return time.Unix(sec-ntpEpochOffset, nsec)
+}
+
+// short converts d to the NTP short format (16.16 fixed point seconds).
+func short(d time.Duration) uint32 {
+	if d < 0 {
+		d = 0
+	}
+	return uint32(d * (1 << 16) / time.Second)
+}
+
+func fromShort(s uint32) time.Duration {
+	return time.Duration(uint64(s) * uint64(time.Second) >> 16)
+}
+
+// Packet is an NTP packet, see RFC 5905, section 7.3.
+type Packet struct {
+	Leap           byte
+	Version        byte
+	Mode           byte
+	Stratum        byte
+	Poll           int8
+	Precision      int8
+	RootDelay      uint32
+	RootDispersion uint32
+	RefID          uint32
+	RefTime        timestamp
+	OrigTime       timestamp
+	RecvTime       timestamp
+	XmitTime       timestamp
+}
+
+const packetLen = 48
+
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, packetLen)
+	b[0] = p.Leap<<6 | (p.Version&7)<<3 | p.Mode&7
+	b[1] = p.Stratum
+	b[2] = byte(p.Poll)
+	b[3] = byte(p.Precision)
+	binary.BigEndian.PutUint32(b[4:], p.RootDelay)
+	binary.BigEndian.PutUint32(b[8:], p.RootDispersion)
+	binary.BigEndian.PutUint32(b[12:], p.RefID)
+	binary.BigEndian.PutUint64(b[16:], uint64(p.RefTime))
+	binary.BigEndian.PutUint64(b[24:], uint64(p.OrigTime))
+	binary.BigEndian.PutUint64(b[32:], uint64(p.RecvTime))
+	binary.BigEndian.PutUint64(b[40:], uint64(p.XmitTime))
+	return b
+}
+
+func (p *Packet) Unmarshal(b []byte) error {
+	// Packets can contain extension fields or a MAC, which are ignored.
+	if len(b) < packetLen {
+		return fmt.Errorf("packet too short: got %d bytes, want at least %d", len(b), packetLen)
+	}
+	p.Leap = b[0] >> 6
+	p.Version = (b[0] >> 3) & 7
+	p.Mode = b[0] & 7
+	p.Stratum = b[1]
+	p.Poll = int8(b[2])
+	p.Precision = int8(b[3])
+	p.RootDelay = binary.BigEndian.Uint32(b[4:])
+	p.RootDispersion = binary.BigEndian.Uint32(b[8:])
+	p.RefID = binary.BigEndian.Uint32(b[12:])
+	p.RefTime = timestamp(binary.BigEndian.Uint64(b[16:]))
+	p.OrigTime = timestamp(binary.BigEndian.Uint64(b[24:]))
+	p.RecvTime = timestamp(binary.BigEndian.Uint64(b[32:]))
+	p.XmitTime = timestamp(binary.BigEndian.Uint64(b[40:]))
+	return nil
+}
+
+// Response describes the reply of an upstream server to Query.
+type Response struct {
+	Server    net.IP
+	Stratum   byte
+	Offset    time.Duration // local clock offset: add to the local clock
+	RTT       time.Duration
+	RootDelay time.Duration
+	RootDisp  time.Duration
+}
+
+// Query sends an SNTP request to addr (host:port) and returns the response.
+func Query(ctx context.Context, addr string) (*Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	t1 := time.Now()
+	req := Packet{
+		Version: 4,
+		Mode:    modeClient,
+		// RFC 4330 recommends setting the transmit timestamp so that the
+		// response can be matched against the request.
+		XmitTime: toTimestamp(t1),
+	}
+	if _, err := conn.Write(req.Marshal()); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		t4 := time.Now()
+		var resp Packet
+		if err := resp.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+		if resp.Mode != modeServer || resp.OrigTime != req.XmitTime {
+			continue // not a reply to our request
+		}
+		if resp.Stratum == 0 {
+			return nil, fmt.Errorf("%s: kiss-o'-death %q", addr, refIDString(resp.RefID))
+		}
+		if resp.Leap == leapUnsynchronized || resp.Stratum >= StratumUnsynchronized {
+			return nil, fmt.Errorf("%s: server not synchronized", addr)
+		}
+		t2, t3 := resp.RecvTime.Time(), resp.XmitTime.Time()
+		rtt := t4.Sub(t1) - t3.Sub(t2)
+		if rtt < 0 {
+			rtt = 0
+		}
+		return &Response{
+			Server:    conn.RemoteAddr().(*net.UDPAddr).IP,
+			Stratum:   resp.Stratum,
+			Offset:    (t2.Sub(t1) + t3.Sub(t4)) / 2,
+			RTT:       rtt,
+			RootDelay: fromShort(resp.RootDelay),
+			RootDisp:  fromShort(resp.RootDispersion),
+		}, nil
+	}
+}
+
+func refIDString(id uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	return string(b[:])
+}
+
+// Server answers SNTP requests from the local clock, advertising the state of
+// the most recent upstream synchronization.
+type Server struct {
+	mu       sync.Mutex
+	upstream *Response
+	synced   time.Time
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// NewServer returns a Server which is unsynchronized until SetUpstream is
+// called.
+func NewServer() *Server {
+	return &Server{now: time.Now}
+}
+
+// SetUpstream records a successful upstream query. Pass nil when upstreams
+// could not be reached for too long, to advertise being unsynchronized.
+func (s *Server) SetUpstream(r *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstream = r
+	s.synced = s.now()
+}
+
+// syncedUpstream returns the upstream to which the local clock is
+// synchronized, or nil. s.mu must be held.
+func (s *Server) syncedUpstream() *Response {
+	u := s.upstream
+	if u == nil || u.Offset <= -MaxOffset || u.Offset >= MaxOffset {
+		return nil
+	}
+	return u
+}
+
+// Stratum returns the stratum which is served to clients.
+func (s *Server) Stratum() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.syncedUpstream()
+	if u == nil {
+		return StratumUnsynchronized
+	}
+	return u.Stratum + 1
+}
+
+// Reply returns the reply to the request b, or nil if b is not a valid client
+// request.
+func (s *Server) Reply(b []byte, recv time.Time) []byte {
+	var req Packet
+	if err := req.Unmarshal(b); err != nil {
+		return nil
+	}
+	if req.Mode != modeClient {
+		return nil
+	}
+	reply := Packet{
+		Leap:      leapUnsynchronized,
+		Version:   req.Version,
+		Mode:      modeServer,
+		Stratum:   StratumUnsynchronized,
+		Poll:      req.Poll,
+		Precision: -20, // ≈1µs
+		OrigTime:  req.XmitTime,
+		RecvTime:  toTimestamp(recv),
+	}
+	s.mu.Lock()
+	if u := s.syncedUpstream(); u != nil {
+		reply.Leap = leapNone
+		reply.Stratum = u.Stratum + 1
+		reply.RootDelay = short(u.RootDelay + u.RTT)
+		// Account for the clock drifting since the last synchronization
+		// (15 ppm, as per RFC 5905).
+		drift := time.Duration(float64(s.now().Sub(s.synced)) * 15e-6)
+		reply.RootDispersion = short(u.RootDisp + u.RTT/2 + drift)
+		if ip := u.Server.To4(); ip != nil {
+			reply.RefID = binary.BigEndian.Uint32(ip)
+		} else {
+			// For IPv6 upstreams, RFC 5905 specifies the first 4 bytes of
+			// the MD5 hash of the address. Any value identifying the
+			// upstream is fine for loop detection purposes in SNTP.
+			ip := u.Server.To16()
+			reply.RefID = binary.BigEndian.Uint32(ip[len(ip)-4:])
+		}
+		reply.RefTime = toTimestamp(s.synced)
+	}
+	s.mu.Unlock()
+	reply.XmitTime = toTimestamp(s.now())
+	return reply.Marshal()
+}
+
+// Serve answers requests on pc until pc is closed. Errors sending a reply
+// (e.g. no route to the client) are logged.
+func (s *Server) Serve(pc net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		recv := s.now()
+		reply := s.Reply(buf[:n], recv)
+		if reply == nil {
+			continue
+		}
+		if _, err := pc.WriteTo(reply, addr); err != nil {
+			log.Printf("replying to %v: %v", addr, err)
+		}
+	}
+}
+
+// Listener serves NTP on a UDP address, implementing multilisten.Listener.
+type Listener struct {
+	Addr   string
+	Server *Server
+
+	mu sync.Mutex
+	pc net.PacketConn
+}
+
+func (l *Listener) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", l.Addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.pc = pc
+	l.mu.Unlock()
+	return l.Server.Serve(pc)
+}
+
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pc == nil {
+		return nil
+	}
+	return l.pc.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ntp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	want := time.Date(2018, time.July, 14, 12, 34, 56, 789012000, time.UTC)
+	got := toTimestamp(want).Time()
+	if diff := got.Sub(want); diff < -time.Microsecond || diff > time.Microsecond {
+		t.Fatalf("round trip of %v: got %v", want, got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	srv := NewServer()
+	go srv.Serve(pc)
+
+	ctx, canc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer canc()
+
+	if _, err := Query(ctx, pc.LocalAddr().String()); err == nil ||
+		!strings.Contains(err.Error(), "not synchronized") {
+		t.Fatalf("Query(unsynchronized server): got %v, want not synchronized error", err)
+	}
+
+	srv.SetUpstream(&Response{
+		Server:  net.ParseIP("192.0.2.123"),
+		Stratum: 2,
+	})
+	resp, err := Query(ctx, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Stratum, byte(3); got != want {
+		t.Errorf("unexpected stratum: got %d, want %d", got, want)
+	}
+	// Client and server share the same clock.
+	if resp.Offset < -time.Second || resp.Offset > time.Second {
+		t.Errorf("unexpected offset: got %v, want ≈0", resp.Offset)
+	}
+}
+
+func TestReplyIgnoresNonClients(t *testing.T) {
+	srv := NewServer()
+	req := Packet{Version: 4, Mode: modeServer}
+	if got := srv.Reply(req.Marshal(), time.Now()); got != nil {
+		t.Errorf("Reply(server packet): got %x, want nil", got)
+	}
+	if got := srv.Reply([]byte{0x23}, time.Now()); got != nil {
+		t.Errorf("Reply(short packet): got %x, want nil", got)
+	}
+}
+
+func TestReplyUnsynchronizedOffset(t *testing.T) {
+	srv := NewServer()
+	req := Packet{Version: 4, Mode: modeClient}
+	for _, tt := range []struct {
+		offset  time.Duration
+		stratum byte
+		leap    byte
+	}{
+		{0, 3, leapNone},
+		{-100 * time.Millisecond, 3, leapNone},
+		{MaxOffset, StratumUnsynchronized, leapUnsynchronized},
+		{-5 * time.Minute, StratumUnsynchronized, leapUnsynchronized},
+	} {
+		srv.SetUpstream(&Response{
+			Server:  net.ParseIP("192.0.2.123"),
+			Stratum: 2,
+			Offset:  tt.offset,
+		})
+		var reply Packet
+		if err := reply.Unmarshal(srv.Reply(req.Marshal(), time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Stratum != tt.stratum || reply.Leap != tt.leap {
+			t.Errorf("offset %v: got stratum %d, leap %d, want stratum %d, leap %d", tt.offset, reply.Stratum, reply.Leap, tt.stratum, tt.leap)
+		}
+		if got := srv.Stratum(); got != tt.stratum {
+			t.Errorf("offset %v: Stratum() = %d, want %d", tt.offset, got, tt.stratum)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Message is an MQTT message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+func (d *Device) objectID() string {
+	return "router7_" + strings.Replace(d.HardwareAddr, ":", "", -1)
+}
+
+func (d *Device) location() string {
+	if d.Home {
+		return "home"
+	}
+	return "not_home"
+}
+
+// DiscoveryMessages returns the (retained) MQTT messages which announce d as a
+// device_tracker entity to Home Assistant and publish its state and
+// attributes. See https://www.home-assistant.io/docs/mqtt/discovery/
+func DiscoveryMessages(prefix string, d Device) ([]Message, error) {
+	id := d.objectID()
+	base := "router7/presence/" + id
+	name := d.Name
+	if name == "" {
+		name = d.HardwareAddr
+	}
+	config, err := json.Marshal(map[string]string{
+		"name":                  name,
+		"unique_id":             id,
+		"state_topic":           base + "/state",
+		"json_attributes_topic": base + "/attributes",
+		"payload_home":          "home",
+		"payload_not_home":      "not_home",
+		"source_type":           "router",
+	})
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := json.Marshal(map[string]string{
+		"mac":       d.HardwareAddr,
+		"ip":        d.Addr,
+		"host_name": d.Name,
+		"last_seen": d.LastSeen.Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []Message{
+		{Topic: prefix + "/device_tracker/" + id + "/config", Payload: config, Retain: true},
+		{Topic: base + "/attributes", Payload: attributes, Retain: true},
+		{Topic: base + "/state", Payload: []byte(d.location()), Retain: true},
+	}, nil
+}
+
+// PostREST reports d to Home Assistant by calling the device_tracker.see
+// service via the REST API.
+func PostREST(ctx context.Context, cfg *RESTConfig, d Device) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"dev_id":        d.objectID(),
+		"mac":           d.HardwareAddr,
+		"host_name":     d.Name,
+		"location_name": d.location(),
+		"source_type":   "router",
+		"attributes": map[string]string{
+			"ip":        d.Addr,
+			"last_seen": d.LastSeen.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, canc := context.WithTimeout(ctx, 30*time.Second)
+	defer canc()
+	u := strings.TrimSuffix(cfg.URL, "/") + "/api/services/device_tracker/see"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected HTTP status: %v (%s)", u, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package presence derives whether devices are home from their DHCP leases,
+// for home automation systems such as Home Assistant.
+package presence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+// Device is the presence state of a device.
+type Device struct {
+	HardwareAddr string    `json:"hardware_addr"`
+	Name         string    `json:"name"`
+	Addr         string    `json:"addr"`
+	Home         bool      `json:"home"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// Tracker tracks the presence of devices tagged devices.TagPresence.
+type Tracker struct {
+	// AwayAfter is how long a device must have been absent before it is
+	// considered away, so that e.g. sleeping phones which do not renew their
+	// lease are not reported as away.
+	AwayAfter time.Duration
+
+	state map[string]*Device
+}
+
+// Update updates the presence state from leases and returns the devices whose
+// state changed (all devices on the first call), sorted by MAC address.
+func (t *Tracker) Update(now time.Time, leases []*dhcp4d.Lease, reg *devices.Registry) []Device {
+	first := t.state == nil
+	if first {
+		t.state = make(map[string]*Device)
+	}
+	active := make(map[string]*dhcp4d.Lease)
+	for _, l := range leases {
+		if l.Expired(now) {
+			continue
+		}
+		active[l.HardwareAddr] = l
+	}
+	tracked := make(map[string]bool)
+	var changed []Device
+	for _, hwaddr := range reg.Tagged(devices.TagPresence) {
+		tracked[hwaddr] = true
+		d, ok := t.state[hwaddr]
+		if !ok {
+			d = &Device{HardwareAddr: hwaddr}
+			t.state[hwaddr] = d
+		}
+		before := *d
+		if rd, ok := reg.Lookup(hwaddr); ok {
+			d.Name = rd.Name
+		}
+		if l, ok := active[hwaddr]; ok {
+			d.Home = true
+			d.LastSeen = now
+			d.Addr = l.Addr.String()
+			if d.Name == "" {
+				d.Name = l.Hostname
+			}
+		} else if d.Home && now.Sub(d.LastSeen) >= t.AwayAfter {
+			d.Home = false
+		}
+		if !ok || first || before.Home != d.Home || before.Name != d.Name || before.Addr != d.Addr {
+			changed = append(changed, *d)
+		}
+	}
+	for hwaddr := range t.state {
+		if !tracked[hwaddr] {
+			delete(t.state, hwaddr) // no longer tagged
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].HardwareAddr < changed[j].HardwareAddr
+	})
+	return changed
+}
+
+// Devices returns the presence state of all tracked devices, sorted by MAC
+// address.
+func (t *Tracker) Devices() []Device {
+	result := make([]Device, 0, len(t.state))
+	for _, d := range t.state {
+		result = append(result, *d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].HardwareAddr < result[j].HardwareAddr
+	})
+	return result
+}
+
+// MQTTConfig configures publishing presence via Home Assistant MQTT discovery.
+type MQTTConfig struct {
+	Broker   string `json:"broker"` // e.g. “homeassistant.lan:1883”
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// DiscoveryPrefix defaults to “homeassistant”.
+	DiscoveryPrefix string `json:"discovery_prefix"`
+}
+
+// RESTConfig configures publishing presence via the Home Assistant REST API
+// (device_tracker.see service).
+type RESTConfig struct {
+	URL   string `json:"url"`   // e.g. “http://homeassistant.lan:8123”
+	Token string `json:"token"` // long-lived access token
+}
+
+// Config is the presence configuration, stored in presence.json.
+type Config struct {
+	AwayAfter string      `json:"away_after"` // e.g. “10m”, defaults to 15m
+	MQTT      *MQTTConfig `json:"mqtt"`
+	REST      *RESTConfig `json:"rest"`
+}
+
+// AwayAfterDuration returns the parsed AwayAfter.
+func (c *Config) AwayAfterDuration() (time.Duration, error) {
+	if c.AwayAfter == "" {
+		return 15 * time.Minute, nil
+	}
+	return time.ParseDuration(c.AwayAfter)
+}
+
+// ReadConfig reads presence.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "presence.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if _, err := cfg.AwayAfterDuration(); err != nil {
+		return nil, fmt.Errorf("%s: away_after: %v", fn, err)
+	}
+	if cfg.MQTT != nil && cfg.MQTT.DiscoveryPrefix == "" {
+		cfg.MQTT.DiscoveryPrefix = "homeassistant"
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presence_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/devices"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/presence"
+)
+
+func testRegistry(t *testing.T) *devices.Registry {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const registry = `{
+  "devices": [
+    {"hardware_addr": "00:1f:16:12:34:56", "name": "phone", "tags": ["presence"]},
+    {"hardware_addr": "00:1f:16:aa:bb:cc", "name": "tv"}
+  ]
+}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "devices.json"), []byte(registry), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := devices.Read(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestTracker(t *testing.T) {
+	reg := testRegistry(t)
+	tr := &presence.Tracker{AwayAfter: 10 * time.Minute}
+	now := time.Now()
+	phone := &dhcp4d.Lease{
+		Addr:         net.IP{192, 168, 42, 23},
+		HardwareAddr: "00:1f:16:12:34:56",
+		Expiry:       now.Add(1 * time.Minute),
+	}
+	tv := &dhcp4d.Lease{
+		Addr:         net.IP{192, 168, 42, 42},
+		HardwareAddr: "00:1f:16:aa:bb:cc",
+		Expiry:       now.Add(1 * time.Hour),
+	}
+	leases := []*dhcp4d.Lease{phone, tv}
+
+	changed := tr.Update(now, leases, reg)
+	if got, want := len(changed), 1; got != want {
+		t.Fatalf("unexpected number of changed devices: got %d, want %d (only tagged devices)", got, want)
+	}
+	if !changed[0].Home || changed[0].Name != "phone" || changed[0].Addr != "192.168.42.23" {
+		t.Fatalf("unexpected state: %+v", changed[0])
+	}
+
+	if changed := tr.Update(now.Add(30*time.Second), leases, reg); len(changed) != 0 {
+		t.Fatalf("unexpected changes without state change: %+v", changed)
+	}
+
+	// The lease expires (e.g. sleeping phone), but the phone remains home
+	// until AwayAfter passed.
+	if changed := tr.Update(now.Add(5*time.Minute), leases, reg); len(changed) != 0 {
+		t.Fatalf("unexpected changes before AwayAfter: %+v", changed)
+	}
+	changed = tr.Update(now.Add(11*time.Minute), leases, reg)
+	if got, want := len(changed), 1; got != want {
+		t.Fatalf("unexpected number of changed devices: got %d, want %d", got, want)
+	}
+	if changed[0].Home {
+		t.Fatalf("device unexpectedly still home after AwayAfter")
+	}
+}
+
+func TestDiscoveryMessages(t *testing.T) {
+	msgs, err := presence.DiscoveryMessages("homeassistant", presence.Device{
+		HardwareAddr: "00:1f:16:12:34:56",
+		Name:         "phone",
+		Home:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msgs[0].Topic, "homeassistant/device_tracker/router7_001f16123456/config"; got != want {
+		t.Errorf("unexpected config topic: got %q, want %q", got, want)
+	}
+	var config map[string]string
+	if err := json.Unmarshal(msgs[0].Payload, &config); err != nil {
+		t.Fatal(err)
+	}
+	state := msgs[len(msgs)-1]
+	if got, want := state.Topic, config["state_topic"]; got != want {
+		t.Errorf("state published to %q, but config announces %q", got, want)
+	}
+	if got, want := string(state.Payload), "home"; got != want {
+		t.Errorf("unexpected state: got %q, want %q", got, want)
+	}
+	for _, m := range msgs {
+		if !m.Retain {
+			t.Errorf("message to %q not retained", m.Topic)
+		}
+	}
+}
+
+func TestPostREST(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/services/device_tracker/see" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	cfg := &presence.RESTConfig{URL: srv.URL, Token: "secret"}
+	if err := presence.PostREST(context.Background(), cfg, presence.Device{
+		HardwareAddr: "00:1f:16:12:34:56",
+		Name:         "phone",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := got["location_name"], "not_home"; got != want {
+		t.Fatalf("unexpected location_name: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package privdrop
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// from include/uapi/linux/landlock.h and the (architecture-independent)
+// syscall table, see https://docs.kernel.org/userspace-api/landlock.html
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockRulePathBeneath = 1
+
+	accessFSExecute    = 1 << 0
+	accessFSWriteFile  = 1 << 1
+	accessFSReadFile   = 1 << 2
+	accessFSReadDir    = 1 << 3
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeChar   = 1 << 6
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSock   = 1 << 9
+	accessFSMakeFifo   = 1 << 10
+	accessFSMakeBlock  = 1 << 11
+	accessFSMakeSym    = 1 << 12
+
+	// accessFSAll contains all access rights of Landlock ABI version 1.
+	accessFSAll = 1<<13 - 1
+
+	accessFSReadOnly = accessFSExecute | accessFSReadFile | accessFSReadDir
+)
+
+var errLandlockUnsupported = errors.New("Landlock not supported by the kernel")
+
+func addPathRule(ruleset uintptr, path string, access uint64) error {
+	fd, err := syscall.Open(path, unix.O_PATH|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open(%s): %v", path, err)
+	}
+	defer syscall.Close(fd)
+	// struct landlock_path_beneath_attr is packed: u64 allowed_access, s32 parent_fd
+	var attr [12]byte
+	binary.LittleEndian.PutUint64(attr[0:], access)
+	binary.LittleEndian.PutUint32(attr[8:], uint32(fd))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_add_rule(%s): %v", path, errno)
+	}
+	return nil
+}
+
+// restrictFilesystem makes the entire file system read-only, except for the
+// specified writable directories and files.
+func restrictFilesystem(writable, writableFiles []string) error {
+	handled := uint64(accessFSAll)
+	ruleset, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+			return errLandlockUnsupported
+		}
+		return fmt.Errorf("landlock_create_ruleset: %v", errno)
+	}
+	defer syscall.Close(int(ruleset))
+
+	if err := addPathRule(ruleset, "/", accessFSReadOnly); err != nil {
+		return err
+	}
+	for _, dir := range writable {
+		if err := addPathRule(ruleset, dir, accessFSAll); err != nil {
+			return err
+		}
+	}
+	for _, fn := range writableFiles {
+		// Rules for files may only contain file access rights.
+		if err := addPathRule(ruleset, fn, accessFSReadFile|accessFSWriteFile); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package privdrop implements dropping root privileges once a process has
+// opened all the sockets and files which require them.
+package privdrop
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Config specifies the unprivileged identity to switch to.
+type Config struct {
+	UID int
+	GID int
+
+	// Caps lists the capabilities (e.g. unix.CAP_KILL) to retain after
+	// switching to UID. All other capabilities are dropped.
+	Caps []int
+
+	// Writable lists directories which the process needs to modify after
+	// dropping privileges (e.g. /perm/dhcp4d). They are created if necessary
+	// and recursively chowned to UID/GID. Everything else becomes read-only if
+	// the kernel supports Landlock.
+	Writable []string
+
+	// WritableFiles lists individual files which the process needs to
+	// modify (but not replace or remove) after dropping privileges, e.g. its
+	// audit log in a directory shared with other daemons. They are created if
+	// necessary and chowned to UID/GID, their directories are not.
+	WritableFiles []string
+}
+
+// from include/uapi/linux/capability.h
+const linuxCapabilityVersion3 = 0x20080522
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+func chownAll(dir string, uid, gid int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+func chownFile(path string, uid, gid int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Chown(uid, gid)
+}
+
+func setCaps(caps []int) error {
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	for _, c := range caps {
+		data[c/32].effective |= 1 << uint(c%32)
+		data[c/32].permitted |= 1 << uint(c%32)
+	}
+	// capset(2) only affects the calling thread, so it needs to be applied to
+	// all threads of the Go runtime.
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	return nil
+}
+
+// Drop switches the process to cfg.UID and cfg.GID, retaining only cfg.Caps,
+// and (if supported by the kernel) restricts write access to the file system
+// to cfg.Writable and cfg.WritableFiles. Drop must be called after all privileged resources have been
+// acquired.
+func Drop(cfg Config) error {
+	for _, dir := range cfg.Writable {
+		if err := chownAll(dir, cfg.UID, cfg.GID); err != nil {
+			return err
+		}
+	}
+	for _, fn := range cfg.WritableFiles {
+		if err := chownFile(fn, cfg.UID, cfg.GID); err != nil {
+			return err
+		}
+	}
+
+	// Retain the permitted capability set across setuid(2), allowing us to
+	// selectively re-enable capabilities below.
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_KEEPCAPS): %v", errno)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(cfg.GID); err != nil {
+		return fmt.Errorf("setgid(%d): %v", cfg.GID, err)
+	}
+	if err := syscall.Setuid(cfg.UID); err != nil {
+		return fmt.Errorf("setuid(%d): %v", cfg.UID, err)
+	}
+	if err := setCaps(cfg.Caps); err != nil {
+		return err
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", errno)
+	}
+
+	if err := restrictFilesystem(cfg.Writable, cfg.WritableFiles); err != nil {
+		if err == errLandlockUnsupported {
+			log.Printf("not restricting file system access: %v", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiling implements the /debug/pprof/ endpoints of router7 daemons,
+// which serve Go runtime profiles (e.g. heap, goroutines) for diagnosing
+// memory growth on long-running routers, e.g.:
+//
+//	go tool pprof http://gokrazy:<password>@router7:8053/debug/pprof/heap
+//
+// Unlike net/http/pprof, the endpoints are not registered with
+// http.DefaultServeMux by importing the package, and they are protected by the
+// gokrazy password: profiles reveal memory contents such as addresses or names.
+package profiling
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/auth"
+)
+
+// Prefix is the path under which Handler must be installed.
+const Prefix = "/debug/pprof/"
+
+// maxSeconds limits how long CPU profiles and execution traces run. It is
+// below the write timeout of multilisten.NewHTTPServer (1 minute).
+const maxSeconds = 50
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<title>/debug/pprof/</title>
+<p>Profiles (<code>?debug=1</code> for text, <code>?debug=2</code> for full goroutine stacks):</p>
+<ul>
+{{ range . }}
+<li><a href="{{ .Name }}?debug=1">{{ .Name }}</a> ({{ .Count }})</li>
+{{ end }}
+<li><a href="profile?seconds=30">profile</a> (CPU, 30s)</li>
+<li><a href="trace?seconds=5">trace</a> (execution trace, 5s)</li>
+</ul>
+`))
+
+func seconds(r *http.Request, def int) (time.Duration, error) {
+	sec := def
+	if s := r.FormValue("seconds"); s != "" {
+		var err error
+		sec, err = strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("seconds: %v", err)
+		}
+	}
+	if sec <= 0 || sec > maxSeconds {
+		return 0, fmt.Errorf("seconds must be in [1, %d]", maxSeconds)
+	}
+	return time.Duration(sec) * time.Second, nil
+}
+
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	d, err := seconds(r, 30)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Most likely, another CPU profile is already running.
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+}
+
+func serveTrace(w http.ResponseWriter, r *http.Request) {
+	d, err := seconds(r, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+	trace.Stop()
+}
+
+func serveLookup(w http.ResponseWriter, r *http.Request, name string) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if name == "heap" && r.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	}
+	if err := p.WriteTo(w, debug); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, Prefix)
+		switch name {
+		case "":
+			if err := indexTmpl.Execute(w, pprof.Profiles()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		case "profile":
+			serveProfile(w, r)
+		case "trace":
+			serveTrace(w, r)
+		default:
+			serveLookup(w, r, name)
+		}
+	})
+}
+
+// Handler returns the /debug/pprof/ endpoints, to be installed under Prefix.
+func Handler() http.Handler {
+	return auth.RequirePassword("pprof", handler())
+}
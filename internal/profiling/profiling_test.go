@@ -0,0 +1,57 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	h := handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	if rec := get(Prefix); !strings.Contains(rec.Body.String(), `href="goroutine?debug=1"`) {
+		t.Errorf("index does not link to the goroutine profile: %s", rec.Body.String())
+	}
+
+	rec := get(Prefix + "goroutine?debug=2")
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("goroutine profile: got HTTP status %d, want %d", got, want)
+	}
+	if !strings.Contains(rec.Body.String(), "TestHandler") {
+		t.Errorf("goroutine profile does not contain the test goroutine: %s", rec.Body.String())
+	}
+
+	if rec := get(Prefix + "heap?gc=1"); rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("heap profile: got HTTP status %d with %d bytes, want a profile", rec.Code, rec.Body.Len())
+	}
+
+	for _, path := range []string{
+		"nonexistent",
+		"profile?seconds=3600",
+		"trace?seconds=-1",
+	} {
+		if rec := get(Prefix + path); rec.Code == http.StatusOK {
+			t.Errorf("%s: unexpectedly got HTTP status %d", path, rec.Code)
+		}
+	}
+}
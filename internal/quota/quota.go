@@ -0,0 +1,306 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota tracks the internet traffic of LAN devices against the daily
+// and monthly quotas configured in the device registry.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/renameio"
+
+	"github.com/rtr7/router7/internal/devices"
+)
+
+// Traffic is the current value of the traffic counters of a LAN client, as
+// returned by netconfig.Accounting (which cannot be used here: netconfig
+// imports quota).
+type Traffic struct {
+	Addr         string // e.g. “192.168.42.23”
+	HardwareAddr string // from the DHCPv4 lease of Addr, empty if unknown
+	RxBytes      uint64
+	TxBytes      uint64
+}
+
+// Counters are the traffic counter values of a client at the last update.
+type Counters struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// Usage is the traffic of a device or group within the current periods.
+type Usage struct {
+	Day          time.Time `json:"day"` // start of the current daily period
+	DailyBytes   uint64    `json:"daily_bytes"`
+	Month        time.Time `json:"month"` // start of the current monthly period
+	MonthlyBytes uint64    `json:"monthly_bytes"`
+}
+
+// dayStart returns the start of the daily period containing now.
+func dayStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// monthStart returns the start of the monthly period containing now, which
+// begins on resetDay.
+func monthStart(now time.Time, resetDay int) time.Time {
+	month := now.Month()
+	if now.Day() < resetDay {
+		month--
+	}
+	return time.Date(now.Year(), month, resetDay, 0, 0, 0, 0, now.Location())
+}
+
+// roll resets u if now is past its periods.
+func (u *Usage) roll(q *devices.Quota, now time.Time) {
+	if day := dayStart(now); !u.Day.Equal(day) {
+		u.Day = day
+		u.DailyBytes = 0
+	}
+	if month := monthStart(now, q.ResetDay); !u.Month.Equal(month) {
+		u.Month = month
+		u.MonthlyBytes = 0
+	}
+}
+
+// exceeded returns when the quota q will be restored if u exceeds it, or
+// false.
+func (u *Usage) exceeded(q *devices.Quota) (time.Time, string, bool) {
+	const mb = 1024 * 1024
+	var until time.Time
+	var reason string
+	if q.DailyMB > 0 && u.DailyBytes >= q.DailyMB*mb {
+		until = u.Day.AddDate(0, 0, 1)
+		reason = fmt.Sprintf("daily quota of %d MB", q.DailyMB)
+	}
+	if q.MonthlyMB > 0 && u.MonthlyBytes >= q.MonthlyMB*mb {
+		until = u.Month.AddDate(0, 1, 0)
+		reason = fmt.Sprintf("monthly quota of %d MB", q.MonthlyMB)
+	}
+	return until, reason, !until.IsZero()
+}
+
+// Exceeded is a device which exceeded its own quota or the quota of its group.
+type Exceeded struct {
+	HardwareAddr string    `json:"hardware_addr"`  // e.g. “00:1f:16:12:34:56”
+	Addr         string    `json:"addr,omitempty"` // IPv4 address, if known
+	Action       string    `json:"action"`         // devices.QuotaBlock or devices.QuotaThrottle
+	ThrottleKbps uint64    `json:"throttle_kbps,omitempty"`
+	Until        time.Time `json:"until"`  // next reset of the exceeded quota
+	Reason       string    `json:"reason"` // e.g. “daily quota of 1024 MB (group kids)”
+}
+
+func (e *Exceeded) equal(o *Exceeded) bool {
+	return e.HardwareAddr == o.HardwareAddr &&
+		e.Addr == o.Addr &&
+		e.Action == o.Action &&
+		e.ThrottleKbps == o.ThrottleKbps &&
+		e.Until.Equal(o.Until) &&
+		e.Reason == o.Reason
+}
+
+// State is the quota state, stored in netconfigd/quota.json.
+type State struct {
+	// Counters are keyed by client address.
+	Counters map[string]Counters `json:"counters"`
+
+	// Usage is keyed by subject, i.e. “device:<MAC address>” or
+	// “group:<name>”.
+	Usage map[string]*Usage `json:"usage"`
+
+	Exceeded []*Exceeded `json:"exceeded"`
+}
+
+// Active returns the devices whose quota is exceeded at now.
+func (s *State) Active(now time.Time) []*Exceeded {
+	var active []*Exceeded
+	for _, e := range s.Exceeded {
+		if now.Before(e.Until) {
+			active = append(active, e)
+		}
+	}
+	return active
+}
+
+type subject struct {
+	name  string // e.g. “device:00:1f:16:12:34:56” or “group:kids”
+	quota *devices.Quota
+}
+
+// subjects returns the subjects whose quotas apply to device d: the device
+// itself and/or its group.
+func subjects(r *devices.Registry, d *devices.Device) []subject {
+	var result []subject
+	if d.Quota != nil {
+		result = append(result, subject{"device:" + d.HardwareAddr, d.Quota})
+	}
+	if g, ok := r.Groups[d.Group]; ok && d.Group != "" && g.Quota != nil {
+		result = append(result, subject{"group:" + d.Group, g.Quota})
+	}
+	return result
+}
+
+// Update accounts traffic (the current counter values of all clients) to the
+// devices and groups of r, and re-evaluates which devices exceeded their
+// quota. Update returns whether the set of exceeded devices changed, and the
+// devices which newly exceeded their quota.
+func (s *State) Update(r *devices.Registry, traffic []Traffic, now time.Time) (changed bool, newly []*Exceeded) {
+	if s.Counters == nil {
+		s.Counters = make(map[string]Counters)
+	}
+	if s.Usage == nil {
+		s.Usage = make(map[string]*Usage)
+	}
+
+	quotas := make(map[string]*devices.Quota)
+	if r != nil {
+		for _, d := range r.Devices {
+			for _, subject := range subjects(r, d) {
+				quotas[subject.name] = subject.quota
+			}
+		}
+	}
+	for subject := range s.Usage {
+		if _, ok := quotas[subject]; !ok {
+			delete(s.Usage, subject) // quota removed
+		}
+	}
+	for subject, q := range quotas {
+		u, ok := s.Usage[subject]
+		if !ok {
+			u = &Usage{}
+			s.Usage[subject] = u
+		}
+		u.roll(q, now)
+	}
+
+	counters := make(map[string]Counters, len(traffic))
+	addrs := make(map[string]string) // by MAC address
+	for _, t := range traffic {
+		cur := Counters{RxBytes: t.RxBytes, TxBytes: t.TxBytes}
+		counters[t.Addr] = cur
+		prev := s.Counters[t.Addr]
+		// Counters which went backwards were reset, e.g. by a reboot.
+		if cur.RxBytes < prev.RxBytes || cur.TxBytes < prev.TxBytes {
+			prev = Counters{}
+		}
+		delta := (cur.RxBytes - prev.RxBytes) + (cur.TxBytes - prev.TxBytes)
+		if t.HardwareAddr == "" {
+			continue
+		}
+		addrs[t.HardwareAddr] = t.Addr
+		d, ok := r.Lookup(t.HardwareAddr)
+		if !ok {
+			continue
+		}
+		for _, subject := range subjects(r, d) {
+			u := s.Usage[subject.name]
+			u.DailyBytes += delta
+			u.MonthlyBytes += delta
+		}
+	}
+	// Counters of clients which are no longer accounted are dropped.
+	s.Counters = counters
+
+	prev := make(map[string]*Exceeded, len(s.Exceeded))
+	for _, e := range s.Exceeded {
+		prev[e.HardwareAddr] = e
+	}
+	var exceeded []*Exceeded
+	if r != nil {
+		for _, d := range r.Devices {
+			var e *Exceeded
+			for _, subject := range subjects(r, d) {
+				q := subject.quota
+				until, reason, ok := s.Usage[subject.name].exceeded(q)
+				if !ok || (e != nil && !until.After(e.Until)) {
+					continue
+				}
+				if subject.name != "device:"+d.HardwareAddr {
+					reason += " (group " + d.Group + ")"
+				}
+				e = &Exceeded{
+					HardwareAddr: d.HardwareAddr,
+					Action:       q.Action,
+					Until:        until,
+					Reason:       reason,
+				}
+				if q.Action == devices.QuotaThrottle {
+					e.ThrottleKbps = q.ThrottleKbps
+				}
+			}
+			if e == nil {
+				continue
+			}
+			e.Addr = addrs[d.HardwareAddr]
+			p, ok := prev[d.HardwareAddr]
+			if e.Addr == "" && ok {
+				e.Addr = p.Addr
+			}
+			if !ok {
+				newly = append(newly, e)
+			}
+			if !ok || !p.equal(e) {
+				changed = true
+			}
+			exceeded = append(exceeded, e)
+		}
+	}
+	if len(exceeded) != len(s.Exceeded) {
+		changed = true
+	}
+	sort.Slice(exceeded, func(i, j int) bool {
+		return exceeded[i].HardwareAddr < exceeded[j].HardwareAddr
+	})
+	s.Exceeded = exceeded
+	return changed, newly
+}
+
+// Read reads netconfigd/quota.json from dir. A missing file results in an
+// empty State.
+func Read(dir string) (*State, error) {
+	fn := filepath.Join(dir, "netconfigd", "quota.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{}, nil
+		}
+		return nil, err
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &s, nil
+}
+
+// Write atomically replaces netconfigd/quota.json in dir with s.
+func Write(dir string, s *State) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, "netconfigd", "quota.json")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(fn, b, 0644)
+}
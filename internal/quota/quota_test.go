@@ -0,0 +1,174 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/devices"
+)
+
+const registryJSON = `{
+  "devices": [
+    {"hardware_addr": "00:1f:16:12:34:56", "name": "midna", "quota": {"daily_mb": 1}},
+    {"hardware_addr": "00:1f:16:aa:bb:cc", "name": "switch", "group": "kids"},
+    {"hardware_addr": "00:1f:16:aa:bb:dd", "name": "tablet", "group": "kids"}
+  ],
+  "groups": {
+    "kids": {"quota": {"monthly_mb": 2, "reset_day": 15, "action": "throttle", "throttle_kbps": 500}}
+  }
+}`
+
+const mb = 1024 * 1024
+
+func TestMonthStart(t *testing.T) {
+	for _, tt := range []struct {
+		now      time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{
+			now:      time.Date(2018, 7, 20, 12, 0, 0, 0, time.UTC),
+			resetDay: 15,
+			want:     time.Date(2018, 7, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:      time.Date(2018, 7, 14, 12, 0, 0, 0, time.UTC),
+			resetDay: 15,
+			want:     time.Date(2018, 6, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:      time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			resetDay: 2,
+			want:     time.Date(2017, 12, 2, 0, 0, 0, 0, time.UTC),
+		},
+	} {
+		if got := monthStart(tt.now, tt.resetDay); !got.Equal(tt.want) {
+			t.Errorf("monthStart(%v, %d) = %v, want %v", tt.now, tt.resetDay, got, tt.want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "devices.json"), []byte(registryJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := devices.Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 7, 20, 12, 0, 0, 0, time.UTC)
+	traffic := []Traffic{
+		{Addr: "192.168.42.23", HardwareAddr: "00:1f:16:12:34:56", RxBytes: 512 * 1024, TxBytes: 256 * 1024},
+		{Addr: "192.168.42.24", HardwareAddr: "00:1f:16:aa:bb:cc", RxBytes: 1 * mb},
+		{Addr: "192.168.42.25", HardwareAddr: "00:1f:16:aa:bb:dd", RxBytes: 512 * 1024},
+		{Addr: "192.168.42.26", RxBytes: 10 * mb}, // unknown device
+	}
+	changed, newly := s.Update(r, traffic, now)
+	if changed || len(newly) > 0 {
+		t.Fatalf("Update: quota unexpectedly exceeded: %+v", s.Exceeded)
+	}
+	if got, want := s.Usage["group:kids"].MonthlyBytes, uint64(1536*1024); got != want {
+		t.Errorf("group usage: got %d, want %d", got, want)
+	}
+
+	// Persisting the state must not lose any traffic.
+	if err := Write(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Read(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	traffic[0].RxBytes += 256 * 1024
+	traffic[2].RxBytes += 512 * 1024
+	now = now.Add(1 * time.Minute)
+	changed, newly = s.Update(r, traffic, now)
+	if !changed {
+		t.Errorf("Update: exceeded quotas unexpectedly unchanged")
+	}
+	want := []*Exceeded{
+		{
+			HardwareAddr: "00:1f:16:12:34:56",
+			Addr:         "192.168.42.23",
+			Action:       devices.QuotaBlock,
+			Until:        time.Date(2018, 7, 21, 0, 0, 0, 0, time.UTC),
+			Reason:       "daily quota of 1 MB",
+		},
+		{
+			HardwareAddr: "00:1f:16:aa:bb:cc",
+			Addr:         "192.168.42.24",
+			Action:       devices.QuotaThrottle,
+			ThrottleKbps: 500,
+			Until:        time.Date(2018, 8, 15, 0, 0, 0, 0, time.UTC),
+			Reason:       "monthly quota of 2 MB (group kids)",
+		},
+		{
+			HardwareAddr: "00:1f:16:aa:bb:dd",
+			Addr:         "192.168.42.25",
+			Action:       devices.QuotaThrottle,
+			ThrottleKbps: 500,
+			Until:        time.Date(2018, 8, 15, 0, 0, 0, 0, time.UTC),
+			Reason:       "monthly quota of 2 MB (group kids)",
+		},
+	}
+	if diff := cmp.Diff(want, newly); diff != "" {
+		t.Errorf("Update: newly exceeded: diff (-want +got):\n%s", diff)
+	}
+
+	// Unchanged counters do not change anything.
+	changed, newly = s.Update(r, traffic, now.Add(1*time.Minute))
+	if changed || len(newly) > 0 {
+		t.Errorf("Update: unexpected change (newly exceeded: %+v)", newly)
+	}
+
+	// After a reboot, counters start from zero again.
+	for i := range traffic {
+		traffic[i].RxBytes, traffic[i].TxBytes = 0, 0
+	}
+	traffic[1].RxBytes = 1024
+	s.Update(r, traffic, now.Add(2*time.Minute))
+	if got, want := s.Usage["group:kids"].MonthlyBytes, uint64(2*mb+1024); got != want {
+		t.Errorf("group usage after reboot: got %d, want %d", got, want)
+	}
+
+	// The daily quota is reset at midnight, the monthly quota persists.
+	changed, _ = s.Update(r, traffic, time.Date(2018, 7, 21, 0, 1, 0, 0, time.UTC))
+	if !changed {
+		t.Errorf("Update: daily quota unexpectedly not reset")
+	}
+	if diff := cmp.Diff(want[1:], s.Exceeded); diff != "" {
+		t.Errorf("Update: exceeded after midnight: diff (-want +got):\n%s", diff)
+	}
+	if got := s.Active(time.Date(2018, 8, 15, 0, 0, 1, 0, time.UTC)); len(got) > 0 {
+		t.Errorf("Active: monthly quota unexpectedly still exceeded after reset: %+v", got)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radvd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config is the router advertisement configuration, stored in radvd.json.
+// All fields are optional. Durations are specified in time.ParseDuration
+// syntax, e.g. “30m”.
+type Config struct {
+	// MinInterval and MaxInterval bound the (randomized) time between
+	// unsolicited router advertisements (MinRtrAdvInterval and
+	// MaxRtrAdvInterval in RFC 4861). MaxInterval defaults to 1m,
+	// MinInterval to a third of MaxInterval.
+	MinInterval string `json:"min_interval"`
+	MaxInterval string `json:"max_interval"`
+
+	// RouterLifetime is how long clients use router7 as default router
+	// (default 30m). 0s advertises router7 as not being a default router.
+	RouterLifetime string `json:"router_lifetime"`
+
+	// Managed (M flag, default true) tells clients to obtain addresses via
+	// DHCPv6, Other (O flag) to obtain other configuration (e.g. DNS
+	// servers) via DHCPv6.
+	Managed *bool `json:"managed"`
+	Other   bool  `json:"other"`
+
+	// PreferredLifetime (default 30m) and ValidLifetime (default 2h) apply
+	// to all announced prefixes, unless overridden in Prefixes.
+	PreferredLifetime string `json:"preferred_lifetime"`
+	ValidLifetime     string `json:"valid_lifetime"`
+
+	Prefixes []PrefixLifetimes `json:"prefixes"`
+
+	// Guest, if set, advertises a unique local address prefix instead of the
+	// delegated prefix on a guest interface, so that guests never see the
+	// delegated prefix.
+	Guest *GuestConfig `json:"guest"`
+}
+
+// GuestConfig configures router advertisements on a guest interface.
+type GuestConfig struct {
+	Interface string `json:"interface"` // e.g. “guest0”
+	Prefix    string `json:"prefix"`    // ULA /64, e.g. “fd12:3456:789a:1::/64”
+
+	// NAT66 translates guest traffic to router7’s address within the
+	// delegated prefix (via netconfigd). Otherwise, guests cannot reach the
+	// internet via IPv6 (ULA-only).
+	NAT66 bool `json:"nat66"`
+}
+
+var ula = func() *net.IPNet {
+	_, n, err := net.ParseCIDR("fc00::/7")
+	if err != nil {
+		panic(err)
+	}
+	return n
+}()
+
+// GuestPrefix returns the validated guest prefix, or nil if no guest
+// interface is configured.
+func (c *Config) GuestPrefix() (*net.IPNet, error) {
+	if c.Guest == nil {
+		return nil, nil
+	}
+	if c.Guest.Interface == "" {
+		return nil, fmt.Errorf("guest: interface not set")
+	}
+	_, prefix, err := net.ParseCIDR(c.Guest.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("guest: %v", err)
+	}
+	if ones, bits := prefix.Mask.Size(); !ula.Contains(prefix.IP) || ones != 64 || bits != 128 {
+		return nil, fmt.Errorf("guest: prefix %v is not a unique local address /64 prefix", prefix)
+	}
+	return prefix, nil
+}
+
+// PrefixLifetimes overrides the lifetimes of announced prefixes within
+// Prefix, e.g. “2001:db8::/48”.
+type PrefixLifetimes struct {
+	Prefix            string `json:"prefix"`
+	PreferredLifetime string `json:"preferred_lifetime"`
+	ValidLifetime     string `json:"valid_lifetime"`
+}
+
+// ReadConfig reads radvd.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "radvd.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+// duration parses the duration value s of field, returning def if s is empty.
+func duration(field, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", field, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s: %v is negative", field, d)
+	}
+	return d, nil
+}
+
+type prefixLifetimes struct {
+	prefix           *net.IPNet
+	preferred, valid time.Duration
+}
+
+// settings is a validated Config.
+type settings struct {
+	minInterval, maxInterval time.Duration
+	routerLifetime           time.Duration
+	managed, other           bool
+	preferred, valid         time.Duration
+	prefixes                 []prefixLifetimes
+}
+
+func lifetimes(field, preferredStr, validStr string, defPreferred, defValid time.Duration) (preferred, valid time.Duration, _ error) {
+	preferred, err := duration(field+"preferred_lifetime", preferredStr, defPreferred)
+	if err != nil {
+		return 0, 0, err
+	}
+	valid, err = duration(field+"valid_lifetime", validStr, defValid)
+	if err != nil {
+		return 0, 0, err
+	}
+	if preferred > valid {
+		return 0, 0, fmt.Errorf("%spreferred_lifetime %v exceeds valid_lifetime %v", field, preferred, valid)
+	}
+	return preferred, valid, nil
+}
+
+// settings validates c (limits as per RFC 4861, section 6.2.1) and fills in
+// defaults.
+func (c *Config) settings() (*settings, error) {
+	s := &settings{
+		managed: c.Managed == nil || *c.Managed,
+		other:   c.Other,
+	}
+	var err error
+	if s.maxInterval, err = duration("max_interval", c.MaxInterval, 1*time.Minute); err != nil {
+		return nil, err
+	}
+	if s.maxInterval < 4*time.Second || s.maxInterval > 1800*time.Second {
+		return nil, fmt.Errorf("max_interval %v not within [4s, 30m]", s.maxInterval)
+	}
+	if s.minInterval, err = duration("min_interval", c.MinInterval, s.maxInterval/3); err != nil {
+		return nil, err
+	}
+	if s.minInterval < 3*time.Second || s.minInterval > s.maxInterval*3/4 {
+		return nil, fmt.Errorf("min_interval %v not within [3s, 0.75 * max_interval]", s.minInterval)
+	}
+	if s.routerLifetime, err = duration("router_lifetime", c.RouterLifetime, 30*time.Minute); err != nil {
+		return nil, err
+	}
+	if s.routerLifetime != 0 &&
+		(s.routerLifetime < s.maxInterval || s.routerLifetime > 9000*time.Second) {
+		return nil, fmt.Errorf("router_lifetime %v must be 0 or within [max_interval, 9000s]", s.routerLifetime)
+	}
+	if s.preferred, s.valid, err = lifetimes("", c.PreferredLifetime, c.ValidLifetime, 30*time.Minute, 2*time.Hour); err != nil {
+		return nil, err
+	}
+	for _, p := range c.Prefixes {
+		_, prefix, err := net.ParseCIDR(p.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("prefixes: %v", err)
+		}
+		preferred, valid, err := lifetimes(fmt.Sprintf("prefixes: %s: ", p.Prefix), p.PreferredLifetime, p.ValidLifetime, s.preferred, s.valid)
+		if err != nil {
+			return nil, err
+		}
+		s.prefixes = append(s.prefixes, prefixLifetimes{
+			prefix:    prefix,
+			preferred: preferred,
+			valid:     valid,
+		})
+	}
+	if _, err := c.GuestPrefix(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lifetimes returns the preferred and valid lifetime (in seconds) of the
+// announced prefix, as configured by the first matching prefix override.
+func (s *settings) lifetimes(prefix net.IPNet) (preferred, valid uint32) {
+	preferredLifetime, validLifetime := s.preferred, s.valid
+	for _, p := range s.prefixes {
+		ones, _ := p.prefix.Mask.Size()
+		announced, _ := prefix.Mask.Size()
+		if p.prefix.Contains(prefix.IP) && ones <= announced {
+			preferredLifetime, validLifetime = p.preferred, p.valid
+			break
+		}
+	}
+	return uint32(preferredLifetime.Seconds()), uint32(validLifetime.Seconds())
+}
+
+// flags returns the router advertisement flags byte.
+func (s *settings) flags() byte {
+	var flags byte
+	if s.managed {
+		flags |= 0x80
+	}
+	if s.other {
+		flags |= 0x40
+	}
+	return flags
+}
+
+// interval returns a random time between minInterval and maxInterval to wait
+// before sending the next unsolicited router advertisement.
+func (s *settings) interval() time.Duration {
+	return s.minInterval + time.Duration(rand.Int63n(int64(s.maxInterval-s.minInterval)+1))
+}
+
+// lowPowerInterval returns the time to wait before the next unsolicited router
+// advertisement in low-power mode: as long as possible (at most 30m, the
+// limit of MaxRtrAdvInterval), but short enough for clients to receive three
+// router advertisements within the router lifetime and the prefix lifetimes,
+// so that neither their default route nor their addresses lapse.
+func (s *settings) lowPowerInterval() time.Duration {
+	limit := 1800 * time.Second
+	lifetimes := []time.Duration{s.routerLifetime, s.preferred, s.valid}
+	for _, p := range s.prefixes {
+		lifetimes = append(lifetimes, p.preferred, p.valid)
+	}
+	for _, lifetime := range lifetimes {
+		if lifetime > 0 && lifetime/3 < limit {
+			limit = lifetime / 3
+		}
+	}
+	if limit <= s.maxInterval {
+		return s.interval()
+	}
+	return limit
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radvd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustParseCIDR(s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *n
+}
+
+func TestConfigDefaults(t *testing.T) {
+	s, err := (&Config{}).settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.flags(), byte(0x80); got != want {
+		t.Errorf("unexpected flags: got %#x, want %#x", got, want)
+	}
+	if got, want := s.routerLifetime, 30*time.Minute; got != want {
+		t.Errorf("unexpected router lifetime: got %v, want %v", got, want)
+	}
+	preferred, valid := s.lifetimes(mustParseCIDR("2001:db8::/64"))
+	if got, want := preferred, uint32(1800); got != want {
+		t.Errorf("unexpected preferred lifetime: got %d, want %d", got, want)
+	}
+	if got, want := valid, uint32(7200); got != want {
+		t.Errorf("unexpected valid lifetime: got %d, want %d", got, want)
+	}
+	for i := 0; i < 100; i++ {
+		if got := s.interval(); got < 20*time.Second || got > 1*time.Minute {
+			t.Fatalf("interval %v not within [20s, 1m]", got)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	managed := false
+	cfg := &Config{
+		MinInterval:       "30s",
+		MaxInterval:       "10m",
+		RouterLifetime:    "1h",
+		Managed:           &managed,
+		Other:             true,
+		PreferredLifetime: "1h",
+		ValidLifetime:     "4h",
+		Prefixes: []PrefixLifetimes{
+			{Prefix: "2001:db8:1::/48", PreferredLifetime: "0s", ValidLifetime: "10m"},
+		},
+	}
+	s, err := cfg.settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.flags(), byte(0x40); got != want {
+		t.Errorf("unexpected flags: got %#x, want %#x", got, want)
+	}
+	for _, tt := range []struct {
+		prefix           string
+		preferred, valid uint32
+	}{
+		{"2001:db8::/64", 3600, 14400},
+		{"2001:db8:1:2::/64", 0, 600},
+		{"2001:db8::/32", 3600, 14400}, // larger than the override
+	} {
+		preferred, valid := s.lifetimes(mustParseCIDR(tt.prefix))
+		if preferred != tt.preferred || valid != tt.valid {
+			t.Errorf("lifetimes(%s) = %d, %d, want %d, %d", tt.prefix, preferred, valid, tt.preferred, tt.valid)
+		}
+	}
+}
+
+func TestLowPowerInterval(t *testing.T) {
+	s, err := (&Config{}).settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Limited by the default router lifetime and preferred lifetime (30m).
+	if got, want := s.lowPowerInterval(), 10*time.Minute; got != want {
+		t.Errorf("lowPowerInterval() = %v, want %v", got, want)
+	}
+
+	s, err = (&Config{
+		RouterLifetime:    "2h",
+		PreferredLifetime: "2h",
+		ValidLifetime:     "4h",
+	}).settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.lowPowerInterval(), 30*time.Minute; got != want {
+		t.Errorf("lowPowerInterval() = %v, want %v", got, want)
+	}
+
+	// Lifetimes too short for a longer interval: the regular interval
+	// applies.
+	s, err = (&Config{
+		MaxInterval:    "10m",
+		RouterLifetime: "20m",
+	}).settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if got := s.lowPowerInterval(); got < s.minInterval || got > s.maxInterval {
+			t.Fatalf("lowPowerInterval() = %v, not within [%v, %v]", got, s.minInterval, s.maxInterval)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		cfg  Config
+	}{
+		{"malformed duration", Config{MaxInterval: "10"}},
+		{"max interval too small", Config{MaxInterval: "3s"}},
+		{"min interval too large", Config{MinInterval: "50s"}},
+		{"router lifetime below max interval", Config{RouterLifetime: "30s"}},
+		{"router lifetime too large", Config{RouterLifetime: "3h"}},
+		{"preferred exceeds valid", Config{PreferredLifetime: "3h"}},
+		{"malformed prefix", Config{Prefixes: []PrefixLifetimes{{Prefix: "2001:db8::"}}}},
+		{"guest without interface", Config{Guest: &GuestConfig{Prefix: "fd12:3456:789a:1::/64"}}},
+		{"guest prefix not ULA", Config{Guest: &GuestConfig{Interface: "guest0", Prefix: "2001:db8::/64"}}},
+		{"guest prefix not /64", Config{Guest: &GuestConfig{Interface: "guest0", Prefix: "fd12:3456:789a::/48"}}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, err := tt.cfg.settings(); err == nil {
+				t.Fatalf("settings(%+v) unexpectedly succeeded", tt.cfg)
+			}
+		})
+	}
+}
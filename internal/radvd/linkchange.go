@@ -0,0 +1,41 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radvd
+
+import (
+	"log"
+
+	"github.com/rtr7/router7/internal/linkstate"
+)
+
+// notifyLinkChange subscribes to link and address changes of the served
+// interface and calls AdvertiseNow when the link comes up or an IPv6 address
+// is added (e.g. after a prefix change, or once the link-local address becomes
+// usable).
+func (s *Server) notifyLinkChange() error {
+	return linkstate.Subscribe(linkstate.Filter{
+		Kinds:     linkstate.Link | linkstate.Addr,
+		Interface: s.ifname,
+	}, func(ev linkstate.Event) {
+		switch {
+		case ev.Kind == linkstate.Link && ev.Up:
+			log.Printf("link %s came up, advertising", ev.Name)
+			s.AdvertiseNow()
+		case ev.Kind == linkstate.Addr && ev.Added && ev.Addr.IP.To4() == nil:
+			log.Printf("address %v added, advertising", ev.Addr.IP)
+			s.AdvertiseNow()
+		}
+	})
+}
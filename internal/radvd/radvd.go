@@ -29,17 +29,99 @@ import (
 	"golang.org/x/net/ipv6"
 )
 
+// As per RFC 4861, section 10.
+const (
+	maxInitialAdvertisements = 3
+	minDelayBetweenRAs       = 3 * time.Second
+)
+
 type Server struct {
-	pc     *ipv6.PacketConn
-	ifname string
+	pc      *ipv6.PacketConn
+	ifname  string
+	trigger chan struct{}
 
 	mu       sync.Mutex
 	prefixes []net.IPNet
 	iface    *net.Interface
+	settings *settings
+	lowPower bool
 }
 
 func NewServer() (*Server, error) {
-	return &Server{}, nil
+	settings, err := (&Config{}).settings()
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		settings: settings,
+		trigger:  make(chan struct{}, 1),
+	}, nil
+}
+
+// AdvertiseNow sends maxInitialAdvertisements unsolicited router
+// advertisements in quick succession, e.g. when the LAN link comes up or the
+// prefix changes, so that clients do not need to wait for the next periodic
+// router advertisement.
+func (s *Server) AdvertiseNow() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+		// already triggered
+	}
+}
+
+// advertise periodically sends unsolicited router advertisements.
+func (s *Server) advertise() {
+	var (
+		burst    int
+		lastSent time.Time
+	)
+	for {
+		s.sendAdvertisement(nil) // TODO: handle error
+		lastSent = time.Now()
+		var wait time.Duration
+		if burst > 0 {
+			burst--
+			wait = minDelayBetweenRAs
+		} else {
+			s.mu.Lock()
+			if s.lowPower {
+				wait = s.settings.lowPowerInterval()
+			} else {
+				wait = s.settings.interval()
+			}
+			s.mu.Unlock()
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.trigger:
+			burst = maxInitialAdvertisements - 1
+			if d := minDelayBetweenRAs - time.Since(lastSent); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+}
+
+// SetConfig validates cfg and applies it to subsequent router advertisements.
+func (s *Server) SetConfig(cfg *Config) error {
+	settings, err := cfg.settings()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.settings = settings
+	s.mu.Unlock()
+	return nil
+}
+
+// SetLowPower makes the server send unsolicited router advertisements less
+// often while lowPower is true, see lowpower.Active. Solicited router
+// advertisements are not affected.
+func (s *Server) SetLowPower(lowPower bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lowPower = lowPower
 }
 
 func (s *Server) SetPrefixes(prefixes []net.IPNet) {
@@ -53,11 +135,28 @@ func (s *Server) SetPrefixes(prefixes []net.IPNet) {
 			log.Fatal(err) // interface vanished
 		}
 	}
+	changed := !equalPrefixes(s.prefixes, prefixes)
 	s.prefixes = prefixes
 	s.mu.Unlock()
 	if s.iface != nil {
-		s.sendAdvertisement(nil)
+		if changed {
+			s.AdvertiseNow()
+		} else {
+			s.sendAdvertisement(nil)
+		}
+	}
+}
+
+func equalPrefixes(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx].String() != b[idx].String() {
+			return false
+		}
 	}
+	return true
 }
 
 func (s *Server) Serve(ifname string, conn net.PacketConn) error {
@@ -80,13 +179,16 @@ func (s *Server) Serve(ifname string, conn net.PacketConn) error {
 		return err
 	}
 
-	go func() {
-		for {
-			s.sendAdvertisement(nil) // TODO: handle error
-			time.Sleep(1 * time.Minute)
-		}
-	}()
+	if err := s.notifyLinkChange(); err != nil {
+		return err
+	}
+	go s.advertise()
 
+	// Solicitations are answered with a router advertisement sent directly
+	// to the soliciting host, so that joining hosts do not need to wait for
+	// the next periodic advertisement and sleeping hosts are not woken up by
+	// multicast advertisements meant for others (see RFC 7772).
+	limiter := newSolicitLimiter(minDelayBetweenRAs)
 	// A 512 bytes buffer is sufficient for router solicitation packets, which
 	// are basically empty.
 	buf := make([]byte, 512)
@@ -100,8 +202,17 @@ func (s *Server) Serve(ifname string, conn net.PacketConn) error {
 			ipv6.ICMPType(buf[0]) != ipv6.ICMPTypeRouterSolicitation {
 			continue
 		}
-		if err := s.sendAdvertisement(addr); err != nil {
-			return err
+		dst := solicitedDestination(addr)
+		host := "ff02::1" // all hosts without address share one limit
+		if dst != nil {
+			host = dst.String()
+		}
+		if !limiter.allow(host, time.Now()) {
+			continue
+		}
+		if err := s.sendAdvertisement(dst); err != nil {
+			// The soliciting host might have left the link already.
+			log.Printf("responding to solicitation from %v: %v", addr, err)
 		}
 	}
 
@@ -201,12 +312,13 @@ func (s *Server) sendAdvertisement(addr net.Addr) error {
 	}
 	// TODO: cache the packet
 	msgbody := []byte{
-		0x40,       // hop limit: 64
-		0x80,       // flags: managed address configuration
-		0x07, 0x08, // router lifetime (s): 1800
+		0x40,               // hop limit: 64
+		s.settings.flags(), // flags: managed/other configuration
+		0x00, 0x00,         // router lifetime (s), filled in below
 		0x00, 0x00, 0x00, 0x00, // reachable time (ms): 0
 		0x00, 0x00, 0x00, 0x00, // retrans time (ms): 0
 	}
+	binary.BigEndian.PutUint16(msgbody[2:], uint16(s.settings.routerLifetime.Seconds()))
 
 	options := layers.ICMPv6Options{
 		(sourceLinkLayerAddress{address: s.iface.HardwareAddr}).Marshal(),
@@ -221,11 +333,12 @@ func (s *Server) sendAdvertisement(addr net.Addr) error {
 
 		var net [16]byte
 		copy(net[:], prefix.IP)
+		preferred, valid := s.settings.lifetimes(prefix)
 		options = append(options, (prefixInfo{
 			prefixLength:      byte(ones),
 			flags:             0xc0, // TODO
-			validLifetime:     7200, // seconds
-			preferredLifetime: 1800, // seconds
+			validLifetime:     valid,
+			preferredLifetime: preferred,
 			prefix:            net,
 		}).Marshal())
 	}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radvd
+
+import (
+	"net"
+	"time"
+)
+
+// maxSolicitors bounds the number of hosts whose most recent solicited router
+// advertisement is remembered.
+const maxSolicitors = 1024
+
+// solicitLimiter limits solicited router advertisements to one per interval
+// for each host, so that hosts which solicit repeatedly (e.g. WiFi clients
+// roaming between access points) cannot make radvd flood the link.
+type solicitLimiter struct {
+	interval time.Duration
+	last     map[string]time.Time // by source address
+}
+
+func newSolicitLimiter(interval time.Duration) *solicitLimiter {
+	return &solicitLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow returns whether a router advertisement may be sent in response to a
+// solicitation from host at now, and records it if so.
+func (l *solicitLimiter) allow(host string, now time.Time) bool {
+	if last, ok := l.last[host]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	if len(l.last) >= maxSolicitors {
+		for h, last := range l.last {
+			if now.Sub(last) >= l.interval {
+				delete(l.last, h)
+			}
+		}
+		if len(l.last) >= maxSolicitors {
+			return false
+		}
+	}
+	l.last[host] = now
+	return true
+}
+
+// solicitedDestination returns the destination of the router advertisement
+// in response to a solicitation from src: the soliciting host itself, or the
+// all-nodes multicast group (nil) if the host has no address yet, see RFC
+// 4861, section 6.2.6.
+func solicitedDestination(src net.Addr) net.Addr {
+	ipaddr, ok := src.(*net.IPAddr)
+	if !ok || ipaddr.IP.IsUnspecified() {
+		return nil
+	}
+	return src
+}
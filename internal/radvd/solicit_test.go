@@ -0,0 +1,68 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radvd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSolicitLimiter(t *testing.T) {
+	l := newSolicitLimiter(3 * time.Second)
+	now := time.Now()
+	for _, tt := range []struct {
+		host  string
+		at    time.Duration
+		allow bool
+	}{
+		{"fe80::1%lan0", 0, true},
+		{"fe80::1%lan0", 1 * time.Second, false},
+		{"fe80::2%lan0", 1 * time.Second, true},
+		{"fe80::1%lan0", 3 * time.Second, true},
+		{"fe80::2%lan0", 2 * time.Second, false},
+	} {
+		if got := l.allow(tt.host, now.Add(tt.at)); got != tt.allow {
+			t.Errorf("allow(%s, +%v) = %v, want %v", tt.host, tt.at, got, tt.allow)
+		}
+	}
+
+	// Once full, expired entries make room for new hosts.
+	l = newSolicitLimiter(3 * time.Second)
+	for i := 0; i < maxSolicitors; i++ {
+		l.allow(fmt.Sprintf("fe80::%x%%lan0", i), now)
+	}
+	if l.allow("fe80::ffff%lan0", now.Add(1*time.Second)) {
+		t.Errorf("allow unexpectedly succeeded while tracking %d hosts", maxSolicitors)
+	}
+	if !l.allow("fe80::ffff%lan0", now.Add(3*time.Second)) {
+		t.Errorf("allow unexpectedly failed after entries expired")
+	}
+	if got, want := len(l.last), 1; got != want {
+		t.Errorf("unexpected number of tracked hosts: got %d, want %d", got, want)
+	}
+}
+
+func TestSolicitedDestination(t *testing.T) {
+	unicast := &net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "lan0"}
+	if got := solicitedDestination(unicast); got != unicast {
+		t.Errorf("solicitedDestination(%v) = %v, want %v", unicast, got, unicast)
+	}
+	unspecified := &net.IPAddr{IP: net.IPv6unspecified, Zone: "lan0"}
+	if got := solicitedDestination(unspecified); got != nil {
+		t.Errorf("solicitedDestination(%v) = %v, want nil (multicast)", unspecified, got)
+	}
+}
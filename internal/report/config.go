@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Report periods.
+const (
+	Daily  = "daily"
+	Weekly = "weekly"
+)
+
+// Config is the reporting configuration, stored in report.json.
+type Config struct {
+	Daily  bool `json:"daily"`
+	Weekly bool `json:"weekly"`
+
+	// Hour is the local hour at which reports are sent, defaults to 7.
+	Hour *int `json:"hour"`
+
+	// Weekday is the day on which weekly reports are sent, defaults to
+	// “monday”.
+	Weekday string `json:"weekday"`
+
+	// Email sends reports via the SMTP relay and to the recipients
+	// configured in alert.json.
+	Email bool `json:"email"`
+
+	// WebhookURL receives reports as JSON in an HTTP POST request.
+	WebhookURL string `json:"webhook_url"`
+
+	// Top is the number of top talkers and blocked domains listed, defaults
+	// to 10.
+	Top int `json:"top"`
+
+	hour    int
+	weekday time.Weekday
+}
+
+// Periods returns the enabled report periods.
+func (c *Config) Periods() []string {
+	var periods []string
+	if c.Daily {
+		periods = append(periods, Daily)
+	}
+	if c.Weekly {
+		periods = append(periods, Weekly)
+	}
+	return periods
+}
+
+// ReadConfig reads report.json from dir. A missing file results in a Config
+// which sends no reports.
+func ReadConfig(dir string) (*Config, error) {
+	cfg := &Config{}
+	fn := filepath.Join(dir, "report.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	cfg.hour = 7
+	if cfg.Hour != nil {
+		cfg.hour = *cfg.Hour
+	}
+	if cfg.hour < 0 || cfg.hour > 23 {
+		return nil, fmt.Errorf("%s: hour %d out of range [0, 23]", fn, cfg.hour)
+	}
+	if cfg.Weekday == "" {
+		cfg.Weekday = "monday"
+	}
+	found := false
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), cfg.Weekday) {
+			cfg.weekday = d
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: unknown weekday %q", fn, cfg.Weekday)
+	}
+	if cfg.Top == 0 {
+		cfg.Top = 10
+	}
+	return cfg, nil
+}
+
+// Due returns the time at which the most recent report of period was due at
+// now, i.e. the end of the period which it covers.
+func (c *Config) Due(period string, now time.Time) time.Time {
+	due := time.Date(now.Year(), now.Month(), now.Day(), c.hour, 0, 0, 0, now.Location())
+	if due.After(now) {
+		due = due.AddDate(0, 0, -1)
+	}
+	if period == Weekly {
+		for due.Weekday() != c.weekday {
+			due = due.AddDate(0, 0, -1)
+		}
+	}
+	return due
+}
+
+// Length returns the duration covered by reports of period.
+func Length(period string) time.Duration {
+	if period == Weekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
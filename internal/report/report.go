@@ -0,0 +1,387 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report assembles daily and weekly summaries of the router’s
+// operation (new devices, top talkers, blocked DNS queries, WAN outages and
+// latency) from the uplink health history, the per-client traffic counters,
+// the DHCPv4 leases and the threat-intelligence hits of dnsd.
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+
+	"github.com/rtr7/router7/internal/history"
+	"github.com/rtr7/router7/internal/threatintel"
+)
+
+// Lease is a non-expired DHCPv4 lease.
+type Lease struct {
+	Addr         string
+	HardwareAddr string
+	Hostname     string
+}
+
+// Traffic is the current value of the traffic counters of a LAN client, see
+// netconfig.Accounting.
+type Traffic struct {
+	Addr    string
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// Input is the data from which reports are assembled.
+type Input struct {
+	Samples []history.Sample
+	Leases  []Lease
+	Traffic []Traffic
+	Blocked []threatintel.Hit // as far as retained by dnsd
+}
+
+// Device is a device which was first seen within the report period.
+type Device struct {
+	HardwareAddr string    `json:"hardware_addr"`
+	Addr         string    `json:"addr,omitempty"`
+	Hostname     string    `json:"hostname,omitempty"`
+	FirstSeen    time.Time `json:"first_seen"`
+}
+
+// Talker is the traffic which a LAN client forwarded within the report
+// period.
+type Talker struct {
+	Addr     string `json:"addr"`
+	Hostname string `json:"hostname,omitempty"`
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+}
+
+// Blocked is a domain whose queries dnsd blocked within the report period.
+type Blocked struct {
+	Name    string   `json:"name"`
+	Feed    string   `json:"feed"`
+	Count   int      `json:"count"`
+	Clients []string `json:"clients"` // hostnames or IP addresses
+}
+
+// Outage is a period in which the uplink was down or lost all probes.
+type Outage struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Report is a summary of the period From to To.
+type Report struct {
+	Period       string    `json:"period"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	NewDevices   []Device  `json:"new_devices"`
+	TopTalkers   []Talker  `json:"top_talkers"`
+	BlockedDNS   []Blocked `json:"blocked_dns"`
+	BlockedTotal int       `json:"blocked_total"`
+	Outages      []Outage  `json:"wan_outages"`
+	AvgRTT       float64   `json:"avg_rtt_ms"` // 0 if unknown
+	Loss         float64   `json:"loss"`       // fraction of lost probes
+}
+
+// Counters are the traffic counter values of a client.
+type Counters struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// State is the reporting state, stored in diagd/reports.json.
+type State struct {
+	// FirstSeen is keyed by MAC address.
+	FirstSeen map[string]time.Time `json:"first_seen"`
+
+	// Sent is the end of the most recently sent report, by period.
+	Sent map[string]time.Time `json:"sent"`
+
+	// Baselines are the traffic counters at the end of the most recently
+	// sent report, by period and client address.
+	Baselines map[string]map[string]Counters `json:"baselines"`
+}
+
+// Observe records the first sighting of the devices of leases. Observe
+// returns whether new devices were recorded.
+func (s *State) Observe(leases []Lease, now time.Time) bool {
+	if s.FirstSeen == nil {
+		s.FirstSeen = make(map[string]time.Time)
+	}
+	changed := false
+	for _, l := range leases {
+		if _, ok := s.FirstSeen[l.HardwareAddr]; !ok {
+			s.FirstSeen[l.HardwareAddr] = now
+			changed = true
+		}
+	}
+	return changed
+}
+
+// outages returns the contiguous runs of failed samples.
+func outages(samples []history.Sample) []Outage {
+	var result []Outage
+	var cur *Outage
+	for _, s := range samples {
+		failed := !s.Up || s.Loss >= 1
+		if failed {
+			if cur == nil {
+				cur = &Outage{From: s.Time}
+			}
+			cur.To = s.Time.Add(1 * time.Minute) // samples are taken once a minute
+			continue
+		}
+		if cur != nil {
+			cur.To = s.Time
+			result = append(result, *cur)
+			cur = nil
+		}
+	}
+	if cur != nil {
+		result = append(result, *cur)
+	}
+	return result
+}
+
+// Build assembles the report of period ending at to from in. Build does not
+// modify s, see Commit.
+func (s *State) Build(cfg *Config, period string, to time.Time, in Input) *Report {
+	from := to.Add(-Length(period))
+	r := &Report{
+		Period: period,
+		From:   from,
+		To:     to,
+	}
+
+	hostnames := make(map[string]string) // by address
+	for _, l := range in.Leases {
+		hostnames[l.Addr] = l.Hostname
+	}
+
+	for _, l := range in.Leases {
+		first, ok := s.FirstSeen[l.HardwareAddr]
+		if ok && !first.After(from) {
+			continue
+		}
+		if !ok {
+			first = to
+		}
+		r.NewDevices = append(r.NewDevices, Device{
+			HardwareAddr: l.HardwareAddr,
+			Addr:         l.Addr,
+			Hostname:     l.Hostname,
+			FirstSeen:    first,
+		})
+	}
+	sort.Slice(r.NewDevices, func(i, j int) bool {
+		return r.NewDevices[i].FirstSeen.Before(r.NewDevices[j].FirstSeen)
+	})
+
+	baseline := s.Baselines[period]
+	for _, t := range in.Traffic {
+		base := baseline[t.Addr]
+		// Counters which went backwards were reset, e.g. by a reboot.
+		if t.RxBytes < base.RxBytes || t.TxBytes < base.TxBytes {
+			base = Counters{}
+		}
+		talker := Talker{
+			Addr:     t.Addr,
+			Hostname: hostnames[t.Addr],
+			RxBytes:  t.RxBytes - base.RxBytes,
+			TxBytes:  t.TxBytes - base.TxBytes,
+		}
+		if talker.RxBytes+talker.TxBytes == 0 {
+			continue
+		}
+		r.TopTalkers = append(r.TopTalkers, talker)
+	}
+	sort.Slice(r.TopTalkers, func(i, j int) bool {
+		ti, tj := r.TopTalkers[i], r.TopTalkers[j]
+		return ti.RxBytes+ti.TxBytes > tj.RxBytes+tj.TxBytes
+	})
+	if len(r.TopTalkers) > cfg.Top {
+		r.TopTalkers = r.TopTalkers[:cfg.Top]
+	}
+
+	byName := make(map[string]*Blocked)
+	for _, hit := range in.Blocked {
+		if !hit.Time.After(from) || hit.Time.After(to) {
+			continue
+		}
+		r.BlockedTotal++
+		b, ok := byName[hit.Name]
+		if !ok {
+			b = &Blocked{Name: hit.Name, Feed: hit.Feed}
+			byName[hit.Name] = b
+		}
+		b.Count++
+		client := hit.Hostname
+		if client == "" {
+			client = hit.Client
+		}
+		known := false
+		for _, c := range b.Clients {
+			known = known || c == client
+		}
+		if !known {
+			b.Clients = append(b.Clients, client)
+		}
+	}
+	for _, b := range byName {
+		r.BlockedDNS = append(r.BlockedDNS, *b)
+	}
+	sort.Slice(r.BlockedDNS, func(i, j int) bool {
+		bi, bj := r.BlockedDNS[i], r.BlockedDNS[j]
+		if bi.Count != bj.Count {
+			return bi.Count > bj.Count
+		}
+		return bi.Name < bj.Name
+	})
+	if len(r.BlockedDNS) > cfg.Top {
+		r.BlockedDNS = r.BlockedDNS[:cfg.Top]
+	}
+
+	var samples []history.Sample
+	for _, sample := range in.Samples {
+		if sample.Time.After(from) && !sample.Time.After(to) {
+			samples = append(samples, sample)
+		}
+	}
+	r.Outages = outages(samples)
+	var rtt, loss float64
+	var rttSamples int
+	for _, sample := range samples {
+		loss += sample.Loss
+		if sample.RTT > 0 {
+			rtt += sample.RTT
+			rttSamples++
+		}
+	}
+	if rttSamples > 0 {
+		r.AvgRTT = rtt / float64(rttSamples)
+	}
+	if len(samples) > 0 {
+		r.Loss = loss / float64(len(samples))
+	}
+	return r
+}
+
+// Commit records that the report of period ending at to was sent, so that
+// the next report covers the traffic from now on.
+func (s *State) Commit(period string, to time.Time, in Input) {
+	s.Observe(in.Leases, to)
+	if s.Sent == nil {
+		s.Sent = make(map[string]time.Time)
+	}
+	s.Sent[period] = to
+	if s.Baselines == nil {
+		s.Baselines = make(map[string]map[string]Counters)
+	}
+	baseline := make(map[string]Counters, len(in.Traffic))
+	for _, t := range in.Traffic {
+		baseline[t.Addr] = Counters{RxBytes: t.RxBytes, TxBytes: t.TxBytes}
+	}
+	s.Baselines[period] = baseline
+}
+
+// Downtime returns the total duration of the outages.
+func (r *Report) Downtime() time.Duration {
+	var total time.Duration
+	for _, o := range r.Outages {
+		total += o.To.Sub(o.From)
+	}
+	return total
+}
+
+// Subject returns the subject of the report e-mail.
+func (r *Report) Subject() string {
+	return fmt.Sprintf("%s%s report for %s", strings.ToUpper(r.Period[:1]), r.Period[1:], r.To.Format("2006-01-02"))
+}
+
+// MB formats bytes in megabytes.
+func MB(bytes uint64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+}
+
+// Text returns the report as plain text, e.g. for e-mails.
+func (r *Report) Text() string {
+	var buf bytes.Buffer
+	const layout = "2006-01-02 15:04"
+	fmt.Fprintf(&buf, "router7 %s report, %s to %s\n", r.Period, r.From.Format(layout), r.To.Format(layout))
+
+	fmt.Fprintf(&buf, "\nWAN: %d outages (%v down), average latency %.1f ms, %.1f%% packet loss\n",
+		len(r.Outages), r.Downtime(), r.AvgRTT, r.Loss*100)
+	for _, o := range r.Outages {
+		fmt.Fprintf(&buf, "  %s to %s\n", o.From.Format(layout), o.To.Format(layout))
+	}
+
+	fmt.Fprintf(&buf, "\nNew devices: %d\n", len(r.NewDevices))
+	for _, d := range r.NewDevices {
+		fmt.Fprintf(&buf, "  %s  %-15s  %s (first seen %s)\n", d.HardwareAddr, d.Addr, d.Hostname, d.FirstSeen.Format(layout))
+	}
+
+	fmt.Fprintf(&buf, "\nTop talkers:\n")
+	if len(r.TopTalkers) == 0 {
+		fmt.Fprintf(&buf, "  (none; is traffic accounting enabled in /perm/accounting.json?)\n")
+	}
+	for _, t := range r.TopTalkers {
+		fmt.Fprintf(&buf, "  %-15s  %-20s  %s received, %s sent\n", t.Addr, t.Hostname, MB(t.RxBytes), MB(t.TxBytes))
+	}
+
+	fmt.Fprintf(&buf, "\nBlocked DNS queries: %d\n", r.BlockedTotal)
+	for _, b := range r.BlockedDNS {
+		fmt.Fprintf(&buf, "  %dx %s (%s) by %s\n", b.Count, b.Name, b.Feed, strings.Join(b.Clients, ", "))
+	}
+	return buf.String()
+}
+
+// ReadState reads diagd/reports.json from dir. A missing file results in an
+// empty State.
+func ReadState(dir string) (*State, error) {
+	fn := filepath.Join(dir, "diagd", "reports.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{}, nil
+		}
+		return nil, err
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &s, nil
+}
+
+// WriteState atomically replaces diagd/reports.json in dir with s.
+func WriteState(dir string, s *State) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, "diagd", "reports.json")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(fn, b, 0644)
+}
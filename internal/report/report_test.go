@@ -0,0 +1,151 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/history"
+	"github.com/rtr7/router7/internal/threatintel"
+)
+
+func TestDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "report.json"), []byte(`{"daily": true, "weekly": true, "weekday": "Sunday"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2018-07-04 is a Wednesday.
+	for _, tt := range []struct {
+		period string
+		now    time.Time
+		want   time.Time
+	}{
+		{Daily, time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC), time.Date(2018, 7, 4, 7, 0, 0, 0, time.UTC)},
+		{Daily, time.Date(2018, 7, 4, 6, 59, 0, 0, time.UTC), time.Date(2018, 7, 3, 7, 0, 0, 0, time.UTC)},
+		{Weekly, time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC), time.Date(2018, 7, 1, 7, 0, 0, 0, time.UTC)},
+		{Weekly, time.Date(2018, 7, 1, 6, 0, 0, 0, time.UTC), time.Date(2018, 6, 24, 7, 0, 0, 0, time.UTC)},
+	} {
+		if got := cfg.Due(tt.period, tt.now); !got.Equal(tt.want) {
+			t.Errorf("Due(%s, %v) = %v, want %v", tt.period, tt.now, got, tt.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "report.json"), []byte(`{"weekly": true, "weekday": "someday"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(dir); err == nil {
+		t.Errorf("ReadConfig unexpectedly accepted an unknown weekday")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	cfg := &Config{Top: 2}
+	to := time.Date(2018, 7, 4, 7, 0, 0, 0, time.UTC)
+	s := &State{}
+	old := []Lease{
+		{Addr: "192.168.42.23", HardwareAddr: "00:1f:16:12:34:56", Hostname: "midna"},
+	}
+	s.Observe(old, to.Add(-48*time.Hour))
+	s.Commit(Daily, to.Add(-24*time.Hour), Input{
+		Traffic: []Traffic{
+			{Addr: "192.168.42.23", RxBytes: 1000, TxBytes: 100},
+			{Addr: "192.168.42.24", RxBytes: 5000, TxBytes: 500},
+		},
+	})
+
+	newSeen := to.Add(-1 * time.Hour)
+	s.Observe([]Lease{{Addr: "192.168.42.25", HardwareAddr: "00:1f:16:aa:bb:cc", Hostname: "tv"}}, newSeen)
+	in := Input{
+		Leases: append(old,
+			Lease{Addr: "192.168.42.25", HardwareAddr: "00:1f:16:aa:bb:cc", Hostname: "tv"},
+			Lease{Addr: "192.168.42.26", HardwareAddr: "00:1f:16:aa:bb:dd"}),
+		Traffic: []Traffic{
+			{Addr: "192.168.42.23", RxBytes: 3000, TxBytes: 300},
+			{Addr: "192.168.42.24", RxBytes: 100, TxBytes: 10}, // reset
+			{Addr: "192.168.42.25", RxBytes: 1 << 20, TxBytes: 0},
+		},
+		Samples: []history.Sample{
+			{Time: to.Add(-25 * time.Hour), Up: false}, // outside of the period
+			{Time: to.Add(-3 * time.Hour), Up: true, RTT: 10},
+			{Time: to.Add(-3*time.Hour + 1*time.Minute), Up: true, Loss: 1},
+			{Time: to.Add(-3*time.Hour + 2*time.Minute), Up: false, Loss: 1},
+			{Time: to.Add(-3*time.Hour + 3*time.Minute), Up: true, RTT: 20},
+		},
+		Blocked: []threatintel.Hit{
+			{Time: to.Add(-2 * time.Hour), Client: "192.168.42.25", Hostname: "tv", Name: "evil.example", Feed: "urlhaus"},
+			{Time: to.Add(-1 * time.Hour), Client: "192.168.42.26", Name: "evil.example", Feed: "urlhaus"},
+			{Time: to.Add(-1 * time.Hour), Client: "192.168.42.25", Hostname: "tv", Name: "bad.example", Feed: "urlhaus"},
+			{Time: to.Add(-30 * time.Hour), Client: "192.168.42.25", Name: "old.example", Feed: "urlhaus"},
+		},
+	}
+	got := s.Build(cfg, Daily, to, in)
+	want := &Report{
+		Period: Daily,
+		From:   to.Add(-24 * time.Hour),
+		To:     to,
+		NewDevices: []Device{
+			{HardwareAddr: "00:1f:16:aa:bb:cc", Addr: "192.168.42.25", Hostname: "tv", FirstSeen: newSeen},
+			{HardwareAddr: "00:1f:16:aa:bb:dd", Addr: "192.168.42.26", FirstSeen: to},
+		},
+		TopTalkers: []Talker{
+			{Addr: "192.168.42.25", Hostname: "tv", RxBytes: 1 << 20},
+			{Addr: "192.168.42.23", Hostname: "midna", RxBytes: 2000, TxBytes: 200},
+		},
+		BlockedDNS: []Blocked{
+			{Name: "evil.example", Feed: "urlhaus", Count: 2, Clients: []string{"tv", "192.168.42.26"}},
+			{Name: "bad.example", Feed: "urlhaus", Count: 1, Clients: []string{"tv"}},
+		},
+		BlockedTotal: 3,
+		Outages: []Outage{
+			{From: to.Add(-3*time.Hour + 1*time.Minute), To: to.Add(-3*time.Hour + 3*time.Minute)},
+		},
+		AvgRTT: 15,
+		Loss:   0.5,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Build: diff (-want +got):\n%s", diff)
+	}
+	if got, want := got.Downtime(), 2*time.Minute; got != want {
+		t.Errorf("Downtime() = %v, want %v", got, want)
+	}
+	if text := got.Text(); !strings.Contains(text, "evil.example") {
+		t.Errorf("Text() does not mention blocked domain evil.example:\n%s", text)
+	}
+	if got, want := got.Subject(), "Daily report for 2018-07-04"; got != want {
+		t.Errorf("Subject() = %q, want %q", got, want)
+	}
+
+	// After committing, the next report only covers new traffic and devices.
+	s.Commit(Daily, to, in)
+	next := s.Build(cfg, Daily, to.Add(24*time.Hour), in)
+	if len(next.NewDevices) > 0 || len(next.TopTalkers) > 0 {
+		t.Errorf("Build after Commit: unexpected devices %+v or talkers %+v", next.NewDevices, next.TopTalkers)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rogue
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Offender is a device which sent rogue packets of one kind.
+type Offender struct {
+	Event               // most recent
+	FirstSeen time.Time `json:"first_seen"`
+	Count     int       `json:"count"`
+}
+
+// Offenders tracks the devices from which rogue packets were received. As
+// source MAC addresses are easily spoofed, Offenders forgets devices not seen
+// for TTL and holds at most Max devices, forgetting the least recently seen
+// ones first.
+type Offenders struct {
+	TTL time.Duration
+	Max int
+
+	mu sync.Mutex
+	m  map[string]*Offender // key: kind + hardware address
+}
+
+// NewOffenders returns empty Offenders.
+func NewOffenders(ttl time.Duration, max int) *Offenders {
+	return &Offenders{
+		TTL: ttl,
+		Max: max,
+		m:   make(map[string]*Offender),
+	}
+}
+
+// expire forgets offenders not seen since now-o.TTL. o.mu must be held.
+func (o *Offenders) expire(now time.Time) {
+	for key, off := range o.m {
+		if now.Sub(off.Time) > o.TTL {
+			delete(o.m, key)
+		}
+	}
+}
+
+// Record records ev and returns whether ev is from a new offender.
+func (o *Offenders) Record(ev *Event) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire(ev.Time)
+	key := ev.Kind + " " + ev.HardwareAddr
+	if off, ok := o.m[key]; ok {
+		off.Event = *ev
+		off.Count++
+		return false
+	}
+	for len(o.m) >= o.Max {
+		var oldest string
+		for key, off := range o.m {
+			if oldest == "" || off.Time.Before(o.m[oldest].Time) {
+				oldest = key
+			}
+		}
+		delete(o.m, oldest)
+	}
+	o.m[key] = &Offender{
+		Event:     *ev,
+		FirstSeen: ev.Time,
+		Count:     1,
+	}
+	return true
+}
+
+// List returns the offenders seen since now-o.TTL, in the order in which they
+// were first seen.
+func (o *Offenders) List(now time.Time) []Offender {
+	o.mu.Lock()
+	o.expire(now)
+	list := make([]Offender, 0, len(o.m))
+	for _, off := range o.m {
+		list = append(list, *off)
+	}
+	o.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FirstSeen.Before(list[j].FirstSeen)
+	})
+	return list
+}
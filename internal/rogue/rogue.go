@@ -0,0 +1,164 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rogue detects rogue IPv6 router advertisements and rogue DHCPv4
+// servers, i.e. devices other than router7 which configure LAN clients.
+package rogue
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/renameio"
+	"golang.org/x/net/bpf"
+)
+
+// Event kinds.
+const (
+	KindRA    = "ra"    // IPv6 router advertisement
+	KindDHCP4 = "dhcp4" // DHCPv4 offer or acknowledgement
+)
+
+// Event describes a packet sent by a rogue device.
+type Event struct {
+	Kind         string    `json:"kind"`
+	HardwareAddr string    `json:"hardware_addr"`
+	Addr         string    `json:"addr"`
+	Time         time.Time `json:"time"`
+}
+
+// Detector inspects ethernet frames captured on the LAN interface.
+type Detector struct {
+	// HardwareAddr is router7’s own LAN MAC address. Frames from this address
+	// are never considered rogue.
+	HardwareAddr net.HardwareAddr
+
+	// Allowed lists MAC addresses of legitimate routers or DHCP servers,
+	// e.g. a DHCP relay.
+	Allowed map[string]bool
+}
+
+func (d *Detector) allowed(hwaddr net.HardwareAddr) bool {
+	return bytes.Equal(hwaddr, d.HardwareAddr) || d.Allowed[hwaddr.String()]
+}
+
+// Filter passes only the frames which Inspect might consider rogue (router
+// advertisements and UDP datagrams from port 67 in unfragmented IPv4 packets)
+// to userspace, for packet sockets receiving all LAN traffic.
+var Filter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2}, // ethertype
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4},
+	bpf.LoadAbsolute{Off: 14 + 6, Size: 1}, // IPv6 next header
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 58, SkipTrue: 11},
+	bpf.LoadAbsolute{Off: 14 + 40, Size: 1}, // ICMPv6 type
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 134, SkipTrue: 8, SkipFalse: 9},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x0800, SkipTrue: 8},
+	bpf.LoadAbsolute{Off: 14 + 9, Size: 1}, // IPv4 protocol
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 17, SkipTrue: 6},
+	bpf.LoadAbsolute{Off: 14 + 6, Size: 2}, // IPv4 fragment offset
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+	bpf.LoadMemShift{Off: 14},          // X = IPv4 header length
+	bpf.LoadIndirect{Off: 14, Size: 2}, // UDP source port
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 67, SkipTrue: 1},
+	bpf.RetConstant{Val: 262144},
+	bpf.RetConstant{Val: 0},
+}
+
+// Inspect returns an Event if frame is a router advertisement or DHCPv4 server
+// reply which was not sent by router7, or nil otherwise.
+func (d *Detector) Inspect(frame []byte, at time.Time) *Event {
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || d.allowed(eth.SrcMAC) {
+		return nil
+	}
+	ev := &Event{
+		HardwareAddr: eth.SrcMAC.String(),
+		Time:         at,
+	}
+	if _, ok := pkt.Layer(layers.LayerTypeICMPv6RouterAdvertisement).(*layers.ICMPv6RouterAdvertisement); ok {
+		ev.Kind = KindRA
+		if ip6, ok := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			ev.Addr = ip6.SrcIP.String()
+		}
+		return ev
+	}
+	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || udp.SrcPort != 67 || udp.DstPort != 68 {
+		return nil
+	}
+	dhcp, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok || dhcp.Operation != layers.DHCPOpReply {
+		return nil
+	}
+	for _, opt := range dhcp.Options {
+		if opt.Type != layers.DHCPOptMessageType || len(opt.Data) != 1 {
+			continue
+		}
+		switch layers.DHCPMsgType(opt.Data[0]) {
+		case layers.DHCPMsgTypeOffer, layers.DHCPMsgTypeAck:
+			ev.Kind = KindDHCP4
+			if ip4, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+				ev.Addr = ip4.SrcIP.String()
+			}
+			return ev
+		}
+	}
+	return nil
+}
+
+// Blocked is the list of offenders for which netconfigd installs nftables
+// drop rules, stored in rogued/blocked.json.
+type Blocked struct {
+	HardwareAddrs []string `json:"hardware_addrs"`
+}
+
+// ReadBlocked reads rogued/blocked.json from dir. A missing file results in an
+// empty list.
+func ReadBlocked(dir string) (*Blocked, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "rogued", "blocked.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Blocked{}, nil
+		}
+		return nil, err
+	}
+	var blocked Blocked
+	if err := json.Unmarshal(b, &blocked); err != nil {
+		return nil, err
+	}
+	return &blocked, nil
+}
+
+// WriteBlocked atomically replaces rogued/blocked.json in dir.
+func WriteBlocked(dir string, blocked *Blocked) error {
+	b, err := json.MarshalIndent(blocked, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "rogued"), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(dir, "rogued", "blocked.json"), b, 0644)
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rogue_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+
+	"github.com/rtr7/router7/internal/rogue"
+)
+
+var (
+	routerMAC = net.HardwareAddr{0x02, 0x73, 0x53, 0x00, 0xb0, 0x0c}
+	rogueMAC  = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x23}
+)
+
+func serialize(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func dhcpOffer(t *testing.T, src net.HardwareAddr) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      255,
+		SrcIP:    net.IP{192, 168, 1, 1},
+		DstIP:    net.IPv4bcast,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{SrcPort: 67, DstPort: 68}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serialize(t,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip,
+		udp,
+		&layers.DHCPv4{
+			Operation:    layers.DHCPOpReply,
+			HardwareType: layers.LinkTypeEthernet,
+			HardwareLen:  6,
+			ClientHWAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+			YourClientIP: net.IP{192, 168, 1, 23},
+			Options: layers.DHCPOptions{
+				layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeOffer)}),
+			},
+		})
+}
+
+func routerAdvertisement(t *testing.T, src net.HardwareAddr) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		SrcIP:      net.ParseIP("fe80::23"),
+		DstIP:      net.IPv6linklocalallnodes,
+		NextHeader: layers.IPProtocolICMPv6,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterAdvertisement, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ip)
+	return serialize(t,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01},
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		ip,
+		icmp,
+		&layers.ICMPv6RouterAdvertisement{
+			HopLimit:       64,
+			RouterLifetime: 1800,
+		})
+}
+
+func TestInspect(t *testing.T) {
+	d := &rogue.Detector{HardwareAddr: routerMAC}
+	now := time.Now()
+
+	for _, tt := range []struct {
+		desc  string
+		frame []byte
+		want  string // kind, or empty if no event is expected
+	}{
+		{"own offer", dhcpOffer(t, routerMAC), ""},
+		{"rogue offer", dhcpOffer(t, rogueMAC), rogue.KindDHCP4},
+		{"own RA", routerAdvertisement(t, routerMAC), ""},
+		{"rogue RA", routerAdvertisement(t, rogueMAC), rogue.KindRA},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			ev := d.Inspect(tt.frame, now)
+			if tt.want == "" {
+				if ev != nil {
+					t.Fatalf("Inspect: got %+v, want nil", ev)
+				}
+				return
+			}
+			if ev == nil {
+				t.Fatalf("Inspect: got nil, want %s event", tt.want)
+			}
+			if got, want := ev.Kind, tt.want; got != want {
+				t.Errorf("unexpected kind: got %q, want %q", got, want)
+			}
+			if got, want := ev.HardwareAddr, rogueMAC.String(); got != want {
+				t.Errorf("unexpected hardware address: got %q, want %q", got, want)
+			}
+		})
+	}
+
+	d.Allowed = map[string]bool{rogueMAC.String(): true}
+	if ev := d.Inspect(dhcpOffer(t, rogueMAC), now); ev != nil {
+		t.Errorf("Inspect(allowed offer): got %+v, want nil", ev)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	vm, err := bpf.NewVM(rogue.Filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := serialize(t,
+		&layers.Ethernet{
+			SrcMAC:       rogueMAC,
+			DstMAC:       routerMAC,
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		&layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    net.ParseIP("192.168.42.23"),
+			DstIP:    net.ParseIP("192.168.42.1"),
+			Protocol: layers.IPProtocolICMPv4,
+		},
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)})
+	for _, tt := range []struct {
+		desc  string
+		frame []byte
+		want  bool
+	}{
+		{"offer", dhcpOffer(t, rogueMAC), true},
+		{"RA", routerAdvertisement(t, rogueMAC), true},
+		{"echo request", echo, false},
+	} {
+		n, err := vm.Run(tt.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n > 0; got != tt.want {
+			t.Errorf("%s: passed = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestOffenders(t *testing.T) {
+	o := rogue.NewOffenders(time.Hour, 2)
+	now := time.Now()
+	event := func(hwaddr string, at time.Time) *rogue.Event {
+		return &rogue.Event{Kind: rogue.KindRA, HardwareAddr: hwaddr, Time: at}
+	}
+	if !o.Record(event("02:00:00:00:00:01", now)) {
+		t.Errorf("Record(first): got false, want true")
+	}
+	if o.Record(event("02:00:00:00:00:01", now.Add(time.Minute))) {
+		t.Errorf("Record(repeated): got true, want false")
+	}
+	o.Record(event("02:00:00:00:00:02", now))
+	// The least recently seen offender is forgotten at capacity.
+	o.Record(event("02:00:00:00:00:03", now.Add(2*time.Minute)))
+	list := o.List(now.Add(2 * time.Minute))
+	if got, want := len(list), 2; got != want {
+		t.Fatalf("List: got %d offenders, want %d", got, want)
+	}
+	if got, want := list[0].HardwareAddr, "02:00:00:00:00:01"; got != want {
+		t.Errorf("List[0]: got %s, want %s", got, want)
+	}
+	if got, want := list[0].Count, 2; got != want {
+		t.Errorf("List[0].Count: got %d, want %d", got, want)
+	}
+	// Offenders not seen for the TTL are forgotten.
+	list = o.List(now.Add(time.Hour + 90*time.Second))
+	if len(list) != 1 || list[0].HardwareAddr != "02:00:00:00:00:03" {
+		t.Errorf("List after TTL: got %+v, want only 02:00:00:00:00:03", list)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ruleset
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Flows selects connection tracking entries by their original direction. The
+// zero value selects all entries.
+type Flows struct {
+	Family   uint8      // unix.AF_INET or unix.AF_INET6, 0 for both
+	Proto    uint8      // e.g. unix.IPPROTO_TCP, 0 for all protocols
+	Src, Dst *net.IPNet // nil for all addresses
+
+	// PortMin and PortMax are the range of destination ports, 0 for all
+	// ports.
+	PortMin, PortMax uint16
+}
+
+func (f Flows) String() string {
+	s := "flows"
+	switch f.Family {
+	case unix.AF_INET:
+		s += " ip"
+	case unix.AF_INET6:
+		s += " ip6"
+	}
+	if f.Proto != 0 {
+		s += fmt.Sprintf(" proto %d", f.Proto)
+	}
+	if f.Src != nil {
+		s += " src " + f.Src.String()
+	}
+	if f.Dst != nil {
+		s += " dst " + f.Dst.String()
+	}
+	if f.PortMin != 0 || f.PortMax != 0 {
+		s += fmt.Sprintf(" dport %d-%d", f.PortMin, f.PortMax)
+	}
+	return s
+}
+
+// MatchConntrackFlow implements netlink.CustomConntrackFilter.
+func (f Flows) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	orig := flow.Forward
+	if f.Family != 0 && flow.FamilyType != f.Family {
+		return false
+	}
+	if f.Proto != 0 && orig.Protocol != f.Proto {
+		return false
+	}
+	if f.Src != nil && !f.Src.Contains(orig.SrcIP) {
+		return false
+	}
+	if f.Dst != nil && !f.Dst.Contains(orig.DstIP) {
+		return false
+	}
+	if f.PortMin != 0 && orig.DstPort < f.PortMin {
+		return false
+	}
+	if f.PortMax != 0 && orig.DstPort > f.PortMax {
+		return false
+	}
+	return true
+}
+
+// Delete deletes the connection tracking entries selected by f, returning how
+// many were deleted.
+func (f Flows) Delete() (uint, error) {
+	var total uint
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if f.Family != 0 && f.Family != family {
+			continue
+		}
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, netlink.InetFamily(family), f)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// register describes what the rule interpreter knows about a register’s
+// contents.
+type register int
+
+const (
+	regUnknown register = iota
+	regProto
+	regSrc
+	regDst
+	regDport
+)
+
+// ruleFlows returns the connections which r applies to, as far as they can be
+// told from its expressions: criteria which connection tracking entries do not
+// record (e.g. interface names or MAC addresses) or which depend on sets are
+// ignored, so the result selects a superset of the connections.
+func ruleFlows(r *nftables.Rule) Flows {
+	f := Flows{Family: unix.AF_INET}
+	srcOffset, dstOffset, addrLen := uint32(12), uint32(16), net.IPv4len
+	if r.Table.Family == nftables.TableFamilyIPv6 {
+		f.Family = unix.AF_INET6
+		srcOffset, dstOffset, addrLen = 8, 24, net.IPv6len
+	}
+	regs := make(map[uint32]register)
+	masks := make(map[uint32][]byte)
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			regs[e.Register] = regUnknown
+			if e.Key == expr.MetaKeyL4PROTO {
+				regs[e.Register] = regProto
+			}
+		case *expr.Payload:
+			reg := regUnknown
+			switch {
+			case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == srcOffset && int(e.Len) == addrLen:
+				reg = regSrc
+			case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == dstOffset && int(e.Len) == addrLen:
+				reg = regDst
+			case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 2 && e.Len == 2:
+				reg = regDport
+			}
+			regs[e.DestRegister] = reg
+			delete(masks, e.DestRegister)
+		case *expr.Bitwise:
+			regs[e.DestRegister] = regs[e.SourceRegister]
+			masks[e.DestRegister] = e.Mask
+		case *expr.Cmp:
+			switch regs[e.Register] {
+			case regProto:
+				if e.Op == expr.CmpOpEq && len(e.Data) == 1 {
+					f.Proto = e.Data[0]
+				}
+			case regSrc, regDst:
+				if e.Op != expr.CmpOpEq || len(e.Data) != addrLen {
+					continue
+				}
+				mask := net.CIDRMask(addrLen*8, addrLen*8)
+				if m, ok := masks[e.Register]; ok && len(m) == addrLen {
+					mask = net.IPMask(m)
+				}
+				n := &net.IPNet{IP: net.IP(e.Data).Mask(mask), Mask: mask}
+				if regs[e.Register] == regSrc {
+					f.Src = n
+				} else {
+					f.Dst = n
+				}
+			case regDport:
+				if len(e.Data) != 2 {
+					continue
+				}
+				port := binary.BigEndian.Uint16(e.Data)
+				switch e.Op {
+				case expr.CmpOpEq:
+					f.PortMin, f.PortMax = port, port
+				case expr.CmpOpGte:
+					f.PortMin = port
+				case expr.CmpOpLte:
+					f.PortMax = port
+				}
+			}
+		case *expr.Range:
+			if regs[e.Register] == regDport && e.Op == expr.CmpOpEq &&
+				len(e.FromData) == 2 && len(e.ToData) == 2 {
+				f.PortMin = binary.BigEndian.Uint16(e.FromData)
+				f.PortMax = binary.BigEndian.Uint16(e.ToData)
+			}
+		}
+	}
+	return f
+}
+
+// statefulRule returns whether r only applies to some packets of a connection
+// (e.g. only to new connections), as opposed to rules which apply to every
+// packet and hence take effect for existing connections, too.
+func statefulRule(r *nftables.Rule) bool {
+	if r.Chain.Type == nftables.ChainTypeNAT {
+		// NAT rules are only evaluated for the first packet of a connection.
+		return true
+	}
+	for _, e := range r.Exprs {
+		if _, ok := e.(*expr.Ct); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AffectedFlows returns the connections which changes affect but which would
+// not be subject to them without deleting their connection tracking entries:
+// those matching added or deleted NAT rules or rules depending on the
+// connection state.
+func AffectedFlows(changes []Change) []Flows {
+	var result []Flows
+	seen := make(map[string]bool)
+	add := func(r *nftables.Rule) {
+		if !statefulRule(r) {
+			return
+		}
+		f := ruleFlows(r)
+		if key := f.String(); !seen[key] {
+			seen[key] = true
+			result = append(result, f)
+		}
+	}
+	for _, c := range changes {
+		switch c.Op {
+		case AddRule, DelRule:
+			add(c.Rule)
+		case DelChain, DelTable:
+			for _, r := range c.Rules {
+				add(r)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ruleset
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// portForwarding returns the expressions of a DNAT rule forwarding TCP port
+// port to 192.168.42.23.
+func portForwarding(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("uplink0\x00")},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(port >> 8), byte(port)}},
+		&expr.Immediate{Register: 1, Data: net.ParseIP("192.168.42.23").To4()},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+	}
+}
+
+func natRuleset(ports ...uint16) *Ruleset {
+	rs := &Ruleset{}
+	nat := rs.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "nat"})
+	prerouting := nat.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityFilter,
+		Type:     nftables.ChainTypeNAT,
+	})
+	for _, port := range ports {
+		prerouting.AddRule(portForwarding(port))
+	}
+	return rs
+}
+
+func TestRuleFlows(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/24")
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	for _, tt := range []struct {
+		desc  string
+		exprs []expr.Any
+		want  Flows
+	}{
+		{
+			desc:  "port forwarding",
+			exprs: portForwarding(8080),
+			want: Flows{
+				Family:  unix.AF_INET,
+				Proto:   unix.IPPROTO_TCP,
+				PortMin: 8080,
+				PortMax: 8080,
+			},
+		},
+
+		{
+			desc: "source network",
+			exprs: []expr.Any{
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       12,
+					Len:          4,
+				},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           lan.Mask,
+					Xor:            []byte{0, 0, 0, 0},
+				},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: lan.IP.To4()},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+			want: Flows{Family: unix.AF_INET, Src: lan},
+		},
+
+		{
+			desc: "port range",
+			exprs: []expr.Any{
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseTransportHeader,
+					Offset:       2,
+					Len:          2,
+				},
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: []byte{0x1f, 0x40}},
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{0x1f, 0x4f}},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+			want: Flows{Family: unix.AF_INET, PortMin: 8000, PortMax: 8015},
+		},
+
+		{
+			desc: "set lookup",
+			exprs: []expr.Any{
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       16,
+					Len:          4,
+				},
+				&expr.Lookup{SourceRegister: 1, SetName: "blocked"},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+			want: Flows{Family: unix.AF_INET},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := ruleFlows(&nftables.Rule{Table: table, Exprs: tt.exprs})
+			if got.String() != tt.want.String() {
+				t.Fatalf("ruleFlows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchConntrackFlow(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/24")
+	flow := &netlink.ConntrackFlow{
+		FamilyType: unix.AF_INET,
+		Forward: netlink.IPTuple{
+			Protocol: unix.IPPROTO_TCP,
+			SrcIP:    net.ParseIP("10.0.0.5"),
+			DstIP:    net.ParseIP("203.0.113.1"),
+			SrcPort:  51234,
+			DstPort:  443,
+		},
+	}
+	for _, tt := range []struct {
+		flows Flows
+		want  bool
+	}{
+		{Flows{}, true},
+		{Flows{Family: unix.AF_INET6}, false},
+		{Flows{Proto: unix.IPPROTO_UDP}, false},
+		{Flows{Src: lan}, true},
+		{Flows{Dst: lan}, false},
+		{Flows{PortMin: 443, PortMax: 443}, true},
+		{Flows{PortMin: 8000, PortMax: 8015}, false},
+		{Flows{PortMax: 1023}, true},
+	} {
+		if got := tt.flows.MatchConntrackFlow(flow); got != tt.want {
+			t.Errorf("%v.MatchConntrackFlow = %v, want %v", tt.flows, got, tt.want)
+		}
+	}
+}
+
+func flowStrings(flows []Flows) []string {
+	var result []string
+	for _, f := range flows {
+		result = append(result, f.String())
+	}
+	return result
+}
+
+func TestAffectedFlows(t *testing.T) {
+	cur := natRuleset(80, 443)
+	var handle uint64
+	for _, r := range cur.Tables[0].Chains[0].Rules {
+		handle++
+		r.Handle = handle
+	}
+
+	for _, tt := range []struct {
+		desc string
+		want *Ruleset
+		diff []string
+	}{
+		{
+			desc: "unchanged",
+			want: natRuleset(80, 443),
+			diff: nil,
+		},
+
+		{
+			desc: "port forwarding added",
+			want: natRuleset(80, 443, 8080),
+			diff: []string{"flows ip proto 6 dport 8080-8080"},
+		},
+
+		{
+			desc: "port forwarding removed",
+			want: natRuleset(443),
+			diff: []string{"flows ip proto 6 dport 80-80"},
+		},
+
+		{
+			desc: "nat table removed",
+			want: &Ruleset{},
+			diff: []string{
+				"flows ip proto 6 dport 80-80",
+				"flows ip proto 6 dport 443-443",
+			},
+		},
+
+		{
+			desc: "filter rule added",
+			want: func() *Ruleset {
+				rs := natRuleset(80, 443)
+				rs.Tables = append(rs.Tables, build(config{ports: []uint16{22}}).Tables...)
+				return rs
+			}(),
+			diff: nil,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := flowStrings(AffectedFlows(Diff(cur, tt.want)))
+			if diff := cmp.Diff(tt.diff, got); diff != "" {
+				t.Fatalf("AffectedFlows: unexpected flows: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
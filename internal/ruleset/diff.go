@@ -0,0 +1,460 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ruleset
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Op is the operation of a Change.
+type Op int
+
+const (
+	DelRule Op = iota
+	DelElements
+	DelChain
+	DelSet
+	DelCounter
+	DelTable
+	AddTable
+	AddChain
+	AddSet
+	AddElements
+	AddCounter
+	AddRule
+)
+
+var opNames = map[Op]string{
+	DelRule:     "delete rule",
+	DelElements: "delete elements",
+	DelChain:    "delete chain",
+	DelSet:      "delete set",
+	DelCounter:  "delete counter",
+	DelTable:    "delete table",
+	AddTable:    "add table",
+	AddChain:    "add chain",
+	AddSet:      "add set",
+	AddElements: "add elements",
+	AddCounter:  "add counter",
+	AddRule:     "add rule",
+}
+
+// Change is one modification of the kernel ruleset. Only the fields relevant
+// to Op are set.
+type Change struct {
+	Op       Op
+	Table    *nftables.Table
+	Chain    *nftables.Chain
+	Rule     *nftables.Rule // for AddRule, Position is the rule to insert before
+	Set      *nftables.Set
+	Elements []nftables.SetElement
+	Counter  *nftables.CounterObj
+
+	// Rules are the rules which DelChain and DelTable delete along with the
+	// chain or table.
+	Rules []*nftables.Rule
+}
+
+func familyName(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	}
+	return fmt.Sprintf("family%d", f)
+}
+
+// String describes the change in nft(8) syntax, e.g. “add rule ip filter
+// forward”.
+func (c Change) String() string {
+	s := fmt.Sprintf("%s %s %s", opNames[c.Op], familyName(c.Table.Family), c.Table.Name)
+	switch c.Op {
+	case DelChain, AddChain:
+		s += " " + c.Chain.Name
+	case DelRule:
+		s += fmt.Sprintf(" %s handle %d", c.Rule.Chain.Name, c.Rule.Handle)
+	case AddRule:
+		s += " " + c.Rule.Chain.Name
+		if c.Rule.Position != 0 {
+			s += fmt.Sprintf(" position %d", c.Rule.Position)
+		}
+	case DelSet, AddSet, DelElements, AddElements:
+		s += " " + c.Set.Name
+		if c.Op != DelSet {
+			s += fmt.Sprintf(" (%d elements)", len(c.Elements))
+		}
+	case DelCounter, AddCounter:
+		s += " " + c.Counter.Name
+	}
+	return s
+}
+
+// changes collects changes by operation, so that they can be applied in a
+// valid order: e.g. rules referring to a set need to be deleted before the
+// set, and sets need to be added before rules referring to them.
+type changes map[Op][]Change
+
+func (cs changes) add(c Change) { cs[c.Op] = append(cs[c.Op], c) }
+
+func (cs changes) ordered() []Change {
+	var result []Change
+	for op := DelRule; op <= AddRule; op++ {
+		result = append(result, cs[op]...)
+	}
+	return result
+}
+
+func sameTable(a, b *nftables.Table) bool {
+	return a.Family == b.Family && a.Name == b.Name
+}
+
+// sameChainType returns whether chains a and b are of the same type, i.e.
+// whether a can be kept instead of re-creating it as b.
+func sameChainType(a, b *nftables.Chain) bool {
+	return reflect.DeepEqual(a.Hooknum, b.Hooknum) &&
+		reflect.DeepEqual(a.Priority, b.Priority) &&
+		a.Type == b.Type
+}
+
+// sameSetType returns whether sets a and b are of the same type, i.e. whether
+// a can be kept (and only its elements updated) instead of re-creating it as
+// b.
+func sameSetType(a, b *nftables.Set) bool {
+	return a.Interval == b.Interval &&
+		a.IsMap == b.IsMap &&
+		a.KeyType.Name == b.KeyType.Name &&
+		a.DataType.Name == b.DataType.Name
+}
+
+func elementKey(e nftables.SetElement) string {
+	return fmt.Sprintf("%x/%x/%x/%v", e.Key, e.KeyEnd, e.Val, e.IntervalEnd)
+}
+
+// elementsDiff returns the elements of b which are missing in a (add) and the
+// elements of a which are missing in b (del).
+func elementsDiff(a, b []nftables.SetElement) (add, del []nftables.SetElement) {
+	inA := make(map[string]bool, len(a))
+	for _, e := range a {
+		inA[elementKey(e)] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, e := range b {
+		inB[elementKey(e)] = true
+		if !inA[elementKey(e)] {
+			add = append(add, e)
+		}
+	}
+	for _, e := range a {
+		if !inB[elementKey(e)] {
+			del = append(del, e)
+		}
+	}
+	return add, del
+}
+
+// refersTo returns whether r looks up one of sets or jumps to one of chains.
+func refersTo(r *nftables.Rule, sets, chains map[string]bool) bool {
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Lookup:
+			if sets[e.SetName] {
+				return true
+			}
+		case *expr.Verdict:
+			if e.Chain != "" && chains[e.Chain] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// diffRules adds the changes turning the rules cur into want. The rules which
+// cur and want have in common at their beginning and end are kept, all others
+// are replaced, so that e.g. appending, inserting or removing a single rule
+// results in a single change. Rules in stale are never kept.
+func diffRules(cs changes, cur, want []*nftables.Rule, stale func(*nftables.Rule) bool) {
+	match := func(c, w *nftables.Rule) bool {
+		fp := ruleFingerprint(c)
+		return fp != nil && !stale(c) && bytes.Equal(fp, ruleFingerprint(w))
+	}
+	prefix := 0
+	for prefix < len(cur) && prefix < len(want) && match(cur[prefix], want[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(cur)-prefix && suffix < len(want)-prefix &&
+		match(cur[len(cur)-1-suffix], want[len(want)-1-suffix]) {
+		suffix++
+	}
+	for _, r := range cur[prefix : len(cur)-suffix] {
+		cs.add(Change{Op: DelRule, Table: r.Table, Rule: r})
+	}
+	var position uint64 // append
+	if suffix > 0 {
+		position = cur[len(cur)-suffix].Handle // insert before the kept rules
+	}
+	for _, r := range want[prefix : len(want)-suffix] {
+		copy := *r
+		copy.Position = position
+		cs.add(Change{Op: AddRule, Table: r.Table, Rule: &copy})
+	}
+}
+
+func diffTable(cs changes, cur, want *Table) {
+	// Sets and chains which need to be re-created, which implies re-creating
+	// all rules referring to them.
+	recreatedSets := make(map[string]bool)
+	recreatedChains := make(map[string]bool)
+
+	curSets := make(map[string]*Set)
+	for _, s := range cur.Sets {
+		curSets[s.Set.Name] = s
+	}
+	wantSets := make(map[string]bool)
+	for _, s := range want.Sets {
+		wantSets[s.Set.Name] = true
+		c, ok := curSets[s.Set.Name]
+		if ok && sameSetType(c.Set, s.Set) {
+			add, del := elementsDiff(c.Elements, s.Elements)
+			if len(del) > 0 {
+				cs.add(Change{Op: DelElements, Table: want.Table, Set: c.Set, Elements: del})
+			}
+			if len(add) > 0 {
+				cs.add(Change{Op: AddElements, Table: want.Table, Set: s.Set, Elements: add})
+			}
+			continue
+		}
+		if ok {
+			recreatedSets[s.Set.Name] = true
+			cs.add(Change{Op: DelSet, Table: want.Table, Set: c.Set})
+		}
+		cs.add(Change{Op: AddSet, Table: want.Table, Set: s.Set, Elements: s.Elements})
+	}
+	for _, s := range cur.Sets {
+		if !wantSets[s.Set.Name] {
+			cs.add(Change{Op: DelSet, Table: cur.Table, Set: s.Set})
+		}
+	}
+
+	curChains := make(map[string]*Chain)
+	for _, c := range cur.Chains {
+		curChains[c.Chain.Name] = c
+	}
+	wantChains := make(map[string]bool)
+	for _, w := range want.Chains {
+		wantChains[w.Chain.Name] = true
+		if c, ok := curChains[w.Chain.Name]; ok && !sameChainType(c.Chain, w.Chain) {
+			recreatedChains[w.Chain.Name] = true
+			cs.add(Change{Op: DelChain, Table: cur.Table, Chain: c.Chain, Rules: c.Rules})
+		}
+	}
+	stale := func(r *nftables.Rule) bool {
+		return refersTo(r, recreatedSets, recreatedChains)
+	}
+	for _, w := range want.Chains {
+		c, ok := curChains[w.Chain.Name]
+		if !ok || recreatedChains[w.Chain.Name] {
+			cs.add(Change{Op: AddChain, Table: want.Table, Chain: w.Chain})
+			diffRules(cs, nil, w.Rules, stale)
+			continue
+		}
+		diffRules(cs, c.Rules, w.Rules, stale)
+	}
+	for _, c := range cur.Chains {
+		if !wantChains[c.Chain.Name] {
+			cs.add(Change{Op: DelChain, Table: cur.Table, Chain: c.Chain, Rules: c.Rules})
+		}
+	}
+
+	// Existing counters are kept as-is to retain their values.
+	curCounters := make(map[string]bool)
+	for _, o := range cur.Counters {
+		curCounters[o.Name] = true
+	}
+	wantCounters := make(map[string]bool)
+	for _, o := range want.Counters {
+		wantCounters[o.Name] = true
+		if !curCounters[o.Name] {
+			cs.add(Change{Op: AddCounter, Table: want.Table, Counter: o})
+		}
+	}
+	for _, o := range cur.Counters {
+		if !wantCounters[o.Name] {
+			cs.add(Change{Op: DelCounter, Table: cur.Table, Counter: o})
+		}
+	}
+}
+
+// Diff returns the changes turning the ruleset cur into want, in the order in
+// which they need to be applied.
+func Diff(cur, want *Ruleset) []Change {
+	cs := make(changes)
+	for _, w := range want.Tables {
+		var c *Table
+		for _, t := range cur.Tables {
+			if sameTable(t.Table, w.Table) {
+				c = t
+				break
+			}
+		}
+		if c == nil {
+			cs.add(Change{Op: AddTable, Table: w.Table})
+			c = &Table{Table: w.Table}
+		}
+		diffTable(cs, c, w)
+	}
+	for _, c := range cur.Tables {
+		found := false
+		for _, w := range want.Tables {
+			if sameTable(c.Table, w.Table) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// Deleting a table deletes its contents, too.
+			var rules []*nftables.Rule
+			for _, ch := range c.Chains {
+				rules = append(rules, ch.Rules...)
+			}
+			cs.add(Change{Op: DelTable, Table: c.Table, Rules: rules})
+		}
+	}
+	return cs.ordered()
+}
+
+// Read returns the ruleset which is currently programmed into the kernel.
+func Read(c *nftables.Conn) (*Ruleset, error) {
+	tables, err := c.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	chains, err := c.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	rs := &Ruleset{}
+	for _, t := range tables {
+		table := rs.AddTable(t)
+		for _, ch := range chains {
+			if !sameTable(ch.Table, t) {
+				continue
+			}
+			ch.Table = t
+			rules, err := c.GetRule(t, ch)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range rules {
+				r.Table = t
+				r.Chain = ch
+			}
+			table.Chains = append(table.Chains, &Chain{Chain: ch, Rules: rules})
+		}
+		sets, err := c.GetSets(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sets {
+			if s.Anonymous {
+				continue // deleted along with the rule referring to it
+			}
+			s.Table = t
+			elements, err := c.GetSetElements(s)
+			if err != nil {
+				return nil, err
+			}
+			table.Sets = append(table.Sets, &Set{Set: s, Elements: elements})
+		}
+		objs, err := c.GetObj(&nftables.CounterObj{Table: t})
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			// Older kernels return the objects of all tables.
+			if co, ok := obj.(*nftables.CounterObj); ok && sameTable(co.Table, t) {
+				co.Table = t
+				table.Counters = append(table.Counters, co)
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (ch Change) queue(c *nftables.Conn) error {
+	switch ch.Op {
+	case DelRule:
+		return c.DelRule(ch.Rule)
+	case DelElements:
+		return c.SetDeleteElements(ch.Set, ch.Elements)
+	case DelChain:
+		c.FlushChain(ch.Chain)
+		c.DelChain(ch.Chain)
+	case DelSet:
+		c.DelSet(ch.Set)
+	case DelCounter:
+		c.DeleteObject(ch.Counter)
+	case DelTable:
+		c.DelTable(ch.Table)
+	case AddTable:
+		c.AddTable(ch.Table)
+	case AddChain:
+		c.AddChain(ch.Chain)
+	case AddSet:
+		return c.AddSet(ch.Set, ch.Elements)
+	case AddElements:
+		return c.SetAddElements(ch.Set, ch.Elements)
+	case AddCounter:
+		c.AddObj(ch.Counter)
+	case AddRule:
+		if ch.Rule.Position != 0 {
+			c.InsertRule(ch.Rule)
+		} else {
+			c.AddRule(ch.Rule)
+		}
+	}
+	return nil
+}
+
+// Apply programs want into the kernel via c, changing only what differs from
+// the current ruleset. All changes are applied atomically: if any of them
+// fails, the ruleset remains unchanged.
+func Apply(c *nftables.Conn, want *Ruleset) ([]Change, error) {
+	cur, err := Read(c)
+	if err != nil {
+		return nil, fmt.Errorf("reading ruleset: %v", err)
+	}
+	changes := Diff(cur, want)
+	for _, ch := range changes {
+		if err := ch.queue(c); err != nil {
+			return nil, fmt.Errorf("%v: %v", ch, err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,369 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ruleset
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// portRule returns a distinct rule for each port.
+func portRule(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{byte(port >> 8), byte(port)},
+		},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+type config struct {
+	ports     []uint16
+	blocked   []net.IP
+	counters  []string
+	setType   nftables.SetDatatype
+	natTable  bool
+	chainType nftables.ChainType
+}
+
+func build(cfg config) *Ruleset {
+	rs := &Ruleset{}
+	if cfg.natTable {
+		nat := rs.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "nat"})
+		nat.AddChain(&nftables.Chain{
+			Name:     "postrouting",
+			Hooknum:  nftables.ChainHookPostrouting,
+			Priority: nftables.ChainPriorityNATSource,
+			Type:     nftables.ChainTypeNAT,
+		})
+	}
+	filter := rs.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+	chainType := cfg.chainType
+	if chainType == "" {
+		chainType = nftables.ChainTypeFilter
+	}
+	forward := filter.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Type:     chainType,
+	})
+	setType := cfg.setType
+	if setType.Name == "" {
+		setType = nftables.TypeIPAddr
+	}
+	var elements []nftables.SetElement
+	for _, ip := range cfg.blocked {
+		elements = append(elements, nftables.SetElement{Key: ip.To4()})
+	}
+	set := filter.AddSet(&nftables.Set{Name: "blocked", KeyType: setType}, elements)
+	forward.AddRule([]expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       12,
+			Len:          4,
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	})
+	for _, port := range cfg.ports {
+		forward.AddRule(portRule(port))
+	}
+	for _, name := range cfg.counters {
+		filter.AddCounter(&nftables.CounterObj{Name: name})
+	}
+	return rs
+}
+
+// kernel simulates reading back the ruleset programmed for cfg: rules are
+// assigned handles in order, starting at 1.
+func kernel(cfg config) *Ruleset {
+	rs := build(cfg)
+	var handle uint64
+	for _, t := range rs.Tables {
+		for _, c := range t.Chains {
+			for _, r := range c.Rules {
+				handle++
+				r.Handle = handle
+			}
+		}
+	}
+	return rs
+}
+
+func changeStrings(changes []Change) []string {
+	var result []string
+	for _, c := range changes {
+		result = append(result, c.String())
+	}
+	return result
+}
+
+func TestDiff(t *testing.T) {
+	base := config{
+		ports:    []uint16{22, 80, 443},
+		blocked:  []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		counters: []string{"fwded"},
+	}
+	for _, tt := range []struct {
+		desc string
+		cur  *Ruleset
+		want config
+		diff []string
+	}{
+		{
+			desc: "empty kernel",
+			cur:  &Ruleset{},
+			want: base,
+			diff: []string{
+				"add table ip filter",
+				"add chain ip filter forward",
+				"add set ip filter blocked (2 elements)",
+				"add counter ip filter fwded",
+				"add rule ip filter forward",
+				"add rule ip filter forward",
+				"add rule ip filter forward",
+				"add rule ip filter forward",
+			},
+		},
+
+		{
+			desc: "unchanged",
+			cur:  kernel(base),
+			want: base,
+			diff: nil,
+		},
+
+		{
+			desc: "rule appended",
+			cur:  kernel(base),
+			want: config{
+				ports:    []uint16{22, 80, 443, 8080},
+				blocked:  base.blocked,
+				counters: base.counters,
+			},
+			diff: []string{"add rule ip filter forward"},
+		},
+
+		{
+			desc: "rule inserted",
+			cur:  kernel(base),
+			want: config{
+				ports:    []uint16{22, 25, 80, 443},
+				blocked:  base.blocked,
+				counters: base.counters,
+			},
+			diff: []string{"add rule ip filter forward position 3"},
+		},
+
+		{
+			desc: "rule removed",
+			cur:  kernel(base),
+			want: config{
+				ports:    []uint16{22, 443},
+				blocked:  base.blocked,
+				counters: base.counters,
+			},
+			diff: []string{"delete rule ip filter forward handle 3"},
+		},
+
+		{
+			desc: "rule replaced",
+			cur:  kernel(base),
+			want: config{
+				ports:    []uint16{22, 8080, 443},
+				blocked:  base.blocked,
+				counters: base.counters,
+			},
+			diff: []string{
+				"delete rule ip filter forward handle 3",
+				"add rule ip filter forward position 4",
+			},
+		},
+
+		{
+			desc: "set elements changed",
+			cur:  kernel(base),
+			want: config{
+				ports:    base.ports,
+				blocked:  []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")},
+				counters: base.counters,
+			},
+			diff: []string{
+				"delete elements ip filter blocked (1 elements)",
+				"add elements ip filter blocked (1 elements)",
+			},
+		},
+
+		{
+			desc: "set type changed",
+			cur:  kernel(base),
+			want: config{
+				ports:    base.ports,
+				blocked:  base.blocked,
+				counters: base.counters,
+				setType:  nftables.TypeIP6Addr,
+			},
+			diff: []string{
+				// The rule referring to the set is re-created.
+				"delete rule ip filter forward handle 1",
+				"delete set ip filter blocked",
+				"add set ip filter blocked (2 elements)",
+				"add rule ip filter forward position 2",
+			},
+		},
+
+		{
+			desc: "chain type changed",
+			cur:  kernel(base),
+			want: config{
+				ports:     base.ports,
+				blocked:   base.blocked,
+				counters:  base.counters,
+				chainType: nftables.ChainTypeRoute,
+			},
+			diff: []string{
+				"delete chain ip filter forward",
+				"add chain ip filter forward",
+				"add rule ip filter forward",
+				"add rule ip filter forward",
+				"add rule ip filter forward",
+				"add rule ip filter forward",
+			},
+		},
+
+		{
+			desc: "counters",
+			cur:  kernel(base),
+			want: config{
+				ports:    base.ports,
+				blocked:  base.blocked,
+				counters: []string{"fwded", "acct_rx_10.0.0.1"},
+			},
+			diff: []string{"add counter ip filter acct_rx_10.0.0.1"},
+		},
+
+		{
+			desc: "counter removed",
+			cur:  kernel(base),
+			want: config{
+				ports:   base.ports,
+				blocked: base.blocked,
+			},
+			diff: []string{"delete counter ip filter fwded"},
+		},
+
+		{
+			desc: "table added",
+			cur:  kernel(base),
+			want: config{
+				ports:    base.ports,
+				blocked:  base.blocked,
+				counters: base.counters,
+				natTable: true,
+			},
+			diff: []string{
+				"add table ip nat",
+				"add chain ip nat postrouting",
+			},
+		},
+
+		{
+			desc: "table removed",
+			cur: kernel(config{
+				ports:    base.ports,
+				blocked:  base.blocked,
+				counters: base.counters,
+				natTable: true,
+			}),
+			want: base,
+			diff: []string{"delete table ip nat"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := changeStrings(Diff(tt.cur, build(tt.want)))
+			if diff := cmp.Diff(tt.diff, got); diff != "" {
+				t.Fatalf("Diff: unexpected changes: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiffForeignRules(t *testing.T) {
+	// Rules without fingerprint (e.g. added via nft(8)) are replaced.
+	cur := kernel(config{ports: []uint16{22}})
+	for _, c := range cur.Tables[0].Chains {
+		for _, r := range c.Rules {
+			r.UserData = nil
+		}
+	}
+	got := changeStrings(Diff(cur, build(config{ports: []uint16{22}})))
+	want := []string{
+		"delete rule ip filter forward handle 1",
+		"delete rule ip filter forward handle 2",
+		"add rule ip filter forward",
+		"add rule ip filter forward",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Diff: unexpected changes: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := fingerprint(portRule(22))
+	if b := fingerprint(portRule(22)); string(a) != string(b) {
+		t.Errorf("fingerprint not deterministic: %x != %x", a, b)
+	}
+	if b := fingerprint(portRule(80)); string(a) == string(b) {
+		t.Errorf("fingerprint(port 22) == fingerprint(port 80)")
+	}
+
+	lookup := func(id uint32) []expr.Any {
+		return []expr.Any{&expr.Lookup{SourceRegister: 1, SetName: "blocked", SetID: id}}
+	}
+	if a, b := fingerprint(lookup(1)), fingerprint(lookup(7)); string(a) != string(b) {
+		t.Errorf("fingerprint depends on set ID")
+	}
+
+	r := &nftables.Rule{UserData: append([]byte{0, 3, 'f', 'o', 0}, fingerprintUserData(portRule(22))...)}
+	if got := ruleFingerprint(r); string(got) != string(a) {
+		t.Errorf("ruleFingerprint = %x, want %x", got, a)
+	}
+	if got := ruleFingerprint(&nftables.Rule{UserData: []byte{fingerprintType, 200, 1}}); got != nil {
+		t.Errorf("ruleFingerprint(truncated) = %x, want nil", got)
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	rs := build(config{})
+	filter := rs.Tables[0]
+	got := Change{Op: AddChain, Table: filter.Table, Chain: filter.Chains[0].Chain}.String()
+	if want := "add chain ip filter forward"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ruleset programs nftables declaratively: the desired ruleset is
+// built as a data structure, diffed against the ruleset in the kernel, and
+// only the differences are applied, in one atomic transaction.
+//
+// Compared to flushing and re-creating the entire ruleset, this keeps
+// connections, counters and set elements of unchanged parts intact, and
+// allows updating individual features (e.g. port forwardings or quotas)
+// without ever passing through an intermediate ruleset.
+package ruleset
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Ruleset is an nftables ruleset.
+type Ruleset struct {
+	Tables []*Table
+}
+
+// Table is an nftables table and its contents.
+type Table struct {
+	Table    *nftables.Table
+	Chains   []*Chain
+	Sets     []*Set
+	Counters []*nftables.CounterObj
+}
+
+// Chain is an nftables chain and its rules, in order.
+type Chain struct {
+	Chain *nftables.Chain
+	Rules []*nftables.Rule
+}
+
+// Set is a named nftables set and its elements.
+type Set struct {
+	Set      *nftables.Set
+	Elements []nftables.SetElement
+}
+
+// AddTable adds t to the ruleset, or returns the table of the same family
+// and name which was added before.
+func (rs *Ruleset) AddTable(t *nftables.Table) *Table {
+	for _, table := range rs.Tables {
+		if table.Table.Family == t.Family && table.Table.Name == t.Name {
+			return table
+		}
+	}
+	table := &Table{Table: t}
+	rs.Tables = append(rs.Tables, table)
+	return table
+}
+
+// AddChain adds c to the table, or returns the chain of the same name which
+// was added before.
+func (t *Table) AddChain(c *nftables.Chain) *Chain {
+	for _, chain := range t.Chains {
+		if chain.Chain.Name == c.Name {
+			return chain
+		}
+	}
+	c.Table = t.Table
+	chain := &Chain{Chain: c}
+	t.Chains = append(t.Chains, chain)
+	return chain
+}
+
+// AddSet adds the named set s containing elements to the table.
+func (t *Table) AddSet(s *nftables.Set, elements []nftables.SetElement) *nftables.Set {
+	s.Table = t.Table
+	t.Sets = append(t.Sets, &Set{Set: s, Elements: elements})
+	return s
+}
+
+// AddCounter adds the named counter o to the table. The packets and bytes of
+// o are only used when the counter is created: existing counters retain their
+// values.
+func (t *Table) AddCounter(o *nftables.CounterObj) *nftables.CounterObj {
+	o.Table = t.Table
+	t.Counters = append(t.Counters, o)
+	return o
+}
+
+// AddRule appends a rule consisting of exprs to the chain.
+func (c *Chain) AddRule(exprs []expr.Any) {
+	c.Rules = append(c.Rules, &nftables.Rule{
+		Table:    c.Chain.Table,
+		Chain:    c.Chain,
+		Exprs:    exprs,
+		UserData: fingerprintUserData(exprs),
+	})
+}
+
+// fingerprintType is the type of the rule user data attribute holding the
+// fingerprint. nft(8) only interprets the comment attribute (type 0) and
+// ignores all others.
+const fingerprintType = 0x72
+
+// fingerprint identifies a rule by its expressions, so that rules in the
+// kernel can be matched with desired rules without having to compare
+// expressions which the kernel returns in a different form (e.g. with
+// padding or defaults).
+func fingerprint(exprs []expr.Any) []byte {
+	h := sha256.New()
+	for _, e := range exprs {
+		if l, ok := e.(*expr.Lookup); ok {
+			copy := *l
+			copy.SetID = 0 // allocated anew in every transaction
+			e = &copy
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			b = []byte(err.Error())
+		}
+		fmt.Fprintf(h, "%T%s\n", e, b)
+	}
+	return h.Sum(nil)[:16]
+}
+
+// fingerprintUserData returns rule user data (a type-length-value attribute)
+// holding the fingerprint of exprs.
+func fingerprintUserData(exprs []expr.Any) []byte {
+	fp := fingerprint(exprs)
+	return append([]byte{fingerprintType, byte(len(fp))}, fp...)
+}
+
+// ruleFingerprint returns the fingerprint stored in the user data of r, or
+// nil if r has none (e.g. because it was not added by this package).
+func ruleFingerprint(r *nftables.Rule) []byte {
+	b := r.UserData
+	for len(b) >= 2 {
+		typ, length := b[0], int(b[1])
+		if len(b) < 2+length {
+			return nil
+		}
+		if typ == fingerprintType {
+			return b[2 : 2+length]
+		}
+		b = b[2+length:]
+	}
+	return nil
+}
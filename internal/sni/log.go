@@ -0,0 +1,244 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Config is the SNI logging configuration, stored in sni.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// Retention is how long to keep entries, e.g. “72h”, defaults to 7 days.
+	Retention string `json:"retention"`
+
+	// MaxEntries is the maximum number of entries (client and hostname
+	// pairs) to keep, defaults to DefaultMaxEntries.
+	MaxEntries int `json:"max_entries"`
+}
+
+// DefaultMaxEntries is the default Config.MaxEntries.
+const DefaultMaxEntries = 10000
+
+// Max returns MaxEntries or its default.
+func (c *Config) Max() int {
+	if c.MaxEntries <= 0 {
+		return DefaultMaxEntries
+	}
+	return c.MaxEntries
+}
+
+// RetentionDuration returns the parsed Retention.
+func (c *Config) RetentionDuration() (time.Duration, error) {
+	if c.Retention == "" {
+		return 7 * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(c.Retention)
+}
+
+// ReadConfig reads sni.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "sni.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if _, err := cfg.RetentionDuration(); err != nil {
+		return nil, fmt.Errorf("%s: retention: %v", fn, err)
+	}
+	return &cfg, nil
+}
+
+// Entry summarizes the observations of one hostname contacted by one client.
+type Entry struct {
+	HardwareAddr string    `json:"hardware_addr"`
+	Addr         string    `json:"addr"` // most recent
+	Host         string    `json:"host"`
+	Proto        string    `json:"proto"` // most recent
+	First        time.Time `json:"first"`
+	Last         time.Time `json:"last"`
+	Count        int       `json:"count"`
+}
+
+// Log keeps the hostnames contacted by each client, for at most Retention. As
+// both the hardware addresses and the hostnames are chosen by the clients, Log
+// holds at most Max entries, forgetting the least recently seen ones first.
+type Log struct {
+	Retention time.Duration
+	Max       int
+
+	mu      sync.Mutex
+	entries map[string]*Entry // key: hardware address + host
+	dirty   bool
+}
+
+// NewLog returns an empty Log.
+func NewLog(retention time.Duration, max int) *Log {
+	return &Log{
+		Retention: retention,
+		Max:       max,
+		entries:   make(map[string]*Entry),
+	}
+}
+
+// Add records obs.
+func (l *Log) Add(obs *Observation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dirty = true
+	key := obs.HardwareAddr + " " + obs.Host
+	if e, ok := l.entries[key]; ok {
+		e.Addr = obs.Addr
+		e.Proto = obs.Proto
+		e.Last = obs.Time
+		e.Count++
+		return
+	}
+	l.evict(l.Max - 1)
+	l.entries[key] = &Entry{
+		HardwareAddr: obs.HardwareAddr,
+		Addr:         obs.Addr,
+		Host:         obs.Host,
+		Proto:        obs.Proto,
+		First:        obs.Time,
+		Last:         obs.Time,
+		Count:        1,
+	}
+}
+
+// evict forgets the least recently seen entries until at most max remain. l.mu
+// must be held.
+func (l *Log) evict(max int) {
+	for len(l.entries) > max {
+		var oldest string
+		for key, e := range l.entries {
+			if oldest == "" || e.Last.Before(l.entries[oldest].Last) {
+				oldest = key
+			}
+		}
+		delete(l.entries, oldest)
+	}
+}
+
+// Prune removes entries which were last observed longer than Retention ago.
+func (l *Log) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range l.entries {
+		if now.Sub(e.Last) > l.Retention {
+			delete(l.entries, key)
+			l.dirty = true
+		}
+	}
+}
+
+// Clients returns the hardware addresses of all clients with entries.
+func (l *Log) Clients() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]bool)
+	var clients []string
+	for _, e := range l.entries {
+		if !seen[e.HardwareAddr] {
+			seen[e.HardwareAddr] = true
+			clients = append(clients, e.HardwareAddr)
+		}
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// Activity returns the entries of the client with hardware address hwaddr (or
+// of all clients if hwaddr is empty), most recently observed first.
+func (l *Log) Activity(hwaddr string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []Entry
+	for _, e := range l.entries {
+		if hwaddr == "" || e.HardwareAddr == hwaddr {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Last.Equal(entries[j].Last) {
+			return entries[i].Last.After(entries[j].Last)
+		}
+		return entries[i].Host < entries[j].Host
+	})
+	return entries
+}
+
+// Load reads the entries persisted by Save from fn.
+func (l *Log) Load(fn string) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range entries {
+		l.entries[e.HardwareAddr+" "+e.Host] = e
+	}
+	l.evict(l.Max)
+	return nil
+}
+
+// Save persists the entries to fn if they changed since the last Save.
+func (l *Log) Save(fn string) error {
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	l.dirty = false
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		e := *e // copy
+		entries = append(entries, &e)
+	}
+	l.mu.Unlock()
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(fn, b, 0644)
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sni passively observes which hostnames LAN clients contact, by
+// inspecting the server name indication (SNI) of TLS client hellos and the
+// Host header of plain HTTP requests. Traffic is never decrypted.
+package sni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// Protocols in which hostnames are observed.
+const (
+	ProtoTLS  = "tls"
+	ProtoHTTP = "http"
+)
+
+// Observation is a hostname contacted by a LAN client.
+type Observation struct {
+	Time         time.Time `json:"time"`
+	HardwareAddr string    `json:"hardware_addr"`
+	Addr         string    `json:"addr"`
+	Host         string    `json:"host"`
+	Proto        string    `json:"proto"`
+}
+
+// Observer inspects ethernet frames captured on the LAN interface.
+type Observer struct {
+	// HardwareAddr is router7’s own LAN MAC address. Frames from this address
+	// are ignored.
+	HardwareAddr net.HardwareAddr
+}
+
+// Filter passes only the frames which Inspect might observe a hostname in (TCP
+// segments with payload to port 80 or 443 in unfragmented IPv4 packets or in
+// IPv6 packets without extension headers) to userspace, for packet sockets
+// receiving all LAN traffic.
+var Filter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2}, // ethertype
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipTrue: 16},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x0800, SkipTrue: 27},
+	bpf.LoadAbsolute{Off: 14 + 9, Size: 1}, // IPv4 protocol
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 6, SkipTrue: 25},
+	bpf.LoadAbsolute{Off: 14 + 6, Size: 2}, // IPv4 fragment offset
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 23},
+	bpf.LoadMemShift{Off: 14},              // X = IPv4 header length
+	bpf.LoadIndirect{Off: 14 + 2, Size: 2}, // TCP destination port
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 443, SkipTrue: 19},
+	bpf.LoadIndirect{Off: 14 + 12, Size: 1}, // TCP data offset
+	bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+	bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+	bpf.ALUOpX{Op: bpf.ALUOpAdd}, // plus IPv4 header length
+	bpf.TAX{},
+	bpf.LoadAbsolute{Off: 14 + 2, Size: 2}, // IPv4 total length
+	bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 11, SkipFalse: 12},
+	bpf.LoadAbsolute{Off: 14 + 6, Size: 1}, // IPv6 next header
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 6, SkipTrue: 10},
+	bpf.LoadAbsolute{Off: 14 + 40 + 2, Size: 2}, // TCP destination port
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 443, SkipTrue: 7},
+	bpf.LoadAbsolute{Off: 14 + 40 + 12, Size: 1}, // TCP data offset
+	bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+	bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+	bpf.TAX{},
+	bpf.LoadAbsolute{Off: 14 + 4, Size: 2}, // IPv6 payload length
+	bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipFalse: 1},
+	bpf.RetConstant{Val: 262144},
+	bpf.RetConstant{Val: 0},
+}
+
+// Inspect returns an Observation if frame is a TLS client hello with server
+// name indication or a plain HTTP request with a Host header, or nil
+// otherwise.
+func (o *Observer) Inspect(frame []byte, at time.Time) *Observation {
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || bytes.Equal(eth.SrcMAC, o.HardwareAddr) {
+		return nil
+	}
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || len(tcp.Payload) == 0 {
+		return nil
+	}
+	obs := &Observation{
+		Time:         at,
+		HardwareAddr: eth.SrcMAC.String(),
+	}
+	if host, ok := ServerName(tcp.Payload); ok {
+		obs.Host, obs.Proto = host, ProtoTLS
+	} else if host, ok := HTTPHost(tcp.Payload); ok {
+		obs.Host, obs.Proto = host, ProtoHTTP
+	} else {
+		return nil
+	}
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		obs.Addr = ip.SrcIP.String()
+	case *layers.IPv6:
+		obs.Addr = ip.SrcIP.String()
+	}
+	return obs
+}
+
+// reader consumes length-prefixed fields of a TLS handshake message.
+type reader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *reader) skip(n int) {
+	if !r.ok || len(r.b) < n {
+		r.ok = false
+		return
+	}
+	r.b = r.b[n:]
+}
+
+func (r *reader) uint8() int {
+	if !r.ok || len(r.b) < 1 {
+		r.ok = false
+		return 0
+	}
+	v := int(r.b[0])
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) uint16() int {
+	if !r.ok || len(r.b) < 2 {
+		r.ok = false
+		return 0
+	}
+	v := int(binary.BigEndian.Uint16(r.b))
+	r.b = r.b[2:]
+	return v
+}
+
+// bytes returns the next n bytes.
+func (r *reader) bytes(n int) []byte {
+	if !r.ok || len(r.b) < n {
+		r.ok = false
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// sub returns a reader for the next n bytes.
+func (r *reader) sub(n int) *reader {
+	b := r.bytes(n)
+	return &reader{b: b, ok: r.ok}
+}
+
+// truncated returns a reader for the next n bytes, or the remaining bytes if
+// fewer than n are available: large client hellos span multiple TCP segments,
+// of which only the first is inspected.
+func (r *reader) truncated(n int) *reader {
+	if r.ok && len(r.b) < n {
+		n = len(r.b)
+	}
+	return r.sub(n)
+}
+
+// ServerName returns the server name indication of the TLS client hello in
+// payload (the first TCP segment of a TLS connection).
+func ServerName(payload []byte) (string, bool) {
+	r := &reader{b: payload, ok: true}
+	if r.uint8() != 22 { // content type: handshake
+		return "", false
+	}
+	r.skip(2) // legacy record version
+	r = r.truncated(r.uint16())
+	if r.uint8() != 1 { // handshake type: client hello
+		return "", false
+	}
+	r.skip(3)  // length (the message might span multiple records)
+	r.skip(2)  // client version
+	r.skip(32) // random
+	r.skip(r.uint8())
+	r.skip(r.uint16()) // cipher suites
+	r.skip(r.uint8())  // compression methods
+	exts := r.truncated(r.uint16())
+	for exts.ok && len(exts.b) > 0 {
+		typ := exts.uint16()
+		data := exts.bytes(exts.uint16())
+		if typ != 0 { // server_name
+			continue
+		}
+		names := &reader{b: data, ok: exts.ok}
+		names = names.sub(names.uint16())
+		for names.ok && len(names.b) > 0 {
+			nameType := names.uint8()
+			name := names.bytes(names.uint16())
+			if names.ok && nameType == 0 { // host_name
+				return strings.ToLower(string(name)), true
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
+
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT "}
+
+// HTTPHost returns the Host header (without port) of the HTTP request in
+// payload.
+func HTTPHost(payload []byte) (string, bool) {
+	var isRequest bool
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, []byte(m)) {
+			isRequest = true
+			break
+		}
+	}
+	if !isRequest {
+		return "", false
+	}
+	for _, line := range strings.Split(string(payload), "\r\n")[1:] {
+		if line == "" {
+			break // end of headers
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx == -1 || !strings.EqualFold(line[:idx], "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[idx+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			return "", false
+		}
+		return strings.ToLower(host), true
+	}
+	return "", false
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sni_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+
+	"github.com/rtr7/router7/internal/sni"
+)
+
+var (
+	routerMAC = net.HardwareAddr{0x02, 0x73, 0x53, 0x00, 0xb0, 0x0c}
+	clientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x23}
+)
+
+// clientHello returns the first bytes a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	buf := make([]byte, 16384)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestServerName(t *testing.T) {
+	hello := clientHello(t, "www.Example.com")
+	got, ok := sni.ServerName(hello)
+	if !ok {
+		t.Fatalf("ServerName: no server name found")
+	}
+	if want := "www.example.com"; got != want {
+		t.Errorf("ServerName: got %q, want %q", got, want)
+	}
+
+	// A client hello spanning multiple TCP segments might still contain the
+	// server name in the first segment:
+	if _, ok := sni.ServerName(hello[:len(hello)-10]); !ok {
+		t.Errorf("ServerName: no server name found in truncated client hello")
+	}
+
+	for _, payload := range [][]byte{
+		nil,
+		hello[:20],
+		[]byte("GET / HTTP/1.1\r\n"),
+		clientHello(t, "192.168.42.1"), // IP addresses are not sent as SNI
+	} {
+		if got, ok := sni.ServerName(payload); ok {
+			t.Errorf("ServerName(%q) = %q, want no server name", payload, got)
+		}
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	for _, tt := range []struct {
+		payload string
+		want    string
+	}{
+		{"GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: Example.com:8080\r\n\r\n", "example.com"},
+		{"POST /upload HTTP/1.1\r\nhost: example.net\r\n\r\n", "example.net"},
+		{"GET / HTTP/1.1\r\n\r\nHost: example.org\r\n", ""}, // body, not a header
+		{"HTTP/1.1 200 OK\r\nHost: example.org\r\n\r\n", ""},
+	} {
+		got, _ := sni.HTTPHost([]byte(tt.payload))
+		if got != tt.want {
+			t.Errorf("HTTPHost(%q) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func tcpFrame(t *testing.T, src net.HardwareAddr, payload []byte) []byte {
+	return tcpFrameTo(t, src, 443, payload)
+}
+
+func tcpFrameTo(t *testing.T, src net.HardwareAddr, port layers.TCPPort, payload []byte) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{192, 168, 42, 23},
+		DstIP:    net.IP{93, 184, 216, 34},
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{SrcPort: 51234, DstPort: port, PSH: true, ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       routerMAC,
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip,
+		tcp,
+		gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspect(t *testing.T) {
+	o := &sni.Observer{HardwareAddr: routerMAC}
+	now := time.Now()
+	obs := o.Inspect(tcpFrame(t, clientMAC, clientHello(t, "example.com")), now)
+	if obs == nil {
+		t.Fatalf("Inspect unexpectedly returned nil")
+	}
+	want := sni.Observation{
+		Time:         now,
+		HardwareAddr: clientMAC.String(),
+		Addr:         "192.168.42.23",
+		Host:         "example.com",
+		Proto:        sni.ProtoTLS,
+	}
+	if *obs != want {
+		t.Errorf("Inspect: got %+v, want %+v", *obs, want)
+	}
+
+	if obs := o.Inspect(tcpFrame(t, routerMAC, clientHello(t, "example.com")), now); obs != nil {
+		t.Errorf("Inspect unexpectedly returned an observation for router7’s own traffic: %+v", obs)
+	}
+}
+
+func tcp6Frame(t *testing.T, src net.HardwareAddr, payload []byte) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::23"),
+		DstIP:      net.ParseIP("2001:db8:1::1"),
+		NextHeader: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{SrcPort: 51234, DstPort: 443, PSH: true, ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       routerMAC,
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		ip,
+		tcp,
+		gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFilter(t *testing.T) {
+	vm, err := bpf.NewVM(sni.Filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := clientHello(t, "example.com")
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	for _, tt := range []struct {
+		desc  string
+		frame []byte
+		want  bool
+	}{
+		{"client hello", tcpFrame(t, clientMAC, hello), true},
+		{"IPv6 client hello", tcp6Frame(t, clientMAC, hello), true},
+		{"HTTP request", tcpFrameTo(t, clientMAC, 80, request), true},
+		{"ACK", tcpFrame(t, clientMAC, nil), false},
+		{"IPv6 ACK", tcp6Frame(t, clientMAC, nil), false},
+		{"SSH", tcpFrameTo(t, clientMAC, 22, []byte("SSH-2.0-OpenSSH_9.6\r\n")), false},
+	} {
+		n, err := vm.Run(tt.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n > 0; got != tt.want {
+			t.Errorf("%s: passed = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Now()
+	l := sni.NewLog(24*time.Hour, sni.DefaultMaxEntries)
+	for _, obs := range []*sni.Observation{
+		{Time: now.Add(-48 * time.Hour), HardwareAddr: "02:00:00:00:00:01", Host: "old.example.com"},
+		{Time: now.Add(-2 * time.Minute), HardwareAddr: "02:00:00:00:00:01", Host: "example.com"},
+		{Time: now.Add(-1 * time.Minute), HardwareAddr: "02:00:00:00:00:01", Host: "example.com"},
+		{Time: now, HardwareAddr: "02:00:00:00:00:02", Host: "example.net"},
+	} {
+		l.Add(obs)
+	}
+	l.Prune(now)
+	fn := filepath.Join(tmp, "activity.json")
+	if err := l.Save(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := sni.NewLog(24*time.Hour, sni.DefaultMaxEntries)
+	if err := loaded.Load(fn); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(loaded.Clients()), 2; got != want {
+		t.Fatalf("Clients: got %d, want %d", got, want)
+	}
+	activity := loaded.Activity("02:00:00:00:00:01")
+	if got, want := len(activity), 1; got != want {
+		t.Fatalf("Activity: got %d entries, want %d: %+v", got, want, activity)
+	}
+	if got, want := activity[0].Count, 2; got != want {
+		t.Errorf("Activity: got count %d, want %d", got, want)
+	}
+	if got, want := len(loaded.Activity("")), 2; got != want {
+		t.Errorf("Activity of all clients: got %d entries, want %d", got, want)
+	}
+}
+
+func TestLogMax(t *testing.T) {
+	now := time.Now()
+	l := sni.NewLog(24*time.Hour, 2)
+	for _, obs := range []*sni.Observation{
+		{Time: now.Add(-3 * time.Minute), HardwareAddr: "02:00:00:00:00:01", Host: "example.com"},
+		{Time: now.Add(-2 * time.Minute), HardwareAddr: "02:00:00:00:00:02", Host: "example.net"},
+		{Time: now.Add(-1 * time.Minute), HardwareAddr: "02:00:00:00:00:01", Host: "example.com"},
+		// evicts example.net, which was seen least recently
+		{Time: now, HardwareAddr: "02:00:00:00:00:03", Host: "example.org"},
+	} {
+		l.Add(obs)
+	}
+	activity := l.Activity("")
+	var hosts []string
+	for _, e := range activity {
+		hosts = append(hosts, e.Host)
+	}
+	if got, want := strings.Join(hosts, ","), "example.org,example.com"; got != want {
+		t.Errorf("Activity: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package statefile implements versioned on-disk schemas for the state which
+// router7 daemons persist in /perm (e.g. DHCP leases): files carry the version
+// of their schema, older versions are migrated when loading, and versions
+// written by a newer router7 are refused instead of being misinterpreted (and
+// then overwritten) after a downgrade.
+package statefile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Migration converts the data of one schema version to the next version.
+type Migration func(data json.RawMessage) (json.RawMessage, error)
+
+// Schema describes the versions of a state file.
+type Schema struct {
+	// Name identifies the file in error messages, e.g. dhcp4d/leases.json.
+	Name string
+
+	// Version is the current version, which Marshal writes.
+	Version int
+
+	// Migrations[v] converts version v to version v+1. Files written
+	// before versioning was introduced (i.e. without envelope) are version
+	// 1.
+	Migrations map[int]Migration
+}
+
+// envelope is the on-disk format of versioned state files.
+type envelope struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// VersionError is returned for files which were written by a newer router7,
+// using a schema version which this version does not know.
+type VersionError struct {
+	Name      string
+	Version   int
+	Supported int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s: schema version %d is newer than the supported version %d (written by a newer router7?), refusing to load it; update router7 or remove the file", e.Name, e.Version, e.Supported)
+}
+
+// Schemas of the state files which are read by other daemons than the one
+// writing them. They are defined here (instead of next to the code writing
+// them) so that readers which cannot import the writer, e.g. package
+// netconfig reading dhcp4d’s leases, agree on the versions.
+var (
+	// Leases4 is dhcp4d/leases.json: []dhcp4d.Lease.
+	Leases4 = &Schema{Name: "dhcp4d/leases.json", Version: 1}
+
+	// LastSeen is dhcp4d/lastseen.json: map[string]time.Time, keyed by
+	// hardware address.
+	LastSeen = &Schema{Name: "dhcp4d/lastseen.json", Version: 1}
+
+	// Leases6 is dhcp6d/leases.json: []dhcp6d.Lease.
+	Leases6 = &Schema{Name: "dhcp6d/leases.json", Version: 1}
+)
+
+// Marshal returns v in the current version of s, indented with tabs.
+func (s *Schema) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(&envelope{Version: s.Version, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "\t"); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decode returns the version and data of file contents b.
+func decode(b []byte) (int, json.RawMessage, error) {
+	// Versioned files are an object with exactly the envelope fields.
+	// Anything else (e.g. a JSON array of leases) predates versioning.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return 1, b, nil
+	}
+	if len(fields) != 2 || fields["version"] == nil || fields["data"] == nil {
+		return 1, b, nil
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return 0, nil, err
+	}
+	if env.Version < 1 {
+		return 0, nil, fmt.Errorf("invalid schema version %d", env.Version)
+	}
+	return env.Version, env.Data, nil
+}
+
+// Unmarshal migrates file contents b to the current version of s and stores
+// the result in v.
+func (s *Schema) Unmarshal(b []byte, v interface{}) error {
+	version, data, err := decode(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.Name, err)
+	}
+	if version > s.Version {
+		return &VersionError{Name: s.Name, Version: version, Supported: s.Version}
+	}
+	for ; version < s.Version; version++ {
+		migrate, ok := s.Migrations[version]
+		if !ok {
+			return fmt.Errorf("%s: no migration from schema version %d", s.Name, version)
+		}
+		if data, err = migrate(data); err != nil {
+			return fmt.Errorf("%s: migrating from schema version %d: %v", s.Name, version, err)
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", s.Name, err)
+	}
+	return nil
+}
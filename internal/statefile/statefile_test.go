@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statefile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type lease struct {
+	Addr     string `json:"addr"`
+	Hostname string `json:"hostname"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	leases := []lease{{Addr: "192.168.42.23", Hostname: "xps"}}
+	b, err := Leases4.Marshal(leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("{\n\t\"version\": 1,")) {
+		t.Errorf("Marshal: unexpected output: %s", b)
+	}
+	var got []lease
+	if err := Leases4.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(leases, got); diff != "" {
+		t.Errorf("Unmarshal: unexpected result: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestUnversioned(t *testing.T) {
+	var leases []lease
+	if err := Leases4.Unmarshal([]byte(`[{"addr": "192.168.42.23", "hostname": "xps"}]`), &leases); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]lease{{Addr: "192.168.42.23", Hostname: "xps"}}, leases); diff != "" {
+		t.Errorf("Unmarshal: unexpected result: diff (-want +got):\n%s", diff)
+	}
+
+	// Objects are unversioned unless they consist of the envelope fields.
+	var seen map[string]string
+	if err := LastSeen.Unmarshal([]byte(`{"version": "1", "data": "2", "aa:bb:cc:dd:ee:ff": "3"}`), &seen); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(seen), 3; got != want {
+		t.Errorf("Unmarshal: got %d entries, want %d", got, want)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	// Version 2 renamed hostname to name, version 3 wraps the list.
+	s := &Schema{
+		Name:    "test.json",
+		Version: 3,
+		Migrations: map[int]Migration{
+			1: func(data json.RawMessage) (json.RawMessage, error) {
+				return json.RawMessage(strings.Replace(string(data), `"hostname"`, `"name"`, -1)), nil
+			},
+			2: func(data json.RawMessage) (json.RawMessage, error) {
+				return json.RawMessage(fmt.Sprintf(`{"leases": %s}`, data)), nil
+			},
+		},
+	}
+	type v3 struct {
+		Leases []struct {
+			Name string `json:"name"`
+		} `json:"leases"`
+	}
+	for _, input := range []string{
+		`[{"hostname": "xps"}]`,
+		`{"version": 1, "data": [{"hostname": "xps"}]}`,
+		`{"version": 2, "data": [{"name": "xps"}]}`,
+		`{"version": 3, "data": {"leases": [{"name": "xps"}]}}`,
+	} {
+		var got v3
+		if err := s.Unmarshal([]byte(input), &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", input, err)
+			continue
+		}
+		if len(got.Leases) != 1 || got.Leases[0].Name != "xps" {
+			t.Errorf("Unmarshal(%s) = %+v, want lease xps", input, got)
+		}
+	}
+
+	delete(s.Migrations, 2)
+	var got v3
+	if err := s.Unmarshal([]byte(`[{"hostname": "xps"}]`), &got); err == nil {
+		t.Errorf("Unmarshal unexpectedly succeeded without migration")
+	}
+}
+
+func TestFutureVersion(t *testing.T) {
+	var leases []lease
+	err := Leases4.Unmarshal([]byte(`{"version": 2, "data": {"leases": []}}`), &leases)
+	if _, ok := err.(*VersionError); !ok {
+		t.Fatalf("Unmarshal(future version) = %v, want *VersionError", err)
+	}
+	if !strings.Contains(err.Error(), "dhcp4d/leases.json") {
+		t.Errorf("error %q does not name the file", err)
+	}
+
+	if err := Leases4.Unmarshal([]byte(`{"version": 0, "data": []}`), &leases); err == nil {
+		t.Errorf("Unmarshal(version 0) unexpectedly succeeded")
+	}
+}
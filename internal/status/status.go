@@ -0,0 +1,326 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package status implements the public status page of diagd: a read-only
+// summary of the router’s health (uptime, WAN connectivity and optionally the
+// WAN address) which does not require authentication, so that it can be
+// exposed to family members or an external uptime monitor without exposing
+// the management interfaces.
+package status
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/rtr7/router7/internal/webui"
+)
+
+// WAN address visibility, see Config.WANAddr.
+const (
+	Hide   = "hide"
+	Redact = "redact"
+	Show   = "show"
+)
+
+// maxClients bounds the number of per-client rate limiters.
+const maxClients = 1024
+
+// Config is the public status page configuration, stored in status.json.
+type Config struct {
+	// Listen are the addresses on which the status page is served, e.g.
+	// [":7780"]. The status page is disabled if empty.
+	Listen []string `json:"listen"`
+
+	// WANAddr is whether the status page contains the WAN address: “hide”
+	// (default), “redact” (e.g. 203.0.113.x) or “show”.
+	WANAddr string `json:"wan_addr"`
+
+	// RequestsPerMinute limits how often each client can request the status
+	// page, defaults to 30.
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// ReadConfig reads status.json from dir. A missing file results in a Config
+// which disables the status page.
+func ReadConfig(dir string) (*Config, error) {
+	cfg := &Config{}
+	fn := filepath.Join(dir, "status.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	if cfg.WANAddr == "" {
+		cfg.WANAddr = Hide
+	}
+	if cfg.WANAddr != Hide && cfg.WANAddr != Redact && cfg.WANAddr != Show {
+		return nil, fmt.Errorf("%s: wan_addr must be one of %q, %q or %q", fn, Hide, Redact, Show)
+	}
+	if cfg.RequestsPerMinute == 0 {
+		cfg.RequestsPerMinute = 30
+	}
+	if cfg.RequestsPerMinute < 0 {
+		return nil, fmt.Errorf("%s: requests_per_minute must be positive", fn)
+	}
+	return cfg, nil
+}
+
+// Status is the content of the status page.
+type Status struct {
+	Uptime time.Duration `json:"-"`
+
+	// UptimeSeconds is the time since the router booted.
+	UptimeSeconds int64 `json:"uptime_seconds"`
+
+	// WANUp is whether the connectivity diagnostics succeeded most recently.
+	WANUp bool `json:"wan_up"`
+
+	// WANSince is when the WAN connection last went up or down, nil if
+	// unknown (e.g. right after diagd started).
+	WANSince *time.Time `json:"wan_since,omitempty"`
+
+	// WANAddr is the WAN address, hidden or redacted according to
+	// Config.WANAddr.
+	WANAddr string `json:"wan_addr,omitempty"`
+}
+
+// redact returns addr with the host part replaced, e.g. 203.0.113.x for
+// 203.0.113.7, or 2001:db8:0:1::/64 for 2001:db8:0:1::7.
+func redact(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.x", ip4[0], ip4[1], ip4[2])
+	}
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return n.String()
+}
+
+// clientLimiter rate-limits the requests of one client address.
+type clientLimiter struct {
+	lim  *rate.Limiter
+	last time.Time
+}
+
+// Page serves the public status page.
+type Page struct {
+	now    func() time.Time
+	uptime func() (time.Duration, error)
+
+	mu       sync.Mutex
+	cfg      *Config
+	wanKnown bool
+	wanUp    bool
+	wanSince time.Time
+	wanAddr  string
+	clients  map[string]*clientLimiter
+}
+
+// NewPage returns a status page configured by cfg.
+func NewPage(cfg *Config) *Page {
+	return &Page{
+		now:     time.Now,
+		uptime:  readUptime,
+		cfg:     cfg,
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// SetConfig replaces the configuration, e.g. after status.json was modified.
+func (p *Page) SetConfig(cfg *Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg = cfg
+	p.clients = make(map[string]*clientLimiter)
+}
+
+// SetWAN records the result of the most recent connectivity diagnostics and
+// the current WAN address.
+func (p *Page) SetWAN(up bool, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wanKnown && up != p.wanUp {
+		p.wanSince = p.now()
+	}
+	p.wanKnown = true
+	p.wanUp = up
+	p.wanAddr = addr
+}
+
+// Status returns the current status.
+func (p *Page) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := Status{
+		WANUp: p.wanUp,
+	}
+	if !p.wanSince.IsZero() {
+		since := p.wanSince
+		st.WANSince = &since
+	}
+	if uptime, err := p.uptime(); err == nil {
+		st.Uptime = uptime.Truncate(time.Second)
+		st.UptimeSeconds = int64(uptime / time.Second)
+	}
+	switch p.cfg.WANAddr {
+	case Show:
+		st.WANAddr = p.wanAddr
+	case Redact:
+		st.WANAddr = redact(p.wanAddr)
+	}
+	return st
+}
+
+// clientKey returns the key under which requests from host are rate-limited:
+// the address itself for IPv4, its /64 for IPv6, as a single client usually
+// has a whole /64 to pick addresses from.
+func clientKey(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// allow returns whether the client with address host may make another request.
+func (p *Page) allow(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	key := clientKey(host)
+	c, ok := p.clients[key]
+	if !ok {
+		if len(p.clients) >= maxClients {
+			p.evictOldest()
+		}
+		rpm := p.cfg.RequestsPerMinute
+		burst := 5
+		if rpm < burst {
+			burst = rpm
+		}
+		c = &clientLimiter{lim: rate.NewLimiter(rate.Every(time.Minute/time.Duration(rpm)), burst)}
+		p.clients[key] = c
+	}
+	c.last = now
+	return c.lim.AllowN(now, 1)
+}
+
+// evictOldest forgets the least recently seen client so that new clients are
+// not refused when the table is full. p.mu must be held.
+func (p *Page) evictOldest() {
+	var (
+		oldest string
+		last   time.Time
+	)
+	for key, c := range p.clients {
+		if oldest == "" || c.last.Before(last) {
+			oldest, last = key, c.last
+		}
+	}
+	delete(p.clients, oldest)
+}
+
+//go:embed status.html.tmpl
+var statusHTML string
+
+var statusTmpl = template.Must(template.New("status").Funcs(template.FuncMap{
+	"T": webui.Translate,
+	"timefmt": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+}).Parse(statusHTML))
+
+// ServeHTTP serves the status page as HTML, or as JSON for /status.json. The
+// client address is taken from the connection, not from headers, as the page
+// is typically exposed to the internet.
+func (p *Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path != "/" && r.URL.Path != "/status.json" {
+		http.NotFound(w, r)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !p.allow(host) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Minute/time.Second)))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	st := p.Status()
+	if r.URL.Path == "/status.json" {
+		b, err := json.Marshal(&st)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTmpl.Execute(w, struct {
+		Lang   string
+		Status Status
+	}{
+		Lang:   webui.Language(r),
+		Status: st,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// readUptime returns the time since boot from /proc/uptime.
+func readUptime() (time.Duration, error) {
+	b, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 1 {
+		return 0, fmt.Errorf("/proc/uptime: unexpected format")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
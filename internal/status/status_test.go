@@ -0,0 +1,201 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listen) > 0 || cfg.WANAddr != Hide || cfg.RequestsPerMinute != 30 {
+		t.Errorf("ReadConfig(missing) = %+v, want disabled defaults", cfg)
+	}
+
+	for _, invalid := range []string{
+		`{"wan_addr": "partial"}`,
+		`{"requests_per_minute": -1}`,
+		`{"listen": ":7780"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "status.json"), []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(dir); err == nil {
+			t.Errorf("ReadConfig(%s) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tt := range []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.x"},
+		{"2001:db8:0:1::7", "2001:db8:0:1::/64"},
+		{"", ""},
+	} {
+		if got := redact(tt.addr); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func newTestPage(cfg *Config) (*Page, func(time.Duration)) {
+	now := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	p := NewPage(cfg)
+	p.now = func() time.Time { return now }
+	p.uptime = func() (time.Duration, error) { return 90 * time.Minute, nil }
+	return p, func(d time.Duration) { now = now.Add(d) }
+}
+
+func get(p *Page, path, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStatus(t *testing.T) {
+	p, advance := newTestPage(&Config{WANAddr: Redact, RequestsPerMinute: 30})
+	p.SetWAN(true, "203.0.113.7")
+	advance(time.Hour)
+	p.SetWAN(false, "203.0.113.7")
+
+	rec := get(p, "/status.json", "192.0.2.1:1234")
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+	var st Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Date(2018, 7, 4, 13, 0, 0, 0, time.UTC)
+	want := Status{
+		UptimeSeconds: 5400,
+		WANUp:         false,
+		WANSince:      &since,
+		WANAddr:       "203.0.113.x",
+	}
+	if st.WANSince == nil || !st.WANSince.Equal(since) || st.UptimeSeconds != want.UptimeSeconds || st.WANUp != want.WANUp || st.WANAddr != want.WANAddr {
+		t.Errorf("status: got %+v, want %+v", st, want)
+	}
+
+	rec = get(p, "/", "192.0.2.1:1234")
+	if body := rec.Body.String(); !strings.Contains(body, "2018-07-04 13:00") {
+		t.Errorf("HTML status page does not contain the WAN change time: %s", body)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "203.0.113.x") || strings.Contains(body, "203.0.113.7") {
+		t.Errorf("HTML status page does not contain the redacted WAN address: %s", body)
+	}
+
+	p.SetConfig(&Config{WANAddr: Hide, RequestsPerMinute: 30})
+	if body := get(p, "/status.json", "192.0.2.1:1234").Body.String(); strings.Contains(body, "203.0.113") {
+		t.Errorf("status contains the hidden WAN address: %s", body)
+	}
+
+	if got, want := get(p, "/metrics", "192.0.2.1:1234").Code, http.StatusNotFound; got != want {
+		t.Errorf("/metrics: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	p, advance := newTestPage(&Config{WANAddr: Hide, RequestsPerMinute: 30})
+	for i := 0; i < 5; i++ {
+		if got, want := get(p, "/status.json", "192.0.2.1:1234").Code, http.StatusOK; got != want {
+			t.Fatalf("request %d: unexpected HTTP status: got %d, want %d", i, got, want)
+		}
+	}
+	rec := get(p, "/status.json", "192.0.2.1:4321")
+	if got, want := rec.Code, http.StatusTooManyRequests; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Retry-After header missing")
+	}
+	if got, want := get(p, "/status.json", "192.0.2.2:1234").Code, http.StatusOK; got != want {
+		t.Errorf("other client: unexpected HTTP status: got %d, want %d", got, want)
+	}
+	advance(2 * time.Second)
+	if got, want := get(p, "/status.json", "192.0.2.1:1234").Code, http.StatusOK; got != want {
+		t.Errorf("after refill: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
+
+func TestWANSinceUnknown(t *testing.T) {
+	p, _ := newTestPage(&Config{WANAddr: Hide, RequestsPerMinute: 30})
+	p.SetWAN(true, "203.0.113.7")
+	if body := get(p, "/status.json", "192.0.2.1:1234").Body.String(); strings.Contains(body, "wan_since") {
+		t.Errorf("status contains unknown wan_since: %s", body)
+	}
+}
+
+func TestRateLimitIPv6Prefix(t *testing.T) {
+	p, _ := newTestPage(&Config{WANAddr: Hide, RequestsPerMinute: 30})
+	for i := 0; i < 5; i++ {
+		addr := fmt.Sprintf("[2001:db8:0:1::%x]:1234", i+1)
+		if got, want := get(p, "/status.json", addr).Code, http.StatusOK; got != want {
+			t.Fatalf("request %d: unexpected HTTP status: got %d, want %d", i, got, want)
+		}
+	}
+	if got, want := get(p, "/status.json", "[2001:db8:0:1::ffff]:1234").Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("same /64: unexpected HTTP status: got %d, want %d", got, want)
+	}
+	if got, want := get(p, "/status.json", "[2001:db8:0:2::1]:1234").Code, http.StatusOK; got != want {
+		t.Errorf("other /64: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
+
+func TestRateLimitEvictOldest(t *testing.T) {
+	p, advance := newTestPage(&Config{WANAddr: Hide, RequestsPerMinute: 30})
+	for i := 0; i < maxClients; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		if got, want := get(p, "/status.json", addr).Code, http.StatusOK; got != want {
+			t.Fatalf("client %d: unexpected HTTP status: got %d, want %d", i, got, want)
+		}
+		advance(time.Millisecond)
+	}
+	if got, want := get(p, "/status.json", "192.0.2.1:1234").Code, http.StatusOK; got != want {
+		t.Fatalf("new client with full table: unexpected HTTP status: got %d, want %d", got, want)
+	}
+	if got, want := len(p.clients), maxClients; got != want {
+		t.Errorf("unexpected number of clients: got %d, want %d", got, want)
+	}
+	if _, ok := p.clients["10.0.0.0"]; ok {
+		t.Errorf("oldest client 10.0.0.0 was not evicted")
+	}
+	if _, ok := p.clients["10.0.0.1"]; !ok {
+		t.Errorf("client 10.0.0.1 was unexpectedly evicted")
+	}
+}
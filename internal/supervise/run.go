@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package supervise
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/healthz"
+)
+
+func (s *Supervisor) registerMetrics() {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Subsystem: "supervise",
+		Name:      "restarts_total",
+		Help:      "Restarts of the daemon since boot",
+	}, func() float64 {
+		return float64(s.State().Starts - 1)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "supervise",
+		Name:      "last_crash_timestamp_seconds",
+		Help:      "Time of the most recent crash of the daemon (0 if never)",
+	}, func() float64 {
+		if c := s.State().LastCrash; c != nil {
+			return float64(c.Time.Unix())
+		}
+		return 0
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "supervise",
+		Name:      "crash_looping",
+		Help:      "Whether the daemon crashed repeatedly within the last 10 minutes (1) or not (0)",
+	}, func() float64 {
+		if s.CrashLooping() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// Run records the start of daemon name (state in /perm/<name>), exports the
+// supervise_* metrics and a “crash-loop” health check, and runs logic. If
+// logic returns an error or panics, Run records the crash and waits (see
+// Crashed) before returning the error or re-panicking.
+func Run(name string, logic func() error) error {
+	s, serr := Start(filepath.Join("/perm", name))
+	if serr != nil {
+		// Supervision is best-effort: a broken /perm must not keep the
+		// daemon from running.
+		log.Printf("%s: not recording restarts: %v", name, serr)
+		return logic()
+	}
+	if c := s.State().LastCrash; c != nil && s.State().Starts > 1 {
+		log.Printf("%s: restart %d, last crash at %v: %s", name, s.State().Starts-1, c.Time.Format(time.RFC3339), c.Reason)
+	}
+	s.registerMetrics()
+	healthz.Register("crash-loop", func() error {
+		if s.CrashLooping() {
+			return fmt.Errorf("crashed %d times within 10m, last: %s", len(s.State().Crashes), s.State().LastCrash.Reason)
+		}
+		return nil
+	})
+
+	crashed := func(reason string) {
+		backoff, err := s.Crashed(reason)
+		if err != nil {
+			log.Printf("%s: recording crash: %v", name, err)
+		}
+		if backoff > 0 {
+			log.Printf("%s: crash-looping, waiting %v before exiting", name, backoff)
+			time.Sleep(backoff)
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			crashed(fmt.Sprintf("panic: %v", r))
+			panic(r)
+		}
+	}()
+	if err := logic(); err != nil {
+		crashed(err.Error())
+		return err
+	}
+	return nil
+}
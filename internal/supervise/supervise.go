@@ -0,0 +1,190 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package supervise makes daemons aware of being restarted by the gokrazy
+// supervisor: each daemon records its starts and the reason of its last crash
+// in /perm/<daemon>/supervise.json, exports them as metrics and backs off
+// before exiting when it is crash-looping, so that a broken daemon neither
+// floods the logs nor goes unnoticed on a remote router.
+package supervise
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+const (
+	// window is the period in which crashes count towards a crash loop.
+	window = 10 * time.Minute
+
+	// loopCrashes is the number of crashes within window from which a daemon
+	// is considered crash-looping.
+	loopCrashes = 3
+
+	maxBackoff = 5 * time.Minute
+)
+
+// Crash describes why a daemon exited.
+type Crash struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// State is persisted across restarts of a daemon.
+type State struct {
+	BootID    string      `json:"boot_id"` // restarts are counted per boot
+	Starts    int         `json:"starts"`
+	Running   bool        `json:"running"` // false once an exit was recorded
+	LastCrash *Crash      `json:"last_crash,omitempty"`
+	Crashes   []time.Time `json:"crashes,omitempty"` // within window
+}
+
+// Supervisor tracks the State of one daemon.
+type Supervisor struct {
+	fn     string
+	bootID string
+	now    func() time.Time
+
+	mu    sync.Mutex
+	state State
+}
+
+// unknownExit is recorded as crash reason when a daemon was started while its
+// previous instance did not record how it exited, e.g. because it was killed.
+const unknownExit = "exited without recording a reason (killed, e.g. out of memory?)"
+
+// Start records a start of the daemon whose state is in dir, e.g.
+// /perm/dhcp4d.
+func Start(dir string) (*Supervisor, error) {
+	return start(dir, readBootID(), time.Now)
+}
+
+func readBootID() string {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func start(dir, bootID string, now func() time.Time) (*Supervisor, error) {
+	s := &Supervisor{
+		fn:     filepath.Join(dir, "supervise.json"),
+		bootID: bootID,
+		now:    now,
+	}
+	b, err := ioutil.ReadFile(s.fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.fn, err)
+		}
+	}
+	if s.state.BootID != bootID {
+		// The router rebooted: previous instances did not crash.
+		s.state = State{BootID: bootID, LastCrash: s.state.LastCrash}
+	} else if s.state.Running {
+		s.recordCrash(unknownExit)
+	}
+	s.state.Starts++
+	s.state.Running = true
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, s.persist()
+}
+
+func (s *Supervisor) persist() error {
+	b, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(s.fn, b, 0644)
+}
+
+// recordCrash must be called with s.mu held.
+func (s *Supervisor) recordCrash(reason string) {
+	now := s.now()
+	s.state.Running = false
+	s.state.LastCrash = &Crash{Time: now, Reason: reason}
+	crashes := []time.Time{now}
+	for _, t := range s.state.Crashes {
+		if now.Sub(t) < window {
+			crashes = append(crashes, t)
+		}
+	}
+	s.state.Crashes = crashes
+}
+
+// Crashed records that the daemon is about to exit because of reason and
+// returns how long to wait before exiting: the gokrazy supervisor restarts
+// daemons right away, so waiting slows down crash loops.
+func (s *Supervisor) Crashed(reason string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordCrash(reason)
+	return s.backoff(), s.persist()
+}
+
+// backoff must be called with s.mu held.
+func (s *Supervisor) backoff() time.Duration {
+	n := s.recentCrashes()
+	if n < loopCrashes {
+		return 0
+	}
+	backoff := time.Second << uint(n-loopCrashes)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// recentCrashes must be called with s.mu held.
+func (s *Supervisor) recentCrashes() int {
+	now := s.now()
+	var n int
+	for _, t := range s.state.Crashes {
+		if now.Sub(t) < window {
+			n++
+		}
+	}
+	return n
+}
+
+// State returns a copy of the current state.
+func (s *Supervisor) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state
+	st.Crashes = append([]time.Time(nil), s.state.Crashes...)
+	return st
+}
+
+// CrashLooping returns whether the daemon crashed repeatedly within the last
+// 10 minutes.
+func (s *Supervisor) CrashLooping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recentCrashes() >= loopCrashes
+}
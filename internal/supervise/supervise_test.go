@@ -0,0 +1,108 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package supervise
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSupervise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	// First start, clean run.
+	s, err := start(dir, "boot1", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := s.State(); st.Starts != 1 || st.LastCrash != nil {
+		t.Fatalf("unexpected state after first start: %+v", st)
+	}
+
+	// Crash twice: no backoff yet.
+	for i := 0; i < 2; i++ {
+		backoff, err := s.Crashed("listen tcp :8067: address already in use")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backoff != 0 {
+			t.Fatalf("crash %d: unexpected backoff %v", i, backoff)
+		}
+		now = now.Add(time.Minute)
+		if s, err = start(dir, "boot1", clock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.CrashLooping() {
+		t.Fatalf("crash-looping after 2 crashes")
+	}
+
+	// The third crash within 10 minutes is a crash loop.
+	backoff, err := s.Crashed("boom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backoff, time.Second; got != want {
+		t.Errorf("unexpected backoff: got %v, want %v", got, want)
+	}
+	if !s.CrashLooping() {
+		t.Errorf("not crash-looping after 3 crashes")
+	}
+
+	// Killed (no crash recorded) counts as crash, too.
+	if s, err = start(dir, "boot1", clock); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = start(dir, "boot1", clock); err != nil {
+		t.Fatal(err)
+	}
+	st := s.State()
+	if got, want := st.Starts, 5; got != want {
+		t.Errorf("unexpected number of starts: got %d, want %d", got, want)
+	}
+	if got, want := st.LastCrash.Reason, unknownExit; got != want {
+		t.Errorf("unexpected crash reason: got %q, want %q", got, want)
+	}
+	if backoff, _ := s.Crashed("boom"); backoff != 4*time.Second {
+		t.Errorf("unexpected backoff after 5 crashes: got %v, want 4s", backoff)
+	}
+
+	// Crashes age out of the window.
+	now = now.Add(time.Hour)
+	if s.CrashLooping() {
+		t.Errorf("still crash-looping an hour later")
+	}
+
+	// A reboot resets the restart count, but retains the last crash.
+	if s, err = start(dir, "boot2", clock); err != nil {
+		t.Fatal(err)
+	}
+	st = s.State()
+	if st.Starts != 1 || len(st.Crashes) != 0 {
+		t.Errorf("unexpected state after reboot: %+v", st)
+	}
+	if st.LastCrash == nil || st.LastCrash.Reason != "boom" {
+		t.Errorf("last crash not retained across reboot: %+v", st.LastCrash)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tailscale configures tailscaled, which joins router7 to a tailnet.
+package tailscale
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config is the tailnet configuration, stored in tailscale.json.
+type Config struct {
+	Enabled bool `json:"enabled"`
+
+	// AuthKey is a (reusable or pre-authorized) auth key, only required
+	// until the node is logged in: the node key is persisted in the state
+	// file.
+	AuthKey string `json:"auth_key"`
+
+	// Hostname is the name of the node in the tailnet, defaults to
+	// “router7”.
+	Hostname string `json:"hostname"`
+
+	// AdvertiseLAN advertises the lan0 subnet (e.g. 192.168.42.0/24) as
+	// subnet route, so that tailnet nodes can reach LAN clients.
+	AdvertiseLAN bool `json:"advertise_lan"`
+
+	// AdvertiseRoutes are additional subnet routes, e.g. 10.0.7.0/24.
+	AdvertiseRoutes []string `json:"advertise_routes"`
+
+	// AcceptRoutes accepts the subnet routes advertised by other nodes.
+	AcceptRoutes bool `json:"accept_routes"`
+
+	// ExposePorts are the TCP ports of router7 (e.g. 80 for the gokrazy web
+	// interface, 7733 for diagd) which are forwarded from router7’s
+	// tailnet address to localhost.
+	ExposePorts []int `json:"expose_ports"`
+
+	// Tailscaled and Tailscale are the paths of the tailscale binaries,
+	// default to /perm/tailscale/bin/tailscaled and
+	// /perm/tailscale/bin/tailscale.
+	Tailscaled string `json:"tailscaled"`
+	Tailscale  string `json:"tailscale"`
+}
+
+// Socket is the control socket of tailscaled.
+const Socket = "/tmp/tailscaled.sock"
+
+// ReadConfig reads tailscale.json from dir and fills in defaults.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "tailscale.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, d := range []struct {
+		field *string
+		def   string
+	}{
+		{&cfg.Hostname, "router7"},
+		{&cfg.Tailscaled, filepath.Join(dir, "tailscale", "bin", "tailscaled")},
+		{&cfg.Tailscale, filepath.Join(dir, "tailscale", "bin", "tailscale")},
+	} {
+		if *d.field == "" {
+			*d.field = d.def
+		}
+	}
+	for _, r := range cfg.AdvertiseRoutes {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return nil, fmt.Errorf("%s: advertise_routes: %v", fn, err)
+		}
+	}
+	for _, port := range cfg.ExposePorts {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s: expose_ports: invalid port %d", fn, port)
+		}
+	}
+	return &cfg, nil
+}
+
+// TailscaledArgs returns the command line arguments for tailscaled, which
+// persists its state (node key, login) in stateDir.
+func (c *Config) TailscaledArgs(stateDir string) []string {
+	return []string{
+		"--state=" + filepath.Join(stateDir, "tailscaled.state"),
+		"--socket=" + Socket,
+	}
+}
+
+// UpArgs returns the command line arguments for “tailscale up”. lan is the
+// lan0 subnet, advertised if AdvertiseLAN is set.
+func (c *Config) UpArgs(lan *net.IPNet) []string {
+	routes := append([]string(nil), c.AdvertiseRoutes...)
+	if c.AdvertiseLAN && lan != nil {
+		routes = append([]string{lan.String()}, routes...)
+	}
+	args := []string{
+		"--socket=" + Socket,
+		"up",
+		"--hostname=" + c.Hostname,
+		fmt.Sprintf("--accept-routes=%v", c.AcceptRoutes),
+		"--advertise-routes=" + strings.Join(routes, ","),
+		// router7 manages the firewall itself (netconfigd) and does not
+		// ship iptables.
+		"--netfilter-mode=off",
+	}
+	if c.AuthKey != "" {
+		args = append(args, "--authkey="+c.AuthKey)
+	}
+	return args
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailscale_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/tailscale"
+)
+
+func TestUpArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tailscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "tailscale.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"enabled": true, "expose_ports": [0]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tailscale.ReadConfig(dir); err == nil {
+		t.Errorf("ReadConfig unexpectedly accepted port 0")
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(`{
+  "enabled": true,
+  "auth_key": "tskey-123",
+  "advertise_lan": true,
+  "advertise_routes": ["10.0.7.0/24"],
+  "accept_routes": true
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := tailscale.ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lan, _ := net.ParseCIDR("192.168.42.1/24")
+	want := []string{
+		"--socket=/tmp/tailscaled.sock",
+		"up",
+		"--hostname=router7",
+		"--accept-routes=true",
+		"--advertise-routes=192.168.42.0/24,10.0.7.0/24",
+		"--netfilter-mode=off",
+		"--authkey=tskey-123",
+	}
+	if diff := cmp.Diff(want, cfg.UpArgs(lan)); diff != "" {
+		t.Errorf("UpArgs: diff (-want +got):\n%s", diff)
+	}
+}
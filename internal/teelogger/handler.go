@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teelogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// privateNets are the networks from which verbosity changes are accepted.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func private(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns the /debug/loglevel endpoint of a daemon. GET returns the
+// verbosity of all components as JSON, POST changes the verbosity of a
+// component temporarily without restarting the daemon, e.g.:
+//
+//	curl -d component=dns -d level=debug -d duration=10m http://router7:8053/debug/loglevel
+//
+// duration defaults to 10m, 0 changes the verbosity until the next restart.
+// Changes are only accepted from private networks.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if !private(r.RemoteAddr) {
+				http.Error(w, "changes only accepted from private networks", http.StatusForbidden)
+				return
+			}
+			if err := setFromRequest(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		b, err := json.MarshalIndent(Levels(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+func setFromRequest(r *http.Request) error {
+	level, err := ParseLevel(r.FormValue("level"))
+	if err != nil {
+		return err
+	}
+	d := 10 * time.Minute
+	if v := r.FormValue("duration"); v != "" {
+		if d, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+	component := r.FormValue("component")
+	if component == "" {
+		return fmt.Errorf("component parameter missing")
+	}
+	levelsMu.Lock()
+	_, ok := components[component]
+	levelsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown component %q", component)
+	}
+	SetLevel(component, level, d)
+	return nil
+}
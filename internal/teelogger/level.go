@@ -0,0 +1,160 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teelogger
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel parses a level name, e.g. “debug”.
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if n == name {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+}
+
+type override struct {
+	level Level
+	until time.Time // zero if permanent
+}
+
+var (
+	levelsMu     sync.Mutex
+	defaultLevel = Info
+	components   = make(map[string]override) // by component name
+	timeNow      = time.Now
+)
+
+func register(component string) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	if _, ok := components[component]; !ok {
+		components[component] = override{level: -1}
+	}
+}
+
+// verbosity returns the minimum level of messages logged by component.
+func verbosity(component string) Level {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	o := components[component]
+	if o.level < 0 || (!o.until.IsZero() && timeNow().After(o.until)) {
+		return defaultLevel
+	}
+	return o.level
+}
+
+// SetLevel sets the verbosity of component to level for duration d (until the
+// next SetLevel call if d is 0). The empty component sets the default
+// verbosity of all components.
+func SetLevel(component string, level Level, d time.Duration) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	if component == "" {
+		defaultLevel = level
+		return
+	}
+	o := override{level: level}
+	if d > 0 {
+		o.until = timeNow().Add(d)
+	}
+	components[component] = o
+}
+
+// ComponentLevel is the verbosity of a component.
+type ComponentLevel struct {
+	Component string    `json:"component"`
+	Level     string    `json:"level"`
+	Until     time.Time `json:"until,omitempty"` // zero if permanent
+}
+
+// Levels returns the verbosity of all components, sorted by name.
+func Levels() []ComponentLevel {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	now := timeNow()
+	result := make([]ComponentLevel, 0, len(components))
+	for name, o := range components {
+		cl := ComponentLevel{Component: name, Level: defaultLevel.String()}
+		if o.level >= 0 && (o.until.IsZero() || !now.After(o.until)) {
+			cl.Level = o.level.String()
+			cl.Until = o.until
+		}
+		result = append(result, cl)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Component < result[j].Component })
+	return result
+}
+
+// levelFlag implements the -v flag: a default level, optionally followed by
+// per-component levels, e.g. “info,dns=debug”.
+type levelFlag struct{}
+
+func (levelFlag) String() string {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	return defaultLevel.String()
+}
+
+func (levelFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		component := ""
+		if idx := strings.IndexByte(part, '='); idx > -1 {
+			component, part = part[:idx], part[idx+1:]
+		}
+		level, err := ParseLevel(part)
+		if err != nil {
+			return err
+		}
+		SetLevel(component, level, 0)
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(levelFlag{}, "v", "log verbosity: debug, info, warn or error, optionally followed by per-component levels, e.g. info,dns=debug")
+}
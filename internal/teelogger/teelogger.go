@@ -13,22 +13,98 @@
 // limitations under the License.
 
 // Package teelogger provides loggers which send their output to multiple
-// writers, like the tee(1) command.
+// writers, like the tee(1) command, and filter messages by level. The
+// verbosity of each component can be set with the -v flag and changed at
+// runtime via Handler.
 package teelogger
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 )
 
+// Logger is a log.Logger whose messages are filtered by the verbosity of its
+// component. Print, Printf and Println log at level Info, Fatal and Panic
+// messages are never filtered.
+type Logger struct {
+	*log.Logger
+	component string
+}
+
 // NewConsole returns a logger which returns to /dev/console and os.Stderr.
-func NewConsole() *log.Logger {
+// Its component is the program name, e.g. dhcp4d.
+func NewConsole() *Logger {
 	var w io.Writer
 	w, err := os.OpenFile("/dev/console", os.O_RDWR, 0600)
 	if err != nil {
 		w = ioutil.Discard
 	}
-	return log.New(io.MultiWriter(os.Stderr, w), "", log.LstdFlags|log.Lshortfile)
+	return New(io.MultiWriter(os.Stderr, w), filepath.Base(os.Args[0]))
+}
+
+// New returns a logger for component which writes to w.
+func New(w io.Writer, component string) *Logger {
+	register(component)
+	return &Logger{
+		Logger:    log.New(w, "", log.LstdFlags|log.Lshortfile),
+		component: component,
+	}
+}
+
+// Component returns a logger which writes to the same destination as l, but
+// whose verbosity can be controlled separately, e.g. for the DNS cache of
+// dnsd.
+func (l *Logger) Component(name string) *Logger {
+	register(name)
+	return &Logger{Logger: l.Logger, component: name}
+}
+
+// Enabled returns whether messages of level are currently logged, e.g. to
+// skip expensive formatting of debug messages.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= verbosity(l.component)
+}
+
+func (l *Logger) logf(level Level, format string, v ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if level != Info {
+		msg = level.String() + ": " + msg
+	}
+	l.Output(3, msg)
+}
+
+// Debugf logs a message useful only when diagnosing a specific problem.
+func (l *Logger) Debugf(format string, v ...interface{}) { l.logf(Debug, format, v...) }
+
+// Infof logs a message about normal operation.
+func (l *Logger) Infof(format string, v ...interface{}) { l.logf(Info, format, v...) }
+
+// Warnf logs a message about a problem from which the daemon recovers.
+func (l *Logger) Warnf(format string, v ...interface{}) { l.logf(Warn, format, v...) }
+
+// Errorf logs a message about a problem which needs attention.
+func (l *Logger) Errorf(format string, v ...interface{}) { l.logf(Error, format, v...) }
+
+// Printf logs at level Info.
+func (l *Logger) Printf(format string, v ...interface{}) { l.logf(Info, format, v...) }
+
+// Print logs at level Info.
+func (l *Logger) Print(v ...interface{}) {
+	if l.Enabled(Info) {
+		l.Output(2, fmt.Sprint(v...))
+	}
+}
+
+// Println logs at level Info.
+func (l *Logger) Println(v ...interface{}) {
+	if l.Enabled(Info) {
+		l.Output(2, fmt.Sprintln(v...))
+	}
 }
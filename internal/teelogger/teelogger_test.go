@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teelogger
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	var buf bytes.Buffer
+	l := New(&buf, "dnsd")
+	cache := l.Component("dnscache")
+
+	var v levelFlag
+	if err := v.Set("warn,dnscache=debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLevel("", Info, 0)
+	l.Printf("hidden")
+	l.Warnf("shown warning")
+	cache.Debugf("shown cache debug")
+
+	SetLevel("dnsd", Debug, 10*time.Minute)
+	l.Debugf("shown debug")
+	now = now.Add(11 * time.Minute) // override expired
+	l.Debugf("hidden")
+	l.Errorf("shown error")
+
+	got := buf.String()
+	if strings.Contains(got, "hidden") {
+		t.Errorf("filtered message logged:\n%s", got)
+	}
+	for _, want := range []string{
+		"teelogger_test.go:", // file of the caller
+		"warn: shown warning",
+		"debug: shown cache debug",
+		"debug: shown debug",
+		"error: shown error",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log does not contain %q:\n%s", want, got)
+		}
+	}
+
+	if err := v.Set("verbose"); err == nil {
+		t.Errorf("levelFlag.Set(verbose) unexpectedly succeeded")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	New(&bytes.Buffer{}, "dhcp4d")
+	defer SetLevel("dhcp4d", Info, 0)
+	h := Handler()
+
+	post := func(remoteAddr string, v url.Values) int {
+		r := httptest.NewRequest("POST", "/debug/loglevel", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	debug := url.Values{"component": {"dhcp4d"}, "level": {"debug"}}
+	if got, want := post("203.0.113.1:1234", debug), http.StatusForbidden; got != want {
+		t.Errorf("public POST: got HTTP %d, want %d", got, want)
+	}
+	if got, want := post("192.168.42.23:1234", url.Values{"component": {"nonexistent"}, "level": {"debug"}}), http.StatusBadRequest; got != want {
+		t.Errorf("unknown component: got HTTP %d, want %d", got, want)
+	}
+	if got, want := post("192.168.42.23:1234", debug), http.StatusOK; got != want {
+		t.Errorf("private POST: got HTTP %d, want %d", got, want)
+	}
+	if got, want := verbosity("dhcp4d"), Debug; got != want {
+		t.Errorf("verbosity(dhcp4d) = %v, want %v", got, want)
+	}
+	for _, cl := range Levels() {
+		if cl.Component == "dhcp4d" && cl.Until.IsZero() {
+			t.Errorf("verbosity change not temporary: %+v", cl)
+		}
+	}
+}
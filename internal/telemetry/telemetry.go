@@ -0,0 +1,293 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package telemetry turns router state (WAN address, uplink status, DHCP
+// leases, traffic counters) into MQTT messages for dashboards and automation
+// systems such as Node-RED.
+package telemetry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+// Config is the telemetry configuration, stored in telemetry.json. Telemetry
+// is disabled unless Broker is set.
+type Config struct {
+	Broker   string `json:"broker"` // e.g. “mqtt.lan:8883”
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// TLS enables TLS, verifying the broker certificate against the system
+	// roots or, if set, the PEM certificates in CACert.
+	TLS                bool   `json:"tls"`
+	CACert             string `json:"ca_cert"` // e.g. “/perm/telemetryd/ca.pem”
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	TopicPrefix string `json:"topic_prefix"` // defaults to “router7”
+	Interval    string `json:"interval"`     // e.g. “30s”, defaults to 1m
+}
+
+// IntervalDuration returns the parsed Interval.
+func (c *Config) IntervalDuration() (time.Duration, error) {
+	if c.Interval == "" {
+		return 1 * time.Minute, nil
+	}
+	return time.ParseDuration(c.Interval)
+}
+
+// TLSConfig returns the TLS configuration for connecting to the broker, or
+// nil if TLS is disabled.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+	host := c.Broker
+	if idx := strings.LastIndex(host, ":"); idx > -1 {
+		host = host[:idx]
+	}
+	cfg := &tls.Config{
+		ServerName:         strings.Trim(host, "[]"),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACert != "" {
+		b, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", c.CACert)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// ReadConfig reads telemetry.json from dir.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "telemetry.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if _, err := cfg.IntervalDuration(); err != nil {
+		return nil, fmt.Errorf("%s: interval: %v", fn, err)
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "router7"
+	}
+	cfg.TopicPrefix = strings.TrimSuffix(cfg.TopicPrefix, "/")
+	return &cfg, nil
+}
+
+// Message is an MQTT message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Traffic is a byte counter pair, e.g. of a LAN client or the uplink.
+type Traffic struct {
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// Snapshot is the router state at a point in time.
+type Snapshot struct {
+	Time     time.Time
+	WANAddr  string // empty if unknown
+	WANAddr6 string // empty if unknown
+	UplinkUp bool
+	Uplink   Traffic
+	Leases   []*dhcp4d.Lease
+	Clients  map[string]Traffic // keyed by IP address
+}
+
+// Event is published to <prefix>/events whenever something noteworthy
+// happens.
+type Event struct {
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"` // wan_addr, wan_addr6, uplink, new_device
+	Addr         string    `json:"addr,omitempty"`
+	Status       string    `json:"status,omitempty"`
+	HardwareAddr string    `json:"hardware_addr,omitempty"`
+	Hostname     string    `json:"hostname,omitempty"`
+}
+
+// Bandwidth is published (not retained) to <prefix>/uplink/bandwidth and
+// <prefix>/clients/<addr>/bandwidth after every update.
+type Bandwidth struct {
+	RxBitsPerSecond float64 `json:"rx_bps"`
+	TxBitsPerSecond float64 `json:"tx_bps"`
+	RxBytes         uint64  `json:"rx_bytes"`
+	TxBytes         uint64  `json:"tx_bytes"`
+}
+
+// Publisher derives MQTT messages from successive snapshots.
+type Publisher struct {
+	Prefix string
+
+	// Seen contains the MAC addresses of all devices which ever obtained a
+	// lease. It should be persisted so that devices are only announced once.
+	Seen map[string]bool
+
+	last *Snapshot
+}
+
+func status(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+func bandwidth(last, cur Traffic, d time.Duration) Bandwidth {
+	bw := Bandwidth{RxBytes: cur.RxBytes, TxBytes: cur.TxBytes}
+	if d <= 0 || cur.RxBytes < last.RxBytes || cur.TxBytes < last.TxBytes {
+		return bw // no previous value or counter reset
+	}
+	bw.RxBitsPerSecond = float64(cur.RxBytes-last.RxBytes) * 8 / d.Seconds()
+	bw.TxBitsPerSecond = float64(cur.TxBytes-last.TxBytes) * 8 / d.Seconds()
+	return bw
+}
+
+func (p *Publisher) message(topic string, v interface{}, retain bool) (Message, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Topic: p.Prefix + "/" + topic, Payload: b, Retain: retain}, nil
+}
+
+// Update returns the messages to publish for s. On the first call, all
+// retained state is published.
+func (p *Publisher) Update(s *Snapshot) ([]Message, error) {
+	if p.Seen == nil {
+		p.Seen = make(map[string]bool)
+	}
+	var (
+		msgs   []Message
+		events []Event
+	)
+	first := p.last == nil
+	last := p.last
+	if first {
+		last = &Snapshot{}
+	}
+	if first || s.WANAddr != last.WANAddr {
+		msgs = append(msgs, Message{
+			Topic:   p.Prefix + "/wan/addr",
+			Payload: []byte(s.WANAddr),
+			Retain:  true,
+		})
+		if !first {
+			events = append(events, Event{Type: "wan_addr", Addr: s.WANAddr})
+		}
+	}
+	if first || s.WANAddr6 != last.WANAddr6 {
+		msgs = append(msgs, Message{
+			Topic:   p.Prefix + "/wan/addr6",
+			Payload: []byte(s.WANAddr6),
+			Retain:  true,
+		})
+		if !first {
+			events = append(events, Event{Type: "wan_addr6", Addr: s.WANAddr6})
+		}
+	}
+	if first || s.UplinkUp != last.UplinkUp {
+		msgs = append(msgs, Message{
+			Topic:   p.Prefix + "/uplink/status",
+			Payload: []byte(status(s.UplinkUp)),
+			Retain:  true,
+		})
+		if !first {
+			events = append(events, Event{Type: "uplink", Status: status(s.UplinkUp)})
+		}
+	}
+	for _, l := range s.Leases {
+		if l.HardwareAddr == "" || p.Seen[l.HardwareAddr] {
+			continue
+		}
+		p.Seen[l.HardwareAddr] = true
+		events = append(events, Event{
+			Type:         "new_device",
+			Addr:         l.Addr.String(),
+			HardwareAddr: l.HardwareAddr,
+			Hostname:     l.Hostname,
+		})
+	}
+	for _, ev := range events {
+		ev.Time = s.Time
+		m, err := p.message("events", ev, false)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	elapsed := s.Time.Sub(last.Time)
+	if first {
+		elapsed = 0
+	}
+	m, err := p.message("uplink/bandwidth", bandwidth(last.Uplink, s.Uplink, elapsed), false)
+	if err != nil {
+		return nil, err
+	}
+	msgs = append(msgs, m)
+	addrs := make([]string, 0, len(s.Clients))
+	for addr := range s.Clients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		prev, ok := last.Clients[addr]
+		d := elapsed
+		if !ok {
+			d = 0
+		}
+		m, err := p.message("clients/"+addr+"/bandwidth", bandwidth(prev, s.Clients[addr], d), false)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	p.last = s
+	return msgs, nil
+}
+
+// Reset makes the next Update publish all retained state again, e.g. after
+// reconnecting to the broker.
+func (p *Publisher) Reset() {
+	p.last = nil
+}
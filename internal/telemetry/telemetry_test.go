@@ -0,0 +1,179 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telemetry_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/telemetry"
+)
+
+func byTopic(msgs []telemetry.Message) map[string][]telemetry.Message {
+	m := make(map[string][]telemetry.Message)
+	for _, msg := range msgs {
+		m[msg.Topic] = append(m[msg.Topic], msg)
+	}
+	return m
+}
+
+func TestPublisher(t *testing.T) {
+	now := time.Now()
+	phone := &dhcp4d.Lease{
+		Addr:         net.IP{192, 168, 42, 23},
+		HardwareAddr: "00:1f:16:12:34:56",
+		Hostname:     "phone",
+	}
+	p := &telemetry.Publisher{
+		Prefix: "router7",
+		Seen:   map[string]bool{"00:1f:16:aa:bb:cc": true},
+	}
+	msgs, err := p.Update(&telemetry.Snapshot{
+		Time:     now,
+		WANAddr:  "203.0.113.7",
+		WANAddr6: "2001:db8::1",
+		UplinkUp: true,
+		Leases:   []*dhcp4d.Lease{phone},
+		Clients: map[string]telemetry.Traffic{
+			"192.168.42.23": {RxBytes: 1000, TxBytes: 100},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := byTopic(msgs)
+	if got, want := string(topics["router7/wan/addr"][0].Payload), "203.0.113.7"; got != want {
+		t.Errorf("unexpected WAN address: got %q, want %q", got, want)
+	}
+	if got, want := string(topics["router7/wan/addr6"][0].Payload), "2001:db8::1"; got != want {
+		t.Errorf("unexpected WAN IPv6 address: got %q, want %q", got, want)
+	}
+	if got, want := string(topics["router7/uplink/status"][0].Payload), "up"; got != want {
+		t.Errorf("unexpected uplink status: got %q, want %q", got, want)
+	}
+	if got, want := len(topics["router7/events"]), 1; got != want {
+		t.Fatalf("unexpected number of events: got %d, want %d (new_device)", got, want)
+	}
+	var ev telemetry.Event
+	if err := json.Unmarshal(topics["router7/events"][0].Payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "new_device" || ev.HardwareAddr != phone.HardwareAddr || ev.Hostname != "phone" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	msgs, err = p.Update(&telemetry.Snapshot{
+		Time:     now.Add(10 * time.Second),
+		WANAddr:  "203.0.113.8",
+		WANAddr6: "2001:db8::1",
+		UplinkUp: true,
+		Leases:   []*dhcp4d.Lease{phone},
+		Clients: map[string]telemetry.Traffic{
+			"192.168.42.23": {RxBytes: 11000, TxBytes: 100},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics = byTopic(msgs)
+	if _, ok := topics["router7/uplink/status"]; ok {
+		t.Errorf("uplink status unexpectedly re-published without change")
+	}
+	if got, want := len(topics["router7/events"]), 1; got != want {
+		t.Fatalf("unexpected number of events: got %d, want %d (wan_addr)", got, want)
+	}
+	if err := json.Unmarshal(topics["router7/events"][0].Payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "wan_addr" || ev.Addr != "203.0.113.8" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	var bw telemetry.Bandwidth
+	if err := json.Unmarshal(topics["router7/clients/192.168.42.23/bandwidth"][0].Payload, &bw); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bw.RxBitsPerSecond, float64(8000); got != want {
+		t.Errorf("unexpected rx bandwidth: got %v, want %v", got, want)
+	}
+	if got, want := bw.TxBitsPerSecond, float64(0); got != want {
+		t.Errorf("unexpected tx bandwidth: got %v, want %v", got, want)
+	}
+
+	if _, ok := topics["router7/wan/addr6"]; ok {
+		t.Errorf("WAN IPv6 address unexpectedly re-published without change")
+	}
+
+	msgs, err = p.Update(&telemetry.Snapshot{
+		Time:     now.Add(20 * time.Second),
+		WANAddr:  "203.0.113.8",
+		WANAddr6: "2001:db8:1::1",
+		UplinkUp: true,
+		Leases:   []*dhcp4d.Lease{phone},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics = byTopic(msgs)
+	if got, want := len(topics["router7/events"]), 1; got != want {
+		t.Fatalf("unexpected number of events: got %d, want %d (wan_addr6)", got, want)
+	}
+	if err := json.Unmarshal(topics["router7/events"][0].Payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "wan_addr6" || ev.Addr != "2001:db8:1::1" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg, err := telemetry.ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Broker != "" {
+		t.Fatalf("telemetry unexpectedly enabled without config")
+	}
+
+	const config = `{"broker": "mqtt.lan:8883", "tls": true, "topic_prefix": "home/router/"}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "telemetry.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = telemetry.ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.TopicPrefix, "home/router"; got != want {
+		t.Errorf("unexpected topic prefix: got %q, want %q", got, want)
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tlsCfg.ServerName, "mqtt.lan"; got != want {
+		t.Errorf("unexpected TLS server name: got %q, want %q", got, want)
+	}
+}
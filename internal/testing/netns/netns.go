@@ -0,0 +1,79 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netns manages network namespaces connected to the host via veth
+// pairs, so that integration tests can run router7 daemons on the host side
+// and real client implementations (e.g. udhcpc(8)) inside the namespace.
+package netns
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// Namespace is a handle for a network namespace.
+type Namespace struct {
+	Name string
+}
+
+// New creates the network namespace name. Call Delete to remove it.
+func New(t *testing.T, name string) *Namespace {
+	t.Helper()
+	add := exec.Command("ip", "netns", "add", name)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	return &Namespace{Name: name}
+}
+
+// Delete removes the network namespace, including the interfaces within.
+func (n *Namespace) Delete() {
+	exec.Command("ip", "netns", "delete", n.Name).Run()
+}
+
+// Command returns an exec.Cmd which runs name within the network namespace.
+func (n *Namespace) Command(name string, arg ...string) *exec.Cmd {
+	return exec.Command("ip", append([]string{"netns", "exec", n.Name, name}, arg...)...)
+}
+
+// Veth creates a veth pair whose host end is called host and whose peer end
+// (within the network namespace) is called peer. hostAddr (e.g.
+// 192.168.23.1/24) is configured on the host end, the peer end is left
+// unconfigured for clients to configure. Duplicate Address Detection is
+// disabled on both ends: until DAD completes, link-local addresses remain in
+// state “tentative”, resulting in bind(2) failing with -EADDRNOTAVAIL.
+func (n *Namespace) Veth(t *testing.T, host, hostAddr, peer string) {
+	t.Helper()
+	Run(t,
+		exec.Command("ip", "link", "add", host, "type", "veth", "peer", "name", peer, "netns", n.Name),
+		exec.Command("/bin/sh", "-c", "echo 0 > /proc/sys/net/ipv6/conf/"+host+"/accept_dad"),
+		n.Command("/bin/sh", "-c", "echo 0 > /proc/sys/net/ipv6/conf/"+peer+"/accept_dad"),
+		exec.Command("ip", "addr", "add", hostAddr, "dev", host),
+		exec.Command("ip", "link", "set", host, "up"),
+		n.Command("ip", "link", "set", peer, "up"),
+	)
+}
+
+// Run runs cmds in order and fails the test if any of them fail.
+func Run(t *testing.T, cmds ...*exec.Cmd) {
+	t.Helper()
+	for _, cmd := range cmds {
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+}
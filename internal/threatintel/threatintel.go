@@ -0,0 +1,230 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package threatintel ingests threat-intelligence domain feeds (e.g. the
+// abuse.ch URLhaus host file), which dnsd uses to sinkhole and report queries
+// for malicious domains.
+package threatintel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Feed is a list of malicious domains, either in hosts file format
+// (“0.0.0.0 example.com”) or with one domain per line. Lines starting with #
+// are ignored.
+type Feed struct {
+	Name    string `json:"name"` // e.g. “urlhaus”
+	URL     string `json:"url"`  // e.g. “https://urlhaus.abuse.ch/downloads/hostfile/”
+	Enabled bool   `json:"enabled"`
+}
+
+// Config is the threat-intelligence configuration, stored in
+// threatintel.json.
+type Config struct {
+	Feeds []Feed `json:"feeds"`
+
+	// WebhookURL, if non-empty, receives a Hit as JSON in an HTTP POST request
+	// when a client queries a domain listed in a feed.
+	WebhookURL string `json:"webhook_url"`
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// ReadConfig reads threatintel.json from dir. A missing file results in a
+// configuration without feeds.
+func ReadConfig(dir string) (*Config, error) {
+	fn := filepath.Join(dir, "threatintel.json")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, f := range cfg.Feeds {
+		// Feed names are used as file names in the feed cache.
+		if !validName.MatchString(f.Name) {
+			return nil, fmt.Errorf("%s: invalid feed name %q: must match %s", fn, f.Name, validName)
+		}
+	}
+	return &cfg, nil
+}
+
+// Parse returns the (lower-cased) domains listed in r.
+func Parse(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx > -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := fields[0]
+		if net.ParseIP(domain) != nil {
+			// hosts file format: address followed by domain(s)
+			if len(fields) < 2 {
+				continue
+			}
+			domain = fields[1]
+		}
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if domain == "localhost" || strings.HasPrefix(domain, "localhost.") {
+			continue // part of the boilerplate of many hosts files
+		}
+		domains = append(domains, domain)
+	}
+	return domains, scanner.Err()
+}
+
+// List maps domains to the feed which lists them.
+type List struct {
+	domains map[string]string
+}
+
+// NewList returns an empty List.
+func NewList() *List {
+	return &List{domains: make(map[string]string)}
+}
+
+// Add adds domains as listed by feed.
+func (l *List) Add(feed string, domains []string) {
+	for _, d := range domains {
+		if _, ok := l.domains[d]; ok {
+			continue // first feed wins
+		}
+		l.domains[d] = feed
+	}
+}
+
+// Len returns the number of domains in l.
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.domains)
+}
+
+// Match returns the feed which lists name (a fully qualified domain name, with
+// or without trailing dot) or any of its parent domains. A nil *List matches
+// nothing.
+func (l *List) Match(name string) (feed string, ok bool) {
+	if l == nil {
+		return "", false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for name != "" {
+		if feed, ok := l.domains[name]; ok {
+			return feed, true
+		}
+		idx := strings.IndexByte(name, '.')
+		if idx == -1 {
+			break
+		}
+		name = name[idx+1:]
+	}
+	return "", false
+}
+
+func cachePath(dir string, f Feed) string {
+	return filepath.Join(dir, f.Name+".txt")
+}
+
+// Update downloads f into the feed cache in dir.
+func Update(ctx context.Context, dir string, f Feed) error {
+	ctx, canc := context.WithTimeout(ctx, 5*time.Minute)
+	defer canc()
+	req, err := http.NewRequest("GET", f.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return fmt.Errorf("%s: unexpected HTTP status: got %v, want %v", f.URL, resp.Status, want)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, f.Name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath(dir, f))
+}
+
+// Load returns a List of the domains in all enabled feeds of cfg, as cached
+// in dir. Feeds which were not yet downloaded are skipped.
+func Load(dir string, cfg *Config) (*List, error) {
+	l := NewList()
+	for _, f := range cfg.Feeds {
+		if !f.Enabled {
+			continue
+		}
+		file, err := os.Open(cachePath(dir, f))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		domains, err := Parse(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		l.Add(f.Name, domains)
+	}
+	return l, nil
+}
+
+// Hit is a query for a domain listed in a feed.
+type Hit struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`   // IP address of the querying client
+	Hostname string    `json:"hostname"` // DHCP hostname of the client, if known
+	Name     string    `json:"name"`     // queried domain name
+	Feed     string    `json:"feed"`
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threatintel_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rtr7/router7/internal/threatintel"
+)
+
+const hostsFeed = `################################################################
+# abuse.ch URLhaus Host file for Adblockers
+################################################################
+127.0.0.1	localhost
+0.0.0.0	Malware.example.com
+0.0.0.0	c2.example.net # comment
+`
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		feed string
+		want []string
+	}{
+		{
+			name: "hosts",
+			feed: hostsFeed,
+			want: []string{"malware.example.com", "c2.example.net"},
+		},
+		{
+			name: "domains",
+			feed: "# comment\nmalware.example.com.\n\nc2.example.net\n",
+			want: []string{"malware.example.com", "c2.example.net"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := threatintel.Parse(strings.NewReader(tt.feed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Parse: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	l := threatintel.NewList()
+	l.Add("urlhaus", []string{"malware.example.com"})
+	l.Add("other", []string{"malware.example.com", "example.net"})
+	for _, tt := range []struct {
+		name     string
+		wantFeed string
+		wantOK   bool
+	}{
+		{"malware.example.com.", "urlhaus", true},
+		{"MALWARE.example.com", "urlhaus", true},
+		{"www.malware.example.com.", "urlhaus", true},
+		{"example.com.", "", false},
+		{"notmalware.example.com.", "", false},
+		{"c2.example.net.", "other", true},
+	} {
+		feed, ok := l.Match(tt.name)
+		if feed != tt.wantFeed || ok != tt.wantOK {
+			t.Errorf("Match(%q): got (%q, %v), want (%q, %v)", tt.name, feed, ok, tt.wantFeed, tt.wantOK)
+		}
+	}
+
+	var nilList *threatintel.List
+	if _, ok := nilList.Match("malware.example.com."); ok {
+		t.Errorf("nil List unexpectedly matched")
+	}
+}
+
+func TestUpdateLoad(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "threatintel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, hostsFeed)
+	}))
+	defer srv.Close()
+
+	cfgJSON := `{"feeds":[
+  {"name":"urlhaus","url":"` + srv.URL + `","enabled":true},
+  {"name":"disabled","url":"` + srv.URL + `","enabled":false}
+]}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "threatintel.json"), []byte(cfgJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := threatintel.ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := filepath.Join(tmp, "cache")
+	for _, f := range cfg.Feeds {
+		if err := threatintel.Update(context.Background(), cache, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := threatintel.Load(cache, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.Len(), 2; got != want {
+		t.Fatalf("unexpected number of domains: got %d, want %d", got, want)
+	}
+	if feed, _ := l.Match("c2.example.net."); feed != "urlhaus" {
+		t.Fatalf("Match(c2.example.net.): got feed %q, want %q", feed, "urlhaus")
+	}
+}
+
+func TestReadConfigInvalidName(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "threatintel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cfgJSON := `{"feeds":[{"name":"../etc/passwd","url":"http://localhost/","enabled":true}]}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "threatintel.json"), []byte(cfgJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := threatintel.ReadConfig(tmp); err == nil {
+		t.Fatalf("ReadConfig unexpectedly accepted an invalid feed name")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uci
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// Result is the router7 configuration equivalent to an OpenWrt configuration.
+type Result struct {
+	Interfaces      netconfig.InterfaceConfig // interfaces.json
+	PortForwardings netconfig.PortForwardings // portforwardings.json
+
+	// Unsupported describes OpenWrt configuration which has no router7
+	// equivalent (or must be completed manually) and was not converted.
+	Unsupported []string
+}
+
+func (r *Result) unsupported(format string, v ...interface{}) {
+	r.Unsupported = append(r.Unsupported, fmt.Sprintf(format, v...))
+}
+
+// defaultRules are the names of the rules in OpenWrt’s default firewall
+// configuration. router7 allows the corresponding traffic implicitly.
+var defaultRules = map[string]bool{
+	"Allow-DHCP-Renew":       true,
+	"Allow-Ping":             true,
+	"Allow-IGMP":             true,
+	"Allow-DHCPv6":           true,
+	"Allow-MLD":              true,
+	"Allow-ICMPv6-Input":     true,
+	"Allow-ICMPv6-Forward":   true,
+	"Allow-IPSec-ESP":        true,
+	"Allow-ISAKMP":           true,
+	"Support-UDP-Traceroute": true,
+}
+
+// lanAddr returns the router’s LAN address in CIDR notation (e.g.
+// 192.168.1.1/24) from the ipaddr and netmask options.
+func lanAddr(s *Section, res *Result) (string, error) {
+	addrs := s.Options["ipaddr"]
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("%s: no ipaddr", s.Label())
+	}
+	for _, extra := range addrs[1:] {
+		res.unsupported("%s: additional address %s (router7 configures one LAN address)", s.Label(), extra)
+	}
+	addr := addrs[0]
+	if strings.Contains(addr, "/") {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", s.Label(), err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		return fmt.Sprintf("%s/%d", ip, ones), nil
+	}
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return "", fmt.Errorf("%s: invalid ipaddr %q", s.Label(), addr)
+	}
+	netmask := s.Option("netmask")
+	if netmask == "" {
+		netmask = "255.255.255.0"
+	}
+	mask := net.ParseIP(netmask).To4()
+	if mask == nil {
+		return "", fmt.Errorf("%s: invalid netmask %q", s.Label(), netmask)
+	}
+	ones, bits := net.IPMask(mask).Size()
+	if bits == 0 {
+		return "", fmt.Errorf("%s: non-canonical netmask %q", s.Label(), netmask)
+	}
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+func convertNetwork(network []*Section, res *Result) error {
+	devices := make(map[string]*Section)
+	for _, s := range network {
+		if s.Type == "device" && s.Option("name") != "" {
+			devices[s.Option("name")] = s
+		}
+	}
+	// device returns the device name of interface section s.
+	device := func(s *Section) string {
+		if d := s.Option("device"); d != "" {
+			return d
+		}
+		return s.Option("ifname") // OpenWrt < 21.02
+	}
+
+	var uplink, lan *netconfig.InterfaceDetails
+	for _, s := range network {
+		switch s.Type {
+		case "interface":
+			switch s.Name {
+			case "loopback":
+				// router7 configures the loopback interface implicitly
+			case "lan":
+				if proto := s.Option("proto"); proto != "static" {
+					res.unsupported("%s: proto %q (router7 requires a static LAN address)", s.Label(), proto)
+					continue
+				}
+				addr, err := lanAddr(s, res)
+				if err != nil {
+					return err
+				}
+				lan = &netconfig.InterfaceDetails{Name: "lan0", Addr: addr}
+				if d, ok := devices[device(s)]; ok && d.Option("type") == "bridge" {
+					res.unsupported("%s: bridge %s of ports %s (router7 uses a single LAN network interface)", s.Label(), d.Option("name"), strings.Join(d.Options["ports"], ", "))
+				}
+				for _, key := range []string{"gateway", "dns"} {
+					if len(s.Options[key]) > 0 {
+						res.unsupported("%s: option %s", s.Label(), key)
+					}
+				}
+			case "wan":
+				if proto := s.Option("proto"); proto != "dhcp" {
+					res.unsupported("%s: proto %q (router7 obtains its uplink address via DHCP)", s.Label(), proto)
+					continue
+				}
+				uplink = &netconfig.InterfaceDetails{Name: "uplink0"}
+				mac := s.Option("macaddr")
+				if d, ok := devices[device(s)]; ok && mac == "" {
+					mac = d.Option("macaddr")
+				}
+				if mac != "" {
+					hwaddr, err := net.ParseMAC(mac)
+					if err != nil {
+						return fmt.Errorf("%s: %v", s.Label(), err)
+					}
+					uplink.SpoofHardwareAddr = hwaddr.String()
+				}
+				if len(s.Options["dns"]) > 0 {
+					res.unsupported("%s: option dns (router7 uses the DNS servers obtained via DHCP)", s.Label())
+				}
+			case "wan6":
+				if proto := s.Option("proto"); proto != "dhcpv6" {
+					res.unsupported("%s: proto %q (router7 obtains an IPv6 prefix via DHCPv6)", s.Label(), proto)
+				}
+			default:
+				res.unsupported("%s: additional interface (device %s, proto %s)", s.Label(), device(s), s.Option("proto"))
+			}
+		case "device", "globals":
+			// bridges are reported with the interface using them
+			if s.Type == "globals" && s.Option("ula_prefix") != "" {
+				res.unsupported("%s: ula_prefix %s", s.Label(), s.Option("ula_prefix"))
+			}
+		default:
+			// e.g. switch, switch_vlan, route, rule
+			res.unsupported("%s: section type not supported", s.Label())
+		}
+	}
+
+	for _, details := range []*netconfig.InterfaceDetails{uplink, lan} {
+		if details == nil {
+			continue
+		}
+		// OpenWrt identifies network cards by name (e.g. eth0), router7 by
+		// MAC address, which the configuration does not contain.
+		res.unsupported("%s: set hardware_addr to the MAC address of the network card", details.Name)
+		res.Interfaces.Interfaces = append(res.Interfaces.Interfaces, *details)
+	}
+	return nil
+}
+
+var portRe = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+func convertFirewall(firewall []*Section, res *Result) error {
+	for _, s := range firewall {
+		switch s.Type {
+		case "defaults":
+			// router7 drops inbound and allows outbound traffic
+		case "zone":
+			if name := s.Option("name"); name != "lan" && name != "wan" {
+				res.unsupported("%s: zones other than lan and wan", s.Label())
+			}
+		case "forwarding":
+			if s.Option("src") != "lan" || s.Option("dest") != "wan" {
+				res.unsupported("%s: forwarding from %s to %s", s.Label(), s.Option("src"), s.Option("dest"))
+			}
+		case "redirect":
+			if s.Option("enabled") == "0" {
+				continue
+			}
+			if target := s.Option("target"); target != "" && target != "DNAT" {
+				res.unsupported("%s: target %s", s.Label(), target)
+				continue
+			}
+			if src := s.Option("src"); src != "wan" {
+				res.unsupported("%s: redirect from zone %q", s.Label(), src)
+				continue
+			}
+			var restricted []string
+			for _, key := range []string{"src_ip", "src_mac", "src_dip", "src_port", "ipset"} {
+				if s.Option(key) != "" {
+					restricted = append(restricted, key)
+				}
+			}
+			if len(restricted) > 0 {
+				// Converting the rule without its restrictions would expose
+				// more than intended, so leave it to the user.
+				res.unsupported("%s: restricted by %s", s.Label(), strings.Join(restricted, ", "))
+				continue
+			}
+			fw := netconfig.PortForwarding{
+				Port:     strings.Replace(s.Option("src_dport"), ":", "-", -1),
+				DestAddr: s.Option("dest_ip"),
+				DestPort: strings.Replace(s.Option("dest_port"), ":", "-", -1),
+			}
+			if fw.DestPort == "" {
+				fw.DestPort = fw.Port
+			}
+			if !portRe.MatchString(fw.Port) || !portRe.MatchString(fw.DestPort) || net.ParseIP(fw.DestAddr).To4() == nil {
+				res.unsupported("%s: src_dport %q, dest_ip %q, dest_port %q (expected a port (range) forwarded to an IPv4 address)", s.Label(), s.Option("src_dport"), s.Option("dest_ip"), s.Option("dest_port"))
+				continue
+			}
+			proto := s.Option("proto")
+			if proto == "" {
+				proto = "tcp udp"
+			}
+			protos := strings.Fields(strings.Replace(proto, "tcpudp", "tcp udp", -1))
+			ok := true
+			for _, p := range protos {
+				if p != "tcp" && p != "udp" {
+					ok = false
+				}
+			}
+			if !ok {
+				res.unsupported("%s: proto %q", s.Label(), proto)
+				continue
+			}
+			fw.Proto = strings.Join(protos, ",")
+			res.PortForwardings.Forwardings = append(res.PortForwardings.Forwardings, fw)
+		case "rule":
+			if defaultRules[s.Option("name")] {
+				continue
+			}
+			res.unsupported("%s: firewall rules (router7 has a fixed policy)", s.Label())
+		default:
+			// e.g. include, ipset
+			res.unsupported("%s: section type not supported", s.Label())
+		}
+	}
+	return nil
+}
+
+// Convert converts the OpenWrt network and firewall configuration. Features
+// which router7 does not support are listed in Result.Unsupported.
+func Convert(network, firewall []*Section) (*Result, error) {
+	var res Result
+	if err := convertNetwork(network, &res); err != nil {
+		return nil, err
+	}
+	if err := convertFirewall(firewall, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package uci converts OpenWrt UCI configuration files (/etc/config/network
+// and /etc/config/firewall) into router7 configuration files.
+package uci
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Section is a UCI config section, e.g.:
+//
+//	config interface 'lan'
+//		option proto 'static'
+//		list dns '8.8.8.8'
+type Section struct {
+	Type    string
+	Name    string // empty for anonymous sections
+	Options map[string][]string
+}
+
+// Option returns the (first) value of option key, or the empty string.
+func (s *Section) Option(key string) string {
+	if v := s.Options[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Label returns a human-readable identification of s for messages.
+func (s *Section) Label() string {
+	if s.Name != "" {
+		return fmt.Sprintf("%s %q", s.Type, s.Name)
+	}
+	if name := s.Option("name"); name != "" {
+		return fmt.Sprintf("%s (name %q)", s.Type, name)
+	}
+	return s.Type
+}
+
+// fields splits line into words, honoring single and double quotes.
+func fields(line string) ([]string, error) {
+	var (
+		result []string
+		word   strings.Builder
+		quote  rune
+		inWord bool
+	)
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '#' && !inWord:
+			return result, nil // comment
+		case r == ' ' || r == '\t':
+			if inWord {
+				result = append(result, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		result = append(result, word.String())
+	}
+	return result, nil
+}
+
+// Parse parses a UCI configuration file.
+func Parse(r io.Reader) ([]*Section, error) {
+	var (
+		sections []*Section
+		current  *Section
+	)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		f, err := fields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "package":
+			// ignored
+		case "config":
+			if len(f) < 2 || len(f) > 3 {
+				return nil, fmt.Errorf("line %d: expected config <type> [<name>]", lineno)
+			}
+			current = &Section{Type: f[1], Options: make(map[string][]string)}
+			if len(f) == 3 {
+				current.Name = f[2]
+			}
+			sections = append(sections, current)
+		case "option", "list":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: %s outside of config section", lineno, f[0])
+			}
+			if len(f) != 3 {
+				return nil, fmt.Errorf("line %d: expected %s <name> <value>", lineno, f[0])
+			}
+			if f[0] == "option" {
+				current.Options[f[1]] = []string{f[2]}
+			} else {
+				current.Options[f[1]] = append(current.Options[f[1]], f[2])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown keyword %q", lineno, f[0])
+		}
+	}
+	return sections, scanner.Err()
+}
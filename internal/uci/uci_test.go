@@ -0,0 +1,196 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uci_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/uci"
+)
+
+const network = `
+config interface 'loopback'
+	option device 'lo'
+	option proto 'static'
+	option ipaddr '127.0.0.1'
+	option netmask '255.0.0.0'
+
+config globals 'globals'
+	option ula_prefix 'fd12:3456:789a::/48'
+
+config device
+	option name 'br-lan'
+	option type 'bridge'
+	list ports 'lan1'
+	list ports 'lan2'
+
+config interface 'lan'
+	option device 'br-lan'
+	option proto 'static'
+	option ipaddr '192.168.42.1'
+	option netmask '255.255.255.0'
+	option ip6assign '60'
+
+config interface 'wan'
+	option device 'wan'
+	option proto 'dhcp'
+	option macaddr '02:73:53:00:CA:FE' # cloned
+
+config interface 'wan6'
+	option device 'wan'
+	option proto 'dhcpv6'
+
+config interface 'guest'
+	option device 'br-guest'
+	option proto 'static'
+	option ipaddr '192.168.3.1'
+	option netmask '255.255.255.0'
+`
+
+const firewall = `
+config defaults
+	option input 'ACCEPT'
+	option output 'ACCEPT'
+	option forward 'REJECT'
+
+config zone
+	option name 'lan'
+	list network 'lan'
+
+config zone
+	option name 'wan'
+	list network 'wan'
+	option masq '1'
+
+config forwarding
+	option src 'lan'
+	option dest 'wan'
+
+config rule
+	option name 'Allow-Ping'
+	option src 'wan'
+	option proto 'icmp'
+	option target 'ACCEPT'
+
+config rule
+	option name 'Allow-SSH'
+	option src 'wan'
+	option dest_port '22'
+	option target 'ACCEPT'
+
+config redirect
+	option name 'webserver'
+	option target 'DNAT'
+	option src 'wan'
+	option src_dport '8080'
+	option dest 'lan'
+	option dest_ip '192.168.42.23'
+	option dest_port '80'
+	option proto 'tcp'
+
+config redirect
+	option name 'game'
+	option src 'wan'
+	option src_dport '27015:27030'
+	option dest_ip '192.168.42.42'
+
+config redirect
+	option name 'office-only'
+	option src 'wan'
+	option src_ip '198.51.100.0/24'
+	option src_dport '3389'
+	option dest_ip '192.168.42.5'
+`
+
+func TestParse(t *testing.T) {
+	sections, err := uci.Parse(strings.NewReader(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(sections), 7; got != want {
+		t.Fatalf("unexpected number of sections: got %d, want %d", got, want)
+	}
+	br := sections[2]
+	if got, want := br.Options["ports"], []string{"lan1", "lan2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected list: got %q, want %q", got, want)
+	}
+	if got, want := sections[4].Option("macaddr"), "02:73:53:00:CA:FE"; got != want {
+		t.Errorf("unexpected option value: got %q, want %q", got, want)
+	}
+
+	if _, err := uci.Parse(strings.NewReader("option proto 'dhcp'")); err == nil {
+		t.Errorf("Parse unexpectedly accepted an option outside of a section")
+	}
+}
+
+func TestConvert(t *testing.T) {
+	nw, err := uci.Parse(strings.NewReader(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := uci.Parse(strings.NewReader(firewall))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := uci.Convert(nw, fw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantInterfaces := []netconfig.InterfaceDetails{
+		{Name: "uplink0", SpoofHardwareAddr: "02:73:53:00:ca:fe"},
+		{Name: "lan0", Addr: "192.168.42.1/24"},
+	}
+	if got := res.Interfaces.Interfaces; !reflect.DeepEqual(got, wantInterfaces) {
+		t.Errorf("unexpected interfaces: got %+v, want %+v", got, wantInterfaces)
+	}
+
+	wantForwardings := []netconfig.PortForwarding{
+		{Proto: "tcp", Port: "8080", DestAddr: "192.168.42.23", DestPort: "80"},
+		{Proto: "tcp,udp", Port: "27015-27030", DestAddr: "192.168.42.42", DestPort: "27015-27030"},
+	}
+	if got := res.PortForwardings.Forwardings; !reflect.DeepEqual(got, wantForwardings) {
+		t.Errorf("unexpected port forwardings: got %+v, want %+v", got, wantForwardings)
+	}
+
+	for _, want := range []string{
+		`interface "lan": bridge br-lan`,
+		`interface "guest": additional interface`,
+		`globals "globals": ula_prefix`,
+		`rule (name "Allow-SSH")`,
+		`redirect (name "office-only"): restricted by src_ip`,
+		`uplink0: set hardware_addr`,
+		`lan0: set hardware_addr`,
+	} {
+		found := false
+		for _, u := range res.Unsupported {
+			if strings.HasPrefix(u, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%q not flagged as unsupported: %q", want, res.Unsupported)
+		}
+	}
+	for _, u := range res.Unsupported {
+		if strings.Contains(u, "Allow-Ping") {
+			t.Errorf("default rule unexpectedly flagged: %q", u)
+		}
+	}
+}
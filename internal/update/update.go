@@ -0,0 +1,277 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package update guards gokrazy updates against loss of connectivity: updates
+// are refused while there is no internet connectivity, and updates after which
+// checks fail which passed before the update are detected so that they can be
+// rolled back. Checks which already failed before the update (e.g. IPv6 checks
+// at IPv4-only sites) are not held against it.
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// DegradedError is returned when connectivity is degraded. Its value
+// describes the failing checks.
+type DegradedError string
+
+func (e DegradedError) Error() string {
+	return "connectivity degraded: " + string(e)
+}
+
+// Pending describes an update which was prepared, but not yet confirmed.
+type Pending struct {
+	Prepared time.Time `json:"prepared"`
+
+	// Failures are the names of the diagd checks which failed when the
+	// update was prepared.
+	Failures []string `json:"failures,omitempty"`
+
+	// BootID and Root describe the system in which the update was
+	// prepared: the update is only verified after booting (a different
+	// BootID) into the other root file system (a different Root).
+	BootID string `json:"boot_id"`
+	Root   string `json:"root"`
+}
+
+// MaxPendingAge is how long after being prepared an update is verified when
+// booting into it. Older updates were presumably never installed.
+const MaxPendingAge = 10 * time.Minute
+
+// System identifies the running system.
+type System struct {
+	BootID string // random per boot, see random(4)
+	Root   string // root= kernel parameter, e.g. /dev/mmcblk0p2
+}
+
+// CurrentSystem returns the running system, as described by /proc.
+func CurrentSystem() (System, error) {
+	bootID, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return System{}, err
+	}
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return System{}, err
+	}
+	sys := System{BootID: strings.TrimSpace(string(bootID))}
+	for _, param := range strings.Fields(string(cmdline)) {
+		if strings.HasPrefix(param, "root=") {
+			sys.Root = strings.TrimPrefix(param, "root=")
+		}
+	}
+	if sys.Root == "" {
+		return System{}, fmt.Errorf("/proc/cmdline: no root= parameter")
+	}
+	return sys, nil
+}
+
+// Guard tracks update state in Dir, querying the diagd health endpoint at
+// HealthURL to assess connectivity.
+type Guard struct {
+	Dir       string // e.g. /perm/updated
+	HealthURL string // e.g. http://localhost:7733/health.json
+
+	// Client is used for querying HealthURL. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+
+	// System returns the running system. If nil, CurrentSystem is used.
+	System func() (System, error)
+}
+
+func (g *Guard) system() (System, error) {
+	if g.System != nil {
+		return g.System()
+	}
+	return CurrentSystem()
+}
+
+func (g *Guard) pendingPath() string {
+	return filepath.Join(g.Dir, "pending.json")
+}
+
+// Health is the connectivity reported by the diagd health endpoint.
+type Health struct {
+	FirstError string   `json:"first_error"` // empty if all checks pass
+	Failures   []string `json:"failures"`    // names of all failing checks
+	Internet   bool     `json:"internet"`    // whether any internet check passes
+}
+
+// NewFailures returns the failing checks which are not listed in before.
+func (h *Health) NewFailures(before []string) []string {
+	known := make(map[string]bool, len(before))
+	for _, name := range before {
+		known[name] = true
+	}
+	var failures []string
+	for _, name := range h.Failures {
+		if !known[name] {
+			failures = append(failures, name)
+		}
+	}
+	return failures
+}
+
+// Health queries the diagd health endpoint.
+func (g *Guard) Health(ctx context.Context) (*Health, error) {
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", g.HealthURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("%s: unexpected HTTP status: got %v, want %v", g.HealthURL, resp.Status, want)
+	}
+	var h Health
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return nil, fmt.Errorf("%s: %v", g.HealthURL, err)
+	}
+	return &h, nil
+}
+
+// Prepare is called before an update is installed. It returns a DegradedError
+// if there is no internet connectivity: in that state, a broken update could
+// not be distinguished from a broken uplink, and an unreachable router might
+// not be recoverable remotely. Otherwise, the update is recorded as pending,
+// along with the checks which currently fail.
+func (g *Guard) Prepare(ctx context.Context) error {
+	h, err := g.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if !h.Internet {
+		return DegradedError(h.FirstError)
+	}
+	sys, err := g.system()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&Pending{
+		Prepared: time.Now(),
+		Failures: h.Failures,
+		BootID:   sys.BootID,
+		Root:     sys.Root,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(g.Dir, 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(g.pendingPath(), b, 0644)
+}
+
+// Pending returns the pending update, or nil if there is none.
+func (g *Guard) Pending() (*Pending, error) {
+	b, err := ioutil.ReadFile(g.pendingPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var p Pending
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// BootedInto returns the pending update if the running system was booted into
+// it, i.e. booted after the update was prepared into the other root file
+// system, within MaxPendingAge. Otherwise, it returns nil and clears pending
+// updates which were not installed (e.g. their upload failed), unless they
+// were prepared in the running system and might still be installed.
+func (g *Guard) BootedInto(now time.Time) (*Pending, error) {
+	p, err := g.Pending()
+	if err != nil || p == nil {
+		return nil, err
+	}
+	sys, err := g.system()
+	if err != nil {
+		return nil, err
+	}
+	// The clock might be behind after booting (e.g. no RTC, NTP not yet
+	// synchronized), so a negative age is not considered expired.
+	expired := now.Sub(p.Prepared) > MaxPendingAge
+	if p.BootID == sys.BootID && !expired {
+		return nil, nil // prepared in this boot, not yet installed
+	}
+	if p.BootID == sys.BootID || p.Root == sys.Root || expired {
+		return nil, g.Clear()
+	}
+	return p, nil
+}
+
+// Clear forgets about the pending update, if any.
+func (g *Guard) Clear() error {
+	if err := os.Remove(g.pendingPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Verify polls the diagd health endpoint every interval until connectivity is
+// restored (i.e. there is internet connectivity and all checks pass which
+// passed when p was prepared) or grace has passed. It returns nil if
+// connectivity was restored, and the most recent error otherwise.
+func (g *Guard) Verify(ctx context.Context, p *Pending, grace, interval time.Duration) error {
+	ctx, canc := context.WithTimeout(ctx, grace)
+	defer canc()
+	var last error
+	for {
+		h, err := g.Health(ctx)
+		switch {
+		case err == nil:
+			failures := h.NewFailures(p.Failures)
+			if h.Internet && len(failures) == 0 {
+				return nil
+			}
+			if len(failures) == 0 {
+				last = DegradedError(h.FirstError)
+			} else {
+				last = DegradedError(strings.Join(failures, ", "))
+			}
+		case ctx.Err() != nil && last != nil:
+			// grace passed while querying: keep the more useful error
+		default:
+			last = err
+		}
+		select {
+		case <-ctx.Done():
+			return last
+		case <-time.After(interval):
+		}
+	}
+}
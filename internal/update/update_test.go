@@ -0,0 +1,203 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package update_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/update"
+)
+
+const (
+	healthy      = `{"first_error":"","failures":[],"internet":true}`
+	noIPv6       = `{"first_error":"ping6/google.ch: timeout","failures":["ping6/google.ch"],"internet":true}`
+	noIPv4       = `{"first_error":"ping4/google.ch: timeout","failures":["ping4/google.ch"],"internet":true}`
+	uplinkDown   = `{"first_error":"link/uplink0: down","failures":["link/uplink0"],"internet":false}`
+	noConnection = `{"first_error":"ping4/google.ch: timeout","failures":["ping4/google.ch","ping6/google.ch"],"internet":false}`
+)
+
+func healthServer(health *atomic.Value) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, health.Load().(string))
+	}))
+}
+
+func TestPrepare(t *testing.T) {
+	var health atomic.Value
+	health.Store(noConnection)
+	srv := healthServer(&health)
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "updatetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	g := &update.Guard{
+		Dir:       tmp,
+		HealthURL: srv.URL,
+		System: func() (update.System, error) {
+			return update.System{BootID: "1", Root: "/dev/mmcblk0p2"}, nil
+		},
+	}
+	ctx := context.Background()
+
+	err = g.Prepare(ctx)
+	if _, ok := err.(update.DegradedError); !ok {
+		t.Fatalf("Prepare: got %v, want DegradedError", err)
+	}
+	p, err := g.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Fatalf("Pending after refused update: got %+v, want nil", p)
+	}
+
+	health.Store(healthy)
+	if err := g.Prepare(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p, err = g.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatalf("Pending after prepared update: got nil, want non-nil")
+	}
+	if err := g.Verify(ctx, p, 1*time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := g.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := g.Pending(); err != nil || p != nil {
+		t.Fatalf("Pending after Clear: got %+v, %v, want nil, nil", p, err)
+	}
+
+	health.Store(uplinkDown)
+	err = g.Verify(ctx, p, 50*time.Millisecond, 10*time.Millisecond)
+	if _, ok := err.(update.DegradedError); !ok {
+		t.Fatalf("Verify: got %v, want DegradedError", err)
+	}
+}
+
+func TestPreexistingFailures(t *testing.T) {
+	// At an IPv4-only site, the IPv6 checks always fail.
+	var health atomic.Value
+	health.Store(noIPv6)
+	srv := healthServer(&health)
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "updatetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	g := &update.Guard{
+		Dir:       tmp,
+		HealthURL: srv.URL,
+		System: func() (update.System, error) {
+			return update.System{BootID: "1", Root: "/dev/mmcblk0p2"}, nil
+		},
+	}
+	ctx := context.Background()
+	if err := g.Prepare(ctx); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	p, err := g.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(p.Failures, ","), "ping6/google.ch"; got != want {
+		t.Errorf("Pending.Failures: got %q, want %q", got, want)
+	}
+	if err := g.Verify(ctx, p, 1*time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("Verify with the same failures as before the update: %v", err)
+	}
+
+	health.Store(noIPv4) // IPv4 broke, even though there is still internet
+	err = g.Verify(ctx, p, 50*time.Millisecond, 10*time.Millisecond)
+	if got, want := err, update.DegradedError("ping4/google.ch"); got != want {
+		t.Fatalf("Verify: got %v, want %v", got, want)
+	}
+}
+
+func TestBootedInto(t *testing.T) {
+	var health atomic.Value
+	health.Store(healthy)
+	srv := healthServer(&health)
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "updatetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	prepared := update.System{BootID: "1", Root: "/dev/mmcblk0p2"}
+	for _, tt := range []struct {
+		desc    string
+		sys     update.System
+		age     time.Duration
+		want    bool // booted into the update
+		cleared bool
+	}{
+		{"same boot", prepared, time.Minute, false, false},
+		{"same boot, expired", prepared, time.Hour, false, true},
+		{"reboot without update", update.System{BootID: "2", Root: "/dev/mmcblk0p2"}, time.Minute, false, true},
+		{"booted into update", update.System{BootID: "2", Root: "/dev/mmcblk0p3"}, time.Minute, true, false},
+		{"clock behind", update.System{BootID: "2", Root: "/dev/mmcblk0p3"}, -24 * time.Hour, true, false},
+		{"booted into update, expired", update.System{BootID: "2", Root: "/dev/mmcblk0p3"}, time.Hour, false, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			sys := prepared
+			g := &update.Guard{
+				Dir:       tmp,
+				HealthURL: srv.URL,
+				System:    func() (update.System, error) { return sys, nil },
+			}
+			if err := g.Prepare(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			sys = tt.sys
+			p, err := g.BootedInto(time.Now().Add(tt.age))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p != nil; got != tt.want {
+				t.Errorf("BootedInto: got %+v, want booted into update = %v", p, tt.want)
+			}
+			pending, err := g.Pending()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pending == nil; got != tt.cleared {
+				t.Errorf("Pending after BootedInto: got %+v, want cleared = %v", pending, tt.cleared)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webui
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Daemon is a router7 daemon which serves a status page.
+type Daemon struct {
+	Name  string // e.g. dhcp4d
+	Port  string
+	Title string // message ID of the navigation link
+}
+
+// Daemons are linked from the navigation bar of every status page.
+var Daemons = []Daemon{
+	{Name: "dhcp4d", Port: "8067", Title: "nav_leases"},
+	{Name: "diagd", Port: "7733", Title: "nav_diagnostics"},
+	{Name: "dnsd", Port: "8053", Title: "nav_dns"},
+	{Name: "fwlogd", Port: "8075", Title: "nav_firewall_log"},
+	{Name: "snid", Port: "8082", Title: "nav_activity"},
+}
+
+// Link is an entry of the navigation bar.
+type Link struct {
+	URL     string
+	Title   string // message ID
+	Current bool
+}
+
+// navigation returns the navigation bar of daemon’s page for r. All daemons
+// listen on the same addresses, so links use the host name of r. An
+// explicitly chosen language is retained.
+func navigation(r *http.Request, daemon string) []Link {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	var query string
+	if lang := r.FormValue("lang"); supported(lang) {
+		query = "?" + url.Values{"lang": []string{lang}}.Encode()
+	}
+	links := make([]Link, 0, len(Daemons))
+	for _, d := range Daemons {
+		links = append(links, Link{
+			URL:     "http://" + net.JoinHostPort(host, d.Port) + "/" + query,
+			Title:   d.Title,
+			Current: d.Name == daemon,
+		})
+	}
+	return links
+}
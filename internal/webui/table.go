@@ -0,0 +1,47 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webui
+
+import "fmt"
+
+// Table is a simple table, rendered by {{ template "table" . }}. Pages with
+// interactive tables (sorting, forms in cells) can use the same CSS instead.
+type Table struct {
+	Columns []string // message IDs of the column headers
+	Rows    [][]Cell
+	Empty   string // message ID displayed if there are no rows
+}
+
+// Cell is a table cell.
+type Cell struct {
+	Text  string
+	Class string // CSS class, e.g. “addr” for monospace addresses
+	Title string // tooltip
+}
+
+// Text returns a cell displaying v (formatted as with fmt.Sprint).
+func Text(v interface{}) Cell {
+	return Cell{Text: fmt.Sprint(v)}
+}
+
+// Addr returns a cell displaying the network address v in monospace.
+func Addr(v interface{}) Cell {
+	return Cell{Text: fmt.Sprint(v), Class: "addr"}
+}
+
+// Append adds a row.
+func (t *Table) Append(cells ...Cell) {
+	t.Rows = append(t.Rows, cells)
+}
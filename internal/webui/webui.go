@@ -0,0 +1,188 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webui renders the HTML status pages of the router7 daemons: a
+// shared layout with navigation between daemons, in the language preferred by
+// the browser (English or German), with a style sheet which follows the
+// browser’s light or dark color scheme.
+package webui
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed style.css
+var style string
+
+//go:embed layout.html.tmpl
+var layoutHTML string
+
+//go:embed lang/*.json
+var langFS embed.FS
+
+// Languages are the supported languages. The first one is the default and
+// must contain all messages.
+var Languages = []string{"en", "de"}
+
+// bundles maps language to message ID to message.
+var bundles = make(map[string]map[string]string)
+
+func init() {
+	for _, lang := range Languages {
+		b, err := langFS.ReadFile("lang/" + lang + ".json")
+		if err != nil {
+			panic(err)
+		}
+		var bundle map[string]string
+		if err := json.Unmarshal(b, &bundle); err != nil {
+			panic(fmt.Sprintf("lang/%s.json: %v", lang, err))
+		}
+		bundles[lang] = bundle
+	}
+}
+
+func supported(lang string) bool {
+	_, ok := bundles[lang]
+	return ok
+}
+
+// Language returns the language in which to respond to r: the lang parameter
+// (e.g. ?lang=de) takes precedence over the Accept-Language header.
+func Language(r *http.Request) string {
+	if lang := r.FormValue("lang"); supported(lang) {
+		return lang
+	}
+	return negotiate(r.Header.Get("Accept-Language"))
+}
+
+// negotiate returns the supported language with the highest quality value in
+// the Accept-Language header value accept, e.g. “de-CH,de;q=0.9,en;q=0.8”.
+func negotiate(accept string) string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// Only the primary language subtag matters, e.g. de-CH → de.
+		if idx := strings.IndexByte(tag, '-'); idx > -1 {
+			tag = tag[:idx]
+		}
+		prefs = append(prefs, weighted{tag, q})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if p.q > 0 && supported(p.lang) {
+			return p.lang
+		}
+	}
+	return Languages[0]
+}
+
+// Translate returns the message with the specified ID in lang, formatted with
+// args (as in fmt.Sprintf). Messages missing in lang fall back to the default
+// language, unknown IDs are returned verbatim.
+func Translate(lang, id string, args ...interface{}) string {
+	msg, ok := bundles[lang][id]
+	if !ok {
+		msg, ok = bundles[Languages[0]][id]
+	}
+	if !ok {
+		msg = id
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Template is a status page, rendered within the shared layout (head, style
+// sheet and navigation bar) in the language of each request. The page text
+// defines the templates “title” and “content” and optionally “style” (CSS
+// specific to the page). In addition to the functions passed to Parse, pages
+// can use:
+//
+//	{{ T "id" args… }}      translates the message id
+//	{{ lang }}               the language, e.g. for <html lang="…">
+//	{{ template "table" . }} renders a *Table
+type Template struct {
+	daemon string
+	tmpl   *template.Template
+}
+
+func builtins(lang string, nav []Link) template.FuncMap {
+	return template.FuncMap{
+		"T": func(id string, args ...interface{}) string {
+			return Translate(lang, id, args...)
+		},
+		"lang":  func() string { return lang },
+		"style": func() template.CSS { return template.CSS(style) },
+		"nav":   func() []Link { return nav },
+	}
+}
+
+// layout contains the templates shared by all pages.
+var layout = template.Must(template.New("").Funcs(builtins(Languages[0], nil)).Parse(layoutHTML))
+
+// Parse parses the page text of daemon (used to highlight its navigation
+// link), which may use funcs and the functions documented on Template.
+func Parse(daemon, text string, funcs template.FuncMap) (*Template, error) {
+	tmpl, err := template.Must(layout.Clone()).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{daemon: daemon, tmpl: tmpl}, nil
+}
+
+// Must panics if err is non-nil, for initializing package-level variables.
+func Must(t *Template, err error) *Template {
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Execute renders the page with data in the language of r.
+func (t *Template) Execute(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	lang := Language(r)
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	tmpl.Funcs(builtins(lang, navigation(r, t.daemon)))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	return tmpl.ExecuteTemplate(w, "layout", data)
+}
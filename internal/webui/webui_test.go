@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webui
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLanguage(t *testing.T) {
+	for _, tt := range []struct {
+		target string
+		accept string
+		want   string
+	}{
+		{"/", "", "en"},
+		{"/", "de-CH,de;q=0.9,en;q=0.8", "de"},
+		{"/", "fr,en;q=0.5,de;q=0.7", "de"},
+		{"/", "fr", "en"},
+		{"/", "de;q=0", "en"},
+		{"/?lang=en", "de", "en"},
+		{"/?lang=xx", "de", "de"},
+	} {
+		t.Run(tt.target+" "+tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Language", tt.accept)
+			}
+			if got := Language(r); got != tt.want {
+				t.Errorf("Language() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBundles(t *testing.T) {
+	for _, lang := range Languages[1:] {
+		for id := range bundles[lang] {
+			if _, ok := bundles[Languages[0]][id]; !ok {
+				t.Errorf("%s: message %q missing in %s", lang, id, Languages[0])
+			}
+		}
+		for id := range bundles[Languages[0]] {
+			if _, ok := bundles[lang][id]; !ok {
+				t.Logf("%s: message %q not translated", lang, id)
+			}
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	tmpl := Must(Parse("fwlogd", `{{ define "title" }}{{ T "fwlog_title" }}{{ end }}
+{{ define "content" }}{{ T "page_of" 1 2 .Total }} {{ T "no_such_message" }}
+{{ template "table" .Table }}{{ end }}`, nil))
+
+	table := &Table{
+		Columns: []string{"source", "count"},
+		Empty:   "no_events",
+	}
+	table.Append(Addr("192.0.2.1"), Text(42))
+	data := struct {
+		Total int
+		Table *Table
+	}{42, table}
+
+	for _, tt := range []struct {
+		lang string
+		want string
+	}{
+		{"en", `<html lang="en">`},
+		{"en", "<title>firewall log – router7</title>"},
+		{"en", "page 1 of 2 (42 leases)"},
+		{"en", "<th>Source</th>"},
+		{"en", `<td class="addr">192.0.2.1</td>`},
+		{"en", `<a href="http://router7:8067/?lang=en">Leases</a>`},
+		{"en", `<a href="http://router7:8075/?lang=en" class="current">Firewall log</a>`},
+		{"de", `<html lang="de">`},
+		{"de", "Seite 1 von 2 (42 Leases)"},
+		{"de", "<th>Quelle</th>"},
+		{"de", "prefers-color-scheme: dark"},
+		{"de", "no_such_message"},
+		// An explicitly chosen language is retained across daemons.
+		{"de", `<a href="http://router7:8082/?lang=de">Aktivität</a>`},
+	} {
+		r := httptest.NewRequest("GET", "http://router7:8075/?lang="+tt.lang, nil)
+		rec := httptest.NewRecorder()
+		if err := tmpl.Execute(rec, r, data); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Content-Language"); got != tt.lang {
+			t.Errorf("Content-Language = %q, want %q", got, tt.lang)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, tt.want) {
+			t.Errorf("%s: body does not contain %q:\n%s", tt.lang, tt.want, body)
+		}
+	}
+}
+
+func TestEmptyTable(t *testing.T) {
+	tmpl := Must(Parse("", `{{ define "title" }}{{ end }}{{ define "content" }}{{ template "table" . }}{{ end }}`, nil))
+	rec := httptest.NewRecorder()
+	if err := tmpl.Execute(rec, httptest.NewRequest("GET", "/?lang=de", nil), &Table{
+		Columns: []string{"source", "count"},
+		Empty:   "no_events",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<td colspan="2">keine Ereignisse</td>`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("body does not contain %q:\n%s", want, rec.Body.String())
+	}
+}